@@ -0,0 +1,106 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+var benchCommand = &Command{
+	Name:  "bench",
+	Short: "Measure the restore throughput of a server by thread count, on synthetic data",
+	Usage: "-h [HOST] -u [USER] [-rows N] [-row-width BYTES] [-threads 1,2,4,8,16]",
+	Run:   runBench,
+}
+
+// benchFlags are the flags of the bench command.
+type benchFlags struct {
+	conn      connFlags
+	db        string
+	rows      int
+	rowWidth  int
+	chunksize int
+	stmtSize  int
+	threads   string
+}
+
+func (f *benchFlags) register(fs *flag.FlagSet) {
+	f.conn.register(fs, "", "benchmark, it creates and drops the -db")
+	fs.StringVar(&f.db, "db", "go_mydumper_bench", "Scratch database of the runs, it must not exist: every run creates it and drops it")
+	fs.IntVar(&f.rows, "rows", 1000000, "Number of rows of the synthetic table, generated in memory once for all the runs")
+	fs.IntVar(&f.rowWidth, "row-width", 200, "Bytes of the varbinary column of a row of the synthetic table, at most 60000")
+	fs.IntVar(&f.chunksize, "F", 8, "Split the synthetic table into data files of this size, in MB")
+	fs.IntVar(&f.stmtSize, "s", 1000000, "Attempted size of INSERT statement in bytes")
+	fs.StringVar(&f.threads, "threads", "1,2,4,8,16", "Comma separated thread counts, a restore of the synthetic data is run with each in order")
+}
+
+// args builds the BenchArgs of the flags.
+func (f *benchFlags) args(log *xlog.Log) (*common.BenchArgs, error) {
+	threads, err := parseThreads(f.threads)
+	if err != nil {
+		return nil, err
+	}
+	passwd, err := f.conn.password(log)
+	if err != nil {
+		return nil, err
+	}
+	return &common.BenchArgs{
+		User:          f.conn.user,
+		Password:      passwd,
+		Address:       f.conn.address(),
+		Database:      f.db,
+		Rows:          f.rows,
+		RowWidth:      f.rowWidth,
+		ChunksizeInMB: f.chunksize,
+		StmtSize:      f.stmtSize,
+		Threads:       threads,
+		IntervalMs:    10 * 1000,
+	}, nil
+}
+
+// parseThreads parses the comma separated thread counts of -threads.
+func parseThreads(s string) ([]int, error) {
+	var threads []int
+	for _, part := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("threads %q must be comma separated numbers", s)
+		}
+		threads = append(threads, n)
+	}
+	return threads, nil
+}
+
+func runBench(s *session, argv []string) error {
+	f := &benchFlags{}
+	f.register(s.fs)
+	if err := s.parse(argv, f.conn.missing); err != nil {
+		return err
+	}
+
+	args, err := f.args(s.log)
+	if err != nil {
+		return usageError(err)
+	}
+	if err := args.Validate(); err != nil {
+		return err
+	}
+	report, err := common.NewBencher(common.BenchConfig{BenchArgs: *args, Log: s.log}).Run(s.ctx)
+	if len(report.Runs) > 0 {
+		report.WriteTable(Output)
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+)
+
+var checkCommand = &Command{
+	Name:  "check",
+	Short: "Read every file of a dump directory and check it restores, without connecting to a server",
+	Usage: "-d [DIR] [-t THREADS] [-max-memory BYTES]",
+	Run:   runCheck,
+}
+
+func runCheck(s *session, argv []string) error {
+	args := common.CheckArgs{}
+	s.fs.StringVar(&args.Dir, "d", "", "Directory of the dump to check")
+	s.fs.IntVar(&args.Threads, "t", 16, "Number of files checked at once")
+	s.fs.Int64Var(&args.MaxMemory, "max-memory", 256*1024*1024, "Bound the bytes of the files read at once, 0 for no bound")
+	missing := func() []string {
+		if args.Dir == "" {
+			return []string{"-d"}
+		}
+		return nil
+	}
+	if err := s.parse(argv, missing); err != nil {
+		return err
+	}
+	report, err := common.CheckDump(s.ctx, s.log, args)
+	if report != nil {
+		report.WriteReport(Output)
+	}
+	return err
+}
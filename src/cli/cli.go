@@ -0,0 +1,257 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// Command is a subcommand of the go-mydumper binary, each has its own flag set.
+type Command struct {
+	Name  string
+	Short string
+	Usage string
+	Run   func(s *session, argv []string) error
+}
+
+// Commands are all the subcommands in the order of the help text.
+var Commands = []*Command{
+	dumpCommand,
+	loadCommand,
+	verifyCommand,
+	checkCommand,
+	pruneCommand,
+	migrateCommand,
+	benchCommand,
+}
+
+// The exit codes of a command which failed, by the common.ErrorCategory of
+// its error, see exitCode.
+const (
+	// ExitFailure is any other error.
+	ExitFailure = 1
+	// ExitUsage is an unknown command, flags which don't parse or arguments
+	// which don't validate.
+	ExitUsage = 2
+	// ExitPartial is a run stopped by its -max-runtime: what it did is kept,
+	// the same command with -resume goes on.
+	ExitPartial = 3
+	// ExitConnection is a server which can't be reached or went away.
+	ExitConnection = 4
+	// ExitPrivilege is a statement the user isn't allowed to run, or a
+	// write refused by a read-only server.
+	ExitPrivilege = 5
+	// ExitStorage is a file of the dump which can't be read or written, like
+	// a full disk, or a server out of disk space.
+	ExitStorage = 6
+	// ExitData is a statement the server refused, like a duplicate key.
+	ExitData = 7
+	// ExitCancelled is a run stopped by SIGINT or SIGTERM.
+	ExitCancelled = 8
+)
+
+// Output is where usage and errors are printed, and the table of bench.
+var Output io.Writer = os.Stderr
+
+// Input is where the confirmations are read, like the one of load -rollback.
+var Input io.Reader = os.Stdin
+
+// Main runs the subcommand named by argv[0] and returns the process exit code.
+func Main(log *xlog.Log, prog string, argv []string) int {
+	if len(argv) == 0 || argv[0] == "help" || argv[0] == "-h" || argv[0] == "--help" {
+		usage(prog)
+		return 0
+	}
+	if argv[0] == "version" || argv[0] == "-version" || argv[0] == "--version" {
+		fmt.Fprintln(Output, common.VersionString())
+		return 0
+	}
+
+	for _, cmd := range Commands {
+		if cmd.Name != argv[0] {
+			continue
+		}
+		return run(log, prog, cmd, argv[1:])
+	}
+	fmt.Fprintf(Output, "%s: unknown command %q\n", prog, argv[0])
+	usage(prog)
+	return ExitUsage
+}
+
+// run runs the command in a session, the session log is closed on any exit path
+// and a panic is written to the log file before it goes on to stderr.
+func run(log *xlog.Log, prog string, cmd *Command, argv []string) int {
+	s := newSession(log, prog, cmd)
+	defer s.close()
+	ctx, stop := signalContext(s)
+	defer stop()
+	s.ctx = ctx
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Error("%s.%s.panic:%v\n%s", prog, cmd.Name, r, debug.Stack())
+			s.close()
+			panic(r)
+		}
+	}()
+
+	if err := cmd.Run(s, argv); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		if s.file != nil {
+			s.log.Error("%s.%s.error:%v", prog, cmd.Name, err)
+		}
+		fmt.Fprintf(Output, "%s %s: %v\n", prog, cmd.Name, err)
+		return exitCode(err)
+	}
+	return 0
+}
+
+// exitCode returns the exit code of the error of a command by its category.
+func exitCode(err error) int {
+	switch common.ErrorCategoryOf(err) {
+	case common.CategoryInvalid:
+		return ExitUsage
+	case common.CategoryPartial:
+		return ExitPartial
+	case common.CategoryConnection:
+		return ExitConnection
+	case common.CategoryPrivilege:
+		return ExitPrivilege
+	case common.CategoryStorage:
+		return ExitStorage
+	case common.CategoryData:
+		return ExitData
+	case common.CategoryCancelled:
+		return ExitCancelled
+	}
+	return ExitFailure
+}
+
+// usageError returns err as a common.CategoryInvalid error unless it has a
+// category of its own, like a log file which can't be opened.
+func usageError(err error) error {
+	if err == nil || err == flag.ErrHelp || common.ErrorCategoryOf(err) != common.CategoryOther {
+		return err
+	}
+	return &common.CategorizedError{Category: common.CategoryInvalid, Err: err}
+}
+
+// signalContext returns a context cancelled by the first SIGINT or SIGTERM,
+// the run then stops cleanly and writes its summary. The signals are handed
+// back to the default handler at once, so a second one kills the process.
+// The returned func stops the handling.
+func signalContext(s *session) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			s.log.Warning("signal[%v].cancelling.the.run, send it again to exit at once", sig)
+			cancel()
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+func usage(prog string) {
+	fmt.Fprintf(Output, "Usage: %s <command> [flags]\n\nCommands:\n", prog)
+	for _, cmd := range Commands {
+		fmt.Fprintf(Output, "  %-8s %s\n", cmd.Name, cmd.Short)
+	}
+	fmt.Fprintf(Output, "  %-8s %s\n", "version", "Print the version and the build metadata")
+	fmt.Fprintf(Output, "\nRun '%s <command> -help' for the flags of a command.\n", prog)
+}
+
+// connFlags are the connection flags shared by the subcommands.
+type connFlags struct {
+	prefix     string
+	user       string
+	passwd     string
+	passwdFile string
+	askPasswd  bool
+	host       string
+	port       int
+}
+
+// register adds the connection flags to fs, all names are prefixed with prefix.
+func (c *connFlags) register(fs *flag.FlagSet, prefix string, what string) {
+	c.prefix = prefix
+	fs.StringVar(&c.user, prefix+"u", "", "Username with privileges to run the "+what)
+	fs.StringVar(&c.passwd, prefix+"p", "", "User password (prefer -"+prefix+"password-file, -"+prefix+"ask-password or the GO_MYDUMPER_PASSWORD/MYSQL_PWD env)")
+	fs.StringVar(&c.passwdFile, prefix+"password-file", "", "Read the password from the first line of this file (must be mode 0600)")
+	fs.BoolVar(&c.askPasswd, prefix+"ask-password", false, "Prompt for the password if stdin is a terminal")
+	fs.StringVar(&c.host, prefix+"h", "", "The host to connect to, as host, host:port, [v6::addr]:port or a bare IPv6 address; a restore takes a comma separated list like db1,db2:3307 tried in order when the server goes away")
+	fs.IntVar(&c.port, prefix+"P", common.DefaultPort, "TCP/IP port of the hosts given without one")
+}
+
+// missing returns the names of the required connection flags which are not set.
+func (c *connFlags) missing() []string {
+	var missing []string
+	if c.host == "" {
+		missing = append(missing, "-"+c.prefix+"h")
+	}
+	if c.user == "" {
+		missing = append(missing, "-"+c.prefix+"u")
+	}
+	return missing
+}
+
+// address returns the host:port of the host, or the comma separated list of
+// them for a list of hosts: a host without a port, like a bare IPv6 address,
+// gets the one of -P, see common.ParseAddress. A host which doesn't parse is
+// kept as it is, for the Validate of the args to report it.
+func (c *connFlags) address() string {
+	hosts := strings.Split(c.host, ",")
+	for i, host := range hosts {
+		host = strings.TrimSpace(host)
+		if address, err := common.ParseAddress(host, c.port); err == nil {
+			host = address
+		}
+		hosts[i] = host
+	}
+	return strings.Join(hosts, ",")
+}
+
+// password resolves the password from all the sources, only the source is logged.
+func (c *connFlags) password(log *xlog.Log) (string, error) {
+	passwd, source, err := common.ResolvePassword(&common.PasswordOptions{
+		Flag: c.passwd,
+		File: c.passwdFile,
+		Ask:  c.askPasswd,
+	})
+	if err != nil {
+		return "", err
+	}
+	if passwd == "" {
+		return "", fmt.Errorf("no password given, use -%sp, -%spassword-file, -%sask-password or the %s env", c.prefix, c.prefix, c.prefix, common.PasswordEnv)
+	}
+	log.Info("%spassword.source[%s]", c.prefix, source)
+	return passwd, nil
+}
@@ -0,0 +1,992 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"bytes"
+	"common"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCliMain(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+
+	// Help.
+	{
+		out.Reset()
+		assert.Equal(t, 0, Main(log, "go-mydumper", nil))
+		for _, cmd := range []string{"dump", "load", "verify", "check", "prune", "migrate", "bench"} {
+			assert.True(t, strings.Contains(out.String(), cmd))
+		}
+	}
+
+	// Version.
+	{
+		out.Reset()
+		assert.Equal(t, 0, Main(log, "go-mydumper", []string{"--version"}))
+		assert.True(t, strings.Contains(out.String(), common.VersionString()))
+
+		out.Reset()
+		assert.Equal(t, 0, Main(log, "go-mydumper", []string{"dump", "-version"}))
+		assert.True(t, strings.Contains(out.String(), common.Version))
+	}
+
+	// Unknown command.
+	{
+		out.Reset()
+		assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"backup"}))
+		assert.True(t, strings.Contains(out.String(), `unknown command "backup"`))
+	}
+
+	// Per command help.
+	{
+		out.Reset()
+		assert.Equal(t, 0, Main(log, "go-mydumper", []string{"load", "-help"}))
+		assert.True(t, strings.Contains(out.String(), "txn-batch-size"))
+		assert.False(t, strings.Contains(out.String(), "-db"))
+	}
+
+	// Missing flags.
+	{
+		out.Reset()
+		assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"dump", "-h", "127.0.0.1"}))
+		assert.True(t, strings.Contains(out.String(), "missing required flags: -u, -db, -o"))
+	}
+
+	// Dump flags are not load flags.
+	{
+		out.Reset()
+		assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"load", "-db", "test"}))
+		assert.True(t, strings.Contains(out.String(), "flag provided but not defined: -db"))
+	}
+
+	// Migrate target flags.
+	{
+		out.Reset()
+		assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"migrate", "-h", "a", "-u", "b", "-db", "c", "-o", "d"}))
+		assert.True(t, strings.Contains(out.String(), "missing required flags: -to-h, -to-u"))
+	}
+
+	// Table threads are db.table=N.
+	{
+		out.Reset()
+		assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"load", "-table-threads", "test.t1"}))
+		assert.True(t, strings.Contains(out.String(), `table threads "test.t1" must be db.table=N`))
+
+		var f tableThreadsFlag
+		assert.Nil(t, f.Set("test.t1=1"))
+		assert.Nil(t, f.Set("test.t2=8"))
+		assert.Equal(t, "test.t1=1,test.t2=8", f.String())
+	}
+
+	// A migrate through the pipe has no work directory.
+	{
+		out.Reset()
+		assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"migrate", "-pipe", "-h", "a", "-u", "b", "-db", "c"}))
+		assert.True(t, strings.Contains(out.String(), "missing required flags: -to-h, -to-u"))
+	}
+
+	// A rollback needs no dump and drops nothing unless confirmed.
+	{
+		out.Reset()
+		path := "/tmp/clirollback.sql"
+		x := common.WriteFile(path, "SET FOREIGN_KEY_CHECKS=0;\nDROP DATABASE IF EXISTS `test`;\nDROP TABLE IF EXISTS `test`.`t1`;\n")
+		common.AssertNil(x)
+		Input = strings.NewReader("no\n")
+		defer func() { Input = os.Stdin }()
+		assert.Equal(t, 1, Main(log, "go-mydumper", []string{"load", "-rollback", path, "-h", "127.0.0.1", "-u", "root", "-p", "mock"}))
+		assert.True(t, strings.Contains(out.String(), "  DROP TABLE IF EXISTS `test`.`t1`\n  DROP DATABASE IF EXISTS `test`\n"))
+		assert.True(t, strings.Contains(out.String(), "rollback cancelled, nothing dropped"))
+	}
+}
+
+func TestCliVerify(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+
+	dir := "/tmp/cliverifytest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	common.AssertNil(x)
+	x = common.WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	common.AssertNil(x)
+
+	assert.Equal(t, 0, Main(log, "go-mydumper", []string{"verify", "-d", dir}))
+
+	x = common.WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+	common.AssertNil(x)
+	assert.Equal(t, 1, Main(log, "go-mydumper", []string{"verify", "-d", dir}))
+}
+
+func TestCliVerifySchema(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+
+	// The connection flags are required with -verify-schema only.
+	assert.NotEqual(t, 0, Main(log, "go-mydumper", []string{"verify", "-d", "/tmp/cliverifyschema", "-verify-schema"}))
+	assert.Contains(t, out.String(), "-h")
+
+	// The rename flags of the load are accepted.
+	out.Reset()
+	assert.NotEqual(t, 0, Main(log, "go-mydumper", []string{"verify", "-d", "/tmp/cliverifyschema", "-table-prefix", "new_", "-table-suffix", "_v2"}))
+	assert.NotContains(t, out.String(), "flag provided but not defined")
+
+	for _, tc := range []struct {
+		args   []string
+		verify bool
+	}{
+		{[]string{"-p", "mock"}, false},
+		{[]string{"-p", "mock", "-verify-schema"}, true},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.verify, args.VerifySchema)
+	}
+}
+
+func TestCliCheck(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+
+	dir := "/tmp/clichecktest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	common.AssertNil(x)
+	x = common.WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	common.AssertNil(x)
+	x = common.WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int(11));\n")
+	common.AssertNil(x)
+	x = common.WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+	common.AssertNil(x)
+	x = common.WriteFile(dir+"/metadata", "Started dump at: 2017-10-13 10:11:12\n")
+	common.AssertNil(x)
+
+	assert.Equal(t, 0, Main(log, "go-mydumper", []string{"check", "-d", dir, "-t", "4"}))
+	assert.True(t, strings.HasPrefix(out.String(), "check ok: files 3,"))
+
+	// A data file cut short.
+	out.Reset()
+	x = common.WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`a`) VALUES\n(1")
+	common.AssertNil(x)
+	assert.Equal(t, ExitStorage, Main(log, "go-mydumper", []string{"check", "-d", dir}))
+	assert.True(t, strings.Contains(out.String(), "  file test.t1.00001.sql ends in the middle of a statement at byte 0\n"))
+	assert.True(t, strings.Contains(out.String(), "go-mydumper check: check.dir[/tmp/clichecktest].failed.problems[1]"))
+}
+
+func TestCliPrune(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+
+	dir := "/tmp/cliprunetest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir+"/old", 0777)
+	common.AssertNil(x)
+	x = common.WriteFile(dir+"/old/manifest.json", `{"version":"1.0.0","tables":[],"expires_at":"2020-01-01T00:00:00Z"}`)
+	common.AssertNil(x)
+
+	// A dry run without -confirm.
+	assert.Equal(t, 0, Main(log, "go-mydumper", []string{"prune", "-d", dir}))
+	assert.True(t, strings.HasPrefix(out.String(), "prune dry-run: runs 1, expired 1, deleted 0,"))
+	_, err := os.Stat(dir + "/old/manifest.json")
+	assert.Nil(t, err)
+
+	out.Reset()
+	assert.Equal(t, 0, Main(log, "go-mydumper", []string{"prune", "-d", dir, "-confirm"}))
+	assert.True(t, strings.HasPrefix(out.String(), "prune confirmed: runs 1, expired 0, deleted 1,"))
+	_, err = os.Stat(dir + "/old")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCliRetention(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args      []string
+		retention time.Duration
+	}{
+		{[]string{"-p", "mock"}, 0},
+		{[]string{"-p", "mock", "-retention", "30d"}, 30 * 24 * time.Hour},
+		{[]string{"-p", "mock", "-retention", "12h"}, 12 * time.Hour},
+	} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.retention, args.Retention)
+	}
+
+	f := &dumpFlags{}
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	fs.SetOutput(&bytes.Buffer{})
+	f.register(fs)
+	assert.NotNil(t, fs.Parse([]string{"-retention", "a month"}))
+}
+
+func TestCliLog(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+
+	dir := "/tmp/clilogtest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	common.AssertNil(x)
+	x = common.WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	common.AssertNil(x)
+	file := dir + "/run.log"
+
+	// Warn level hides the info lines.
+	{
+		assert.Equal(t, 0, Main(log, "go-mydumper", []string{"verify", "-d", dir, "-log-level", "warn", "-log-file", file}))
+		data, err := common.ReadFile(file)
+		assert.Nil(t, err)
+		assert.False(t, strings.Contains(string(data), "verify.dir"))
+	}
+
+	// Append at info level, errors go to the file and stderr.
+	{
+		x = common.WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+		common.AssertNil(x)
+		out.Reset()
+		assert.Equal(t, 1, Main(log, "go-mydumper", []string{"verify", "-d", dir, "-log-file", file}))
+		data, err := common.ReadFile(file)
+		assert.Nil(t, err)
+		assert.True(t, strings.Contains(string(data), "verify.dir"))
+		assert.True(t, strings.Contains(string(data), "go-mydumper.verify.error"))
+		assert.True(t, strings.Contains(out.String(), "has no schema file"))
+	}
+
+	// Bad level.
+	{
+		out.Reset()
+		assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"verify", "-d", dir, "-log-level", "trace"}))
+		assert.True(t, strings.Contains(out.String(), `unknown log level "trace"`))
+	}
+
+	// JSON lines.
+	{
+		os.Remove(file)
+		assert.Equal(t, 1, Main(log, "go-mydumper", []string{"verify", "-d", dir, "-log-file", file, "-log-format", "json"}))
+		data, err := common.ReadFile(file)
+		assert.Nil(t, err)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			assert.True(t, strings.HasPrefix(line, `{"ts":`), line)
+			assert.True(t, strings.Contains(line, `"run_id":`), line)
+		}
+		assert.True(t, strings.Contains(string(data), `"level":"error"`))
+	}
+}
+
+func TestCliAddress(t *testing.T) {
+	c := &connFlags{host: "127.0.0.1", port: 3306}
+	assert.Equal(t, "127.0.0.1:3306", c.address())
+
+	// The hosts of an HA pair, with the port of -P or their own.
+	c = &connFlags{host: "db1, db2:3307,::1", port: 3308}
+	assert.Equal(t, "db1:3308,db2:3307,[::1]:3308", c.address())
+
+	// A bracketed IPv6 address, with a port or the one of -P.
+	c = &connFlags{host: "[fe80::1]:3310,[::1]", port: 3308}
+	assert.Equal(t, "[fe80::1]:3310,[::1]:3308", c.address())
+
+	// The ones which don't parse are left for Validate to report.
+	c = &connFlags{host: "db1:mysql", port: 3308}
+	assert.Equal(t, "db1:mysql", c.address())
+}
+
+func TestCliTuneTarget(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"-tune-target"}, common.TuneTargetOn},
+		{[]string{"-tune-target=dry-run"}, common.TuneTargetDryRun},
+		{[]string{"-tune-target=false"}, ""},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		assert.Equal(t, tc.want, string(f.tune))
+	}
+}
+
+func TestCliLock(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args  []string
+		lock  bool
+		force bool
+	}{
+		{[]string{"-p", "mock"}, false, false},
+		{[]string{"-p", "mock", "-lock"}, true, false},
+		{[]string{"-p", "mock", "-lock", "-force"}, true, true},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.lock, args.Lock)
+		assert.Equal(t, tc.force, args.ForceLock)
+	}
+}
+
+func TestCliSchemaChanges(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args    []string
+		check   bool
+		retries int
+	}{
+		{[]string{"-p", "mock"}, true, 2},
+		{[]string{"-p", "mock", "-schema-change-retries", "0"}, true, 0},
+		{[]string{"-p", "mock", "-check-schema-changes=false"}, false, 2},
+	} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.check, args.CheckSchemaChanges)
+		assert.Equal(t, tc.retries, args.SchemaChangeRetries)
+	}
+}
+
+func TestCliFileTrailers(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	{
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse([]string{"-p", "mock", "-file-trailers"}))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.True(t, args.FileTrailers)
+	}
+	for _, tc := range []struct {
+		args   []string
+		verify bool
+	}{
+		{[]string{"-p", "mock"}, false},
+		{[]string{"-p", "mock", "-verify-file-trailers"}, true},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.verify, args.VerifyFileTrailers)
+	}
+}
+
+func TestCliSkipEmptyFiles(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args []string
+		skip bool
+	}{
+		{[]string{"-p", "mock"}, false},
+		{[]string{"-p", "mock", "-skip-empty-files"}, true},
+	} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.skip, args.SkipEmptyFiles)
+	}
+}
+
+func TestCliSmokeTest(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	{
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse([]string{"-p", "mock", "-smoke-test"}))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.True(t, args.SmokeTest)
+	}
+	{
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse([]string{"-p", "mock", "-allow-smoke"}))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.True(t, args.AllowSmoke)
+	}
+}
+
+func TestCliChunkRows(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	f := &dumpFlags{}
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	f.register(fs)
+	assert.Nil(t, fs.Parse([]string{"-p", "mock", "-chunk-rows", "500000"}))
+	args, err := f.args(log)
+	assert.Nil(t, err)
+	assert.Equal(t, 500000, args.ChunkRows)
+}
+
+func TestCliPhaseThreads(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	f := &loadFlags{}
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	f.register(fs)
+	assert.Nil(t, fs.Parse([]string{"-p", "mock", "-schema-threads", "2", "-data-threads", "32", "-post-threads", "8"}))
+	args, err := f.args(log)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, args.SchemaThreads)
+	assert.Equal(t, 32, args.DataThreads)
+	assert.Equal(t, 8, args.PostThreads)
+
+	// -t alone caps every phase, an explicit -schema-threads goes past it.
+	for _, tc := range []struct {
+		args   []string
+		schema int
+	}{
+		{[]string{"-p", "mock"}, 4},
+		{[]string{"-p", "mock", "-t", "2"}, 2},
+		{[]string{"-p", "mock", "-t", "2", "-schema-threads", "3"}, 3},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.schema, args.SchemaThreads, "%v", tc.args)
+	}
+}
+
+func TestCliLockMode(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args []string
+		mode string
+	}{
+		{[]string{"-p", "mock"}, common.LockModeAuto},
+		{[]string{"-p", "mock", "-consistency", "lock", "-lock-mode", "backup-lock"}, common.LockModeBackup},
+		{[]string{"-p", "mock", "-consistency", "lock", "-lock-mode", "none"}, common.LockModeNone},
+	} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.mode, args.LockMode)
+	}
+}
+
+func TestCliClean(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args  []string
+		clean bool
+	}{
+		{[]string{"-p", "mock"}, false},
+		{[]string{"-p", "mock", "-clean"}, true},
+	} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.clean, args.Clean)
+	}
+}
+
+func TestCliIncremental(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	{
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		f.register(fs)
+		err := fs.Parse([]string{"-p", "mock", "-incremental-from", "/backups/full", "-incremental-column", "test.orders:updated_at", "-incremental-column", "test.items: modified"})
+		assert.Nil(t, err)
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, "/backups/full", args.IncrementalFrom)
+		assert.Equal(t, map[string]string{"test.orders": "updated_at", "test.items": "modified"}, args.IncrementalColumns)
+	}
+
+	for _, bad := range [][]string{{"-incremental-column", "test.orders"}, {"-incremental-column", ":updated_at"}, {"-incremental-column", "test.orders:a", "-incremental-column", "test.orders:b"}} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		f.register(fs)
+		assert.NotNil(t, fs.Parse(bad), bad)
+	}
+
+	{
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		f.register(fs)
+		err := fs.Parse([]string{"-p", "mock", "-d", "/backups/full", "-incremental", "/backups/inc1", "-incremental", "/backups/inc2"})
+		assert.Nil(t, err)
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"/backups/inc1", "/backups/inc2"}, args.Incrementals)
+	}
+}
+
+func TestCliOptimizeAfterLoad(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args    []string
+		tables  []string
+		threads int
+	}{
+		{[]string{"-p", "mock"}, nil, 1},
+		{[]string{"-p", "mock", "-optimize-after-load", "db.t1,db.t2", "-optimize-threads", "2"}, []string{"db.t1", "db.t2"}, 2},
+		{[]string{"-p", "mock", "-optimize-after-load=all"}, []string{common.OptimizeAll}, 1},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.tables, args.OptimizeTables)
+		assert.Equal(t, tc.threads, args.OptimizeThreads)
+	}
+}
+
+func TestCliPostSQL(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args      []string
+		scripts   []string
+		onFailure []string
+		db        string
+	}{
+		{[]string{"-p", "mock"}, nil, nil, ""},
+		{[]string{"-p", "mock", "-post-sql", "a.sql", "-post-sql", "b.sql", "-post-sql-database", "app"}, []string{"a.sql", "b.sql"}, nil, "app"},
+		{[]string{"-p", "mock", "-post-sql-on-failure", "alert.sql"}, nil, []string{"alert.sql"}, ""},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.scripts, args.PostSQL)
+		assert.Equal(t, tc.onFailure, args.PostSQLOnFailure)
+		assert.Equal(t, tc.db, args.PostSQLDatabase)
+	}
+}
+
+func TestCliFillMissingColumns(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args   []string
+		fill   bool
+		values map[string]string
+	}{
+		{[]string{"-p", "mock"}, false, nil},
+		{[]string{"-p", "mock", "-fill-missing-columns", "-fill-value", "DATETIME='2000-01-01 00:00:00'", "-fill-value", "json='[]'"}, true,
+			map[string]string{"datetime": "'2000-01-01 00:00:00'", "json": "'[]'"}},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(tc.args))
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.fill, args.FillMissingColumns)
+		assert.Equal(t, tc.values, args.FillValues)
+	}
+
+	f := &loadFlags{}
+	fs := flag.NewFlagSet("load", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	f.register(fs)
+	assert.NotNil(t, fs.Parse([]string{"-fill-value", "datetime"}))
+}
+
+func TestCliReplicaLagCheck(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		check   string
+		address string
+		max     int
+		err     bool
+	}{
+		{"", "", 0, false},
+		{"10.0.0.3:3306,30", "10.0.0.3:3306", 30, false},
+		{"[::1]:3306,5", "[::1]:3306", 5, false},
+		{"10.0.0.3:3306", "", 0, true},
+		{"10.0.0.3:3306,0", "", 0, true},
+		{"10.0.0.3:3306,30s", "", 0, true},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse([]string{"-p", "mock", "-replica-lag-check", tc.check, "-max-transaction-time", "500"}))
+		args, err := f.args(log)
+		if tc.err {
+			assert.NotNil(t, err, tc.check)
+			continue
+		}
+		assert.Nil(t, err, tc.check)
+		assert.Equal(t, tc.address, args.ReplicaLagAddress)
+		assert.Equal(t, tc.max, args.MaxReplicaLag)
+		assert.Equal(t, 500, args.TxnMaxTimeMs)
+	}
+}
+
+func TestCliFileMode(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args  []string
+		file  os.FileMode
+		dir   os.FileMode
+		chown string
+		err   bool
+	}{
+		{nil, 0, 0, "", false},
+		{[]string{"-file-mode", "0640", "-dir-mode", "750", "-chown", "34:34"}, 0640, 0750, "34:34", false},
+		{[]string{"-file-mode", "0690"}, 0, 0, "", true},
+		{[]string{"-dir-mode", "rwx"}, 0, 0, "", true},
+	} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		f.register(fs)
+		err := fs.Parse(append([]string{"-p", "mock"}, tc.args...))
+		if tc.err {
+			assert.NotNil(t, err, tc.args)
+			continue
+		}
+		assert.Nil(t, err, tc.args)
+		args, err := f.args(log)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.file, args.FileMode)
+		assert.Equal(t, tc.dir, args.DirMode)
+		assert.Equal(t, tc.chown, args.Chown)
+	}
+}
+
+func TestCliSubsetSeed(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	f := &dumpFlags{}
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	f.register(fs)
+	err := fs.Parse([]string{"-p", "mock", "-subset-seed", "test.customers:id IN (1,2)", "-subset-seed", "test.customers:email LIKE '%@example.com'",
+		"-subset-seed", "test.orders:created > '2024-01-01'", "-subset-max-rows", "100000"})
+	assert.Nil(t, err)
+	args, err := f.args(log)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"test.customers": "(id IN (1,2)) OR (email LIKE '%@example.com')",
+		"test.orders":    "created > '2024-01-01'",
+	}, args.SubsetSeeds)
+	assert.Equal(t, 100000, args.SubsetMaxRows)
+
+	for _, bad := range []string{"test.customers", "test.customers: ", ":id = 1"} {
+		f := &dumpFlags{}
+		fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		f.register(fs)
+		assert.NotNil(t, fs.Parse([]string{"-subset-seed", bad}), bad)
+	}
+}
+
+func TestCliTargets(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		args      []string
+		address   string
+		targets   []string
+		placement string
+		err       bool
+	}{
+		{[]string{"-h", "10.0.0.1"}, "10.0.0.1:3306", nil, "", false},
+		{[]string{"-targets", "10.0.0.1, 10.0.0.2:3307,10.0.0.3"}, "10.0.0.1:3306", []string{"10.0.0.2:3307", "10.0.0.3:3306"}, common.PlacementRoundRobin, false},
+		{[]string{"-targets", "10.0.0.1,10.0.0.2", "-placement", "file", "-placement-file", "placement.txt"}, "10.0.0.1:3306", []string{"10.0.0.2:3306"}, common.PlacementFile, false},
+		{[]string{"-targets", "10.0.0.1"}, "", nil, "", true},
+		{[]string{"-targets", "10.0.0.1,10.0.0.1:3306"}, "", nil, "", true},
+		{[]string{"-targets", "10.0.0.1,10.0.0.2", "-h", "10.0.0.3"}, "", nil, "", true},
+	} {
+		f := &loadFlags{}
+		fs := flag.NewFlagSet("load", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse(append([]string{"-u", "mock", "-p", "mock", "-d", "/tmp"}, tc.args...)))
+		assert.Nil(t, f.missing(), tc.args)
+		args, err := f.args(log)
+		if tc.err {
+			assert.NotNil(t, err, tc.args)
+			continue
+		}
+		assert.Nil(t, err, tc.args)
+		assert.Equal(t, tc.address, args.Address)
+		var targets []string
+		for name, target := range args.Targets {
+			assert.Equal(t, name, target.Address)
+			assert.Equal(t, "mock", target.Password)
+			targets = append(targets, name)
+		}
+		sort.Strings(targets)
+		assert.Equal(t, tc.targets, targets)
+		assert.Equal(t, tc.placement, args.Placement)
+	}
+}
+
+func TestCliProfile(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	config := "/tmp/cliprofile.conf"
+	x := ioutil.WriteFile(config, []byte(`# The profiles of the team.
+[nightly]
+extends = replica-seed
+t = 8
+o = /backup/nightly
+
+[nightly-checked]
+extends = nightly
+checksum = true
+
+[masked]
+command = load
+requires = replace, d
+replace = @corp.com=@example.com
+replace = secret=xxx
+
+[loop1]
+extends = loop2
+[loop2]
+extends = loop1
+`), 0644)
+	assert.Nil(t, x)
+	defer os.Remove(config)
+
+	dump := func(argv ...string) (*dumpFlags, error) {
+		s := newSession(log, "go-mydumper", dumpCommand)
+		f := &dumpFlags{}
+		f.register(s.fs)
+		return f, s.parse(argv, f.missing)
+	}
+	load := func(argv ...string) (*loadFlags, error) {
+		s := newSession(log, "go-mydumper", loadCommand)
+		f := &loadFlags{}
+		f.register(s.fs)
+		return f, s.parse(argv, f.missing)
+	}
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+
+	// A built-in profile, the flags given win.
+	{
+		f, err := dump("-profile", "replica-seed", "-h", "db1", "-u", "root", "-db", "shop", "-o", "/backup")
+		assert.Nil(t, err)
+		assert.Equal(t, common.ConsistencyLock, f.consistent)
+		f, err = dump("-profile", "replica-seed", "-consistency", "gtid", "-h", "db1", "-u", "root", "-db", "shop", "-o", "/backup")
+		assert.Nil(t, err)
+		assert.Equal(t, common.ConsistencyGTID, f.consistent)
+	}
+
+	// The profiles of the config extend one another, the parents first.
+	{
+		f, err := dump("-config", config, "-profile", "nightly-checked", "-t", "4", "-h", "db1", "-u", "root", "-db", "shop")
+		assert.Nil(t, err)
+		assert.Equal(t, common.ConsistencyLock, f.consistent)
+		assert.Equal(t, 4, f.threads)
+		assert.Equal(t, "/backup/nightly", f.dir)
+		assert.True(t, f.checksum)
+	}
+
+	// The required flags, a repeatable flag.
+	{
+		_, err := load("-config", config, "-profile", "masked", "-h", "db1", "-u", "root")
+		assert.NotNil(t, err)
+		assert.Equal(t, `profile "masked" needs -d`, err.Error())
+		assert.Equal(t, common.CategoryInvalid, common.ErrorCategoryOf(err))
+
+		f, err := load("-config", config, "-profile", "masked", "-h", "db1", "-u", "root", "-d", "/backup")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(f.replace))
+
+		_, err = load("-profile", "staging-refresh", "-h", "db1", "-u", "root", "-d", "/backup")
+		assert.NotNil(t, err)
+		assert.Equal(t, `profile "staging-refresh" needs -replace`, err.Error())
+		f, err = load("-profile", "staging-refresh", "-h", "db1", "-u", "root", "-d", "/backup", "-replace", "a=b")
+		assert.Nil(t, err)
+		assert.True(t, f.overwrite)
+		assert.True(t, f.skipBinlog)
+		f, err = load("-profile", "staging-refresh", "-h", "db1", "-u", "root", "-d", "/backup", "-replace", "a=b", "-skip-binlog=false")
+		assert.Nil(t, err)
+		assert.False(t, f.skipBinlog)
+	}
+
+	// Errors.
+	{
+		_, err := load("-profile", "replica-seed", "-h", "db1", "-u", "root", "-d", "/backup")
+		assert.NotNil(t, err)
+		assert.Equal(t, `profile "replica-seed" is for the dump command, not load`, err.Error())
+
+		_, err = load("-profile", "nightly", "-h", "db1", "-u", "root", "-d", "/backup")
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), `profile "nightly" is not defined, the built-in ones are dev-sample, replica-seed, staging-refresh`), err.Error())
+
+		_, err = dump("-config", config, "-profile", "loop1")
+		assert.NotNil(t, err)
+		assert.Equal(t, `profile "loop1" extends itself: loop1 -> loop2 -> loop1`, err.Error())
+
+		_, err = dump("-config", config, "-h", "db1", "-u", "root", "-db", "shop", "-o", "/backup")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestCliReplay(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	file := "/tmp/clireplay.json"
+	data, err := json.Marshal(&common.RunConfig{
+		Version: common.Version,
+		Args:    common.DumpArgs{User: "backup", Password: "<redacted>", Address: "db1:3306", Database: "shop", Outdir: "/backup/first", Threads: 8, ChunksizeInMB: 64, Checksum: true},
+		Tables:  []common.RunConfigTable{{Name: "users", ChunksizeInMB: 64}, {Name: "orders", ChunksizeInMB: 64}},
+	})
+	assert.Nil(t, err)
+	x := ioutil.WriteFile(file, data, 0644)
+	assert.Nil(t, x)
+	defer os.Remove(file)
+
+	replay := func(argv ...string) (*common.DumpArgs, error) {
+		s := newSession(log, "go-mydumper", dumpCommand)
+		f := &dumpFlags{}
+		f.register(s.fs)
+		if err := s.parse(argv, f.missing); err != nil {
+			return nil, err
+		}
+		return f.replayArgs(s)
+	}
+
+	// The flags of the run, with the connection and the directory given.
+	{
+		args, err := replay("-replay", file, "-h", "db2", "-p", "secret", "-o", "/backup/again")
+		assert.Nil(t, err)
+		assert.Equal(t, &common.DumpArgs{User: "backup", Password: "secret", Address: "db2:3306", Database: "shop", Table: "users,orders", Outdir: "/backup/again", Threads: 8, ChunksizeInMB: 64, Checksum: true, Replay: file}, args)
+
+		args, err = replay("-replay", file, "-p", "secret")
+		assert.Nil(t, err)
+		assert.Equal(t, "db1:3306", args.Address)
+		assert.Equal(t, "/backup/first", args.Outdir)
+	}
+
+	// Errors.
+	{
+		_, err := replay("-replay", file, "-p", "secret", "-t", "4", "-checksum=false")
+		assert.NotNil(t, err)
+		assert.Equal(t, "-replay runs with the flags of its run config, only -h, -P, -u, -o, the password and the log flags can be given, not -checksum, -t", err.Error())
+
+		_, err = replay("-replay", "/tmp/clireplay-none.json", "-p", "secret")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestCliBench(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, tc := range []struct {
+		threads string
+		want    []int
+		err     bool
+	}{
+		{"1,2,4,8,16", []int{1, 2, 4, 8, 16}, false},
+		{"8, 32", []int{8, 32}, false},
+		{"1,,2", nil, true},
+		{"four", nil, true},
+	} {
+		f := &benchFlags{}
+		fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+		f.register(fs)
+		assert.Nil(t, fs.Parse([]string{"-h", "127.0.0.1", "-u", "root", "-p", "mock", "-threads", tc.threads}))
+		args, err := f.args(log)
+		if tc.err {
+			assert.NotNil(t, err, tc.threads)
+			continue
+		}
+		assert.Nil(t, err, tc.threads)
+		assert.Equal(t, tc.want, args.Threads)
+		assert.Equal(t, "go_mydumper_bench", args.Database)
+		assert.Nil(t, args.Validate())
+	}
+
+	out := &bytes.Buffer{}
+	Output = out
+	defer func() { Output = os.Stderr }()
+	assert.Equal(t, ExitUsage, Main(log, "go-mydumper", []string{"bench", "-h", "127.0.0.1"}))
+	assert.True(t, strings.Contains(out.String(), "missing required flags: -u"))
+}
+
+func TestCliExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{errors.New("rollback cancelled, nothing dropped"), ExitFailure},
+		{&common.ValidationError{Problems: []string{"user is required"}}, ExitUsage},
+		{usageError(errors.New("missing required flags: -u")), ExitUsage},
+		{&common.PartialError{Mode: "load", MaxRuntime: time.Hour}, ExitPartial},
+		{&common.CategorizedError{Category: common.CategoryConnection, Err: errors.New("dumping.table[test.t1].error:EOF")}, ExitConnection},
+		{sqldb.NewSQLError(1045, "Access denied for user 'app'@'10.0.0.1' (using password: YES)"), ExitPrivilege},
+		{&os.PathError{Op: "write", Path: "/backups/test.t1.00001.sql", Err: syscall.ENOSPC}, ExitStorage},
+		{sqldb.NewSQLError(1062, "Duplicate entry '1' for key 'PRIMARY'"), ExitData},
+		{context.Canceled, ExitCancelled},
+	} {
+		assert.Equal(t, tc.code, exitCode(tc.err), tc.err.Error())
+	}
+
+	// A log file which can't be opened is not a usage error.
+	err := usageError(&os.PathError{Op: "open", Path: "/nonexistent/run.log", Err: syscall.ENOENT})
+	assert.Equal(t, ExitStorage, exitCode(err))
+}
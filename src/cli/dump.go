@@ -0,0 +1,452 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+var dumpCommand = &Command{
+	Name:  "dump",
+	Short: "Dump a database into a directory",
+	Usage: "-h [HOST] -P [PORT] -u [USER] [-p PASSWORD | -password-file FILE | -ask-password] -db [DATABASE] -o [OUTDIR]",
+	Run:   runDump,
+}
+
+// dumpFlags are the flags of the dump command.
+type dumpFlags struct {
+	conn       connFlags
+	db         string
+	table      string
+	dir        string
+	chunksize  int
+	threads    int
+	schThreads int
+	stmtSize   int
+	mkdir      bool
+	clean      bool
+	retention  retentionFlag
+	fileMode   modeFlag
+	dirMode    modeFlag
+	chown      string
+	addDrop    bool
+	ifNotExist bool
+	keepTbsp   bool
+	checksum   bool
+	paranoid   bool
+	schCheck   bool
+	schRetries int
+	grants     bool
+	resume     bool
+	maxRuntime time.Duration
+	grace      time.Duration
+	format     string
+	trailers   bool
+	skipEmpty  bool
+	smoke      bool
+	volumes    volumeFlag
+	partitions partitionsFlag
+	chunkBy    chunkByFlag
+	chunkRows  int
+	subset     subsetSeedFlag
+	subsetMax  int
+	incFrom    string
+	incColumns incrementalColumnFlag
+	maxLag     int
+	lagAction  string
+	consistent string
+	lockWait   int
+	lockMode   string
+	metrics    string
+	status     string
+	token      string
+	progress   string
+	replay     string
+}
+
+// replayFlags are the flags a -replay takes besides the run config: the
+// connection, the output directory and the log.
+var replayFlags = map[string]bool{
+	"replay": true, "o": true, "h": true, "P": true, "u": true, "p": true, "password-file": true, "ask-password": true,
+	"log-level": true, "log-file": true, "log-format": true,
+}
+
+// volumeFlag is the repeatable -volume PATH=SIZE flag of the dump.
+type volumeFlag []common.Volume
+
+func (f *volumeFlag) String() string {
+	var volumes []string
+	for _, v := range *f {
+		volumes = append(volumes, fmt.Sprintf("%s=%d", v.Path, v.Budget))
+	}
+	return strings.Join(volumes, ",")
+}
+
+func (f *volumeFlag) Set(s string) error {
+	v, err := common.ParseVolume(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, v)
+	return nil
+}
+
+// partitionsFlag is the repeatable -partitions db.table:p1,p2 flag of the dump.
+type partitionsFlag map[string][]string
+
+func (f *partitionsFlag) String() string {
+	var tables []string
+	for table, partitions := range *f {
+		tables = append(tables, table+":"+strings.Join(partitions, ","))
+	}
+	sort.Strings(tables)
+	return strings.Join(tables, " ")
+}
+
+func (f *partitionsFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("partitions %q must be db.table:p1,p2", s)
+	}
+	if *f == nil {
+		*f = make(partitionsFlag)
+	}
+	(*f)[s[:i]] = append((*f)[s[:i]], strings.Split(s[i+1:], ",")...)
+	return nil
+}
+
+// chunkByFlag is the repeatable -chunk-by db.table:column[:interval] flag of
+// the dump.
+type chunkByFlag map[string]common.ChunkColumn
+
+func (f *chunkByFlag) String() string {
+	var tables []string
+	for table, col := range *f {
+		tables = append(tables, table+":"+col.String())
+	}
+	sort.Strings(tables)
+	return strings.Join(tables, " ")
+}
+
+func (f *chunkByFlag) Set(s string) error {
+	splits := strings.SplitN(s, ":", 3)
+	if len(splits) < 2 || splits[0] == "" || splits[1] == "" {
+		return fmt.Errorf("chunk-by %q must be db.table:column[:interval]", s)
+	}
+	if *f == nil {
+		*f = make(chunkByFlag)
+	}
+	col := common.ChunkColumn{Column: splits[1]}
+	if len(splits) == 3 {
+		col.Interval = splits[2]
+	}
+	(*f)[splits[0]] = col
+	return nil
+}
+
+// subsetSeedFlag is the repeatable -subset-seed db.table:WHERE flag of the
+// dump, the seeds of a table given again are ORed.
+type subsetSeedFlag map[string]string
+
+func (f *subsetSeedFlag) String() string {
+	var seeds []string
+	for table, where := range *f {
+		seeds = append(seeds, table+":"+where)
+	}
+	sort.Strings(seeds)
+	return strings.Join(seeds, " ")
+}
+
+func (f *subsetSeedFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.TrimSpace(s[i+1:]) == "" {
+		return fmt.Errorf("subset seed %q must be db.table:WHERE", s)
+	}
+	if *f == nil {
+		*f = make(subsetSeedFlag)
+	}
+	table, where := s[:i], s[i+1:]
+	if prev, ok := (*f)[table]; ok {
+		where = "(" + prev + ") OR (" + where + ")"
+	}
+	(*f)[table] = where
+	return nil
+}
+
+// incrementalColumnFlag is the repeatable -incremental-column db.table:column
+// flag of the dump.
+type incrementalColumnFlag map[string]string
+
+func (f *incrementalColumnFlag) String() string {
+	var columns []string
+	for table, column := range *f {
+		columns = append(columns, table+":"+column)
+	}
+	sort.Strings(columns)
+	return strings.Join(columns, " ")
+}
+
+func (f *incrementalColumnFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 || strings.TrimSpace(s[i+1:]) == "" {
+		return fmt.Errorf("incremental column %q must be db.table:column", s)
+	}
+	if *f == nil {
+		*f = make(incrementalColumnFlag)
+	}
+	table := s[:i]
+	if _, ok := (*f)[table]; ok {
+		return fmt.Errorf("incremental column of %q is given twice", table)
+	}
+	(*f)[table] = strings.TrimSpace(s[i+1:])
+	return nil
+}
+
+// modeFlag is a -file-mode or -dir-mode flag of the dump, in octal like 0640.
+type modeFlag os.FileMode
+
+func (m *modeFlag) String() string {
+	if *m == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+func (m *modeFlag) Set(s string) error {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("mode %q must be octal like 0640", s)
+	}
+	*m = modeFlag(mode)
+	return nil
+}
+
+// retentionFlag is the -retention flag of the dump, a duration in days like
+// 30d or a Go one like 12h.
+type retentionFlag time.Duration
+
+func (r *retentionFlag) String() string {
+	if *r == 0 {
+		return ""
+	}
+	d := time.Duration(*r)
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+func (r *retentionFlag) Set(s string) error {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("retention %q must be days like 30d or a duration like 12h", s)
+		}
+		*r = retentionFlag(time.Duration(days) * 24 * time.Hour)
+		return nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("retention %q must be days like 30d or a duration like 12h", s)
+	}
+	*r = retentionFlag(d)
+	return nil
+}
+
+func (f *dumpFlags) register(fs *flag.FlagSet) {
+	f.conn.register(fs, "", "dump")
+	fs.StringVar(&f.db, "db", "", "Database to dump")
+	fs.StringVar(&f.table, "table", "", "Table to dump")
+	fs.StringVar(&f.dir, "o", "", "Directory to output files to")
+	fs.Var(&f.volumes, "volume", "Spread the data files on this directory as PATH=SIZE, like /mnt/nfs1=2T, repeatable: a new file goes on the volume with the most room left, -o keeps the other files")
+	fs.Var(&f.partitions, "partitions", "Dump only these partitions of a table as db.table:p1,p2, repeatable for other tables: the schema is the whole table's, the selection is recorded in the metadata and manifest.json")
+	fs.Var(&f.subset, "subset-seed", "Dump only a referentially complete subset from the rows of a table as db.table:WHERE, like shop.customers:'id IN (1,2)', repeatable: the rows referencing them through the foreign keys, recursively, and every row these reference, the other tables without rows")
+	fs.IntVar(&f.subsetMax, "subset-max-rows", 0, "Fail a -subset-seed dump whose subset has more rows than this across the tables (0 is no bound)")
+	fs.StringVar(&f.incFrom, "incremental-from", "", "Dump only the tables changed since the dump of this directory or manifest.json, a full or incremental dump with a GTID set: the dump is the next incremental of its chain, restored after it with load -incremental; requires -consistency lock or gtid")
+	fs.Var(&f.incColumns, "incremental-column", "Dump only the rows of a changed table whose column is at or after the snapshot of -incremental-from as db.table:column, like shop.orders:updated_at, repeatable for other tables: the column must be set on every INSERT and UPDATE")
+	fs.Var(&f.chunkBy, "chunk-by", "Order and chunk the datas of a table by a column instead of -F as db.table:column[:interval], repeatable for other tables: a file per hour, day (the default), month or year of a date column, or per interval of a numeric one, named after its start like db.table.2024-01-15.sql, split in parts like db.table.2024-01-15.00001.sql past -F")
+	fs.IntVar(&f.chunkRows, "chunk-rows", 0, "Read every table without a -chunk-by in ranges of about this many rows of its primary key, or of a unique key on NOT NULL columns, a data file or more per range, each range recorded in manifest.json and dumped by any idle thread: a table without such a key is read at once (0 reads every table at once)")
+	fs.BoolVar(&f.mkdir, "force-mkdir", false, "Create the output directory if it does not exist")
+	fs.BoolVar(&f.clean, "clean", false, "Remove the *.tmp files a crashed dump left in the output directory and the volumes before starting, every file is written as name.tmp then renamed into place")
+	fs.Var(&f.retention, "retention", "Keep the dump this long, like 30d: its expires_at in manifest.json, the prune command deletes it past that")
+	fs.Var(&f.fileMode, "file-mode", "Mode of every file of the dump in octal, like 0640, set after it's created whatever the umask (by default 0644 less the umask)")
+	fs.Var(&f.dirMode, "dir-mode", "Mode of the directories -force-mkdir creates in octal, like 0750, set after they're created whatever the umask")
+	fs.StringVar(&f.chown, "chown", "", "Give every file of the dump, and the directories -force-mkdir creates, to this numeric uid:gid, like 34:34 for a backup user reading a dump run as root; needs root")
+	fs.BoolVar(&f.addDrop, "add-drop-table", false, "Write a DROP TABLE IF EXISTS before every CREATE TABLE of the schema files, as mysqldump does (load -create-if-not-exists skips it)")
+	fs.BoolVar(&f.ifNotExist, "if-not-exists", false, "Write the CREATE TABLEs of the schema files as CREATE TABLE IF NOT EXISTS, exclusive with -add-drop-table (load -overwrite-tables still drops the tables)")
+	fs.BoolVar(&f.keepTbsp, "keep-tablespace-options", false, "Keep the DATA DIRECTORY, INDEX DIRECTORY and TABLESPACE options of the CREATE TABLEs in the schema files, they are stripped without it (load -strip-tablespace-options=false restores them)")
+	fs.BoolVar(&f.grants, "grants", false, "Dump the users and roles but root and mysql.* with their password hashes, grants and default roles into grants.sql, for load -grants")
+	fs.BoolVar(&f.checksum, "checksum", false, "Record the CHECKSUM TABLE of every table in manifest.json, for load -verify-checksums")
+	fs.BoolVar(&f.paranoid, "paranoid", false, "Read every InnoDB table again in the snapshot once it's dumped, COUNT(*) and SUM(CRC32(primary key)), and fail it if its data files don't add up to it; requires -consistency lock or gtid")
+	fs.BoolVar(&f.schCheck, "check-schema-changes", true, "Read the CREATE TABLE of every table again once its datas are dumped and dump it again if an ALTER ran in the meantime, up to -schema-change-retries times, then mark it failed in manifest.json; not done with -consistency lock or gtid")
+	fs.IntVar(&f.schRetries, "schema-change-retries", 2, "How many times a table whose schema changed during its dump is dumped again before it's marked failed")
+	fs.BoolVar(&f.resume, "resume", false, "Skip the tables an interrupted dump into the output directory finished, see checkpoint.jsonl")
+	fs.DurationVar(&f.maxRuntime, "max-runtime", 0, "Stop starting tables after this long, like 4h: the tables being dumped get -max-runtime-grace then stop, the run exits with status 3 and -resume goes on (0 runs until done)")
+	fs.DurationVar(&f.grace, "max-runtime-grace", 5*time.Minute, "How long the tables being dumped at -max-runtime go on before they are stopped, to be dumped again by -resume")
+	fs.IntVar(&f.chunksize, "F", 128, "Split tables into chunks of this output file size. This value is in MB")
+	fs.IntVar(&f.threads, "t", 16, "Number of threads to use")
+	fs.IntVar(&f.schThreads, "schema-threads", 2, "Number of extra connections dumping the table schemas ahead of the data threads, 0 dumps each schema on its data thread")
+	fs.IntVar(&f.stmtSize, "s", 1000000, "Attempted size of INSERT statement in bytes")
+	fs.StringVar(&f.format, "format", common.FormatSQL, "Format of the data files: sql (INSERT statements, restored by load), csv (for LOAD DATA) or jsonl (a JSON object per row), csv and jsonl are not restored by load")
+	fs.BoolVar(&f.trailers, "file-trailers", false, "Write a header comment (version, table, chunk, snapshot, start time) and a trailer line (rows, bytes, sha256) into every data file, for load -verify-file-trailers; sql format only")
+	fs.BoolVar(&f.skipEmpty, "skip-empty-files", false, "Write no data file for a table without rows, instead of the marker of an empty table, a sql file of only a header comment; manifest.json records the table as empty either way")
+	fs.BoolVar(&f.smoke, "smoke-test", false, "Dump only the schemas and the first 1000 rows of every table, by primary key, into db.table.smoke.sql files, and report each table's success or failure: a quick check of the connection, the privileges and the output before a real dump; load refuses these files without -allow-smoke")
+	fs.IntVar(&f.maxLag, "max-replica-lag", 0, "Check the replication lag of the source, a replica, before and every 5 seconds during the dump: over this many seconds -lag-action applies, 0 doesn't check it")
+	fs.StringVar(&f.lagAction, "lag-action", common.LagActionPause, "What a lag over -max-replica-lag does: pause (the threads wait until it's back under) or abort (the dump fails)")
+	fs.StringVar(&f.consistent, "consistency", common.ConsistencyNone, "Dump all the tables at the same point: none (each table as it is when read), lock (FLUSH TABLES WITH READ LOCK while the threads start their snapshots, needs RELOAD) or gtid (no lock, needs gtid_mode=ON), see README")
+	fs.IntVar(&f.lockWait, "lock-wait-timeout", 60, "Seconds to wait for the FLUSH TABLES WITH READ LOCK of -consistency lock, past it the dump fails with the queries blocking it")
+	fs.StringVar(&f.lockMode, "lock-mode", common.LockModeAuto, "The lock of -consistency lock: auto (the backup locks of Percona Server 5.6/5.7 or MariaDB 10.4+ if the server has them, else ftwrl), ftwrl (FLUSH TABLES WITH READ LOCK), backup-lock (fails without them) or none (no lock, the snapshots may differ)")
+	fs.StringVar(&f.metrics, "metrics-listen", "", "Serve the Prometheus metrics at /metrics on this address during the run, like :9104")
+	fs.StringVar(&f.status, "status-listen", "", "Serve the progress as JSON at /status (and /healthz) on this address during the run, like :8080")
+	fs.StringVar(&f.token, "status-token", "", "Enable the POST /cancel of -status-listen for the requests with the header 'Authorization: Bearer <token>'")
+	fs.StringVar(&f.progress, "progress-file", "", "Append the progress as one JSON line per event (phase, file done or failed, tick every 10 seconds, retried error, end with the report) to this file, for a tool tailing it")
+	fs.StringVar(&f.replay, "replay", "", "Run again the dump of this runconfig.json, every dump writes one in its directory: its flags and tables, only -h, -P, -u, -o and the password can be given, a table which no longer exists fails the dump before any is dumped")
+}
+
+func (f *dumpFlags) missing() []string {
+	if f.replay != "" {
+		return nil
+	}
+	missing := f.conn.missing()
+	if f.db == "" {
+		missing = append(missing, "-db")
+	}
+	if f.dir == "" {
+		missing = append(missing, "-o")
+	}
+	return missing
+}
+
+// args builds the DumpArgs, the password is resolved here.
+func (f *dumpFlags) args(log *xlog.Log) (*common.DumpArgs, error) {
+	passwd, err := f.conn.password(log)
+	if err != nil {
+		return nil, err
+	}
+	return &common.DumpArgs{
+		User:                  f.conn.user,
+		Password:              passwd,
+		Address:               f.conn.address(),
+		Database:              f.db,
+		Table:                 f.table,
+		Outdir:                f.dir,
+		ChunksizeInMB:         f.chunksize,
+		Threads:               f.threads,
+		SchemaThreads:         f.schThreads,
+		StmtSize:              f.stmtSize,
+		ForceMkdir:            f.mkdir,
+		Clean:                 f.clean,
+		Retention:             time.Duration(f.retention),
+		FileMode:              os.FileMode(f.fileMode),
+		DirMode:               os.FileMode(f.dirMode),
+		Chown:                 f.chown,
+		AddDropTable:          f.addDrop,
+		IfNotExists:           f.ifNotExist,
+		KeepTablespaceOptions: f.keepTbsp,
+		Checksum:              f.checksum,
+		Paranoid:              f.paranoid,
+		SmokeTest:             f.smoke,
+		CheckSchemaChanges:    f.schCheck,
+		SchemaChangeRetries:   f.schRetries,
+		Grants:                f.grants,
+		Resume:                f.resume,
+		MaxRuntime:            f.maxRuntime,
+		MaxRuntimeGrace:       f.grace,
+		Format:                f.format,
+		FileTrailers:          f.trailers,
+		SkipEmptyFiles:        f.skipEmpty,
+		Volumes:               f.volumes,
+		Partitions:            f.partitions,
+		ChunkBy:               f.chunkBy,
+		ChunkRows:             f.chunkRows,
+		SubsetSeeds:           f.subset,
+		SubsetMaxRows:         f.subsetMax,
+		IncrementalFrom:       f.incFrom,
+		IncrementalColumns:    f.incColumns,
+		MaxReplicaLag:         f.maxLag,
+		LagAction:             f.lagAction,
+		Consistency:           f.consistent,
+		LockWaitTimeout:       f.lockWait,
+		LockMode:              f.lockMode,
+		IntervalMs:            10 * 1000,
+		MetricsListen:         f.metrics,
+		StatusListen:          f.status,
+		StatusToken:           f.token,
+		ProgressFile:          f.progress,
+	}, nil
+}
+
+// replayArgs builds the DumpArgs of a -replay: the ones of its run config,
+// with the connection and the output directory given, the password is
+// resolved here.
+func (f *dumpFlags) replayArgs(s *session) (*common.DumpArgs, error) {
+	var others []string
+	s.fs.Visit(func(fl *flag.Flag) {
+		if !replayFlags[fl.Name] {
+			others = append(others, "-"+fl.Name)
+		}
+	})
+	if len(others) > 0 {
+		return nil, fmt.Errorf("-replay runs with the flags of its run config, only -h, -P, -u, -o, the password and the log flags can be given, not %s", strings.Join(others, ", "))
+	}
+	rc, err := common.ReadRunConfig(f.replay)
+	if err != nil {
+		return nil, err
+	}
+	args := rc.ReplayArgs(f.replay)
+	if f.conn.host != "" {
+		args.Address = f.conn.address()
+	}
+	if f.conn.user != "" {
+		args.User = f.conn.user
+	}
+	if f.dir != "" {
+		args.Outdir = f.dir
+	}
+	if args.Password, err = f.conn.password(s.log); err != nil {
+		return nil, err
+	}
+	s.log.Info("dump.replay[%s].version[%s].tables[%d]", f.replay, rc.Version, len(rc.Tables))
+	return &args, nil
+}
+
+func runDump(s *session, argv []string) error {
+	f := &dumpFlags{}
+	f.register(s.fs)
+	if err := s.parse(argv, f.missing); err != nil {
+		return err
+	}
+
+	var args *common.DumpArgs
+	var err error
+	if f.replay != "" {
+		args, err = f.replayArgs(s)
+	} else {
+		args, err = f.args(s.log)
+	}
+	if err != nil {
+		return usageError(err)
+	}
+	if err := args.Validate(); err != nil {
+		return err
+	}
+	report, err := common.NewDumper(common.DumpConfig{DumpArgs: *args, Log: s.log}).Run(s.ctx)
+	common.LogReport(s.log, report)
+	return err
+}
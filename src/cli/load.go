@@ -0,0 +1,668 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"bufio"
+	"common"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+var loadCommand = &Command{
+	Name:  "load",
+	Short: "Restore a dump directory into a server",
+	Usage: "-h [HOST] -P [PORT] -u [USER] [-p PASSWORD | -password-file FILE | -ask-password] -d [DIR]",
+	Run:   runLoad,
+}
+
+// loadFlags are the flags of the load command.
+type loadFlags struct {
+	conn         connFlags
+	dir          string
+	threads      int
+	schThreads   int
+	dataThreads  int
+	postThreads  int
+	roMaxWait    int
+	txnBatchSize int
+	smallBatch   int
+	smallMax     int64
+	txnMaxStmts  int
+	txnMaxTime   int
+	compat       string
+	version      string
+	filter       string
+	filterFile   string
+	recent       int
+	replace      replaceFlag
+	rewrite      string
+	upgrade      bool
+	collations   collationsFlag
+	keyBytes     int
+	collation    string
+	tableColl    bool
+	engine       string
+	skipChecks   bool
+	stripTbsp    bool
+	tune         tuneFlag
+	lock         bool
+	forceLock    bool
+	metrics      string
+	status       string
+	statusToken  string
+	progress     string
+	targets      string
+	placement    string
+	placeFile    string
+	expect       string
+	files        string
+	pipes        bool
+	pipeReopen   string
+	partial      bool
+	allowSmoke   bool
+	downgrade    bool
+	incompat     bool
+	autoInc      bool
+	checksums    bool
+	trailers     bool
+	verifySchema bool
+	deferChecks  bool
+	checkTables  bool
+	prepared     bool
+	managed      bool
+	definers     bool
+	definerUser  string
+	grants       bool
+	grantsExist  string
+	skipSets     bool
+	skipBinlog   bool
+	logSQL       string
+	logSQLMax    int
+	captureWarn  bool
+	warnMessages int
+	warnErrors   bool
+	warnMax      int
+	checkUTF8    string
+	ifNotExists  bool
+	overwrite    bool
+	tablePrefix  string
+	tableSuffix  string
+	expandSource bool
+	volumes      pathsFlag
+	upsert       bool
+	incrementals pathsFlag
+	fill         bool
+	fillValues   fillValuesFlag
+	seed         int64
+	perDatabase  int
+	perTable     tableThreadsFlag
+	inFlight     int64
+	maxMemory    int64
+	openFiles    int
+	bytesPerSec  int64
+	rowsPerSec   int64
+	lagCheck     string
+	rollbackFile string
+	rollback     string
+	resumeFile   string
+	resume       bool
+	maxRuntime   time.Duration
+	runtimeGrace time.Duration
+	yes          bool
+	preHook      string
+	postHook     string
+	warm         string
+	warmThreads  int
+	optimize     string
+	optThreads   int
+	postSQL      pathsFlag
+	postFailSQL  pathsFlag
+	postSQLDB    string
+}
+
+// pathsFlag is a repeatable flag of paths.
+type pathsFlag []string
+
+func (p *pathsFlag) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathsFlag) Set(s string) error {
+	*p = append(*p, s)
+	return nil
+}
+
+// tableThreadsFlag is the repeatable -table-threads db.table=N flag.
+type tableThreadsFlag map[string]int
+
+func (f *tableThreadsFlag) String() string {
+	var caps []string
+	for table, n := range *f {
+		caps = append(caps, fmt.Sprintf("%s=%d", table, n))
+	}
+	sort.Strings(caps)
+	return strings.Join(caps, ",")
+}
+
+func (f *tableThreadsFlag) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("table threads %q must be db.table=N", s)
+	}
+	n, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return fmt.Errorf("table threads %q must be db.table=N", s)
+	}
+	if *f == nil {
+		*f = make(tableThreadsFlag)
+	}
+	(*f)[s[:i]] = n
+	return nil
+}
+
+// collationsFlag is the repeatable -upgrade-collation FROM=TO flag.
+type collationsFlag map[string]string
+
+func (f *collationsFlag) String() string {
+	var pairs []string
+	for from, to := range *f {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *collationsFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("upgrade collation %q must be FROM=TO", s)
+	}
+	if *f == nil {
+		*f = make(collationsFlag)
+	}
+	(*f)[s[:i]] = s[i+1:]
+	return nil
+}
+
+// fillValuesFlag is the repeatable -fill-value TYPE=VALUE flag.
+type fillValuesFlag map[string]string
+
+func (f *fillValuesFlag) String() string {
+	var pairs []string
+	for typ, value := range *f {
+		pairs = append(pairs, typ+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f *fillValuesFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return fmt.Errorf("fill value %q must be TYPE=VALUE", s)
+	}
+	if *f == nil {
+		*f = make(fillValuesFlag)
+	}
+	(*f)[strings.ToLower(s[:i])] = s[i+1:]
+	return nil
+}
+
+// replaceFlag is the repeatable -replace FIND=REPLACE flag.
+type replaceFlag []common.Replacement
+
+func (r *replaceFlag) String() string {
+	var pairs []string
+	for _, rep := range *r {
+		pairs = append(pairs, rep.Find+"="+rep.Replace)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (r *replaceFlag) Set(s string) error {
+	rep, err := common.ParseReplacement(s)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rep)
+	return nil
+}
+
+// tuneFlag is the -tune-target flag, on alone or -tune-target=dry-run.
+type tuneFlag string
+
+func (t *tuneFlag) String() string {
+	return string(*t)
+}
+
+func (t *tuneFlag) Set(s string) error {
+	switch s {
+	case "true":
+		s = common.TuneTargetOn
+	case "false":
+		s = ""
+	}
+	*t = tuneFlag(s)
+	return nil
+}
+
+// IsBoolFlag lets -tune-target go without a value.
+func (t *tuneFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (f *loadFlags) register(fs *flag.FlagSet) {
+	f.conn.register(fs, "", "loader")
+	fs.StringVar(&f.dir, "d", "", "Directory of the dump to import")
+	fs.Var(&f.volumes, "volume", "Directory of the data files of a dump spread on volumes, repeatable, by default the volumes recorded in manifest.json")
+	fs.IntVar(&f.threads, "t", 16, "Number of threads to use")
+	fs.IntVar(&f.schThreads, "schema-threads", 0, "Number of threads creating the table schemas, DDL touching the same referenced table is serialized (1 creates them one by one, 0 for 4 or -t if less)")
+	fs.IntVar(&f.dataThreads, "data-threads", 0, "Number of threads restoring the data files (0 for -t)")
+	fs.IntVar(&f.postThreads, "post-threads", 0, "Number of threads of the phases after the datas: -defer-constraints, -verify-checksums, -warm-tables and -optimize-tables (0 for -t); the pool has the most of -schema-threads, -data-threads and -post-threads")
+	fs.IntVar(&f.roMaxWait, "read-only-max-wait", 300, "Seconds a schema statement refused by a read-only target (super_read_only during a failover) waits for it to become writable before the restore fails, and a statement whose server went away for a writable -h to reconnect to")
+	fs.IntVar(&f.perDatabase, "max-threads-per-database", 0, "Restore at most this many files of the same database at once, the other threads take files of other databases (0 is no cap)")
+	fs.Var(&f.perTable, "table-threads", "Restore at most N files of a table at once, as db.table=N, repeatable: 1 restores the table file by file, the threads come from -t")
+	fs.Int64Var(&f.inFlight, "max-in-flight-bytes", 0, "Read at most this many bytes of data files into memory at once across the threads, a larger file waits for all the others (0 is no bound)")
+	fs.Int64Var(&f.maxMemory, "max-memory", 0, "Hold at most this many bytes of statements in flight at once across the threads, a thread waits for the size of a statement before rewriting and executing it (0 is no bound)")
+	fs.Int64Var(&f.bytesPerSec, "max-bytes-per-sec", 0, "Throttle the data statements of all the threads to this many bytes a second (0 is no throttle)")
+	fs.StringVar(&f.lagCheck, "replica-lag-check", "", "Pause the dispatch of the data files while this replica of the target lags over the threshold, as host:port,seconds like 10.0.0.3:3306,30")
+	fs.Int64Var(&f.rowsPerSec, "max-rows-per-sec", 0, "Throttle the data statements of all the threads to this many rows a second, counted from their VALUES tuples; exclusive with -max-bytes-per-sec (0 is no throttle)")
+	fs.IntVar(&f.openFiles, "max-open-files", 0, "Open at most this many files of the dump at once across the threads, keep it plus -t under 'ulimit -n' (0 is no bound)")
+	fs.IntVar(&f.txnBatchSize, "txn-batch-size", 0, "Group up to this many small (<=1MB) table files of the same database into one transaction")
+	fs.IntVar(&f.smallBatch, "small-file-batch", 0, "Restore up to this many small table files of the same database back to back as one unit of a thread, under one 'use' and in autocommit, for dumps of many tiny tables; exclusive with -txn-batch-size")
+	fs.Int64Var(&f.smallMax, "small-file-max-bytes", 0, "Largest table file of a -small-file-batch batch (0 is 1MB)")
+	fs.IntVar(&f.txnMaxStmts, "txn-max-statements", 0, "Commit the transaction of a -txn-batch-size batch every this many statements (0 is no cap, 100 with -compat proxy)")
+	fs.IntVar(&f.txnMaxTime, "max-transaction-time", 0, "Commit the transaction of a -txn-batch-size batch once it has been open this many milliseconds, to bound the lag of the replicas of the target (0 is no cap)")
+	fs.StringVar(&f.compat, "compat", "", "Restore through a sharding proxy (Vitess, ProxySQL) with proxy: no 'use', the INSERTs and CREATE TABLEs name their database, the SETs it refuses are skipped")
+	fs.StringVar(&f.version, "schema-version", "", "Restore only the tables tagged with this schema version in the manifest.json of the dump")
+	fs.StringVar(&f.filter, "filter", "", "Restore only the tables this expression holds for, like \"database matching 'shard_*' AND size < 1G\"")
+	fs.StringVar(&f.filterFile, "filter-file", "", "Read the -filter expression from this file, the lines starting with # are comments")
+	fs.IntVar(&f.recent, "recent-chunks", 0, "Restore only the N highest numbered chunk files of every table, the most recent ones if the chunks follow time (0 restores all)")
+	fs.Var(&f.replace, "replace", "Replace FIND with REPLACE in the string values of the data, as FIND=REPLACE, repeatable and applied in order")
+	fs.StringVar(&f.rewrite, "rewrite", "", fmt.Sprintf("Comma separated builtin rewrites of the statements, applied in order: %s", strings.Join(common.BuiltinRewrites(), ", ")))
+	fs.BoolVar(&f.upgrade, "upgrade-charset", false, "Move the databases and tables from utf8/utf8mb3 to utf8mb4, the keys which get too long are shortened to a prefix, see README")
+	fs.Var(&f.collations, "upgrade-collation", "The utf8mb4 collation of a utf8mb3 one for -upgrade-charset, as FROM=TO like utf8_general_ci=utf8mb4_0900_ai_ci, repeatable, by default utf8_xxx becomes utf8mb4_xxx")
+	fs.IntVar(&f.keyBytes, "upgrade-key-bytes", 767, "Longest key part of the target for -upgrade-charset, 767 for the COMPACT row format, 3072 for DYNAMIC")
+	fs.StringVar(&f.collation, "default-collation", "", "Create the databases with this default collation and its character set, like utf8mb4_0900_ai_ci, whatever their CREATE DATABASE says")
+	fs.BoolVar(&f.tableColl, "force-table-collation", false, "Set the -default-collation as the default of the tables too, the columns with their own collation keep it")
+	fs.StringVar(&f.engine, "force-engine", "", "Create every table with this storage engine, like InnoDB for a MyISAM dump, the definitions it handles differently are logged")
+	fs.BoolVar(&f.skipChecks, "skip-check-constraints", false, "Create the tables without their CHECK constraints, for a target which rejects them or drops them, the expression defaults are kept")
+	fs.BoolVar(&f.stripTbsp, "strip-tablespace-options", true, "Create the tables without the DATA DIRECTORY, INDEX DIRECTORY and TABLESPACE options of their CREATE TABLE, each one stripped is logged; -strip-tablespace-options=false keeps them for a target with the same directories and tablespaces")
+	fs.Var(&f.tune, "tune-target", "Relax innodb_flush_log_at_trx_commit, sync_binlog and innodb_max_dirty_pages_pct of the target for the restore and set them back after it, needs SYSTEM_VARIABLES_ADMIN or SUPER; -tune-target=dry-run logs the changes only")
+	fs.BoolVar(&f.lock, "lock", false, "Take the advisory lock GET_LOCK('go-mydumper:<db>') of every database restored, and GET_LOCK('go-mydumper') for a restore of the whole dump, a restore into a database another one holds refuses to start; the holder is recorded in the go_mydumper.locks table")
+	fs.BoolVar(&f.forceLock, "force", false, "With -lock, restore even into the databases another restore holds the lock of, with a warning: the restores may interleave their DDL")
+	fs.StringVar(&f.files, "files", "", "Comma separated data files to restore instead of the whole dump, relative to -d if set: the schema of a table is restored only if it's missing on the target")
+	fs.BoolVar(&f.pipes, "allow-pipes", false, "Restore the data files which are named pipes (FIFOs), read once each: a pipe is sized by manifest.json if the dump has one, else never batched")
+	fs.StringVar(&f.pipeReopen, "pipe-reopen-command", "", "Shell command run before a pipe is read again, like by a -txn-batch-size batch run again after a failover, with DB, TABLE, FILE and STATUS=reopen in its environment: it must feed the pipe again, without it the read fails")
+	fs.StringVar(&f.expect, "expect-tables", "", "Comma separated 'db' or 'db.table' names which must be in the dump, the restore fails before starting if one is missing")
+	fs.StringVar(&f.rollbackFile, "rollback-file", "", "Write a DROP ... IF EXISTS statement to this file for every database and table the restore creates, as it creates them, for -rollback")
+	fs.StringVar(&f.rollback, "rollback", "", "Drop the databases and tables of a -rollback-file of a previous restore instead of restoring, once confirmed")
+	fs.BoolVar(&f.yes, "yes", false, "Don't ask for the confirmation of -rollback")
+	fs.StringVar(&f.resumeFile, "resume-file", "", "Write a line to this file for every database, schema and data file restored, and for a data file stopped by -max-runtime with its next statement, for -resume")
+	fs.BoolVar(&f.resume, "resume", false, "Skip what the -resume-file of a previous restore of the dump records, a stopped data file goes on from its next statement")
+	fs.DurationVar(&f.maxRuntime, "max-runtime", 0, "Stop starting data files after this long, like 4h: the files being restored get -max-runtime-grace then stop, the run exits with status 3 and -resume goes on; needs -resume-file (0 runs until done)")
+	fs.DurationVar(&f.runtimeGrace, "max-runtime-grace", 5*time.Minute, "How long the data files being restored at -max-runtime go on before they stop at their next statement")
+	fs.BoolVar(&f.downgrade, "allow-version-downgrade", false, "Restore into a target of an older major or minor version than the source server (recorded in manifest.json) with a warning instead of refusing it")
+	fs.BoolVar(&f.incompat, "fail-on-incompat", false, "Fail before any statement if the dump has features the target lacks, like its collations or CHECK constraints, instead of warning")
+	fs.BoolVar(&f.partial, "allow-partial-dump", false, "Restore a dump with partial markers (metadata.partial, *.partial) with a warning instead of refusing it, the dump was still running or failed")
+	fs.BoolVar(&f.allowSmoke, "allow-smoke", false, "Restore the data files of a dump -smoke-test (*.smoke.sql) with a warning instead of refusing them, they are the first rows of the tables, not a dump")
+	fs.BoolVar(&f.ifNotExists, "create-if-not-exists", false, "Create the tables with CREATE TABLE IF NOT EXISTS, an existing table is kept as it is (its schema is NOT updated), the DROP TABLE of a schema file dumped with -add-drop-table is skipped")
+	fs.BoolVar(&f.overwrite, "overwrite-tables", false, "Drop every table before creating it, once only if its schema file dumped with -add-drop-table drops it, even if it's dumped with -if-not-exists; exclusive with -create-if-not-exists")
+	fs.StringVar(&f.tablePrefix, "table-prefix", "", "Restore every table t as <prefix>t, with its foreign keys and constraint names, to restore a second copy into the same database")
+	fs.StringVar(&f.tableSuffix, "table-suffix", "", "Restore every table t as t<suffix>, like -table-prefix")
+	fs.BoolVar(&f.expandSource, "expand-source", false, "Restore the files the 'SOURCE file;' lines of the table schema files include in their place, relative to the including file")
+	fs.BoolVar(&f.upsert, "upsert", false, "Restore the INSERTs as INSERT ... ON DUPLICATE KEY UPDATE of the columns of the dump, a table without a primary key gets plain INSERTs")
+	fs.Var(&f.incrementals, "incremental", "Restore this dump -incremental-from after the one of -d, repeatable in the order of the chain: its INSERTs are restored as -upsert INSERT ... ON DUPLICATE KEY UPDATE, not REPLACE, so a changed row is updated in place, the tables it recreated are dropped first, the rows deleted since are NOT deleted")
+	fs.BoolVar(&f.fill, "fill-missing-columns", false, "Add the NOT NULL columns without a default the target tables have and the dump doesn't to every INSERT, with an empty string, 0 or the epoch by type; a column only the dump has fails before any data")
+	fs.Var(&f.fillValues, "fill-value", "The value of -fill-missing-columns for a column type as TYPE=VALUE, a SQL literal like datetime=\"'2000-01-01 00:00:00'\", repeatable")
+	fs.Int64Var(&f.seed, "shuffle-seed", 0, "Seed of the shuffle of the data files, to restore them in the order of a previous run (logged as restoring.shuffle.seed), 0 seeds it with the time")
+	fs.BoolVar(&f.autoInc, "preserve-auto-increment", false, "Set the AUTO_INCREMENT counters of the source (recorded in manifest.json) after the datas are restored")
+	fs.BoolVar(&f.checksums, "verify-checksums", false, "Compare every restored table with the CHECKSUM TABLE (dump -checksum) or the row count recorded in manifest.json, fail on a mismatch")
+	fs.BoolVar(&f.verifySchema, "verify-schema", false, "Compare the SHOW CREATE TABLE of every restored table with its schema file once the schemas are restored, fail on a difference; AUTO_INCREMENT, ROW_FORMAT=DYNAMIC, utf8 as utf8mb3 and the integer display widths aside")
+	fs.BoolVar(&f.trailers, "verify-file-trailers", false, "Check every data file against its trailer (dump -file-trailers) before executing it, fail the files without one or which don't match it")
+	fs.BoolVar(&f.deferChecks, "defer-constraints", false, "Restore the datas with the foreign key checks off, then validate the foreign keys in one pass and fail with the rows which violate them")
+	fs.BoolVar(&f.checkTables, "check-tables", false, "Run CHECK TABLE on the restored tables in the validation pass of -defer-constraints")
+	fs.BoolVar(&f.grants, "grants", false, "Restore the roles, users and grants of grants.sql (dump -grants) once the datas are restored")
+	fs.StringVar(&f.grantsExist, "grants-existing", common.GrantsSkipExisting, "What -grants does with a user which exists on the target: skip leaves it as it is, update sets its password and adds the grants")
+	fs.BoolVar(&f.managed, "managed", false, "Restore into a managed server without SUPER (RDS, Aurora, Cloud SQL): same as -rewrite-definers -skip-privileged-sets")
+	fs.BoolVar(&f.definers, "rewrite-definers", false, "Replace the DEFINER=user@host clauses of the schemas with DEFINER=CURRENT_USER")
+	fs.StringVar(&f.definerUser, "definer-user", "", "Replace the DEFINER=user@host clauses of the schemas with this account, as user@host like app@%, instead of CURRENT_USER")
+	fs.BoolVar(&f.skipBinlog, "skip-binlog", false, "Turn sql_log_bin off on every connection of the restore, the restored rows don't reach the binlog nor the replicas of the target (needs SUPER or SYSTEM_VARIABLES_ADMIN)")
+	fs.BoolVar(&f.skipSets, "skip-privileged-sets", false, "Skip the SET statements of the files which need SUPER (global variables, sql_log_bin, gtid_purged, gtid_next, read_only)")
+	fs.BoolVar(&f.prepared, "use-prepared", false, "Execute the INSERTs through prepared statements reused per INSERT shape, see README before using it")
+	fs.StringVar(&f.logSQL, "log-sql", common.LogSQLNone, "Log the executed statements: ddl logs the schema statements, all also logs the data statements redacted, none only the failed ones")
+	fs.IntVar(&f.logSQLMax, "log-sql-max-bytes", 256, "Truncate the redacted statements in the log to this many bytes")
+	fs.BoolVar(&f.captureWarn, "capture-warnings", false, "Run SHOW WARNINGS after every data statement, log the values truncated or coerced and count them by code in the summary, the ones past max_error_count from @@warning_count")
+	fs.IntVar(&f.warnMessages, "warning-messages", 0, "With -capture-warnings, the warnings of every table kept in full for the summary (default 5)")
+	fs.BoolVar(&f.warnErrors, "warnings-as-errors", false, "With -capture-warnings, fail the data file whose warnings bring the ones of its table over -warnings-threshold")
+	fs.IntVar(&f.warnMax, "warnings-threshold", 0, "The warnings a table may have with -warnings-as-errors, 0 fails the first one")
+	fs.StringVar(&f.checkUTF8, "check-utf8", "", "Check the values of the utf8 and utf8mb4 columns: 'warn' logs the invalid UTF-8 and double encoded ones, 'abort' fails on invalid UTF-8")
+	fs.StringVar(&f.warm, "warm-tables", "", "Comma separated 'db.table' names read into the buffer pool once the restore is done, skipped by a POST to /skip?phase=warm on -status-listen")
+	fs.IntVar(&f.warmThreads, "warm-threads", 2, "Number of connections warming the -warm-tables")
+	fs.StringVar(&f.optimize, "optimize-after-load", "", "Comma separated 'db.table' names, or 'all', rebuilt once the restore is done to defragment them, skipped by a POST to /skip?phase=optimize on -status-listen")
+	fs.IntVar(&f.optThreads, "optimize-threads", 1, "Number of connections rebuilding the -optimize-after-load tables")
+	fs.Var(&f.postSQL, "post-sql", "SQL script run once every phase of the restore succeeded, repeatable, in order: the first failed statement fails the load")
+	fs.Var(&f.postFailSQL, "post-sql-on-failure", "SQL script run once the restore failed, repeatable, with @go_mydumper_status and @go_mydumper_error set")
+	fs.StringVar(&f.postSQLDB, "post-sql-database", "", "Default database of the -post-sql and -post-sql-on-failure scripts")
+	fs.StringVar(&f.preHook, "pre-table-hook", "", "Shell command run before the first data file of every table, with DB, TABLE, FILE and STATUS=start in its environment, a failure skips the table")
+	fs.StringVar(&f.postHook, "post-table-hook", "", "Shell command run once the data files of a table are restored, with STATUS=ok or failed")
+	fs.StringVar(&f.targets, "targets", "", "Restore the databases onto these servers instead of -h, comma separated like 10.0.0.1,10.0.0.2:3307, one after the other with -u and the password: every database with all its tables on one of them by -placement")
+	fs.StringVar(&f.placement, "placement", "", "How -targets places the databases: round-robin (the default, the databases by name to the servers in turn) or file (the -placement-file)")
+	fs.StringVar(&f.placeFile, "placement-file", "", "File of 'db server' lines for -placement file, the server one of -targets, '#' starts a comment")
+	fs.StringVar(&f.metrics, "metrics-listen", "", "Serve the Prometheus metrics at /metrics on this address during the run, like :9104")
+	fs.StringVar(&f.status, "status-listen", "", "Serve the progress as JSON at /status (and /healthz) on this address during the run, like :8080")
+	fs.StringVar(&f.statusToken, "status-token", "", "Enable the POST /cancel of -status-listen for the requests with the header 'Authorization: Bearer <token>', the POST /skip then needs it too")
+	fs.StringVar(&f.progress, "progress-file", "", "Append the progress as one JSON line per event (phase, file done or failed, tick every 10 seconds, retried error, end with the report) to this file, for a tool tailing it")
+}
+
+func (f *loadFlags) missing() []string {
+	var missing []string
+	for _, name := range f.conn.missing() {
+		// The -targets are the servers.
+		if name != "-h" || f.targets == "" {
+			missing = append(missing, name)
+		}
+	}
+	if f.dir == "" && f.rollback == "" && f.files == "" {
+		missing = append(missing, "-d")
+	}
+	return missing
+}
+
+// parseLagCheck parses the -replica-lag-check host:port,seconds flag, empty
+// watches no replica.
+func parseLagCheck(s string) (string, int, error) {
+	if s == "" {
+		return "", 0, nil
+	}
+	i := strings.LastIndex(s, ",")
+	if i < 0 {
+		return "", 0, fmt.Errorf("-replica-lag-check %q must be host:port,seconds", s)
+	}
+	seconds, err := strconv.Atoi(s[i+1:])
+	if err != nil || seconds < 1 {
+		return "", 0, fmt.Errorf("-replica-lag-check %q must end with the seconds of lag, a positive number", s)
+	}
+	return s[:i], seconds, nil
+}
+
+// parseTargets parses the -targets host1,host2,... flag, the hosts without a
+// port get port: the first is the address of the restore, the others are the
+// targets named by their address, with the user and the password.
+func parseTargets(s string, port int, user string, password string) (string, map[string]common.LoadTarget, error) {
+	hosts := strings.Split(s, ",")
+	if len(hosts) < 2 {
+		return "", nil, fmt.Errorf("-targets %q must list at least two servers", s)
+	}
+	var address string
+	targets := make(map[string]common.LoadTarget)
+	for i, host := range hosts {
+		a, err := common.ParseAddress(strings.TrimSpace(host), port)
+		if err != nil {
+			return "", nil, fmt.Errorf("-targets %v", err)
+		}
+		if _, ok := targets[a]; ok || a == address {
+			return "", nil, fmt.Errorf("-targets %q lists %s twice", s, a)
+		}
+		if i == 0 {
+			address = a
+			continue
+		}
+		targets[a] = common.LoadTarget{Address: a, User: user, Password: password}
+	}
+	return address, targets, nil
+}
+
+// args builds the LoadArgs, the password is resolved here.
+// schemaThreads returns -schema-threads, 0 for 4 or -t if less: -t alone
+// caps the connections of a load.
+func (f *loadFlags) schemaThreads() int {
+	if f.schThreads != 0 {
+		return f.schThreads
+	}
+	if f.threads < 4 {
+		return f.threads
+	}
+	return 4
+}
+
+func (f *loadFlags) args(log *xlog.Log) (*common.LoadArgs, error) {
+	passwd, err := f.conn.password(log)
+	if err != nil {
+		return nil, err
+	}
+	filter := f.filter
+	if f.filterFile != "" {
+		if filter != "" {
+			return nil, fmt.Errorf("-filter and -filter-file can not be set together")
+		}
+		if filter, err = readFilterFile(f.filterFile); err != nil {
+			return nil, err
+		}
+	}
+	var expect []string
+	if f.expect != "" {
+		expect = strings.Split(f.expect, ",")
+	}
+	var files []string
+	if f.files != "" {
+		files = strings.Split(f.files, ",")
+	}
+	var warm []string
+	if f.warm != "" {
+		warm = strings.Split(f.warm, ",")
+	}
+	var optimize []string
+	if f.optimize != "" {
+		optimize = strings.Split(f.optimize, ",")
+	}
+	var rewrites []string
+	if f.rewrite != "" {
+		rewrites = strings.Split(f.rewrite, ",")
+	}
+	lagAddress, maxLag, err := parseLagCheck(f.lagCheck)
+	if err != nil {
+		return nil, err
+	}
+	address := f.conn.address()
+	var targets map[string]common.LoadTarget
+	placement := f.placement
+	if f.targets != "" {
+		if f.conn.host != "" {
+			return nil, fmt.Errorf("-h and -targets can not be set together, the first of -targets is the first server")
+		}
+		if address, targets, err = parseTargets(f.targets, f.conn.port, f.conn.user, passwd); err != nil {
+			return nil, err
+		}
+		if placement == "" {
+			placement = common.PlacementRoundRobin
+		}
+	}
+	return &common.LoadArgs{
+		User:                  f.conn.user,
+		Password:              passwd,
+		Address:               address,
+		Targets:               targets,
+		Placement:             placement,
+		PlacementFile:         f.placeFile,
+		Outdir:                f.dir,
+		Volumes:               f.volumes,
+		Threads:               f.threads,
+		SchemaThreads:         f.schemaThreads(),
+		DataThreads:           f.dataThreads,
+		PostThreads:           f.postThreads,
+		ReadOnlyMaxWait:       f.roMaxWait,
+		IntervalMs:            10 * 1000,
+		TxnBatchSize:          f.txnBatchSize,
+		SmallFileBatch:        f.smallBatch,
+		SmallFileMaxBytes:     f.smallMax,
+		TxnMaxStatements:      f.txnMaxStmts,
+		TxnMaxTimeMs:          f.txnMaxTime,
+		Compat:                f.compat,
+		SchemaVersion:         f.version,
+		Filter:                filter,
+		RecentChunks:          f.recent,
+		Replacements:          f.replace,
+		Rewrites:              rewrites,
+		UpgradeCharset:        f.upgrade,
+		UpgradeCollations:     f.collations,
+		UpgradeKeyBytes:       f.keyBytes,
+		DefaultCollation:      f.collation,
+		ForceTableCollation:   f.tableColl,
+		ForceEngine:           f.engine,
+		SkipCheckConstraints:  f.skipChecks,
+		KeepTablespaceOptions: !f.stripTbsp,
+		TuneTarget:            string(f.tune),
+		Lock:                  f.lock,
+		ForceLock:             f.forceLock,
+		MetricsListen:         f.metrics,
+		StatusListen:          f.status,
+		StatusToken:           f.statusToken,
+		ProgressFile:          f.progress,
+		ExpectTables:          expect,
+		Files:                 files,
+		AllowPipes:            f.pipes,
+		PipeReopenCommand:     f.pipeReopen,
+		RollbackFile:          f.rollbackFile,
+		ResumeFile:            f.resumeFile,
+		Resume:                f.resume,
+		MaxRuntime:            f.maxRuntime,
+		MaxRuntimeGrace:       f.runtimeGrace,
+		AllowPartialDump:      f.partial,
+		AllowSmoke:            f.allowSmoke,
+		LogSQL:                f.logSQL,
+		UsePrepared:           f.prepared,
+		ManagedMode:           f.managed,
+		RewriteDefiners:       f.definers,
+		DefinerUser:           f.definerUser,
+		Grants:                f.grants,
+		GrantsExisting:        f.grantsExist,
+		LogSQLMaxBytes:        f.logSQLMax,
+		CaptureWarnings:       f.captureWarn,
+		WarningMessages:       f.warnMessages,
+		WarningsAsErrors:      f.warnErrors,
+		WarningsThreshold:     f.warnMax,
+		CheckUTF8:             f.checkUTF8,
+		WarmTables:            warm,
+		WarmThreads:           f.warmThreads,
+		OptimizeTables:        optimize,
+		OptimizeThreads:       f.optThreads,
+		PostSQL:               f.postSQL,
+		PostSQLOnFailure:      f.postFailSQL,
+		PostSQLDatabase:       f.postSQLDB,
+
+		PreserveAutoIncrement: f.autoInc,
+		AllowVersionDowngrade: f.downgrade,
+		FailOnIncompat:        f.incompat,
+		VerifyChecksums:       f.checksums,
+		VerifyFileTrailers:    f.trailers,
+		VerifySchema:          f.verifySchema,
+		DeferConstraints:      f.deferChecks,
+		CheckTables:           f.checkTables,
+		SkipPrivilegedSets:    f.skipSets,
+		SkipBinlog:            f.skipBinlog,
+		CreateIfNotExists:     f.ifNotExists,
+		OverwriteTables:       f.overwrite,
+		TablePrefix:           f.tablePrefix,
+		TableSuffix:           f.tableSuffix,
+		ExpandSource:          f.expandSource,
+		Upsert:                f.upsert,
+		Incrementals:          f.incrementals,
+		FillMissingColumns:    f.fill,
+		FillValues:            f.fillValues,
+		ShuffleSeed:           f.seed,
+		MaxThreadsPerDatabase: f.perDatabase,
+		TableThreads:          f.perTable,
+		MaxInFlightBytes:      f.inFlight,
+		MaxMemory:             f.maxMemory,
+		MaxOpenFiles:          f.openFiles,
+		MaxBytesPerSec:        f.bytesPerSec,
+		MaxRowsPerSec:         f.rowsPerSec,
+		ReplicaLagAddress:     lagAddress,
+		MaxReplicaLag:         maxLag,
+		PreTableHookCommand:   f.preHook,
+		PostTableHookCommand:  f.postHook,
+	}, nil
+}
+
+func runLoad(s *session, argv []string) error {
+	f := &loadFlags{}
+	f.register(s.fs)
+	if err := s.parse(argv, f.missing); err != nil {
+		return err
+	}
+
+	if f.rollback != "" {
+		return runRollback(s, f)
+	}
+	args, err := f.args(s.log)
+	if err != nil {
+		return usageError(err)
+	}
+	if err := args.Validate(); err != nil {
+		return err
+	}
+	report, err := common.NewLoader(common.LoadConfig{LoadArgs: *args, Log: s.log}).Run(s.ctx)
+	common.LogReport(s.log, report)
+	return err
+}
+
+// runRollback runs the drops of the -rollback file once the user typed yes,
+// or with -yes.
+func runRollback(s *session, f *loadFlags) error {
+	drops, err := common.ReadRollbackFile(f.rollback)
+	if err != nil {
+		return err
+	}
+	if len(drops) == 0 {
+		s.log.Info("rollback.file[%s].has.no.objects", f.rollback)
+		return nil
+	}
+	if !f.yes {
+		fmt.Fprintf(Output, "The rollback drops on %s:\n", f.conn.address())
+		for _, drop := range drops {
+			fmt.Fprintf(Output, "  %s\n", drop)
+		}
+		fmt.Fprintf(Output, "Type 'yes' to drop them: ")
+		answer, _ := bufio.NewReader(Input).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			return errors.New("rollback cancelled, nothing dropped")
+		}
+	}
+	args, err := f.args(s.log)
+	if err != nil {
+		return usageError(err)
+	}
+	return common.Rollback(s.log, args, drops)
+}
+
+// readFilterFile reads the -filter expression of file, its lines but the
+// comments, which start with a #.
+func readFilterFile(file string) (string, error) {
+	data, err := common.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
@@ -0,0 +1,97 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+)
+
+var migrateCommand = &Command{
+	Name:  "migrate",
+	Short: "Dump a database from a source server and restore it into a target server",
+	Usage: "-h [HOST] -u [USER] -db [DATABASE] (-o [WORKDIR] | -pipe) -to-h [HOST] -to-u [USER]",
+	Run:   runMigrate,
+}
+
+// migrateFlags are the dump flags for the source plus the target connection flags.
+type migrateFlags struct {
+	dump   dumpFlags
+	target connFlags
+	pipe   bool
+}
+
+func (f *migrateFlags) missing() []string {
+	var missing []string
+	for _, name := range f.dump.missing() {
+		// A pipe has no work directory.
+		if name == "-o" && f.pipe {
+			continue
+		}
+		missing = append(missing, name)
+	}
+	return append(missing, f.target.missing()...)
+}
+
+func runMigrate(s *session, argv []string) error {
+	f := &migrateFlags{}
+	f.dump.register(s.fs)
+	f.target.register(s.fs, "to-", "load on the target")
+	s.fs.BoolVar(&f.pipe, "pipe", false, "Restore every file on the target as soon as it is dumped, in memory, instead of through the -o work directory")
+	if err := s.parse(argv, f.missing); err != nil {
+		return err
+	}
+
+	dumpArgs, err := f.dump.args(s.log)
+	if err != nil {
+		return usageError(err)
+	}
+	passwd, err := f.target.password(s.log)
+	if err != nil {
+		return usageError(err)
+	}
+	loadArgs := &common.LoadArgs{
+		User:          f.target.user,
+		Password:      passwd,
+		Address:       f.target.address(),
+		Outdir:        dumpArgs.Outdir,
+		Threads:       dumpArgs.Threads,
+		IntervalMs:    dumpArgs.IntervalMs,
+		MetricsListen: dumpArgs.MetricsListen,
+		StatusListen:  dumpArgs.StatusListen,
+		StatusToken:   dumpArgs.StatusToken,
+		ProgressFile:  dumpArgs.ProgressFile,
+	}
+
+	if f.pipe {
+		// One server for the metrics and the status, the ones of the restore.
+		dumpArgs.MetricsListen, dumpArgs.StatusListen, dumpArgs.StatusToken = "", "", ""
+		report, err := common.NewCopier(common.CopyConfig{Dump: *dumpArgs, Load: *loadArgs, Log: s.log}).Run(s.ctx)
+		common.LogReport(s.log, report.Dump)
+		common.LogReport(s.log, report.Load)
+		return err
+	}
+	if err := dumpArgs.Validate(); err != nil {
+		return err
+	}
+	// The dump directory is checked by the dump, it may be created by it.
+	check := *loadArgs
+	check.Outdir = "mem://"
+	if err := check.Validate(); err != nil {
+		return err
+	}
+	report, err := common.NewDumper(common.DumpConfig{DumpArgs: *dumpArgs, Log: s.log}).Run(s.ctx)
+	common.LogReport(s.log, report)
+	if err != nil {
+		return err
+	}
+	report, err = common.NewLoader(common.LoadConfig{LoadArgs: *loadArgs, Log: s.log}).Run(s.ctx)
+	common.LogReport(s.log, report)
+	return err
+}
@@ -0,0 +1,212 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// profile is a named bundle of the flags of a command, for -profile.
+type profile struct {
+	// command is the command of the flags, inherited from extends.
+	command string
+	// extends is the profile whose flags come first.
+	extends string
+	// flags are the 'name=value' of the flags, in their order: a repeatable
+	// flag may be there more than once.
+	flags [][2]string
+	// requires are the flags, without their '-', the run must set.
+	requires []string
+	// about is what a built-in profile is for, in the -help.
+	about string
+}
+
+// builtinProfiles are the profiles shipped, a -config file may extend or
+// replace them.
+var builtinProfiles = map[string]*profile{
+	"replica-seed": {
+		command: "dump",
+		flags:   [][2]string{{"consistency", "lock"}},
+		about:   "dump all the tables at one point with its binlog coordinates and GTID set in the metadata, to seed a replica",
+	},
+	"staging-refresh": {
+		command:  "load",
+		flags:    [][2]string{{"overwrite-tables", "true"}, {"skip-binlog", "true"}},
+		requires: []string{"replace"},
+		about:    "replace the tables of a staging server without writing its binlog, the values masked by -replace",
+	},
+	"dev-sample": {
+		command: "load",
+		flags:   [][2]string{{"recent-chunks", "1"}},
+		about:   "restore every schema and the last data file of every table, a sample for a developer",
+	},
+}
+
+// profileHelp returns the built-in profiles for the -help, 'name (command:
+// about)'.
+func profileHelp() string {
+	var help []string
+	for _, name := range builtinProfileNames() {
+		p := builtinProfiles[name]
+		help = append(help, fmt.Sprintf("%s (%s: %s)", name, p.command, p.about))
+	}
+	return strings.Join(help, "; ")
+}
+
+// readProfiles reads the profiles of a -config file, in '[name]' sections of
+// 'flag = value' lines, the flag without its '-'. The keys 'command',
+// 'extends' and 'requires', a comma separated list of flags, describe the
+// profile. The empty lines and the ones starting with '#' are skipped.
+func readProfiles(path string) (map[string]*profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	profiles := make(map[string]*profile)
+	var p *profile
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+			continue
+		case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+			name := strings.TrimSpace(text[1 : len(text)-1])
+			if name == "" {
+				return nil, fmt.Errorf("config %s line %d: a profile needs a name", path, line)
+			}
+			if _, ok := profiles[name]; ok {
+				return nil, fmt.Errorf("config %s line %d: profile %q is defined twice", path, line, name)
+			}
+			p = &profile{}
+			profiles[name] = p
+			continue
+		}
+		i := strings.Index(text, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("config %s line %d: %q is not 'flag = value'", path, line, text)
+		}
+		if p == nil {
+			return nil, fmt.Errorf("config %s line %d: %q is before the first [profile]", path, line, text)
+		}
+		key := strings.TrimPrefix(strings.TrimSpace(text[:i]), "-")
+		value := strings.TrimSpace(text[i+1:])
+		switch key {
+		case "command":
+			p.command = value
+		case "extends":
+			p.extends = value
+		case "requires":
+			for _, name := range strings.Split(value, ",") {
+				if name = strings.TrimPrefix(strings.TrimSpace(name), "-"); name != "" {
+					p.requires = append(p.requires, name)
+				}
+			}
+		default:
+			p.flags = append(p.flags, [2]string{key, value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return profiles, nil
+}
+
+// resolveProfile returns the profile name of profiles, or of the built-in
+// ones, with the flags and the requires of the profiles it extends first.
+func resolveProfile(profiles map[string]*profile, name string) (*profile, error) {
+	resolved := &profile{}
+	var chain []string
+	for next := name; next != ""; {
+		for _, seen := range chain {
+			if seen == next {
+				return nil, fmt.Errorf("profile %q extends itself: %s", name, strings.Join(append(chain, next), " -> "))
+			}
+		}
+		chain = append(chain, next)
+		p, ok := profiles[next]
+		if !ok {
+			if p, ok = builtinProfiles[next]; !ok {
+				return nil, fmt.Errorf("profile %q is not defined, the built-in ones are %s", next, strings.Join(builtinProfileNames(), ", "))
+			}
+		}
+		if resolved.command == "" {
+			resolved.command = p.command
+		}
+		resolved.flags = append(append([][2]string(nil), p.flags...), resolved.flags...)
+		resolved.requires = append(append([]string(nil), p.requires...), resolved.requires...)
+		next = p.extends
+	}
+	return resolved, nil
+}
+
+// builtinProfileNames returns the names of the built-in profiles, sorted.
+func builtinProfileNames() []string {
+	names := make([]string, 0, len(builtinProfiles))
+	for name := range builtinProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyProfile sets the flags of the -profile of the session the command
+// line didn't set, so the explicit flags win, then checks the flags the
+// profile requires are set.
+func (s *session) applyProfile() error {
+	if s.profile == "" {
+		if s.config != "" {
+			return fmt.Errorf("-config is only read with -profile, it has the profiles")
+		}
+		return nil
+	}
+	profiles := make(map[string]*profile)
+	if s.config != "" {
+		var err error
+		if profiles, err = readProfiles(s.config); err != nil {
+			return err
+		}
+	}
+	p, err := resolveProfile(profiles, s.profile)
+	if err != nil {
+		return err
+	}
+	if p.command != s.command {
+		return fmt.Errorf("profile %q is for the %s command, not %s", s.profile, p.command, s.command)
+	}
+	set := make(map[string]bool)
+	s.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, kv := range p.flags {
+		if set[kv[0]] {
+			continue
+		}
+		if err := s.fs.Set(kv[0], kv[1]); err != nil {
+			return fmt.Errorf("profile %q sets -%s=%s: %v", s.profile, kv[0], kv[1], err)
+		}
+	}
+	s.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var missing []string
+	for _, name := range p.requires {
+		if !set[name] {
+			missing = append(missing, "-"+name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("profile %q needs %s", s.profile, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+)
+
+var pruneCommand = &Command{
+	Name:  "prune",
+	Short: "Delete the dump runs of a directory past the expiry of their manifest, a dry run without -confirm",
+	Usage: "-d [DIR] [-confirm]",
+	Run:   runPrune,
+}
+
+func runPrune(s *session, argv []string) error {
+	args := common.PruneArgs{}
+	s.fs.StringVar(&args.Dir, "d", "", "Directory of the dump runs, a sub directory each, or the location of its storage")
+	s.fs.BoolVar(&args.Confirm, "confirm", false, "Delete the expired runs, without it they are only reported")
+	missing := func() []string {
+		if args.Dir == "" {
+			return []string{"-d"}
+		}
+		return nil
+	}
+	if err := s.parse(argv, missing); err != nil {
+		return err
+	}
+	report, err := common.Prune(s.log, args)
+	if report != nil {
+		report.WriteReport(Output)
+	}
+	return err
+}
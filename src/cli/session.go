@@ -0,0 +1,117 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// session is one run of a command: its flag set and the log configured by the flags.
+type session struct {
+	// ctx is cancelled by SIGINT or SIGTERM, see signalContext.
+	ctx     context.Context
+	log     *xlog.Log
+	fs      *flag.FlagSet
+	file    *os.File
+	command string
+
+	version   bool
+	logLevel  string
+	logFile   string
+	logFormat string
+	profile   string
+	config    string
+}
+
+func newSession(log *xlog.Log, prog string, cmd *Command) *session {
+	fs := flag.NewFlagSet(prog+" "+cmd.Name, flag.ContinueOnError)
+	fs.SetOutput(Output)
+	fs.Usage = func() {
+		fmt.Fprintf(Output, "Usage: %s %s %s\n", prog, cmd.Name, cmd.Usage)
+		fs.PrintDefaults()
+	}
+	return &session{ctx: context.Background(), log: log, fs: fs, command: cmd.Name}
+}
+
+// parse parses argv into the flag set, applies the -profile, sets up the log
+// and checks the required flags. Every command gets the -version, -profile,
+// -config and -log-* flags.
+func (s *session) parse(argv []string, missing func() []string) error {
+	s.fs.BoolVar(&s.version, "version", false, "Print the version and the build metadata")
+	s.fs.StringVar(&s.logLevel, "log-level", "", "Log level: debug|info|warn|error, debug adds the per file progress, warn shows only problems and the final summary (default info)")
+	s.fs.StringVar(&s.logFile, "log-file", "", "Append the log to this file instead of stdout, fatal errors still go to stderr")
+	s.fs.StringVar(&s.logFormat, "log-format", "", "Log format: text|json, json writes one object per line with stable field names (default text)")
+	s.fs.StringVar(&s.profile, "profile", "", "Run with the flags of this profile of -config, or of a built-in one, the flags given win: "+profileHelp())
+	s.fs.StringVar(&s.config, "config", "", "Read the -profile from this file of [name] sections of 'flag = value' lines, with 'extends = profile' and 'requires = flag,...'")
+	if err := s.fs.Parse(argv); err != nil {
+		return usageError(err)
+	}
+	if s.version {
+		fmt.Fprintln(Output, common.VersionString())
+		return flag.ErrHelp
+	}
+	if err := s.applyProfile(); err != nil {
+		return usageError(err)
+	}
+	if err := s.openLog(); err != nil {
+		return usageError(err)
+	}
+	if s.profile != "" {
+		s.log.Info("%s.profile[%s]", s.command, s.profile)
+	}
+	if s.fs.NArg() > 0 {
+		return usageError(fmt.Errorf("unexpected arguments: %s", strings.Join(s.fs.Args(), " ")))
+	}
+	if m := missing(); len(m) > 0 {
+		s.fs.Usage()
+		return usageError(errors.New("missing required flags: " + strings.Join(m, ", ")))
+	}
+	return nil
+}
+
+// openLog replaces the default log if any of the -log-* flags is set.
+func (s *session) openLog() error {
+	if s.logLevel == "" && s.logFile == "" && s.logFormat == "" {
+		return nil
+	}
+	var w io.Writer = os.Stdout
+	if s.logFile != "" {
+		f, err := os.OpenFile(s.logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		s.file = f
+		w = f
+	}
+	log, err := common.NewLog(w, s.logLevel, s.logFormat)
+	if err != nil {
+		return err
+	}
+	s.log = log
+	return nil
+}
+
+// close flushes and closes the log file.
+func (s *session) close() {
+	if s.file != nil {
+		s.file.Sync()
+		s.file.Close()
+		s.file = nil
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package cli
+
+import (
+	"common"
+)
+
+var verifyCommand = &Command{
+	Name:  "verify",
+	Short: "Check the layout of a dump directory without connecting to a server, or its restored schemas with -verify-schema",
+	Usage: "-d [DIR] [-verify-schema -h [HOST] -u [USER]]",
+	Run:   runVerify,
+}
+
+func runVerify(s *session, argv []string) error {
+	var dir string
+	var schema bool
+	var threads int
+	var tablePrefix, tableSuffix string
+	var conn connFlags
+	s.fs.StringVar(&dir, "d", "", "Directory of the dump to verify")
+	s.fs.BoolVar(&schema, "verify-schema", false, "Compare the SHOW CREATE TABLE of the tables restored on the server with the schema files of the dump, instead of checking the layout")
+	s.fs.IntVar(&threads, "t", 4, "Number of tables compared at once by -verify-schema")
+	s.fs.StringVar(&tablePrefix, "table-prefix", "", "The -table-prefix the dump was restored with, -verify-schema compares the table t with <prefix>t")
+	s.fs.StringVar(&tableSuffix, "table-suffix", "", "The -table-suffix the dump was restored with, like -table-prefix")
+	conn.register(s.fs, "", "SHOW CREATE TABLE of -verify-schema")
+	missing := func() []string {
+		var missing []string
+		if dir == "" {
+			missing = append(missing, "-d")
+		}
+		if schema {
+			missing = append(missing, conn.missing()...)
+		}
+		return missing
+	}
+	if err := s.parse(argv, missing); err != nil {
+		return err
+	}
+	if !schema {
+		return common.Verify(s.log, dir)
+	}
+	passwd, err := conn.password(s.log)
+	if err != nil {
+		return err
+	}
+	return common.VerifySchema(s.ctx, s.log, common.LoadArgs{Outdir: dir, Address: conn.address(), User: conn.user, Password: passwd, Threads: threads, TablePrefix: tablePrefix, TableSuffix: tableSuffix})
+}
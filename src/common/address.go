@@ -0,0 +1,100 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the port of an address given without one.
+const DefaultPort = 3306
+
+// ParseAddress returns the host:port of an address given as 'host',
+// 'host:port', '[v6::addr]:port', '[v6::addr]' or a bare IPv6 literal like
+// '::1', the ones without a port get port. A host name is kept as it is, not
+// resolved: the driver tries the IPs it resolves to in order. The error says
+// what is wrong with the address, like a port which is not a number.
+func ParseAddress(address string, port int) (string, error) {
+	a := strings.TrimSpace(address)
+	if a == "" {
+		return "", fmt.Errorf("address is required")
+	}
+	host, p, hasPort := a, "", false
+	switch {
+	case strings.HasPrefix(a, "["):
+		end := strings.Index(a, "]")
+		if end < 0 {
+			return "", fmt.Errorf("address %q has no closing ']'", address)
+		}
+		host = a[1:end]
+		switch rest := a[end+1:]; {
+		case rest == "":
+		case strings.HasPrefix(rest, ":"):
+			p, hasPort = rest[1:], true
+		default:
+			return "", fmt.Errorf("address %q has %q after ']', it must be '[v6::addr]:port'", address, rest)
+		}
+		if !isIPv6(host) {
+			return "", fmt.Errorf("address %q has %q in brackets which is not an IPv6 address", address, host)
+		}
+	case strings.Count(a, ":") > 1:
+		// A bare IPv6 literal, its port can only be given apart.
+		if !isIPv6(a) {
+			return "", fmt.Errorf("address %q is not host:port nor an IPv6 address, an IPv6 address with a port must be '[v6::addr]:port'", address)
+		}
+	case strings.Contains(a, ":"):
+		i := strings.Index(a, ":")
+		host, p, hasPort = a[:i], a[i+1:], true
+	}
+	if host == "" {
+		return "", fmt.Errorf("address %q has no host", address)
+	}
+	if i := strings.IndexFunc(host, func(r rune) bool { return r <= ' ' || strings.ContainsRune("/@,[]", r) }); i >= 0 {
+		return "", fmt.Errorf("address %q has an invalid character %q in its host", address, host[i])
+	}
+	if hasPort {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("address %q has an invalid port, it must be between 1 and 65535", address)
+		}
+		port = n
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// isIPv6 reports whether s is an IPv6 address, with an optional zone like
+// 'fe80::1%eth0'.
+func isIPv6(s string) bool {
+	if i := strings.Index(s, "%"); i > 0 {
+		s = s[:i]
+	}
+	return strings.Contains(s, ":") && net.ParseIP(s) != nil
+}
+
+// parseAddresses returns the host:port of the addresses of a comma
+// separated list, see SplitAddresses and ParseAddress.
+func parseAddresses(address string) ([]string, error) {
+	split := SplitAddresses(address)
+	if len(split) == 0 {
+		return nil, fmt.Errorf("address is required")
+	}
+	addresses := make([]string, 0, len(split))
+	for _, a := range split {
+		parsed, err := ParseAddress(a, DefaultPort)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, parsed)
+	}
+	return addresses, nil
+}
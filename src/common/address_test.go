@@ -0,0 +1,72 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAddress(t *testing.T) {
+	for _, tc := range []struct {
+		address string
+		port    int
+		want    string
+		err     string
+	}{
+		{address: "127.0.0.1:3306", port: DefaultPort, want: "127.0.0.1:3306"},
+		{address: "db1", port: DefaultPort, want: "db1:3306"},
+		{address: " db1 ", port: 3307, want: "db1:3307"},
+		{address: "db1:3310", port: 3307, want: "db1:3310"},
+		{address: "[::1]:3310", port: DefaultPort, want: "[::1]:3310"},
+		{address: "[::1]", port: 3307, want: "[::1]:3307"},
+		{address: "::1", port: 3307, want: "[::1]:3307"},
+		{address: "2001:db8::10", port: DefaultPort, want: "[2001:db8::10]:3306"},
+		{address: "fe80::1%eth0", port: DefaultPort, want: "[fe80::1%eth0]:3306"},
+
+		{address: "", err: "address is required"},
+		{address: ":3306", err: `address ":3306" has no host`},
+		{address: "db1:", err: `address "db1:" has an invalid port, it must be between 1 and 65535`},
+		{address: "db1:mysql", err: `address "db1:mysql" has an invalid port, it must be between 1 and 65535`},
+		{address: "db1:65536", err: `address "db1:65536" has an invalid port, it must be between 1 and 65535`},
+		{address: "db1:3306:1", err: `address "db1:3306:1" is not host:port nor an IPv6 address, an IPv6 address with a port must be '[v6::addr]:port'`},
+		{address: "::1:3306:x", err: `address "::1:3306:x" is not host:port nor an IPv6 address, an IPv6 address with a port must be '[v6::addr]:port'`},
+		{address: "[::1", err: `address "[::1" has no closing ']'`},
+		{address: "[::1]3306", err: `address "[::1]3306" has "3306" after ']', it must be '[v6::addr]:port'`},
+		{address: "[db1]:3306", err: `address "[db1]:3306" has "db1" in brackets which is not an IPv6 address`},
+		{address: "root@db1", err: `address "root@db1" has an invalid character '@' in its host`},
+		{address: "mysql://db1", err: `address "mysql://db1" has an invalid port, it must be between 1 and 65535`},
+	} {
+		got, err := ParseAddress(tc.address, tc.port)
+		if tc.err != "" {
+			assert.NotNil(t, err, tc.address)
+			if err != nil {
+				assert.Equal(t, tc.err, err.Error())
+			}
+			continue
+		}
+		assert.Nil(t, err, tc.address)
+		assert.Equal(t, tc.want, got, tc.address)
+	}
+}
+
+func TestParseAddressesResolving(t *testing.T) {
+	// A name which resolves to several IPs, like localhost to 127.0.0.1 and
+	// ::1, stays one address: the driver tries its IPs in order.
+	addresses, err := parseAddresses("localhost,[::1]:3307")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"localhost:3306", "[::1]:3307"}, addresses)
+
+	_, err = parseAddresses(" , ")
+	assert.NotNil(t, err)
+	_, err = parseAddresses("db1,db2:x")
+	assert.Equal(t, `address "db2:x" has an invalid port, it must be between 1 and 65535`, err.Error())
+}
@@ -0,0 +1,505 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The Report.Status of a run.
+const (
+	RunOK     = "ok"
+	RunFailed = "failed"
+	// RunCancelled is the status of a run stopped by its context.
+	RunCancelled = "cancelled"
+	// RunPartial is the status of a run stopped by its MaxRuntime, see
+	// PartialError.
+	RunPartial = "partial"
+)
+
+// runStatus returns the Report.Status of a run which returned err.
+func runStatus(err error) string {
+	switch {
+	case err == nil:
+		return RunOK
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		return RunCancelled
+	}
+	if _, ok := err.(*PartialError); ok {
+		return RunPartial
+	}
+	return RunFailed
+}
+
+// DumpConfig is the configuration of a Dumper.
+type DumpConfig struct {
+	DumpArgs
+
+	// Log is the log of the run, nil logs to stderr at the info level.
+	Log *xlog.Log
+}
+
+// LoadConfig is the configuration of a Loader.
+type LoadConfig struct {
+	LoadArgs
+
+	// Log is the log of the run, nil logs to stderr at the info level.
+	Log *xlog.Log
+
+	// PreTableHook is called before the first data file of every table is
+	// restored, after the LoadArgs.PreTableHookCommand. An error skips the
+	// table, its files are counted as failed and the run fails once done.
+	// The other files of the table wait for it.
+	PreTableHook TableHook
+	// PostTableHook is called once the data files of a table which passed its
+	// pre-table hook are all restored, or the restore stopped, after the
+	// LoadArgs.PostTableHookCommand. An error fails the run once done.
+	PostTableHook TableHook
+	// PipeReopenHook is called before a data file which is a named pipe is
+	// read again, after the LoadArgs.PipeReopenCommand, with HookReopen: it
+	// must feed the pipe again. An error fails the file.
+	PipeReopenHook TableHook
+	// Rewriters are called in order on every statement of their kind before
+	// it's executed, after the LoadArgs.Rewrites. An error fails the file.
+	Rewriters map[StatementKind][]Rewriter
+	// OnProgress is called every LoadArgs.IntervalMs while the data files are
+	// restored, with the progress line, from a single goroutine: never twice
+	// at once, but while the threads restore, so a slow callback only delays
+	// its next call. It's not called for the schemas nor once the data files
+	// are all done, the Report tells the end. An error stops the restore as a
+	// cancel of the context: no file is started, the ones being restored are
+	// stopped and Run returns once they all returned, with the error, or
+	// context.Canceled for ErrCancel.
+	OnProgress ProgressFunc
+	// Executor returns the executors of the connections of the restore
+	// instead of dialing LoadArgs.Address, like mocks in a test, the
+	// LoadArgs.Address and User are still validated. Nil dials the server.
+	Executor ExecutorFunc
+	// Classifier routes the tables to the LoadArgs.Targets, it's required
+	// with them unless the LoadArgs.Placement routes the databases.
+	Classifier TableClassifier
+	// Filter restores only the tables of the dump it returns true for, and
+	// LoadArgs.Filter holds for: the escape hatch of the expressions, called
+	// once per table before any statement.
+	Filter TableFilter
+}
+
+// Report is the outcome of a run, the figures of the summary lines and of /status.
+type Report struct {
+	Mode   string `json:"mode"`
+	RunID  string `json:"run_id"`
+	Status string `json:"status"`
+	// Target is the LoadArgs.Targets name of the report of a target.
+	Target string `json:"target,omitempty"`
+	// Error is the error of a failed run.
+	Error          string              `json:"error,omitempty"`
+	ElapsedSeconds float64             `json:"elapsed_seconds"`
+	Bytes          uint64              `json:"bytes"`
+	Rows           uint64              `json:"rows,omitempty"`
+	TablesDone     uint64              `json:"tables_done,omitempty"`
+	TablesTotal    uint64              `json:"tables_total,omitempty"`
+	FilesDone      uint64              `json:"files_done"`
+	FilesFailed    uint64              `json:"files_failed"`
+	FilesTotal     uint64              `json:"files_total"`
+	PhaseSeconds   map[string]float64  `json:"phase_seconds"`
+	Threads        []ThreadUtilization `json:"threads"`
+	Errors         []string            `json:"recent_errors"`
+	// ErrorCategory is the ErrorCategory of the Error of a failed run,
+	// FailureCategories count its failed files by category.
+	ErrorCategory     ErrorCategory            `json:"error_category,omitempty"`
+	FailureCategories map[ErrorCategory]uint64 `json:"failure_categories,omitempty"`
+	// ThrottledSeconds is the time the threads of a load waited with files
+	// left, all of databases at LoadArgs.MaxThreadsPerDatabase or of tables
+	// at their LoadArgs.TableThreads, or the time a dump was paused by
+	// DumpArgs.MaxReplicaLag.
+	ThrottledSeconds float64 `json:"throttled_seconds,omitempty"`
+	// LagPausedSeconds is the time the dispatch of the data files of a load
+	// was paused by LoadArgs.MaxReplicaLag.
+	LagPausedSeconds float64 `json:"lag_paused_seconds,omitempty"`
+	// FilesOnly are the only data files of a load with LoadArgs.Files, a
+	// partial restore of the dump.
+	FilesOnly []string `json:"files_only,omitempty"`
+	// Hooks are the runs of the table hooks of a load by hook, "pre_table",
+	// "post_table" and "pipe_reopen", none if it has no hooks.
+	Hooks map[string]HookStats `json:"hooks,omitempty"`
+	// WarmSeconds are the warm-up durations of the LoadArgs.WarmTables by
+	// 'db.table', WarmSkipped the tables not warmed as the phase was skipped.
+	WarmSeconds map[string]float64 `json:"warm_seconds,omitempty"`
+	WarmSkipped []string           `json:"warm_skipped,omitempty"`
+	// OptimizeSeconds are the rebuild durations of the LoadArgs.OptimizeTables
+	// by 'db.table', OptimizeFailed the tables which failed to rebuild.
+	OptimizeSeconds map[string]float64 `json:"optimize_seconds,omitempty"`
+	OptimizeFailed  []string           `json:"optimize_failed,omitempty"`
+	// Warnings count the warnings of the data statements of a load by level
+	// and code, like 'Warning 1265', with LoadArgs.CaptureWarnings.
+	Warnings map[string]uint64 `json:"warnings,omitempty"`
+	// TableWarnings are the same by 'db.table', with their first
+	// LoadArgs.WarningMessages in full.
+	TableWarnings map[string]TableWarnings `json:"table_warnings,omitempty"`
+	// EncodingProblems count the values of the utf8 columns of a load which
+	// aren't valid UTF-8, 'invalid utf8', or look double encoded, 'double
+	// encoded', with LoadArgs.CheckUTF8.
+	EncodingProblems map[string]uint64 `json:"encoding_problems,omitempty"`
+	// Reconnects are the connections of a load connected again once their
+	// server went away, Failovers the times they moved to another address of
+	// the LoadArgs.Address.
+	Reconnects uint64 `json:"reconnects,omitempty"`
+	Failovers  uint64 `json:"failovers,omitempty"`
+	// SmallFileBatches are the LoadArgs.SmallFileBatch batches of a load
+	// restored, SmallFiles their data files.
+	SmallFileBatches uint64 `json:"small_file_batches,omitempty"`
+	SmallFiles       uint64 `json:"small_files,omitempty"`
+	// EmptyTableMarkers and EmptyFiles are the data files of a load of only
+	// a header and of no statement, not restored, SuspiciousFiles the ones of
+	// either kind of the tables the manifest counts rows for.
+	EmptyTableMarkers uint64   `json:"empty_table_markers,omitempty"`
+	EmptyFiles        uint64   `json:"empty_files,omitempty"`
+	SuspiciousFiles   []string `json:"suspicious_files,omitempty"`
+	// TablesWithoutSnapshot are the tables of a dump read without a
+	// snapshot, see TableNoSnapshot.
+	TablesWithoutSnapshot uint64 `json:"tables_without_snapshot,omitempty"`
+	// Smoke are the outcomes of the tables of a dump with
+	// DumpArgs.SmokeTest, by table.
+	Smoke []SmokeTable `json:"smoke,omitempty"`
+	// PhaseThreads are the threads of the phases of a load and the most
+	// connections each had working at once, in their order.
+	PhaseThreads []PhaseThreads `json:"phase_threads,omitempty"`
+	// PostSQL are the runs of the LoadArgs.PostSQL and PostSQLOnFailure
+	// scripts of a load, in order.
+	PostSQL []PostSQLRun `json:"post_sql,omitempty"`
+	// NotAttempted, Interrupted and SkippedPhases are what a run stopped by
+	// its MaxRuntime did not do, see PartialError.
+	NotAttempted  []string `json:"not_attempted,omitempty"`
+	Interrupted   []string `json:"interrupted,omitempty"`
+	SkippedPhases []string `json:"skipped_phases,omitempty"`
+	// Targets are the reports of the targets of a load with
+	// LoadArgs.Targets by name, the bytes, files and errors of the report
+	// are their sums.
+	Targets map[string]Report `json:"targets,omitempty"`
+}
+
+// Dumper dumps a database into a directory, see NewDumper.
+type Dumper struct {
+	cfg DumpConfig
+}
+
+// NewDumper creates a Dumper, cfg is copied.
+func NewDumper(cfg DumpConfig) *Dumper {
+	return &Dumper{cfg: cfg}
+}
+
+// Run validates the configuration and dumps the database. The report is
+// filled in even when the run fails, with the status RunFailed and the error.
+// Once ctx is done no table is started and the connections are closed, which
+// stops the tables being dumped, Run returns ctx.Err() when they have all
+// returned and the status is RunCancelled. A run stopped by its MaxRuntime
+// returns a *PartialError and the status is RunPartial.
+// Run may be called again, every run starts from the configuration.
+func (d *Dumper) Run(ctx context.Context) (Report, error) {
+	args := d.cfg.DumpArgs
+	log := logOrDefault(d.cfg.Log)
+	args.metrics = newMetrics(log, "dump", nil, &args.allbytes, &args.allrows)
+	// cancel is the POST /cancel of the status.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	args.metrics.cancel = cancel
+	err := args.Validate()
+	if err == nil {
+		err = args.makeOutdir()
+	}
+	if err == nil {
+		err = args.metrics.openProgress(log, args.ProgressFile, time.Duration(args.IntervalMs)*time.Millisecond)
+	}
+	switch {
+	case err != nil:
+	case args.SmokeTest:
+		err = smokeTest(ctx, log, &args)
+	default:
+		err = dump(ctx, log, &args)
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	report := args.metrics.report(err)
+	args.metrics.closeProgress(report)
+	return report, err
+}
+
+// Loader restores a dump directory, see NewLoader.
+type Loader struct {
+	cfg LoadConfig
+}
+
+// NewLoader creates a Loader, cfg is copied.
+func NewLoader(cfg LoadConfig) *Loader {
+	return &Loader{cfg: cfg}
+}
+
+// Run validates the configuration and restores the dump, see Dumper.Run.
+func (l *Loader) Run(ctx context.Context) (Report, error) {
+	args := l.cfg.LoadArgs
+	log := logOrDefault(l.cfg.Log)
+	var bytes uint64
+	args.metrics = newMetrics(log, "load", nil, &bytes, nil)
+	// cancel is the POST /cancel of the status.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	args.metrics.cancel = cancel
+	args.preTableHook = l.cfg.PreTableHook
+	args.postTableHook = l.cfg.PostTableHook
+	args.pipeReopenHook = l.cfg.PipeReopenHook
+	args.rewriters = l.cfg.Rewriters
+	args.onProgress = l.cfg.OnProgress
+	args.executor = l.cfg.Executor
+	args.filter = l.cfg.Filter
+	err := args.Validate()
+	if err == nil && len(args.Targets) > 0 && l.cfg.Classifier == nil && args.Placement == "" {
+		err = fmt.Errorf("restoring.targets.require.a.classifier")
+	}
+	if err == nil && l.cfg.Classifier != nil && args.Placement != "" {
+		err = fmt.Errorf("restoring.classifier.and.placement.can.not.be.set.together")
+	}
+	classify := l.cfg.Classifier
+	if err == nil && args.Placement != "" {
+		classify, err = placeDatabases(log, &args)
+	}
+	if err == nil {
+		err = args.metrics.openProgress(log, args.ProgressFile, time.Duration(args.IntervalMs)*time.Millisecond)
+	}
+	switch {
+	case err != nil:
+	case len(args.Targets) > 0:
+		err = loadTargets(ctx, log, &args, classify)
+	case len(args.Incrementals) > 0:
+		err = loadIncrementals(ctx, log, &args)
+	default:
+		err = load(ctx, log, &args)
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	report := args.metrics.report(err)
+	args.metrics.closeProgress(report)
+	return report, err
+}
+
+func logOrDefault(log *xlog.Log) *xlog.Log {
+	if log == nil {
+		return xlog.NewStdLog(xlog.Level(xlog.INFO))
+	}
+	return log
+}
+
+// report builds the report of the run, err is the error it ended with.
+func (m *Metrics) report(err error) Report {
+	st := m.snapshot()
+	r := Report{
+		Mode:           st.Mode,
+		RunID:          st.RunID,
+		Status:         RunOK,
+		Target:         st.Target,
+		ElapsedSeconds: st.Elapsed,
+		Bytes:          st.BytesDone,
+		TablesDone:     st.TablesDone,
+		TablesTotal:    st.TablesTotal,
+		FilesDone:      st.FilesDone,
+		FilesFailed:    st.FilesFailed,
+		FilesTotal:     st.FilesTotal,
+		PhaseSeconds:   make(map[string]float64),
+		Threads:        st.Threads,
+		Errors:         st.Errors,
+	}
+	if st.RowsDone != nil {
+		r.Rows = *st.RowsDone
+	}
+	r.ThrottledSeconds = time.Duration(atomic.LoadInt64(&m.throttled)).Seconds()
+	r.Reconnects = atomic.LoadUint64(&m.reconnects)
+	r.Failovers = atomic.LoadUint64(&m.failovers)
+	r.SmallFileBatches = atomic.LoadUint64(&m.smallBatches)
+	r.SmallFiles = atomic.LoadUint64(&m.smallFiles)
+	r.EmptyTableMarkers = atomic.LoadUint64(&m.emptyMarkers)
+	r.EmptyFiles = atomic.LoadUint64(&m.emptyFiles)
+	r.TablesWithoutSnapshot = atomic.LoadUint64(&m.noSnapshot)
+	r.Smoke = m.smokeTables()
+	r.PhaseThreads = m.phaseConcurrency()
+	m.mu.Lock()
+	r.SuspiciousFiles = append(r.SuspiciousFiles, m.suspicious...)
+	r.PostSQL = append(r.PostSQL, m.postSQL...)
+	if m.lag != nil && m.mode == "load" {
+		paused, _ := m.lag.pausedFor()
+		r.LagPausedSeconds = paused.Seconds()
+	}
+	r.FilesOnly = m.filesOnly
+	if len(m.failures) > 0 {
+		r.FailureCategories = make(map[ErrorCategory]uint64)
+		for category, n := range m.failures {
+			r.FailureCategories[category] = n
+		}
+	}
+	for phase, seconds := range m.phase {
+		r.PhaseSeconds[phase] = seconds
+	}
+	if len(m.hooks) > 0 {
+		r.Hooks = make(map[string]HookStats)
+		for hook, s := range m.hooks {
+			r.Hooks[hook] = *s
+		}
+	}
+	if len(m.warm) > 0 {
+		r.WarmSeconds = make(map[string]float64)
+		for table, seconds := range m.warm {
+			r.WarmSeconds[table] = seconds
+		}
+	}
+	r.WarmSkipped = append(r.WarmSkipped, m.warmSkips...)
+	if len(m.optimize) > 0 {
+		r.OptimizeSeconds = make(map[string]float64)
+		for table, seconds := range m.optimize {
+			r.OptimizeSeconds[table] = seconds
+		}
+	}
+	r.OptimizeFailed = append(r.OptimizeFailed, m.optimizeFails...)
+	if len(m.warnings) > 0 {
+		r.Warnings = make(map[string]uint64)
+		for kind, n := range m.warnings {
+			r.Warnings[kind] = n
+		}
+		r.TableWarnings = make(map[string]TableWarnings)
+		for table, tw := range m.tableWarnings {
+			counts := make(map[string]uint64)
+			for kind, n := range tw.Counts {
+				counts[kind] = n
+			}
+			r.TableWarnings[table] = TableWarnings{Total: tw.Total, Counts: counts, Messages: append([]string(nil), tw.Messages...)}
+		}
+	}
+	if len(m.encoding) > 0 {
+		r.EncodingProblems = make(map[string]uint64)
+		for kind, n := range m.encoding {
+			r.EncodingProblems[kind] = n
+		}
+	}
+	if len(m.targets) > 0 {
+		r.Targets = make(map[string]Report)
+		for name, t := range m.targets {
+			r.Targets[name] = t
+			r.Bytes += t.Bytes
+			r.FilesDone += t.FilesDone
+			r.FilesFailed += t.FilesFailed
+			r.FilesTotal += t.FilesTotal
+			r.Reconnects += t.Reconnects
+			r.Failovers += t.Failovers
+			r.SmallFileBatches += t.SmallFileBatches
+			r.SmallFiles += t.SmallFiles
+			r.EmptyTableMarkers += t.EmptyTableMarkers
+			r.EmptyFiles += t.EmptyFiles
+			r.SuspiciousFiles = append(r.SuspiciousFiles, t.SuspiciousFiles...)
+			r.PostSQL = append(r.PostSQL, t.PostSQL...)
+			r.Errors = append(r.Errors, t.Errors...)
+			for category, n := range t.FailureCategories {
+				if r.FailureCategories == nil {
+					r.FailureCategories = make(map[ErrorCategory]uint64)
+				}
+				r.FailureCategories[category] += n
+			}
+		}
+	}
+	m.mu.Unlock()
+	if err != nil {
+		r.Status = runStatus(err)
+		if partial, ok := err.(*PartialError); ok {
+			r.Status = RunPartial
+			r.NotAttempted = partial.NotAttempted
+			r.Interrupted = partial.Interrupted
+			r.SkippedPhases = partial.SkippedPhases
+		}
+		r.Error = err.Error()
+		r.ErrorCategory = ErrorCategoryOf(err)
+	}
+	return r
+}
+
+// LogReport logs the summary lines of a run from its report, they are shown
+// at every log level.
+func LogReport(log *xlog.Log, r Report) {
+	action := "dumping"
+	if r.Mode == "load" {
+		action = "restoring"
+	}
+	// The targets first, by name, then the sums.
+	names := make([]string, 0, len(r.Targets))
+	for name := range r.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		logReport(log, fmt.Sprintf("%s.target[%s]", action, name), r.Targets[name])
+	}
+	logReport(log, action, r)
+}
+
+// logReport logs the summary lines of the report r of a run or of a target.
+func logReport(log *xlog.Log, action string, r Report) {
+	done := "all.done"
+	if r.Status != RunOK {
+		done = r.Status
+	}
+	mb := float64(r.Bytes / 1024 / 1024)
+	var rate float64
+	if r.ElapsedSeconds > 0 {
+		rate = mb / r.ElapsedSeconds
+	}
+	switch {
+	case r.Mode == "load" && r.Status == RunOK && r.FilesTotal == 0:
+		// A schema only dump, there is no rate to speak of.
+		logSummary(log, "%s.%s.schema.only.cost[%.2fsec].no.data", action, done, r.ElapsedSeconds)
+	case r.Mode == "load":
+		logSummary(log, "%s.%s.cost[%.2fsec].allbytes[%.2fMB].rate[%.2fMB/s]", action, done, r.ElapsedSeconds, mb, rate)
+	case r.Mode == "dump":
+		logSummary(log, "%s.%s.cost[%.2fsec].allrows[%v].allbytes[%v].rate[%.2fMB/s].tables.without.snapshot[%d/%d]", action, done, r.ElapsedSeconds, r.Rows, r.Bytes, rate, r.TablesWithoutSnapshot, r.TablesDone)
+	default:
+		logSummary(log, "%s.%s.cost[%.2fsec].allrows[%v].allbytes[%v].rate[%.2fMB/s]", action, done, r.ElapsedSeconds, r.Rows, r.Bytes, rate)
+	}
+	if r.Status == RunFailed && r.ErrorCategory != "" {
+		logSummary(log, "%s.failed.error.category[%s]", action, r.ErrorCategory)
+	}
+	if len(r.FilesOnly) > 0 {
+		logSummary(log, "%s.files.only[%d].partial.restore.the.other.files.of.the.dump.were.not.restored", action, len(r.FilesOnly))
+	}
+	logThreadSummary(log, action, r.Threads)
+	logPhaseThreadsSummary(log, action, r.PhaseThreads)
+	if r.ThrottledSeconds > 0 {
+		if r.Mode == "load" {
+			logSummary(log, "%s.throttled.by.max.threads.per.database.cost[%.2fsec]", action, r.ThrottledSeconds)
+		} else {
+			logSummary(log, "%s.throttled.by.replica.lag.cost[%.2fsec]", action, r.ThrottledSeconds)
+		}
+	}
+	if r.LagPausedSeconds > 0 {
+		logSummary(log, "%s.paused.by.replica.lag.cost[%.2fsec]", action, r.LagPausedSeconds)
+	}
+	logHookSummary(log, action, r.Hooks)
+	logWarmSummary(log, action, r.WarmSeconds, r.WarmSkipped)
+	logOptimizeSummary(log, action, r.OptimizeSeconds, r.OptimizeFailed)
+	logSmokeSummary(log, action, r.Smoke)
+	logWarningSummary(log, action, r.Warnings, r.TableWarnings)
+	logEncodingSummary(log, action, r.EncodingProblems)
+	logFailoverSummary(log, action, r)
+	logSmallFilesSummary(log, action, r)
+	logEmptyFilesSummary(log, action, r)
+	logPostSQLSummary(log, action, r.PostSQL)
+	logPartialSummary(log, action, r)
+}
@@ -0,0 +1,212 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIValidate(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+
+	// Nothing is connected with an invalid configuration.
+	{
+		report, err := NewDumper(DumpConfig{Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+		_, ok := err.(*ValidationError)
+		assert.True(t, ok)
+		assert.Equal(t, "dump", report.Mode)
+		assert.Equal(t, RunFailed, report.Status)
+		assert.Equal(t, err.Error(), report.Error)
+	}
+	{
+		report, err := NewLoader(LoadConfig{LoadArgs: LoadArgs{User: "mock"}, Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "load", report.Mode)
+		assert.Equal(t, RunFailed, report.Status)
+	}
+}
+
+func TestAPIReportStatus(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	var bytes uint64
+	m := newMetrics(log, "load", nil, &bytes, nil)
+
+	assert.Equal(t, RunOK, m.report(nil).Status)
+	assert.Equal(t, RunFailed, m.report(errors.New("mock.error")).Status)
+	r := m.report(context.Canceled)
+	assert.Equal(t, RunCancelled, r.Status)
+	assert.Equal(t, "context canceled", r.Error)
+	assert.Equal(t, RunCancelled, m.report(context.DeadlineExceeded).Status)
+	r = m.report(&PartialError{Mode: "load", MaxRuntime: time.Hour, NotAttempted: []string{"test.t1.00002.sql"}, Interrupted: []string{"test.t1.00001.sql"}, SkippedPhases: []string{"verify"}})
+	assert.Equal(t, RunPartial, r.Status)
+	assert.Equal(t, []string{"test.t1.00002.sql"}, r.NotAttempted)
+	assert.Equal(t, []string{"test.t1.00001.sql"}, r.Interrupted)
+	assert.Equal(t, []string{"verify"}, r.SkippedPhases)
+	assert.Equal(t, "restoring.max.runtime[1h0m0s].reached.not.attempted[1].interrupted[1].phases.skipped[verify], the run is partial: "+
+		"run it again with Resume (-resume) and the same ResumeFile (-resume-file) to go on", r.Error)
+}
+
+func TestAPILoaderError(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryErrorPattern("insert into .*", errors.New("mock.insert.error"))
+	}
+
+	dir := "/tmp/apiloadererror"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int);\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+	AssertNil(x)
+
+	// The error is returned, no panic.
+	cfg := LoadConfig{
+		LoadArgs: LoadArgs{
+			Outdir:     dir,
+			User:       "mock",
+			Password:   "mock",
+			Threads:    2,
+			Address:    address,
+			IntervalMs: 500,
+		},
+		Log: log,
+	}
+	report, err := NewLoader(cfg).Run(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, RunFailed, report.Status)
+	assert.Equal(t, uint64(1), report.FilesFailed)
+	assert.Equal(t, uint64(0), report.FilesDone)
+}
+
+func TestAPILoaderCancel(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryDelay("insert into `t1`(`a`) values\n(1)", &sqltypes.Result{}, 2000)
+	}
+
+	dir := "/tmp/apiloadercancel"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int);\n")
+	AssertNil(x)
+	for i := 1; i <= 8; i++ {
+		x = WriteFile(fmt.Sprintf("%s/test.t1.%05d.sql", dir, i), "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+		AssertNil(x)
+	}
+
+	cfg := LoadConfig{
+		LoadArgs: LoadArgs{
+			Outdir:     dir,
+			User:       "mock",
+			Password:   "mock",
+			Threads:    2,
+			Address:    address,
+			IntervalMs: 10,
+		},
+		Log: log,
+	}
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	// The blocked inserts don't pin the shutdown.
+	start := time.Now()
+	report, err := NewLoader(cfg).Run(ctx)
+	assert.True(t, time.Since(start) < time.Second, "cancelled run took %v", time.Since(start))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, RunCancelled, report.Status)
+	assert.Equal(t, uint64(0), report.FilesDone)
+
+	// No goroutine of the run is left, the mock server ones end with their delayed query.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= goroutines, "goroutines %d, before the run %d", runtime.NumGoroutine(), goroutines)
+}
+
+func ExampleNewLoader() {
+	loader := NewLoader(LoadConfig{
+		LoadArgs: LoadArgs{
+			User:       "root",
+			Password:   "secret",
+			Address:    "127.0.0.1:3306",
+			Outdir:     "/backups/shop",
+			Threads:    8,
+			IntervalMs: 10 * 1000,
+		},
+	})
+	report, err := loader.Run(context.Background())
+	if err != nil {
+		fmt.Printf("restore %s failed: %v\n", report.RunID, err)
+		return
+	}
+	fmt.Printf("restored %d files, %d bytes in %.1fs\n", report.FilesDone, report.Bytes, report.ElapsedSeconds)
+}
+
+func ExampleNewDumper() {
+	dumper := NewDumper(DumpConfig{
+		DumpArgs: DumpArgs{
+			User:          "root",
+			Password:      "secret",
+			Address:       "127.0.0.1:3306",
+			Database:      "shop",
+			Outdir:        "/backups/shop",
+			ForceMkdir:    true,
+			Threads:       8,
+			ChunksizeInMB: 128,
+			StmtSize:      1000000,
+			IntervalMs:    10 * 1000,
+		},
+	})
+	report, err := dumper.Run(context.Background())
+	if err != nil {
+		fmt.Printf("dump %s failed: %v\n", report.RunID, err)
+		return
+	}
+	fmt.Printf("dumped %d tables, %d rows\n", report.TablesDone, report.Rows)
+}
@@ -0,0 +1,101 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// tableFinalizer is a step run once per table by the tableBarrier, like
+// setting its AUTO_INCREMENT counter.
+type tableFinalizer struct {
+	name string
+	run  func(conn *Connection, db string, table string) error
+}
+
+// barrierTable is the count of the data files of a table still restoring.
+type barrierTable struct {
+	pending int
+	failed  bool
+}
+
+// tableBarrier runs the finalizers of a table once all its data files are
+// restored, whatever the threads which restored them and their order: on the
+// connection of the last one, right after it, and exactly once. A table with
+// a failed file is not finalized. A nil *tableBarrier runs nothing.
+type tableBarrier struct {
+	log        *xlog.Log
+	finalizers []tableFinalizer
+
+	mu     sync.Mutex
+	tables map[string]*barrierTable
+}
+
+// newTableBarrier returns the barrier of the data files, nil if there are no
+// finalizers.
+func newTableBarrier(log *xlog.Log, files []string, finalizers []tableFinalizer) *tableBarrier {
+	if len(finalizers) == 0 {
+		return nil
+	}
+	b := &tableBarrier{log: log, finalizers: finalizers, tables: make(map[string]*barrierTable)}
+	for _, file := range files {
+		db, tbl, _ := parseTableFile(file)
+		t, ok := b.tables[db+"."+tbl]
+		if !ok {
+			t = &barrierTable{}
+			b.tables[db+"."+tbl] = t
+		}
+		t.pending++
+	}
+	return b
+}
+
+// has reports whether the table db.tbl has data files, so it's finalized by
+// the barrier.
+func (b *tableBarrier) has(db string, tbl string) bool {
+	if b == nil {
+		return false
+	}
+	_, ok := b.tables[db+"."+tbl]
+	return ok
+}
+
+// done records the restore of file on conn, with its error, and runs the
+// finalizers of its table if it was the last of its files. It returns the
+// error of the first finalizer which failed, the next ones don't run.
+func (b *tableBarrier) done(conn *Connection, file string, err error) error {
+	if b == nil {
+		return nil
+	}
+	db, tbl, _ := parseTableFile(file)
+	b.mu.Lock()
+	t := b.tables[db+"."+tbl]
+	t.pending--
+	if err != nil {
+		t.failed = true
+	}
+	last := t.pending == 0 && !t.failed
+	b.mu.Unlock()
+	if !last {
+		return nil
+	}
+
+	for _, f := range b.finalizers {
+		start := time.Now()
+		if err := f.run(conn, db, tbl); err != nil {
+			return wrapf(err, "restoring.table[%s.%s].finalize[%s].error:%v", db, tbl, f.name, err)
+		}
+		b.log.Info("restoring.table[%s.%s].finalize[%s].done.cost[%.2fsec]", db, tbl, f.name, time.Since(start).Seconds())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableBarrier(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	files := []string{"db.t1.00001.sql", "db.t1.00002.sql", "db.t1.00003.sql", "db.t2.00001.sql", "db.t3.00001.sql", "db.t3.00002.sql"}
+
+	var mu sync.Mutex
+	var finalized []string
+	restored := make(map[string]int)
+	finalizer := tableFinalizer{name: "mock", run: func(conn *Connection, db string, table string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		finalized = append(finalized, db+"."+table)
+		// All the chunks of the table are done.
+		assert.Equal(t, map[string]int{"db.t1": 3, "db.t2": 1}[db+"."+table], restored[db+"."+table])
+		if table == "t2" {
+			return errors.New("mock.finalize.error")
+		}
+		return nil
+	}}
+	b := newTableBarrier(log, files, []tableFinalizer{finalizer})
+	assert.True(t, b.has("db", "t1"))
+	assert.False(t, b.has("db", "t4"))
+
+	// The 3 chunks of t1 end on 3 threads, it's finalized once.
+	{
+		var wg sync.WaitGroup
+		for _, file := range files[:3] {
+			wg.Add(1)
+			go func(file string) {
+				defer wg.Done()
+				mu.Lock()
+				restored["db.t1"]++
+				mu.Unlock()
+				assert.Nil(t, b.done(nil, file, nil))
+			}(file)
+		}
+		wg.Wait()
+		assert.Equal(t, []string{"db.t1"}, finalized)
+	}
+
+	// The error of a finalizer.
+	{
+		restored["db.t2"]++
+		err := b.done(nil, "db.t2.00001.sql", nil)
+		assert.Equal(t, "restoring.table[db.t2].finalize[mock].error:mock.finalize.error", err.Error())
+	}
+
+	// A table with a failed chunk is not finalized.
+	{
+		assert.Nil(t, b.done(nil, "db.t3.00001.sql", errors.New("mock.insert.error")))
+		assert.Nil(t, b.done(nil, "db.t3.00002.sql", nil))
+		assert.Equal(t, []string{"db.t1", "db.t2"}, finalized)
+	}
+
+	// No finalizers.
+	assert.Nil(t, newTableBarrier(log, files, nil))
+}
@@ -0,0 +1,236 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+const (
+	// benchTable is the table of the synthetic dump of a Bench.
+	benchTable = "bench"
+	// maxBenchRowWidth keeps a row of the bench table under the 65535 bytes
+	// row size limit of MySQL.
+	maxBenchRowWidth = 60000
+)
+
+// benchRuns numbers the in memory dumps of the Benchers of the process.
+var benchRuns uint64
+
+// BenchArgs are the arguments of a Bencher: the target, the synthetic dump
+// and the thread counts of the runs.
+type BenchArgs struct {
+	User     string
+	Password string
+	Address  string
+	// Database is the scratch database of the runs, it must not exist on
+	// the target: every run creates it and drops it.
+	Database string
+	// Rows is the number of rows of the synthetic table, RowWidth the bytes
+	// of the varbinary column of a row.
+	Rows     int
+	RowWidth int
+	// ChunksizeInMB and StmtSize split the synthetic data files as the
+	// dump does, see DumpArgs.
+	ChunksizeInMB int
+	StmtSize      int
+	// Threads are the LoadArgs.Threads of the runs, in their order.
+	Threads    []int
+	IntervalMs int
+}
+
+// BenchConfig is the configuration of a Bencher.
+type BenchConfig struct {
+	BenchArgs
+
+	// Log is the log of the run, nil logs to stderr at the info level.
+	Log *xlog.Log
+	// Executor returns the executors of the connections instead of dialing
+	// BenchArgs.Address, see LoadConfig.Executor.
+	Executor ExecutorFunc
+}
+
+// BenchReport is the outcome of a Bencher: the synthetic dump and a run per
+// thread count done.
+type BenchReport struct {
+	Database string     `json:"database"`
+	Rows     uint64     `json:"rows"`
+	RowWidth int        `json:"row_width"`
+	Bytes    uint64     `json:"bytes"`
+	Files    int        `json:"files"`
+	Runs     []BenchRun `json:"runs"`
+}
+
+// BenchRun is the throughput of a restore of the synthetic dump, over the
+// data phase of its Report: the schemas are not counted.
+type BenchRun struct {
+	Threads    int     `json:"threads"`
+	Seconds    float64 `json:"seconds"`
+	MBPerSec   float64 `json:"mb_per_sec"`
+	RowsPerSec float64 `json:"rows_per_sec"`
+}
+
+// Bencher measures the restore throughput a target sustains by thread
+// count, see NewBencher.
+type Bencher struct {
+	cfg BenchConfig
+}
+
+// NewBencher creates a Bencher, cfg is copied.
+func NewBencher(cfg BenchConfig) *Bencher {
+	return &Bencher{cfg: cfg}
+}
+
+// Run validates the configuration, generates the synthetic dump in memory
+// and restores it once per BenchArgs.Threads with a Loader, the production
+// path, dropping the scratch database after each run. The first failed run
+// stops the sweep, Run returns its error and the runs done before it.
+func (b *Bencher) Run(ctx context.Context) (BenchReport, error) {
+	args := b.cfg.BenchArgs
+	log := logOrDefault(b.cfg.Log)
+	report := BenchReport{Database: args.Database, Rows: uint64(args.Rows), RowWidth: args.RowWidth}
+	if err := args.Validate(); err != nil {
+		return report, err
+	}
+
+	name := fmt.Sprintf("go-mydumper-bench-%d", atomic.AddUint64(&benchRuns, 1))
+	storage, _ := openMemStorage("mem://" + name)
+	defer func() {
+		memStoragesMu.Lock()
+		delete(memStorages, name)
+		memStoragesMu.Unlock()
+	}()
+	files, size, err := generateBench(storage, &args)
+	if err != nil {
+		return report, err
+	}
+	report.Files, report.Bytes = files, size
+	log.Info("bench.dump.rows[%d].row.width[%d].files[%d].bytes[%d]", args.Rows, args.RowWidth, files, size)
+
+	base := LoadArgs{User: args.User, Password: args.Password, Address: args.Address, executor: b.cfg.Executor}
+	pool, err := newLoadPool(log, &base, 1)
+	if err != nil {
+		return report, err
+	}
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+	exists, err := databaseExists(conn, args.Database)
+	if err != nil {
+		return report, err
+	}
+	if exists {
+		return report, fmt.Errorf("bench.database[%s].exists.on.the.target.it.would.be.dropped", args.Database)
+	}
+
+	for _, threads := range args.Threads {
+		load := LoadArgs{
+			User:       args.User,
+			Password:   args.Password,
+			Address:    args.Address,
+			Outdir:     "mem://" + name,
+			Threads:    threads,
+			IntervalMs: args.IntervalMs,
+		}
+		r, err := NewLoader(LoadConfig{LoadArgs: load, Log: log, Executor: b.cfg.Executor}).Run(ctx)
+		if dropErr := conn.Execute("DROP DATABASE IF EXISTS " + quoteIdentifier(args.Database)); dropErr != nil && err == nil {
+			err = fmt.Errorf("bench.drop.database[%s].error:%v", args.Database, dropErr)
+		}
+		if err != nil {
+			return report, err
+		}
+		run := BenchRun{Threads: threads, Seconds: r.PhaseSeconds["data"]}
+		if run.Seconds > 0 {
+			run.MBPerSec = float64(r.Bytes) / 1024 / 1024 / run.Seconds
+			run.RowsPerSec = float64(args.Rows) / run.Seconds
+		}
+		log.Info("bench.threads[%d].seconds[%.2f].mb.per.sec[%.2f].rows.per.sec[%.0f]", threads, run.Seconds, run.MBPerSec, run.RowsPerSec)
+		report.Runs = append(report.Runs, run)
+	}
+	return report, nil
+}
+
+// generateBench writes the synthetic dump of args into s: the scratch
+// database, the bench table with an id and a varbinary(RowWidth) column, and
+// its rows split into data files and statements as the dump does. The pad
+// of a row is random letters, a fixed seed makes every dump the same. It
+// returns the number of data files and their bytes.
+func generateBench(s Storage, args *BenchArgs) (int, uint64, error) {
+	db := args.Database
+	if err := writeFile(s, db+dbSuffix, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s;\n", quoteIdentifier(db))); err != nil {
+		return 0, 0, err
+	}
+	schema := fmt.Sprintf("CREATE TABLE %s (\n  `id` bigint NOT NULL,\n  `pad` varbinary(%d) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n", quoteIdentifier(benchTable), args.RowWidth)
+	if err := writeFile(s, db+"."+benchTable+schemaSuffix, schema); err != nil {
+		return 0, 0, err
+	}
+
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	rnd := rand.New(rand.NewSource(1))
+	pad := make([]byte, args.RowWidth)
+	insert := "INSERT INTO " + quoteIdentifier(benchTable) + "(`id`,`pad`) VALUES\n"
+	var file, stmt bytes.Buffer
+	var files int
+	var size uint64
+	flush := func() error {
+		files++
+		size += uint64(file.Len())
+		name := fmt.Sprintf("%s.%s.%05d%s", db, benchTable, files, tableSuffix)
+		err := writeFile(s, name, file.String())
+		file.Reset()
+		return err
+	}
+	for id := 1; id <= args.Rows; id++ {
+		for i := range pad {
+			pad[i] = letters[rnd.Intn(len(letters))]
+		}
+		if stmt.Len() == 0 {
+			stmt.WriteString(insert)
+		} else {
+			stmt.WriteString(",\n")
+		}
+		stmt.WriteString("(" + strconv.Itoa(id) + ",'")
+		stmt.Write(pad)
+		stmt.WriteString("')")
+		if stmt.Len() >= args.StmtSize || id == args.Rows {
+			stmt.WriteString(";\n")
+			file.Write(stmt.Bytes())
+			stmt.Reset()
+		}
+		if file.Len() >= args.ChunksizeInMB*1024*1024 || (id == args.Rows && file.Len() > 0) {
+			if err := flush(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	return files, size, nil
+}
+
+// WriteTable writes the runs of the report as a table of threads, seconds,
+// MB/s and rows/s.
+func (r BenchReport) WriteTable(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%-8s %10s %10s %12s\n", "threads", "seconds", "MB/s", "rows/s"); err != nil {
+		return err
+	}
+	for _, run := range r.Runs {
+		if _, err := fmt.Fprintf(w, "%-8d %10.2f %10.2f %12.0f\n", run.Threads, run.Seconds, run.MBPerSec, run.RowsPerSec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateBench(t *testing.T) {
+	s := NewMemStorage()
+	args := &BenchArgs{Database: "scratch", Rows: 3000, RowWidth: 1000, ChunksizeInMB: 1, StmtSize: 100000}
+	files, size, err := generateBench(s, args)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, files)
+
+	names, err := s.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"scratch-schema-create.sql", "scratch.bench-schema.sql", "scratch.bench.00001.sql", "scratch.bench.00002.sql", "scratch.bench.00003.sql"}, names)
+	var total uint64
+	var rows int
+	for _, name := range names[2:] {
+		fi, err := s.Stat(name)
+		assert.Nil(t, err)
+		total += uint64(fi.Size())
+		dat, err := readFile(s, name)
+		assert.Nil(t, err)
+		for _, stmt := range strings.Split(strings.TrimSuffix(string(dat), ";\n"), ";\n") {
+			assert.True(t, strings.HasPrefix(stmt, "INSERT INTO `bench`(`id`,`pad`) VALUES\n"))
+			assert.True(t, len(stmt) < args.StmtSize+args.RowWidth+100)
+			rows += strings.Count(stmt, "\n")
+		}
+	}
+	assert.Equal(t, size, total)
+	assert.Equal(t, args.Rows, rows)
+
+	// The same dump every time.
+	again := NewMemStorage()
+	_, _, err = generateBench(again, args)
+	assert.Nil(t, err)
+	a, _ := readFile(s, "scratch.bench.00002.sql")
+	b, _ := readFile(again, "scratch.bench.00002.sql")
+	assert.Equal(t, a, b)
+}
+
+func TestBencher(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := BenchArgs{User: "mock", Password: "mock", Address: "127.0.0.1:3306", Database: "scratch", Rows: 100, RowWidth: 10, ChunksizeInMB: 1, StmtSize: 200, Threads: []int{1, 2}, IntervalMs: 1000}
+
+	// A run per thread count, the scratch database dropped after each.
+	{
+		rec := &recordingExecutor{}
+		report, err := NewBencher(BenchConfig{BenchArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, report.Files)
+		assert.Equal(t, 2, len(report.Runs))
+		assert.Equal(t, 1, report.Runs[0].Threads)
+		assert.Equal(t, 2, report.Runs[1].Threads)
+		assert.Equal(t, []string{"DROP DATABASE IF EXISTS `scratch`", "DROP DATABASE IF EXISTS `scratch`"}, matchingQueries(rec.queries, "DROP DATABASE"))
+		assert.Equal(t, 2, len(matchingQueries(rec.queries, "CREATE TABLE")))
+		inserts := matchingQueries(rec.queries, "INSERT INTO")
+		assert.True(t, len(inserts) > 2)
+		assert.Equal(t, 0, len(inserts)%2)
+	}
+
+	// A scratch database which exists is not touched.
+	{
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			"SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME='scratch'": {
+				Fields: []*querypb.Field{{Name: "COUNT(*)", Type: querypb.Type_INT64}},
+				Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, []byte("1"))}},
+			},
+		}}
+		_, err := NewBencher(BenchConfig{BenchArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Nil(t, matchingQueries(rec.queries, "DROP"))
+		assert.Nil(t, matchingQueries(rec.queries, "CREATE"))
+	}
+
+	// A failed run stops the sweep, the scratch database is dropped.
+	{
+		rec := &recordingExecutor{errs: map[string]error{"CREATE TABLE `bench` (\n  `id` bigint NOT NULL,\n  `pad` varbinary(10) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB": errors.New("mock.error")}}
+		report, err := NewBencher(BenchConfig{BenchArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Nil(t, report.Runs)
+		assert.Equal(t, []string{"DROP DATABASE IF EXISTS `scratch`"}, matchingQueries(rec.queries, "DROP DATABASE"))
+	}
+}
+
+func TestBenchReportWriteTable(t *testing.T) {
+	report := BenchReport{Runs: []BenchRun{
+		{Threads: 1, Seconds: 10, MBPerSec: 12.5, RowsPerSec: 50000},
+		{Threads: 16, Seconds: 2.5, MBPerSec: 50, RowsPerSec: 200000},
+	}}
+	var buf bytes.Buffer
+	assert.Nil(t, report.WriteTable(&buf))
+	want := "threads     seconds       MB/s       rows/s\n" +
+		"1             10.00      12.50        50000\n" +
+		"16             2.50      50.00       200000\n"
+	assert.Equal(t, want, buf.String())
+}
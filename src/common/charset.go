@@ -0,0 +1,174 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultUpgradeKeyBytes is the longest key part of the COMPACT and
+	// REDUNDANT row formats, see LoadArgs.UpgradeKeyBytes.
+	defaultUpgradeKeyBytes = 767
+	// largeKeyBytes is the longest key part of the DYNAMIC and COMPRESSED
+	// row formats.
+	largeKeyBytes = 3072
+)
+
+var (
+	// utf8mb3Regexp matches the utf8 and utf8mb3 character sets and their
+	// collations, with the collation suffix.
+	utf8mb3Regexp = regexp.MustCompile(`(?i)\butf8(?:mb3)?(_\w+)?\b`)
+	// charsetRegexp matches the CHARACTER SET or CHARSET of a column
+	// definition or of the table options, with the character set.
+	charsetRegexp = regexp.MustCompile(`(?i)\b(?:CHARACTER\s+SET|CHARSET)\s*=?\s*(\w+)`)
+	// stringTypeRegexp matches the type of a string column, with its length
+	// in characters if it has one.
+	stringTypeRegexp = regexp.MustCompile(`(?i)^\s*(?:NATIONAL\s+)?(?:VARCHAR|CHAR|TINYTEXT|TEXT|MEDIUMTEXT|LONGTEXT|ENUM|SET)\b(?:\s*\((\d+)\))?`)
+	// largeRowFormatRegexp matches the ROW_FORMAT table options of the large
+	// key parts.
+	largeRowFormatRegexp = regexp.MustCompile(`(?i)\bROW_FORMAT\s*=\s*(DYNAMIC|COMPRESSED)\b`)
+	// keyPartsRegexp matches an index definition: its head up to the key
+	// parts, its kind, its key parts and what follows them.
+	keyPartsRegexp = regexp.MustCompile("(?is)^((?:CONSTRAINT\\s+(?:`(?:[^`]|``)*`\\s+)?)?(PRIMARY\\s+KEY|UNIQUE|KEY|INDEX)\\b[^(]*)\\((.*)\\)(.*)$")
+	// keyPartRegexp matches a key part on a column, with its prefix length
+	// and its order. An expression key part doesn't match.
+	keyPartRegexp = regexp.MustCompile("(?s)^(`(?:[^`]|``)*`)(?:\\s*\\((\\d+)\\))?(.*)$")
+)
+
+// isUtf8mb3 reports whether charset is utf8 or its utf8mb3 alias.
+func isUtf8mb3(charset string) bool {
+	charset = strings.ToLower(charset)
+	return charset == "utf8" || charset == "utf8mb3"
+}
+
+// upgradeCollation returns the utf8mb4 character set or collation of the
+// utf8mb3 one name: the one collations maps it to, named utf8_xxx or
+// utf8mb3_xxx, else the same name with utf8mb4.
+func upgradeCollation(name string, collations map[string]string) string {
+	lower := strings.ToLower(name)
+	suffix := strings.TrimPrefix(lower, "utf8mb3")
+	if suffix == lower {
+		suffix = strings.TrimPrefix(lower, "utf8")
+	}
+	if suffix != "" {
+		for _, key := range []string{"utf8" + suffix, "utf8mb3" + suffix} {
+			if to, ok := collations[key]; ok {
+				return to
+			}
+		}
+	}
+	return "utf8mb4" + suffix
+}
+
+// upgradeCharsetNames replaces the utf8 and utf8mb3 character sets and
+// collations of query with the utf8mb4 ones, see upgradeCollation. The quoted
+// strings and identifiers are left as they are.
+func upgradeCharsetNames(query string, collations map[string]string) string {
+	return mapCode(query, func(code string) string {
+		return utf8mb3Regexp.ReplaceAllStringFunc(code, func(name string) string {
+			return upgradeCollation(name, collations)
+		})
+	})
+}
+
+// upgradeCharset moves the CREATE DATABASE or CREATE TABLE statement query
+// from utf8mb3 to utf8mb4, see upgradeCharsetNames. A utf8mb4 character takes
+// 4 bytes against 3, so the key parts on the columns moved which would be
+// longer than keyBytes, 0 meaning 767, get a prefix of keyBytes/4 characters.
+// A table with ROW_FORMAT=DYNAMIC or COMPRESSED allows 3072 bytes. A primary
+// key is never shortened, it identifies the rows. The returned warnings tell
+// what was shortened, or could not be.
+func upgradeCharset(query string, collations map[string]string, keyBytes int) (string, []string) {
+	if !createTableRegexp.MatchString(query) {
+		return upgradeCharsetNames(query, collations), nil
+	}
+	if keyBytes < 1 {
+		keyBytes = defaultUpgradeKeyBytes
+	}
+	options := tableOptions(query)
+	if largeRowFormatRegexp.MatchString(options) && keyBytes < largeKeyBytes {
+		keyBytes = largeKeyBytes
+	}
+	tableUtf8 := false
+	if match := charsetRegexp.FindStringSubmatch(options); match != nil {
+		tableUtf8 = isUtf8mb3(match[1])
+	}
+
+	// The characters of the string columns moved to utf8mb4, 0 if their type
+	// has no length.
+	moved := make(map[string]int)
+	for _, def := range tableDefinitions(query) {
+		name, attrs, ok := columnDefinition(def)
+		if !ok {
+			continue
+		}
+		match := stringTypeRegexp.FindStringSubmatch(attrs)
+		if match == nil {
+			continue
+		}
+		utf8 := tableUtf8
+		if charset := charsetRegexp.FindStringSubmatch(attrs); charset != nil {
+			utf8 = isUtf8mb3(charset[1])
+		}
+		if utf8 {
+			moved[name], _ = strconv.Atoi(match[1])
+		}
+	}
+
+	var warnings []string
+	out := query
+	for _, def := range tableDefinitions(query) {
+		match := keyPartsRegexp.FindStringSubmatch(def)
+		if match == nil {
+			continue
+		}
+		kind := strings.ToUpper(match[2])
+		key := strings.TrimSpace(match[1])
+		parts := tableDefinitions("(" + match[3] + ")")
+		shortened := false
+		for i, part := range parts {
+			column := keyPartRegexp.FindStringSubmatch(part)
+			if column == nil {
+				continue
+			}
+			chars, ok := moved[column[1]]
+			if !ok {
+				continue
+			}
+			if column[2] != "" {
+				chars, _ = strconv.Atoi(column[2])
+			}
+			if chars*4 <= keyBytes {
+				continue
+			}
+			if strings.HasPrefix(kind, "PRIMARY") {
+				warnings = append(warnings, fmt.Sprintf("%s column %s takes %d bytes in utf8mb4, over the %d bytes of a key part: "+
+					"not shortened, the CREATE TABLE fails unless the target allows large key parts", key, column[1], chars*4, keyBytes))
+				continue
+			}
+			parts[i] = fmt.Sprintf("%s(%d)%s", column[1], keyBytes/4, column[3])
+			shortened = true
+			warning := fmt.Sprintf("%s column %s shortened to a %d characters prefix, %d bytes in utf8mb4 are over the %d bytes of a key part",
+				key, column[1], keyBytes/4, chars*4, keyBytes)
+			if kind == "UNIQUE" {
+				warning += ": the uniqueness now only applies to the prefix"
+			}
+			warnings = append(warnings, warning)
+		}
+		if shortened {
+			out = strings.Replace(out, def, match[1]+"("+strings.Join(parts, ",")+")"+match[4], 1)
+		}
+	}
+	return upgradeCharsetNames(out, collations), warnings
+}
@@ -0,0 +1,108 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCharsetUpgradeCollation(t *testing.T) {
+	collations := map[string]string{"utf8_general_ci": "utf8mb4_0900_ai_ci", "utf8mb3_unicode_ci": "utf8mb4_unicode_520_ci"}
+	assert.Equal(t, "utf8mb4", upgradeCollation("utf8", collations))
+	assert.Equal(t, "utf8mb4", upgradeCollation("UTF8MB3", collations))
+	assert.Equal(t, "utf8mb4_0900_ai_ci", upgradeCollation("utf8_general_ci", collations))
+	assert.Equal(t, "utf8mb4_0900_ai_ci", upgradeCollation("utf8mb3_general_ci", collations))
+	assert.Equal(t, "utf8mb4_unicode_520_ci", upgradeCollation("utf8_unicode_ci", collations))
+	assert.Equal(t, "utf8mb4_bin", upgradeCollation("utf8_bin", collations))
+	assert.Equal(t, "utf8mb4_general_ci", upgradeCollation("utf8_general_ci", nil))
+}
+
+func TestCharsetUpgrade(t *testing.T) {
+	collations := map[string]string{"utf8_general_ci": "utf8mb4_0900_ai_ci"}
+
+	// A database.
+	{
+		out, warnings := upgradeCharset("CREATE DATABASE /*!32312 IF NOT EXISTS*/ `test` /*!40100 DEFAULT CHARACTER SET utf8 COLLATE utf8_general_ci */", collations, 0)
+		assert.Equal(t, "CREATE DATABASE /*!32312 IF NOT EXISTS*/ `test` /*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci */", out)
+		assert.Nil(t, warnings)
+	}
+
+	// The VARCHAR(255) unique keys of a 5.7 table get a prefix under 767 bytes,
+	// the latin1 and binary columns and the short keys are left as they are.
+	{
+		schema := "CREATE TABLE `users` (\n" +
+			"  `id` int(11) NOT NULL AUTO_INCREMENT,\n" +
+			"  `email` varchar(255) NOT NULL,\n" +
+			"  `name` varchar(255) CHARACTER SET utf8 COLLATE utf8_bin DEFAULT NULL,\n" +
+			"  `code` varchar(64) NOT NULL,\n" +
+			"  `legacy` varchar(255) CHARACTER SET latin1 DEFAULT NULL,\n" +
+			"  `token` varbinary(255) DEFAULT NULL,\n" +
+			"  PRIMARY KEY (`id`),\n" +
+			"  UNIQUE KEY `uk_email` (`email`),\n" +
+			"  KEY `idx_name_code` (`name`(200),`code`) USING BTREE,\n" +
+			"  KEY `idx_code_email` (`code`,`email` DESC),\n" +
+			"  UNIQUE KEY `uk_legacy` (`legacy`),\n" +
+			"  KEY `idx_token` (`token`)\n" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci"
+		out, warnings := upgradeCharset(schema, collations, 0)
+		want := "CREATE TABLE `users` (\n" +
+			"  `id` int(11) NOT NULL AUTO_INCREMENT,\n" +
+			"  `email` varchar(255) NOT NULL,\n" +
+			"  `name` varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin DEFAULT NULL,\n" +
+			"  `code` varchar(64) NOT NULL,\n" +
+			"  `legacy` varchar(255) CHARACTER SET latin1 DEFAULT NULL,\n" +
+			"  `token` varbinary(255) DEFAULT NULL,\n" +
+			"  PRIMARY KEY (`id`),\n" +
+			"  UNIQUE KEY `uk_email` (`email`(191)),\n" +
+			"  KEY `idx_name_code` (`name`(191),`code`) USING BTREE,\n" +
+			"  KEY `idx_code_email` (`code`,`email`(191) DESC),\n" +
+			"  UNIQUE KEY `uk_legacy` (`legacy`),\n" +
+			"  KEY `idx_token` (`token`)\n" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci"
+		assert.Equal(t, want, out)
+		assert.Equal(t, []string{
+			"UNIQUE KEY `uk_email` column `email` shortened to a 191 characters prefix, 1020 bytes in utf8mb4 are over the 767 bytes of a key part: the uniqueness now only applies to the prefix",
+			"KEY `idx_name_code` column `name` shortened to a 191 characters prefix, 800 bytes in utf8mb4 are over the 767 bytes of a key part",
+			"KEY `idx_code_email` column `email` shortened to a 191 characters prefix, 1020 bytes in utf8mb4 are over the 767 bytes of a key part",
+		}, warnings)
+	}
+
+	// A primary key is not shortened.
+	{
+		schema := "CREATE TABLE `t1` (\n  `k` varchar(255) NOT NULL,\n  PRIMARY KEY (`k`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+		out, warnings := upgradeCharset(schema, nil, 0)
+		assert.Equal(t, "CREATE TABLE `t1` (\n  `k` varchar(255) NOT NULL,\n  PRIMARY KEY (`k`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4", out)
+		assert.Equal(t, 1, len(warnings))
+		assert.Equal(t, "PRIMARY KEY column `k` takes 1020 bytes in utf8mb4, over the 767 bytes of a key part: not shortened, "+
+			"the CREATE TABLE fails unless the target allows large key parts", warnings[0])
+	}
+
+	// The large key parts of ROW_FORMAT=DYNAMIC, or of the target.
+	{
+		schema := "CREATE TABLE `t1` (\n  `k` varchar(255) NOT NULL,\n  UNIQUE KEY `uk` (`k`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8 ROW_FORMAT=DYNAMIC"
+		out, warnings := upgradeCharset(schema, nil, 0)
+		assert.Equal(t, "CREATE TABLE `t1` (\n  `k` varchar(255) NOT NULL,\n  UNIQUE KEY `uk` (`k`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 ROW_FORMAT=DYNAMIC", out)
+		assert.Nil(t, warnings)
+
+		schema = "CREATE TABLE `t1` (\n  `k` varchar(255) NOT NULL,\n  UNIQUE KEY `uk` (`k`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"
+		_, warnings = upgradeCharset(schema, nil, 3072)
+		assert.Nil(t, warnings)
+	}
+
+	// A latin1 table with a utf8 column.
+	{
+		schema := "CREATE TABLE `t1` (\n  `a` varchar(255) CHARACTER SET utf8 NOT NULL,\n  `b` varchar(255) NOT NULL,\n  KEY `ab` (`a`,`b`)\n) ENGINE=InnoDB DEFAULT CHARSET=latin1"
+		out, warnings := upgradeCharset(schema, nil, 0)
+		assert.Equal(t, "CREATE TABLE `t1` (\n  `a` varchar(255) CHARACTER SET utf8mb4 NOT NULL,\n  `b` varchar(255) NOT NULL,\n  KEY `ab` (`a`(191),`b`)\n) ENGINE=InnoDB DEFAULT CHARSET=latin1", out)
+		assert.Equal(t, 1, len(warnings))
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The MySQL error numbers of a row rejected by a CHECK constraint.
+const (
+	// erCheckConstraintViolated is the one of MySQL 8.0.16 and later.
+	erCheckConstraintViolated = 3819
+	// erConstraintFailed is the one of MariaDB.
+	erConstraintFailed = 4025
+)
+
+var (
+	// checkConstraintRegexp matches a CHECK constraint of a create table
+	// statement, with its name if it has one.
+	checkConstraintRegexp = regexp.MustCompile("(?is)^(?:CONSTRAINT\\s+(`(?:[^`]|``)*`)\\s+)?CHECK\\s*\\(")
+	// columnCheckRegexp matches the CHECK of the attributes of a column
+	// definition, as MariaDB shows one declared with its column.
+	columnCheckRegexp = regexp.MustCompile(`(?i)\bCHECK\s*\(`)
+	// notEnforcedRegexp matches the NOT ENFORCED of a CHECK constraint, in its
+	// /*!80016 NOT ENFORCED */ comment too.
+	notEnforcedRegexp = regexp.MustCompile(`(?i)\bNOT\s+ENFORCED\b`)
+)
+
+// checkConstraints returns the enforced CHECK constraints of the create table
+// statement schema: the quoted name of the named ones, 'column `c`' for the
+// ones of a column. The NOT ENFORCED ones reject no row and are left out.
+func checkConstraints(schema string) []string {
+	var checks []string
+	for _, def := range tableDefinitions(schema) {
+		if name, attrs, ok := columnDefinition(def); ok {
+			if columnCheckRegexp.MatchString(attrs) && !notEnforcedRegexp.MatchString(attrs) {
+				checks = append(checks, "column "+name)
+			}
+			continue
+		}
+		match := checkConstraintRegexp.FindStringSubmatch(def)
+		if match == nil || notEnforcedRegexp.MatchString(mapLiterals(def, func(string) string { return "" })) {
+			continue
+		}
+		if match[1] == "" {
+			match[1] = "CHECK"
+		}
+		checks = append(checks, match[1])
+	}
+	return checks
+}
+
+// stripCheckConstraints returns the create table statement schema without
+// its CHECK constraints, NOT ENFORCED or not, and their names as
+// checkConstraints has them: for a target which rejects them, or whose
+// sql_mode rejects their expressions. The other definitions, the expression
+// defaults too, are left as they are.
+func stripCheckConstraints(schema string) (string, []string) {
+	var stripped []string
+	var out strings.Builder
+	last := 0
+	for i, span := range tableDefinitionSpans(schema) {
+		def := schema[span[0]:span[1]]
+		trimmed := strings.TrimSpace(def)
+		if name, _, ok := columnDefinition(trimmed); ok {
+			// The CHECK of a column is cut out of its attributes.
+			at := span[0] + strings.Index(def, trimmed) + len(name)
+			masked := maskQuoted(schema[at:span[1]])
+			if loc := columnCheckRegexp.FindStringIndex(masked); loc != nil {
+				// The spaces before the CHECK go with it.
+				start := at + loc[0]
+				for start > at && schema[start-1] == ' ' {
+					start--
+				}
+				out.WriteString(schema[last:start])
+				last = at + matchingParen(schema[at:span[1]], loc[1]-1)
+				stripped = append(stripped, "column "+name)
+			}
+			continue
+		}
+		match := checkConstraintRegexp.FindStringSubmatch(trimmed)
+		if match == nil {
+			continue
+		}
+		if match[1] == "" {
+			match[1] = "CHECK"
+		}
+		stripped = append(stripped, match[1])
+		// The definition goes with the comma before it, the spaces after it
+		// stay before the closing parenthesis, or with the comma after it
+		// for the first one.
+		start, end := span[0], span[1]
+		if i > 0 {
+			start--
+			end = span[0] + len(strings.TrimRight(def, " \t\r\n"))
+		} else if schema[end] == ',' {
+			end++
+		}
+		out.WriteString(schema[last:start])
+		last = end
+	}
+	if stripped == nil {
+		return schema, nil
+	}
+	out.WriteString(schema[last:])
+	return out.String(), stripped
+}
+
+// maskQuoted returns s with the content of its quoted strings and
+// identifiers blanked out, so a regexp finds only what is outside them at
+// the same offsets.
+func maskQuoted(s string) string {
+	b := []byte(s)
+	for i := 0; i < len(b); {
+		switch b[i] {
+		case '\'', '"', '`':
+			end := skipQuoted(s, i)
+			for j := i + 1; j < end-1; j++ {
+				b[j] = ' '
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	return string(b)
+}
+
+// matchingParen returns the offset after the parenthesis of s which closes
+// the one at open, len(s) if none does.
+func matchingParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); {
+		switch s[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(s, i)
+			continue
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+		i++
+	}
+	return len(s)
+}
+
+// checkDroppedConstraints warns if the CREATE TABLE query just executed for
+// the table db.table had enforced CHECK constraints the target dropped: MySQL
+// 5.7 and earlier parse them and forget them.
+func checkDroppedConstraints(log *xlog.Log, conn *Connection, db string, table string, query string) {
+	checks := checkConstraints(query)
+	if len(checks) == 0 {
+		return
+	}
+	qr, err := conn.Fetch(fmt.Sprintf("SHOW CREATE TABLE `%s`.`%s`", db, table))
+	if err != nil || len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 {
+		log.Warning("restoring.schema[%s.%s].check.constraints.not.verified:%v", db, table, err)
+		return
+	}
+	if kept := checkConstraints(qr.Rows[0][1].String()); len(kept) < len(checks) {
+		log.Warning("restoring.schema[%s.%s].check.constraints.dropped.by.target[%s]:the target parses and ignores CHECK (MySQL 5.7 and earlier), "+
+			"the rows they reject are accepted", db, table, strings.Join(checks, ","))
+	}
+}
+
+// checkViolation explains the error of a statement of the data file file at
+// offset if a CHECK constraint rejected a row, else it returns err.
+func checkViolation(file string, offset int, err error) error {
+	switch errorNumber(err) {
+	case erCheckConstraintViolated, erConstraintFailed:
+		return fmt.Errorf("restoring.file[%s].offset[%d].check.constraint.violated:%v, a CHECK constraint is enforced even with "+
+			"foreign_key_checks and unique_checks off: fix the rows, make the constraint NOT ENFORCED on the target, "+
+			"or restore the tables without their CHECK constraints with SkipCheckConstraints (-skip-check-constraints)", file, offset, err)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// checkSchema is a MySQL 8.0 table with named CHECK constraints, one of them
+// NOT ENFORCED.
+const checkSchema = "CREATE TABLE `orders` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `qty` int NOT NULL,\n" +
+	"  `price` decimal(10,2) NOT NULL,\n" +
+	"  `note` varchar(64) DEFAULT 'check (none)',\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  CONSTRAINT `chk_qty` CHECK ((`qty` > 0)),\n" +
+	"  CONSTRAINT `chk_price` CHECK ((`price` >= 0)),\n" +
+	"  CONSTRAINT `chk_note` CHECK ((`note` <> _utf8mb4'not enforced')) /*!80016 NOT ENFORCED */\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+func TestCheckConstraintsParse(t *testing.T) {
+	assert.Equal(t, []string{"`chk_qty`", "`chk_price`"}, checkConstraints(checkSchema))
+
+	// MariaDB shows the CHECK of a column with it.
+	mariadb := "CREATE TABLE `t1` (\n  `a` int(11) DEFAULT NULL CHECK (`a` > 0),\n  `b` int(11) DEFAULT NULL,\n" +
+		"  CONSTRAINT `CONSTRAINT_1` CHECK (`b` > `a`)\n) ENGINE=InnoDB"
+	assert.Equal(t, []string{"column `a`", "`CONSTRAINT_1`"}, checkConstraints(mariadb))
+
+	// MySQL 5.7 shows none.
+	assert.Nil(t, checkConstraints("CREATE TABLE `t1` (\n  `a` int(11) DEFAULT NULL\n) ENGINE=InnoDB"))
+
+	// The compatibility report.
+	reasons := compatibilityReasons(checkSchema, "", "")
+	assert.Equal(t, 1, len(reasons))
+	assert.True(t, strings.HasPrefix(reasons[0], "CHECK constraints `chk_qty`, `chk_price`: enforced by MySQL 8.0.16 or later"))
+
+	// A row rejected by a CHECK, MySQL and MariaDB.
+	for _, num := range []uint16{erCheckConstraintViolated, erConstraintFailed} {
+		err := checkViolation("test.orders.00001.sql", 12, sqldb.NewSQLError(num, "Check constraint 'chk_qty' is violated."))
+		assert.True(t, strings.HasPrefix(err.Error(), "restoring.file[test.orders.00001.sql].offset[12].check.constraint.violated:"))
+	}
+	other := sqldb.NewSQLError(1062, "Duplicate entry '1' for key 'PRIMARY'")
+	assert.Equal(t, error(other), checkViolation("test.orders.00001.sql", 12, other))
+}
+
+func TestCheckConstraintsRoundTrip(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Table", Type: querypb.Type_VARCHAR},
+			{Name: "Create Table", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("orders")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(checkSchema)),
+		}},
+	}
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "id", Type: querypb.Type_INT32},
+			{Name: "qty", Type: querypb.Type_INT32},
+			{Name: "price", Type: querypb.Type_DECIMAL},
+			{Name: "note", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")),
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("2")),
+			sqltypes.MakeTrusted(querypb.Type_DECIMAL, []byte("9.90")),
+			sqltypes.NULL,
+		}},
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+	}
+
+	dir := "/tmp/checkconstraints"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	// The dump keeps the constraints and reports them.
+	{
+		args := DumpArgs{Database: "test", Table: "orders", Outdir: dir, User: "mock", Password: "mock", Address: address,
+			ChunksizeInMB: 1, Threads: 1, StmtSize: 10000, IntervalMs: 500}
+		_, err := NewDumper(DumpConfig{DumpArgs: args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+		data, err := ioutil.ReadFile(dir + "/test.orders-schema.sql")
+		assert.Nil(t, err)
+		assert.True(t, strings.Contains(string(data), "CONSTRAINT `chk_qty` CHECK ((`qty` > 0))"))
+		assert.True(t, strings.Contains(string(data), "/*!80016 NOT ENFORCED */"))
+		data, err = ioutil.ReadFile(dir + "/" + compatibilityFile)
+		assert.Nil(t, err)
+		assert.True(t, strings.Contains(string(data), "CHECK constraints `chk_qty`, `chk_price`"))
+	}
+
+	load := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: address, Threads: 1, IntervalMs: 500}
+
+	// The loader creates the table with them, the target kept them.
+	{
+		fakedbs.AddQueryPattern("insert .*", &sqltypes.Result{})
+		_, err := NewLoader(LoadConfig{LoadArgs: load, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum(strings.ToLower(checkSchema)))
+	}
+
+	// A row the target rejects fails with the constraint named.
+	{
+		fakedbs.ResetAll()
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryErrorPattern("insert .*", sqldb.NewSQLError(erCheckConstraintViolated, "Check constraint 'chk_qty' is violated."))
+		_, err := NewLoader(LoadConfig{LoadArgs: load, Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "check.constraint.violated"))
+		assert.True(t, strings.Contains(err.Error(), "chk_qty"))
+	}
+}
+
+// exprSchema is a MySQL 8.0 table with multi-line and named CHECK
+// constraints, quotes and semicolons in their expressions, and functional
+// defaults.
+const exprSchema = "CREATE TABLE `events` (\n" +
+	"  `id` binary(16) NOT NULL DEFAULT (uuid_to_bin(uuid())),\n" +
+	"  `qty` int NOT NULL,\n" +
+	"  `note` varchar(64) DEFAULT 'a;b (c',\n" +
+	"  `tags` json DEFAULT (json_array()),\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  CONSTRAINT `chk_qty` CHECK (((`qty` > 0)\n" +
+	"    and (`qty` < 1000))),\n" +
+	"  CONSTRAINT `chk_note` CHECK ((not((`note` like _utf8mb4'%;%')))) /*!80016 NOT ENFORCED */,\n" +
+	"  CONSTRAINT `events_chk_1` CHECK ((`note` <> _utf8mb4'it''s \\'quoted\\' ) ;'))\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+func TestStripCheckConstraints(t *testing.T) {
+	// The splitter keeps the statement whole.
+	stmts := splitStatements(exprSchema + ";\n")
+	assert.Equal(t, 1, len(stmts))
+	assert.Equal(t, exprSchema, stmts[0].sql)
+	assert.Equal(t, []string{"`chk_qty`", "`events_chk_1`"}, checkConstraints(exprSchema))
+
+	// The CHECKs are left out, the expression defaults are kept.
+	{
+		query, checks := stripCheckConstraints(exprSchema)
+		assert.Equal(t, []string{"`chk_qty`", "`chk_note`", "`events_chk_1`"}, checks)
+		assert.Equal(t, "CREATE TABLE `events` (\n"+
+			"  `id` binary(16) NOT NULL DEFAULT (uuid_to_bin(uuid())),\n"+
+			"  `qty` int NOT NULL,\n"+
+			"  `note` varchar(64) DEFAULT 'a;b (c',\n"+
+			"  `tags` json DEFAULT (json_array()),\n"+
+			"  PRIMARY KEY (`id`)\n"+
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4", query)
+		assert.Nil(t, checkConstraints(query))
+	}
+
+	// MariaDB, the CHECK of a column and an unnamed one.
+	{
+		mariadb := "CREATE TABLE `t1` (\n  `a` int(11) DEFAULT NULL CHECK (`a` > 0),\n  `b` varchar(8) DEFAULT 'check (b)',\n" +
+			"  CHECK (`b` <> 'x')\n) ENGINE=InnoDB"
+		query, checks := stripCheckConstraints(mariadb)
+		assert.Equal(t, []string{"column `a`", "CHECK"}, checks)
+		assert.Equal(t, "CREATE TABLE `t1` (\n  `a` int(11) DEFAULT NULL,\n  `b` varchar(8) DEFAULT 'check (b)'\n) ENGINE=InnoDB", query)
+	}
+
+	// None, the statement is left as it is.
+	{
+		query, checks := stripCheckConstraints(checkSchema[:strings.Index(checkSchema, ",\n  CONSTRAINT")] + "\n) ENGINE=InnoDB")
+		assert.Nil(t, checks)
+		assert.True(t, strings.HasSuffix(query, "PRIMARY KEY (`id`)\n) ENGINE=InnoDB"))
+	}
+}
+
+func TestLoaderSkipCheckConstraints(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/loaderskipchecks"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.events-schema.sql", "/*!40101 SET NAMES binary*/;\n"+exprSchema+";\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.events.00001.sql", "INSERT INTO `events`(`qty`,`note`) VALUES\n(1,'x;y');\n")
+	AssertNil(x)
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+
+	// The CREATE TABLE goes as it was dumped.
+	{
+		rec := &recordingExecutor{}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Contains(t, rec.queries, exprSchema)
+	}
+
+	// Without its CHECKs.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.SkipCheckConstraints = true
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		stripped, _ := stripCheckConstraints(exprSchema)
+		assert.Contains(t, rec.queries, stripped)
+		assert.NotContains(t, rec.queries, exprSchema)
+		assert.Contains(t, rec.queries, "INSERT INTO `events`(`qty`,`note`) VALUES\n(1,'x;y')")
+	}
+}
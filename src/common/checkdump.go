@@ -0,0 +1,324 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// CheckArgs are the arguments of CheckDump.
+type CheckArgs struct {
+	// Dir is the dump directory, or the location of its storage.
+	Dir     string
+	Threads int
+	// MaxMemory bounds the bytes of the files read at once, 0 for no bound.
+	MaxMemory int64
+}
+
+// CheckReport is what CheckDump read of a dump and the problems it found.
+type CheckReport struct {
+	Files      int
+	Bytes      int64
+	Statements int
+	// Hashed are the files checked against the size and the CRC32 they were
+	// written with in checkpoint.jsonl.
+	Hashed   int
+	Problems []string
+}
+
+// WriteReport writes the report, a line of totals then a line per problem.
+func (r *CheckReport) WriteReport(w io.Writer) error {
+	status := "ok"
+	if len(r.Problems) > 0 {
+		status = "failed"
+	}
+	if _, err := fmt.Fprintf(w, "check %s: files %d, bytes %d, statements %d, hashed %d, problems %d\n", status, r.Files, r.Bytes, r.Statements, r.Hashed, len(r.Problems)); err != nil {
+		return err
+	}
+	for _, problem := range r.Problems {
+		if _, err := fmt.Fprintf(w, "  %s\n", problem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkFile is the check of a file of the dump.
+type checkFile struct {
+	name       string
+	bytes      int64
+	statements int
+	hashed     bool
+	problems   []string
+}
+
+// CheckDump checks a dump restores without any connection: the layout of
+// Verify, every SQL file read and split into its statements which must all
+// be terminated, the rows of the other formats whole, the files of
+// checkpoint.jsonl with the size and the CRC32 they were written with, and
+// the metadata and manifest.json complete. The files are checked by
+// args.Threads workers, with at most args.MaxMemory bytes of them read at
+// once. The problems fail it with a CategoryStorage error.
+func CheckDump(ctx context.Context, log *xlog.Log, args CheckArgs) (*CheckReport, error) {
+	storage, err := openDumpStorage(log, args.Dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	names, err := storage.List()
+	if err != nil {
+		return nil, wrapf(err, "check.file.walk.error:%v", err)
+	}
+	files, err := loadFiles(storage)
+	if err != nil {
+		return nil, err
+	}
+	notDumpedMarker(storage, files)
+
+	report := &CheckReport{Problems: layoutProblems(files)}
+	report.Problems = append(report.Problems, checkDumpFiles(log, storage, names, files)...)
+	hashes, problems := checkpointHashes(storage)
+	report.Problems = append(report.Problems, problems...)
+
+	// The files of the checkpoint missing from the dump are checked too, they
+	// fail to open.
+	var checks []*checkFile
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if checkedFile(name) {
+			seen[name] = true
+			checks = append(checks, &checkFile{name: name})
+		}
+	}
+	for _, name := range hashes.names {
+		if !seen[name] {
+			checks = append(checks, &checkFile{name: name})
+		}
+	}
+	if err := checkFiles(ctx, storage, checks, hashes.chunks, args); err != nil {
+		return nil, err
+	}
+	for _, c := range checks {
+		report.Files++
+		report.Bytes += c.bytes
+		report.Statements += c.statements
+		if c.hashed {
+			report.Hashed++
+		}
+		report.Problems = append(report.Problems, c.problems...)
+	}
+
+	log.Info("check.dir[%s].files[%d].bytes[%d].statements[%d].hashed[%d].problems[%d]", args.Dir, report.Files, report.Bytes, report.Statements, report.Hashed, len(report.Problems))
+	if len(report.Problems) > 0 {
+		return report, &CategorizedError{Category: CategoryStorage, Err: fmt.Errorf("check.dir[%s].failed.problems[%d]", args.Dir, len(report.Problems))}
+	}
+	return report, nil
+}
+
+// checkedFile reports whether CheckDump reads the file: the SQL files and the
+// data files of the other formats, not the partial markers or the files
+// describing the dump.
+func checkedFile(name string) bool {
+	if partialMarker(name) {
+		return false
+	}
+	if strings.HasSuffix(name, tableSuffix) {
+		return true
+	}
+	return volumeFile(name) && rowFormatFile(name)
+}
+
+// rowFormatFile reports whether the file has the suffix of a data file of one
+// of the rowFormats.
+func rowFormatFile(name string) bool {
+	for _, format := range rowFormats {
+		if strings.HasSuffix(name, format.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDumpFiles returns the problems of the files describing the dump: the
+// metadata file the dumper writes last must be there, and the tables of
+// manifest.json must have their schema file and the data files its stats
+// count. A dump without manifest.json, from mydumper, is only logged.
+func checkDumpFiles(log *xlog.Log, s Storage, names []string, files *Files) []string {
+	var problems []string
+	present := make(map[string]bool)
+	for _, name := range names {
+		present[name] = true
+	}
+	if !present[metaFile] {
+		problems = append(problems, fmt.Sprintf("no %s file, the dump did not finish", metaFile))
+	}
+
+	m, err := readManifest(s)
+	if os.IsNotExist(err) {
+		log.Warning("check.no.%s.tables.not.checked.against.it", manifestFile)
+		return problems
+	}
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s does not parse: %v", manifestFile, err))
+	}
+	datas := make(map[string]int)
+	for _, name := range names {
+		if volumeFile(name) && rowFormatFile(name) && !partialMarker(name) {
+			db, table := dataFileTable(name)
+			datas[db+"."+table]++
+		}
+	}
+	for _, t := range m.Tables {
+		name := t.Database + "." + t.Table
+		if !present[name+schemaSuffix] {
+			problems = append(problems, fmt.Sprintf("table %s of %s has no schema file %s%s", name, manifestFile, name, schemaSuffix))
+		}
+		if t.Failed != "" {
+			problems = append(problems, fmt.Sprintf("table %s failed in the dump: %s", name, t.Failed))
+		}
+		if t.Stats != nil && t.Stats.Files != datas[name] {
+			problems = append(problems, fmt.Sprintf("table %s has %d data files, %s counts %d", name, datas[name], manifestFile, t.Stats.Files))
+		}
+	}
+	return problems
+}
+
+// dumpHashes are the data files of checkpoint.jsonl, with the size and the
+// CRC32 they were written with.
+type dumpHashes struct {
+	names  []string
+	chunks map[string]checkpointChunk
+}
+
+// checkpointHashes reads the hashes of checkpoint.jsonl, none without one.
+// A line which doesn't parse is a problem, the checkpoint was cut short.
+func checkpointHashes(s Storage) (dumpHashes, []string) {
+	hashes := dumpHashes{chunks: make(map[string]checkpointChunk)}
+	data, err := readFile(s, checkpointFile)
+	if os.IsNotExist(err) {
+		return hashes, nil
+	}
+	if err != nil {
+		return hashes, []string{fmt.Sprintf("%s can't be read: %v", checkpointFile, err)}
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		t := &checkpointTable{}
+		if err := json.Unmarshal(scanner.Bytes(), t); err != nil || t.Stats == nil {
+			return hashes, []string{fmt.Sprintf("%s line %d does not parse, the checkpoint is truncated", checkpointFile, line)}
+		}
+		for _, chunk := range t.Chunks {
+			if _, ok := hashes.chunks[chunk.Name]; !ok {
+				hashes.names = append(hashes.names, chunk.Name)
+			}
+			hashes.chunks[chunk.Name] = chunk
+		}
+	}
+	return hashes, nil
+}
+
+// checkFiles checks the files by args.Threads workers, each holds a file in
+// memory while it checks it, args.MaxMemory bounds their bytes.
+func checkFiles(ctx context.Context, s Storage, checks []*checkFile, hashes map[string]checkpointChunk, args CheckArgs) error {
+	threads := args.Threads
+	if threads < 1 {
+		threads = 1
+	}
+	memory := newByteSemaphore(ctx, args.MaxMemory)
+	work := make(chan *checkFile)
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				c.check(s, hashes, memory)
+			}
+		}()
+	}
+	var err error
+	for _, c := range checks {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		work <- c
+	}
+	close(work)
+	wg.Wait()
+	return err
+}
+
+// check reads the file and records its problems.
+func (c *checkFile) check(s Storage, hashes map[string]checkpointChunk, memory *byteSemaphore) {
+	if memory != nil {
+		info, err := s.Stat(c.name)
+		if err != nil {
+			c.problems = append(c.problems, c.unreadable(err))
+			return
+		}
+		held, err := memory.acquire(info.Size())
+		if err != nil {
+			c.problems = append(c.problems, c.unreadable(err))
+			return
+		}
+		defer memory.release(held)
+	}
+	data, err := readFile(s, c.name)
+	if err != nil {
+		c.problems = append(c.problems, c.unreadable(err))
+		return
+	}
+	c.bytes = int64(len(data))
+
+	if chunk, ok := hashes[c.name]; ok {
+		c.hashed = true
+		if c.bytes != chunk.Size || crc32.ChecksumIEEE(data) != chunk.CRC32 {
+			c.problems = append(c.problems, fmt.Sprintf("file %s has %d bytes and CRC32 %08x, %s recorded %d bytes and CRC32 %08x", c.name, c.bytes, crc32.ChecksumIEEE(data), checkpointFile, chunk.Size, chunk.CRC32))
+		}
+	}
+
+	if !strings.HasSuffix(c.name, tableSuffix) {
+		// A row of the other formats is a line.
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			c.problems = append(c.problems, fmt.Sprintf("file %s ends in the middle of a row", c.name))
+		}
+		return
+	}
+	body, trailer := splitFileTrailer(string(data))
+	if trailer != "" {
+		if err := verifyFileTrailer(c.name, string(data)); err != nil {
+			c.problems = append(c.problems, fmt.Sprintf("file %s doesn't match its trailer: %v", c.name, err))
+		}
+	}
+	stmts := splitStatements(body)
+	c.statements = len(stmts)
+	if n := len(stmts); n > 0 && !stmts[n-1].terminated {
+		c.problems = append(c.problems, fmt.Sprintf("file %s ends in the middle of a statement at byte %d", c.name, stmts[n-1].offset))
+	}
+}
+
+// unreadable returns the problem of a file which can't be read.
+func (c *checkFile) unreadable(err error) string {
+	if os.IsNotExist(err) {
+		return fmt.Sprintf("file %s of %s is missing", c.name, checkpointFile)
+	}
+	return fmt.Sprintf("file %s can't be read: %v", c.name, err)
+}
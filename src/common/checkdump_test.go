@@ -0,0 +1,124 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDump(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	dir := "/tmp/checkdumptest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	data := "INSERT INTO `t1`(`a`) VALUES\n(1);\nINSERT INTO `t1`(`a`) VALUES\n(2);\n"
+	x = WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int(11));\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", data)
+	AssertNil(x)
+	x = WriteFile(dir+"/metadata", "Started dump at: 2017-10-13 10:11:12\nFinished dump at: 2017-10-13 10:11:13\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/manifest.json", `{"version":"1.0.0","tables":[{"database":"test","table":"t1","stats":{"files":1}}]}`)
+	AssertNil(x)
+	x = WriteFile(dir+"/checkpoint.jsonl", fmt.Sprintf(`{"database":"test","table":"t1","format":"sql","chunks":[{"name":"test.t1.00001.sql","size":%d,"crc32":%d}],"stats":{"files":1}}`+"\n", len(data), crc32.ChecksumIEEE([]byte(data))))
+	AssertNil(x)
+	args := CheckArgs{Dir: dir, Threads: 2, MaxMemory: 16}
+
+	// Good.
+	{
+		report, err := CheckDump(context.Background(), log, args)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, report.Files)
+		assert.Equal(t, 4, report.Statements)
+		assert.Equal(t, 1, report.Hashed)
+		assert.Nil(t, report.Problems)
+
+		out := &bytes.Buffer{}
+		assert.Nil(t, report.WriteReport(out))
+		assert.Equal(t, fmt.Sprintf("check ok: files 3, bytes %d, statements 4, hashed 1, problems 0\n", report.Bytes), out.String())
+	}
+
+	// A data file cut short, changed since the checkpoint, and a file of the
+	// checkpoint missing.
+	{
+		x = WriteFile(dir+"/test.t1.00001.sql", data[:len(data)-5])
+		AssertNil(x)
+		x = WriteFile(dir+"/checkpoint.jsonl", fmt.Sprintf(`{"database":"test","table":"t1","format":"sql","chunks":[{"name":"test.t1.00001.sql","size":%d,"crc32":%d},{"name":"test.t1.00002.sql","size":1,"crc32":1}],"stats":{"files":2}}`+"\n", len(data), crc32.ChecksumIEEE([]byte(data))))
+		AssertNil(x)
+		report, err := CheckDump(context.Background(), log, args)
+		assert.NotNil(t, err)
+		assert.Equal(t, CategoryStorage, ErrorCategoryOf(err))
+		assert.Equal(t, fmt.Sprintf("check.dir[%s].failed.problems[3]", dir), err.Error())
+		assert.Equal(t, []string{
+			fmt.Sprintf("file test.t1.00001.sql has %d bytes and CRC32 %08x, checkpoint.jsonl recorded %d bytes and CRC32 %08x", len(data)-5, crc32.ChecksumIEEE([]byte(data[:len(data)-5])), len(data), crc32.ChecksumIEEE([]byte(data))),
+			"file test.t1.00001.sql ends in the middle of a statement at byte 34",
+			"file test.t1.00002.sql of checkpoint.jsonl is missing",
+		}, report.Problems)
+	}
+
+	// No metadata, a table of the manifest without its schema file, failed
+	// and with data files missing, a CSV file cut in a row, a truncated checkpoint.
+	{
+		x = WriteFile(dir+"/test.t1.00001.sql", data)
+		AssertNil(x)
+		os.Remove(dir + "/metadata")
+		x = WriteFile(dir+"/manifest.json", `{"version":"1.0.0","tables":[{"database":"test","table":"t1","stats":{"files":1}},{"database":"test","table":"t2","stats":{"files":2},"failed":"the schema changed"}]}`)
+		AssertNil(x)
+		x = WriteFile(dir+"/test.t2.00001.csv", "1,\"a\"\n2,\"b")
+		AssertNil(x)
+		x = WriteFile(dir+"/checkpoint.jsonl", `{"database":"test","table":"t1","format":"sql","chunks":[`)
+		AssertNil(x)
+		report, err := CheckDump(context.Background(), log, CheckArgs{Dir: dir})
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{
+			"no metadata file, the dump did not finish",
+			"table test.t2 of manifest.json has no schema file test.t2-schema.sql",
+			"table test.t2 failed in the dump: the schema changed",
+			"table test.t2 has 1 data files, manifest.json counts 2",
+			"checkpoint.jsonl line 1 does not parse, the checkpoint is truncated",
+			"file test.t2.00001.csv ends in the middle of a row",
+		}, report.Problems)
+	}
+
+	// The layout problems of Verify.
+	{
+		x = WriteFile(dir+"/test.t3.00001.sql", "INSERT INTO `t3`(`a`) VALUES\n(1);\n")
+		AssertNil(x)
+		report, err := CheckDump(context.Background(), log, CheckArgs{Dir: dir})
+		assert.NotNil(t, err)
+		assert.Equal(t, "data file test.t3.00001.sql has no schema file test.t3-schema.sql", report.Problems[0])
+		out := &bytes.Buffer{}
+		assert.Nil(t, report.WriteReport(out))
+		assert.True(t, strings.HasPrefix(out.String(), "check failed: files 5,"))
+		assert.True(t, strings.Contains(out.String(), "\n  data file test.t3.00001.sql has no schema file test.t3-schema.sql\n"))
+	}
+
+	// A data file changed since its trailer.
+	{
+		x = WriteFile(dir+"/test.t1.00001.sql", data+fileTrailer([]byte(data[:len(data)-5]), 2))
+		AssertNil(x)
+		report, err := CheckDump(context.Background(), log, CheckArgs{Dir: dir})
+		assert.NotNil(t, err)
+		assert.Contains(t, report.Problems, fmt.Sprintf("file test.t1.00001.sql doesn't match its trailer: restoring.file[test.t1.00001.sql].has[%d].bytes.the.trailer.recorded[%d]", len(data), len(data)-5))
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+const checkpointFile = "checkpoint.jsonl"
+
+// checkpointChunk is a data file of a checkpointed table.
+type checkpointChunk struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+	// From and To are the range of the column of a table dumped with
+	// DumpArgs.ChunkBy, or of the key of one dumped with DumpArgs.ChunkRows,
+	// see ManifestChunk.
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// checkpointTable is a line of checkpoint.jsonl, written once the data files
+// of the table are all written, with what the manifest records of it.
+type checkpointTable struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Format   string `json:"format"`
+	// ChunkBy is the DumpArgs.ChunkBy of the table as column[:interval],
+	// empty if it was chunked by size.
+	ChunkBy string `json:"chunk_by,omitempty"`
+	// ChunkKey is the ManifestTable.ChunkKey of the table.
+	ChunkKey      string            `json:"chunk_key,omitempty"`
+	Chunks        []checkpointChunk `json:"chunks"`
+	Stats         *TableStats       `json:"stats"`
+	AutoIncrement uint64            `json:"auto_increment,omitempty"`
+	// Checksummed is set if the dump ran with DumpArgs.Checksum, Checksum is
+	// still nil if the table has none.
+	Checksummed bool    `json:"checksummed,omitempty"`
+	Checksum    *uint64 `json:"checksum,omitempty"`
+	// Paranoid is the check of DumpArgs.Paranoid, nil without it or for a
+	// table out of the snapshot.
+	Paranoid *ParanoidCheck `json:"paranoid,omitempty"`
+	// Consistency is the ManifestTable.Consistency of the table.
+	Consistency string `json:"consistency,omitempty"`
+}
+
+// newCheckpointChunk records a data file written with data.
+func newCheckpointChunk(name string, data []byte) checkpointChunk {
+	return checkpointChunk{Name: name, Size: int64(len(data)), CRC32: crc32.ChecksumIEEE(data)}
+}
+
+// formatName returns DumpArgs.Format, FormatSQL if unset.
+func (args *DumpArgs) formatName() string {
+	if args.Format == "" {
+		return FormatSQL
+	}
+	return args.Format
+}
+
+// checkpointWriter appends the lines of checkpoint.jsonl as the tables finish,
+// like the statsWriter, so a killed dump keeps the tables it finished.
+type checkpointWriter struct {
+	mu   sync.Mutex
+	file io.WriteCloser
+	// done are the tables written, by name.
+	done map[string]bool
+}
+
+// newCheckpointWriter creates checkpoint.jsonl with the tables resumed from
+// the previous one.
+func newCheckpointWriter(s Storage, resumed []*checkpointTable) (*checkpointWriter, error) {
+	f, err := createLog(s, checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+	w := &checkpointWriter{file: f, done: make(map[string]bool)}
+	for _, t := range resumed {
+		if err := w.write(t); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *checkpointWriter) write(t *checkpointTable) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err = w.file.Write(append(data, '\n')); err == nil {
+		w.done[t.Table] = true
+	}
+	return err
+}
+
+// pending returns the tables which are not written yet.
+func (w *checkpointWriter) pending(tables []string) []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var pending []string
+	for _, table := range tables {
+		if !w.done[table] {
+			pending = append(pending, table)
+		}
+	}
+	return pending
+}
+
+func (w *checkpointWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// readCheckpoint reads the tables of checkpoint.jsonl by 'db.table', none if
+// there is no checkpoint. A killed dump may have cut the last line short, the
+// reading stops at the first line which does not parse.
+func readCheckpoint(log *xlog.Log, s Storage) (map[string]*checkpointTable, error) {
+	tables := make(map[string]*checkpointTable)
+	data, err := readFile(s, checkpointFile)
+	if os.IsNotExist(err) {
+		log.Warning("dumping.resume.no.checkpoint[%s].dumping.all.tables", checkpointFile)
+		return tables, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		t := &checkpointTable{}
+		if err := json.Unmarshal(scanner.Bytes(), t); err != nil || t.Stats == nil {
+			log.Warning("dumping.resume.checkpoint[%s].line[%d].truncated.ignoring.the.rest", checkpointFile, line)
+			break
+		}
+		tables[t.Database+"."+t.Table] = t
+	}
+	return tables, nil
+}
+
+// verify reads the data files of a checkpointed table back, they must all be
+// there with the size and the CRC32 they were written with.
+func (t *checkpointTable) verify(s Storage) error {
+	for _, chunk := range t.Chunks {
+		data, err := readFile(s, chunk.Name)
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != chunk.Size || crc32.ChecksumIEEE(data) != chunk.CRC32 {
+			return fmt.Errorf("file[%s].changed.since.the.checkpoint", chunk.Name)
+		}
+	}
+	return nil
+}
+
+// resumeTables returns the tables of the checkpoint the dump can skip: written
+// in the same format, checksummed if args.Checksum asks for it, and with their
+// data files unchanged. The others are dumped again.
+func resumeTables(log *xlog.Log, args *DumpArgs, tables []string) (map[string]*checkpointTable, error) {
+	done, err := readCheckpoint(log, args.storage)
+	if err != nil {
+		return nil, err
+	}
+	resumed := make(map[string]*checkpointTable)
+	for _, table := range tables {
+		t, ok := done[args.Database+"."+table]
+		if !ok {
+			continue
+		}
+		switch {
+		case t.Format != args.formatName():
+			log.Warning("dumping.resume.table[%s.%s].format[%s].is.not[%s].dumping.again", args.Database, table, t.Format, args.formatName())
+		case t.ChunkBy != args.tableChunkBy(table).String():
+			log.Warning("dumping.resume.table[%s.%s].chunk.by[%s].is.not[%s].dumping.again", args.Database, table, t.ChunkBy, args.tableChunkBy(table))
+		case args.Checksum && !t.Checksummed:
+			log.Warning("dumping.resume.table[%s.%s].has.no.checksum.dumping.again", args.Database, table)
+		default:
+			if err := t.verify(args.storage); err != nil {
+				log.Warning("dumping.resume.table[%s.%s].%v.dumping.again", args.Database, table, err)
+				continue
+			}
+			resumed[table] = t
+		}
+	}
+	log.Info("dumping.resume.tables[%d/%d].from.checkpoint", len(resumed), len(tables))
+	return resumed, nil
+}
+
+// checkStaleChunk fails if a data file after the last ones of a table dumped
+// again exists, by the labels next of TableStats: it was written by the
+// interrupted dump of a table which has fewer rows now, the loader would
+// restore its rows twice.
+func checkStaleChunk(args *DumpArgs, table string, next []string) error {
+	for _, label := range next {
+		file := fmt.Sprintf("%s.%s.%s%s", args.Database, table, label, args.format().suffix)
+		if _, err := args.storage.Stat(file); err == nil {
+			return fmt.Errorf("dumping.resume.table[%s.%s].stale.file[%s].from.the.interrupted.dump.remove.the.table.files.and.retry", args.Database, table, file)
+		}
+	}
+	return nil
+}
+
+// resumeTable records a table skipped by a resumed dump in the stats and the
+// manifest as the interrupted dump recorded it.
+func resumeTable(log *xlog.Log, args *DumpArgs, manifest *Manifest, stats *statsWriter, t *checkpointTable) error {
+	if err := stats.write(t.Database, t.Table, t.Stats); err != nil {
+		return err
+	}
+	manifest.setStats(t.Database, t.Table, t.Stats, args.wholeTable(t.Table))
+	if t.ChunkBy != "" {
+		manifest.setChunks(t.Database, t.Table, t.ChunkBy, t.Chunks)
+	} else if t.ChunkKey != "" {
+		manifest.setChunkKey(t.Database, t.Table, t.ChunkKey, t.Chunks)
+	}
+	if t.AutoIncrement > 0 {
+		manifest.setAutoIncrement(t.Database, t.Table, t.AutoIncrement)
+	}
+	if t.Checksum != nil {
+		manifest.setChecksum(t.Database, t.Table, *t.Checksum)
+	}
+	if t.Paranoid != nil {
+		manifest.setParanoid(t.Database, t.Table, t.Paranoid)
+	}
+	if t.Consistency != "" {
+		manifest.setConsistency(t.Database, t.Table, t.Consistency)
+		args.metrics.tableConsistency(t.Consistency)
+	}
+	args.metrics.tableDone()
+	log.Info("dumping.table[%s.%s].resumed.from.checkpoint.files[%d].rows[%d]", t.Database, t.Table, len(t.Chunks), t.Stats.Rows)
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckpointReadWrite(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	s := NewMemStorage()
+
+	// No checkpoint.
+	{
+		tables, err := readCheckpoint(log, s)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(tables))
+	}
+
+	// Written then read back.
+	{
+		sum := uint64(42)
+		t1 := &checkpointTable{Database: "db", Table: "t1", Format: FormatSQL, Stats: &TableStats{Rows: 1}, AutoIncrement: 7}
+		t2 := &checkpointTable{Database: "db", Table: "t2", Format: FormatSQL, Stats: &TableStats{Rows: 2}, Checksummed: true, Checksum: &sum}
+		w, err := newCheckpointWriter(s, []*checkpointTable{t1})
+		assert.Nil(t, err)
+		assert.Nil(t, w.write(t2))
+		assert.Nil(t, w.close())
+
+		tables, err := readCheckpoint(log, s)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(tables))
+		assert.Equal(t, uint64(7), tables["db.t1"].AutoIncrement)
+		assert.Equal(t, uint64(42), *tables["db.t2"].Checksum)
+	}
+
+	// Cut short by a killed dump.
+	{
+		data, err := readFile(s, checkpointFile)
+		assert.Nil(t, err)
+		assert.Nil(t, writeFile(s, checkpointFile, string(data[:len(data)-10])))
+		tables, err := readCheckpoint(log, s)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(tables))
+		assert.NotNil(t, tables["db.t1"])
+	}
+}
+
+func TestCheckpointResumeTables(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	s := NewMemStorage()
+	args := &DumpArgs{Database: "db", storage: s}
+
+	chunk := func(name string, data string) checkpointChunk {
+		assert.Nil(t, writeFile(s, name, data))
+		return newCheckpointChunk(name, []byte(data))
+	}
+	tables := []*checkpointTable{
+		{Database: "db", Table: "ok", Format: FormatSQL, Stats: &TableStats{}, Chunks: []checkpointChunk{chunk("db.ok.00001.sql", "a"), chunk("db.ok.00002.sql", "b")}},
+		{Database: "db", Table: "changed", Format: FormatSQL, Stats: &TableStats{}, Chunks: []checkpointChunk{chunk("db.changed.00001.sql", "a")}},
+		{Database: "db", Table: "missing", Format: FormatSQL, Stats: &TableStats{}, Chunks: []checkpointChunk{{Name: "db.missing.00001.sql", Size: 1}}},
+		{Database: "db", Table: "csv", Format: FormatCSV, Stats: &TableStats{}, Chunks: []checkpointChunk{chunk("db.csv.00001.csv", "a")}},
+		{Database: "db", Table: "empty", Format: FormatSQL, Stats: &TableStats{}},
+	}
+	assert.Nil(t, writeFile(s, "db.changed.00001.sql", "b"))
+	w, err := newCheckpointWriter(s, tables)
+	assert.Nil(t, err)
+	assert.Nil(t, w.close())
+
+	// Only the unchanged tables of the same format.
+	{
+		resumed, err := resumeTables(log, args, []string{"ok", "changed", "missing", "csv", "empty", "new"})
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(resumed))
+		assert.NotNil(t, resumed["ok"])
+		assert.NotNil(t, resumed["empty"])
+	}
+
+	// Not dumped with checksums.
+	{
+		sums := *args
+		sums.Checksum = true
+		resumed, err := resumeTables(log, &sums, []string{"ok"})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resumed))
+	}
+
+	// Chunked by a column now.
+	{
+		chunked := *args
+		chunked.ChunkBy = map[string]ChunkColumn{"db.ok": {Column: "created_date"}}
+		resumed, err := resumeTables(log, &chunked, []string{"ok", "empty"})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(resumed))
+		assert.NotNil(t, resumed["empty"])
+	}
+}
+
+func TestCheckpointStaleChunk(t *testing.T) {
+	s := NewMemStorage()
+	args := &DumpArgs{Database: "db", storage: s}
+	assert.Nil(t, writeFile(s, "db.t1.00001.sql", "a"))
+	assert.Nil(t, writeFile(s, "db.t1.00002.sql", "b"))
+
+	assert.Nil(t, checkStaleChunk(args, "t1", []string{"00003"}))
+	assert.NotNil(t, checkStaleChunk(args, "t1", []string{"00002"}))
+	assert.NotNil(t, checkStaleChunk(args, "t1", []string{"00001"}))
+
+	// The files of the key ranges, by range.
+	assert.Nil(t, writeFile(s, "db.t2.00001.00001.sql", "a"))
+	assert.Nil(t, writeFile(s, "db.t2.00002.00002.sql", "b"))
+	assert.Nil(t, checkStaleChunk(args, "t2", []string{"00001.00002", "00002.00003", "00003.00001"}))
+	assert.NotNil(t, checkStaleChunk(args, "t2", []string{"00001.00002", "00002.00002", "00003.00001"}))
+}
@@ -0,0 +1,193 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The ways verifyTable compares a restored table with its source.
+const (
+	verifyChecksum = "checksum"
+	verifyCount    = "count"
+)
+
+// tableChecksum returns the CHECKSUM TABLE of a table, ok is false if the
+// server has none for it (NULL).
+func tableChecksum(conn *Connection, db string, table string) (sum uint64, ok bool, err error) {
+	qr, err := conn.Fetch(fmt.Sprintf("CHECKSUM TABLE `%s`.`%s`", db, table))
+	if err != nil {
+		return 0, false, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 || qr.Rows[0][1].Raw() == nil {
+		return 0, false, nil
+	}
+	sum, err = strconv.ParseUint(qr.Rows[0][1].String(), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return sum, true, nil
+}
+
+// tableRows returns the COUNT(*) of a table.
+func tableRows(conn *Connection, db string, table string) (uint64, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT COUNT(*) FROM `%s`.`%s`", db, table))
+	if err != nil {
+		return 0, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+		return 0, fmt.Errorf("table[%s.%s].count.has.no.row", db, table)
+	}
+	return strconv.ParseUint(qr.Rows[0][0].String(), 10, 64)
+}
+
+// targetEngine returns the storage engine of a restored table, the server may
+// have substituted the one of the create statement.
+func targetEngine(conn *Connection, db string, table string) (string, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT ENGINE FROM information_schema.TABLES WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s'", EscapeBytes([]byte(db)), EscapeBytes([]byte(table))))
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) == 0 {
+		return "", fmt.Errorf("table[%s.%s].not.found", db, table)
+	}
+	return qr.Rows[0][0].String(), nil
+}
+
+// verifyMethod returns how a restored table with engine is compared with the
+// source table t: its checksum if the dumper recorded one and the engines
+// match, the checksum depends on the row format, else its row count, "" if
+// the manifest has neither.
+func verifyMethod(t *ManifestTable, engine string) string {
+	if t.Stats == nil {
+		return ""
+	}
+	if t.Checksum != nil && strings.EqualFold(t.Stats.Engine, engine) {
+		return verifyChecksum
+	}
+	return verifyCount
+}
+
+// verifyTable compares a restored table with the figures of the manifest and
+// returns the problem found, "" if it matches.
+func verifyTable(log *xlog.Log, conn *Connection, t *ManifestTable) (string, error) {
+	engine, err := targetEngine(conn, t.Database, t.Table)
+	if err != nil {
+		return "", err
+	}
+	switch verifyMethod(t, engine) {
+	case verifyChecksum:
+		sum, ok, err := tableChecksum(conn, t.Database, t.Table)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			if sum != *t.Checksum {
+				return fmt.Sprintf("table %s.%s checksum %d, source %d", t.Database, t.Table, sum, *t.Checksum), nil
+			}
+			log.Info("restoring.verify.table[%s.%s].checksum[%d].ok", t.Database, t.Table, sum)
+			return "", nil
+		}
+		log.Warning("restoring.verify.table[%s.%s].has.no.checksum.on.target.falling.back.to.count", t.Database, t.Table)
+	case verifyCount:
+		if t.Checksum != nil {
+			log.Warning("restoring.verify.table[%s.%s].engine[%s].source.engine[%s].differ.falling.back.to.count", t.Database, t.Table, engine, t.Stats.Engine)
+		}
+	default:
+		log.Warning("restoring.verify.table[%s.%s].skipped.no.stats.in.manifest", t.Database, t.Table)
+		return "", nil
+	}
+
+	rows, err := tableRows(conn, t.Database, t.Table)
+	if err != nil {
+		return "", err
+	}
+	if rows != t.Stats.Rows {
+		return fmt.Sprintf("table %s.%s has %d rows, source %d", t.Database, t.Table, rows, t.Stats.Rows), nil
+	}
+	log.Info("restoring.verify.table[%s.%s].rows[%d].ok", t.Database, t.Table, rows)
+	return "", nil
+}
+
+// verifyChecksums compares the restored tables with the manifest of the dump,
+// in parallel on the connections of the pool, and fails with every mismatch.
+func verifyChecksums(log *xlog.Log, pool *Pool, args *LoadArgs, schemas []string) error {
+	manifest, err := readManifest(args.store())
+	if err != nil {
+		// A dump of the C mydumper has no manifest.json, its metadata files
+		// have the rows.
+		files, lerr := loadFiles(args.store())
+		if lerr == nil {
+			manifest = mydumperManifest(mydumperRows(log, args.store(), files))
+		}
+		if manifest == nil {
+			return wrapf(err, "restoring.verify.checksums.requires.manifest:%v", err)
+		}
+		log.Info("restoring.verify.rows.of.mydumper.metadata.tables[%d]", len(manifest.Tables))
+	}
+	restored := make(map[string]bool)
+	for _, schema := range schemas {
+		restored[strings.TrimSuffix(filepath.Base(schema), schemaSuffix)] = true
+	}
+
+	limit := newPhaseLimit(args.metrics, "verify", args.postThreads())
+	defer limit.done()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs firstError
+	var problems []string
+	for _, t := range manifest.Tables {
+		if !restored[t.Database+"."+t.Table] {
+			continue
+		}
+		if errs.get() != nil {
+			break
+		}
+		conn := limit.get(pool)
+		wg.Add(1)
+		go func(conn *Connection, t *ManifestTable) {
+			defer limit.working()()
+			defer func() {
+				wg.Done()
+				limit.put(pool, conn)
+			}()
+			// The restored table, of LoadArgs.TablePrefix and TableSuffix.
+			target := *t
+			target.Table = args.targetTable(t.Table)
+			problem, err := verifyTable(log, conn, &target)
+			if err != nil {
+				errs.set(wrapf(err, "restoring.verify.table[%s.%s].error:%v", t.Database, t.Table, err))
+				return
+			}
+			if problem != "" {
+				log.Error("restoring.verify.mismatch:%s", problem)
+				mu.Lock()
+				problems = append(problems, problem)
+				mu.Unlock()
+			}
+		}(conn, t)
+	}
+	wg.Wait()
+	if err := errs.get(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("restoring.verify.checksums.failed:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksumVerifyMethod(t *testing.T) {
+	sum := uint64(1234)
+	innodb := &TableStats{Engine: "InnoDB", Rows: 10}
+
+	assert.Equal(t, verifyChecksum, verifyMethod(&ManifestTable{Stats: innodb, Checksum: &sum}, "InnoDB"))
+	assert.Equal(t, verifyChecksum, verifyMethod(&ManifestTable{Stats: innodb, Checksum: &sum}, "innodb"))
+	// The checksum depends on the row format, not comparable across engines.
+	assert.Equal(t, verifyCount, verifyMethod(&ManifestTable{Stats: innodb, Checksum: &sum}, "MyISAM"))
+	// Dumped without -checksum.
+	assert.Equal(t, verifyCount, verifyMethod(&ManifestTable{Stats: innodb}, "InnoDB"))
+	assert.Equal(t, "", verifyMethod(&ManifestTable{}, "InnoDB"))
+}
+
+// checksumResult is the result of CHECKSUM TABLE, NULL if sum is empty.
+func checksumResult(sum string) *sqltypes.Result {
+	value := sqltypes.NULL
+	if sum != "" {
+		value = sqltypes.MakeTrusted(querypb.Type_INT64, []byte(sum))
+	}
+	return &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Checksum",
+				Type: querypb.Type_INT64,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t")),
+				value,
+			},
+		}}
+}
+
+func singleResult(name string, value string) *sqltypes.Result {
+	return &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: name,
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(value)),
+			},
+		}}
+}
+
+func TestChecksumVerify(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		// t1 matches its checksum, t2 changed engine and has its rows, t3 lost a row.
+		fakedbs.AddQuery("select engine from information_schema.tables where table_schema='test' and table_name='t1'", singleResult("ENGINE", "InnoDB"))
+		fakedbs.AddQuery("select engine from information_schema.tables where table_schema='test' and table_name='t2'", singleResult("ENGINE", "MyISAM"))
+		fakedbs.AddQuery("select engine from information_schema.tables where table_schema='test' and table_name='t3'", singleResult("ENGINE", "InnoDB"))
+		fakedbs.AddQuery("checksum table `test`.`t1`", checksumResult("100"))
+		fakedbs.AddQuery("checksum table `test`.`t3`", checksumResult("301"))
+		fakedbs.AddQuery("select count(*) from `test`.`t2`", singleResult("COUNT(*)", "20"))
+		fakedbs.AddQuery("select count(*) from `test`.`t3`", singleResult("COUNT(*)", "29"))
+	}
+
+	dir := "/tmp/checksumverifytest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	sum1, sum2, sum3 := uint64(100), uint64(200), uint64(300)
+	m := newManifest()
+	m.Tables = []*ManifestTable{
+		{Database: "test", Table: "t1", Checksum: &sum1, Stats: &TableStats{Engine: "InnoDB", Rows: 10}},
+		{Database: "test", Table: "t2", Checksum: &sum2, Stats: &TableStats{Engine: "InnoDB", Rows: 20}},
+		{Database: "test", Table: "t3", Checksum: &sum3, Stats: &TableStats{Engine: "InnoDB", Rows: 30}},
+		{Database: "test", Table: "gone", Checksum: &sum3, Stats: &TableStats{Engine: "InnoDB", Rows: 30}},
+	}
+	storage := NewDirStorage(dir)
+	x = m.write(storage)
+	AssertNil(x)
+
+	pool, err := NewPool(log, 2, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	args := &LoadArgs{storage: storage}
+
+	// Only the restored tables.
+	{
+		err := verifyChecksums(log, pool, args, []string{"test.t1-schema.sql", "test.t2-schema.sql"})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, fakedbs.GetQueryCalledNum("checksum table `test`.`t2`"))
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("select count(*) from `test`.`t2`"))
+	}
+
+	// The mismatch fails.
+	{
+		err := verifyChecksums(log, pool, args, []string{"test.t1-schema.sql", "test.t3-schema.sql"})
+		assert.NotNil(t, err)
+		want := "restoring.verify.checksums.failed:\n  table test.t3 checksum 301, source 300"
+		assert.Equal(t, want, err.Error())
+	}
+
+	// Fall back to the count without a checksum on the target.
+	{
+		fakedbs.AddQuery("checksum table `test`.`t3`", checksumResult(""))
+		err := verifyChecksums(log, pool, args, []string{"test.t3-schema.sql"})
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "table test.t3 has 29 rows, source 30"))
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+const (
+	// The intervals of a ChunkColumn of a DATE, DATETIME or TIMESTAMP
+	// column.
+	ChunkHour  = "hour"
+	ChunkDay   = "day"
+	ChunkMonth = "month"
+	ChunkYear  = "year"
+
+	// chunkNullLabel is the part of the data file of the rows whose chunk
+	// column is NULL.
+	chunkNullLabel = "null"
+)
+
+// chunkUnits are the temporal intervals of a ChunkColumn by name: the
+// layout of the start of the value the chunk is cut to, the layout of its
+// range and the step to the next one.
+var chunkUnits = map[string]struct {
+	cut    string
+	layout string
+	next   func(time.Time) time.Time
+}{
+	ChunkHour:  {"2006-01-02 15", "2006-01-02 15:04:05", func(t time.Time) time.Time { return t.Add(time.Hour) }},
+	ChunkDay:   {"2006-01-02", "2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	ChunkMonth: {"2006-01", "2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	ChunkYear:  {"2006", "2006-01-02", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// ChunkColumn is the column the datas of a table are ordered and chunked
+// by, see DumpArgs.ChunkBy.
+type ChunkColumn struct {
+	Column string
+	// Interval is the width of a chunk: ChunkHour, ChunkDay (the default),
+	// ChunkMonth or ChunkYear for a DATE, DATETIME or TIMESTAMP column, a
+	// positive number for a numeric one.
+	Interval string
+}
+
+// String returns the column[:interval] of the flag, empty for none.
+func (c ChunkColumn) String() string {
+	if c.Interval == "" {
+		return c.Column
+	}
+	return c.Column + ":" + c.Interval
+}
+
+// validInterval reports whether the interval is one of a temporal column or
+// a positive number.
+func (c ChunkColumn) validInterval() bool {
+	if _, ok := chunkUnits[c.Interval]; ok || c.Interval == "" {
+		return true
+	}
+	f, err := strconv.ParseFloat(c.Interval, 64)
+	return err == nil && f > 0 && !math.IsInf(f, 0)
+}
+
+// tableChunkBy returns the DumpArgs.ChunkBy of a table of the dumped
+// database, the zero ChunkColumn if it's chunked by size.
+func (args *DumpArgs) tableChunkBy(table string) ChunkColumn {
+	return args.ChunkBy[args.Database+"."+table]
+}
+
+// chunkByTables returns the 'db.table' names of the DumpArgs.ChunkBy, sorted.
+func (args *DumpArgs) chunkByTables() []string {
+	names := make([]string, 0, len(args.ChunkBy))
+	for name := range args.ChunkBy {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// chunkRange is the chunk of a row: the part of the name of its data file
+// and the range of the column, from included and to excluded, both empty for
+// the NULLs.
+type chunkRange struct {
+	label string
+	from  string
+	to    string
+}
+
+// chunker labels the rows of a table dumped with a ChunkColumn.
+type chunker struct {
+	col     ChunkColumn
+	index   int
+	current string
+	// done are the labels of the chunks before the current one.
+	done map[string]bool
+}
+
+// newChunker returns the chunker of the column of fields.
+func newChunker(col ChunkColumn, fields []*querypb.Field) (*chunker, error) {
+	for i, fld := range fields {
+		if strings.EqualFold(fld.Name, col.Column) {
+			return &chunker{col: col, index: i, done: make(map[string]bool)}, nil
+		}
+	}
+	return nil, fmt.Errorf("chunk.by.column[%s].not.found", col.Column)
+}
+
+// chunk returns the chunk of a row. The rows are read ordered by the
+// column, a chunk is done once the next one starts: its label coming back
+// fails, its data file is already written.
+func (c *chunker) chunk(row []sqltypes.Value) (chunkRange, error) {
+	r, err := c.rangeOf(row[c.index])
+	if err != nil {
+		return chunkRange{}, err
+	}
+	if r.label != c.current {
+		if c.done[r.label] {
+			return chunkRange{}, fmt.Errorf("chunk.by.column[%s].chunk[%s].out.of.order", c.col.Column, r.label)
+		}
+		if c.current != "" {
+			c.done[c.current] = true
+		}
+		c.current = r.label
+	}
+	return r, nil
+}
+
+// rangeOf returns the chunk of a value of the column.
+func (c *chunker) rangeOf(v sqltypes.Value) (chunkRange, error) {
+	_, temporal := chunkUnits[c.col.Interval]
+	switch {
+	case v.Raw() == nil:
+		return chunkRange{label: chunkNullLabel}, nil
+	case v.Type() == querypb.Type_DATE || v.Type() == querypb.Type_DATETIME || v.Type() == querypb.Type_TIMESTAMP:
+		if !temporal && c.col.Interval != "" {
+			return chunkRange{}, fmt.Errorf("chunk.by.column[%s].is.temporal.interval[%s].must.be.%s.%s.%s.or.%s", c.col.Column, c.col.Interval, ChunkHour, ChunkDay, ChunkMonth, ChunkYear)
+		}
+		return temporalRange(v.String(), c.col.Interval)
+	case v.IsIntegral() || v.IsFloat() || v.Type() == querypb.Type_DECIMAL:
+		if temporal || c.col.Interval == "" {
+			return chunkRange{}, fmt.Errorf("chunk.by.column[%s].is.numeric.interval[%s].must.be.a.number", c.col.Column, c.col.Interval)
+		}
+		return numericRange(v.String(), c.col.Interval, v.IsIntegral())
+	}
+	return chunkRange{}, fmt.Errorf("chunk.by.column[%s].type[%v].is.not.numeric.or.temporal", c.col.Column, v.Type())
+}
+
+// temporalRange returns the chunk of a DATE, DATETIME or TIMESTAMP value by
+// an interval of chunkUnits, ChunkDay if empty: the label is the value cut
+// to the interval, like 2024-01-15 for a day or 2024-01-15-10 for an hour.
+// A zero date has no range.
+func temporalRange(value string, interval string) (chunkRange, error) {
+	if interval == "" {
+		interval = ChunkDay
+	}
+	unit := chunkUnits[interval]
+	if len(value) < len("2006-01-02") {
+		return chunkRange{}, fmt.Errorf("chunk.by.value[%s].is.not.a.date", value)
+	}
+	// The hour of a DATE is its first.
+	if len(value) < len(unit.cut) {
+		value += " 00"
+	}
+	cut := value[:len(unit.cut)]
+	r := chunkRange{label: strings.Replace(cut, " ", "-", 1)}
+	start, err := time.Parse(unit.cut, cut)
+	if err != nil {
+		return r, nil
+	}
+	r.from = start.Format(unit.layout)
+	r.to = unit.next(start).Format(unit.layout)
+	return r, nil
+}
+
+// numericRange returns the chunk of a numeric value by a numeric interval:
+// the label is the start of the chunk, the value rounded down to a multiple
+// of the interval. An integer column needs an integer interval.
+func numericRange(value string, interval string, integral bool) (chunkRange, error) {
+	if integral {
+		step, err := strconv.ParseInt(interval, 10, 64)
+		if err != nil {
+			return chunkRange{}, fmt.Errorf("chunk.by.interval[%s].must.be.an.integer.for.an.integer.column", interval)
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return chunkRange{}, fmt.Errorf("chunk.by.value[%s].error:%v", value, err)
+		}
+		start := n - ((n%step)+step)%step
+		return chunkRange{label: strconv.FormatInt(start, 10), from: strconv.FormatInt(start, 10), to: strconv.FormatInt(start+step, 10)}, nil
+	}
+	step, err := strconv.ParseFloat(interval, 64)
+	if err != nil {
+		return chunkRange{}, fmt.Errorf("chunk.by.interval[%s].error:%v", interval, err)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return chunkRange{}, fmt.Errorf("chunk.by.value[%s].error:%v", value, err)
+	}
+	start := strconv.FormatFloat(math.Floor(f/step)*step, 'f', -1, 64)
+	return chunkRange{label: start, from: start, to: strconv.FormatFloat(math.Floor(f/step)*step+step, 'f', -1, 64)}, nil
+}
+
+// chunkPartRegexp matches the label of a file of a chunk split in parts,
+// 'label.00001' and up, see dumpRange.
+var chunkPartRegexp = regexp.MustCompile(`^(.+)\.(\d{5})$`)
+
+// partLess orders the parts of the data files of a table: the numbers by
+// value, the labels of a ChunkColumn as strings, which orders the dates, and
+// the NULLs first. The files of a chunk split in parts follow each other.
+func partLess(a string, b string) bool {
+	if x, y := chunkPartRegexp.FindStringSubmatch(a), chunkPartRegexp.FindStringSubmatch(b); x != nil && y != nil && x[1] == y[1] {
+		return x[2] < y[2]
+	}
+	if x := chunkPartRegexp.FindStringSubmatch(a); x != nil {
+		a = x[1]
+	}
+	if y := chunkPartRegexp.FindStringSubmatch(b); y != nil {
+		b = y[1]
+	}
+	return labelLess(a, b)
+}
+
+// labelLess orders the labels of the chunks, see partLess.
+func labelLess(a string, b string) bool {
+	if a == chunkNullLabel || b == chunkNullLabel {
+		return a == chunkNullLabel && b != chunkNullLabel
+	}
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
@@ -0,0 +1,238 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkRanges(t *testing.T) {
+	temporal := []struct {
+		value    string
+		interval string
+		want     chunkRange
+	}{
+		{"2024-01-15 10:22:33", "", chunkRange{"2024-01-15", "2024-01-15", "2024-01-16"}},
+		{"2024-01-31", ChunkDay, chunkRange{"2024-01-31", "2024-01-31", "2024-02-01"}},
+		{"2024-01-15 10:22:33.123456", ChunkHour, chunkRange{"2024-01-15-10", "2024-01-15 10:00:00", "2024-01-15 11:00:00"}},
+		{"2024-01-15", ChunkHour, chunkRange{"2024-01-15-00", "2024-01-15 00:00:00", "2024-01-15 01:00:00"}},
+		{"2024-12-15", ChunkMonth, chunkRange{"2024-12", "2024-12-01", "2025-01-01"}},
+		{"2024-12-15 23:59:59", ChunkYear, chunkRange{"2024", "2024-01-01", "2025-01-01"}},
+		// A zero date has no range.
+		{"0000-00-00 00:00:00", ChunkDay, chunkRange{"0000-00-00", "", ""}},
+	}
+	for _, test := range temporal {
+		r, err := temporalRange(test.value, test.interval)
+		assert.Nil(t, err, test.value)
+		assert.Equal(t, test.want, r, test.value)
+	}
+	_, err := temporalRange("10:22:33", ChunkDay)
+	assert.NotNil(t, err)
+
+	numeric := []struct {
+		value    string
+		interval string
+		integral bool
+		want     chunkRange
+	}{
+		{"1234", "1000", true, chunkRange{"1000", "1000", "2000"}},
+		{"1000", "1000", true, chunkRange{"1000", "1000", "2000"}},
+		{"-1", "1000", true, chunkRange{"-1000", "-1000", "0"}},
+		{"2.75", "0.5", false, chunkRange{"2.5", "2.5", "3"}},
+		{"-0.25", "1", false, chunkRange{"-1", "-1", "0"}},
+	}
+	for _, test := range numeric {
+		r, err := numericRange(test.value, test.interval, test.integral)
+		assert.Nil(t, err, test.value)
+		assert.Equal(t, test.want, r, test.value)
+	}
+	_, err = numericRange("12", "0.5", true)
+	assert.NotNil(t, err)
+}
+
+func TestChunker(t *testing.T) {
+	fields := []*querypb.Field{{Name: "id", Type: querypb.Type_INT64}, {Name: "created_date", Type: querypb.Type_DATETIME}}
+	row := func(id string, date string) []sqltypes.Value {
+		r := []sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_INT64, []byte(id)), sqltypes.NULL}
+		if date != "" {
+			r[1] = sqltypes.MakeTrusted(querypb.Type_DATETIME, []byte(date))
+		}
+		return r
+	}
+
+	_, err := newChunker(ChunkColumn{Column: "updated_date"}, fields)
+	assert.NotNil(t, err)
+
+	// The NULLs, then a chunk per day, a day done can't come back.
+	{
+		c, err := newChunker(ChunkColumn{Column: "Created_Date"}, fields)
+		assert.Nil(t, err)
+		var labels []string
+		for _, date := range []string{"", "2024-01-15 00:00:00", "2024-01-15 23:59:59", "2024-01-16 08:00:00"} {
+			r, err := c.chunk(row("1", date))
+			assert.Nil(t, err)
+			labels = append(labels, r.label)
+		}
+		assert.Equal(t, []string{chunkNullLabel, "2024-01-15", "2024-01-15", "2024-01-16"}, labels)
+		_, err = c.chunk(row("1", "2024-01-15 12:00:00"))
+		assert.NotNil(t, err)
+	}
+
+	// The interval must fit the column.
+	{
+		c, err := newChunker(ChunkColumn{Column: "id"}, fields)
+		assert.Nil(t, err)
+		_, err = c.chunk(row("1", ""))
+		assert.NotNil(t, err)
+		c, err = newChunker(ChunkColumn{Column: "created_date", Interval: "1000"}, fields)
+		assert.Nil(t, err)
+		_, err = c.chunk(row("1", "2024-01-15 00:00:00"))
+		assert.NotNil(t, err)
+		c, err = newChunker(ChunkColumn{Column: "id", Interval: "1000"}, fields)
+		assert.Nil(t, err)
+		r, err := c.chunk(row("1999", ""))
+		assert.Nil(t, err)
+		assert.Equal(t, "1000", r.label)
+	}
+
+	// Neither numeric nor temporal.
+	{
+		c, err := newChunker(ChunkColumn{Column: "name"}, []*querypb.Field{{Name: "name", Type: querypb.Type_VARCHAR}})
+		assert.Nil(t, err)
+		_, err = c.chunk([]sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("a"))})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestPartLess(t *testing.T) {
+	assert.True(t, partLess("00009", "00010"))
+	assert.True(t, partLess("-1000", "0"))
+	assert.True(t, partLess("2.5", "10"))
+	assert.True(t, partLess("2023-12-31", "2024-01-15"))
+	assert.True(t, partLess("2024-01-15-09", "2024-01-15-10"))
+	assert.True(t, partLess(chunkNullLabel, "2024-01-15"))
+	assert.False(t, partLess("2024-01-15", chunkNullLabel))
+	assert.False(t, partLess(chunkNullLabel, chunkNullLabel))
+
+	// The parts of a split chunk.
+	assert.True(t, partLess("2024-01-15.00001", "2024-01-15.00002"))
+	assert.True(t, partLess("2024-01-15.00002", "2024-01-16"))
+	assert.True(t, partLess("2.5.00003", "10.5.00001"))
+	assert.True(t, partLess("null.00002", "0"))
+	assert.True(t, partLess("00001.00002", "00002.00001"))
+	assert.False(t, partLess("2024-01-15.00002", "2024-01-15.00001"))
+}
+
+func TestManifestChunks(t *testing.T) {
+	m := newManifest()
+	m.addTable("test", "events", "CREATE TABLE `events` (`a` int)")
+	m.setChunks("test", "events", "created_date:day", []checkpointChunk{
+		{Name: "test.events.null.sql"},
+		{Name: "test.events.2024-01-15.sql", From: "2024-01-15", To: "2024-01-16"},
+	})
+	assert.Equal(t, "created_date:day", m.Tables[0].ChunkBy)
+	assert.Equal(t, []ManifestChunk{
+		{File: "test.events.null.sql"},
+		{File: "test.events.2024-01-15.sql", From: "2024-01-15", To: "2024-01-16"},
+	}, m.Tables[0].Chunks)
+}
+
+func TestDumperChunkBy(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	date := func(s string) sqltypes.Value {
+		return sqltypes.MakeTrusted(querypb.Type_DATETIME, []byte(s))
+	}
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "a", Type: querypb.Type_INT32}, {Name: "created_date", Type: querypb.Type_DATETIME}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")), sqltypes.NULL},
+			{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("2")), date("2024-01-15 08:00:00")},
+			{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("3")), date("2024-01-15 09:00:00")},
+			{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("4")), date("2024-01-16 10:00:00")},
+		}}
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Table", Type: querypb.Type_VARCHAR}, {Name: "Create Table", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`a` int(11) DEFAULT NULL, `created_date` datetime DEFAULT NULL) ENGINE=InnoDB")),
+		}}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQuery("show create table `test`.`t1`", schemaResult)
+		fakedbs.AddQuery("select /*backup*/ * from `test`.`t1` order by `created_date`", selectResult)
+	}
+
+	pool, err := NewPool(log, 1, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	args := &DumpArgs{
+		Database:      "test",
+		Outdir:        "/tmp/dumpchunkbytest",
+		ChunksizeInMB: 1,
+		StmtSize:      10000,
+		ChunkBy:       map[string]ChunkColumn{"test.t1": {Column: "created_date"}},
+	}
+	os.RemoveAll(args.Outdir)
+	x := os.MkdirAll(args.Outdir, 0777)
+	AssertNil(x)
+	storage, err := OpenStorage(args.Outdir)
+	assert.Nil(t, err)
+	args.storage = storage
+
+	ts, err := dumpTable(log, conn, args, "t1", "CREATE TABLE `t1` (`a` int(11) DEFAULT NULL, `created_date` datetime DEFAULT NULL) ENGINE=InnoDB;\n")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), ts.Files)
+	var files []string
+	for _, c := range ts.chunks {
+		files = append(files, c.Name)
+	}
+	assert.Equal(t, []string{"test.t1.null.sql", "test.t1.2024-01-15.sql", "test.t1.2024-01-16.sql"}, files)
+	assert.Equal(t, "2024-01-15", ts.chunks[1].From)
+	assert.Equal(t, "2024-01-16", ts.chunks[1].To)
+	dat, err := ioutil.ReadFile(args.Outdir + "/test.t1.2024-01-15.sql")
+	assert.Nil(t, err)
+	assert.Equal(t, "INSERT INTO `t1`(`a`,`created_date`) VALUES\n(2,'2024-01-15 08:00:00'),\n(3,'2024-01-15 09:00:00');\n", string(dat))
+
+	// A chunk over the ChunksizeInMB is split in numbered parts, a row each
+	// with 0.
+	{
+		args.ChunksizeInMB = 0
+		ts, err := dumpTable(log, conn, args, "t1", "CREATE TABLE `t1` (`a` int(11) DEFAULT NULL, `created_date` datetime DEFAULT NULL) ENGINE=InnoDB;\n")
+		assert.Nil(t, err)
+		var files []string
+		for _, c := range ts.chunks {
+			files = append(files, c.Name)
+		}
+		assert.Equal(t, []string{"test.t1.null.00001.sql", "test.t1.2024-01-15.00001.sql", "test.t1.2024-01-15.00002.sql", "test.t1.2024-01-16.00001.sql"}, files)
+		assert.Equal(t, "2024-01-15", ts.chunks[2].From)
+		assert.Equal(t, "2024-01-16", ts.chunks[2].To)
+		dat, err := ioutil.ReadFile(args.Outdir + "/test.t1.2024-01-15.00002.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT INTO `t1`(`a`,`created_date`) VALUES\n(3,'2024-01-15 09:00:00');\n", string(dat))
+	}
+}
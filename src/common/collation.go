@@ -0,0 +1,109 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// defaultCharsetRegexp matches a [DEFAULT] CHARACTER SET, CHARSET or
+	// COLLATE clause of a CREATE DATABASE or of the table options, with the
+	// spaces before it and the character set or collation.
+	defaultCharsetRegexp = regexp.MustCompile(`(?i)\s*\b(?:DEFAULT\s+)?(CHARACTER\s+SET|CHARSET|COLLATE)\s*=?\s*(\w+)`)
+	// createDatabaseRegexp matches the start of a CREATE DATABASE or CREATE
+	// SCHEMA statement.
+	createDatabaseRegexp = regexp.MustCompile(`(?i)^\s*CREATE\s+(?:DATABASE|SCHEMA)\b`)
+	// collationNameRegexp matches a collation name of
+	// LoadArgs.DefaultCollation.
+	collationNameRegexp = regexp.MustCompile(`^(?:[A-Za-z0-9]+_\w+|binary)$`)
+	// statementEndRegexp matches the end of a statement: the semicolon and
+	// the spaces.
+	statementEndRegexp = regexp.MustCompile(`[\s;]*$`)
+)
+
+// collationCharset returns the character set of the collation name, the
+// part before its first underscore: utf8mb4 for utf8mb4_0900_ai_ci.
+func collationCharset(name string) string {
+	if i := strings.Index(name, "_"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// replaceDefaultCollation replaces the CHARACTER SET and COLLATE clauses of
+// options, outside the quoted strings and identifiers, with clause: the first
+// one takes its place, the others are dropped. It returns the collation, else
+// the character set, replaced and whether options had any clause.
+func replaceDefaultCollation(options string, clause string) (string, string, bool) {
+	var charset, collation string
+	found := false
+	out := mapCode(options, func(code string) string {
+		return defaultCharsetRegexp.ReplaceAllStringFunc(code, func(match string) string {
+			m := defaultCharsetRegexp.FindStringSubmatch(match)
+			if strings.EqualFold(m[1], "COLLATE") {
+				collation = m[2]
+			} else {
+				charset = m[2]
+			}
+			if found {
+				return ""
+			}
+			found = true
+			return " " + clause
+		})
+	})
+	if collation != "" {
+		return out, collation, found
+	}
+	return out, charset, found
+}
+
+// defaultDatabaseCollation sets the default character set and collation of
+// the CREATE DATABASE statement query to collation, see
+// LoadArgs.DefaultCollation: its clauses are replaced, a database without
+// any gets them at its end. It returns the collation, else the character
+// set, replaced, empty if it had none. Another statement is left as it is.
+func defaultDatabaseCollation(query string, collation string) (string, string) {
+	if !createDatabaseRegexp.MatchString(query) {
+		return query, ""
+	}
+	clause := "DEFAULT CHARACTER SET " + collationCharset(collation) + " COLLATE " + collation
+	out, old, found := replaceDefaultCollation(query, clause)
+	if !found {
+		cut := len(out) - len(statementEndRegexp.FindString(out))
+		out = out[:cut] + " " + clause + out[cut:]
+	}
+	return out, old
+}
+
+// defaultTableCollation sets the default character set and collation of the
+// table options of the CREATE TABLE statement query to collation, see
+// LoadArgs.ForceTableCollation: its clauses are replaced, a table without
+// any gets them before its partition options. The columns keep their own
+// CHARACTER SET and COLLATE, the ones without take the new default. It
+// returns the collation, else the character set, replaced, empty if it had
+// none.
+func defaultTableCollation(query string, collation string) (string, string) {
+	end := definitionsEnd(query)
+	if end < 0 {
+		return query, ""
+	}
+	options := query[end+1:]
+	p := partitionStart(options)
+	clause := "DEFAULT CHARSET=" + collationCharset(collation) + " COLLATE=" + collation
+	table, old, found := replaceDefaultCollation(options[:p], clause)
+	if !found {
+		cut := len(table) - len(optionsEndRegexp.FindString(table))
+		table = table[:cut] + " " + clause + table[cut:]
+	}
+	return query[:end+1] + table + options[p:], old
+}
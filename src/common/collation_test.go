@@ -0,0 +1,145 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDatabaseCollation(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		old string
+	}{
+		// The clauses of mysqldump and mydumper, in their version comment.
+		{
+			"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `test` /*!40100 DEFAULT CHARACTER SET latin1 COLLATE latin1_swedish_ci */ /*!80016 DEFAULT ENCRYPTION='N' */",
+			"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `test` /*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci */ /*!80016 DEFAULT ENCRYPTION='N' */",
+			"latin1_swedish_ci",
+		},
+		{
+			"CREATE DATABASE `test` /*!40100 DEFAULT CHARACTER SET utf8 */;\n",
+			"CREATE DATABASE `test` /*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci */;\n",
+			"utf8",
+		},
+		{
+			"CREATE SCHEMA `test` CHARSET=latin1 COLLATE latin1_bin",
+			"CREATE SCHEMA `test` DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci",
+			"latin1_bin",
+		},
+		// Without any clause, they're appended before the semicolon.
+		{
+			"CREATE DATABASE IF NOT EXISTS `test`;",
+			"CREATE DATABASE IF NOT EXISTS `test` DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci;",
+			"",
+		},
+		// The identifiers are left as they are.
+		{
+			"CREATE DATABASE IF NOT EXISTS `charset collate latin1`",
+			"CREATE DATABASE IF NOT EXISTS `charset collate latin1` DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci",
+			"",
+		},
+		// Another statement is left as it is.
+		{
+			"SET NAMES latin1 COLLATE latin1_bin",
+			"SET NAMES latin1 COLLATE latin1_bin",
+			"",
+		},
+	}
+	for _, test := range tests {
+		out, old := defaultDatabaseCollation(test.in, "utf8mb4_0900_ai_ci")
+		assert.Equal(t, test.out, out, test.in)
+		assert.Equal(t, test.old, old, test.in)
+	}
+}
+
+func TestDefaultTableCollation(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+		old string
+	}{
+		// The column collations are left as they are.
+		{
+			"CREATE TABLE `t1` (\n  `a` varchar(10) CHARACTER SET latin1 COLLATE latin1_bin,\n  `b` text\n) ENGINE=InnoDB DEFAULT CHARSET=latin1 COMMENT='charset=utf8'",
+			"CREATE TABLE `t1` (\n  `a` varchar(10) CHARACTER SET latin1 COLLATE latin1_bin,\n  `b` text\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='charset=utf8'",
+			"latin1",
+		},
+		{
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_unicode_ci ROW_FORMAT=DYNAMIC",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci ROW_FORMAT=DYNAMIC",
+			"utf8_unicode_ci",
+		},
+		// Without any clause, they're appended before the partitions.
+		{
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci",
+			"",
+		},
+		{
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB\n/*!50100 PARTITION BY HASH (`a`) PARTITIONS 4 */",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci\n/*!50100 PARTITION BY HASH (`a`) PARTITIONS 4 */",
+			"",
+		},
+		// A table named like a clause.
+		{
+			"CREATE TABLE `collate` (`charset` int) COMMENT 'DEFAULT CHARSET=latin1'",
+			"CREATE TABLE `collate` (`charset` int) COMMENT 'DEFAULT CHARSET=latin1' DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci",
+			"",
+		},
+	}
+	for _, test := range tests {
+		out, old := defaultTableCollation(test.in, "utf8mb4_0900_ai_ci")
+		assert.Equal(t, test.out, out, test.in)
+		assert.Equal(t, test.old, old, test.in)
+	}
+}
+
+func TestLoaderDefaultCollation(t *testing.T) {
+	dir := "/tmp/loaderdefaultcollation"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	files := map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test` /*!40100 DEFAULT CHARACTER SET latin1 */;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` varchar(10) COLLATE latin1_bin) ENGINE=InnoDB DEFAULT CHARSET=latin1;\n",
+	}
+	for name, sql := range files {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 1000, DefaultCollation: "utf8mb4_0900_ai_ci"}
+
+	// The databases only.
+	{
+		rec := &recordingExecutor{}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"CREATE DATABASE IF NOT EXISTS `test` /*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci */;"}, matchingQueries(rec.queries, "CREATE DATABASE"))
+		assert.Equal(t, []string{"CREATE TABLE `t1` (`a` varchar(10) COLLATE latin1_bin) ENGINE=InnoDB DEFAULT CHARSET=latin1"}, matchingQueries(rec.queries, "CREATE TABLE"))
+	}
+
+	// And the tables.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.ForceTableCollation = true
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"CREATE TABLE `t1` (`a` varchar(10) COLLATE latin1_bin) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci"}, matchingQueries(rec.queries, "CREATE TABLE"))
+	}
+}
@@ -10,29 +10,864 @@
 package common
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"time"
 
 	"github.com/XeLabs/go-mysqlstack/common"
+	"github.com/XeLabs/go-mysqlstack/xlog"
 )
 
-type Args struct {
-	User          string
-	Password      string
-	Address       string
-	Database      string
-	Table         string
+// DumpArgs is the configuration of Dumper.
+type DumpArgs struct {
+	User     string
+	Password string
+	Address  string
+	Database string
+	Table    string
+	// Outdir is the dump directory, or a 'scheme://...' location of a
+	// registered storage, see OpenStorage.
 	Outdir        string
 	Threads       int
 	ChunksizeInMB int
 	StmtSize      int
 
-	Allbytes uint64
-	Allrows  uint64
+	// SchemaThreads dumps the schemas of the tables on this many connections
+	// of their own, ahead of and concurrently with the data Threads, instead
+	// of each schema on the data connection just before its datas. A table's
+	// schema file is always written before its first data file.
+	SchemaThreads int
+
+	// ForceMkdir creates Outdir if it does not exist, a directory only, once
+	// the run starts: Validate accepts a missing one.
+	ForceMkdir bool
+	// Clean removes the temp files a crashed dump left in Outdir, and on
+	// the Volumes, before the dump starts: every file of a directory is
+	// written as name.tmp and renamed into place once synced.
+	Clean bool
+	// Retention is how long the dump is kept, its expires_at in
+	// manifest.json from the start of the dump, see Prune. 0 writes none,
+	// the dump never expires.
+	Retention time.Duration
+	// FileMode is the mode of every file of the dump, like 0640, and
+	// DirMode the one of the directories ForceMkdir creates, like 0750.
+	// They are set once created, so the umask doesn't change them; 0 leaves
+	// them as the umask makes them from 0644 and 0777.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+	// Chown is the 'uid:gid' owner, numeric, of every file of the dump and
+	// of the directories ForceMkdir creates, set once created, for a dump
+	// run as root and read by an unprivileged user. It needs root.
+	Chown string
+
+	// AddDropTable writes a DROP TABLE IF EXISTS before the CREATE TABLE of
+	// every table schema file, as mysqldump does, so the restore replaces the
+	// tables of the target. IfNotExists writes the CREATE TABLE as a CREATE
+	// TABLE IF NOT EXISTS instead, the restore keeps them. They can't be set
+	// together, see LoadArgs.OverwriteTables for how the loader options win.
+	AddDropTable bool
+	IfNotExists  bool
+	// KeepTablespaceOptions keeps the DATA DIRECTORY, INDEX DIRECTORY and
+	// TABLESPACE options of the CREATE TABLE in the schema files, they are
+	// stripped without it and logged, see stripTablespaceOptions. The
+	// loader strips them again unless LoadArgs.KeepTablespaceOptions.
+	KeepTablespaceOptions bool
+
+	// Partitions dumps only these partitions, or subpartitions, of the
+	// tables by 'db.table' of Database: their SELECT reads them with a
+	// PARTITION clause, their schema is the whole table's. They're checked
+	// against information_schema.PARTITIONS before anything is dumped, and
+	// recorded in the metadata file and in manifest.json, the loader warns
+	// the tables are partial. Their CHECKSUM TABLE isn't recorded.
+	Partitions map[string][]string
+
+	// ChunkBy orders and chunks the datas of the tables by 'db.table' of
+	// Database by a column instead of by ChunksizeInMB: a data file per
+	// interval of the column, named after its start like
+	// 'db.table.2024-01-15.sql', the NULLs in 'db.table.null.sql'. An
+	// interval over the ChunksizeInMB is split in parts, numbered like
+	// 'db.table.2024-01-15.00001.sql'. The range of every file is recorded
+	// in manifest.json.
+	ChunkBy map[string]ChunkColumn
+	// ChunkRows reads every table without a ChunkBy in ranges of about this
+	// many rows of its key, the first column of its primary key or of a
+	// unique key on NOT NULL columns, see pickChunkKey: a data file or more
+	// per range, labelled by its number like 'db.table.00003.00001.sql',
+	// each range recorded in manifest.json. A table without such a key, or
+	// with fewer rows, is read at once. Every range is a unit of work of its
+	// own: the connection of the table dumps them with the connections the
+	// other tables leave idle. 0 reads every table at once.
+	ChunkRows int
+
+	// IncrementalFrom dumps only the tables changed since the previous dump of
+	// a chain, the dump of this directory or of its manifest.json path, a
+	// full dump or another incremental: a table whose information_schema
+	// UPDATE_TIME is at or after the snapshot time of the previous dump, or
+	// unknown, like after a restart of the server. A table the previous dump
+	// doesn't have, or whose CREATE_TIME is at or after it, is recreated by
+	// the loader and dumped with all its rows. The previous dump must have a
+	// Consistency point with a GTID set the server executed, and so must this
+	// one, the loader chains them by it, see LoadArgs.Incrementals. The chain
+	// is recorded in manifest.json, see ManifestIncremental. The rows deleted
+	// since are not dumped.
+	IncrementalFrom string
+	// IncrementalColumns are the DATETIME or TIMESTAMP columns, by 'db.table'
+	// of Database, every write of a row sets to its time, like updated_at:
+	// a changed table with one is dumped from its rows whose column is at or
+	// after the snapshot time of the previous dump, and left unchanged if its
+	// MAX is before it. It requires IncrementalFrom.
+	IncrementalColumns map[string]string
+
+	// SubsetSeeds dumps a referentially complete subset of the tables instead
+	// of all their rows, by 'db.table' of Database and a WHERE clause: the
+	// rows of the seeds, the rows referencing them through a foreign key,
+	// recursively, and the rows all of these reference, walked from
+	// information_schema.KEY_COLUMN_USAGE before the datas are dumped, see
+	// walkSubset. The tables the walk reaches must have a primary key and be
+	// dumped, the others are dumped without rows. The walk is recorded in
+	// manifest.json.
+	SubsetSeeds map[string]string
+	// SubsetMaxRows fails a subset of more rows than this across the tables,
+	// 0 bounds nothing.
+	SubsetMaxRows int
+
+	// Format is the format of the data files, FormatSQL (the default),
+	// FormatCSV or FormatJSONL.
+	Format string
+	// FileTrailers writes a header comment into every data file, with the
+	// version, the table, the chunk, the snapshot and the time its first row
+	// was read, and a trailer line with its rows, bytes and the sha256 of all
+	// that's before it: a file cut short by an interrupted copy has none,
+	// see LoadArgs.VerifyFileTrailers. FormatSQL only.
+	FileTrailers bool
+	// SkipEmptyFiles writes no data file for a table dumped without any row.
+	// Without it a FormatSQL table of no rows gets the marker of an empty
+	// table, a data file of only the header comment of FileTrailers, which
+	// the loader skips. manifest.json records the table as Empty either way.
+	SkipEmptyFiles bool
+	// SmokeTest dumps the first 1000 rows of every table, by its primary
+	// key, instead of the dump: the schema files and a data file per table
+	// named 'db.table.smoke.sql', which the loader refuses without
+	// LoadArgs.AllowSmoke. A table which fails doesn't stop the others, the
+	// Report has the outcome of each, see smokeTest.
+	SmokeTest bool
+
+	// Checksum records the CHECKSUM TABLE of every table in manifest.json once
+	// its datas are dumped, for LoadArgs.VerifyChecksums.
+	Checksum bool
+	// Paranoid reads every InnoDB table again once its data files are
+	// written, COUNT(*) and SUM(CRC32(primary key)) in the snapshot of the
+	// dump, and fails the table if the rows of its data files, added up
+	// chunk by chunk as they were written, don't match. The checks are
+	// recorded in manifest.json. It requires a Consistency snapshot.
+	Paranoid bool
+	// CheckSchemaChanges reads the create statement of every table again on
+	// its data connection once its datas are dumped: if it's not the one of
+	// the schema file, an ALTER ran in the meantime, the schema and the
+	// datas are dumped again up to SchemaChangeRetries times, the data files
+	// of the dump before removed, then the table is marked failed in
+	// manifest.json and the dump fails once done. The AUTO_INCREMENT counter
+	// is left out of the comparison. A Consistency snapshot needs no check, a
+	// DDL after it fails the reads of the table.
+	CheckSchemaChanges  bool
+	SchemaChangeRetries int
+
+	// Grants writes the users of the server but the system ones (root and
+	// mysql.*) into grants.sql: a CREATE USER IF NOT EXISTS with the
+	// authentication plugin and the password hash as they are, and the SHOW
+	// GRANTS of every user, see LoadArgs.Grants. The roles of a MySQL 8.0
+	// source come first with their CREATE ROLE, in the order they are granted,
+	// and the default roles of an account follow its grants. It needs SELECT
+	// on mysql.user, and on mysql.role_edges and mysql.default_roles for the
+	// roles.
+	Grants bool
+
+	// Resume skips the tables the checkpoint.jsonl of Outdir records as dumped
+	// by an interrupted dump, if their data files are unchanged. The dump takes
+	// no snapshot, the tables skipped are as they were read by that dump.
+	Resume bool
+
+	// Replay is the runconfig.json of the dump this one runs again, set by
+	// RunConfig.ReplayArgs: a table of it which no longer exists fails the
+	// dump before any table is dumped. Every dump writes its runconfig.json.
+	Replay string
+
+	// MaxRuntime stops the dump at a deadline: once it's reached no table is
+	// started, the tables being dumped go on for MaxRuntimeGrace (0 means 5
+	// minutes) then their connections are closed. The run fails with a
+	// *PartialError listing the tables not dumped, checkpoint.jsonl has the
+	// ones done for Resume and manifest.json lists the others in NotDumped.
+	// 0 runs until done.
+	MaxRuntime      time.Duration
+	MaxRuntimeGrace time.Duration
+
+	// Volumes spread the data files of the dump on these directories, within
+	// their budgets, the other files stay in Outdir. A new data file goes on
+	// the volume with the most budget left, manifest.json records the volume
+	// of every data file. The dump fails once a data file has room on no
+	// volume, with an estimate of the room still needed.
+	Volumes []Volume
+
+	// MaxReplicaLag, in seconds, bounds the replication lag of a replica
+	// source: it's checked before the datas are dumped and every 5 seconds
+	// after, a stopped replication lags. 0 doesn't check it.
+	MaxReplicaLag int
+	// LagAction is what a lag over MaxReplicaLag does, LagActionPause (the
+	// default) holds the threads before their next table or key range of
+	// ChunkRows until it's back under, LagActionAbort fails the dump.
+	LagAction string
+
+	// Consistency makes the threads dump the tables at the same point, in
+	// snapshots started together: ConsistencyNone (the default) reads every
+	// table as it is when it's dumped, ConsistencyLock starts the snapshots
+	// under FLUSH TABLES WITH READ LOCK, ConsistencyGTID starts them without
+	// a lock and checks them with the GTIDs, see startSnapshots. The point
+	// is recorded in manifest.json. Only the transactional tables, InnoDB,
+	// are read in the snapshots.
+	Consistency string
+	// LockWaitTimeout, in seconds, bounds the wait for the FLUSH TABLES WITH
+	// READ LOCK of ConsistencyLock, 0 means 60: past it the dump fails with
+	// the queries blocking the lock, see flushWithReadLock. The backup locks
+	// wait for it as their lock_wait_timeout.
+	LockWaitTimeout int
+	// LockMode is the lock ConsistencyLock starts the snapshots under:
+	// LockModeAuto (the default) the backup locks of Percona Server or
+	// MariaDB if the server has them, else LockModeFTWRL, or LockModeBackup
+	// or LockModeNone, see chooseSnapshotLock.
+	LockMode string
 
 	// Interval in millisecond.
 	IntervalMs int
+
+	// MetricsListen serves the Prometheus metrics of the run at /metrics on this address, like ':9104'.
+	MetricsListen string
+	// StatusListen serves the progress of the run as JSON at /status on this address, like ':8080'.
+	StatusListen string
+	// StatusToken enables the POST /cancel of StatusListen, for the requests
+	// with the header 'Authorization: Bearer <StatusToken>'; the POST /skip
+	// then needs it too. Without it /cancel is refused.
+	StatusToken string
+	// ProgressFile appends the progress of the run to this file, one JSON
+	// line per event, see ProgressEvent.
+	ProgressFile string
+
+	// allbytes and allrows are the counters of the run the workerCounters of
+	// its Metrics add to.
+	allbytes uint64
+	allrows  uint64
+	metrics  *Metrics
+	// storage is the storage of Outdir, opened by the run.
+	storage Storage
+	// sessionTimeZone is the time zone of the DATETIMEs of FormatJSONL, read
+	// by the run.
+	sessionTimeZone *time.Location
+	// serverVersion is the VERSION() of the source, read by the run, empty
+	// if it's unknown.
+	serverVersion string
+	// snapshot is the ConsistentPoint of the run for the FileTrailers
+	// headers, nil without one.
+	snapshot *ConsistentPoint
+	// nonTransactional is set if the database has tables the snapshots
+	// don't cover, ConsistencyLock holds its lock for them, see heldLock.
+	nonTransactional bool
+	// heldLock is the lock held for them, nil if it wasn't.
+	heldLock *heldLock
+	// lag holds the threads while the replica lags, see MaxReplicaLag.
+	lag *lagGate
+	// pool is the pool of the run, its idle connections dump the key ranges
+	// of ChunkRows along with the one of the table, nil for DumpTable.
+	pool *Pool
+	// subset is the walk of SubsetSeeds, nil without them.
+	subset *subset
+	// incremental is the previous dump of IncrementalFrom, nil without one.
+	incremental *incrementalBase
+}
+
+// LoadArgs is the configuration of Loader.
+type LoadArgs struct {
+	User     string
+	Password string
+	// Address is the host:port of the target, or the comma separated ones of
+	// an HA pair: the connections reconnect to them in order once their
+	// server went away, see ReadOnlyMaxWait.
+	Address string
+	// Outdir is the dump directory, or a 'scheme://...' location, see DumpArgs.Outdir.
+	Outdir  string
+	Threads int
+
+	// SchemaThreads is the number of connections creating the table schemas,
+	// DDL touching the same (referenced) table is always serialized.
+	// Less than 2 creates them one by one.
+	SchemaThreads int
+	// DataThreads is the number of connections restoring the data files, 0
+	// for Threads. PostThreads is the number of connections of the phases
+	// after the datas, the validation of DeferConstraints, VerifyChecksums,
+	// the warm-up and the rebuilds, 0 for Threads. The phases draw from one
+	// pool of the most threads of SchemaThreads, DataThreads and PostThreads,
+	// each capped by its own, the summary has the most every phase had
+	// working at once.
+	DataThreads int
+	PostThreads int
+	// ReadOnlyMaxWait, in seconds, is how long a statement of the schemas
+	// refused by a read-only target waits for it to become writable, like a
+	// target flipped to super_read_only during a failover: the statement is
+	// retried once it is, the statements before it are not run again. It's
+	// also how long a statement whose server was gone before it was sent
+	// waits for a writable address of Address to reconnect to, a statement
+	// lost once sent fails its file, see isUnsentError. 0 means 300.
+	ReadOnlyMaxWait int
+
+	// Interval in millisecond.
+	IntervalMs int
+
+	// TxnBatchSize groups up to this many small data files of the same database
+	// into one transaction on a single connection, less than 2 disables batching.
+	// It excludes SmallFileBatch, see unitBatch.
+	TxnBatchSize int
+	// TxnBatchFileMaxBytes is the largest data file eligible for batching, 0 means 1MB.
+	TxnBatchFileMaxBytes int64
+	// TxnMaxStatements commits the transaction of a batch every this many
+	// statements and begins another, for the targets which cap them: a
+	// failure then only rolls back the statements since the last commit,
+	// which the ResumeFile records. 0 is no cap, 100 with CompatProxy.
+	TxnMaxStatements int
+	// TxnMaxTimeMs commits the transaction of a batch, and begins another,
+	// after its statement which ends past this many milliseconds since the
+	// transaction began, so a target with replicas never has a transaction
+	// open long enough to make them lag behind. 0 is no cap.
+	TxnMaxTimeMs int
+
+	// SmallFileBatch groups up to this many data files of the same database
+	// of at most SmallFileMaxBytes (0 means 1MB) into one unit of the
+	// scheduler, for the dumps of many tiny tables: a thread restores them
+	// back to back under one 'use', each in autocommit, with one log line
+	// for the batch. A failure stops the batch, the files before it stay
+	// restored. Less than 2 disables it, it excludes TxnBatchSize.
+	SmallFileBatch    int
+	SmallFileMaxBytes int64
+
+	// Compat adapts the restore to what is in front of the target. CompatProxy
+	// is for a sharding proxy (Vitess, ProxySQL) which refuses 'use' and some
+	// session variables: no 'use' is sent, the INSERT and CREATE TABLE
+	// statements name their database (the qualify-tables rewrite), the SET
+	// statements of the files which fail are skipped with a warning, and
+	// TxnMaxStatements defaults to 100.
+	Compat string
+
+	// SchemaVersion restores only the tables tagged with this schema version
+	// in the manifest.json of the dump, empty restores all.
+	SchemaVersion string
+	// Filter restores only the tables of the dump this expression holds for,
+	// like "database matching 'shard_*' AND table NOT MATCHING '*_archive'
+	// AND size < 1G", see filterParser for the grammar and TableInfo for
+	// what it knows of a table. LoadConfig.Filter must hold too.
+	Filter string
+
+	// RecentChunks restores only the N highest numbered data files of every
+	// table, see filterRecentChunks for the ordering assumption, 0 restores all.
+	// The schemas are all restored.
+	RecentChunks int
+
+	// Replacements are applied in order to the string literals of the data
+	// INSERT statements before they are executed, see replaceLiterals.
+	Replacements []Replacement
+	// Rewrites are the names of the builtin rewrites applied in order to the
+	// statements before they are executed, see BuiltinRewrites and
+	// LoadConfig.Rewriters, which run after them.
+	Rewrites []string
+
+	// UpgradeCharset moves the databases and tables of the dump from utf8mb3
+	// to utf8mb4: the CHARSET and COLLATE clauses of the CREATE DATABASE and
+	// CREATE TABLE statements, with the key parts which would get too long
+	// shortened, see upgradeCharset. The latin1 and binary columns are left
+	// as they are.
+	UpgradeCharset bool
+	// UpgradeCollations maps the utf8mb3 collations to the utf8mb4 ones of
+	// UpgradeCharset, like utf8_general_ci to utf8mb4_0900_ai_ci. The others
+	// keep their name, utf8_bin becomes utf8mb4_bin.
+	UpgradeCollations map[string]string
+	// UpgradeKeyBytes is the longest key part UpgradeCharset shortens the keys
+	// to, 0 means 767, the limit of the COMPACT row format.
+	UpgradeKeyBytes int
+
+	// DefaultCollation creates the databases with this default collation,
+	// and its character set, like utf8mb4_0900_ai_ci for a target which
+	// standardizes on it: the CHARACTER SET and COLLATE clauses of every
+	// CREATE DATABASE are replaced, a database without any gets them, see
+	// defaultDatabaseCollation. It applies after UpgradeCharset.
+	DefaultCollation string
+	// ForceTableCollation sets the DefaultCollation as the default of the
+	// tables too, in their table options: the columns with their own
+	// CHARACTER SET or COLLATE keep it, see defaultTableCollation.
+	ForceTableCollation bool
+
+	// ForceEngine creates the tables with this storage engine, like InnoDB
+	// for a dump of MyISAM tables: the ENGINE of every CREATE TABLE, and of
+	// its partitions, is rewritten, a table without one gets it. The
+	// definitions the engine handles differently or refuses, like a FULLTEXT
+	// index or an AUTO_INCREMENT column starting no index, are logged as
+	// warnings, see forceEngine.
+	ForceEngine string
+
+	// SkipCheckConstraints creates the tables without their CHECK
+	// constraints, enforced or not, for a target which rejects them or
+	// parses and drops them: the constraints left out are logged, the rows
+	// they would reject are restored. The expression defaults are kept.
+	SkipCheckConstraints bool
+	// KeepTablespaceOptions creates the tables with the DATA DIRECTORY,
+	// INDEX DIRECTORY and TABLESPACE options of their CREATE TABLE, for a
+	// target with the same directories and tablespaces as the source. They
+	// are stripped without it, every one logged, so a table dumped from them
+	// is created in the default tablespace of the target.
+	KeepTablespaceOptions bool
+
+	// TuneTarget relaxes the flush settings of the target for the restore,
+	// TuneTargetOn sets innodb_flush_log_at_trx_commit=2, sync_binlog=0 and
+	// innodb_max_dirty_pages_pct=90 where they are slower and sets them back
+	// once the restore is done, failed or cancelled, TuneTargetDryRun only
+	// logs the changes. A target whose user lacks SYSTEM_VARIABLES_ADMIN or
+	// SUPER is restored untuned with a warning. A crash of the target may
+	// lose the last second of the restore, which is run again anyway.
+	TuneTarget string
+	// Lock takes an advisory lock of every database restored on the target,
+	// and a global one for a restore of the whole dump, on a connection of
+	// its own, and holds them until the restore is done, failed or cancelled:
+	// a restore into a database another one holds refuses to start, with who
+	// holds it, see lockTarget. The holder is recorded in a table of the
+	// go_mydumper database, created on the target, and replicated, if it
+	// isn't there. ForceLock restores anyway, with a warning, the restores
+	// may interleave their DDL.
+	Lock      bool
+	ForceLock bool
+
+	// ExpandSource restores the files the SOURCE directives of the mysql
+	// client in the table schema files include, like 'SOURCE common.sql;' in
+	// a hand written schema, in their place: the path is relative to the
+	// including file and the includes nest up to 16 deep. Without it a
+	// SOURCE directive fails the restore before any statement. The foreign
+	// keys of an included file are not seen when the schemas are grouped for
+	// SchemaThreads.
+	ExpandSource bool
+
+	// CreateIfNotExists creates the tables with CREATE TABLE IF NOT EXISTS, so
+	// a restore into a database where some tables exist goes on: an existing
+	// table is kept as it is, its schema is not updated, and a warning is
+	// logged. Its datas are still restored into it and may fail if its schema
+	// differs.
+	CreateIfNotExists bool
+
+	// OverwriteTables drops every table of the dump before it's created, so
+	// a restore replaces the tables of the target. A schema file dumped with
+	// DumpArgs.AddDropTable already drops its table and isn't dropped twice.
+	// The loader options win over the statements of the schema files:
+	// CreateIfNotExists skips their DROP TABLE, OverwriteTables drops the
+	// tables they create IF NOT EXISTS. It can't be set with
+	// CreateIfNotExists.
+	OverwriteTables bool
+	// TablePrefix and TableSuffix rename every table of the dump, t is
+	// restored as TablePrefix+t+TableSuffix, so a second copy of a dump fits
+	// in the same database: the CREATE TABLE, INSERT, REPLACE and DROP TABLE
+	// statements, the tables of the same database the foreign keys reference
+	// and the constraint names are rewritten, see renameTables. The views,
+	// triggers and routines are restored as they are.
+	TablePrefix string
+	TableSuffix string
+
+	// Upsert restores the INSERTs of the tables with a primary key as INSERT ...
+	// ON DUPLICATE KEY UPDATE of their other columns, so a restore into tables
+	// which already have some of the rows updates them instead of failing on a
+	// duplicate key. The columns and the key are read from the schema files,
+	// a table without a primary key is restored with plain INSERTs.
+	Upsert bool
+	// Incrementals are the directories of the incremental dumps of the dump
+	// of Outdir, see DumpArgs.IncrementalFrom, restored in this order once it
+	// is: the manifest.json of every one must be the next of the chain, from
+	// the GTID set of the dump before it, which is checked before anything is
+	// restored. Their existing tables are kept, but the ones recreated since
+	// which are dropped first, and their INSERTs are restored as upserts,
+	// INSERT ... ON DUPLICATE KEY UPDATE, see Upsert, so a changed row updates
+	// the one with the same primary or unique key: a REPLACE would delete it,
+	// which a foreign key refuses or cascades to its child rows, and fire the
+	// delete triggers. The rows deleted since are left. The phases after the
+	// datas, the grants, the warm-up, the rebuilds and the PostSQL, run once,
+	// with the last one, the ExpectTables are the ones of Outdir.
+	Incrementals []string
+
+	// FillMissingColumns compares the columns of every table of the dump with
+	// the ones of its table on the target once the schemas are restored: the
+	// NOT NULL columns without a default only the target has are added to
+	// every INSERT with a placeholder by their type, an empty string, 0 or
+	// the epoch, see defaultFillValues. A column only the dump has, or a
+	// filled one of a type without a placeholder, fails the restore before
+	// any data, with the problems of every table.
+	FillMissingColumns bool
+	// FillValues replace the placeholders of FillMissingColumns by the
+	// DATA_TYPE of the column, like "datetime": "'2000-01-01 00:00:00'", as
+	// SQL literals.
+	FillValues map[string]string
+
+	// MaxThreadsPerDatabase caps the data files of the same database restored
+	// at once, the other threads take the files of other databases. Once only
+	// capped databases are left the restore goes on with this many threads.
+	// 0 caps nothing.
+	MaxThreadsPerDatabase int
+
+	// TableThreads caps the data files of a table restored at once, by
+	// 'db.table': 1 restores the table file by file, like a table heavy on
+	// foreign keys, a larger cap spreads a table of many chunks on as many
+	// threads. The caps share the Threads of the pool with the other tables,
+	// they never add threads: a cap above Threads is Threads, and the threads
+	// a capped table doesn't use take the files of the other tables. Once only
+	// capped tables are left the restore goes on with the threads their caps
+	// allow. The tables not listed are only capped by MaxThreadsPerDatabase.
+	TableThreads map[string]int
+
+	// MaxInFlightBytes bounds the bytes of the data files read into memory at
+	// once by all the threads: a thread waits for the size of its file to be
+	// free before reading it and frees it once the file is executed. A file
+	// larger than the bound is read once no other file is in memory. 0 bounds
+	// nothing, the peak is then Threads times the largest file.
+	MaxInFlightBytes int64
+
+	// MaxMemory bounds the bytes of the statements in flight at once by all
+	// the threads: a thread takes the size of a statement as its data file
+	// has it before the statement is rewritten and releases it once it's
+	// executed, waiting for it to be free. Some threads may idle for it, a
+	// statement larger than the bound runs once no other is in flight. 0
+	// bounds nothing.
+	MaxMemory int64
+
+	// MaxOpenFiles bounds the files of the dump open at once by all the
+	// threads: a thread waits for a free slot before opening its file, which
+	// is closed as soon as it's read, or fails. The connections and the
+	// process take file descriptors too, keep MaxOpenFiles plus Threads well
+	// under 'ulimit -n'. 0 bounds nothing, at most Threads data files are then
+	// open at once.
+	MaxOpenFiles int
+
+	// MaxBytesPerSec throttles the data statements of all the threads to
+	// this many bytes a second, MaxRowsPerSec to this many rows, counted from
+	// the VALUES tuples of the INSERTs, for the targets or replicas bound by
+	// their writes per row. Only one of them can be set, 0 throttles nothing.
+	// A second of burst goes through at once, see tokenBucket.
+	MaxBytesPerSec int64
+	MaxRowsPerSec  int64
+
+	// ReplicaLagAddress is a replica of the target whose lag the load
+	// watches during the datas, on a connection of its own with User and
+	// Password: while its lag is over MaxReplicaLag seconds, or its
+	// replication is stopped, no data file is dispatched, the ones being
+	// restored go on. It's checked before the first one and every 5 seconds.
+	ReplicaLagAddress string
+	MaxReplicaLag     int
+
+	// ShuffleSeed seeds the shuffle of the data files, the same seed and dump
+	// restore them in the same order. 0 seeds it with the time, every run has
+	// its own order. The seed used is logged.
+	ShuffleSeed int64
+
+	// Volumes are the directories the data files of a dump spread on volumes
+	// are searched on, see DumpArgs.Volumes. Empty takes the volumes from the
+	// manifest.json of the dump, the paths they had when it was dumped.
+	Volumes []string
+
+	// RollbackFile is a local file the loader writes a DROP ... IF EXISTS
+	// statement to for every database and table it creates, as it creates
+	// them, see ReadRollbackFile and Rollback. The databases and tables which
+	// exist before, like the ones CreateIfNotExists keeps, are not in it.
+	RollbackFile string
+
+	// ResumeFile is a local file the loader writes a line to for every
+	// database, table schema and data file it restores, as it restores
+	// them, and for a data file stopped by MaxRuntime with the offset of its
+	// next statement. Resume reads it first and skips what it records, the
+	// stopped data file is restored from that statement on: the restore
+	// goes on where the previous one stopped. The file records the Outdir,
+	// it's refused for another dump.
+	ResumeFile string
+	Resume     bool
+	// MaxRuntime stops the restore at a deadline, it requires a ResumeFile:
+	// once it's reached no data file is started nor any phase after the
+	// datas, the data files being restored go on for MaxRuntimeGrace (0
+	// means 5 minutes) then stop before their next statement, the batches
+	// of TxnBatchSize finish. The run fails with a *PartialError. The
+	// databases and schemas are always restored. 0 runs until done.
+	MaxRuntime      time.Duration
+	MaxRuntimeGrace time.Duration
+
+	// ExpectTables are 'db' or 'db.table' names which must be in the dump, the
+	// restore fails before any statement if one is missing. A table needs its
+	// schema file and a data file: a table dumped empty has no data file, so
+	// don't list the tables which may be empty.
+	ExpectTables []string
+	// Files restores only these data files of the dump, for a surgical
+	// re-run of a failed one, instead of walking Outdir. A relative path is
+	// in Outdir, an absolute one must be; without an Outdir the files must be
+	// in one directory, which is the dump. The schema of a table, and the
+	// schema-create of its database, are only restored if it's missing on
+	// the target. The report lists them as a partial restore.
+	Files []string
+	// AllowPipes restores the data files which are named pipes (FIFOs), like
+	// the ones a backup system feeds on demand: a pipe is read once, its
+	// size is the one of the manifest if the dump has one, else it's never
+	// batched. Without it a pipe fails the run; a schema file which is one
+	// always does.
+	AllowPipes bool
+	// PipeReopenCommand is run with 'sh -c' before a pipe is read again,
+	// like by a transaction batch run again after a failover, with DB,
+	// TABLE, FILE and STATUS=reopen in its environment: it must feed the
+	// pipe again. Without it, or a LoadConfig.PipeReopenHook, reading a pipe
+	// again fails.
+	PipeReopenCommand string
+	// AllowVersionDowngrade restores a dump into a target of an older major
+	// or minor version than the source server, with a warning: by default the
+	// restore refuses it before any statement, see checkServerVersion.
+	AllowVersionDowngrade bool
+	// FailOnIncompat fails the restore before any statement if the dump has
+	// features the target lacks, like a collation or CHECK constraints: by
+	// default they are warnings, see checkIncompatibilities.
+	FailOnIncompat bool
+	// AllowPartialDump restores a dump with partial markers, see
+	// partialMarker, with a warning: by default the restore refuses it, the
+	// dump was still running or failed.
+	AllowPartialDump bool
+	// AllowSmoke restores the data files of a DumpArgs.SmokeTest, with a
+	// warning: by default the restore refuses them, they are not a dump.
+	AllowSmoke bool
+
+	// PreserveAutoIncrement sets the AUTO_INCREMENT counters the dumper recorded
+	// in manifest.json, so no id of the source is reused: the one of a table
+	// once its last data file is restored.
+	PreserveAutoIncrement bool
+
+	// VerifyChecksums compares every restored table with the manifest.json of
+	// the dump once the datas are restored: its CHECKSUM TABLE if the dump has
+	// one (DumpArgs.Checksum) and the engines match, else its COUNT(*) with the
+	// rows dumped. A dump of the C mydumper has no manifest.json, the COUNT(*)
+	// is compared with the rows of its metadata files. Any mismatch fails the
+	// restore.
+	VerifyChecksums bool
+	// VerifyFileTrailers checks every data file against its trailer
+	// (DumpArgs.FileTrailers) before any of its statements is executed, on
+	// the datas as the storage reads them: a file without one, or whose
+	// bytes or sha256 don't match it, fails. The trailers are skipped
+	// without it.
+	VerifyFileTrailers bool
+	// VerifySchema compares the SHOW CREATE TABLE of every restored table
+	// with its schema file once the schemas are restored, as the restore
+	// executed it: the AUTO_INCREMENT counters, ROW_FORMAT=DYNAMIC, utf8 shown
+	// as utf8mb3 and the display widths of the integers aside. A table which
+	// differs fails the restore with the lines of the difference.
+	VerifySchema bool
+	// DeferConstraints restores the data files with the foreign key checks
+	// off, so the rows of a table don't wait for the ones they reference,
+	// then validates the foreign keys in one pass once the datas are
+	// restored: the checks are turned back on and every row of the restored
+	// tables without the row its foreign key references is counted and
+	// sampled. Any violation fails the restore, the rows are left restored.
+	DeferConstraints bool
+	// CheckTables adds a CHECK TABLE of every restored table with datas to the
+	// validation pass of DeferConstraints.
+	CheckTables bool
+
+	// Grants restores the roles, the users and the grants of the grants.sql
+	// of the dump (DumpArgs.Grants) once the datas are restored. A user which
+	// exists on the target is handled as GrantsExisting says. A target older
+	// than MySQL 8.0 skips the roles with warnings.
+	Grants bool
+	// GrantsExisting is GrantsSkipExisting, the default, or
+	// GrantsUpdateExisting.
+	GrantsExisting string
+
+	// WarmTables are 'db.table' names read into the buffer pool, in this
+	// order, once the restore is done, so the first queries on them don't
+	// wait on the disk: the primary key and every secondary index are scanned
+	// by a SELECT COUNT(*). A POST to /skip?phase=warm on StatusListen skips
+	// the warm-up, see warmTables.
+	WarmTables []string
+	// WarmThreads is how many connections warm the tables, at least 1 and at
+	// most PostThreads.
+	WarmThreads int
+
+	// OptimizeTables are 'db.table' names rebuilt once the restore is done,
+	// in this order, or OptimizeAll alone for every restored table, to
+	// defragment them: an InnoDB table by an ALTER TABLE FORCE, the others by
+	// an OPTIMIZE TABLE. A POST to /skip?phase=optimize on StatusListen skips
+	// the rebuilds, see optimizeTables.
+	OptimizeTables []string
+	// OptimizeThreads is how many connections rebuild the tables, at least 1
+	// and at most PostThreads.
+	OptimizeThreads int
+
+	// PostSQL are SQL scripts run in order once every phase of the restore
+	// succeeded, on a connection of their own: their statements are split as
+	// the ones of a dump file and the first failed one fails the load. The
+	// scripts are read before anything is restored.
+	PostSQL []string
+	// PostSQLOnFailure are SQL scripts run the same way once the restore
+	// failed, was cancelled or stopped by MaxRuntime, a failed PostSQL script
+	// too. @go_mydumper_status and @go_mydumper_error hold the status of the
+	// restore and its error, see runPostSQL.
+	PostSQLOnFailure []string
+	// PostSQLDatabase is the default database of the scripts, none if empty.
+	PostSQLDatabase string
+
+	// UsePrepared executes the data INSERTs through a prepared statement per
+	// connection and INSERT shape (table, columns and number of rows) instead of
+	// the literal SQL, and pings the connections before the datas.
+	// See executePrepared, it's only worth it for dumps of single row INSERTs.
+	UsePrepared bool
+
+	// ManagedMode is the profile of the managed targets (RDS, Aurora, Cloud SQL)
+	// where the restoring user has no SUPER: it turns on RewriteDefiners and
+	// SkipPrivilegedSets. The loader itself never runs a statement needing SUPER.
+	ManagedMode bool
+	// RewriteDefiners replaces the DEFINER=user@host clauses of the schema
+	// statements with DEFINER=CURRENT_USER.
+	RewriteDefiners bool
+	// DefinerUser rewrites the DEFINER=user@host clauses of the views,
+	// triggers, routines and events to this account, 'user@host' like
+	// 'app@%', instead of CURRENT_USER: the objects with SQL SECURITY DEFINER
+	// then run with the privileges of the service user. Setting another
+	// account than the restoring one needs SET_USER_ID (SUPER before 8.0).
+	DefinerUser string
+	// SkipPrivilegedSets skips the SET statements of the files which need SUPER:
+	// global variables, sql_log_bin, gtid_purged, gtid_next and read_only.
+	SkipPrivilegedSets bool
+	// SkipBinlog turns sql_log_bin off on every connection of the restore,
+	// so the restored rows don't reach the replicas of the target nor its
+	// binlog. It needs SUPER, or SYSTEM_VARIABLES_ADMIN on MySQL 8.0.
+	SkipBinlog bool
+
+	// LogSQL logs the statements as they are executed: LogSQLDDL the schema
+	// statements verbatim, LogSQLAll the data statements too, redacted and
+	// truncated to LogSQLMaxBytes. Empty is LogSQLNone. A failed statement is
+	// always logged redacted, with its file, offset and MySQL error number.
+	LogSQL string
+	// LogSQLMaxBytes is the prefix of a redacted statement kept in the log, 0 means 256.
+	LogSQLMaxBytes int
+	// CaptureWarnings runs SHOW WARNINGS after every data statement, to learn
+	// about the values the server truncated or coerced into a schema with
+	// other column types. The first warning of a code is logged per table,
+	// the counts by level and code are in the summary and Report.Warnings.
+	// It's a round trip more per statement, and the server keeps at most
+	// max_error_count warnings of a statement.
+	CaptureWarnings bool
+	// WarningMessages is how many warnings of every table CaptureWarnings
+	// keeps in full, with their file and offset, for the summary and
+	// Report.TableWarnings, 0 means 5.
+	WarningMessages int
+	// WarningsAsErrors fails the data file whose warnings bring the ones of
+	// its table over WarningsThreshold, and the next files of the table
+	// with a warning: for a restore which must not truncate nor coerce a
+	// value. 0 fails the first one. It needs CaptureWarnings.
+	WarningsAsErrors  bool
+	WarningsThreshold int
+	// CheckUTF8 scans the string values the data statements have for the
+	// utf8, utf8mb3 and utf8mb4 columns of their table, the server would
+	// silently truncate or mangle the invalid ones: CheckUTF8Warn logs the
+	// first invalid value of a table with its file, offset, row and column,
+	// CheckUTF8Abort fails its file. The values which look double encoded,
+	// like 'Ã©' for 'é', are only logged. The counts by kind are in the
+	// summary and Report.EncodingProblems. Empty checks nothing.
+	CheckUTF8 string
+
+	// Targets are the other servers the tables can be restored into by name,
+	// like an archive server next to the hot one: the LoadConfig.Classifier
+	// routes every table to one of them or to Address, the DefaultTarget.
+	// The targets are restored one after the other, Address first, each with
+	// its own pool and progress, see loadTargets. A name can't be empty nor
+	// DefaultTarget.
+	Targets map[string]LoadTarget
+	// Placement routes whole databases to the Targets instead of the
+	// LoadConfig.Classifier, for a multi-tenant dump restored onto several
+	// smaller servers: PlacementRoundRobin or PlacementFile. A schema which
+	// refers to a database placed on another target fails the restore
+	// before any statement.
+	Placement string
+	// PlacementFile has a 'db target' line for every database of the dump
+	// with PlacementFile, the target a name of the Targets, DefaultTarget,
+	// or the address of one of them.
+	PlacementFile string
+
+	// PreTableHookCommand is run with 'sh -c' before the first data file of
+	// every table is restored, with DB, TABLE, FILE and STATUS=start in its
+	// environment. A failure skips the table, see LoadConfig.PreTableHook.
+	PreTableHookCommand string
+	// PostTableHookCommand is run once the data files of a table are all
+	// restored, with STATUS=ok, or failed, see LoadConfig.PostTableHook.
+	PostTableHookCommand string
+
+	// MetricsListen serves the Prometheus metrics of the run at /metrics on this address, like ':9104'.
+	MetricsListen string
+	// StatusListen serves the progress of the run as JSON at /status on this address, like ':8080'.
+	StatusListen string
+	// StatusToken enables the POST /cancel of StatusListen, for the requests
+	// with the header 'Authorization: Bearer <StatusToken>'; the POST /skip
+	// then needs it too. Without it /cancel is refused.
+	StatusToken string
+	// ProgressFile appends the progress of the run to this file, one JSON
+	// line per event, see ProgressEvent.
+	ProgressFile string
+
+	metrics *Metrics
+	// preTableHook and postTableHook are the callbacks of the LoadConfig.
+	preTableHook  TableHook
+	postTableHook TableHook
+	// pipeReopenHook is the PipeReopenHook of the LoadConfig.
+	pipeReopenHook TableHook
+	// rewriters are the Rewriters of the LoadConfig.
+	rewriters map[StatementKind][]Rewriter
+	// onProgress is the OnProgress of the LoadConfig.
+	onProgress ProgressFunc
+	// executor is the Executor of the LoadConfig.
+	executor ExecutorFunc
+	// filter is the Filter of the LoadConfig.
+	filter TableFilter
+	// route is the target of the run of a load with Targets, nil without.
+	route *targetRoute
+	// inflight is the semaphore of MaxInFlightBytes, nil if it's 0.
+	inflight *byteSemaphore
+	// memory is the semaphore of MaxMemory, nil if it's 0.
+	memory *byteSemaphore
+	// limit is the throttle of MaxBytesPerSec or MaxRowsPerSec, nil if they're 0.
+	limit *rateLimit
+	// lag holds the dispatch of the data files while the replica of
+	// ReplicaLagAddress lags, nil without one.
+	lag *lagGate
+	// upserts are the tables of Upsert by 'db.table', read by the run.
+	upserts map[string]*upsertTable
+	// fills are the tables of FillMissingColumns by 'db.table' with columns
+	// to fill, read by the run.
+	fills map[string]*fillTable
+	// utf8Tables are the tables CheckUTF8 checks by 'db.table', read by the run.
+	utf8Tables map[string]*utf8Table
+	// rollback writes the RollbackFile of the run, nil without one.
+	rollback *rollbackLog
+	// journal writes the ResumeFile of the run, nil without one.
+	journal *resumeJournal
+	// runtime is the deadline of MaxRuntime, nil without one.
+	runtime *runtimeLimit
+	// storage is the storage of Outdir, opened by the run, see store.
+	storage Storage
+	// incremental is whether Outdir is one of the Incrementals, its INSERTs
+	// are restored as upserts, see incrementalPasses.
+	incremental bool
+	// recreate are the tables, 'db.table', an incremental recreated, they
+	// are dropped before they're created.
+	recreate map[string]bool
+}
+
+// store returns the storage the files are read from: the one of Outdir during
+// a run, else the filesystem with the file names as paths, as the exported
+// functions like RestoreTableFile take them.
+func (args *LoadArgs) store() Storage {
+	if args.storage != nil {
+		return args.storage
+	}
+	return NewDirStorage("")
 }
 
 func WriteFile(file string, data string) error {
@@ -60,6 +895,11 @@ func ReadFile(file string) ([]byte, error) {
 	return ioutil.ReadFile(file)
 }
 
+// logSummary logs the final summary line of a run, it's shown at every log level.
+func logSummary(log *xlog.Log, format string, v ...interface{}) {
+	log.Output(2, fmt.Sprintf("\t  [SUMMARY]  \t"+format, v...))
+}
+
 func AssertNil(err error) {
 	if err != nil {
 		panic(err)
@@ -10,9 +10,12 @@
 package common
 
 import (
+	"bytes"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/XeLabs/go-mysqlstack/xlog"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -54,3 +57,12 @@ func TestEscapeBytes(t *testing.T) {
 		assert.Equal(t, want, got)
 	}
 }
+
+func TestLogSummary(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := xlog.NewXLog(buf, xlog.Level(xlog.WARNING))
+	log.Info("info.line")
+	logSummary(log, "summary.line[%d]", 1)
+	assert.False(t, strings.Contains(buf.String(), "info.line"))
+	assert.True(t, strings.Contains(buf.String(), "summary.line[1]"))
+}
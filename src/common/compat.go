@@ -0,0 +1,152 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// compatibilityFile is the report of the tables of a dump which may not
+// restore faithfully, written only if there are some.
+const compatibilityFile = "compatibility-report.txt"
+
+// CompatibilityWarning is a feature of a dumped table which may not restore
+// faithfully, see Manifest.Compatibility.
+type CompatibilityWarning struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Reason   string `json:"reason"`
+}
+
+var (
+	// encryptionRegexp matches the ENCRYPTION='Y' table option.
+	encryptionRegexp = regexp.MustCompile(`(?i)\bENCRYPTION\s*=\s*['"]Y['"]`)
+	// directoryRegexp matches the DATA DIRECTORY and INDEX DIRECTORY table options.
+	directoryRegexp = regexp.MustCompile(`(?i)\b(DATA|INDEX)\s+DIRECTORY\s*=`)
+	// tablespaceRegexp matches the TABLESPACE table option, with its name.
+	tablespaceRegexp = regexp.MustCompile("(?i)\\bTABLESPACE\\s*=?\\s*`?([\\w$]+)")
+	// zeroDateDefaultRegexp matches a zero date default of a column definition.
+	zeroDateDefaultRegexp = regexp.MustCompile(`(?i)\bDEFAULT\s+'0000-00-00`)
+	// expressionDefaultRegexp matches an expression default of the attributes
+	// of a column definition, its literals emptied.
+	expressionDefaultRegexp = regexp.MustCompile(`(?i)\bDEFAULT\s*\(`)
+)
+
+// compatibilityReasons returns why the table of the create table statement
+// schema may not restore faithfully, none if it should. engine and options are
+// its ENGINE and CREATE_OPTIONS in information_schema.TABLES, empty if they
+// are unknown, then the engine is read from schema.
+func compatibilityReasons(schema string, engine string, options string) []string {
+	var reasons []string
+	if engine == "" {
+		engine = tableEngine(schema)
+	}
+	switch strings.ToUpper(engine) {
+	case "FEDERATED":
+		reasons = append(reasons, "FEDERATED table: the dump holds the rows of the remote table, "+
+			"restored they are sent to the remote server named by its CONNECTION, which the target must reach")
+	case "CONNECT", "SPIDER":
+		reasons = append(reasons, fmt.Sprintf("%s table: its rows are read from an external source, the dump holds "+
+			"a copy of them and the target needs the %s engine and the same source", engine, engine))
+	}
+
+	table := tableOptions(schema) + " " + options
+	if encryptionRegexp.MatchString(table) {
+		reasons = append(reasons, "encrypted tablespace (ENCRYPTION='Y'): the target needs a keyring, else the CREATE TABLE fails")
+	}
+	if directoryRegexp.MatchString(table) {
+		reasons = append(reasons, "DATA or INDEX DIRECTORY: the directory must exist on the target and be allowed "+
+			"by innodb_directories, else the CREATE TABLE fails")
+	}
+	if match := tablespaceRegexp.FindStringSubmatch(table); match != nil {
+		switch strings.ToLower(match[1]) {
+		case "innodb_file_per_table", "innodb_system":
+		default:
+			reasons = append(reasons, fmt.Sprintf("general tablespace %s: it must exist on the target, else the CREATE TABLE fails", match[1]))
+		}
+	}
+
+	if checks := checkConstraints(schema); len(checks) > 0 {
+		reasons = append(reasons, fmt.Sprintf("CHECK constraints %s: enforced by MySQL 8.0.16 or later and MariaDB 10.2.1 or later, "+
+			"MySQL 5.7 and earlier parse and drop them, the restored table then accepts the rows they reject", strings.Join(checks, ", ")))
+	}
+	for _, def := range tableDefinitions(schema) {
+		name, attrs, ok := columnDefinition(def)
+		if !ok {
+			continue
+		}
+		if zeroDateDefaultRegexp.MatchString(def) {
+			reasons = append(reasons, fmt.Sprintf("column %s defaults to a zero date: the CREATE TABLE fails if the sql_mode "+
+				"of the target has NO_ZERO_DATE or NO_ZERO_IN_DATE with a strict mode, the default since MySQL 5.7", name))
+		}
+		if expressionDefaultRegexp.MatchString(attrs) {
+			reasons = append(reasons, fmt.Sprintf("column %s has an expression default: the target needs MySQL 8.0.13 "+
+				"or later, and the expression may be invalid under its sql_mode", name))
+		}
+	}
+	return reasons
+}
+
+// tableCreateOptions reads the ENGINE and the CREATE_OPTIONS of the tables of
+// the database db from information_schema, by table.
+func tableCreateOptions(conn *Connection, db string) (engines map[string]string, options map[string]string, err error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT TABLE_NAME, ENGINE, CREATE_OPTIONS FROM information_schema.TABLES WHERE TABLE_SCHEMA='%s'", EscapeBytes([]byte(db))))
+	if err != nil {
+		return nil, nil, err
+	}
+	engines = make(map[string]string)
+	options = make(map[string]string)
+	for _, row := range qr.Rows {
+		if len(row) < 3 {
+			continue
+		}
+		engines[row[0].String()] = row[1].String()
+		options[row[0].String()] = row[2].String()
+	}
+	return engines, options, nil
+}
+
+// writeCompatibilityReport writes the compatibility-report.txt of the
+// warnings, one table per paragraph, nothing if there are none.
+func writeCompatibilityReport(s Storage, warnings []*CompatibilityWarning) error {
+	if len(warnings) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Tables which may not restore faithfully, found by go-mydumper %s.\n", Version)
+	last := ""
+	for _, w := range warnings {
+		if table := w.Database + "." + w.Table; table != last {
+			fmt.Fprintf(&buf, "\n%s\n", table)
+			last = table
+		}
+		fmt.Fprintf(&buf, "  - %s\n", w.Reason)
+	}
+	return writeFile(s, compatibilityFile, buf.String())
+}
+
+// logCompatibility logs the warnings of the manifest of the dump for the
+// tables restored, the 'db.table' of restored.
+func logCompatibility(log *xlog.Log, s Storage, restored map[string]bool) {
+	manifest, err := readManifest(s)
+	if err != nil {
+		return
+	}
+	for _, w := range manifest.Compatibility {
+		if table := w.Database + "." + w.Table; restored[table] {
+			log.Warning("restoring.compatibility.table[%s]:%s", table, w.Reason)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompatibilityReasons(t *testing.T) {
+	// Nothing to say.
+	{
+		schema := "CREATE TABLE `t1` (`a` int NOT NULL,`b` datetime DEFAULT CURRENT_TIMESTAMP,`c` varchar(10) DEFAULT 'DEFAULT (x)'," +
+			"PRIMARY KEY (`a`)) /*!50100 TABLESPACE `innodb_system` */ ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;\n"
+		assert.Nil(t, compatibilityReasons(schema, "", ""))
+	}
+
+	// Everything.
+	{
+		schema := "CREATE TABLE `t2` (`a` int NOT NULL,`d` date NOT NULL DEFAULT '0000-00-00',`e` int DEFAULT (`a` + 1)," +
+			"PRIMARY KEY (`a`)) /*!50100 TABLESPACE `ts1` */ ENGINE=FEDERATED DATA DIRECTORY='/mnt/t2' ENCRYPTION='Y';\n"
+		reasons := compatibilityReasons(schema, "", "")
+		assert.Equal(t, 6, len(reasons))
+		assert.Contains(t, reasons[0], "FEDERATED table")
+		assert.Contains(t, reasons[1], "ENCRYPTION='Y'")
+		assert.Contains(t, reasons[2], "DATA or INDEX DIRECTORY")
+		assert.Contains(t, reasons[3], "general tablespace ts1")
+		assert.Contains(t, reasons[4], "column `d` defaults to a zero date")
+		assert.Contains(t, reasons[5], "column `e` has an expression default")
+	}
+
+	// information_schema wins over the create statement.
+	{
+		schema := "CREATE TABLE `t3` (`a` int) ENGINE=InnoDB;\n"
+		reasons := compatibilityReasons(schema, "CONNECT", `encryption="Y"`)
+		assert.Equal(t, 2, len(reasons))
+		assert.Contains(t, reasons[0], "CONNECT table")
+		assert.Contains(t, reasons[1], "encrypted tablespace")
+	}
+}
+
+func TestCompatibilityReport(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/compatibilitytest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	s := NewDirStorage(dir)
+
+	// No warning, no report.
+	{
+		assert.Nil(t, writeCompatibilityReport(s, nil))
+		_, err := s.Stat(compatibilityFile)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	m := newManifest()
+	m.addCompatibility("test", "t2", []string{"reason 1", "reason 2"})
+	m.addCompatibility("test", "t1", []string{"reason 3"})
+	assert.Nil(t, m.write(s))
+	assert.Nil(t, writeCompatibilityReport(s, m.Compatibility))
+
+	// One paragraph per table, sorted.
+	{
+		data, err := readFile(s, compatibilityFile)
+		assert.Nil(t, err)
+		want := "# Tables which may not restore faithfully, found by go-mydumper " + Version + ".\n" +
+			"\ntest.t1\n  - reason 3\n" +
+			"\ntest.t2\n  - reason 1\n  - reason 2\n"
+		assert.Equal(t, want, string(data))
+	}
+
+	// The manifest carries them.
+	{
+		read, err := readManifest(s)
+		assert.Nil(t, err)
+		assert.Equal(t, []*CompatibilityWarning{
+			{Database: "test", Table: "t1", Reason: "reason 3"},
+			{Database: "test", Table: "t2", Reason: "reason 1"},
+			{Database: "test", Table: "t2", Reason: "reason 2"},
+		}, read.Compatibility)
+		logCompatibility(log, s, map[string]bool{"test.t2": true})
+	}
+}
@@ -0,0 +1,445 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The consistency modes of DumpArgs.Consistency.
+const (
+	// ConsistencyNone reads every table in its own autocommit statements,
+	// the tables are dumped as they are when each is read.
+	ConsistencyNone = "none"
+	// ConsistencyLock holds FLUSH TABLES WITH READ LOCK, or the backup lock
+	// of DumpArgs.LockMode, while every connection starts its snapshot, like
+	// mysqldump --single-transaction.
+	ConsistencyLock = "lock"
+	// ConsistencyGTID starts the snapshots without a lock and checks with
+	// @@global.gtid_executed that no transaction committed in between.
+	ConsistencyGTID = "gtid"
+)
+
+const (
+	// consistencyGTIDAttempts bounds the tries of ConsistencyGTID.
+	consistencyGTIDAttempts = 10
+	// startSnapshot starts the consistent snapshot of a connection.
+	startSnapshot = "START TRANSACTION WITH CONSISTENT SNAPSHOT"
+)
+
+// defaultLockWaitTimeout is the DumpArgs.LockWaitTimeout if it's 0.
+const defaultLockWaitTimeout = 60 * time.Second
+
+// consistencyGTIDBackoff is the wait between two tries of ConsistencyGTID.
+var consistencyGTIDBackoff = 100 * time.Millisecond
+
+// lockWaitTimeout returns the LockWaitTimeout of args, the default if unset.
+func (args *DumpArgs) lockWaitTimeout() time.Duration {
+	if args.LockWaitTimeout > 0 {
+		return time.Duration(args.LockWaitTimeout) * time.Second
+	}
+	return defaultLockWaitTimeout
+}
+
+// ConsistentPoint is where the snapshot of a consistent dump is, in the
+// manifest.json, to set up a replica of the source from the dump.
+type ConsistentPoint struct {
+	// Mode is the DumpArgs.Consistency of the dump.
+	Mode string `json:"mode"`
+	// LockMode is the lock ConsistencyLock took, LockModeFTWRL,
+	// LockModeBackup or LockModeNone.
+	LockMode string `json:"lock_mode,omitempty"`
+	// BinlogFile and BinlogPosition are the ones of SHOW MASTER STATUS taken
+	// under the lock, empty with ConsistencyGTID or without a binlog.
+	BinlogFile     string `json:"binlog_file,omitempty"`
+	BinlogPosition uint64 `json:"binlog_position,omitempty"`
+	// GTIDSet is the @@global.gtid_executed of the snapshot, empty if the
+	// server has no GTIDs.
+	GTIDSet string `json:"gtid_set,omitempty"`
+	// SnapshotTime is the NOW() of the server read before the snapshots
+	// started, an incremental dump of this one dumps the tables changed at
+	// or after it, see DumpArgs.IncrementalFrom.
+	SnapshotTime string `json:"snapshot_time,omitempty"`
+}
+
+// takeAll takes every connection of the pool, the caller puts them back.
+func takeAll(pool *Pool) []*Connection {
+	size, _ := pool.Stats()
+	conns := make([]*Connection, 0, size)
+	for i := 0; i < size; i++ {
+		conns = append(conns, pool.Get())
+	}
+	return conns
+}
+
+// startSnapshots starts a REPEATABLE READ transaction WITH CONSISTENT
+// SNAPSHOT on every connection of the pool, all at the same point, as
+// DumpArgs.Consistency asks. The tables read by the connections after it are
+// then dumped as they were at that point, which is returned. Nothing is
+// done, and nil returned, with ConsistencyNone.
+func startSnapshots(log *xlog.Log, pool *Pool, args *DumpArgs) (*ConsistentPoint, error) {
+	if args.Consistency != ConsistencyLock && args.Consistency != ConsistencyGTID {
+		return nil, nil
+	}
+	conns := takeAll(pool)
+	defer func() {
+		for _, conn := range conns {
+			pool.Put(conn)
+		}
+	}()
+	for _, conn := range conns {
+		if err := conn.Execute("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"); err != nil {
+			return nil, wrapf(err, "dumping.consistency.isolation.error:%v", err)
+		}
+	}
+
+	// The time is read before the snapshots, a commit in the same second is
+	// in the next incremental dump too.
+	now, err := serverNow(conns[0])
+	if err != nil {
+		log.Warning("dumping.consistency.snapshot.time.error:%v", err)
+	}
+	t := time.Now()
+	var point *ConsistentPoint
+	if args.Consistency == ConsistencyLock {
+		var lock *snapshotLock
+		if lock, err = chooseSnapshotLock(log, conns[0], args.LockMode); err != nil {
+			return nil, err
+		}
+		point, args.heldLock, err = lockedSnapshots(log, conns, lock, args.lockWaitTimeout(), args.nonTransactional)
+	} else {
+		point, err = gtidSnapshots(log, conns)
+	}
+	if err != nil {
+		return nil, err
+	}
+	point.SnapshotTime = now
+	log.Info("dumping.consistency[%s].connections[%d].binlog[%s:%d].gtid.set[%s].cost[%.2fsec]",
+		point.Mode, len(conns), point.BinlogFile, point.BinlogPosition, point.GTIDSet, time.Since(t).Seconds())
+	return point, nil
+}
+
+// lockedSnapshots starts the snapshots of conns under the lock taken by the
+// first one, a global read lock or a backup lock: no transaction commits
+// until they all started, the binlog position and the GTID set are read
+// under it. The lock is held for that instant only, see flushWithReadLock
+// for how the global read lock is taken, or with hold until the tables the
+// snapshots don't cover are dumped, see heldLock. On an error the snapshots
+// started are rolled back.
+func lockedSnapshots(log *xlog.Log, conns []*Connection, lock *snapshotLock, timeout time.Duration, hold bool) (*ConsistentPoint, *heldLock, error) {
+	coordinator := conns[0]
+	if err := lock.acquire(log, conns, timeout); err != nil {
+		return nil, nil, err
+	}
+	held := &heldLock{log: log, conn: coordinator, lock: lock, at: time.Now()}
+	started := 0
+	point, err := func() (*ConsistentPoint, error) {
+		for _, conn := range conns {
+			if err := conn.Execute(startSnapshot); err != nil {
+				return nil, wrapf(err, "dumping.consistency.start.snapshot.thread[%d].error:%v", conn.ID, err)
+			}
+			started++
+		}
+		point := &ConsistentPoint{Mode: ConsistencyLock, LockMode: lock.mode}
+		// MySQL 8.2 renamed SHOW MASTER STATUS.
+		qr, err := coordinator.Fetch("SHOW MASTER STATUS")
+		if err != nil {
+			qr, err = coordinator.Fetch("SHOW BINARY LOG STATUS")
+		}
+		if err != nil {
+			log.Warning("dumping.consistency.master.status.error:%v", err)
+		} else if len(qr.Rows) > 0 && len(qr.Rows[0]) >= 2 {
+			point.BinlogFile = qr.Rows[0][0].String()
+			point.BinlogPosition, _ = strconv.ParseUint(qr.Rows[0][1].String(), 10, 64)
+		}
+		if point.GTIDSet, err = gtidExecuted(coordinator); err != nil {
+			log.Warning("dumping.consistency.gtid.executed.error:%v", err)
+		}
+		return point, nil
+	}()
+	if err != nil || !hold || lock.mode == LockModeNone {
+		if uerr := held.release(); uerr != nil && err == nil {
+			err = uerr
+		}
+		held = nil
+	} else {
+		log.Info("dumping.consistency[lock].%s.held.for.the.tables.out.of.the.snapshots", lock.name)
+	}
+	if err != nil {
+		for _, conn := range conns[:started] {
+			conn.Execute("ROLLBACK")
+		}
+		return nil, nil, err
+	}
+	return point, held, nil
+}
+
+// heldLock is the lock of lockedSnapshots kept once the snapshots started,
+// while the tables of the engines they don't cover, like MyISAM, are dumped:
+// no write changes them either, they are at the point of the dump too. The
+// connection holding it goes on dumping, the lock is released once no other
+// uses it.
+type heldLock struct {
+	log  *xlog.Log
+	conn *Connection
+	lock *snapshotLock
+	at   time.Time
+	// released is set once the lock is released.
+	released int32
+}
+
+// held reports whether the lock is still held.
+func (h *heldLock) held() bool {
+	return h != nil && atomic.LoadInt32(&h.released) == 0
+}
+
+// release releases the lock on its connection.
+func (h *heldLock) release() error {
+	atomic.StoreInt32(&h.released, 1)
+	var err error
+	for _, release := range h.lock.release {
+		if uerr := h.conn.Execute(release); uerr != nil && err == nil {
+			err = fmt.Errorf("dumping.consistency.unlock[%s].error:%v", release, uerr)
+		}
+	}
+	h.log.Info("dumping.consistency[lock].%s.held[%.3fsec]", h.lock.name, time.Since(h.at).Seconds())
+	return err
+}
+
+// flushWithReadLock takes the global read lock on the first of conns, see
+// watchedLock. A FLUSH NO_WRITE_TO_BINLOG TABLES first closes the tables
+// without the lock, so the FLUSH TABLES WITH READ LOCK has little left to
+// flush and blocks the writes for less time. Both FLUSHes wait for the long
+// queries on their tables, they are waited for together.
+func flushWithReadLock(log *xlog.Log, conns []*Connection, timeout time.Duration) error {
+	return watchedLock(log, conns, timeout, "flush.tables.with.read.lock", func(coordinator *Connection) (bool, error) {
+		if err := coordinator.Execute("FLUSH NO_WRITE_TO_BINLOG TABLES"); err != nil {
+			return false, fmt.Errorf("dumping.consistency.flush.tables.error:%v, it needs the RELOAD privilege", err)
+		}
+		if err := coordinator.Execute("FLUSH TABLES WITH READ LOCK"); err != nil {
+			return false, wrapf(err, "dumping.consistency.flush.tables.with.read.lock.error:%v", err)
+		}
+		return true, nil
+	}, []string{"UNLOCK TABLES"})
+}
+
+// watchedLock takes the lock name on the first of conns with take, which
+// reports whether it holds any part of it. take is waited for up to timeout:
+// past it the running statement is killed from the last of conns, which
+// lists the queries blocking it in the error. A lock held when take fails,
+// got at the last instant or only in part, is released with release. With
+// one connection the server bounds the wait, with the lock_wait_timeout of
+// the session, set before take.
+func watchedLock(log *xlog.Log, conns []*Connection, timeout time.Duration, name string, take func(*Connection) (bool, error), release []string) error {
+	coordinator := conns[0]
+	if err := coordinator.Execute(fmt.Sprintf("SET SESSION lock_wait_timeout=%d", int(timeout.Seconds()+0.999))); err != nil {
+		return wrapf(err, "dumping.consistency.lock.wait.timeout.error:%v", err)
+	}
+	var id string
+	if len(conns) > 1 {
+		qr, err := coordinator.Fetch("SELECT CONNECTION_ID()")
+		if err != nil {
+			return wrapf(err, "dumping.consistency.connection.id.error:%v", err)
+		}
+		if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+			return fmt.Errorf("dumping.consistency.connection.id.has.no.row")
+		}
+		id = qr.Rows[0][0].String()
+	}
+
+	log.Info("dumping.consistency[lock].%s.timeout[%v]...", name, timeout)
+	type taken struct {
+		held bool
+		err  error
+	}
+	done := make(chan taken, 1)
+	go func() {
+		held, err := take(coordinator)
+		done <- taken{held, err}
+	}()
+	var t taken
+	var blockers []string
+	if id == "" {
+		t = <-done
+	} else {
+		select {
+		case t = <-done:
+		case <-time.After(timeout):
+			killer := conns[len(conns)-1]
+			blockers = lockBlockers(killer, id)
+			if kerr := killer.Execute(fmt.Sprintf("KILL QUERY %s", id)); kerr != nil {
+				log.Warning("dumping.consistency.kill.%s[%s].error:%v", name, id, kerr)
+			}
+			t = <-done
+		}
+	}
+	if blockers == nil && t.err == nil {
+		return nil
+	}
+	if t.held {
+		for _, stmt := range release {
+			coordinator.Execute(stmt)
+		}
+	}
+	if blockers != nil {
+		return fmt.Errorf("dumping.consistency.%s.timeout[%v], the queries blocking it:\n  %s", name, timeout, strings.Join(blockers, "\n  "))
+	}
+	return t.err
+}
+
+// lockBlockers lists the queries of the processlist which may block the
+// lock of the connection id, the longest first: the
+// long running ones keep their tables open, the LOCK TABLES hold theirs.
+// Their text is cut to 256 characters and redacted, see blockerInfo.
+func lockBlockers(conn *Connection, id string) []string {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT ID, USER, HOST, DB, COMMAND, TIME, STATE, LEFT(INFO, 256) FROM information_schema.PROCESSLIST "+
+		"WHERE ID NOT IN (%s, CONNECTION_ID()) AND COMMAND NOT IN ('Sleep', 'Daemon', 'Binlog Dump', 'Binlog Dump GTID') ORDER BY TIME DESC LIMIT 20", id))
+	if err != nil {
+		return []string{fmt.Sprintf("processlist.error:%v", err)}
+	}
+	if len(qr.Rows) == 0 {
+		return []string{"none found"}
+	}
+	var blockers []string
+	for _, row := range qr.Rows {
+		if len(row) < 8 {
+			continue
+		}
+		blockers = append(blockers, fmt.Sprintf("id[%s].user[%s@%s].db[%s].command[%s].time[%ssec].state[%s]:%s",
+			row[0].String(), row[1].String(), row[2].String(), row[3].String(), row[4].String(), row[5].String(), row[6].String(), blockerInfo(row[7].String())))
+	}
+	return blockers
+}
+
+// blockerInfo returns the INFO of a blocking query with the content of its
+// string literals redacted, like redactSQL: no value of the datas, nor a
+// password of a statement, ends in the error. A literal the cut of the INFO
+// left open is closed first, so it's redacted too.
+func blockerInfo(info string) string {
+	var quote byte
+	for i := 0; i < len(info); i++ {
+		c := info[i]
+		switch {
+		case quote == 0:
+			if c == '\'' || c == '"' || c == '`' {
+				quote = c
+			}
+		case c == '\\' && quote != '`':
+			// An escape cut in two is dropped, it would escape the close.
+			if i == len(info)-1 {
+				info = info[:i]
+			}
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	if quote == '\'' || quote == '"' {
+		info += string(quote)
+	}
+	return redactSQL(info, 0)
+}
+
+// gtidExecuted returns the @@global.gtid_executed of the server of conn,
+// without its line breaks.
+func gtidExecuted(conn *Connection) (string, error) {
+	qr, err := conn.Fetch("SELECT @@global.gtid_executed")
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+		return "", fmt.Errorf("gtid.executed.has.no.row")
+	}
+	return strings.Replace(qr.Rows[0][0].String(), "\n", "", -1), nil
+}
+
+// serverNow returns the NOW() of the server of conn, like '2024-03-01
+// 10:00:00', in the time zone of the session.
+func serverNow(conn *Connection) (string, error) {
+	qr, err := conn.Fetch("SELECT NOW()")
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+		return "", fmt.Errorf("now.has.no.row")
+	}
+	return qr.Rows[0][0].String(), nil
+}
+
+// gtidSnapshots starts the snapshots of conns at once without a lock. Every
+// connection reads @@global.gtid_executed before and after its START
+// TRANSACTION: if all the reads are the same set, no transaction committed
+// from the first start to the last, the snapshots are the same. Else they
+// are rolled back and started again, up to consistencyGTIDAttempts times.
+// It needs gtid_mode=ON.
+func gtidSnapshots(log *xlog.Log, conns []*Connection) (*ConsistentPoint, error) {
+	qr, err := conns[0].Fetch("SELECT @@global.gtid_mode")
+	if err != nil {
+		return nil, fmt.Errorf("dumping.consistency[gtid].gtid.mode.error:%v, it needs MySQL 5.7 or later with gtid_mode=ON", err)
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 || !strings.EqualFold(qr.Rows[0][0].String(), "ON") {
+		return nil, fmt.Errorf("dumping.consistency[gtid].needs.gtid.mode.on, use the lock consistency")
+	}
+
+	for attempt := 1; ; attempt++ {
+		var wg sync.WaitGroup
+		var errs firstError
+		sets := make([][2]string, len(conns))
+		for i, conn := range conns {
+			wg.Add(1)
+			go func(i int, conn *Connection) {
+				defer wg.Done()
+				before, err := gtidExecuted(conn)
+				if err != nil {
+					errs.set(err)
+					return
+				}
+				if err := conn.Execute(startSnapshot); err != nil {
+					errs.set(wrapf(err, "dumping.consistency.start.snapshot.thread[%d].error:%v", conn.ID, err))
+					return
+				}
+				after, err := gtidExecuted(conn)
+				if err != nil {
+					errs.set(err)
+					return
+				}
+				sets[i] = [2]string{before, after}
+			}(i, conn)
+		}
+		wg.Wait()
+		if err := errs.get(); err != nil {
+			return nil, err
+		}
+		same := true
+		for _, set := range sets {
+			same = same && set[0] == sets[0][0] && set[1] == sets[0][0]
+		}
+		if same {
+			return &ConsistentPoint{Mode: ConsistencyGTID, GTIDSet: sets[0][0]}, nil
+		}
+		for _, conn := range conns {
+			if err := conn.Execute("ROLLBACK"); err != nil {
+				return nil, err
+			}
+		}
+		if attempt == consistencyGTIDAttempts {
+			return nil, fmt.Errorf("dumping.consistency[gtid].snapshots.differ.after[%d].attempts, transactions commit while they start, use the lock consistency", attempt)
+		}
+		log.Warning("dumping.consistency[gtid].attempt[%d].snapshots.differ,retrying", attempt)
+		time.Sleep(consistencyGTIDBackoff)
+	}
+}
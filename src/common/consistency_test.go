@@ -0,0 +1,272 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// snapshotServer answers the statements of startSnapshots on every
+// connection of a pool and records them, as 'id:statement'.
+type snapshotServer struct {
+	mu         sync.Mutex
+	statements []string
+	gtidMode   string
+	// gtid returns the gtid_executed of the nth read.
+	gtid  func(n int) string
+	reads int
+	// blocked blocks the statement blockOn, the FLUSH TABLES WITH READ LOCK
+	// if empty, until a KILL QUERY closes it.
+	blocked chan struct{}
+	blockOn string
+	// version, comment and logBin answer the probe of the backup locks, an
+	// empty version fails it.
+	version, comment, logBin string
+}
+
+func (s *snapshotServer) executor(id int) (Executor, error) {
+	return &snapshotConn{id: id, s: s}, nil
+}
+
+type snapshotConn struct {
+	id int
+	s  *snapshotServer
+}
+
+func (c *snapshotConn) Execute(query string) error {
+	c.s.mu.Lock()
+	c.s.statements = append(c.s.statements, fmt.Sprintf("%d:%s", c.id, query))
+	blocked := c.s.blocked
+	blockOn := c.s.blockOn
+	c.s.mu.Unlock()
+	if blockOn == "" {
+		blockOn = "FLUSH TABLES WITH READ LOCK"
+	}
+	switch {
+	case query == blockOn && blocked != nil:
+		<-blocked
+		return errors.New("Query execution was interrupted (errno 1317)")
+	case strings.HasPrefix(query, "KILL QUERY") && blocked != nil:
+		close(blocked)
+	}
+	return nil
+}
+
+func (c *snapshotConn) Fetch(query string) (*sqltypes.Result, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	if strings.Contains(query, "information_schema.PROCESSLIST") {
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{{Name: "ID"}, {Name: "USER"}, {Name: "HOST"}, {Name: "DB"}, {Name: "COMMAND"}, {Name: "TIME"}, {Name: "STATE"}, {Name: "INFO"}},
+			Rows: [][]sqltypes.Value{{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("42")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("report")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("10.0.0.7:51334")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("shop")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("Query")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("3600")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("Sending data")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("SELECT SUM(total) FROM orders WHERE email = 'ann@example.com'")),
+			}},
+		}, nil
+	}
+	switch query {
+	case "SELECT @@version, @@version_comment, @@log_bin":
+		if c.s.version == "" {
+			break
+		}
+		return stringsResult([]string{"@@version", "@@version_comment", "@@log_bin"}, []string{c.s.version, c.s.comment, c.s.logBin}), nil
+	case "SELECT NOW()":
+		return singleResult("NOW()", "2024-03-01 10:00:00"), nil
+	case "SELECT CONNECTION_ID()":
+		return singleResult("CONNECTION_ID()", fmt.Sprintf("%d", 100+c.id)), nil
+	case "SELECT @@global.gtid_mode":
+		return singleResult("@@global.gtid_mode", c.s.gtidMode), nil
+	case "SELECT @@global.gtid_executed":
+		c.s.reads++
+		return singleResult("@@global.gtid_executed", c.s.gtid(c.s.reads)), nil
+	case "SHOW MASTER STATUS":
+		c.s.statements = append(c.s.statements, fmt.Sprintf("%d:%s", c.id, query))
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{{Name: "File", Type: querypb.Type_VARCHAR}, {Name: "Position", Type: querypb.Type_UINT64}},
+			Rows: [][]sqltypes.Value{{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("mysql-bin.000003")),
+				sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("1234")),
+			}},
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected.query[%s]", query)
+}
+
+func (c *snapshotConn) Ping() error {
+	return nil
+}
+
+func (c *snapshotConn) Close() error {
+	return nil
+}
+
+// statementIndex returns the position of the statement, -1 if it's not run.
+func (s *snapshotServer) statementIndex(stmt string) int {
+	for i, st := range s.statements {
+		if st == stmt {
+			return i
+		}
+	}
+	return -1
+}
+
+// count returns how many statements are query.
+func (s *snapshotServer) count(query string) int {
+	n := 0
+	for _, stmt := range s.statements {
+		if strings.HasSuffix(stmt, ":"+query) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConsistencySnapshots(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	defer func(backoff time.Duration) { consistencyGTIDBackoff = backoff }(consistencyGTIDBackoff)
+	consistencyGTIDBackoff = 0
+	const gtid = "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"
+	snapshots := func(mode string, s *snapshotServer) (*ConsistentPoint, error) {
+		pool, err := NewExecutorPool(log, 3, s.executor)
+		AssertNil(err)
+		defer pool.Close()
+		return startSnapshots(log, pool, &DumpArgs{Consistency: mode})
+	}
+
+	// None starts nothing.
+	{
+		s := &snapshotServer{}
+		point, err := snapshots(ConsistencyNone, s)
+		assert.Nil(t, err)
+		assert.Nil(t, point)
+		assert.Nil(t, s.statements)
+	}
+
+	// Lock: every snapshot started under the lock, the point read under it.
+	{
+		s := &snapshotServer{gtid: func(int) string { return gtid + "\n" }}
+		point, err := snapshots(ConsistencyLock, s)
+		assert.Nil(t, err)
+		assert.Equal(t, &ConsistentPoint{Mode: ConsistencyLock, LockMode: LockModeFTWRL, BinlogFile: "mysql-bin.000003", BinlogPosition: 1234, GTIDSet: gtid, SnapshotTime: "2024-03-01 10:00:00"}, point)
+		assert.Equal(t, 3, s.count("SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ"))
+		want := []string{
+			"0:SET SESSION lock_wait_timeout=60",
+			"0:FLUSH NO_WRITE_TO_BINLOG TABLES",
+			"0:FLUSH TABLES WITH READ LOCK",
+			"0:START TRANSACTION WITH CONSISTENT SNAPSHOT",
+			"1:START TRANSACTION WITH CONSISTENT SNAPSHOT",
+			"2:START TRANSACTION WITH CONSISTENT SNAPSHOT",
+			"0:SHOW MASTER STATUS",
+			"0:UNLOCK TABLES",
+		}
+		assert.Equal(t, want, s.statements[3:])
+	}
+
+	// Lock: a FLUSH TABLES WITH READ LOCK blocked past the timeout is killed,
+	// the error lists the blocking queries.
+	{
+		s := &snapshotServer{blocked: make(chan struct{})}
+		pool, err := NewExecutorPool(log, 3, s.executor)
+		AssertNil(err)
+		_, err = startSnapshots(log, pool, &DumpArgs{Consistency: ConsistencyLock, LockWaitTimeout: 1})
+		pool.Close()
+		assert.NotNil(t, err)
+		want := "dumping.consistency.flush.tables.with.read.lock.timeout[1s], the queries blocking it:\n" +
+			"  id[42].user[report@10.0.0.7:51334].db[shop].command[Query].time[3600sec].state[Sending data]:SELECT SUM(total) FROM orders WHERE email = '…'"
+		assert.Equal(t, want, err.Error())
+		assert.Equal(t, 1, s.count("KILL QUERY 100"))
+		assert.Equal(t, 0, s.count(startSnapshot))
+		assert.True(t, s.statementIndex("2:KILL QUERY 100") > s.statementIndex("0:FLUSH TABLES WITH READ LOCK"), "%v", s.statements)
+	}
+
+	// Lock: the FLUSH NO_WRITE_TO_BINLOG TABLES before it waits for the
+	// same queries, it's bounded and killed the same way.
+	{
+		s := &snapshotServer{blocked: make(chan struct{}), blockOn: "FLUSH NO_WRITE_TO_BINLOG TABLES"}
+		pool, err := NewExecutorPool(log, 3, s.executor)
+		AssertNil(err)
+		_, err = startSnapshots(log, pool, &DumpArgs{Consistency: ConsistencyLock, LockWaitTimeout: 1})
+		pool.Close()
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "dumping.consistency.flush.tables.with.read.lock.timeout[1s], the queries blocking it:"), err.Error())
+		assert.Equal(t, 1, s.count("KILL QUERY 100"))
+		assert.Equal(t, 0, s.count("FLUSH TABLES WITH READ LOCK"))
+		assert.Equal(t, 0, s.count("UNLOCK TABLES"))
+		assert.True(t, s.statementIndex("0:SET SESSION lock_wait_timeout=1") < s.statementIndex("0:FLUSH NO_WRITE_TO_BINLOG TABLES"), "%v", s.statements)
+	}
+
+	// GTID: no lock, the same set everywhere.
+	{
+		s := &snapshotServer{gtidMode: "ON", gtid: func(int) string { return gtid }}
+		point, err := snapshots(ConsistencyGTID, s)
+		assert.Nil(t, err)
+		assert.Equal(t, &ConsistentPoint{Mode: ConsistencyGTID, GTIDSet: gtid, SnapshotTime: "2024-03-01 10:00:00"}, point)
+		assert.Equal(t, 0, s.count("FLUSH TABLES WITH READ LOCK"))
+		assert.Equal(t, 3, s.count(startSnapshot))
+		assert.Equal(t, 0, s.count("ROLLBACK"))
+	}
+
+	// GTID: a transaction commits while the first snapshots start, they are
+	// started again.
+	{
+		s := &snapshotServer{gtidMode: "ON", gtid: func(n int) string {
+			if n <= 2 {
+				return gtid
+			}
+			return strings.Replace(gtid, "1-5", "1-6", 1)
+		}}
+		point, err := snapshots(ConsistencyGTID, s)
+		assert.Nil(t, err)
+		assert.Equal(t, "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-6", point.GTIDSet)
+		assert.Equal(t, 6, s.count(startSnapshot))
+		assert.Equal(t, 3, s.count("ROLLBACK"))
+	}
+
+	// GTID: a server always committing.
+	{
+		s := &snapshotServer{gtidMode: "ON", gtid: func(n int) string { return fmt.Sprintf("3e11fa47-71ca-11e1-9e33-c80aa9429562:1-%d", n) }}
+		_, err := snapshots(ConsistencyGTID, s)
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "dumping.consistency[gtid].snapshots.differ.after[10].attempts"), err.Error())
+		assert.Equal(t, 30, s.count("ROLLBACK"))
+	}
+
+	// GTID: gtid_mode OFF.
+	{
+		s := &snapshotServer{gtidMode: "OFF"}
+		_, err := snapshots(ConsistencyGTID, s)
+		assert.NotNil(t, err)
+		assert.Equal(t, 0, s.count(startSnapshot))
+	}
+}
+
+func TestConsistencyBlockerInfo(t *testing.T) {
+	assert.Equal(t, "SELECT SUM(total) FROM orders", blockerInfo("SELECT SUM(total) FROM orders"))
+	assert.Equal(t, "UPDATE `users` SET password = '…' WHERE id = 7", blockerInfo("UPDATE `users` SET password = 'hunter2' WHERE id = 7"))
+	// A literal cut short by the LEFT(INFO, 256) is closed and redacted.
+	assert.Equal(t, "INSERT INTO t VALUES (1, '…'", blockerInfo("INSERT INTO t VALUES (1, 'secret, and the rest is c"))
+	assert.Equal(t, "INSERT INTO t VALUES (\"…\"", blockerInfo("INSERT INTO t VALUES (\"it\\'s cut in an escape \\"))
+}
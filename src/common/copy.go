@@ -0,0 +1,307 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// CopyConfig is the configuration of a Copier.
+type CopyConfig struct {
+	// Dump is the source: the connection, Database, Table, Threads,
+	// ChunksizeInMB and StmtSize. Outdir is not used, the data files are
+	// always SQL ones.
+	Dump DumpArgs
+	// Load is the target: the connection, Threads and the options applied to
+	// the statements, like CreateIfNotExists or Replacements. Outdir is not
+	// used, see Validate for the options a copy doesn't support.
+	Load LoadArgs
+
+	// Log is the log of the run, nil logs to stderr at the info level.
+	Log *xlog.Log
+}
+
+// CopyReport is the outcome of a copy, the reports of its dump and its load.
+type CopyReport struct {
+	Dump Report `json:"dump"`
+	Load Report `json:"load"`
+}
+
+// Copier copies a database from a server into another without staging the
+// files anywhere: every file of the dump is restored as soon as it's written,
+// see NewCopier.
+type Copier struct {
+	cfg CopyConfig
+}
+
+// NewCopier creates a Copier, cfg is copied.
+func NewCopier(cfg CopyConfig) *Copier {
+	return &Copier{cfg: cfg}
+}
+
+// Run validates the configuration and copies the database. The dump and the
+// load run at once: the data files are handed over in memory, a dump thread
+// waits while Load.Threads files are already waiting for the target, see
+// pipeStorage. The first error of either side stops both, Run returns it and
+// the reports of the two sides, see Dumper.Run.
+func (c *Copier) Run(ctx context.Context) (CopyReport, error) {
+	log := logOrDefault(c.cfg.Log)
+	dumpArgs := c.cfg.Dump
+	dumpArgs.metrics = newMetrics(log, "dump", nil, &dumpArgs.allbytes, &dumpArgs.allrows)
+	loadArgs := c.cfg.Load
+	var bytes uint64
+	loadArgs.metrics = newMetrics(log, "load", nil, &bytes, nil)
+	// cancel is the POST /cancel of the status of either side.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dumpArgs.metrics.cancel = cancel
+	loadArgs.metrics.cancel = cancel
+
+	err := c.cfg.Validate()
+	if err == nil {
+		err = dumpArgs.metrics.openProgress(log, dumpArgs.ProgressFile, time.Duration(dumpArgs.IntervalMs)*time.Millisecond)
+	}
+	if err == nil {
+		err = loadArgs.metrics.openProgress(log, loadArgs.ProgressFile, time.Duration(loadArgs.IntervalMs)*time.Millisecond)
+	}
+	var dumpErr, loadErr error
+	if err == nil {
+		runCtx, cancel := context.WithCancel(ctx)
+		pipe := newPipeStorage(runCtx, loadArgs.Threads)
+		dumpArgs.storage = pipe
+
+		var errs firstError
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			dumpErr = dump(runCtx, log, &dumpArgs)
+			if dumpErr != nil {
+				errs.set(dumpErr)
+				cancel()
+			}
+			close(pipe.files)
+		}()
+		loadErr = copyLoad(runCtx, log, &loadArgs, pipe)
+		if loadErr != nil {
+			errs.set(loadErr)
+			cancel()
+		}
+		<-done
+		cancel()
+		err = errs.get()
+	} else {
+		dumpErr, loadErr = err, err
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	report := CopyReport{Dump: dumpArgs.metrics.report(dumpErr), Load: loadArgs.metrics.report(loadErr)}
+	dumpArgs.metrics.closeProgress(report.Dump)
+	loadArgs.metrics.closeProgress(report.Load)
+	return report, err
+}
+
+// copyLoad restores the files of the pipe as they come, until it's closed.
+// The database and the table schemas are restored one by one in their order,
+// a table schema is always written before the data files of its table, the
+// data files are restored by the LoadArgs.DataThreads connections. The first error stops
+// the restore, the files not taken yet are left to the dump, which the caller
+// stops.
+func copyLoad(ctx context.Context, log *xlog.Log, args *LoadArgs, pipe *pipeStorage) error {
+	args.storage = pipe
+	pool, err := NewPool(log, args.dataThreads(), args.Address, args.User, args.Password)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	defer pool.CloseOnDone(ctx)()
+	defer tuneTarget(log, args)()
+
+	args.metrics.pool = pool
+	config := *args
+	config.Password = redacted
+	args.metrics.config = &config
+	stop, err := serveRun(log, args.metrics, args.MetricsListen, args.StatusListen, args.StatusToken)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	args.limit = newRateLimit(args)
+	var wg sync.WaitGroup
+	var errs firstError
+	t := args.metrics.phaseStarted("data")
+	args.metrics.threadsStarted(args.dataThreads())
+	stopEvents := args.metrics.collectFileEvents()
+	defer stopEvents()
+
+	stopTick := tickEvery(time.Millisecond*time.Duration(args.IntervalMs), func() {
+		loadEvents(log).ProgressTick(args.metrics.progressStats(args.dataThreads(), t))
+	})
+	defer stopTick()
+
+	for name := range pipe.files {
+		if err := ctx.Err(); err != nil {
+			errs.set(err)
+		}
+		if errs.get() != nil {
+			pipe.release(name)
+			break
+		}
+		switch {
+		case strings.HasSuffix(name, dbSuffix):
+			conn := pool.Get()
+			err := restoreDatabaseSchema(ctx, log, conn, args, []string{name})
+			pool.Put(conn)
+			pipe.release(name)
+			errs.set(err)
+		case strings.HasSuffix(name, schemaSuffix):
+			schema, err := readSchemaFile(pipe, name)
+			pipe.release(name)
+			if err != nil {
+				errs.set(err)
+				continue
+			}
+			conn := pool.Get()
+			if err := restoreSchemaFile(ctx, log, conn, args, schema); err != nil {
+				errs.set(wrapf(err, "restoring.schema[%s].error:%v", schema.key(), err))
+			}
+			pool.Put(conn)
+		default:
+			if _, _, _, err := ParseTableFile(name); err != nil {
+				pipe.release(name)
+				errs.set(err)
+				continue
+			}
+			args.metrics.addFiles(1)
+			conn := pool.Get()
+			wg.Add(1)
+			go func(conn *Connection, name string) {
+				args.metrics.workerStarted()
+				defer func() {
+					pipe.release(name)
+					args.metrics.workerDone()
+					wg.Done()
+					pool.Put(conn)
+				}()
+				n, err := restoreTable(log, conn, args, name)
+				if err != nil {
+					errs.set(err)
+					return
+				}
+				args.metrics.addProgress(conn.ID, uint64(n), 0)
+			}(conn, name)
+		}
+	}
+
+	wg.Wait()
+	if args.limit != nil {
+		logRateLimit(log, args)
+	}
+	args.metrics.threadsDone()
+	if err := errs.get(); err != nil {
+		return err
+	}
+	args.metrics.phaseDone("data", t)
+	args.metrics.phaseStarted("done")
+	return nil
+}
+
+// pipeStorage is the Storage a copy dumps into: the database, schema and data
+// files are queued for the restore once closed, the other files like the
+// manifest.json are dropped. The queue holds as many files as the restore has
+// threads, Close waits for a free slot, so a dump thread stops reading its
+// table while the target is behind. A file is kept in memory until the
+// restore releases it.
+type pipeStorage struct {
+	ctx   context.Context
+	files chan string
+
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newPipeStorage(ctx context.Context, size int) *pipeStorage {
+	return &pipeStorage{ctx: ctx, files: make(chan string, size), data: make(map[string][]byte)}
+}
+
+// List returns no file, the files are only handed to the restore in order.
+func (p *pipeStorage) List() ([]string, error) {
+	return nil, nil
+}
+
+// Open opens a file queued and not released yet.
+func (p *pipeStorage) Open(name string) (io.ReadCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, ok := p.data[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Create buffers the file, Close queues it.
+func (p *pipeStorage) Create(name string) (io.WriteCloser, error) {
+	return &pipeWriter{pipe: p, name: name}, nil
+}
+
+func (p *pipeStorage) Stat(name string) (os.FileInfo, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, ok := p.data[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFileInfo{name: name, size: int64(len(data)), modTime: time.Now()}, nil
+}
+
+// queue queues a file for the restore, it waits for a slot until ctx is done.
+func (p *pipeStorage) queue(name string, data []byte) error {
+	if !strings.HasSuffix(name, tableSuffix) {
+		return nil
+	}
+	p.mu.Lock()
+	p.data[name] = data
+	p.mu.Unlock()
+	select {
+	case p.files <- name:
+		return nil
+	case <-p.ctx.Done():
+		p.release(name)
+		return p.ctx.Err()
+	}
+}
+
+// release drops a file taken from the queue.
+func (p *pipeStorage) release(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.data, name)
+}
+
+type pipeWriter struct {
+	bytes.Buffer
+	pipe *pipeStorage
+	name string
+}
+
+func (w *pipeWriter) Close() error {
+	return w.pipe.queue(w.name, w.Bytes())
+}
@@ -0,0 +1,183 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopier(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	source := driver.NewTestHandler(log)
+	sourceServer, err := driver.MockMysqlServer(log, source)
+	assert.Nil(t, err)
+	defer sourceServer.Close()
+	target := driver.NewTestHandler(log)
+	targetServer, err := driver.MockMysqlServer(log, target)
+	assert.Nil(t, err)
+	defer targetServer.Close()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "a",
+				Type: querypb.Type_INT32,
+			},
+			{
+				Name: "b",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+	}
+	for i := 0; i < 50000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("11")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx")),
+		})
+	}
+
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Create Table",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`a` int(11) DEFAULT NULL,`b` varchar(100) DEFAULT NULL) ENGINE=InnoDB")),
+			},
+		}}
+
+	tablesResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Tables_in_test",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+			},
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t2")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		source.AddQueryPattern("use .*", &sqltypes.Result{})
+		source.AddQueryPattern("show create table .*", schemaResult)
+		source.AddQueryPattern("show tables from .*", tablesResult)
+		source.AddQueryPattern("select .*", selectResult)
+		target.AddQueryPattern("use .*", &sqltypes.Result{})
+		target.AddQueryPattern("create .*", &sqltypes.Result{})
+		target.AddQueryPattern("insert .*", &sqltypes.Result{})
+	}
+
+	cfg := CopyConfig{
+		Dump: DumpArgs{
+			Database:      "test",
+			User:          "mock",
+			Password:      "mock",
+			Address:       sourceServer.Addr(),
+			ChunksizeInMB: 1,
+			Threads:       2,
+			StmtSize:      10000,
+			IntervalMs:    500,
+		},
+		Load: LoadArgs{
+			User:       "mock",
+			Password:   "mock",
+			Address:    targetServer.Addr(),
+			Threads:    2,
+			IntervalMs: 500,
+		},
+		Log: log,
+	}
+
+	// Every data file dumped is restored.
+	{
+		report, err := NewCopier(cfg).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Dump.Status)
+		assert.Equal(t, RunOK, report.Load.Status)
+		assert.True(t, report.Dump.FilesDone > 2)
+		assert.Equal(t, report.Dump.FilesDone, report.Load.FilesDone)
+		assert.Equal(t, report.Dump.FilesDone, report.Load.FilesTotal)
+	}
+
+	// A failed restore stops the dump.
+	{
+		failing := driver.NewTestHandler(log)
+		failingServer, err := driver.MockMysqlServer(log, failing)
+		assert.Nil(t, err)
+		defer failingServer.Close()
+		failing.AddQueryPattern("use .*", &sqltypes.Result{})
+		failing.AddQueryPattern("create .*", &sqltypes.Result{})
+		failing.AddQueryErrorPattern("insert .*", errors.New("mock.insert.error"))
+
+		cfg := cfg
+		cfg.Load.Address = failingServer.Addr()
+		report, err := NewCopier(cfg).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, RunFailed, report.Load.Status)
+		assert.True(t, report.Load.FilesFailed > 0)
+	}
+}
+
+func TestCopyPipeStorage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pipe := newPipeStorage(ctx, 1)
+
+	// The files which are not restored are dropped.
+	{
+		assert.Nil(t, writeFile(pipe, manifestFile, "{}"))
+		assert.Nil(t, writeFile(pipe, "test.t1.00001.sql", "INSERT"))
+		assert.Equal(t, "test.t1.00001.sql", <-pipe.files)
+		data, err := readFile(pipe, "test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT", string(data))
+		info, err := pipe.Stat("test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(6), info.Size())
+		pipe.release("test.t1.00001.sql")
+		_, err = pipe.Open("test.t1.00001.sql")
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// A full queue waits, until ctx is done.
+	{
+		assert.Nil(t, writeFile(pipe, "test.t1.00002.sql", "INSERT"))
+		time.AfterFunc(50*time.Millisecond, cancel)
+		start := time.Now()
+		assert.Equal(t, context.Canceled, writeFile(pipe, "test.t1.00003.sql", "INSERT"))
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+		_, err := pipe.Open("test.t1.00003.sql")
+		assert.True(t, os.IsNotExist(err))
+	}
+}
@@ -0,0 +1,165 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// cacheLineSize is the size the counter of a worker is padded to.
+	cacheLineSize = 64
+	// counterSlots are the workerCounters of a run, the connections above
+	// as many share one.
+	counterSlots = 64
+	// fileEventsBuffer is how many file events the workers queue before
+	// they wait on the collector.
+	fileEventsBuffer = 1024
+)
+
+// workerCounter is the bytes and rows added by the workers of one slot, alone
+// on its cache line so that the workers don't invalidate each other's.
+type workerCounter struct {
+	bytes uint64
+	rows  uint64
+	_     [cacheLineSize - 16]byte
+}
+
+// workerCounters are the bytes and rows of the workers of a run by slot. Every
+// worker adds to the slot of its connection and the readers, the ticks, the
+// status and the report, sum them: with 64 threads adding to the same two
+// counters for every row the cache line of the counters moved from core to
+// core on every add.
+type workerCounters []workerCounter
+
+func newWorkerCounters() workerCounters {
+	return make(workerCounters, counterSlots)
+}
+
+// add adds the bytes and rows of worker, the ID of its connection.
+func (c workerCounters) add(worker int, bytes uint64, rows uint64) {
+	slot := &c[uint(worker)%uint(len(c))]
+	if bytes > 0 {
+		atomic.AddUint64(&slot.bytes, bytes)
+	}
+	if rows > 0 {
+		atomic.AddUint64(&slot.rows, rows)
+	}
+}
+
+// sum returns the bytes and rows of all the workers.
+func (c workerCounters) sum() (uint64, uint64) {
+	var bytes, rows uint64
+	for i := range c {
+		bytes += atomic.LoadUint64(&c[i].bytes)
+		rows += atomic.LoadUint64(&c[i].rows)
+	}
+	return bytes, rows
+}
+
+// fileEvent is a data file written or restored, or failed with err.
+type fileEvent struct {
+	file string
+	err  error
+}
+
+// addProgress adds the bytes and rows the worker of the connection ID did.
+func (m *Metrics) addProgress(worker int, bytes uint64, rows uint64) {
+	if m != nil {
+		m.counters.add(worker, bytes, rows)
+	}
+}
+
+// redumped takes the rows, the row bytes and the files of the dump ts of a
+// table dumped again by the worker out of the counters, see
+// redumpChangedSchema: the next dump adds them again.
+func (m *Metrics) redumped(worker int, ts *TableStats) {
+	if m == nil {
+		return
+	}
+	slot := &m.counters[uint(worker)%uint(len(m.counters))]
+	atomic.AddUint64(&slot.bytes, ^(ts.rowBytes - 1))
+	atomic.AddUint64(&slot.rows, ^(ts.Rows - 1))
+	atomic.AddUint64(&m.files, ^(uint64(ts.Files) - 1))
+	atomic.AddUint64(&m.filesDone, ^(uint64(ts.Files) - 1))
+}
+
+// bytesDone returns the bytes of the run: the ones of its counter and the
+// ones the workers added.
+func (m *Metrics) bytesDone() uint64 {
+	if m == nil {
+		return 0
+	}
+	bytes, _ := m.counters.sum()
+	return atomic.LoadUint64(m.bytes) + bytes
+}
+
+// rowsDone returns the rows of the run, 0 if it doesn't count them.
+func (m *Metrics) rowsDone() uint64 {
+	if m == nil || m.rows == nil {
+		return 0
+	}
+	_, rows := m.counters.sum()
+	return atomic.LoadUint64(m.rows) + rows
+}
+
+// collectFileEvents starts the collector of the file events of the data phase:
+// the workers queue them and the collector alone records them, the workers
+// don't wait on the lock of the failures or the progress file. The returned
+// func stops it once all the queued ones are recorded, it's called once the
+// workers are done. Without a collector the events are recorded at once.
+func (m *Metrics) collectFileEvents() func() {
+	if m == nil {
+		return func() {}
+	}
+	events := make(chan fileEvent, fileEventsBuffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range events {
+			m.recordFile(ev)
+		}
+	}()
+	m.events.Store(events)
+	return func() {
+		m.events.Store((chan fileEvent)(nil))
+		close(events)
+		<-done
+	}
+}
+
+// fileEvent queues ev for the collector, or records it without one.
+func (m *Metrics) fileEvent(ev fileEvent) {
+	if events, _ := m.events.Load().(chan fileEvent); events != nil {
+		events <- ev
+		return
+	}
+	m.recordFile(ev)
+}
+
+// recordFile records the file of ev done or failed.
+func (m *Metrics) recordFile(ev fileEvent) {
+	if ev.err == nil {
+		atomic.AddUint64(&m.filesDone, 1)
+		m.progressEvent(&ProgressEvent{Event: ProgressFileDone, File: ev.file}, false)
+		return
+	}
+	atomic.AddUint64(&m.filesFailed, 1)
+	m.addError(fmt.Errorf("%s: %v", ev.file, ev.err))
+	category := ErrorCategoryOf(ev.err)
+	m.mu.Lock()
+	if m.failures == nil {
+		m.failures = make(map[ErrorCategory]uint64)
+	}
+	m.failures[category]++
+	m.mu.Unlock()
+	m.progressEvent(&ProgressEvent{Event: ProgressFileFailed, File: ev.file, Error: ev.err.Error(), Category: category}, false)
+}
@@ -0,0 +1,133 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerCounters(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	assert.Equal(t, uintptr(cacheLineSize), unsafe.Sizeof(workerCounter{}))
+
+	// The workers, more than the slots, add to their own slot and the sum is
+	// on top of the counters of the run.
+	{
+		var allbytes, allrows uint64 = 100, 10
+		m := newMetrics(log, "dump", nil, &allbytes, &allrows)
+		var wg sync.WaitGroup
+		for worker := 0; worker < 2*counterSlots; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					m.addProgress(worker, 3, 1)
+				}
+			}(worker)
+		}
+		wg.Wait()
+		assert.Equal(t, uint64(100+2*counterSlots*300), m.bytesDone())
+		assert.Equal(t, uint64(10+2*counterSlots*100), m.rowsDone())
+		assert.Equal(t, m.bytesDone(), m.snapshot().BytesDone)
+		assert.Equal(t, m.rowsDone(), *m.snapshot().RowsDone)
+	}
+
+	// A run without rows, and without metrics.
+	{
+		var allbytes uint64
+		m := newMetrics(log, "load", nil, &allbytes, nil)
+		m.addProgress(1, 5, 0)
+		assert.Equal(t, uint64(5), m.bytesDone())
+		assert.Equal(t, uint64(0), m.rowsDone())
+		assert.Nil(t, m.snapshot().RowsDone)
+
+		var none *Metrics
+		none.addProgress(1, 5, 1)
+		assert.Equal(t, uint64(0), none.bytesDone())
+		none.collectFileEvents()()
+	}
+}
+
+func TestCollectFileEvents(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	var allbytes uint64
+	m := newMetrics(log, "load", nil, &allbytes, nil)
+
+	// The events of the workers are all recorded once the collector stops.
+	stop := m.collectFileEvents()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 64; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				file := fmt.Sprintf("test.t%d.%05d.sql", worker, i)
+				if i%10 == 0 {
+					m.fileFailed(file, &CategorizedError{Category: CategoryData, Err: errors.New("mock.error")})
+					continue
+				}
+				m.fileDone(file)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	stop()
+	r := m.report(nil)
+	assert.Equal(t, uint64(64*90), r.FilesDone)
+	assert.Equal(t, uint64(64*10), r.FilesFailed)
+	assert.Equal(t, map[ErrorCategory]uint64{CategoryData: 64 * 10}, r.FailureCategories)
+	assert.Equal(t, maxRecentErrors, len(r.Errors))
+
+	// Stopped, they are recorded at once.
+	m.fileDone("test.t1.00001.sql")
+	assert.Equal(t, uint64(64*90+1), m.snapshot().FilesDone)
+}
+
+// BenchmarkProgressAccounting compares the counters of a run all the workers
+// add to with the workerCounters, at 64 workers adding a row at a time.
+func BenchmarkProgressAccounting(b *testing.B) {
+	const workers = 64
+	run := func(b *testing.B, add func(worker int)) {
+		var wg sync.WaitGroup
+		for worker := 0; worker < workers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for i := worker; i < b.N; i += workers {
+					add(worker)
+				}
+			}(worker)
+		}
+		wg.Wait()
+	}
+
+	b.Run("shared", func(b *testing.B) {
+		var allbytes, allrows uint64
+		run(b, func(worker int) {
+			atomic.AddUint64(&allbytes, 128)
+			atomic.AddUint64(&allrows, 1)
+		})
+	})
+	b.Run("workers", func(b *testing.B) {
+		var allbytes, allrows uint64
+		m := newMetrics(xlog.NewStdLog(xlog.Level(xlog.PANIC)), "dump", nil, &allbytes, &allrows)
+		run(b, func(worker int) {
+			m.addProgress(worker, 128, 1)
+		})
+	})
+}
@@ -0,0 +1,258 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// validatePhase is the phase of the validation pass of LoadArgs.DeferConstraints.
+const validatePhase = "validate"
+
+// maxOrphanSamples is how many rows of a violated foreign key are reported.
+const maxOrphanSamples = 10
+
+// foreignKeyDefRegexp matches a FOREIGN KEY definition of a create table
+// statement, with its constraint name, its columns, the referenced table and
+// the referenced columns.
+var foreignKeyDefRegexp = regexp.MustCompile("(?is)^(?:CONSTRAINT\\s+(`(?:[^`]|``)*`)\\s+)?FOREIGN\\s+KEY\\s*(?:`(?:[^`]|``)*`\\s*)?" +
+	"\\(([^)]*)\\)\\s*REFERENCES\\s+(`(?:[^`]|``)*`(?:\\.`(?:[^`]|``)*`)?)\\s*\\(([^)]*)\\)")
+
+// foreignKey is a FOREIGN KEY of a restored table, the names are quoted.
+type foreignKey struct {
+	// table is the table of the key, `db`.`t`, and name its constraint name,
+	// empty if it has none.
+	table   string
+	name    string
+	columns []string
+	// refTable is the referenced table, `db`.`t`.
+	refTable   string
+	refColumns []string
+}
+
+// foreignKeys returns the foreign keys of the create table statement schema
+// of the table db.table. An unqualified referenced table is one of db.
+func foreignKeys(db string, table string, schema string) []foreignKey {
+	var keys []foreignKey
+	for _, def := range tableDefinitions(schema) {
+		match := foreignKeyDefRegexp.FindStringSubmatch(def)
+		if match == nil {
+			continue
+		}
+		ref := match[3]
+		if refDB := identifierEnd(ref, 0); refDB == len(ref) {
+			ref = quoteIdentifier(db) + "." + ref
+		}
+		keys = append(keys, foreignKey{
+			table:      quoteIdentifier(db) + "." + quoteIdentifier(table),
+			name:       match[1],
+			columns:    quotedNameRegexp.FindAllString(match[2], -1),
+			refTable:   ref,
+			refColumns: quotedNameRegexp.FindAllString(match[4], -1),
+		})
+	}
+	return keys
+}
+
+// String names the key in the logs, by its constraint name if it has one.
+func (k foreignKey) String() string {
+	if k.name != "" {
+		return k.table + "." + k.name
+	}
+	return k.table + "(" + strings.Join(k.columns, ",") + ")"
+}
+
+// orphansQuery returns the query of the rows of the table of k whose columns
+// have no row of the referenced table, at most limit of them with their
+// columns, or their count if limit is 0. A row with a NULL in the columns
+// references nothing, as MATCH SIMPLE has it.
+func (k foreignKey) orphansQuery(limit int) string {
+	var notNull, join []string
+	for i, column := range k.columns {
+		notNull = append(notNull, "c."+column+" IS NOT NULL")
+		if i < len(k.refColumns) {
+			join = append(join, "p."+k.refColumns[i]+" = c."+column)
+		}
+	}
+	where := fmt.Sprintf("WHERE %s AND NOT EXISTS (SELECT 1 FROM %s AS p WHERE %s)",
+		strings.Join(notNull, " AND "), k.refTable, strings.Join(join, " AND "))
+	if limit == 0 {
+		return fmt.Sprintf("SELECT COUNT(*) FROM %s AS c %s", k.table, where)
+	}
+	columns := make([]string, len(k.columns))
+	for i, column := range k.columns {
+		columns[i] = "c." + column
+	}
+	return fmt.Sprintf("SELECT %s FROM %s AS c %s LIMIT %d", strings.Join(columns, ", "), k.table, where, limit)
+}
+
+// checkForeignKey returns the violations of k on conn as a problem line, empty
+// if every row has its parent.
+func checkForeignKey(log *xlog.Log, conn *Connection, k foreignKey) (string, error) {
+	qr, err := conn.Fetch(k.orphansQuery(maxOrphanSamples))
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) == 0 {
+		log.Info("restoring.validate.foreign.key[%s].ok", k)
+		return "", nil
+	}
+	orphans := fmt.Sprintf("%d", len(qr.Rows))
+	if len(qr.Rows) == maxOrphanSamples {
+		count, err := conn.Fetch(k.orphansQuery(0))
+		if err != nil {
+			return "", err
+		}
+		if len(count.Rows) > 0 && len(count.Rows[0]) > 0 {
+			orphans = count.Rows[0][0].String()
+		}
+	}
+	samples := make([]string, 0, len(qr.Rows))
+	for _, row := range qr.Rows {
+		values := make([]string, 0, len(row))
+		for i, v := range row {
+			if i < len(k.columns) {
+				values = append(values, k.columns[i]+"="+v.String())
+			}
+		}
+		samples = append(samples, "("+strings.Join(values, ",")+")")
+	}
+	log.Error("restoring.validate.foreign.key[%s].references[%s].orphans[%s].sample[%s]", k, k.refTable, orphans, strings.Join(samples, ","))
+	return fmt.Sprintf("foreign key %s has %s rows without their row in %s: %s", k, orphans, k.refTable, strings.Join(samples, ",")), nil
+}
+
+// checkTable runs CHECK TABLE on table, `db`.`t`, and returns its errors as a
+// problem line, empty if it's OK.
+func checkTable(log *xlog.Log, conn *Connection, table string) (string, error) {
+	qr, err := conn.Fetch("CHECK TABLE " + table)
+	if err != nil {
+		return "", err
+	}
+	var errs []string
+	for _, row := range qr.Rows {
+		if len(row) < 4 {
+			continue
+		}
+		kind, text := strings.ToLower(row[2].String()), row[3].String()
+		switch {
+		case kind == "error", kind == "status" && !strings.EqualFold(text, "OK"):
+			errs = append(errs, text)
+		case kind == "warning":
+			log.Warning("restoring.validate.check.table[%s].warning:%s", table, text)
+		}
+	}
+	if len(errs) == 0 {
+		log.Info("restoring.validate.check.table[%s].ok", table)
+		return "", nil
+	}
+	log.Error("restoring.validate.check.table[%s].errors:%s", table, strings.Join(errs, "; "))
+	return fmt.Sprintf("check table %s: %s", table, strings.Join(errs, "; ")), nil
+}
+
+// validateConstraints is the validation pass of LoadArgs.DeferConstraints once
+// the data files are restored with the foreign key checks off: it turns them
+// back on for every connection of the pool, then looks for the rows of the
+// restored tables with data which have no row in the table a foreign key
+// references, and with LoadArgs.CheckTables runs CHECK TABLE on these tables,
+// in parallel on the connections of the pool. It fails with every violation.
+func validateConstraints(log *xlog.Log, pool *Pool, args *LoadArgs, schemas []string, tables []string) error {
+	if err := pool.executeAll("SET foreign_key_checks=1"); err != nil {
+		return err
+	}
+	datas := make(map[string]bool)
+	for _, table := range tables {
+		db, tbl, _ := parseTableFile(table)
+		datas[db+"."+tbl] = true
+	}
+
+	// The checks of a table, its foreign keys then its CHECK TABLE.
+	type check struct {
+		key   *foreignKey
+		table string
+	}
+	var checks []check
+	for _, path := range schemas {
+		s, err := readSchemaFile(args.store(), path)
+		if err != nil {
+			return err
+		}
+		if !datas[s.db+"."+s.table] {
+			continue
+		}
+		for _, stmt := range splitStatements(s.sql) {
+			if !createTableRegexp.MatchString(stmt.sql) {
+				continue
+			}
+			// The restored table, of LoadArgs.TablePrefix and TableSuffix.
+			create := renameTables(args, s.db, stmt.sql)
+			for _, k := range foreignKeys(s.db, args.targetTable(s.table), create) {
+				k := k
+				checks = append(checks, check{key: &k})
+			}
+			if args.CheckTables {
+				checks = append(checks, check{table: quoteIdentifier(s.db) + "." + quoteIdentifier(args.targetTable(s.table))})
+			}
+			break
+		}
+	}
+	log.Info("restoring.validate.checks[%d].tables[%d]", len(checks), len(datas))
+
+	limit := newPhaseLimit(args.metrics, validatePhase, args.postThreads())
+	defer limit.done()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs firstError
+	var problems []string
+	for _, c := range checks {
+		if errs.get() != nil {
+			break
+		}
+		conn := limit.get(pool)
+		wg.Add(1)
+		go func(conn *Connection, c check) {
+			defer limit.working()()
+			defer func() {
+				wg.Done()
+				limit.put(pool, conn)
+			}()
+			var problem string
+			var err error
+			if c.key != nil {
+				problem, err = checkForeignKey(log, conn, *c.key)
+			} else {
+				problem, err = checkTable(log, conn, c.table)
+			}
+			if err != nil {
+				errs.set(wrapf(err, "restoring.validate.error:%v", err))
+				return
+			}
+			if problem != "" {
+				mu.Lock()
+				problems = append(problems, problem)
+				mu.Unlock()
+			}
+		}(conn, c)
+	}
+	wg.Wait()
+	if err := errs.get(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("restoring.validate.constraints.failed:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForeignKeys(t *testing.T) {
+	schema := "CREATE TABLE `orders` (\n" +
+		"  `id` int NOT NULL,\n" +
+		"  `customer_id` int DEFAULT NULL,\n" +
+		"  `shop` int DEFAULT NULL,\n" +
+		"  `sku` varchar(16) DEFAULT NULL,\n" +
+		"  PRIMARY KEY (`id`),\n" +
+		"  CONSTRAINT `fk_customer` FOREIGN KEY (`customer_id`) REFERENCES `customers` (`id`),\n" +
+		"  FOREIGN KEY (`shop`,`sku`) REFERENCES `catalog`.`items` (`shop`,`sku`) ON DELETE CASCADE\n" +
+		") ENGINE=InnoDB"
+	keys := foreignKeys("db1", "orders", schema)
+	want := []foreignKey{
+		{table: "`db1`.`orders`", name: "`fk_customer`", columns: []string{"`customer_id`"}, refTable: "`db1`.`customers`", refColumns: []string{"`id`"}},
+		{table: "`db1`.`orders`", columns: []string{"`shop`", "`sku`"}, refTable: "`catalog`.`items`", refColumns: []string{"`shop`", "`sku`"}},
+	}
+	assert.Equal(t, want, keys)
+	assert.Equal(t, "`db1`.`orders`.`fk_customer`", keys[0].String())
+	assert.Equal(t, "`db1`.`orders`(`shop`,`sku`)", keys[1].String())
+
+	assert.Equal(t, "SELECT c.`shop`, c.`sku` FROM `db1`.`orders` AS c WHERE c.`shop` IS NOT NULL AND c.`sku` IS NOT NULL AND "+
+		"NOT EXISTS (SELECT 1 FROM `catalog`.`items` AS p WHERE p.`shop` = c.`shop` AND p.`sku` = c.`sku`) LIMIT 10", keys[1].orphansQuery(10))
+	assert.Equal(t, "SELECT COUNT(*) FROM `db1`.`orders` AS c WHERE c.`customer_id` IS NOT NULL AND "+
+		"NOT EXISTS (SELECT 1 FROM `db1`.`customers` AS p WHERE p.`id` = c.`customer_id`)", keys[0].orphansQuery(0))
+
+	assert.Nil(t, foreignKeys("db1", "t", "CREATE TABLE `t` (`a` int, KEY `k` (`a`)) ENGINE=InnoDB"))
+}
+
+func TestLoaderDeferConstraints(t *testing.T) {
+	dir := "/tmp/loaderdeferconstraints"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql":  "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.parent-schema.sql":  "CREATE TABLE `parent` (`id` int NOT NULL, PRIMARY KEY (`id`)) ENGINE=InnoDB;\n",
+		"test.parent.00001.sql":   "INSERT INTO `parent` VALUES (1),(2);\n",
+		"test.child-schema.sql":   "CREATE TABLE `child` (`id` int NOT NULL, `parent_id` int, PRIMARY KEY (`id`), CONSTRAINT `fk_parent` FOREIGN KEY (`parent_id`) REFERENCES `parent` (`id`)) ENGINE=InnoDB;\n",
+		"test.child.00001.sql":    "INSERT INTO `child` VALUES (1,1),(2,NULL),(3,7);\n",
+		"test.orphans-schema.sql": "CREATE TABLE `orphans` (`id` int NOT NULL, `parent_id` int, CONSTRAINT `fk_orphans` FOREIGN KEY (`parent_id`) REFERENCES `parent` (`id`)) ENGINE=InnoDB;\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	key := foreignKey{table: "`test`.`child`", name: "`fk_parent`", columns: []string{"`parent_id`"}, refTable: "`test`.`parent`", refColumns: []string{"`id`"}}
+	// The row (3,7) violates the foreign key, the restore let it through.
+	orphans := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "parent_id"}},
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("7"))}},
+	}
+	checkOK := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Table"}, {Name: "Op"}, {Name: "Msg_type"}, {Name: "Msg_text"}},
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("test.child")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("check")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("status")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("OK")),
+		}},
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500}
+
+	// The datas are restored with the checks off, the pass finds the row.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			key.orphansQuery(maxOrphanSamples): orphans,
+			"CHECK TABLE `test`.`child`":       checkOK,
+		}}
+		args := args
+		args.DeferConstraints = true
+		args.CheckTables = true
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.validate.constraints.failed:\n"+
+			"  foreign key `test`.`child`.`fk_parent` has 1 rows without their row in `test`.`parent`: (`parent_id`=7)", err.Error())
+		assert.Equal(t, RunFailed, report.Status)
+		assert.Equal(t, uint64(2), report.FilesDone)
+
+		index := func(query string) int {
+			for i, q := range rec.queries {
+				if q == query {
+					return i
+				}
+			}
+			return -1
+		}
+		off, on := index("SET foreign_key_checks=0"), index("SET foreign_key_checks=1")
+		assert.True(t, off >= 0 && on > off, "%v", rec.queries)
+		for i, query := range rec.queries {
+			if strings.HasPrefix(query, "INSERT") {
+				assert.True(t, off < i && i < on, "%v", rec.queries)
+			}
+		}
+		assert.Equal(t, 2, strings.Count(strings.Join(rec.queries, "\n"), "SET foreign_key_checks=0"))
+		assert.True(t, index("CHECK TABLE `test`.`child`") > on)
+		assert.True(t, index("CHECK TABLE `test`.`parent`") > on)
+		// A table without datas is not validated.
+		assert.Equal(t, -1, index("CHECK TABLE `test`.`orphans`"))
+	}
+
+	// Without a violation the restore is OK.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{}
+		args := args
+		args.DeferConstraints = true
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		assert.Contains(t, rec.queries, key.orphansQuery(maxOrphanSamples))
+	}
+
+	// Off by default.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.NotContains(t, rec.queries, "SET foreign_key_checks=0")
+		assert.NotContains(t, rec.queries, key.orphansQuery(maxOrphanSamples))
+	}
+}
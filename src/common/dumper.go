@@ -10,180 +10,981 @@
 package common
 
 import (
+	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
-	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
 	"github.com/XeLabs/go-mysqlstack/xlog"
 )
 
-func writeMetaData(args *Args) {
-	file := fmt.Sprintf("%s/metadata", args.Outdir)
-	WriteFile(file, "")
+func writeMetaData(args *DumpArgs) error {
+	return writeFile(args.storage, metaFile, metaData()+partitionsMetaData(args))
 }
 
-func dumpDatabaseSchema(log *xlog.Log, conn *Connection, args *Args) {
-	err := conn.Execute(fmt.Sprintf("use `%s`", args.Database))
-	AssertNil(err)
+func dumpDatabaseSchema(log *xlog.Log, conn *Connection, args *DumpArgs) error {
+	if err := conn.Use(args.Database); err != nil {
+		return err
+	}
 
 	schema := fmt.Sprintf("create database if not exists `%s`;", args.Database)
-	file := fmt.Sprintf("%s/%s-schema-create.sql", args.Outdir, args.Database)
-	WriteFile(file, schema)
+	file := fmt.Sprintf("%s-schema-create.sql", args.Database)
+	if err := writeFile(args.storage, file, schema); err != nil {
+		return err
+	}
 	log.Info("dumping.database[%s].schema...", args.Database)
+	return nil
 }
 
-func dumpTableSchema(log *xlog.Log, conn *Connection, args *Args, table string) {
+// dumpTableSchema writes the create statement of the table, after a DROP
+// TABLE IF EXISTS with AddDropTable or as a CREATE TABLE IF NOT EXISTS with
+// IfNotExists, without its tablespace options unless KeepTablespaceOptions,
+// and returns the create statement as it is.
+func dumpTableSchema(log *xlog.Log, conn *Connection, args *DumpArgs, table string) (string, error) {
 	qr, err := conn.Fetch(fmt.Sprintf("show create table `%s`.`%s`", args.Database, table))
-	AssertNil(err)
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 {
+		return "", fmt.Errorf("dumping.table[%s.%s].show.create.table.has.no.row", args.Database, table)
+	}
 	schema := qr.Rows[0][1].String() + ";\n"
-
-	file := fmt.Sprintf("%s/%s.%s-schema.sql", args.Outdir, args.Database, table)
-	WriteFile(file, schema)
+	create := qr.Rows[0][1].String()
+	if !args.KeepTablespaceOptions {
+		var options []string
+		create, options = stripTablespaceOptions(create)
+		for _, option := range options {
+			log.Warning("dumping.table[%s.%s].tablespace.option.stripped[%s]", args.Database, table, option)
+		}
+	}
+	data := create + ";\n"
+	switch {
+	case args.AddDropTable:
+		data = fmt.Sprintf("DROP TABLE IF EXISTS %s;\n%s", quoteIdentifier(table), data)
+	case args.IfNotExists:
+		data = createIfNotExists(create) + ";\n"
+	}
+	file := fmt.Sprintf("%s.%s-schema.sql", args.Database, table)
+	if err := writeFile(args.storage, file, data); err != nil {
+		return "", err
+	}
 	log.Info("dumping.table[%s.%s].schema...", args.Database, table)
+	return schema, nil
 }
 
-func dumpTable(log *xlog.Log, conn *Connection, args *Args, table string) {
-	var allBytes, allRows uint64
+// dumpTable dumps the datas of a table with the create statement schema and
+// returns its stats, without the engine. The INVISIBLE columns are selected by
+// name, the INSERTs always name their columns so they go back to the right ones.
+// A table of DumpArgs.ChunkBy gets a data file per chunk of its column, one of
+// DumpArgs.ChunkRows is dumped a range of its key at a time, see dumpRanges.
+func dumpTable(log *xlog.Log, conn *Connection, args *DumpArgs, table string, schema string) (*TableStats, error) {
+	start := time.Now()
+	var key *chunkKey
+	var ranges []keyRange
+	if args.ChunkRows > 0 && args.tableChunkBy(table).Column == "" {
+		k, r, err := tableKeyRanges(log, conn, args, table, schema)
+		if err != nil {
+			return nil, err
+		}
+		if len(r) > 0 {
+			key, ranges = k, r
+		}
+	}
+
+	var stats *TableStats
+	if key == nil {
+		ts, err := dumpRange(log, conn, args, table, schema, nil, keyRange{}, 0)
+		if err != nil {
+			return nil, err
+		}
+		stats = ts
+	} else {
+		parts, err := dumpRanges(log, conn, args, table, schema, key, ranges)
+		if err != nil {
+			return nil, err
+		}
+		stats = &TableStats{chunkKey: key.String()}
+		for _, ts := range parts {
+			stats.Rows += ts.Rows
+			stats.rowBytes += ts.rowBytes
+			stats.Bytes += ts.Bytes
+			stats.Files += ts.Files
+			stats.chunks = append(stats.chunks, ts.chunks...)
+			stats.next = append(stats.next, ts.next...)
+			if args.Paranoid {
+				if stats.paranoid == nil {
+					stats.paranoid = &paranoidSums{key: ts.paranoid.key}
+				}
+				stats.paranoid.merge(ts.paranoid)
+			}
+		}
+		// An interrupted dump with more ranges left the files of the next one.
+		stats.next = append(stats.next, fmt.Sprintf("%05d.%05d", len(ranges)+1, 1))
+	}
+
+	if stats.Files == 0 && !args.SkipEmptyFiles && args.formatName() == FormatSQL {
+		if err := writeEmptyMarker(log, conn, args, table, stats); err != nil {
+			return nil, err
+		}
+	}
+	stats.Seconds = time.Since(start).Seconds()
+	if stats.Seconds > 0 {
+		stats.MBPerSec = float64(stats.Bytes) / 1024 / 1024 / stats.Seconds
+	}
+	dumpEvents(log).TableDone(args.Database, table, stats.Rows, stats.rowBytes, conn.ID)
+	return stats, nil
+}
+
+// emptyMarkerStatement ends the header of the marker of an empty table: a
+// file of only comments has no statement, the SET of a user variable is one
+// any loader runs harmlessly.
+const emptyMarkerStatement = "SET @go_mydumper_empty_table = 1;\n"
 
-	cursor, err := conn.StreamFetch(fmt.Sprintf("select /*backup*/ * from `%s`.`%s`", args.Database, table))
-	AssertNil(err)
+// writeEmptyMarker writes the marker of an empty table into its first data
+// file, the header comment of DumpArgs.FileTrailers and emptyMarkerStatement,
+// with its trailer, see DumpArgs.SkipEmptyFiles.
+func writeEmptyMarker(log *xlog.Log, conn *Connection, args *DumpArgs, table string, stats *TableStats) error {
+	// The first file of the table, of its first range with a key.
+	label := stats.next[0]
+	data := []byte(fileHeader(args, table, label, time.Now()) + emptyMarkerStatement)
+	if args.FileTrailers {
+		data = append(data, fileTrailer(data, 0)...)
+	}
+	file := fmt.Sprintf("%s.%s.%s%s", args.Database, table, label, tableSuffix)
+	args.metrics.addFiles(1)
+	if err := writeFile(args.storage, file, string(data)); err != nil {
+		args.metrics.fileFailed(file, err)
+		return err
+	}
+	args.metrics.fileDone(file)
+	log.Info("dumping.table[%s.%s].has.no.rows.wrote.the.empty.table.marker[%s]", args.Database, table, file)
+	stats.chunks = append(stats.chunks, newCheckpointChunk(file, data))
+	stats.paranoid.endChunk()
+	stats.Files++
+	stats.Bytes += uint64(len(data))
+	stats.next[0] = nextLabel(label)
+	dumpEvents(log).FileDone(args.Database, table, file, uint64(len(data)), conn.ID)
+	return nil
+}
 
-	fields := make([]string, 0, 16)
-	flds := cursor.Fields()
-	for _, fld := range flds {
-		fields = append(fields, fmt.Sprintf("`%s`", fld.Name))
+// nextLabel returns the label of the numbered data file after label, like
+// '00002' after '00001' or '00001.00002' after '00001.00001'.
+func nextLabel(label string) string {
+	i := strings.LastIndexByte(label, '.') + 1
+	n, _ := strconv.Atoi(label[i:])
+	return fmt.Sprintf("%s%05d", label[:i], n+1)
+}
+
+// dumpRanges dumps the key ranges of a table of DumpArgs.ChunkRows, each a
+// unit of work: conn dumps them in turn along with the idle connections of
+// the run, taken as the ranges start, so a big table spreads over the threads
+// the other tables leave idle. The stats of the ranges are in their order,
+// the first error stops the ranges not started.
+func dumpRanges(log *xlog.Log, conn *Connection, args *DumpArgs, table string, schema string, key *chunkKey, ranges []keyRange) ([]*TableStats, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	parts := make([]*TableStats, len(ranges))
+	next := 0
+	// take returns the next range to dump, false once they are all taken or
+	// a range failed.
+	take := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if next == len(ranges) || failed != nil {
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+	var work func(c *Connection)
+	// help takes the idle connections of the run while ranges are left, a
+	// goroutine dumps ranges on each.
+	help := func() {
+		for args.pool != nil {
+			mu.Lock()
+			left := next < len(ranges) && failed == nil
+			mu.Unlock()
+			if !left {
+				return
+			}
+			helper := args.pool.TryGet()
+			if helper == nil {
+				return
+			}
+			wg.Add(1)
+			go func(c *Connection) {
+				args.metrics.workerStarted()
+				args.metrics.startWork(c.ID, args.Database+"."+table, "")
+				defer func() {
+					args.metrics.endWork(c.ID)
+					args.metrics.workerDone()
+					wg.Done()
+					args.pool.Put(c)
+				}()
+				work(c)
+			}(helper)
+		}
+	}
+	work = func(c *Connection) {
+		for {
+			// A range starts once the replica catches up, the cursor of the
+			// previous one is closed: a paused one would hold its snapshot
+			// and its connection open for nothing.
+			args.lag.wait()
+			help()
+			i, ok := take()
+			if !ok {
+				return
+			}
+			ts, err := dumpRange(log, c, args, table, schema, key, ranges[i], i+1)
+			mu.Lock()
+			parts[i] = ts
+			if err != nil && failed == nil {
+				failed = err
+			}
+			mu.Unlock()
+		}
+	}
+	work(conn)
+	wg.Wait()
+	if failed != nil {
+		return nil, failed
+	}
+	return parts, nil
+}
+
+// dumpRange dumps the rows of the range span of the key k of a table, all of
+// them without a key, and returns their stats. The data files of the range
+// number no, 0 without a key, are labelled 'no.00001' and up, the ones of a
+// table without a key '00001' and up.
+func dumpRange(log *xlog.Log, conn *Connection, args *DumpArgs, table string, schema string, k *chunkKey, span keyRange, no int) (*TableStats, error) {
+	var allBytes, allRows uint64
+	stats := &TableStats{}
+	chunkBy := args.tableChunkBy(table)
+	cursor, err := selectTable(log, conn, args.Database, table, schema, args.tablePartitions(table), rangeWhere(args.rowsWhere(table), k, span), chunkBy.Column)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cursor != nil {
+			cursor.Close()
+		}
+	}()
+
+	names := make([]string, 0, 16)
+	for _, fld := range cursor.Fields() {
+		names = append(names, fld.Name)
+	}
+	format := args.format()
+	// The columns of the table are written once, by its first range.
+	if format.columns != nil && no <= 1 {
+		if err := format.columns(args, table, cursor.Fields(), schema); err != nil {
+			return nil, err
+		}
 	}
+	var chunks *chunker
+	if chunkBy.Column != "" {
+		if chunks, err = newChunker(chunkBy, cursor.Fields()); err != nil {
+			return nil, err
+		}
+	}
+	if args.Paranoid {
+		stats.paranoid = newParanoidSums(schema, cursor.Fields())
+	}
+	w := format.writer(args)
+	w.BeginTable(table, names)
+	defer w.EndTable()
 
 	fileNo := 1
+	// numbered returns the label of the numbered data file n.
+	numbered := func(n int) string {
+		if no > 0 {
+			return fmt.Sprintf("%05d.%05d", no, n)
+		}
+		return fmt.Sprintf("%05d", n)
+	}
 	chunkbytes := 0
-	stmtsize := 0
-	rows := make([]string, 0, 256)
-	inserts := make([]string, 0, 256)
+	// chunkRows and chunkStarted are the rows of the chunk and the time its
+	// first one was read, for FileTrailers.
+	var chunkRows uint64
+	var chunkStarted time.Time
+	// current is the chunk being written by ChunkBy, nil for a numbered one.
+	// One over the ChunksizeInMB is split in parts, its files are labelled
+	// 'label.00001' and up, parts the ones written.
+	var current *chunkRange
+	parts := 0
+	// writeChunk writes the data file of the rows written, split tells the
+	// one of a ChunkBy chunk which goes on in another part.
+	writeChunk := func(split bool) error {
+		data := w.EndChunk()
+		label := numbered(fileNo)
+		if current != nil {
+			label = current.label
+			if split || parts > 0 {
+				parts++
+				label = fmt.Sprintf("%s.%05d", label, parts)
+			}
+			if !split {
+				parts = 0
+			}
+		}
+		file := fmt.Sprintf("%s.%s.%s%s", args.Database, table, label, format.suffix)
+		if args.FileTrailers {
+			data = append([]byte(fileHeader(args, table, label, chunkStarted)), data...)
+			data = append(data, fileTrailer(data, chunkRows)...)
+		}
+		args.metrics.addFiles(1)
+		if err := writeFile(args.storage, file, string(data)); err != nil {
+			args.metrics.fileFailed(file, err)
+			return err
+		}
+		args.metrics.fileDone(file)
+		args.metrics.threadBytes(conn.ID, uint64(len(data)))
+		chunk := newCheckpointChunk(file, data)
+		if current != nil {
+			chunk.From, chunk.To = current.from, current.to
+		} else if k != nil {
+			chunk.From, chunk.To = span.from, span.to
+		}
+		stats.chunks = append(stats.chunks, chunk)
+		stats.paranoid.endChunk()
+		stats.Files++
+		stats.Bytes += uint64(len(data))
+		dumpEvents(log).FileDone(args.Database, table, file, uint64(len(data)), conn.ID)
+		chunkbytes = 0
+		chunkRows = 0
+		fileNo++
+		return nil
+	}
 	for cursor.Next() {
 		row, err := cursor.RowValues()
-		AssertNil(err)
-
-		values := make([]string, 0, 16)
-		for _, v := range row {
-			if v.Raw() == nil {
-				values = append(values, "NULL")
-			} else {
-				str := v.String()
-				switch {
-				case v.IsSigned(), v.IsUnsigned(), v.IsFloat(), v.IsIntegral(), v.Type() == querypb.Type_DECIMAL:
-					values = append(values, str)
-				default:
-					values = append(values, fmt.Sprintf("\"%s\"", EscapeBytes(v.Raw())))
+		if err != nil {
+			return nil, err
+		}
+		if chunks != nil {
+			r, err := chunks.chunk(row)
+			if err != nil {
+				return nil, err
+			}
+			if current != nil && current.label != r.label {
+				// The last part of a split chunk may be written already.
+				if chunkbytes == 0 {
+					parts = 0
+				} else if err := writeChunk(false); err != nil {
+					return nil, err
 				}
 			}
+			current = &r
 		}
-		r := "(" + strings.Join(values, ",") + ")"
-		rows = append(rows, r)
-
-		allRows++
-		chunkbytes += len(r)
-		stmtsize += len(r)
-		allBytes += uint64(len(r))
-		atomic.AddUint64(&args.Allbytes, uint64(len(r)))
-		atomic.AddUint64(&args.Allrows, 1)
 
-		if stmtsize >= args.StmtSize {
-			insertone := fmt.Sprintf("INSERT INTO `%s`(%s) VALUES\n%s", table, strings.Join(fields, ","), strings.Join(rows, ",\n"))
-			inserts = append(inserts, insertone)
-			rows = rows[:0]
-			stmtsize = 0
+		if chunkRows == 0 {
+			chunkStarted = time.Now()
 		}
+		n := w.WriteRow(row)
+		stats.paranoid.add(row)
+		allRows++
+		chunkRows++
+		chunkbytes += n
+		allBytes += uint64(n)
+		args.metrics.addProgress(conn.ID, uint64(n), 1)
 
 		if (chunkbytes / 1024 / 1024) >= args.ChunksizeInMB {
-			query := strings.Join(inserts, ";\n") + ";\n"
-			file := fmt.Sprintf("%s/%s.%s.%05d.sql", args.Outdir, args.Database, table, fileNo)
-			WriteFile(file, query)
-
-			log.Info("dumping.table[%s.%s].rows[%v].bytes[%vMB].part[%v].thread[%d]", args.Database, table, allRows, (allBytes / 1024 / 1024), fileNo, conn.ID)
-			inserts = inserts[:0]
-			chunkbytes = 0
-			fileNo++
+			if err := writeChunk(chunks != nil); err != nil {
+				return nil, err
+			}
 		}
 	}
 	if chunkbytes > 0 {
-		insertone := fmt.Sprintf("INSERT INTO `%s`(%s) VALUES\n%s", table, strings.Join(fields, ","), strings.Join(rows, ",\n"))
-		inserts = append(inserts, insertone)
+		if err := writeChunk(false); err != nil {
+			return nil, err
+		}
+	}
+	c := cursor
+	cursor = nil
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
 
-		query := strings.Join(inserts, ";\n") + ";\n"
-		file := fmt.Sprintf("%s/%s.%s.%05d.sql", args.Outdir, args.Database, table, fileNo)
-		WriteFile(file, query)
+	stats.Rows = allRows
+	stats.rowBytes = allBytes
+	stats.next = []string{numbered(fileNo)}
+	return stats, nil
+}
+
+// dumpAutoIncrement reads the AUTO_INCREMENT counter of a table again once its
+// datas are dumped: the one in the schema file is older, the rows inserted
+// in the meantime may be in the dump and must not get their ids reused.
+func dumpAutoIncrement(conn *Connection, args *DumpArgs, table string) (uint64, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("show create table `%s`.`%s`", args.Database, table))
+	if err != nil {
+		return 0, err
 	}
-	err = cursor.Close()
-	AssertNil(err)
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 {
+		return 0, fmt.Errorf("dumping.table[%s.%s].auto.increment.show.create.table.has.no.row", args.Database, table)
+	}
+	return tableAutoIncrement(qr.Rows[0][1].String()), nil
+}
 
-	log.Info("dumping.table[%s.%s].done.allrows[%v].allbytes[%vMB].thread[%d]...", args.Database, table, allRows, (allBytes / 1024 / 1024), conn.ID)
+// DumpTable dumps the schema and the datas of one table of args.Database into
+// args.Outdir, with the same file layout as Dumper. The storage of args.Outdir,
+// the version of the server and the session time zone of FormatJSONL, are
+// read by the first call.
+// The caller owns conn, it is not returned to any pool.
+func DumpTable(log *xlog.Log, conn *Connection, args *DumpArgs, table string) error {
+	if args.storage == nil {
+		storage, err := OpenStorage(args.Outdir)
+		if err != nil {
+			return err
+		}
+		args.storage = withPerm(storage, args.filePerm())
+	}
+	if args.Format == FormatJSONL && args.sessionTimeZone == nil {
+		loc, err := sessionTimeZone(conn)
+		if err != nil {
+			return wrapf(err, "dumping.session.time.zone.error:%v", err)
+		}
+		args.sessionTimeZone = loc
+	}
+	if args.serverVersion == "" {
+		// Left unknown on an error, the spatial values are then written
+		// without their axis order.
+		args.serverVersion, _ = fetchServerVersion(conn)
+	}
+	schema, err := dumpTableSchema(log, conn, args, table)
+	if err != nil {
+		return err
+	}
+	_, err = dumpTable(log, conn, args, table, schema)
+	return err
 }
 
-func allTables(log *xlog.Log, conn *Connection, args *Args) []string {
+func allTables(conn *Connection, args *DumpArgs) ([]string, error) {
 	qr, err := conn.Fetch(fmt.Sprintf("show tables from `%s`", args.Database))
-	AssertNil(err)
+	if err != nil {
+		return nil, err
+	}
 
 	tables := make([]string, 0, 128)
 	for _, t := range qr.Rows {
 		tables = append(tables, t[0].String())
 	}
-	return tables
+	return tables, nil
 }
 
-func Dumper(log *xlog.Log, args *Args) {
+// dump runs a dump with the metrics of args already created, see Dumper.Run.
+// The first error of a worker stops the dispatch of the tables, the tables
+// already being dumped are waited for. A done ctx does the same and closes
+// the connections, so the tables being dumped fail at their next read.
+// The storage of Outdir, and of the Volumes, is opened unless args has one,
+// like the pipe of a copy.
+func dump(ctx context.Context, log *xlog.Log, args *DumpArgs) error {
+	if args.storage == nil {
+		storage, err := OpenStorage(args.Outdir)
+		if err != nil {
+			return err
+		}
+		perm := args.filePerm()
+		storage = withPerm(storage, perm)
+		if len(args.Volumes) > 0 {
+			volumes, err := newVolumeStorage(storage, args.Volumes)
+			if err != nil {
+				return err
+			}
+			for _, v := range volumes.volumes {
+				v.storage = withPerm(v.storage, perm)
+			}
+			storage = volumes
+			log.Info("dumping.volumes[%d]", len(args.Volumes))
+		}
+		args.storage = storage
+	}
+	if args.Clean {
+		if err := cleanTempFiles(log, args.storage); err != nil {
+			return err
+		}
+	}
+
+	// cancel stops the dump once the replica lags, see DumpArgs.LagAction,
+	// and once the grace period of the MaxRuntime is over.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limit := newRuntimeLimit(log, "dumping", args.MaxRuntime, args.MaxRuntimeGrace, cancel)
+	defer limit.close()
 	pool, err := NewPool(log, args.Threads, args.Address, args.User, args.Password)
-	AssertNil(err)
+	if err != nil {
+		return err
+	}
 	defer pool.Close()
+	defer pool.CloseOnDone(ctx)()
+
+	args.metrics.pool = pool
+	args.pool = pool
+	config := *args
+	config.Password = redacted
+	args.metrics.config = &config
+	stop, err := serveRun(log, args.metrics, args.MetricsListen, args.StatusListen, args.StatusToken)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if len(args.Partitions) > 0 {
+		conn := pool.Get()
+		err := checkPartitions(log, conn, args)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Meta data.
-	writeMetaData(args)
+	if err := writeMetaData(args); err != nil {
+		return err
+	}
+	manifest := newManifest()
+	if args.Retention > 0 {
+		expires := time.Now().Add(args.Retention).UTC().Truncate(time.Second)
+		manifest.ExpiresAt = &expires
+	}
+	if args.IncrementalFrom != "" {
+		if args.incremental, err = readIncrementalBase(args.IncrementalFrom); err != nil {
+			return err
+		}
+	}
+	// The tables of the engines the snapshots don't cover are dumped under
+	// the lock of ConsistencyLock, held until they are.
+	conn := pool.Get()
+	engines, options, err := tableCreateOptions(conn, args.Database)
+	pool.Put(conn)
+	if err != nil {
+		log.Warning("dumping.compatibility.create.options.error:%v", err)
+	}
+	only := make(map[string]bool)
+	if args.Table != "" {
+		for _, table := range strings.Split(args.Table, ",") {
+			only[table] = true
+		}
+	}
+	for table, engine := range engines {
+		if engine != "" && !snapshotEngine(engine) && (len(only) == 0 || only[table]) {
+			args.nonTransactional = true
+		}
+	}
+	if manifest.Consistency, err = startSnapshots(log, pool, args); err != nil {
+		return err
+	}
+	args.snapshot = manifest.Consistency
+	stats, err := newStatsWriter(args.storage)
+	if err != nil {
+		return err
+	}
+	defer stats.close()
 
 	// database.
-	conn := pool.Get()
-	dumpDatabaseSchema(log, conn, args)
+	phase := args.metrics.phaseStarted("schema")
+	conn = pool.Get()
+	if manifest.ServerVersion, err = fetchServerVersion(conn); err != nil {
+		log.Warning("dumping.server.version.error:%v", err)
+	} else {
+		log.Info("dumping.server.version[%s]", manifest.ServerVersion)
+		args.serverVersion = manifest.ServerVersion
+		if manifest.ServerFeatures, err = fetchServerFeatures(conn, manifest.ServerVersion); err != nil {
+			log.Warning("dumping.server.features.error:%v", err)
+		}
+	}
+	err = dumpDatabaseSchema(log, conn, args)
+	if err == nil && args.Format == FormatJSONL {
+		if args.sessionTimeZone, err = sessionTimeZone(conn); err != nil {
+			err = wrapf(err, "dumping.session.time.zone.error:%v", err)
+		} else {
+			log.Info("dumping.jsonl.time.zone[%s]", args.sessionTimeZone)
+		}
+	}
 	pool.Put(conn)
+	if err != nil {
+		return err
+	}
+	if args.Grants {
+		conn := pool.Get()
+		err := dumpGrants(log, conn, args)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+	}
+	args.metrics.phaseDone("schema", phase)
 
 	// tables.
 	var wg sync.WaitGroup
+	var errs firstError
 	var tables []string
-	t := time.Now()
+	t := args.metrics.phaseStarted("data")
+	args.metrics.threadsStarted(args.Threads)
+	stopEvents := args.metrics.collectFileEvents()
+	defer stopEvents()
 	if args.Table != "" {
 		tables = strings.Split(args.Table, ",")
 	} else {
-		tables = allTables(log, conn, args)
+		conn := pool.Get()
+		tables, err = allTables(conn, args)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
 	}
-	for _, table := range tables {
+	if args.Replay != "" {
+		conn := pool.Get()
+		err := checkReplayTables(conn, args, tables)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+	}
+	if args.incremental != nil {
 		conn := pool.Get()
-		dumpTableSchema(log, conn, args, table)
+		manifest.Incremental, tables, err = incrementalTables(log, conn, args, manifest.Consistency, tables)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeRunConfig(args, tables); err != nil {
+		return err
+	}
+	if len(args.SubsetSeeds) > 0 {
+		conn := pool.Get()
+		args.subset, err = walkSubset(log, conn, args, tables)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+		manifest.Subset = args.subset.manifest(args)
+	}
+	args.metrics.setTables(len(tables))
+	// locked are the tables dumped first, under the held lock.
+	locked := 0
+	if args.heldLock != nil {
+		tables, locked = lockedFirst(tables, engines)
+		log.Info("dumping.tables.out.of.the.snapshots[%d].under.the.lock", locked)
+	}
+
+	var resumed map[string]*checkpointTable
+	if args.Resume {
+		if resumed, err = resumeTables(log, args, tables); err != nil {
+			return err
+		}
+	}
+	var carried []*checkpointTable
+	var left []string
+	for _, table := range tables {
+		if t, ok := resumed[table]; ok {
+			carried = append(carried, t)
+		} else {
+			left = append(left, table)
+		}
+	}
+	// The tables carried from the checkpoint don't add to the bytes, the
+	// estimate of the ETA is the one of the tables left.
+	conn = pool.Get()
+	estimated, err := estimateTableBytes(conn, args.Database, left)
+	pool.Put(conn)
+	if err != nil {
+		log.Warning("dumping.estimate.error:%v", err)
+	} else {
+		args.metrics.setTotalBytes(estimated)
+		log.Info("dumping.estimated.bytes[%vMB].tables[%d]", estimated/1024/1024, len(left))
+	}
+	checkpoint, err := newCheckpointWriter(args.storage, carried)
+	if err != nil {
+		return err
+	}
+	defer checkpoint.close()
+
+	// The schemas are dumped ahead of the datas on connections of their own.
+	var ahead *schemaAhead
+	if args.SchemaThreads > 0 && len(tables) > 0 {
+		schemaPool, err := NewPool(log, args.SchemaThreads, args.Address, args.User, args.Password)
+		if err != nil {
+			return err
+		}
+		defer schemaPool.Close()
+		defer schemaPool.CloseOnDone(ctx)()
+		ahead = dumpSchemasAhead(log, schemaPool, args, tables, args.SchemaThreads)
+		defer ahead.stop()
+	}
+
+	if args.MaxReplicaLag > 0 {
+		args.lag = newLagGate()
+		args.metrics.setLagGate(args.lag)
+		stopLag, err := watchReplicaLag(ctx, log, dumpLagWatch(args), func(err error) {
+			errs.set(err)
+			cancel()
+		})
+		if err != nil {
+			return err
+		}
+		defer stopLag()
+		defer func() {
+			paused, _ := args.lag.pausedFor()
+			args.metrics.setThrottled(paused)
+		}()
+	}
+
+	stopTick := tickEvery(time.Millisecond*time.Duration(args.IntervalMs), func() {
+		dumpEvents(log).ProgressTick(args.metrics.progressStats(args.Threads, t))
+		paused, ok := args.lag.pausedFor()
+		if args.lag != nil {
+			args.metrics.setThrottled(paused)
+		}
+		if ok {
+			log.Warning("dumping.paused.by.replica.lag.cost[%.2fsec]", paused.Seconds())
+		}
+	})
+	defer stopTick()
+
+	// releaseLock releases the held lock once the tables dumped under it
+	// are, on all the connections: the one holding it is idle.
+	releaseLock := func() {
+		if !args.heldLock.held() {
+			return
+		}
+		wg.Wait()
+		conns := takeAll(pool)
+		if err := args.heldLock.release(); err != nil {
+			errs.set(err)
+		}
+		for _, conn := range conns {
+			pool.Put(conn)
+		}
+	}
+	// notAttempted are the tables left once the MaxRuntime is reached.
+	var notAttempted []string
+	for i, table := range tables {
+		if i == locked {
+			releaseLock()
+		}
+		args.lag.wait()
+		if limit.reached() {
+			notAttempted = tables[i:]
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			errs.set(err)
+		}
+		if errs.get() != nil {
+			break
+		}
+		var conn *Connection
+		var schema string
+		if ahead != nil {
+			// The schema file is written before the data connection is taken.
+			if schema, err = ahead.get(i); err == nil {
+				conn = pool.Get()
+			}
+		} else {
+			conn = pool.Get()
+			schema, err = dumpTableSchema(log, conn, args, table)
+		}
+		if err != nil {
+			if conn != nil {
+				pool.Put(conn)
+			}
+			errs.set(err)
+			break
+		}
+		manifest.addTable(args.Database, table, schema)
+		manifest.setPartitions(args.Database, table, args.tablePartitions(table))
+		// The tablespace options stripped from the schema file don't
+		// restore, they can't fail.
+		compat := schema
+		if !args.KeepTablespaceOptions {
+			compat, _ = stripTablespaceOptions(schema)
+		}
+		if reasons := compatibilityReasons(compat, engines[table], options[table]); len(reasons) > 0 {
+			for _, reason := range reasons {
+				log.Warning("dumping.compatibility.table[%s.%s]:%s", args.Database, table, reason)
+			}
+			manifest.addCompatibility(args.Database, table, reasons)
+		}
+		if t, ok := resumed[table]; ok {
+			pool.Put(conn)
+			if err := resumeTable(log, args, manifest, stats, t); err != nil {
+				errs.set(err)
+				break
+			}
+			continue
+		}
 
 		wg.Add(1)
-		go func(conn *Connection, table string) {
+		go func(conn *Connection, table string, schema string) {
+			args.metrics.workerStarted()
+			args.metrics.startWork(conn.ID, args.Database+"."+table, "")
 			defer func() {
+				args.metrics.endWork(conn.ID)
+				args.metrics.workerDone()
 				wg.Done()
 				pool.Put(conn)
 			}()
-			log.Info("dumping.table[%s.%s].datas.thread[%d]...", args.Database, table, conn.ID)
-			dumpTable(log, conn, args, table)
-			log.Info("dumping.table[%s.%s].datas.thread[%d].done...", args.Database, table, conn.ID)
-		}(conn, table)
-	}
-
-	tick := time.NewTicker(time.Millisecond * time.Duration(args.IntervalMs))
-	defer tick.Stop()
-	go func() {
-		for range tick.C {
-			diff := time.Since(t).Seconds()
-			allbytesMB := float64(atomic.LoadUint64(&args.Allbytes) / 1024 / 1024)
-			allrows := atomic.LoadUint64(&args.Allrows)
-			rates := allbytesMB / diff
-			log.Info("dumping.allbytes[%vMB].allrows[%v].time[%.2fsec].rates[%.2fMB/sec]...", allbytesMB, allrows, diff, rates)
-		}
-	}()
+			dumpEvents(log).TableStarted(args.Database, table, conn.ID)
+			// fail fails the dump, but for the errors of a connection closed at
+			// the end of the grace period of the MaxRuntime: the table is left
+			// out of the checkpoint, a resume dumps it again.
+			fail := func(err error) {
+				if limit.interrupted() {
+					log.Warning("dumping.table[%s.%s].interrupted.by.max.runtime:%v", args.Database, table, err)
+					return
+				}
+				errs.set(err)
+			}
+			ts, err := dumpTable(log, conn, args, table, schema)
+			if err != nil {
+				fail(wrapf(err, "dumping.table[%s.%s].error:%v", args.Database, table, err))
+				return
+			}
+			// failed is why the table is marked failed in the manifest, it's
+			// left out of the checkpoint so a resume dumps it again.
+			var failed string
+			if schema, ts, failed, err = redumpChangedSchema(log, conn, args, table, schema, ts); err != nil {
+				fail(wrapf(err, "dumping.table[%s.%s].error:%v", args.Database, table, err))
+				return
+			}
+			// The labels of ChunkBy are not numbered, the stale ones can't be
+			// told apart.
+			if args.Resume && args.tableChunkBy(table).Column == "" {
+				if err := checkStaleChunk(args, table, ts.next); err != nil {
+					fail(err)
+					return
+				}
+			}
+			ts.Engine = tableEngine(schema)
+			cp := &checkpointTable{Database: args.Database, Table: table, Format: args.formatName(), ChunkBy: args.tableChunkBy(table).String(), ChunkKey: ts.chunkKey, Chunks: ts.chunks, Stats: ts, Checksummed: args.Checksum}
+			cp.Consistency = tableConsistency(args, ts.Engine)
+			manifest.setConsistency(args.Database, table, cp.Consistency)
+			args.metrics.tableConsistency(cp.Consistency)
+			if err := stats.write(args.Database, table, ts); err != nil {
+				fail(err)
+				return
+			}
+			manifest.setStats(args.Database, table, ts, args.wholeTable(table))
+			if failed != "" {
+				log.Error("dumping.table[%s.%s].failed:%s", args.Database, table, failed)
+				manifest.setFailed(args.Database, table, failed)
+			}
+			if cp.ChunkBy != "" {
+				manifest.setChunks(args.Database, table, cp.ChunkBy, ts.chunks)
+			} else if cp.ChunkKey != "" {
+				manifest.setChunkKey(args.Database, table, cp.ChunkKey, ts.chunks)
+			}
+			if strings.Contains(schema, "AUTO_INCREMENT") {
+				n, err := dumpAutoIncrement(conn, args, table)
+				if err != nil {
+					fail(err)
+					return
+				}
+				manifest.setAutoIncrement(args.Database, table, n)
+				cp.AutoIncrement = n
+			}
+			if args.Checksum && len(args.tablePartitions(table)) == 0 {
+				sum, ok, err := tableChecksum(conn, args.Database, table)
+				if err != nil {
+					fail(err)
+					return
+				}
+				if ok {
+					manifest.setChecksum(args.Database, table, sum)
+					cp.Checksum = &sum
+				}
+			}
+			if args.Paranoid {
+				if !snapshotEngine(ts.Engine) {
+					log.Warning("dumping.table[%s.%s].engine[%s].not.in.the.snapshot.paranoid.check.skipped", args.Database, table, ts.Engine)
+				} else {
+					check, err := ts.paranoid.check(conn, args, table)
+					if err != nil {
+						fail(err)
+						return
+					}
+					manifest.setParanoid(args.Database, table, check)
+					cp.Paranoid = check
+					if !check.Match {
+						fail(fmt.Errorf("dumping.table[%s.%s].paranoid.check.failed:chunks[%d].rows[%d].sum[%d].table.rows[%d].sum[%d]", args.Database, table, check.Chunks, check.ChunkRows, check.ChunkSum, check.TableRows, check.TableSum))
+						return
+					}
+				}
+			}
+			if failed == "" {
+				if err := checkpoint.write(cp); err != nil {
+					fail(err)
+					return
+				}
+			}
+			args.metrics.tableDone()
+		}(conn, table, schema)
+	}
 
+	releaseLock()
 	wg.Wait()
-	elapsed := time.Since(t).Seconds()
-	log.Info("dumping.all.done.cost[%.2fsec].allrows[%v].allbytes[%v].rate[%.2fMB/s]", elapsed, args.Allrows, args.Allbytes, (float64(args.Allbytes/1024/1024) / elapsed))
+	args.metrics.threadsDone()
+	volumes, _ := args.storage.(*volumeStorage)
+	if err := errs.get(); err != nil {
+		if volumes != nil {
+			conn := pool.Get()
+			full := volumes.fullError(log, conn, args.Database, checkpoint.pending(tables))
+			pool.Put(conn)
+			if full != nil {
+				return full
+			}
+		}
+		return err
+	}
+	var partial *PartialError
+	if pending := checkpoint.pending(tables); len(pending) > 0 && limit.reached() {
+		partial = &PartialError{Mode: "dump", MaxRuntime: args.MaxRuntime}
+		left := make(map[string]bool)
+		for _, table := range notAttempted {
+			left[table] = true
+		}
+		for _, table := range pending {
+			name := args.Database + "." + table
+			if left[table] {
+				partial.NotAttempted = append(partial.NotAttempted, name)
+			} else {
+				partial.Interrupted = append(partial.Interrupted, name)
+			}
+			manifest.NotDumped = append(manifest.NotDumped, name)
+		}
+	}
+	if partial == nil {
+		args.metrics.phaseDone("data", t)
+	}
+	manifest.Progress = args.metrics.progressStats(args.Threads, t).dumpProgress()
+	logDumpProgress(log, manifest.Progress)
+	args.metrics.phaseStarted("done")
+	if volumes != nil {
+		dumped := make(map[string]bool)
+		for _, table := range tables {
+			dumped[table] = true
+		}
+		manifest.VolumeFiles = volumes.volumeFiles(func(name string) bool {
+			db, table := dataFileTable(name)
+			return db == args.Database && dumped[table]
+		})
+	}
+	if err := manifest.write(args.storage); err != nil {
+		return err
+	}
+	if err := writeCompatibilityReport(args.storage, manifest.Compatibility); err != nil {
+		return err
+	}
+	// A failed table is left out of the checkpoint, a resume dumps it again.
+	if failed := manifest.failedTables(); len(failed) > 0 {
+		return fmt.Errorf("dumping.tables[%s].failed:see.the.failed.of.%s,a.resume.dumps.them.again", strings.Join(failed, ","), manifestFile)
+	}
+	if partial != nil {
+		return partial
+	}
+	return nil
 }
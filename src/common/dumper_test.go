@@ -10,6 +10,8 @@
 package common
 
 import (
+	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -113,7 +115,7 @@ func TestDumper(t *testing.T) {
 		fakedbs.AddQueryPattern("select .*", selectResult)
 	}
 
-	args := &Args{
+	args := &DumpArgs{
 		Database:      "test",
 		Outdir:        "/tmp/dumpertest",
 		User:          "mock",
@@ -132,11 +134,320 @@ func TestDumper(t *testing.T) {
 	}
 
 	// Dumper.
-	{
-		Dumper(log, args)
-	}
+	report, err := NewDumper(DumpConfig{DumpArgs: *args, Log: log}).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, RunOK, report.Status)
 	dat, err := ioutil.ReadFile(args.Outdir + "/test.t1.00001.sql")
 	assert.Nil(t, err)
 	want := strings.Contains(string(dat), `(11,"11\"xx\"","",NULL,210.01,NULL)`)
 	assert.True(t, want)
+
+	// Stats.
+	{
+		dat, err := ioutil.ReadFile(args.Outdir + "/" + statsFile)
+		assert.Nil(t, err)
+		lines := strings.Split(strings.TrimSpace(string(dat)), "\n")
+		assert.Equal(t, 3, len(lines))
+		assert.Equal(t, strings.TrimSpace(statsHeader), lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "test\tt"))
+
+		m, err := readManifest(NewDirStorage(args.Outdir))
+		assert.Nil(t, err)
+		assert.Equal(t, "InnoDB", m.Tables[0].Stats.Engine)
+		assert.Equal(t, report.Rows/2, m.Tables[0].Stats.Rows)
+		// No snapshot without -consistency.
+		assert.Equal(t, TableNoSnapshot, m.Tables[0].Consistency)
+		assert.Equal(t, uint64(2), report.TablesWithoutSnapshot)
+	}
+}
+
+func TestDumperDumpTable(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "a",
+				Type: querypb.Type_INT32,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")),
+			},
+		}}
+
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Create Table",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`a` int(11) DEFAULT NULL) ENGINE=InnoDB")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQuery("show create table `test`.`t1`", schemaResult)
+		fakedbs.AddQueryError("show create table `test`.`t2`", errors.New("mock.no.such.table"))
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	pool, err := NewPool(log, 1, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	args := &DumpArgs{
+		Database:      "test",
+		Outdir:        "/tmp/dumptabletest",
+		ChunksizeInMB: 1,
+		StmtSize:      10000,
+	}
+	os.RemoveAll(args.Outdir)
+	x := os.MkdirAll(args.Outdir, 0777)
+	AssertNil(x)
+
+	// Ok.
+	{
+		err := DumpTable(log, conn, args, "t1")
+		assert.Nil(t, err)
+		dat, err := ioutil.ReadFile(args.Outdir + "/test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT INTO `t1`(`a`) VALUES\n(1);\n", string(dat))
+		_, err = os.Stat(args.Outdir + "/test.t1-schema.sql")
+		assert.Nil(t, err)
+	}
+
+	// CSV.
+	{
+		csv := *args
+		csv.Format = FormatCSV
+		err := DumpTable(log, conn, &csv, "t1")
+		assert.Nil(t, err)
+		dat, err := ioutil.ReadFile(args.Outdir + "/test.t1.00001.csv")
+		assert.Nil(t, err)
+		assert.Equal(t, "\"a\"\n1\n", string(dat))
+	}
+
+	// JSON Lines, with the columns.
+	{
+		fakedbs.AddQuery("select @@session.time_zone, timestampdiff(second, utc_timestamp(), now())", &sqltypes.Result{
+			Fields: []*querypb.Field{{Name: "tz", Type: querypb.Type_VARCHAR}, {Name: "offset", Type: querypb.Type_INT64}},
+			Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("+00:00")), sqltypes.MakeTrusted(querypb.Type_INT64, []byte("0"))}},
+		})
+		jsonl := *args
+		jsonl.Format = FormatJSONL
+		err := DumpTable(log, conn, &jsonl, "t1")
+		assert.Nil(t, err)
+		dat, err := ioutil.ReadFile(args.Outdir + "/test.t1.00001.jsonl")
+		assert.Nil(t, err)
+		assert.Equal(t, "{\"a\":1}\n", string(dat))
+		_, err = os.Stat(args.Outdir + "/test.t1-columns.json")
+		assert.Nil(t, err)
+	}
+
+	// Error.
+	{
+		err := DumpTable(log, conn, args, "t2")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestDumperResume(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "a",
+				Type: querypb.Type_INT32,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")),
+			},
+		}}
+
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Create Table",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`a` int(11) DEFAULT NULL) ENGINE=InnoDB")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	args := &DumpArgs{
+		Database:      "test",
+		Table:         "t1,t2",
+		Outdir:        "/tmp/dumperresumetest",
+		User:          "mock",
+		Password:      "mock",
+		Address:       address,
+		ChunksizeInMB: 1,
+		Threads:       2,
+		StmtSize:      10000,
+		IntervalMs:    500,
+	}
+	os.RemoveAll(args.Outdir)
+	x := os.MkdirAll(args.Outdir, 0777)
+	AssertNil(x)
+
+	_, err = NewDumper(DumpConfig{DumpArgs: *args, Log: log}).Run(context.Background())
+	assert.Nil(t, err)
+
+	// t2 damaged, t1 resumed as it is.
+	{
+		assert.Nil(t, ioutil.WriteFile(args.Outdir+"/test.t1.00001.sql", []byte("INSERT INTO `t1`(`a`) VALUES\n(1);\n"), 0644))
+		assert.Nil(t, ioutil.WriteFile(args.Outdir+"/test.t2.00001.sql", []byte("INSERT"), 0644))
+		resume := *args
+		resume.Resume = true
+		_, err := NewDumper(DumpConfig{DumpArgs: resume, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+
+		dat, err := ioutil.ReadFile(args.Outdir + "/test.t2.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT INTO `t2`(`a`) VALUES\n(1);\n", string(dat))
+		m, err := readManifest(NewDirStorage(args.Outdir))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(m.Tables))
+		assert.Equal(t, uint64(1), m.Tables[0].Stats.Rows)
+		assert.Equal(t, uint64(1), m.Tables[1].Stats.Rows)
+	}
+
+	// A stale chunk of the interrupted dump.
+	{
+		assert.Nil(t, ioutil.WriteFile(args.Outdir+"/test.t2.00001.sql", []byte("INSERT"), 0644))
+		assert.Nil(t, ioutil.WriteFile(args.Outdir+"/test.t2.00002.sql", []byte("INSERT"), 0644))
+		resume := *args
+		resume.Resume = true
+		_, err := NewDumper(DumpConfig{DumpArgs: resume, Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+	}
+}
+
+func TestDumperVolumes(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "a",
+				Type: querypb.Type_INT32,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")),
+			},
+		}}
+
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Create Table",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`a` int(11) DEFAULT NULL) ENGINE=InnoDB")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show create table .*", schemaResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+	}
+
+	dir := "/tmp/dumpervolumestest"
+	os.RemoveAll(dir)
+	for _, sub := range []string{"main", "v1", "v2"} {
+		x := os.MkdirAll(dir+"/"+sub, 0777)
+		AssertNil(x)
+	}
+	// Every data file is 34 bytes.
+	args := &DumpArgs{
+		Database:      "test",
+		Table:         "t1,t2",
+		Outdir:        dir + "/main",
+		Volumes:       []Volume{{Path: dir + "/v1", Budget: 40}, {Path: dir + "/v2", Budget: 40}},
+		User:          "mock",
+		Password:      "mock",
+		Address:       address,
+		ChunksizeInMB: 1,
+		Threads:       1,
+		StmtSize:      10000,
+		IntervalMs:    500,
+	}
+
+	// One file on each volume, recorded in the manifest.
+	{
+		_, err := NewDumper(DumpConfig{DumpArgs: *args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+		m, err := readManifest(NewDirStorage(args.Outdir))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(m.VolumeFiles))
+		assert.NotEqual(t, m.VolumeFiles["test.t1.00001.sql"], m.VolumeFiles["test.t2.00001.sql"])
+		assert.Nil(t, Verify(log, args.Outdir))
+	}
+
+	// No room for t3.
+	{
+		full := *args
+		full.Table = "t1,t2,t3"
+		_, err := NewDumper(DumpConfig{DumpArgs: full, Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "dumping.volumes.full: the data file test.t3.00001.sql (34B) has room on no volume"))
+	}
 }
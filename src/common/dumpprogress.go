@@ -0,0 +1,135 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// progressStats are the figures of a progress tick, from the Metrics of the
+// run, see Metrics.progressStats.
+type progressStats struct {
+	bytes   uint64
+	rows    uint64
+	elapsed float64
+	// tablesDone and tables are the finished tables of the run and all of
+	// them.
+	tablesDone uint64
+	tables     uint64
+	// active are the workers busy on a table or a file, of threads.
+	active  int64
+	threads int
+	// estimated are the bytes the run is expected to write or restore, 0 if
+	// they are unknown.
+	estimated uint64
+	// files are the progress of the largest files a load is restoring, see
+	// largeFiles.
+	files []string
+}
+
+// progressStats returns the progress of the run of threads, with the elapsed
+// time since start, the start of its data phase.
+func (m *Metrics) progressStats(threads int, start time.Time) progressStats {
+	s := progressStats{elapsed: time.Since(start).Seconds(), threads: threads}
+	if m == nil {
+		return s
+	}
+	s.bytes = m.bytesDone()
+	s.rows = m.rowsDone()
+	s.tablesDone = atomic.LoadUint64(&m.tablesDone)
+	s.tables = atomic.LoadUint64(&m.tables)
+	s.active = atomic.LoadInt64(&m.workers)
+	s.estimated = atomic.LoadUint64(&m.totalBytes)
+	s.files = m.largeFiles()
+	return s
+}
+
+// eta returns the seconds left, the estimated bytes left at the rate so far,
+// or the tables left without an estimate, false until there is a rate.
+func (s progressStats) eta() (float64, bool) {
+	percent, ok := progressPercent(s.bytes, s.estimated, s.tablesDone, s.tables)
+	if !ok || percent <= 0 {
+		return 0, false
+	}
+	return s.elapsed * (100 - percent) / percent, true
+}
+
+// rates returns the MB and the rows a second so far.
+func (s progressStats) rates() (float64, float64) {
+	if s.elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(s.bytes/1024/1024) / s.elapsed, float64(s.rows) / s.elapsed
+}
+
+// DumpProgress are the totals of the data phase of a dump, in its manifest,
+// the same as its final progress line.
+type DumpProgress struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	Bytes          uint64  `json:"bytes"`
+	Rows           uint64  `json:"rows"`
+	TablesDone     uint64  `json:"tables_done"`
+	TablesTotal    uint64  `json:"tables_total"`
+	RateMBPerSec   float64 `json:"rate_mb_per_sec"`
+	RowsPerSec     float64 `json:"rows_per_sec"`
+	// EstimatedBytes are the DATA_LENGTH of the tables dumped the ETA of the
+	// ticks was estimated from, none if it was unknown.
+	EstimatedBytes uint64 `json:"estimated_bytes,omitempty"`
+}
+
+// dumpProgress returns the DumpProgress of the stats at the end of a dump.
+func (s progressStats) dumpProgress() *DumpProgress {
+	mbs, rows := s.rates()
+	return &DumpProgress{
+		ElapsedSeconds: s.elapsed,
+		Bytes:          s.bytes,
+		Rows:           s.rows,
+		TablesDone:     s.tablesDone,
+		TablesTotal:    s.tables,
+		RateMBPerSec:   mbs,
+		RowsPerSec:     rows,
+		EstimatedBytes: s.estimated,
+	}
+}
+
+// logDumpProgress logs the final progress line of a dump.
+func logDumpProgress(log *xlog.Log, p *DumpProgress) {
+	logSummary(log, "dumping.progress.tables[%d/%d].allbytes[%vMB].allrows[%v].time[%.2fsec].rates[%.2fMB/sec].rows[%.0f/sec].estimated[%vMB]",
+		p.TablesDone, p.TablesTotal, p.Bytes/1024/1024, p.Rows, p.ElapsedSeconds, p.RateMBPerSec, p.RowsPerSec, p.EstimatedBytes/1024/1024)
+}
+
+// estimateTableBytes returns the DATA_LENGTH of the tables of the database db
+// from information_schema, the estimate of the bytes a dump of them writes.
+// The statistics of InnoDB are approximate, and the size of the rows on disk
+// isn't the one of the statements, it's only good for an ETA.
+func estimateTableBytes(conn *Connection, db string, tables []string) (uint64, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT TABLE_NAME, DATA_LENGTH FROM information_schema.TABLES WHERE TABLE_SCHEMA='%s'", EscapeBytes([]byte(db))))
+	if err != nil {
+		return 0, err
+	}
+	lengths := make(map[string]uint64)
+	for _, row := range qr.Rows {
+		if len(row) < 2 {
+			continue
+		}
+		n, _ := strconv.ParseUint(row[1].String(), 10, 64)
+		lengths[row[0].String()] = n
+	}
+	var total uint64
+	for _, table := range tables {
+		total += lengths[table]
+	}
+	return total, nil
+}
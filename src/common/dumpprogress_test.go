@@ -0,0 +1,125 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressStats(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	var allbytes, allrows uint64
+	m := newMetrics(log, "dump", nil, &allbytes, &allrows)
+	m.setTables(4)
+	m.tableDone()
+	m.workerStarted()
+	m.addProgress(1, 10*1024*1024, 1000)
+
+	s := m.progressStats(8, time.Now().Add(-10*time.Second))
+	assert.Equal(t, uint64(10*1024*1024), s.bytes)
+	assert.Equal(t, uint64(1000), s.rows)
+	assert.Equal(t, uint64(1), s.tablesDone)
+	assert.Equal(t, uint64(4), s.tables)
+	assert.Equal(t, int64(1), s.active)
+	assert.Equal(t, 8, s.threads)
+	mbs, rows := s.rates()
+	assert.True(t, math.Abs(1-mbs) < 0.01)
+	assert.True(t, math.Abs(100-rows) < 1)
+
+	// Without an estimate, the ETA is the one of the tables left.
+	{
+		eta, ok := s.eta()
+		assert.True(t, ok)
+		assert.True(t, math.Abs(30-eta) < 0.5)
+	}
+
+	// With one, the one of the bytes left.
+	{
+		m.setTotalBytes(40 * 1024 * 1024)
+		s := m.progressStats(8, time.Now().Add(-10*time.Second))
+		eta, ok := s.eta()
+		assert.True(t, ok)
+		assert.True(t, math.Abs(30-eta) < 0.5)
+		assert.Equal(t, &DumpProgress{
+			ElapsedSeconds: s.elapsed,
+			Bytes:          10 * 1024 * 1024,
+			Rows:           1000,
+			TablesDone:     1,
+			TablesTotal:    4,
+			RateMBPerSec:   10 / s.elapsed,
+			RowsPerSec:     1000 / s.elapsed,
+			EstimatedBytes: 40 * 1024 * 1024,
+		}, s.dumpProgress())
+	}
+
+	// Nothing done yet, and no metrics.
+	{
+		_, ok := progressStats{tables: 4, elapsed: 1}.eta()
+		assert.False(t, ok)
+		var none *Metrics
+		s := none.progressStats(2, time.Now())
+		_, ok = s.eta()
+		assert.False(t, ok)
+		assert.Equal(t, 2, s.threads)
+	}
+}
+
+func TestDumpProgressTick(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "info", "text")
+	assert.Nil(t, err)
+	s := progressStats{bytes: 20 * 1024 * 1024, rows: 200, elapsed: 2, tablesDone: 1, tables: 2, active: 3, threads: 4}
+	dumpEvents(log).ProgressTick(s)
+	s.tablesDone = 0
+	dumpEvents(log).ProgressTick(s)
+	loadEvents(log).ProgressTick(s)
+	logDumpProgress(log, progressStats{bytes: 20 * 1024 * 1024, rows: 200, elapsed: 2, tablesDone: 2, tables: 2, estimated: 30 * 1024 * 1024}.dumpProgress())
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.Contains(t, lines[0], "dumping.allbytes[20MB].allrows[200].time[2.00sec].rates[10.00MB/sec].rows[100/sec].tables[1/2].threads[3/4].eta[2sec]...")
+	assert.Contains(t, lines[1], ".tables[0/2].threads[3/4].eta[unknown]...")
+	assert.Contains(t, lines[2], "restoring.allbytes[20MB].time[2.00sec].rates[10.00MB/sec]...")
+	assert.Contains(t, lines[3], "dumping.progress.tables[2/2].allbytes[20MB].allrows[200].time[2.00sec].rates[10.00MB/sec].rows[100/sec].estimated[30MB]")
+}
+
+func TestEstimateTableBytes(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	rec := &recordingExecutor{results: map[string]*sqltypes.Result{"SELECT TABLE_NAME, DATA_LENGTH FROM information_schema.TABLES WHERE TABLE_SCHEMA='shop'": {
+		Fields: []*querypb.Field{{Name: "TABLE_NAME", Type: querypb.Type_VARCHAR}, {Name: "DATA_LENGTH", Type: querypb.Type_UINT64}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("users")), sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("16384"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("orders")), sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("1048576"))},
+			// A view has no DATA_LENGTH.
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("v1")), sqltypes.NULL},
+		},
+	}}}
+	pool, err := NewExecutorPool(log, 1, rec.executor)
+	AssertNil(err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	n, err := estimateTableBytes(conn, "shop", []string{"users", "orders", "v1", "gone"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(16384+1048576), n)
+	n, err = estimateTableBytes(conn, "shop", []string{"users"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(16384), n)
+}
@@ -0,0 +1,132 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// maxEmptyFileBytes is the largest data file read before the restore to tell
+// whether it has any row, a header is a few comments and SETs.
+const maxEmptyFileBytes = 64 * 1024
+
+// The kinds of the data files without any row, see emptyFileKind.
+const (
+	// emptyTableMarker is a file of only a header: comments and session
+	// statements, the way other dumpers write an empty table.
+	emptyTableMarker = "empty.table.marker"
+	// noStatements is a file of nothing at all, zero bytes or blanks.
+	noStatements = "no.statements"
+)
+
+// headerStatement reports whether the statement of a data file is of its
+// header: a comment, a versioned one like /*!40101 SET NAMES binary*/ too, or
+// a SET of the session.
+func headerStatement(sql string) bool {
+	if strings.HasPrefix(sql, "/*") || strings.HasPrefix(sql, "--") || strings.HasPrefix(sql, "#") {
+		return true
+	}
+	fields := strings.Fields(sql)
+	return len(fields) > 0 && strings.EqualFold(fields[0], "SET")
+}
+
+// emptyFileKind returns the kind of a data file without any row, empty if
+// it has some.
+func emptyFileKind(data []byte) string {
+	stmts := splitStatements(string(data))
+	if len(stmts) == 0 {
+		return noStatements
+	}
+	for _, stmt := range stmts {
+		if !headerStatement(stmt.sql) {
+			return ""
+		}
+	}
+	return emptyTableMarker
+}
+
+// manifestRows returns the rows of the tables of manifest.json by
+// 'db.table', nil without one.
+func manifestRows(s Storage) map[string]uint64 {
+	m, err := readManifest(s)
+	if err != nil {
+		return nil
+	}
+	rows := make(map[string]uint64)
+	for _, t := range m.Tables {
+		if t.Stats != nil {
+			rows[t.Database+"."+t.Table] = t.Stats.Rows
+		}
+	}
+	return rows
+}
+
+// filterEmptyFiles takes the data files without any row out of the files,
+// so they take no thread of the restore: the ones of only a header are the
+// markers of an empty table, the ones of no statement at all are logged
+// apart. Either is suspicious if manifest.json counts rows for its table, a
+// copy of the dump may have cut it: they are in the Report and fail the load
+// before any data is restored. The named pipes are left alone, reading one
+// consumes it.
+func filterEmptyFiles(log *xlog.Log, args *LoadArgs, s Storage, files *Files) error {
+	rows := manifestRows(s)
+	var datas, suspicious []string
+	for _, table := range files.tables {
+		info, err := s.Stat(table)
+		if err != nil || isPipe(info) || info.Size() > maxEmptyFileBytes {
+			datas = append(datas, table)
+			continue
+		}
+		// A file which can't be read fails its restore with the error.
+		data, err := readFile(s, table)
+		if err != nil {
+			datas = append(datas, table)
+			continue
+		}
+		kind := emptyFileKind(data)
+		if kind == "" {
+			datas = append(datas, table)
+			continue
+		}
+		db, tbl, _ := parseTableFile(table)
+		if n := rows[db+"."+tbl]; n > 0 {
+			log.Warning("restoring.file[%s].%s.SUSPICIOUS:the.manifest.counts.rows[%d].of.table[%s.%s].the.file.may.be.truncated", table, kind, n, db, tbl)
+			args.metrics.emptyFile(table, kind, true)
+			suspicious = append(suspicious, table)
+			continue
+		}
+		if kind == emptyTableMarker {
+			log.Info("restoring.file[%s].empty.table.marker.of.table[%s.%s].skipped", table, db, tbl)
+		} else {
+			log.Warning("restoring.file[%s].no.statements.skipped", table)
+		}
+		args.metrics.emptyFile(table, kind, false)
+	}
+	files.tables = datas
+	if len(suspicious) > 0 {
+		return fmt.Errorf("restoring.suspicious.files[%s]:the.manifest.counts.rows.of.their.tables.the.dump.may.be.truncated.check.it", strings.Join(suspicious, ","))
+	}
+	return nil
+}
+
+// logEmptyFilesSummary logs the summary line of the data files of a load
+// without any row, and the suspicious ones by name.
+func logEmptyFilesSummary(log *xlog.Log, action string, r Report) {
+	if r.EmptyTableMarkers+r.EmptyFiles == 0 && len(r.SuspiciousFiles) == 0 {
+		return
+	}
+	logSummary(log, "%s.empty.files.markers[%d].no.statements[%d].suspicious[%d]", action, r.EmptyTableMarkers, r.EmptyFiles, len(r.SuspiciousFiles))
+	if len(r.SuspiciousFiles) > 0 {
+		logSummary(log, "%s.suspicious.files[%s]:the.manifest.counts.rows.of.their.tables", action, strings.Join(r.SuspiciousFiles, ","))
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmptyFileKind(t *testing.T) {
+	tests := []struct {
+		data string
+		kind string
+	}{
+		{"", noStatements},
+		{"\n  \n", noStatements},
+		{"/*!40101 SET NAMES binary*/;\n", emptyTableMarker},
+		{"-- empty table\n/*!40014 SET FOREIGN_KEY_CHECKS=0*/;\nSET time_zone='+00:00';\n", emptyTableMarker},
+		{"/*!40101 SET NAMES binary*/;\nINSERT INTO `t1` VALUES (1);\n", ""},
+		{"INSERT INTO `t1` VALUES (1);\n", ""},
+		{"settle_accounts;\n", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.kind, emptyFileKind([]byte(test.data)), test.data)
+	}
+}
+
+func TestEmptyTableMarker(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	conn := &Connection{ID: 1}
+	s := NewMemStorage()
+
+	// The first data file of the table, of only a header.
+	{
+		args := &DumpArgs{Database: "test", storage: s}
+		stats := &TableStats{next: []string{"00001"}}
+		assert.Nil(t, writeEmptyMarker(log, conn, args, "t1", stats))
+		data, err := readFile(s, "test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, emptyTableMarker, emptyFileKind(data))
+		assert.Equal(t, 1, stats.Files)
+		assert.Equal(t, "test.t1.00001.sql", stats.chunks[0].Name)
+		assert.Equal(t, []string{"00002"}, stats.next)
+	}
+
+	// The first file of the first key range, with its trailer.
+	{
+		args := &DumpArgs{Database: "test", storage: s, FileTrailers: true}
+		stats := &TableStats{next: []string{"00001.00001", "00002.00001", "00003.00001"}}
+		assert.Nil(t, writeEmptyMarker(log, conn, args, "t2", stats))
+		data, err := readFile(s, "test.t2.00001.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, emptyTableMarker, emptyFileKind(data))
+		assert.Nil(t, verifyFileTrailer("test.t2.00001.00001.sql", string(data)))
+		assert.Equal(t, []string{"00001.00002", "00002.00001", "00003.00001"}, stats.next)
+	}
+}
+
+func TestLoaderEmptyFiles(t *testing.T) {
+	dir := "/tmp/loaderemptyfiles"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (`a` int) ENGINE=InnoDB;\n",
+		"test.t2.00001.sql":      "/*!40101 SET NAMES binary*/;\n/*!40014 SET FOREIGN_KEY_CHECKS=0*/;\n",
+		"test.t3-schema.sql":     "CREATE TABLE `t3` (`a` int) ENGINE=InnoDB;\n",
+		"test.t3.00001.sql":      "",
+		"test.t4-schema.sql":     "CREATE TABLE `t4` (`a` int) ENGINE=InnoDB;\n",
+		"test.t4.00001.sql":      "INSERT INTO `t4` VALUES (1);\n",
+		"test.t4.00002.sql":      "",
+		"manifest.json":          `{"version":"1.0.0","tables":[{"database":"test","table":"t1","stats":{"rows":1,"files":1}},{"database":"test","table":"t2","stats":{"rows":0},"empty":true},{"database":"test","table":"t4","stats":{"rows":2,"files":2}}]}`,
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500}
+
+	// The empty file of t4, whose table has rows in the manifest, is
+	// suspicious: the load fails before any data is restored.
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	{
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Equal(t, "restoring.suspicious.files[test.t4.00002.sql]:the.manifest.counts.rows.of.their.tables.the.dump.may.be.truncated.check.it", err.Error())
+		assert.Equal(t, RunFailed, report.Status)
+		assert.Equal(t, []string{"test.t4.00002.sql"}, report.SuspiciousFiles)
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "INSERT")))
+		LogReport(log, report)
+	}
+
+	// The files without rows take no thread: the header only one is the
+	// marker of an empty table, the empty file of t3 has no rows in the
+	// manifest.
+	{
+		x := os.Remove(dir + "/test.t4.00002.sql")
+		AssertNil(x)
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(2), report.FilesTotal)
+		assert.Equal(t, uint64(2), report.FilesDone)
+		assert.Equal(t, uint64(1), report.EmptyTableMarkers)
+		assert.Equal(t, uint64(1), report.EmptyFiles)
+		assert.Nil(t, report.SuspiciousFiles)
+		assert.Equal(t, 2, len(matchingQueries(rec.queries, "INSERT")))
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "SET FOREIGN_KEY_CHECKS")))
+		assert.Equal(t, 4, len(matchingQueries(rec.queries, "CREATE TABLE")))
+		LogReport(log, report)
+	}
+}
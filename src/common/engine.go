@@ -0,0 +1,184 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// engineOptionRegexp matches the ENGINE [=] name option of a table or of
+	// a partition.
+	engineOptionRegexp = regexp.MustCompile(`(?i)\bENGINE(?:\s*=\s*|\s+)(\w+)`)
+	// engineNameRegexp matches a storage engine name of LoadArgs.ForceEngine.
+	engineNameRegexp = regexp.MustCompile(`^\w+$`)
+	// partitionByRegexp matches the PARTITION BY starting the partition
+	// options, after the table options.
+	partitionByRegexp = regexp.MustCompile(`(?i)^PARTITION\s+BY\b`)
+	// optionsEndRegexp matches the end of the table options before the
+	// partition options: the spaces and the /*!50100 comment the dumps wrap
+	// them in.
+	optionsEndRegexp = regexp.MustCompile(`\s*(?:/\*!\d*\s*)?$`)
+	// fixedRowFormatRegexp matches the ROW_FORMAT=FIXED of MyISAM.
+	fixedRowFormatRegexp = regexp.MustCompile(`(?i)\bROW_FORMAT\s*=\s*FIXED\b`)
+	// foreignKeyRegexp matches a FOREIGN KEY definition.
+	foreignKeyRegexp = regexp.MustCompile("(?i)^(?:CONSTRAINT\\s+(`(?:[^`]|``)*`\\s+)?)?FOREIGN\\s+KEY\\b")
+	// blobTypeRegexp matches the BLOB and TEXT types of a column definition.
+	blobTypeRegexp = regexp.MustCompile(`(?i)^\s*(?:TINY|MEDIUM|LONG)?(?:BLOB|TEXT)\b`)
+)
+
+// definitionsEnd returns the index of the parenthesis closing the columns and
+// indexes of a create table statement, -1 if it has none.
+func definitionsEnd(schema string) int {
+	depth := 0
+	for i := 0; i < len(schema); {
+		switch schema[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(schema, i)
+			continue
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+		i++
+	}
+	return -1
+}
+
+// partitionStart returns the index of the PARTITION BY of the table options
+// options outside the quoted strings, len(options) if it has none.
+func partitionStart(options string) int {
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(options, i)
+			continue
+		}
+		if (i == 0 || !isWordByte(options[i-1])) && partitionByRegexp.MatchString(options[i:]) {
+			return i
+		}
+		i++
+	}
+	return len(options)
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// forceEngine rewrites the ENGINE of the CREATE TABLE statement query, and
+// of its partitions, into engine, a table without one gets it. It returns the
+// engine replaced, empty if the table had none, and warnings about the
+// definitions of the table the new engine handles differently or refuses. A
+// table already of engine is left as it is.
+func forceEngine(query string, engine string) (string, string, []string) {
+	end := definitionsEnd(query)
+	if end < 0 {
+		return query, "", nil
+	}
+	options := query[end+1:]
+	p := partitionStart(options)
+	table, partitions := options[:p], options[p:]
+
+	var old string
+	table = mapCode(table, func(code string) string {
+		return engineOptionRegexp.ReplaceAllStringFunc(code, func(option string) string {
+			old = engineOptionRegexp.FindStringSubmatch(option)[1]
+			return "ENGINE=" + engine
+		})
+	})
+	if strings.EqualFold(old, engine) {
+		return query, old, nil
+	}
+	if old == "" {
+		cut := len(table) - len(optionsEndRegexp.FindString(table))
+		table = table[:cut] + " ENGINE=" + engine + table[cut:]
+	}
+	partitions = mapCode(partitions, func(code string) string {
+		return engineOptionRegexp.ReplaceAllString(code, "ENGINE="+engine)
+	})
+	return query[:end+1] + table + partitions, old, engineWarnings(query, engine)
+}
+
+// engineWarnings returns what the table of the create table statement schema
+// loses or fails on once created with engine.
+func engineWarnings(schema string, engine string) []string {
+	var warnings []string
+	engine = strings.ToUpper(engine)
+	name := map[string]string{"INNODB": "InnoDB", "ROCKSDB": "RocksDB", "MYISAM": "MyISAM", "MEMORY": "MEMORY"}[engine]
+	if name == "" {
+		name = engine
+	}
+
+	var autoIncrement string
+	leading := make(map[string]bool)
+	for _, def := range tableDefinitions(schema) {
+		if column, attrs, ok := columnDefinition(def); ok {
+			if strings.Contains(strings.ToUpper(attrs), "AUTO_INCREMENT") {
+				autoIncrement = column
+			}
+			if engine == "MEMORY" && blobTypeRegexp.MatchString(attrs) {
+				warnings = append(warnings, fmt.Sprintf("column %s is a BLOB or TEXT: MEMORY doesn't support them, the CREATE TABLE fails", column))
+			}
+			continue
+		}
+		if foreignKeyRegexp.MatchString(def) {
+			switch engine {
+			case "INNODB":
+			case "ROCKSDB":
+				warnings = append(warnings, "FOREIGN KEY: RocksDB doesn't support foreign keys, the CREATE TABLE fails")
+			default:
+				warnings = append(warnings, fmt.Sprintf("FOREIGN KEY: %s parses and drops it, the restored table enforces no reference", name))
+			}
+			continue
+		}
+		upper := strings.ToUpper(def)
+		switch {
+		case strings.HasPrefix(upper, "FULLTEXT"):
+			switch engine {
+			case "INNODB":
+				warnings = append(warnings, fmt.Sprintf("%s: InnoDB supports FULLTEXT from MySQL 5.6 and MariaDB 10.0.5 on, an older target fails the CREATE TABLE; "+
+					"its innodb_ft_min_token_size and stopwords differ from the MyISAM ones, a search may match other rows", def))
+			case "MYISAM", "ARIA", "MROONGA":
+			default:
+				warnings = append(warnings, fmt.Sprintf("%s: %s doesn't support FULLTEXT indexes, the CREATE TABLE fails", def, name))
+			}
+			continue
+		case strings.HasPrefix(upper, "SPATIAL"):
+			switch engine {
+			case "INNODB":
+				warnings = append(warnings, fmt.Sprintf("%s: InnoDB supports SPATIAL from MySQL 5.7 and MariaDB 10.2.2 on, an older target fails the CREATE TABLE", def))
+			case "MYISAM", "ARIA":
+			default:
+				warnings = append(warnings, fmt.Sprintf("%s: %s doesn't support SPATIAL indexes, the CREATE TABLE fails", def, name))
+			}
+			continue
+		}
+		if match := keyPartsRegexp.FindStringSubmatch(def); match != nil {
+			if part := keyPartRegexp.FindStringSubmatch(strings.TrimSpace(match[3])); part != nil {
+				leading[part[1]] = true
+			}
+		}
+	}
+	if autoIncrement != "" && !leading[autoIncrement] && engine != "MYISAM" && engine != "ARIA" {
+		warnings = append(warnings, fmt.Sprintf("column %s is AUTO_INCREMENT but starts no index: MyISAM counts it per prefix of a composite key, "+
+			"%s needs it first in an index, the CREATE TABLE fails", autoIncrement, name))
+	}
+	if engine == "INNODB" && fixedRowFormatRegexp.MatchString(tableOptions(schema)) {
+		warnings = append(warnings, "ROW_FORMAT=FIXED: InnoDB doesn't support it, the CREATE TABLE fails under innodb_strict_mode, else it gets the default row format")
+	}
+	return warnings
+}
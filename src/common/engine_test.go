@@ -0,0 +1,150 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForceEngine(t *testing.T) {
+	tests := []struct {
+		in     string
+		engine string
+		out    string
+		old    string
+	}{
+		{
+			"CREATE TABLE `t1` (`a` int) ENGINE=MyISAM DEFAULT CHARSET=utf8",
+			"InnoDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			"MyISAM",
+		},
+		{
+			"CREATE TABLE `t1` (`a` int) engine = MyISAM COMMENT='ENGINE=MyISAM'",
+			"RocksDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=RocksDB COMMENT='ENGINE=MyISAM'",
+			"MyISAM",
+		},
+		// No ENGINE, it's appended.
+		{
+			"CREATE TABLE `t1` (`a` int) DEFAULT CHARSET=utf8",
+			"InnoDB",
+			"CREATE TABLE `t1` (`a` int) DEFAULT CHARSET=utf8 ENGINE=InnoDB",
+			"",
+		},
+		{
+			"CREATE TABLE `engine` (`engine` varchar(8) DEFAULT 'ENGINE=x')",
+			"InnoDB",
+			"CREATE TABLE `engine` (`engine` varchar(8) DEFAULT 'ENGINE=x') ENGINE=InnoDB",
+			"",
+		},
+		// Before the partition options, the partitions get it too.
+		{
+			"CREATE TABLE `t1` (`a` int)\n/*!50100 PARTITION BY RANGE (`a`)\n(PARTITION p0 VALUES LESS THAN (10) ENGINE = MyISAM) */",
+			"InnoDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB\n/*!50100 PARTITION BY RANGE (`a`)\n(PARTITION p0 VALUES LESS THAN (10) ENGINE=InnoDB) */",
+			"",
+		},
+		{
+			"CREATE TABLE `t1` (`a` int) ENGINE=MyISAM\n/*!50100 PARTITION BY HASH (`a`)\nPARTITIONS 4 */",
+			"InnoDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB\n/*!50100 PARTITION BY HASH (`a`)\nPARTITIONS 4 */",
+			"MyISAM",
+		},
+		// Already of the engine.
+		{
+			"CREATE TABLE `t1` (`a` int) ENGINE=innodb",
+			"InnoDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=innodb",
+			"innodb",
+		},
+	}
+	for _, test := range tests {
+		out, old, _ := forceEngine(test.in, test.engine)
+		assert.Equal(t, test.out, out)
+		assert.Equal(t, test.old, old)
+	}
+}
+
+func TestForceEngineWarnings(t *testing.T) {
+	schema := "CREATE TABLE `posts` (\n" +
+		"  `blog` int(11) NOT NULL,\n" +
+		"  `id` int(11) NOT NULL AUTO_INCREMENT,\n" +
+		"  `body` text,\n" +
+		"  `at` point NOT NULL,\n" +
+		"  PRIMARY KEY (`blog`,`id`),\n" +
+		"  FULLTEXT KEY `ft_body` (`body`),\n" +
+		"  SPATIAL KEY `sp_at` (`at`),\n" +
+		"  CONSTRAINT `fk_blog` FOREIGN KEY (`blog`) REFERENCES `blogs` (`id`)\n" +
+		") ENGINE=MyISAM ROW_FORMAT=FIXED"
+
+	// MyISAM to InnoDB.
+	{
+		_, _, warnings := forceEngine(schema, "InnoDB")
+		want := []string{
+			"FULLTEXT KEY `ft_body` (`body`): InnoDB supports FULLTEXT from MySQL 5.6 and MariaDB 10.0.5 on, an older target fails the CREATE TABLE; " +
+				"its innodb_ft_min_token_size and stopwords differ from the MyISAM ones, a search may match other rows",
+			"SPATIAL KEY `sp_at` (`at`): InnoDB supports SPATIAL from MySQL 5.7 and MariaDB 10.2.2 on, an older target fails the CREATE TABLE",
+			"column `id` is AUTO_INCREMENT but starts no index: MyISAM counts it per prefix of a composite key, InnoDB needs it first in an index, the CREATE TABLE fails",
+			"ROW_FORMAT=FIXED: InnoDB doesn't support it, the CREATE TABLE fails under innodb_strict_mode, else it gets the default row format",
+		}
+		assert.Equal(t, want, warnings)
+	}
+
+	// MyISAM to RocksDB.
+	{
+		_, _, warnings := forceEngine(schema, "RocksDB")
+		want := []string{
+			"FULLTEXT KEY `ft_body` (`body`): RocksDB doesn't support FULLTEXT indexes, the CREATE TABLE fails",
+			"SPATIAL KEY `sp_at` (`at`): RocksDB doesn't support SPATIAL indexes, the CREATE TABLE fails",
+			"FOREIGN KEY: RocksDB doesn't support foreign keys, the CREATE TABLE fails",
+			"column `id` is AUTO_INCREMENT but starts no index: MyISAM counts it per prefix of a composite key, RocksDB needs it first in an index, the CREATE TABLE fails",
+		}
+		assert.Equal(t, want, warnings)
+	}
+
+	// An AUTO_INCREMENT starting an index is fine.
+	{
+		_, _, warnings := forceEngine("CREATE TABLE `t1` (`a` int NOT NULL AUTO_INCREMENT, `b` int, PRIMARY KEY (`b`), KEY `k` (`a`,`b`)) ENGINE=MyISAM", "InnoDB")
+		assert.Nil(t, warnings)
+	}
+}
+
+func TestLoaderForceEngine(t *testing.T) {
+	dir := "/tmp/loaderforceengine"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.posts-schema.sql":  "CREATE TABLE `posts` (\n  `id` int(11) NOT NULL AUTO_INCREMENT,\n  `body` text,\n  PRIMARY KEY (`id`),\n  FULLTEXT KEY `ft_body` (`body`)\n) ENGINE=MyISAM;\n",
+		"test.posts.00001.sql":   "INSERT INTO `posts` VALUES (1,'a');\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+
+	buf := &bytes.Buffer{}
+	log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+	rec := &recordingExecutor{}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, ForceEngine: "InnoDB"}
+	_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Contains(t, rec.queries, "CREATE TABLE `posts` (\n  `id` int(11) NOT NULL AUTO_INCREMENT,\n  `body` text,\n  PRIMARY KEY (`id`),\n  FULLTEXT KEY `ft_body` (`body`)\n) ENGINE=InnoDB")
+	assert.True(t, strings.Contains(buf.String(), "restoring.force.engine.table[test.posts].engine[MyISAM].to[InnoDB]"), buf.String())
+	assert.True(t, strings.Contains(buf.String(), "restoring.force.engine.table[test.posts]:FULLTEXT KEY `ft_body` (`body`): InnoDB supports FULLTEXT"), buf.String())
+}
@@ -0,0 +1,267 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+)
+
+// ErrorCategory is the kind of failure of an error of a run, for the
+// automation around it to tell a source it can't reach from a full disk or a
+// bad row, see ErrorCategoryOf.
+type ErrorCategory string
+
+// The ErrorCategory of the errors of the runs.
+const (
+	// CategoryConnection is a server which can't be reached, refuses more
+	// connections or went away.
+	CategoryConnection ErrorCategory = "connection"
+	// CategoryPrivilege is a statement the account isn't allowed to run,
+	// or a write refused by a read-only server.
+	CategoryPrivilege ErrorCategory = "privilege"
+	// CategoryStorage is a file of the dump which can't be read or written,
+	// like a full disk, or a server out of disk space.
+	CategoryStorage ErrorCategory = "storage"
+	// CategoryData is any other statement the server refused, like a
+	// duplicate key, a value out of range or a lock wait timeout.
+	CategoryData ErrorCategory = "data"
+	// CategoryCancelled is a run stopped by its context.
+	CategoryCancelled ErrorCategory = "cancelled"
+	// CategoryPartial is a run stopped by its MaxRuntime, see PartialError.
+	CategoryPartial ErrorCategory = "partial"
+	// CategoryInvalid is a configuration which doesn't validate.
+	CategoryInvalid ErrorCategory = "invalid"
+	// CategoryOther is any other error.
+	CategoryOther ErrorCategory = "other"
+)
+
+// CategorizedError is an error of a run which says where it failed, with the
+// category of the error it failed at, see wrapf.
+type CategorizedError struct {
+	Category ErrorCategory
+	Err      error
+}
+
+func (e *CategorizedError) Error() string {
+	return e.Err.Error()
+}
+
+// retryKind is how a statement which failed may still succeed.
+type retryKind int
+
+const (
+	retryNone retryKind = iota
+	// retryLock is a deadlock or a lock wait timeout, worth retrying.
+	retryLock
+	// retryReadOnly is a write refused by a read-only server, like a target
+	// flipped to super_read_only by a failover, see waitWritable.
+	retryReadOnly
+	// retryReconnect is the server going away under the connection, like
+	// the primary of an HA pair during a failover, see failover.
+	retryReconnect
+)
+
+// errorClass is what a run makes of an error: its category and how the
+// statement may be retried.
+type errorClass struct {
+	category ErrorCategory
+	retry    retryKind
+}
+
+// MySQL error numbers the runs act on.
+const (
+	erLockWaitTimeout = 1205
+	erLockDeadlock    = 1213
+	// erOptionPreventsStatement is the error of a write refused by read_only
+	// or super_read_only, and of other options like --secure-file-priv.
+	erOptionPreventsStatement = 1290
+	// erReadOnlyMode is the error of a write refused by a server in read-only mode.
+	erReadOnlyMode = 1836
+	// erServerShutdown is the error of the statements of a server shutting down.
+	erServerShutdown = 1053
+	// crServerGone and crServerLost are the client errors of a connection
+	// the server closed, or lost in the middle of a statement.
+	crServerGone = 2006
+	crServerLost = 2013
+)
+
+// errorClasses are the classes of the MySQL error numbers which aren't
+// CategoryData statements. The client errors, 2000 to 2999, not listed are
+// CategoryConnection.
+var errorClasses = map[uint16]errorClass{
+	// ER_CON_COUNT_ERROR, ER_BAD_HOST_ERROR, ER_HANDSHAKE_ERROR.
+	1040:             {CategoryConnection, retryNone},
+	1042:             {CategoryConnection, retryNone},
+	1043:             {CategoryConnection, retryNone},
+	erServerShutdown: {CategoryConnection, retryReconnect},
+	// ER_HOST_IS_BLOCKED, ER_ABORTING_CONNECTION, ER_NET_*, ER_CONNECTION_KILLED.
+	1129:         {CategoryConnection, retryNone},
+	1152:         {CategoryConnection, retryNone},
+	1158:         {CategoryConnection, retryNone},
+	1159:         {CategoryConnection, retryNone},
+	1160:         {CategoryConnection, retryNone},
+	1161:         {CategoryConnection, retryNone},
+	1927:         {CategoryConnection, retryNone},
+	crServerGone: {CategoryConnection, retryReconnect},
+	crServerLost: {CategoryConnection, retryReconnect},
+	// CR_SERVER_LOST_EXTENDED.
+	2055: {CategoryConnection, retryReconnect},
+
+	// ER_DBACCESS_DENIED_ERROR, ER_ACCESS_DENIED_ERROR, ER_HOST_NOT_PRIVILEGED,
+	// ER_TABLEACCESS_DENIED_ERROR, ER_COLUMNACCESS_DENIED_ERROR,
+	// ER_NO_PERMISSION_TO_CREATE_USER, ER_SPECIFIC_ACCESS_DENIED_ERROR,
+	// ER_PROCACCESS_DENIED_ERROR, ER_BINLOG_CREATE_ROUTINE_NEED_SUPER,
+	// ER_ACCESS_DENIED_NO_PASSWORD_ERROR.
+	1044:                      {CategoryPrivilege, retryNone},
+	1045:                      {CategoryPrivilege, retryNone},
+	1130:                      {CategoryPrivilege, retryNone},
+	1142:                      {CategoryPrivilege, retryNone},
+	1143:                      {CategoryPrivilege, retryNone},
+	1211:                      {CategoryPrivilege, retryNone},
+	erSpecificAccessDenied:    {CategoryPrivilege, retryNone},
+	1370:                      {CategoryPrivilege, retryNone},
+	1419:                      {CategoryPrivilege, retryNone},
+	1698:                      {CategoryPrivilege, retryNone},
+	erOptionPreventsStatement: {CategoryPrivilege, retryReadOnly},
+	erReadOnlyMode:            {CategoryPrivilege, retryReadOnly},
+
+	// ER_DISK_FULL, ER_ERROR_ON_WRITE, ER_GET_ERRNO, ER_RECORD_FILE_FULL,
+	// ER_TEMP_FILE_WRITE_FAILURE, ER_DISK_FULL_NOWAIT.
+	1021: {CategoryStorage, retryNone},
+	1026: {CategoryStorage, retryNone},
+	1030: {CategoryStorage, retryNone},
+	1114: {CategoryStorage, retryNone},
+	1878: {CategoryStorage, retryNone},
+	3164: {CategoryStorage, retryNone},
+
+	erLockWaitTimeout: {CategoryData, retryLock},
+	erLockDeadlock:    {CategoryData, retryLock},
+}
+
+// classifyError returns the class of err: by its MySQL error number for a
+// server error, a CategoryData statement if it's not in errorClasses; by
+// its type for the others.
+func classifyError(err error) errorClass {
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		return errorClass{CategoryConnection, retryReconnect}
+	// A deadline is a net.Error too.
+	case context.Canceled, context.DeadlineExceeded:
+		return errorClass{category: CategoryCancelled}
+	}
+	switch e := err.(type) {
+	case nil:
+		return errorClass{}
+	case *CategorizedError:
+		return errorClass{category: e.Category}
+	case *PartialError:
+		return errorClass{category: CategoryPartial}
+	case *ValidationError:
+		return errorClass{category: CategoryInvalid}
+	case *sqldb.SQLError:
+		if c, ok := errorClasses[e.Num]; ok {
+			return c
+		}
+		if e.Num >= 2000 && e.Num < 3000 {
+			return errorClass{category: CategoryConnection}
+		}
+		return errorClass{category: CategoryData}
+	case net.Error:
+		return errorClass{CategoryConnection, retryReconnect}
+	case *os.PathError, *os.LinkError, *os.SyscallError:
+		return errorClass{category: CategoryStorage}
+	}
+	return errorClass{category: CategoryOther}
+}
+
+// ErrorCategoryOf returns the category of an error of a run, empty for nil.
+// The errors returned by the Run of the Dumper, Loader and Copier all have
+// one: a *PartialError, a *ValidationError, a cancel of the context, a
+// *CategorizedError, or the error of the driver or of the storage itself.
+func ErrorCategoryOf(err error) ErrorCategory {
+	return classifyError(err).category
+}
+
+// wrapf returns fmt.Errorf(format, a...), the error err says where it
+// failed, with the category of err: the automation still tells a server
+// which went away from a full disk once the error is wrapped.
+func wrapf(err error, format string, a ...interface{}) error {
+	wrapped := fmt.Errorf(format, a...)
+	category := ErrorCategoryOf(err)
+	if category == "" || category == CategoryOther {
+		return wrapped
+	}
+	return &CategorizedError{Category: category, Err: wrapped}
+}
+
+// errorNumber returns the MySQL error number of err, 0 if it's not a server error.
+func errorNumber(err error) uint16 {
+	if se, ok := err.(*sqldb.SQLError); ok {
+		return se.Num
+	}
+	return 0
+}
+
+// isLockError reports whether err is a deadlock or a lock wait timeout,
+// which are worth retrying.
+func isLockError(err error) bool {
+	return classifyError(err).retry == retryLock
+}
+
+// isReadOnlyError reports whether err may be a write refused by a read-only
+// server, like a target flipped to super_read_only by a failover.
+func isReadOnlyError(err error) bool {
+	return classifyError(err).retry == retryReadOnly
+}
+
+// isGoneError reports whether err is the server going away under the
+// connection, like the primary of an HA pair during a failover, see failover.
+func isGoneError(err error) bool {
+	return classifyError(err).retry == retryReconnect
+}
+
+// isUnsentError reports whether err is the server gone away before the
+// statement was sent: the client fails the write of a statement to a
+// connection the server closed with CR_SERVER_GONE_ERROR. A connection lost
+// once the statement was sent, CR_SERVER_LOST, a server shutting down or an
+// EOF reading the result, may have executed it.
+func isUnsentError(err error) bool {
+	return errorNumber(err) == crServerGone
+}
+
+// firstError keeps the first error of the workers of a run.
+type firstError struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (e *firstError) set(err error) {
+	if err == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *firstError) get() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
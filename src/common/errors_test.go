@@ -0,0 +1,175 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyErrorNumbers(t *testing.T) {
+	tests := []struct {
+		num      uint16
+		msg      string
+		category ErrorCategory
+		retry    retryKind
+	}{
+		// Connection.
+		{1040, "Too many connections", CategoryConnection, retryNone},
+		{1042, "Can't get hostname for your address", CategoryConnection, retryNone},
+		{1043, "Bad handshake", CategoryConnection, retryNone},
+		{1053, "Server shutdown in progress", CategoryConnection, retryReconnect},
+		{1129, "Host '10.0.0.9' is blocked because of many connection errors", CategoryConnection, retryNone},
+		{1152, "Aborted connection 12 to db: 'test' user: 'root' host: 'localhost' (Got an error reading communication packets)", CategoryConnection, retryNone},
+		{1158, "Got an error reading communication packets", CategoryConnection, retryNone},
+		{1159, "Got timeout reading communication packets", CategoryConnection, retryNone},
+		{1160, "Got an error writing communication packets", CategoryConnection, retryNone},
+		{1161, "Got timeout writing communication packets", CategoryConnection, retryNone},
+		{1927, "Connection was killed", CategoryConnection, retryNone},
+		{2002, "Can't connect to local MySQL server through socket '/tmp/mysql.sock' (2)", CategoryConnection, retryNone},
+		{2003, "Can't connect to MySQL server on '10.0.0.9' (111)", CategoryConnection, retryNone},
+		{2005, "Unknown MySQL server host 'db9' (0)", CategoryConnection, retryNone},
+		{2006, "MySQL server has gone away", CategoryConnection, retryReconnect},
+		{2013, "Lost connection to MySQL server during query", CategoryConnection, retryReconnect},
+		{2055, "Lost connection to MySQL server at 'reading initial communication packet', system error: 104", CategoryConnection, retryReconnect},
+
+		// Privilege.
+		{1044, "Access denied for user 'app'@'%' to database 'test'", CategoryPrivilege, retryNone},
+		{1045, "Access denied for user 'app'@'10.0.0.1' (using password: YES)", CategoryPrivilege, retryNone},
+		{1130, "Host '10.0.0.1' is not allowed to connect to this MySQL server", CategoryPrivilege, retryNone},
+		{1142, "INSERT command denied to user 'app'@'%' for table 't1'", CategoryPrivilege, retryNone},
+		{1143, "SELECT command denied to user 'app'@'%' for column 'a' in table 't1'", CategoryPrivilege, retryNone},
+		{1211, "'app'@'%' is not allowed to create new users", CategoryPrivilege, retryNone},
+		{1227, "Access denied; you need (at least one of) the SUPER or SYSTEM_VARIABLES_ADMIN privilege(s) for this operation", CategoryPrivilege, retryNone},
+		{1370, "alter routine command denied to user 'app'@'%' for routine 'test.p1'", CategoryPrivilege, retryNone},
+		{1419, "You do not have the SUPER privilege and binary logging is enabled", CategoryPrivilege, retryNone},
+		{1698, "Access denied for user 'root'@'localhost'", CategoryPrivilege, retryNone},
+		{1290, "The MySQL server is running with the --super-read-only option so it cannot execute this statement", CategoryPrivilege, retryReadOnly},
+		{1836, "Running in read-only mode", CategoryPrivilege, retryReadOnly},
+
+		// Storage.
+		{1021, "Disk full (/var/lib/mysql/test/t1.ibd); waiting for someone to free some space...", CategoryStorage, retryNone},
+		{1026, "Error writing file './test/t1.frm' (Errcode: 28 - No space left on device)", CategoryStorage, retryNone},
+		{1030, "Got error 28 from storage engine", CategoryStorage, retryNone},
+		{1114, "The table 't1' is full", CategoryStorage, retryNone},
+		{1878, "Temporary file write failure.", CategoryStorage, retryNone},
+		{3164, "Create table/tablespace 't1' failed, as disk is full", CategoryStorage, retryNone},
+
+		// Data: the statement, retried on the locks.
+		{1205, "Lock wait timeout exceeded; try restarting transaction", CategoryData, retryLock},
+		{1213, "Deadlock found when trying to get lock; try restarting transaction", CategoryData, retryLock},
+		{1062, "Duplicate entry '1' for key 'PRIMARY'", CategoryData, retryNone},
+		{1064, "You have an error in your SQL syntax; check the manual near 'VALUES' at line 1", CategoryData, retryNone},
+		{1146, "Table 'test.t9' doesn't exist", CategoryData, retryNone},
+		{1264, "Out of range value for column 'a' at row 1", CategoryData, retryNone},
+		{1366, "Incorrect integer value: 'x' for column 'a' at row 1", CategoryData, retryNone},
+		{1406, "Data too long for column 'name' at row 1", CategoryData, retryNone},
+		{1452, "Cannot add or update a child row: a foreign key constraint fails", CategoryData, retryNone},
+		{1153, "Got a packet bigger than 'max_allowed_packet' bytes", CategoryData, retryNone},
+		{3819, "Check constraint 'chk_qty' is violated.", CategoryData, retryNone},
+	}
+	for _, test := range tests {
+		c := classifyError(sqldb.NewSQLError(test.num, "%s", test.msg))
+		assert.Equal(t, test.category, c.category, test.msg)
+		assert.Equal(t, test.retry, c.retry, test.msg)
+	}
+
+	// The client errors not listed are the connection's.
+	assert.Equal(t, CategoryConnection, ErrorCategoryOf(sqldb.NewSQLError(2026, "SSL connection error")))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyErrorTypes(t *testing.T) {
+	var _ net.Error = timeoutError{}
+	tests := []struct {
+		err      error
+		category ErrorCategory
+		retry    retryKind
+	}{
+		{nil, "", retryNone},
+		{io.EOF, CategoryConnection, retryReconnect},
+		{io.ErrUnexpectedEOF, CategoryConnection, retryReconnect},
+		{timeoutError{}, CategoryConnection, retryReconnect},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, CategoryConnection, retryReconnect},
+		{&os.PathError{Op: "write", Path: "/backups/test.t1.00001.sql", Err: syscall.ENOSPC}, CategoryStorage, retryNone},
+		{&os.PathError{Op: "open", Path: "/backups/test.t1.00001.sql", Err: syscall.EACCES}, CategoryStorage, retryNone},
+		{&os.LinkError{Op: "rename", Old: "a", New: "b", Err: syscall.EXDEV}, CategoryStorage, retryNone},
+		{context.Canceled, CategoryCancelled, retryNone},
+		{context.DeadlineExceeded, CategoryCancelled, retryNone},
+		{&PartialError{Mode: "load", MaxRuntime: time.Hour}, CategoryPartial, retryNone},
+		{&ValidationError{Problems: []string{"user is required"}}, CategoryInvalid, retryNone},
+		{errors.New("restoring.check.databases.failed"), CategoryOther, retryNone},
+	}
+	for _, test := range tests {
+		c := classifyError(test.err)
+		assert.Equal(t, test.category, c.category, fmt.Sprintf("%v", test.err))
+		assert.Equal(t, test.retry, c.retry, fmt.Sprintf("%v", test.err))
+	}
+}
+
+func TestWrapf(t *testing.T) {
+	// The category is kept through the wrapping, the retry is not: the
+	// statement already failed.
+	{
+		cause := sqldb.NewSQLError(1045, "Access denied for user 'app'@'10.0.0.1' (using password: YES)")
+		err := wrapf(cause, "restoring.file[%s].error:%v", "test.t1.00001.sql", cause)
+		assert.Equal(t, "restoring.file[test.t1.00001.sql].error:"+cause.Error(), err.Error())
+		assert.Equal(t, CategoryPrivilege, ErrorCategoryOf(err))
+		again := wrapf(err, "restoring.target[%s].error:%v", "eu", err)
+		assert.Equal(t, CategoryPrivilege, ErrorCategoryOf(again))
+		assert.False(t, isGoneError(wrapf(io.EOF, "dumping.table[%s].error:%v", "test.t1", io.EOF)))
+	}
+
+	// An error without a category stays a plain one.
+	{
+		cause := errors.New("unexpected token")
+		err := wrapf(cause, "rewrite[%s]:%v", "r1", cause)
+		_, ok := err.(*CategorizedError)
+		assert.False(t, ok)
+		assert.Equal(t, CategoryOther, ErrorCategoryOf(err))
+	}
+}
+
+func TestReportErrorCategory(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	m := newMetrics(log, "load", nil, new(uint64), nil)
+	m.fileFailed("test.t1.00001.sql", sqldb.NewSQLError(1062, "Duplicate entry '1' for key 'PRIMARY'"))
+	m.fileFailed("test.t1.00002.sql", sqldb.NewSQLError(1062, "Duplicate entry '2' for key 'PRIMARY'"))
+	m.fileFailed("test.t2.00001.sql", &os.PathError{Op: "open", Path: "test.t2.00001.sql", Err: syscall.EIO})
+
+	r := m.report(wrapf(io.EOF, "restoring.file[%s].error:%v", "test.t3.00001.sql", io.EOF))
+	assert.Equal(t, RunFailed, r.Status)
+	assert.Equal(t, CategoryConnection, r.ErrorCategory)
+	assert.Equal(t, map[ErrorCategory]uint64{CategoryData: 2, CategoryStorage: 1}, r.FailureCategories)
+
+	r = m.report(context.Canceled)
+	assert.Equal(t, RunCancelled, r.Status)
+	assert.Equal(t, CategoryCancelled, r.ErrorCategory)
+
+	r = newMetrics(log, "load", nil, new(uint64), nil).report(nil)
+	assert.Equal(t, ErrorCategory(""), r.ErrorCategory)
+	assert.Nil(t, r.FailureCategories)
+}
@@ -0,0 +1,92 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// errTargetReadOnly is the error of an address passed over by a failover as
+// its server is read-only.
+var errTargetReadOnly = errors.New("target.read.only")
+
+// targetWritable takes the connections of a writable target only, a failover
+// is over once the new primary leaves super_read_only.
+func targetWritable(conn *Connection) error {
+	readOnly, err := targetReadOnly(conn)
+	if err != nil {
+		return err
+	}
+	if readOnly {
+		return errTargetReadOnly
+	}
+	return nil
+}
+
+// failover reconnects conn once the statement of what failed with err, the
+// server gone away, like the primary of an HA pair during a failover: the
+// addresses of the LoadArgs.Address are tried in order from the one of the
+// pool, passing over the read-only ones, with a growing backoff up to the
+// readOnlyMaxWait of args, as waitWritable does. It returns nil once conn is
+// on a writable target, the statement is then retried. err is returned as it
+// is once the context of the restore is done.
+func failover(log *xlog.Log, conn *Connection, args *LoadArgs, what string, err error) error {
+	if conn.pool == nil {
+		return err
+	}
+	args.metrics.retry(err)
+	args.metrics.waitingWritable(1)
+	defer args.metrics.waitingWritable(-1)
+
+	max := args.readOnlyMaxWait()
+	start := time.Now()
+	backoff := readOnlyBackoff
+	for {
+		moved, rerr := conn.pool.reconnect(conn, targetWritable)
+		if rerr == errPoolDone {
+			return err
+		}
+		if rerr == nil {
+			args.metrics.reconnected(moved)
+			if moved {
+				log.Warning("restoring.%s.failover.to.address[%s].after[%v].thread[%d]:%v", what, conn.pool.address(), time.Since(start).Round(time.Second), conn.ID, err)
+			} else {
+				log.Warning("restoring.%s.reconnected.to.address[%s].after[%v].thread[%d]:%v", what, conn.pool.address(), time.Since(start).Round(time.Second), conn.ID, err)
+			}
+			return nil
+		}
+		waited := time.Since(start)
+		if waited >= max {
+			// The servers are all gone, or all read-only.
+			return &CategorizedError{Category: CategoryConnection, Err: fmt.Errorf("restoring.%s.no.writable.address.after[%v]:%v, the last reconnect:%v", what, max, err, rerr)}
+		}
+		if backoff > max-waited {
+			backoff = max - waited
+		}
+		log.Warning("restoring.%s.server.gone.waiting.for.a.writable.address.waited[%v].next.reconnect.after[%v].thread[%d]:%v", what, waited.Round(time.Second), backoff, conn.ID, rerr)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > readOnlyMaxBackoff {
+			backoff = readOnlyMaxBackoff
+		}
+	}
+}
+
+// logFailoverSummary logs the summary line of the reconnects of a load, none
+// if it had none.
+func logFailoverSummary(log *xlog.Log, action string, r Report) {
+	if r.Reconnects == 0 {
+		return
+	}
+	logSummary(log, "%s.server.gone.reconnects[%d].failovers[%d]", action, r.Reconnects, r.Failovers)
+}
@@ -0,0 +1,349 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+const readOnlyCheck = "SELECT @@global.super_read_only, @@global.read_only"
+
+// readOnlyResult is the result of readOnlyCheck on a server, read-only or not.
+func readOnlyResult(readOnly bool) *sqltypes.Result {
+	v := []byte("0")
+	if readOnly {
+		v = []byte("1")
+	}
+	return &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "@@global.super_read_only", Type: querypb.Type_INT64},
+			{Name: "@@global.read_only", Type: querypb.Type_INT64},
+		},
+		Rows: [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, v), sqltypes.MakeTrusted(querypb.Type_INT64, v)}},
+	}
+}
+
+func TestGoneError(t *testing.T) {
+	assert.True(t, isGoneError(sqldb.NewSQLError(crServerGone, "MySQL server has gone away")))
+	assert.True(t, isGoneError(sqldb.NewSQLError(crServerLost, "Lost connection to MySQL server during query")))
+	assert.True(t, isGoneError(sqldb.NewSQLError(erServerShutdown, "Server shutdown in progress")))
+	assert.True(t, isGoneError(io.EOF))
+	assert.False(t, isGoneError(sqldb.NewSQLError(erLockDeadlock, "Deadlock found when trying to get lock")))
+	assert.False(t, isGoneError(errors.New("restoring.file[test.t1.00001.sql].error")))
+	assert.False(t, isGoneError(nil))
+	assert.True(t, isUnsentError(sqldb.NewSQLError(crServerGone, "MySQL server has gone away")))
+	assert.False(t, isUnsentError(sqldb.NewSQLError(crServerLost, "Lost connection to MySQL server during query")))
+	assert.False(t, isUnsentError(sqldb.NewSQLError(erServerShutdown, "Server shutdown in progress")))
+	assert.False(t, isUnsentError(io.EOF))
+
+	assert.Equal(t, []string{"db1:3306", "db2:3306"}, SplitAddresses(" db1:3306 ,db2:3306,"))
+	assert.Nil(t, SplitAddresses(""))
+}
+
+func TestPoolReconnect(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	servers := map[string]*recordingExecutor{"a": {}, "b": {}}
+	down := make(map[string]bool)
+	dial := func(id int, address string) (*Connection, error) {
+		if down[address] {
+			return nil, errors.New("connection refused")
+		}
+		return &Connection{ID: id, exec: &recordingConn{r: servers[address]}}, nil
+	}
+	pool, err := newPool(log, 2, []string{"a", "b"}, dial)
+	assert.Nil(t, err)
+	defer pool.Close()
+	assert.Equal(t, "a", pool.address())
+
+	// The first address down, the connection goes to the next one with the
+	// statements of the session and its database.
+	{
+		assert.Nil(t, pool.executeAll("SET foreign_key_checks=0"))
+		conn := pool.Get()
+		assert.Nil(t, conn.Use("test"))
+		down["a"] = true
+		moved, err := pool.reconnect(conn, nil)
+		assert.Nil(t, err)
+		assert.True(t, moved)
+		assert.Equal(t, "b", pool.address())
+		assert.Equal(t, []string{"SET foreign_key_checks=0", "use `test`"}, servers["b"].queries)
+		assert.Equal(t, "test", conn.db)
+		pool.Put(conn)
+	}
+
+	// The pool sticks to the address which worked.
+	{
+		down["a"] = false
+		conn := pool.Get()
+		moved, err := pool.reconnect(conn, nil)
+		assert.Nil(t, err)
+		assert.False(t, moved)
+		assert.Equal(t, "b", pool.address())
+		pool.Put(conn)
+	}
+
+	// A read-only server is passed over.
+	{
+		servers["a"].results = map[string]*sqltypes.Result{readOnlyCheck: readOnlyResult(false)}
+		servers["b"].results = map[string]*sqltypes.Result{readOnlyCheck: readOnlyResult(true)}
+		conn := pool.Get()
+		moved, err := pool.reconnect(conn, targetWritable)
+		assert.Nil(t, err)
+		assert.True(t, moved)
+		assert.Equal(t, "a", pool.address())
+
+		down["a"] = true
+		_, err = pool.reconnect(conn, targetWritable)
+		assert.NotNil(t, err)
+		assert.Equal(t, "pool.thread[0].no.address.usable[a:connection refused,b:target.read.only]", err.Error())
+		pool.Put(conn)
+	}
+
+	// Once the context is done nothing is reconnected.
+	{
+		down["a"] = false
+		ctx, cancel := context.WithCancel(context.Background())
+		stop := pool.CloseOnDone(ctx)
+		cancel()
+		for {
+			pool.mu.RLock()
+			done := pool.done
+			pool.mu.RUnlock()
+			if done {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		stop()
+		conn := pool.Get()
+		_, err := pool.reconnect(conn, nil)
+		assert.Equal(t, errPoolDone, err)
+		pool.Put(conn)
+	}
+}
+
+// deadConn is a connection the server closed: its ping fails.
+type deadConn struct {
+	recordingConn
+}
+
+func (c *deadConn) Ping() error {
+	return errors.New("connection was killed")
+}
+
+func TestPoolPingOnReuse(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	rec := &recordingExecutor{}
+	dead := true
+	dialed := 0
+	dial := func(id int, address string) (*Connection, error) {
+		dialed++
+		if dead {
+			return &Connection{ID: id, exec: &deadConn{recordingConn{r: rec}}}, nil
+		}
+		return &Connection{ID: id, exec: &recordingConn{r: rec}}, nil
+	}
+	pool, err := newPool(log, 1, []string{"a"}, dial)
+	assert.Nil(t, err)
+	defer pool.Close()
+	assert.Nil(t, pool.executeAll("SET sql_log_bin=0"))
+	conn := pool.Get()
+	assert.Nil(t, conn.Use("test"))
+	pool.Put(conn)
+
+	// Off, a connection is taken as it is.
+	conn = pool.Get()
+	assert.Equal(t, 1, dialed)
+	pool.Put(conn)
+
+	// Taken again past pingIdle, a dead connection is connected again with
+	// the statements of the session and its database.
+	pool.pingIdle = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	dead = false
+	rec.queries = nil
+	conn = pool.Get()
+	assert.Equal(t, 2, dialed)
+	assert.Equal(t, []string{"SET sql_log_bin=0", "use `test`"}, rec.queries)
+	_, ok := conn.exec.(*recordingConn)
+	assert.True(t, ok)
+	pool.Put(conn)
+
+	// A live one is kept, a recent one isn't pinged.
+	time.Sleep(2 * time.Millisecond)
+	conn = pool.Get()
+	assert.Equal(t, 2, dialed)
+	pool.Put(conn)
+	pool.pingIdle = time.Hour
+	dead = true
+	conn = pool.TryGet()
+	assert.NotNil(t, conn)
+	assert.Equal(t, 2, dialed)
+	pool.Put(conn)
+}
+
+// haExecutor is the executors of an HA pair: the connections dialed before
+// the failover are on the primary a, the first one dialed after it fails as
+// a is down, the next ones are on b.
+type haExecutor struct {
+	mu     sync.Mutex
+	before int
+	dialed int
+	a, b   *recordingExecutor
+}
+
+func (h *haExecutor) executor(id int) (Executor, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dialed++
+	switch {
+	case h.dialed <= h.before:
+		return &recordingConn{r: h.a}, nil
+	case h.dialed == h.before+1:
+		return nil, errors.New("dial a: connection refused")
+	}
+	return &recordingConn{r: h.b}, nil
+}
+
+func TestLoaderFailover(t *testing.T) {
+	dir := "/tmp/loaderfailover"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\nINSERT INTO `t1` VALUES (2);\nINSERT INTO `t1` VALUES (3);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	gone := sqldb.NewSQLError(crServerGone, "MySQL server has gone away")
+	lost := sqldb.NewSQLError(crServerLost, "Lost connection to MySQL server during query")
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "a:3306,b:3306", Threads: 1, IntervalMs: 500}
+
+	// The statement the primary was gone away before runs again on the
+	// other address, once it's writable, the ones before it are not.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		ha := &haExecutor{
+			before: 1,
+			a:      &recordingExecutor{errs: map[string]error{"INSERT INTO `t1` VALUES (2)": gone}},
+			b:      &recordingExecutor{results: map[string]*sqltypes.Result{readOnlyCheck: readOnlyResult(false)}},
+		}
+		args := args
+		args.DeferConstraints = true
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: ha.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		assert.Equal(t, uint64(1), report.Reconnects)
+		assert.Equal(t, uint64(1), report.Failovers)
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1)", "INSERT INTO `t1` VALUES (2)"}, matchingQueries(ha.a.queries, "INSERT"))
+		assert.Equal(t, []string{readOnlyCheck, "SET foreign_key_checks=0", "use `test`", "INSERT INTO `t1` VALUES (2)", "INSERT INTO `t1` VALUES (3)", "SET foreign_key_checks=1"}, ha.b.queries[:6])
+		assert.True(t, strings.Contains(buf.String(), "restoring.file[test.t1.00001.sql].offset[29].failover.to.address[b:3306]"), buf.String())
+
+		LogReport(log, report)
+		assert.True(t, strings.Contains(buf.String(), "restoring.server.gone.reconnects[1].failovers[1]"), buf.String())
+	}
+
+	// The statement the connection was lost under may have been executed,
+	// it's not run again: the file fails and the resume file goes on from it.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		ha := &haExecutor{
+			before: 1,
+			a:      &recordingExecutor{errs: map[string]error{"INSERT INTO `t1` VALUES (2)": lost}},
+			b:      &recordingExecutor{results: map[string]*sqltypes.Result{readOnlyCheck: readOnlyResult(false)}},
+		}
+		args := args
+		args.ResumeFile = dir + "/resume.jsonl"
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: ha.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, CategoryConnection, ErrorCategoryOf(err))
+		assert.True(t, strings.Contains(err.Error(), "offset[29].server.gone.after.the.statement.was.sent.it.may.have.been.executed"), err.Error())
+		assert.Equal(t, uint64(0), report.Reconnects)
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1)", "INSERT INTO `t1` VALUES (2)"}, matchingQueries(ha.a.queries, "INSERT"))
+		journal, x := ioutil.ReadFile(args.ResumeFile)
+		AssertNil(x)
+		assert.True(t, strings.Contains(string(journal), `{"file":"test.t1.00001.sql","offset":29}`), string(journal))
+		os.Remove(args.ResumeFile)
+	}
+
+	// A batch runs again in full, its transaction is lost with the server.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		x := WriteFile(dir+"/test.t1.00002.sql", "INSERT INTO `t1` VALUES (4);\n")
+		AssertNil(x)
+		ha := &haExecutor{
+			before: 1,
+			a:      &recordingExecutor{errs: map[string]error{"INSERT INTO `t1` VALUES (4)": lost}},
+			b:      &recordingExecutor{results: map[string]*sqltypes.Result{readOnlyCheck: readOnlyResult(false)}},
+		}
+		args := args
+		args.TxnBatchSize = 2
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: ha.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), report.Failovers)
+		assert.Equal(t, uint64(2), report.FilesDone)
+		assert.Equal(t, 4, len(matchingQueries(ha.b.queries, "INSERT")))
+	}
+
+	// A batch whose commit was sent may have been committed, it fails.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		ha := &haExecutor{
+			before: 1,
+			a:      &recordingExecutor{errs: map[string]error{"commit": lost}},
+			b:      &recordingExecutor{results: map[string]*sqltypes.Result{readOnlyCheck: readOnlyResult(false)}},
+		}
+		args := args
+		args.TxnBatchSize = 2
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: ha.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "server.gone.after.the.commit.was.sent.it.may.have.been.committed"), err.Error())
+		assert.Equal(t, uint64(0), report.Failovers)
+		assert.Equal(t, 0, len(matchingQueries(ha.b.queries, "INSERT")))
+	}
+
+	// So does a batch whose intermediate commit was sent.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		ha := &haExecutor{
+			before: 1,
+			a:      &recordingExecutor{errs: map[string]error{"commit": lost}},
+			b:      &recordingExecutor{results: map[string]*sqltypes.Result{readOnlyCheck: readOnlyResult(false)}},
+		}
+		args := args
+		args.TxnBatchSize = 2
+		args.TxnMaxStatements = 2
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: ha.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, CategoryConnection, ErrorCategoryOf(err))
+		assert.True(t, strings.Contains(err.Error(), "restoring.file[test.t1.00001.sql].offset[56].server.gone.after.the.commit.was.sent.it.may.have.been.committed"), err.Error())
+		assert.Equal(t, uint64(0), report.Failovers)
+		assert.Equal(t, 0, len(matchingQueries(ha.b.queries, "INSERT")))
+	}
+}
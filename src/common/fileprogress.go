@@ -0,0 +1,78 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	// largeFileBytes is the size from which a data file being restored is
+	// in the progress tick line with its percent, a smaller one is done
+	// before the next ticks.
+	largeFileBytes = 256 * 1024 * 1024
+	// maxTickFiles is how many of the large files being restored the tick
+	// line has, the largest.
+	maxTickFiles = 3
+)
+
+// fileProgress records the bytes done of the data file of size bytes the
+// worker of conn is restoring, the end of its last statement executed before
+// its delimiter. The size is the one of the data read, the file isn't read
+// twice.
+func (m *Metrics) fileProgress(conn *Connection, file string, done int, size int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ts := m.inflight[conn.ID]; ts != nil && ts.File == file {
+		ts.FileBytes, ts.BytesDone = uint64(size), uint64(done)
+	}
+}
+
+// largeFiles returns the progress of the largest files being restored of at
+// least largeFileBytes, at most maxTickFiles, see fileProgressText.
+func (m *Metrics) largeFiles() []string {
+	m.mu.Lock()
+	var large []tableState
+	for _, ts := range m.inflight {
+		if ts.FileBytes >= largeFileBytes {
+			large = append(large, *ts)
+		}
+	}
+	m.mu.Unlock()
+	sort.Slice(large, func(i, j int) bool {
+		if large[i].FileBytes != large[j].FileBytes {
+			return large[i].FileBytes > large[j].FileBytes
+		}
+		return large[i].File < large[j].File
+	})
+	if len(large) > maxTickFiles {
+		large = large[:maxTickFiles]
+	}
+	var files []string
+	for _, ts := range large {
+		files = append(files, fileProgressText(ts.File, ts.BytesDone, ts.FileBytes))
+	}
+	return files
+}
+
+// fileProgressText returns the progress of a file of size bytes with done
+// of them restored, like 'shop.orders.00007.sql:43%(77/180GB)', in MB below
+// a GB.
+func fileProgressText(file string, done uint64, size uint64) string {
+	unit, name := float64(1<<20), "MB"
+	if size >= 1<<30 {
+		unit, name = float64(1<<30), "GB"
+	}
+	return fmt.Sprintf("%s:%.0f%%(%.0f/%.0f%s)", file, float64(done)*100/float64(size), float64(done)/unit, float64(size)/unit, name)
+}
@@ -0,0 +1,80 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileProgressText(t *testing.T) {
+	assert.Equal(t, "shop.orders.00007.sql:43%(77/180GB)", fileProgressText("shop.orders.00007.sql", 77<<30+1<<20, 180<<30))
+	assert.Equal(t, "shop.orders.00008.sql:50%(256/512MB)", fileProgressText("shop.orders.00008.sql", 256<<20, 512<<20))
+}
+
+func TestLargeFiles(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	var allbytes uint64
+	m := newMetrics(log, "load", nil, &allbytes, nil)
+	sizes := map[int]int{1: 180 << 30, 2: 512 << 20, 3: 1 << 20, 4: 1 << 30, 5: 2 << 30}
+	for thread, size := range sizes {
+		file := "shop.orders.0000" + string(rune('0'+thread)) + ".sql"
+		m.startWork(thread, "shop.orders", file)
+		m.fileProgress(&Connection{ID: thread}, file, size/4, size)
+	}
+	// Another file of the thread is not its progress.
+	m.fileProgress(&Connection{ID: 3}, "shop.orders.00009.sql", 1, 2)
+
+	assert.Equal(t, []string{"shop.orders.00001.sql:25%(45/180GB)", "shop.orders.00005.sql:25%(0/2GB)", "shop.orders.00004.sql:25%(0/1GB)"}, m.largeFiles())
+	st := m.snapshot()
+	assert.Equal(t, 5, len(st.InFlight))
+	assert.Equal(t, uint64(1<<20), st.InFlight[2].FileBytes)
+	assert.Equal(t, uint64(1<<18), st.InFlight[2].BytesDone)
+	assert.Equal(t, 25.0, *st.InFlight[2].Percent)
+
+	m.endWork(1)
+	assert.Equal(t, []string{"shop.orders.00005.sql:25%(0/2GB)", "shop.orders.00004.sql:25%(0/1GB)", "shop.orders.00002.sql:25%(128/512MB)"}, m.largeFiles())
+}
+
+func TestLoaderFileProgress(t *testing.T) {
+	dir := "/tmp/loaderfileprogress"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\nINSERT INTO `t1` VALUES (2);\n")
+	AssertNil(x)
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	var allbytes uint64
+	args := &LoadArgs{Outdir: dir, storage: NewDirStorage(dir), metrics: newMetrics(log, "load", nil, &allbytes, nil)}
+	conn := &Connection{ID: 7, exec: &recordingConn{r: &recordingExecutor{}}}
+
+	// The progress is the end of the last statement executed, before its
+	// delimiter.
+	args.metrics.startWork(conn.ID, "test.t1", "test.t1.00001.sql")
+	_, err := executeTableFile(log, conn, args, "test.t1.00001.sql", nil)
+	assert.Nil(t, err)
+	st := args.metrics.snapshot()
+	assert.Equal(t, uint64(58), st.InFlight[0].FileBytes)
+	assert.Equal(t, uint64(56), st.InFlight[0].BytesDone)
+}
+
+func TestLoadProgressTickFiles(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "info", "text")
+	assert.Nil(t, err)
+	s := progressStats{bytes: 20 * 1024 * 1024, elapsed: 2, files: []string{"shop.orders.00007.sql:43%(77/180GB)", "shop.orders.00008.sql:10%(1/8GB)"}}
+	loadEvents(log).ProgressTick(s)
+	assert.Contains(t, strings.TrimSpace(out.String()), "restoring.allbytes[20MB].time[2.00sec].rates[10.00MB/sec].files[shop.orders.00007.sql:43%(77/180GB),shop.orders.00008.sql:10%(1/8GB)]...")
+}
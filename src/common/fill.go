@@ -0,0 +1,235 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// defaultFillValues are the values LoadArgs.FillMissingColumns gives a NOT
+// NULL column without a default the dump doesn't have, by its DATA_TYPE: an
+// empty string, 0 or the epoch. An ENUM gets its first member, see fillValue.
+var defaultFillValues = map[string]string{
+	"char": "''", "varchar": "''", "tinytext": "''", "text": "''", "mediumtext": "''", "longtext": "''",
+	"binary": "''", "varbinary": "''", "tinyblob": "''", "blob": "''", "mediumblob": "''", "longblob": "''",
+	"enum": "''", "set": "''",
+	"tinyint": "0", "smallint": "0", "mediumint": "0", "int": "0", "bigint": "0",
+	"decimal": "0", "float": "0", "double": "0", "bit": "0",
+	"date": "'1970-01-01'", "datetime": "'1970-01-01 00:00:00'", "timestamp": "'1970-01-01 00:00:01'",
+	"time": "'00:00:00'", "year": "1970",
+	"json": "'{}'",
+}
+
+// targetColumn is a column of a table of the target, from
+// information_schema.COLUMNS.
+type targetColumn struct {
+	name       string
+	dataType   string
+	columnType string
+	// filled is a NOT NULL column without a default, which an INSERT must
+	// set: not an AUTO_INCREMENT or a generated one.
+	filled bool
+}
+
+// fillTable is a table of LoadArgs.FillMissingColumns, with columns on the
+// target the dump doesn't have.
+type fillTable struct {
+	// columns are the quoted columns of the dump, the ones of the INSERTs
+	// without a column list.
+	columns []string
+	// names and values are the columns filled and their values, each after
+	// a comma, like ",`c`" and ",''".
+	names  string
+	values string
+}
+
+// fetchTargetColumns returns the columns of the table db.table of the target,
+// in their order, none if it has no such table.
+func fetchTargetColumns(conn *Connection, db string, table string) ([]targetColumn, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE, COLUMN_DEFAULT IS NULL, EXTRA FROM information_schema.COLUMNS WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s' ORDER BY ORDINAL_POSITION",
+		EscapeBytes([]byte(db)), EscapeBytes([]byte(table))))
+	if err != nil {
+		return nil, err
+	}
+	var columns []targetColumn
+	for _, row := range qr.Rows {
+		if len(row) < 6 {
+			continue
+		}
+		extra := strings.ToLower(row[5].String())
+		columns = append(columns, targetColumn{
+			name:       row[0].String(),
+			dataType:   strings.ToLower(row[1].String()),
+			columnType: row[2].String(),
+			filled: row[3].String() == "NO" && row[4].String() == "1" &&
+				!strings.Contains(extra, "auto_increment") && !strings.Contains(extra, "generated"),
+		})
+	}
+	return columns, nil
+}
+
+// fillValue returns the value of a filled column, from values by its
+// DATA_TYPE, else the default one, false if there is none.
+func fillValue(col targetColumn, values map[string]string) (string, bool) {
+	if v, ok := values[col.dataType]; ok {
+		return v, true
+	}
+	if col.dataType == "enum" && strings.HasPrefix(strings.ToLower(col.columnType), "enum(") {
+		return col.columnType[5:skipQuoted(col.columnType, 5)], true
+	}
+	v, ok := defaultFillValues[col.dataType]
+	return v, ok
+}
+
+// newFillTable compares the columns of the dump, from its create statement
+// schema, with the ones of the target. It returns the fillTable of the NOT
+// NULL columns without a default only the target has, nil if there are none,
+// and the problems the fill can't resolve: the columns only the dump has,
+// the filled ones of a type without a value.
+func newFillTable(schema string, target []targetColumn, values map[string]string) (*fillTable, []string) {
+	u, _ := newUpsertTable(schema)
+	dump := make(map[string]bool)
+	for _, name := range u.columns {
+		dump[strings.ToLower(unquoteIdentifier(name))] = true
+	}
+	on := make(map[string]bool)
+	f := &fillTable{columns: u.columns}
+	var problems []string
+	for _, col := range target {
+		on[strings.ToLower(col.name)] = true
+		if dump[strings.ToLower(col.name)] || !col.filled {
+			continue
+		}
+		v, ok := fillValue(col, values)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("column[%s].type[%s].has.no.fill.value", col.name, col.dataType))
+			continue
+		}
+		f.names += "," + quoteIdentifier(col.name)
+		f.values += "," + v
+	}
+	var missing []string
+	for _, name := range u.columns {
+		if !on[strings.ToLower(unquoteIdentifier(name))] {
+			missing = append(missing, unquoteIdentifier(name))
+		}
+	}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("columns[%s].not.in.target", strings.Join(missing, ",")))
+	}
+	if f.names == "" {
+		return nil, problems
+	}
+	return f, problems
+}
+
+// readFillTables reads the fillTable of every table with data files, keyed by
+// 'db.table', comparing the columns of its schema file with the ones of its
+// table on the target, created by then. All the problems of all the tables
+// fail it before any data is restored.
+func readFillTables(log *xlog.Log, conn *Connection, args *LoadArgs, storage Storage, schemas []string, tables []string) (map[string]*fillTable, error) {
+	datas := make(map[string]bool)
+	for _, table := range tables {
+		db, tbl, _ := parseTableFile(table)
+		datas[db+"."+tbl] = true
+	}
+	fills := make(map[string]*fillTable)
+	var problems []string
+	for _, path := range schemas {
+		s, err := readSchemaFile(storage, path)
+		if err != nil {
+			return nil, err
+		}
+		name := s.db + "." + s.table
+		if !datas[name] {
+			continue
+		}
+		var create string
+		for _, stmt := range splitStatements(s.sql) {
+			if createTableRegexp.MatchString(stmt.sql) {
+				create = stmt.sql
+				break
+			}
+		}
+		if create == "" {
+			continue
+		}
+		target, err := fetchTargetColumns(conn, s.db, args.targetTable(s.table))
+		if err != nil {
+			return nil, wrapf(err, "restoring.fill.missing.columns.table[%s].error:%v", name, err)
+		}
+		if len(target) == 0 {
+			problems = append(problems, fmt.Sprintf("table[%s].not.in.target", name))
+			continue
+		}
+		f, unresolved := newFillTable(create, target, args.FillValues)
+		for _, problem := range unresolved {
+			problems = append(problems, fmt.Sprintf("table[%s].%s", name, problem))
+		}
+		if f != nil {
+			fills[name] = f
+			log.Warning("restoring.fill.missing.columns.table[%s].columns[%s].values[%s]", name, f.names[1:], f.values[1:])
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("restoring.fill.missing.columns.preflight:%s", strings.Join(problems, ","))
+	}
+	log.Info("restoring.fill.missing.columns.tables[%d/%d]", len(fills), len(datas))
+	return fills, nil
+}
+
+// rewrite appends the filled columns to the column list of the INSERT query,
+// or to the columns of the dump without one, and their values to each of its
+// rows. A clause after the rows, like the ON DUPLICATE KEY UPDATE of an
+// upsert, is kept as it is. Any other statement is returned as it is.
+func (f *fillTable) rewrite(query string) string {
+	if !insertRegexp.MatchString(query) {
+		return query
+	}
+	i := valuesKeyword(query)
+	if i < 0 {
+		return query
+	}
+	out := &strings.Builder{}
+	head := query[:i]
+	if insertColumns(head) == nil {
+		out.WriteString(strings.TrimRight(head, " \t\r\n"))
+		out.WriteString("(" + strings.Join(f.columns, ",") + f.names + ") ")
+	} else {
+		end := strings.LastIndexByte(head, ')')
+		out.WriteString(head[:end] + f.names + head[end:])
+	}
+
+	start, depth := i, 0
+rows:
+	for j := i + len("VALUES"); j < len(query); j++ {
+		switch c := query[j]; {
+		case c == '\'' || c == '"' || c == '`':
+			j = skipQuoted(query, j) - 1
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				out.WriteString(query[start:j] + f.values)
+				start = j
+			}
+		case depth == 0 && c != ',' && !isSpace(c):
+			break rows
+		}
+	}
+	out.WriteString(query[start:])
+	return out.String()
+}
@@ -0,0 +1,152 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// columnsResult returns the information_schema.COLUMNS query of the table
+// db.table and its result, a row of name, type, column type, nullable, no
+// default and extra per column.
+func columnsResult(db string, table string, columns ...[6]string) (string, *sqltypes.Result) {
+	query := fmt.Sprintf("SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, IS_NULLABLE, COLUMN_DEFAULT IS NULL, EXTRA FROM information_schema.COLUMNS WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s' ORDER BY ORDINAL_POSITION", db, table)
+	r := &sqltypes.Result{}
+	for _, name := range []string{"COLUMN_NAME", "DATA_TYPE", "COLUMN_TYPE", "IS_NULLABLE", "COLUMN_DEFAULT IS NULL", "EXTRA"} {
+		r.Fields = append(r.Fields, &querypb.Field{Name: name, Type: querypb.Type_VARCHAR})
+	}
+	for _, col := range columns {
+		var row []sqltypes.Value
+		for _, v := range col {
+			row = append(row, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	return query, r
+}
+
+func TestFillTableRewrite(t *testing.T) {
+	f := &fillTable{columns: []string{"`a`", "`b`"}, names: ",`c`,`d`", values: ",'',0"}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"INSERT INTO `t1`(`a`,`b`) VALUES\n(1,'x'),\n(2,NULL)", "INSERT INTO `t1`(`a`,`b`,`c`,`d`) VALUES\n(1,'x','',0),\n(2,NULL,'',0)"},
+		// The quoted parentheses and the nested ones.
+		{"INSERT INTO `t1`(`a`,`b`) VALUES (1,'(x)'),(2,ST_GeomFromText('POINT(1 1)'))", "INSERT INTO `t1`(`a`,`b`,`c`,`d`) VALUES (1,'(x)','',0),(2,ST_GeomFromText('POINT(1 1)'),'',0)"},
+		// Without a column list, the columns of the dump.
+		{"INSERT INTO `t1` VALUES (1,'x')", "INSERT INTO `t1`(`a`,`b`,`c`,`d`) VALUES (1,'x','',0)"},
+		// The clause of an upsert is kept.
+		{"INSERT INTO `t1`(`a`,`b`) VALUES (1,'x') ON DUPLICATE KEY UPDATE `b`=VALUES(`b`)", "INSERT INTO `t1`(`a`,`b`,`c`,`d`) VALUES (1,'x','',0) ON DUPLICATE KEY UPDATE `b`=VALUES(`b`)"},
+		{"REPLACE INTO `t1`(`a`,`b`) VALUES (1,'x')", "REPLACE INTO `t1`(`a`,`b`,`c`,`d`) VALUES (1,'x','',0)"},
+		{"SET NAMES utf8mb4", "SET NAMES utf8mb4"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, f.rewrite(test.query), test.query)
+	}
+}
+
+func TestNewFillTable(t *testing.T) {
+	schema := "CREATE TABLE `t1` (\n  `a` int NOT NULL,\n  `b` varchar(10) DEFAULT NULL,\n  PRIMARY KEY (`a`)\n) ENGINE=InnoDB"
+	col := func(name string, dataType string, columnType string, filled bool) targetColumn {
+		return targetColumn{name: name, dataType: dataType, columnType: columnType, filled: filled}
+	}
+	target := []targetColumn{
+		col("a", "int", "int", true),
+		col("b", "varchar", "varchar(10)", false),
+		col("created", "datetime", "datetime", true),
+		col("state", "enum", "enum('new','done')", true),
+		// Nullable, with a default, an AUTO_INCREMENT.
+		col("note", "varchar", "varchar(10)", false),
+		col("n", "int", "int", false),
+		col("id2", "bigint", "bigint", false),
+	}
+
+	// The NOT NULL columns without a default only, by type.
+	{
+		f, problems := newFillTable(schema, target, nil)
+		assert.Nil(t, problems)
+		assert.Equal(t, &fillTable{columns: []string{"`a`", "`b`"}, names: ",`created`,`state`", values: ",'1970-01-01 00:00:00','new'"}, f)
+	}
+
+	// The values given win.
+	{
+		f, problems := newFillTable(schema, target, map[string]string{"datetime": "'2000-01-01 00:00:00'"})
+		assert.Nil(t, problems)
+		assert.Equal(t, ",'2000-01-01 00:00:00','new'", f.values)
+	}
+
+	// Nothing to fill.
+	{
+		f, problems := newFillTable(schema, target[:2], nil)
+		assert.Nil(t, problems)
+		assert.Nil(t, f)
+	}
+
+	// A column the target lacks, a type without a value.
+	{
+		f, problems := newFillTable(schema, []targetColumn{target[0], col("shape", "geometry", "geometry", true)}, nil)
+		assert.Nil(t, f)
+		assert.Equal(t, []string{"column[shape].type[geometry].has.no.fill.value", "columns[b].not.in.target"}, problems)
+	}
+}
+
+func TestLoaderFillMissingColumns(t *testing.T) {
+	dir := "/tmp/loaderfill"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"shop-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `shop`;",
+		"shop.users-schema.sql":  "CREATE TABLE `users` (\n  `id` int NOT NULL,\n  `name` varchar(10) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n",
+		"shop.users.00001.sql":   "INSERT INTO `users`(`id`,`name`) VALUES\n(1,'a'),\n(2,'b');\n",
+		"shop.orders-schema.sql": "CREATE TABLE `orders` (\n  `id` int NOT NULL\n) ENGINE=InnoDB;\n",
+		"shop.orders.00001.sql":  "INSERT INTO `orders`(`id`) VALUES\n(1);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500, FillMissingColumns: true, CreateIfNotExists: true}
+	usersQuery, users := columnsResult("shop", "users",
+		[6]string{"id", "int", "int", "NO", "1", ""},
+		[6]string{"name", "varchar", "varchar(10)", "YES", "1", ""},
+		[6]string{"tenant", "int", "int", "NO", "1", ""},
+		[6]string{"seq", "bigint", "bigint", "NO", "1", "auto_increment"},
+		[6]string{"created", "timestamp", "timestamp", "NO", "0", "DEFAULT_GENERATED"})
+	ordersQuery, orders := columnsResult("shop", "orders", [6]string{"id", "int", "int", "NO", "1", ""})
+
+	// The users get a tenant, the other columns get their value on their own.
+	{
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{usersQuery: users, ordersQuery: orders}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"INSERT INTO `users`(`id`,`name`,`tenant`) VALUES\n(1,'a',0),\n(2,'b',0)"}, matchingQueries(rec.queries, "INSERT INTO `users`"))
+		assert.Equal(t, []string{"INSERT INTO `orders`(`id`) VALUES\n(1)"}, matchingQueries(rec.queries, "INSERT INTO `orders`"))
+	}
+
+	// The target lacks a column of the dump, and a table: no data is restored.
+	{
+		_, users := columnsResult("shop", "users", [6]string{"id", "int", "int", "NO", "1", ""})
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{usersQuery: users}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.fill.missing.columns.preflight:table[shop.orders].not.in.target,table[shop.users].columns[name].not.in.target", err.Error())
+		assert.Nil(t, matchingQueries(rec.queries, "INSERT"))
+	}
+}
@@ -0,0 +1,459 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// TableInfo is what a LoadArgs.Filter or a LoadConfig.Filter knows of a
+// table of the dump.
+type TableInfo struct {
+	Database string
+	Table    string
+	// Engine is the ENGINE of the schema file, empty if it has none.
+	Engine string
+	// Bytes are the bytes of the data files of the table and Parts their
+	// number, 0 for a table without datas.
+	Bytes int64
+	Parts int
+}
+
+// TableFilter reports whether the table t of the dump is restored, see
+// LoadConfig.Filter.
+type TableFilter func(t TableInfo) bool
+
+// The fields of a filter expression, by name.
+const (
+	filterDatabase = "database"
+	filterTable    = "table"
+	filterEngine   = "engine"
+	filterSize     = "size"
+	filterParts    = "parts"
+)
+
+// filterExpr is a parsed filter expression.
+type filterExpr interface {
+	eval(t TableInfo) bool
+}
+
+type filterAnd struct{ left, right filterExpr }
+
+func (e filterAnd) eval(t TableInfo) bool { return e.left.eval(t) && e.right.eval(t) }
+
+type filterOr struct{ left, right filterExpr }
+
+func (e filterOr) eval(t TableInfo) bool { return e.left.eval(t) || e.right.eval(t) }
+
+type filterNot struct{ expr filterExpr }
+
+func (e filterNot) eval(t TableInfo) bool { return !e.expr.eval(t) }
+
+// filterCond is a condition on a field: op is one of =, !=, <, <=, >, >= or
+// 'matching', a glob, negated by NOT, value the text of a name field, lower
+// case for the engine, and number the value of a number field.
+type filterCond struct {
+	field  string
+	op     string
+	negate bool
+	value  string
+	number int64
+}
+
+func (c filterCond) eval(t TableInfo) bool {
+	var holds bool
+	switch c.field {
+	case filterSize, filterParts:
+		n := t.Bytes
+		if c.field == filterParts {
+			n = int64(t.Parts)
+		}
+		switch c.op {
+		case "=":
+			holds = n == c.number
+		case "!=":
+			holds = n != c.number
+		case "<":
+			holds = n < c.number
+		case "<=":
+			holds = n <= c.number
+		case ">":
+			holds = n > c.number
+		case ">=":
+			holds = n >= c.number
+		}
+	default:
+		s := t.Database
+		switch c.field {
+		case filterTable:
+			s = t.Table
+		case filterEngine:
+			s = strings.ToLower(t.Engine)
+		}
+		switch c.op {
+		case "matching":
+			holds, _ = path.Match(c.value, s)
+		case "=":
+			holds = s == c.value
+		case "!=":
+			holds = s != c.value
+		}
+	}
+	return holds != c.negate
+}
+
+// filterToken is a token of a filter expression, at its offset.
+type filterToken struct {
+	text   string
+	quoted bool
+	at     int
+}
+
+// filterParser parses a filter expression:
+//
+//	expr := and { OR and }
+//	and  := not { AND not }
+//	not  := NOT not | '(' expr ')' | cond
+//	cond := name-field ( '=' | '!=' | [NOT] MATCHING ) value
+//	      | number-field ( '=' | '!=' | '<' | '<=' | '>' | '>=' ) number
+//
+// The name fields are database, table and engine, the number fields size,
+// in bytes with an optional K, M, G or T suffix and a B, and parts. A value
+// is a word or a quoted string, MATCHING takes a glob like 'shard_*'. The
+// keywords are case insensitive, the names are not but the engine.
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseFilter parses the filter expression expr.
+func parseFilter(expr string) (filterExpr, error) {
+	tokens, err := tokenizeFilter(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &filterParser{tokens: tokens}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return e, nil
+}
+
+// tokenizeFilter splits expr into parentheses, operators, quoted strings and
+// words.
+func tokenizeFilter(expr string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case isSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{text: expr[i : i+1], at: i})
+			i++
+		case c == '=' || c == '<' || c == '>' || c == '!':
+			end := i + 1
+			if end < len(expr) && expr[end] == '=' {
+				end++
+			}
+			if expr[i:end] == "!" {
+				return nil, fmt.Errorf("unexpected '!' at %d", i)
+			}
+			tokens = append(tokens, filterToken{text: expr[i:end], at: i})
+			i = end
+		case c == '\'' || c == '"':
+			end := skipQuoted(expr, i)
+			if end-i < 2 || end == len(expr) && expr[end-1] != c {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, filterToken{text: unescapeLiteral(expr[i+1:end-1], c), quoted: true, at: i})
+			i = end
+		default:
+			end := i
+			for end < len(expr) && !isSpace(expr[end]) && !strings.ContainsRune("()=<>!'\"", rune(expr[end])) {
+				end++
+			}
+			tokens = append(tokens, filterToken{text: expr[i:end], at: i})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	at := -1
+	if p.pos < len(p.tokens) {
+		at = p.tokens[p.pos].at
+	}
+	if at < 0 {
+		return fmt.Errorf(format+" at the end", args...)
+	}
+	return fmt.Errorf(format+" at %d", append(args, at)...)
+}
+
+// keyword reports whether the next token is the keyword word, and takes it.
+func (p *filterParser) keyword(word string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (filterExpr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (filterExpr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) not() (filterExpr, error) {
+	if p.keyword("not") {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return filterNot{e}, nil
+	}
+	if p.keyword("(") {
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, p.errorf("missing ')'")
+		}
+		return e, nil
+	}
+	return p.cond()
+}
+
+func (p *filterParser) cond() (filterExpr, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("missing condition")
+	}
+	field := p.tokens[p.pos]
+	c := filterCond{field: strings.ToLower(field.text)}
+	switch {
+	case field.quoted:
+		return nil, p.errorf("unexpected string %q, a condition starts with a field", field.text)
+	case c.field == filterDatabase, c.field == filterTable, c.field == filterEngine,
+		c.field == filterSize, c.field == filterParts:
+	default:
+		return nil, p.errorf("unknown field %q, the fields are database, table, engine, size and parts", field.text)
+	}
+	p.pos++
+
+	numeric := c.field == filterSize || c.field == filterParts
+	switch {
+	case p.keyword("not"):
+		if !p.keyword("matching") {
+			return nil, p.errorf("NOT must be followed by MATCHING")
+		}
+		c.op, c.negate = "matching", true
+	case p.keyword("matching"):
+		c.op = "matching"
+	case p.pos < len(p.tokens) && !p.tokens[p.pos].quoted:
+		switch op := p.tokens[p.pos].text; op {
+		case "=", "!=", "<", "<=", ">", ">=":
+			c.op = op
+			p.pos++
+		}
+	}
+	switch {
+	case c.op == "":
+		return nil, p.errorf("missing operator after %s", c.field)
+	case numeric && c.op == "matching":
+		return nil, p.errorf("%s is a number, it can not be MATCHING", c.field)
+	case !numeric && strings.ContainsAny(c.op, "<>"):
+		return nil, p.errorf("%s is a name, it can not be compared with %s", c.field, c.op)
+	}
+
+	if p.pos >= len(p.tokens) || (!p.tokens[p.pos].quoted && strings.ContainsAny(p.tokens[p.pos].text, "()=<>!")) {
+		return nil, p.errorf("missing value after %s %s", c.field, c.op)
+	}
+	value := p.tokens[p.pos]
+	if numeric {
+		n, err := parseFilterNumber(c.field, value.text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		c.number = n
+	} else {
+		c.value = value.text
+		if c.field == filterEngine {
+			c.value = strings.ToLower(c.value)
+		}
+		if c.op == "matching" {
+			if _, err := path.Match(c.value, ""); err != nil {
+				return nil, p.errorf("bad pattern %q", c.value)
+			}
+		}
+	}
+	p.pos++
+	return c, nil
+}
+
+// parseFilterNumber parses the value of the number field field: parts in a
+// count, size in bytes with an optional K, M, G or T suffix, and a B.
+func parseFilterNumber(field string, value string) (int64, error) {
+	if field == filterSize {
+		if n := len(value); n > 1 && (value[n-1] == 'B' || value[n-1] == 'b') && strings.ContainsRune("KMGTkmgt", rune(value[n-2])) {
+			value = value[:n-1]
+		}
+		if value == "0" {
+			return 0, nil
+		}
+		return parseSize(value)
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("parts %q must be a count", value)
+	}
+	return n, nil
+}
+
+// filterTables keeps only the schema and data files of the tables filter
+// holds for, and the databases of these tables: a database without any table
+// is kept if filter holds for it as a table with an empty name. The
+// LoadArgs.WarmTables and OptimizeTables are the ones kept.
+func filterTables(log *xlog.Log, args *LoadArgs, files *Files, s Storage, filter TableFilter) error {
+	infos := make(map[string]*TableInfo)
+	info := func(db string, table string) *TableInfo {
+		t, ok := infos[db+"."+table]
+		if !ok {
+			t = &TableInfo{Database: db, Table: table}
+			infos[db+"."+table] = t
+		}
+		return t
+	}
+	for _, schema := range files.schemas {
+		splits := strings.SplitN(strings.TrimSuffix(filepath.Base(schema), schemaSuffix), ".", 2)
+		if len(splits) != 2 {
+			return fmt.Errorf("schema.file[%s].not.named.as[db.table%s]", schema, schemaSuffix)
+		}
+		data, err := readFile(s, schema)
+		if err != nil {
+			return err
+		}
+		t := info(splits[0], splits[1])
+		if match := engineOptionRegexp.FindStringSubmatch(tableOptions(string(data))); match != nil {
+			t.Engine = match[1]
+		}
+	}
+	for _, table := range files.tables {
+		db, tbl, _ := parseTableFile(table)
+		t := info(db, tbl)
+		t.Parts++
+		if stat, err := s.Stat(table); err == nil {
+			t.Bytes += stat.Size()
+		}
+	}
+
+	kept := make(map[string]bool)
+	databases := make(map[string]bool)
+	for name, t := range infos {
+		if _, ok := databases[t.Database]; !ok {
+			databases[t.Database] = false
+		}
+		if filter(*t) {
+			kept[name] = true
+			databases[t.Database] = true
+		}
+	}
+	var dbs []string
+	for _, file := range files.databases {
+		db := strings.TrimSuffix(filepath.Base(file), dbSuffix)
+		if has, ok := databases[db]; has || (!ok && filter(TableInfo{Database: db})) {
+			dbs = append(dbs, file)
+		}
+	}
+	var schemas []string
+	for _, schema := range files.schemas {
+		if kept[strings.TrimSuffix(filepath.Base(schema), schemaSuffix)] {
+			schemas = append(schemas, schema)
+		}
+	}
+	var datas []string
+	for _, table := range files.tables {
+		db, tbl, _ := parseTableFile(table)
+		if kept[db+"."+tbl] {
+			datas = append(datas, table)
+		}
+	}
+	var warm []string
+	for _, name := range args.WarmTables {
+		if kept[name] {
+			warm = append(warm, name)
+		}
+	}
+	log.Info("restoring.filter.databases[%d/%d].tables[%d/%d].files[%d/%d]", len(dbs), len(files.databases),
+		len(kept), len(infos), len(datas), len(files.tables))
+	files.databases, files.schemas, files.tables = dbs, schemas, datas
+	args.WarmTables = warm
+	args.OptimizeTables = keptTables(args.OptimizeTables, kept)
+	return nil
+}
+
+// tableFilter returns the filter of LoadArgs.Filter and of the LoadConfig,
+// both must hold, nil if there is none.
+func (args *LoadArgs) tableFilter() (TableFilter, error) {
+	var expr filterExpr
+	if args.Filter != "" {
+		var err error
+		if expr, err = parseFilter(args.Filter); err != nil {
+			return nil, err
+		}
+	}
+	fn := args.filter
+	switch {
+	case expr == nil:
+		return fn, nil
+	case fn == nil:
+		return expr.eval, nil
+	}
+	return func(t TableInfo) bool { return expr.eval(t) && fn(t) }, nil
+}
@@ -0,0 +1,170 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilter(t *testing.T) {
+	tables := []TableInfo{
+		{Database: "shard_1", Table: "orders", Engine: "InnoDB", Bytes: 10 << 20, Parts: 2},
+		{Database: "shard_1", Table: "orders_archive", Engine: "InnoDB", Bytes: 3 << 30, Parts: 24},
+		{Database: "shard_2", Table: "users", Engine: "InnoDB", Bytes: 2 << 30, Parts: 16},
+		{Database: "shard_2", Table: "sessions", Engine: "MEMORY"},
+		{Database: "billing", Table: "invoices", Engine: "MyISAM", Bytes: 100, Parts: 1},
+	}
+	holds := func(expr string) []string {
+		e, err := parseFilter(expr)
+		assert.Nil(t, err, expr)
+		if err != nil {
+			return nil
+		}
+		var names []string
+		for _, table := range tables {
+			if e.eval(table) {
+				names = append(names, table.Database+"."+table.Table)
+			}
+		}
+		return names
+	}
+
+	// Combined conditions.
+	assert.Equal(t, []string{"shard_1.orders", "shard_2.sessions"},
+		holds("database matching shard_* AND table not matching '*_archive' AND size < 1GB"))
+	assert.Equal(t, []string{"shard_1.orders", "shard_2.users", "billing.invoices"},
+		holds("(engine = innodb OR engine = 'MyISAM') and NOT table matching \"*_archive\""))
+	assert.Equal(t, []string{"shard_1.orders_archive", "shard_2.users", "billing.invoices"},
+		holds("size >= 2G or database = billing"))
+	assert.Equal(t, []string{"shard_2.sessions", "billing.invoices"},
+		holds("parts <= 1 AND engine != InnoDB"))
+	// AND binds tighter than OR.
+	assert.Equal(t, []string{"shard_1.orders", "shard_1.orders_archive", "billing.invoices"},
+		holds("database = shard_1 OR database = billing AND parts = 1"))
+	assert.Equal(t, []string{"billing.invoices"},
+		holds("(database = shard_1 OR database = billing) AND parts = 1"))
+	assert.Equal(t, []string{"shard_2.sessions"}, holds("size = 0 AND\n  parts > 0 OR size = 0"))
+	assert.Equal(t, []string{"shard_2.users"}, holds("table = users and size > 1024M and size != 1T"))
+
+	for expr, want := range map[string]string{
+		"":                           "empty expression",
+		"database":                   "missing operator after database at the end",
+		"database = ":                "missing value after database = at the end",
+		"schema = x":                 `unknown field "schema", the fields are database, table, engine, size and parts at 0`,
+		"size matching 1G":           "size is a number, it can not be MATCHING at 14",
+		"table < x":                  "table is a name, it can not be compared with < at 8",
+		"size < lots":                `size "lots" must be a positive number of bytes, K, M, G or T at 7`,
+		"parts > -1":                 `parts "-1" must be a count at 8`,
+		"table not like x":           "NOT must be followed by MATCHING at 10",
+		"(table = x":                 "missing ')' at the end",
+		"table = x y":                `unexpected "y" at 10`,
+		"table = 'x":                 "unterminated string at 8",
+		"table matching '[x'":        `bad pattern "[x" at 15`,
+		"table = x AND OR table = y": `unknown field "OR", the fields are database, table, engine, size and parts at 14`,
+		"table ! x":                  "unexpected '!' at 6",
+	} {
+		_, err := parseFilter(expr)
+		if assert.NotNil(t, err, expr) {
+			assert.Equal(t, want, err.Error(), expr)
+		}
+	}
+}
+
+func TestLoaderFilter(t *testing.T) {
+	dir := "/tmp/loaderfilter"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"shard_1-schema-create.sql":         "CREATE DATABASE IF NOT EXISTS `shard_1`;",
+		"shard_1.orders-schema.sql":         "CREATE TABLE `orders` (`a` int) ENGINE=InnoDB;\n",
+		"shard_1.orders.00001.sql":          "INSERT INTO `orders` VALUES (1);\n",
+		"shard_1.orders.00002.sql":          "INSERT INTO `orders` VALUES (2);\n",
+		"shard_1.orders_archive-schema.sql": "CREATE TABLE `orders_archive` (`a` int) ENGINE=InnoDB;\n",
+		"shard_1.orders_archive.00001.sql":  "INSERT INTO `orders_archive` VALUES (1);\n",
+		"shard_1.cache-schema.sql":          "CREATE TABLE `cache` (`a` int) ENGINE=MEMORY;\n",
+		"billing-schema-create.sql":         "CREATE DATABASE IF NOT EXISTS `billing`;",
+		"billing.invoices-schema.sql":       "CREATE TABLE `invoices` (`a` int) ENGINE=InnoDB;\n",
+		"billing.invoices.00001.sql":        "INSERT INTO `invoices` VALUES (1);\n",
+		"empty-schema-create.sql":           "CREATE DATABASE IF NOT EXISTS `empty`;",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+	// created returns the databases and tables created, sorted.
+	created := func(queries []string) []string {
+		var names []string
+		for _, query := range queries {
+			if strings.HasPrefix(query, "CREATE") {
+				names = append(names, query[:strings.IndexAny(query, ";(")])
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// The expression keeps the InnoDB tables of the shards but the archives,
+	// the other databases and their tables are left out.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{}
+		args := args
+		args.Filter = "database matching 'shard_*' AND table NOT MATCHING '*_archive' AND engine = innodb AND parts >= 2"
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"CREATE DATABASE IF NOT EXISTS `shard_1`", "CREATE TABLE `orders` "}, created(rec.queries))
+		assert.Equal(t, uint64(2), report.FilesDone)
+	}
+
+	// The func must hold too, a database without tables is seen with an
+	// empty table name.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{}
+		args := args
+		args.Filter = "table != orders_archive"
+		var seen []TableInfo
+		filter := func(t TableInfo) bool {
+			seen = append(seen, t)
+			return t.Database != "shard_1" || t.Table == "cache"
+		}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor, Filter: filter}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{
+			"CREATE DATABASE IF NOT EXISTS `billing`",
+			"CREATE DATABASE IF NOT EXISTS `empty`",
+			"CREATE DATABASE IF NOT EXISTS `shard_1`",
+			"CREATE TABLE `cache` ",
+			"CREATE TABLE `invoices` ",
+		}, created(rec.queries))
+		assert.Equal(t, uint64(1), report.FilesDone)
+		assert.Contains(t, seen, TableInfo{Database: "shard_1", Table: "orders", Engine: "InnoDB", Bytes: 66, Parts: 2})
+		assert.Contains(t, seen, TableInfo{Database: "shard_1", Table: "cache", Engine: "MEMORY"})
+		assert.Contains(t, seen, TableInfo{Database: "empty"})
+	}
+
+	// An invalid expression fails the validation.
+	{
+		args := args
+		args.Filter = "size < lots"
+		err := args.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{`filter "size < lots" is invalid: size "lots" must be a positive number of bytes, K, M, G or T at 7`},
+			err.(*ValidationError).Problems)
+	}
+}
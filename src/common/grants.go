@@ -0,0 +1,314 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// grantsFile is the users and the grants of a dump with DumpArgs.Grants.
+const grantsFile = "grants.sql"
+
+// grantsAccountPrefix starts the comment line of every account in grants.sql,
+// its statements follow.
+const grantsAccountPrefix = "-- account "
+
+// grantsRolePrefix starts the comment line of every role in grants.sql, its
+// CREATE ROLE and its grants follow.
+const grantsRolePrefix = "-- role "
+
+// The queries of the roles of a MySQL 8 source: a role is an account of
+// mysql.user locked with an expired and empty password, which is what CREATE
+// ROLE makes. role_edges are the roles granted to every account and
+// default_roles the ones it gets at login.
+const (
+	rolesQuery        = "SELECT user, host FROM mysql.user WHERE account_locked='Y' AND password_expired='Y' AND authentication_string='' ORDER BY user, host"
+	roleEdgesQuery    = "SELECT from_user, from_host, to_user, to_host FROM mysql.role_edges ORDER BY to_user, to_host, from_user, from_host"
+	defaultRolesQuery = "SELECT user, host, default_role_user, default_role_host FROM mysql.default_roles ORDER BY user, host, default_role_user, default_role_host"
+)
+
+// The LoadArgs.GrantsExisting values.
+const (
+	// GrantsSkipExisting leaves a user which exists on the target as it is.
+	GrantsSkipExisting = "skip"
+	// GrantsUpdateExisting sets the authentication of the dump on a user which
+	// exists on the target and adds the grants of the dump, the grants it has
+	// are kept.
+	GrantsUpdateExisting = "update"
+)
+
+// systemUser reports whether user is an account of the server itself, which
+// is never dumped.
+func systemUser(user string) bool {
+	return user == "root" || strings.HasPrefix(user, "mysql.")
+}
+
+// authLiteral returns the SQL literal of an authentication string, quoted if
+// it's printable, else hexadecimal: the caching_sha2_password hashes are
+// binary, which a target needs MySQL 8.0.27 or later to read.
+func authLiteral(auth string) string {
+	for i := 0; i < len(auth); i++ {
+		if auth[i] < 0x20 || auth[i] > 0x7e {
+			return fmt.Sprintf("0x%X", auth)
+		}
+	}
+	return fmt.Sprintf("'%s'", EscapeBytes([]byte(auth)))
+}
+
+// sourceRoles are the roles of a source, the accounts quoted.
+type sourceRoles struct {
+	// roles are the accounts which are roles.
+	roles map[string]bool
+	// edges are the roles granted to every account.
+	edges map[string][]string
+	// defaults are the default roles of every account.
+	defaults map[string][]string
+}
+
+// fetchRoles returns the roles of the MySQL 8 server of conn.
+func fetchRoles(conn *Connection) (*sourceRoles, error) {
+	r := &sourceRoles{roles: make(map[string]bool), edges: make(map[string][]string), defaults: make(map[string][]string)}
+	qr, err := conn.Fetch(rolesQuery)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range qr.Rows {
+		r.roles[quoteAccount(row[0].String(), row[1].String())] = true
+	}
+	if qr, err = conn.Fetch(roleEdgesQuery); err != nil {
+		return nil, err
+	}
+	for _, row := range qr.Rows {
+		to := quoteAccount(row[2].String(), row[3].String())
+		r.edges[to] = append(r.edges[to], quoteAccount(row[0].String(), row[1].String()))
+	}
+	if qr, err = conn.Fetch(defaultRolesQuery); err != nil {
+		return nil, err
+	}
+	for _, row := range qr.Rows {
+		account := quoteAccount(row[0].String(), row[1].String())
+		r.defaults[account] = append(r.defaults[account], quoteAccount(row[2].String(), row[3].String()))
+	}
+	return r, nil
+}
+
+// grantsOrder returns the accounts in the order of grants.sql: the roles then
+// the users, each after the accounts granted to it by edges, so the GRANT of a
+// role always follows its CREATE ROLE. The accounts which aren't dumped, the
+// system ones, are left out.
+func grantsOrder(accounts []string, roles map[string]bool, edges map[string][]string) []string {
+	dumped := make(map[string]bool)
+	for _, a := range accounts {
+		dumped[a] = true
+	}
+	var ordered []string
+	visited := make(map[string]bool)
+	var visit func(a string)
+	visit = func(a string) {
+		if visited[a] || !dumped[a] {
+			return
+		}
+		visited[a] = true
+		for _, from := range edges[a] {
+			visit(from)
+		}
+		ordered = append(ordered, a)
+	}
+	for _, role := range []bool{true, false} {
+		for _, a := range accounts {
+			if roles[a] == role {
+				visit(a)
+			}
+		}
+	}
+	return ordered
+}
+
+// dumpGrants writes the grants.sql of the users and the roles of the source
+// but the system ones: every account is a comment line, a CREATE USER IF NOT
+// EXISTS with its authentication plugin and string as they are, or a CREATE
+// ROLE IF NOT EXISTS, then its SHOW GRANTS, then its SET DEFAULT ROLE. The
+// roles are only read from MySQL 8.0 and later, see grantsOrder.
+func dumpGrants(log *xlog.Log, conn *Connection, args *DumpArgs) error {
+	qr, err := conn.Fetch("SELECT user, host, plugin, authentication_string FROM mysql.user ORDER BY user, host")
+	if err != nil {
+		return wrapf(err, "dumping.grants.users.error:%v", err)
+	}
+	roles := &sourceRoles{}
+	if v, ok := parseServerVersion(args.serverVersion); ok && v.mariadb {
+		log.Warning("dumping.grants.mariadb.roles.not.dumped:the.grants.of.roles.to.users.fail.without.them")
+	} else if ok && newServerFeatures(v).Roles {
+		if roles, err = fetchRoles(conn); err != nil {
+			return wrapf(err, "dumping.grants.roles.error:%v", err)
+		}
+	}
+
+	var accounts []string
+	rows := make(map[string][]sqltypes.Value)
+	for _, row := range qr.Rows {
+		if systemUser(row[0].String()) {
+			continue
+		}
+		account := quoteAccount(row[0].String(), row[1].String())
+		accounts = append(accounts, account)
+		rows[account] = row
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "-- Users, roles and grants dumped by go-mydumper %s, restored by load -grants.\n", Version)
+	var users, nroles int
+	for _, account := range grantsOrder(accounts, roles.roles, roles.edges) {
+		grants, err := conn.Fetch(fmt.Sprintf("SHOW GRANTS FOR %s", account))
+		if err != nil {
+			return wrapf(err, "dumping.grants.user[%s].error:%v", account, err)
+		}
+		if roles.roles[account] {
+			fmt.Fprintf(&buf, "\n%s%s\n", grantsRolePrefix, account)
+			fmt.Fprintf(&buf, "CREATE ROLE IF NOT EXISTS %s;\n", account)
+			nroles++
+		} else {
+			row := rows[account]
+			fmt.Fprintf(&buf, "\n%s%s\n", grantsAccountPrefix, account)
+			fmt.Fprintf(&buf, "CREATE USER IF NOT EXISTS %s IDENTIFIED WITH '%s'", account, EscapeBytes([]byte(row[2].String())))
+			if auth := row[3].String(); auth != "" {
+				fmt.Fprintf(&buf, " AS %s", authLiteral(auth))
+			}
+			buf.WriteString(";\n")
+			users++
+		}
+		for _, grant := range grants.Rows {
+			fmt.Fprintf(&buf, "%s;\n", grant[0].String())
+		}
+		if defaults := roles.defaults[account]; len(defaults) > 0 {
+			fmt.Fprintf(&buf, "SET DEFAULT ROLE %s TO %s;\n", strings.Join(defaults, ", "), account)
+		}
+	}
+	if err := writeFile(args.storage, grantsFile, buf.String()); err != nil {
+		return err
+	}
+	log.Info("dumping.grants.users[%d].roles[%d]", users, nroles)
+	return nil
+}
+
+// grantsAccount is an account of grants.sql with its statements, the CREATE
+// USER, or the CREATE ROLE of a role, first.
+type grantsAccount struct {
+	account    string
+	role       bool
+	statements []string
+}
+
+// parseGrants reads the accounts of grants.sql, a statement is a line.
+func parseGrants(data string) ([]*grantsAccount, error) {
+	var accounts []*grantsAccount
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, grantsAccountPrefix):
+			accounts = append(accounts, &grantsAccount{account: strings.TrimPrefix(line, grantsAccountPrefix)})
+		case strings.HasPrefix(line, grantsRolePrefix):
+			accounts = append(accounts, &grantsAccount{account: strings.TrimPrefix(line, grantsRolePrefix), role: true})
+		case line == "" || strings.HasPrefix(line, "--"):
+		case len(accounts) == 0:
+			return nil, fmt.Errorf("restoring.grants.statement.without.account:%s", redactSQL(line, 64))
+		default:
+			last := accounts[len(accounts)-1]
+			last.statements = append(last.statements, strings.TrimSuffix(line, ";"))
+		}
+	}
+	for _, a := range accounts {
+		switch {
+		case a.role && (len(a.statements) == 0 || !strings.HasPrefix(a.statements[0], "CREATE ROLE IF NOT EXISTS ")):
+			return nil, fmt.Errorf("restoring.grants.role[%s].has.no.create.role", a.account)
+		case !a.role && (len(a.statements) == 0 || !strings.HasPrefix(a.statements[0], "CREATE USER IF NOT EXISTS ")):
+			return nil, fmt.Errorf("restoring.grants.account[%s].has.no.create.user", a.account)
+		}
+	}
+	return accounts, nil
+}
+
+// restoreGrants restores the roles, the users and the grants of the
+// grants.sql of the dump, in its order. An account which exists on the target
+// is skipped or updated, see LoadArgs.GrantsExisting. A target without roles,
+// older than MySQL 8.0, skips the roles and the role statements of the users
+// with a warning. The statements are never logged, they hold the password
+// hashes.
+func restoreGrants(log *xlog.Log, conn *Connection, args *LoadArgs) error {
+	data, err := readFile(args.store(), grantsFile)
+	if err != nil {
+		return wrapf(err, "restoring.grants.requires[%s]:%v", grantsFile, err)
+	}
+	accounts, err := parseGrants(string(data))
+	if err != nil {
+		return err
+	}
+	targetRoles := true
+	if version, err := fetchServerVersion(conn); err != nil {
+		log.Warning("restoring.grants.target.version.error.roles.restored:%v", err)
+	} else if v, ok := parseServerVersion(version); ok && !newServerFeatures(v).Roles {
+		targetRoles = false
+	}
+	var users, roles struct{ created, updated, skipped int }
+	for _, a := range accounts {
+		kind, counts := "user", &users
+		if a.role {
+			kind, counts = "role", &roles
+		}
+		if a.role && !targetRoles {
+			log.Warning("restoring.grants.role[%s].skipped:the.target.has.no.roles", a.account)
+			counts.skipped++
+			continue
+		}
+		user, host, ok := accountParts(a.account)
+		if !ok {
+			return fmt.Errorf("restoring.grants.account[%s].not.user@host", a.account)
+		}
+		qr, err := conn.Fetch(fmt.Sprintf("SELECT COUNT(*) FROM mysql.user WHERE user='%s' AND host='%s'", EscapeBytes([]byte(user)), EscapeBytes([]byte(host))))
+		if err != nil {
+			return wrapf(err, "restoring.grants.%s[%s].error:%v", kind, a.account, err)
+		}
+		exists := len(qr.Rows) > 0 && qr.Rows[0][0].String() != "0"
+		statements := a.statements
+		switch {
+		case exists && args.GrantsExisting == GrantsUpdateExisting:
+			// The CREATE ROLE IF NOT EXISTS of a role does nothing.
+			if !a.role {
+				statements = append([]string{"ALTER USER " + strings.TrimPrefix(statements[0], "CREATE USER IF NOT EXISTS ")}, statements[1:]...)
+			}
+			counts.updated++
+		case exists:
+			log.Info("restoring.grants.%s[%s].exists.skipped", kind, a.account)
+			counts.skipped++
+			continue
+		default:
+			counts.created++
+		}
+		var skipped int
+		for _, statement := range statements {
+			if !targetRoles && roleStatement(statement) {
+				skipped++
+				continue
+			}
+			if err := conn.Execute(statement); err != nil {
+				return wrapf(err, "restoring.grants.%s[%s].error:%v", kind, a.account, err)
+			}
+		}
+		if skipped > 0 {
+			log.Warning("restoring.grants.%s[%s].role.statements[%d].skipped:the.target.has.no.roles", kind, a.account, skipped)
+		}
+	}
+	log.Info("restoring.grants.users.created[%d].updated[%d].skipped[%d].roles.created[%d].updated[%d].skipped[%d]",
+		users.created, users.updated, users.skipped, roles.created, roles.updated, roles.skipped)
+	return nil
+}
@@ -0,0 +1,281 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrantsAuthLiteral(t *testing.T) {
+	assert.Equal(t, "'*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9'", authLiteral("*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9"))
+	assert.Equal(t, "'it\\'s'", authLiteral("it's"))
+	assert.Equal(t, "0x24410024", authLiteral("$A\x00$"))
+}
+
+func TestGrantsParse(t *testing.T) {
+	data := "-- Users and grants dumped by go-mydumper.\n" +
+		"\n-- account 'app'@'%'\n" +
+		"CREATE USER IF NOT EXISTS 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*AB';\n" +
+		"GRANT USAGE ON *.* TO `app`@`%`;\n" +
+		"GRANT SELECT (`a`), INSERT ON `test`.`t1` TO `app`@`%`;\n" +
+		"\n-- account 'ro'@'10.%'\n" +
+		"CREATE USER IF NOT EXISTS 'ro'@'10.%' IDENTIFIED WITH 'auth_socket';\n" +
+		"\n-- role 'reader'@'%'\n" +
+		"CREATE ROLE IF NOT EXISTS 'reader'@'%';\n"
+	accounts, err := parseGrants(data)
+	assert.Nil(t, err)
+	assert.Equal(t, []*grantsAccount{
+		{
+			account: "'app'@'%'",
+			statements: []string{
+				"CREATE USER IF NOT EXISTS 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*AB'",
+				"GRANT USAGE ON *.* TO `app`@`%`",
+				"GRANT SELECT (`a`), INSERT ON `test`.`t1` TO `app`@`%`",
+			},
+		},
+		{
+			account:    "'ro'@'10.%'",
+			statements: []string{"CREATE USER IF NOT EXISTS 'ro'@'10.%' IDENTIFIED WITH 'auth_socket'"},
+		},
+		{
+			account:    "'reader'@'%'",
+			role:       true,
+			statements: []string{"CREATE ROLE IF NOT EXISTS 'reader'@'%'"},
+		},
+	}, accounts)
+
+	_, err = parseGrants("GRANT USAGE ON *.* TO `app`@`%`;\n")
+	assert.NotNil(t, err)
+	_, err = parseGrants("-- account 'app'@'%'\nGRANT USAGE ON *.* TO `app`@`%`;\n")
+	assert.NotNil(t, err)
+	_, err = parseGrants("-- role 'reader'@'%'\nCREATE USER IF NOT EXISTS 'reader'@'%';\n")
+	assert.NotNil(t, err)
+}
+
+func TestGrantsOrder(t *testing.T) {
+	// app is granted writer, writer is granted reader, and reader the user
+	// audit used as a role; the system account is no dump's.
+	accounts := []string{"'app'@'%'", "'audit'@'%'", "'reader'@'%'", "'writer'@'%'"}
+	roles := map[string]bool{"'reader'@'%'": true, "'writer'@'%'": true}
+	edges := map[string][]string{
+		"'app'@'%'":    {"'writer'@'%'"},
+		"'writer'@'%'": {"'reader'@'%'", "'mysql.sys'@'localhost'"},
+		"'reader'@'%'": {"'audit'@'%'"},
+	}
+	assert.Equal(t, []string{"'audit'@'%'", "'reader'@'%'", "'writer'@'%'", "'app'@'%'"}, grantsOrder(accounts, roles, edges))
+	assert.Equal(t, accounts, grantsOrder(accounts, nil, nil))
+}
+
+func TestGrantsRoles(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+		"SELECT user, host, plugin, authentication_string FROM mysql.user ORDER BY user, host": stringsResult([]string{"user", "host", "plugin", "authentication_string"},
+			[]string{"app", "%", "mysql_native_password", "*AB"},
+			[]string{"reader", "%", "caching_sha2_password", ""},
+			[]string{"writer", "%", "caching_sha2_password", ""}),
+		rolesQuery:                     stringsResult([]string{"user", "host"}, []string{"reader", "%"}, []string{"writer", "%"}),
+		roleEdgesQuery:                 stringsResult([]string{"from_user", "from_host", "to_user", "to_host"}, []string{"writer", "%", "app", "%"}, []string{"reader", "%", "writer", "%"}),
+		defaultRolesQuery:              stringsResult([]string{"user", "host", "default_role_user", "default_role_host"}, []string{"app", "%", "writer", "%"}),
+		"SHOW GRANTS FOR 'app'@'%'":    stringsResult([]string{"Grants"}, []string{"GRANT USAGE ON *.* TO `app`@`%`"}, []string{"GRANT `writer`@`%` TO `app`@`%`"}),
+		"SHOW GRANTS FOR 'reader'@'%'": stringsResult([]string{"Grants"}, []string{"GRANT USAGE ON *.* TO `reader`@`%`"}, []string{"GRANT SELECT ON `shop`.* TO `reader`@`%`"}),
+		"SHOW GRANTS FOR 'writer'@'%'": stringsResult([]string{"Grants"}, []string{"GRANT INSERT ON `shop`.* TO `writer`@`%`"}, []string{"GRANT `reader`@`%` TO `writer`@`%`"}),
+		"SELECT VERSION()":             singleResult("VERSION()", "5.7.42-log"),
+	}}
+	conn := &Connection{ID: 1, exec: &recordingConn{r: rec}}
+	storage := NewMemStorage()
+
+	// The roles first, in the order they are granted, then the users with
+	// their default roles.
+	{
+		err := dumpGrants(log, conn, &DumpArgs{storage: storage, serverVersion: "8.0.35"})
+		assert.Nil(t, err)
+		data, err := readFile(storage, grantsFile)
+		assert.Nil(t, err)
+		want := "\n-- role 'reader'@'%'\n" +
+			"CREATE ROLE IF NOT EXISTS 'reader'@'%';\n" +
+			"GRANT USAGE ON *.* TO `reader`@`%`;\n" +
+			"GRANT SELECT ON `shop`.* TO `reader`@`%`;\n" +
+			"\n-- role 'writer'@'%'\n" +
+			"CREATE ROLE IF NOT EXISTS 'writer'@'%';\n" +
+			"GRANT INSERT ON `shop`.* TO `writer`@`%`;\n" +
+			"GRANT `reader`@`%` TO `writer`@`%`;\n" +
+			"\n-- account 'app'@'%'\n" +
+			"CREATE USER IF NOT EXISTS 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*AB';\n" +
+			"GRANT USAGE ON *.* TO `app`@`%`;\n" +
+			"GRANT `writer`@`%` TO `app`@`%`;\n" +
+			"SET DEFAULT ROLE 'writer'@'%' TO 'app'@'%';\n"
+		assert.True(t, strings.HasSuffix(string(data), want), string(data))
+	}
+
+	// A 5.7 source has no roles to read.
+	{
+		rec.queries = nil
+		err := dumpGrants(log, conn, &DumpArgs{storage: NewMemStorage(), serverVersion: "5.7.42-log"})
+		assert.Nil(t, err)
+		assert.Nil(t, matchingQueries(rec.queries, rolesQuery))
+	}
+
+	// A 5.7 target skips the roles and the role statements.
+	{
+		rec.queries = nil
+		err := restoreGrants(log, conn, &LoadArgs{storage: storage})
+		assert.Nil(t, err)
+		assert.Nil(t, matchingQueries(rec.queries, "CREATE ROLE"))
+		assert.Nil(t, matchingQueries(rec.queries, "SET DEFAULT ROLE"))
+		assert.Nil(t, matchingQueries(rec.queries, "GRANT `"))
+		assert.Equal(t, []string{"GRANT USAGE ON *.* TO `app`@`%`"}, matchingQueries(rec.queries, "GRANT"))
+	}
+
+	// An 8.0 one restores them all in order.
+	{
+		rec.queries = nil
+		rec.results["SELECT VERSION()"] = singleResult("VERSION()", "8.0.35")
+		err := restoreGrants(log, conn, &LoadArgs{storage: storage})
+		assert.Nil(t, err)
+		var executed []string
+		for _, query := range rec.queries {
+			if !strings.HasPrefix(query, "SELECT ") {
+				executed = append(executed, query)
+			}
+		}
+		assert.Equal(t, []string{
+			"CREATE ROLE IF NOT EXISTS 'reader'@'%'",
+			"GRANT USAGE ON *.* TO `reader`@`%`",
+			"GRANT SELECT ON `shop`.* TO `reader`@`%`",
+			"CREATE ROLE IF NOT EXISTS 'writer'@'%'",
+			"GRANT INSERT ON `shop`.* TO `writer`@`%`",
+			"GRANT `reader`@`%` TO `writer`@`%`",
+			"CREATE USER IF NOT EXISTS 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*AB'",
+			"GRANT USAGE ON *.* TO `app`@`%`",
+			"GRANT `writer`@`%` TO `app`@`%`",
+			"SET DEFAULT ROLE 'writer'@'%' TO 'app'@'%'",
+		}, executed)
+	}
+}
+
+func TestGrantsDumpRestore(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	usersResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "user", Type: querypb.Type_VARCHAR},
+			{Name: "host", Type: querypb.Type_VARCHAR},
+			{Name: "plugin", Type: querypb.Type_VARCHAR},
+			{Name: "authentication_string", Type: querypb.Type_VARCHAR},
+		},
+	}
+	for _, user := range [][]string{
+		{"app", "%", "mysql_native_password", "*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9"},
+		{"mysql.sys", "localhost", "mysql_native_password", "*THISISNOTAVALIDPASSWORDTHATCANBEUSEDHERE"},
+		{"root", "localhost", "mysql_native_password", ""},
+		{"ro", "10.%", "auth_socket", ""},
+	} {
+		var row []sqltypes.Value
+		for _, v := range user {
+			row = append(row, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+		}
+		usersResult.Rows = append(usersResult.Rows, row)
+	}
+	grantsResult := func(grants ...string) *sqltypes.Result {
+		r := &sqltypes.Result{Fields: []*querypb.Field{{Name: "Grants", Type: querypb.Type_VARCHAR}}}
+		for _, grant := range grants {
+			r.Rows = append(r.Rows, []sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(grant))})
+		}
+		return r
+	}
+	countResult := func(n string) *sqltypes.Result {
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{{Name: "COUNT(*)", Type: querypb.Type_INT64}},
+			Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, []byte(n))}},
+		}
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQuery("select user, host, plugin, authentication_string from mysql.user order by user, host", usersResult)
+		fakedbs.AddQuery("show grants for 'app'@'%'", grantsResult("GRANT USAGE ON *.* TO `app`@`%`", "GRANT SELECT (`a`), INSERT ON `test`.`t1` TO `app`@`%`"))
+		fakedbs.AddQuery("show grants for 'ro'@'10.%'", grantsResult("GRANT SELECT ON `test`.* TO `ro`@`10.%`"))
+		fakedbs.AddQuery("select version()", singleResult("VERSION()", "8.0.35"))
+		fakedbs.AddQuery("select count(*) from mysql.user where user='app' and host='%'", countResult("1"))
+		fakedbs.AddQuery("select count(*) from mysql.user where user='ro' and host='10.%'", countResult("0"))
+		fakedbs.AddQueryPattern("create user .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("alter user .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("grant .*", &sqltypes.Result{})
+	}
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	dir := "/tmp/grantstest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	storage := NewDirStorage(dir)
+
+	// The users but the system ones, with their hash.
+	{
+		err := dumpGrants(log, conn, &DumpArgs{storage: storage})
+		assert.Nil(t, err)
+		data, err := readFile(storage, grantsFile)
+		assert.Nil(t, err)
+		want := "\n-- account 'app'@'%'\n" +
+			"CREATE USER IF NOT EXISTS 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*6BB4837EB74329105EE4568DDA7DC67ED2CA2AD9';\n" +
+			"GRANT USAGE ON *.* TO `app`@`%`;\n" +
+			"GRANT SELECT (`a`), INSERT ON `test`.`t1` TO `app`@`%`;\n" +
+			"\n-- account 'ro'@'10.%'\n" +
+			"CREATE USER IF NOT EXISTS 'ro'@'10.%' IDENTIFIED WITH 'auth_socket';\n" +
+			"GRANT SELECT ON `test`.* TO `ro`@`10.%`;\n"
+		assert.True(t, strings.HasSuffix(string(data), want))
+	}
+
+	createApp := "create user if not exists 'app'@'%' identified with 'mysql_native_password' as '*6bb4837eb74329105ee4568dda7dc67ed2ca2ad9'"
+	alterApp := "alter user 'app'@'%' identified with 'mysql_native_password' as '*6bb4837eb74329105ee4568dda7dc67ed2ca2ad9'"
+	createRo := "create user if not exists 'ro'@'10.%' identified with 'auth_socket'"
+
+	// An existing user is skipped.
+	{
+		err := restoreGrants(log, conn, &LoadArgs{storage: storage})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, fakedbs.GetQueryCalledNum(createApp))
+		assert.Equal(t, 0, fakedbs.GetQueryCalledNum("grant usage on *.* to `app`@`%`"))
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum(createRo))
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("grant select on `test`.* to `ro`@`10.%`"))
+	}
+
+	// Or updated.
+	{
+		err := restoreGrants(log, conn, &LoadArgs{storage: storage, GrantsExisting: GrantsUpdateExisting})
+		assert.Nil(t, err)
+		assert.Equal(t, 0, fakedbs.GetQueryCalledNum(createApp))
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum(alterApp))
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("grant usage on *.* to `app`@`%`"))
+	}
+
+	// No grants.sql.
+	{
+		err := restoreGrants(log, conn, &LoadArgs{storage: NewDirStorage("/tmp/grantstest-none")})
+		assert.NotNil(t, err)
+	}
+}
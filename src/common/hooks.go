@@ -0,0 +1,275 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The TableEvent.Status of a hook.
+const (
+	// HookStart is the status of the pre-table hook.
+	HookStart = "start"
+	// HookOK and HookFailed are the status of the post-table hook: whether
+	// all the data files of the table were restored.
+	HookOK     = "ok"
+	HookFailed = "failed"
+	// HookReopen is the status of the pipe reopen hook, see
+	// LoadArgs.PipeReopenCommand.
+	HookReopen = "reopen"
+)
+
+// The hooks, as named in the report.
+const (
+	preTableHook   = "pre_table"
+	postTableHook  = "post_table"
+	pipeReopenHook = "pipe_reopen"
+)
+
+// maxHookOutput is the tail of the output of a failed hook command kept in its error.
+const maxHookOutput = 512
+
+// TableEvent is the table a hook runs for.
+type TableEvent struct {
+	Database string
+	Table    string
+	// File is the first data file of the table to be restored for the
+	// pre-table hook, the last one restored for the post-table hook.
+	File string
+	// Status is HookStart, HookOK, HookFailed or HookReopen.
+	Status string
+}
+
+// TableHook is a callback of LoadConfig, see LoadConfig.PreTableHook.
+type TableHook func(ctx context.Context, e TableEvent) error
+
+// HookStats are the runs of a hook in the report.
+type HookStats struct {
+	Runs    int     `json:"runs"`
+	Failed  int     `json:"failed"`
+	Seconds float64 `json:"seconds"`
+}
+
+// runHookCommand runs a hook command with 'sh -c' and the event in its
+// environment: DB, TABLE, FILE and STATUS.
+func runHookCommand(ctx context.Context, command string, e TableEvent) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), "DB="+e.Database, "TABLE="+e.Table, "FILE="+e.File, "STATUS="+e.Status)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		output := strings.TrimSpace(string(out))
+		if len(output) > maxHookOutput {
+			output = "..." + output[len(output)-maxHookOutput:]
+		}
+		return fmt.Errorf("command[%s].%v.output[%s]", command, err, output)
+	}
+	return nil
+}
+
+// hookedTable is the hook state of a table with data files.
+type hookedTable struct {
+	// mu serializes the hooks of the table, the workers restoring its other
+	// files wait for the pre-table hook.
+	mu      sync.Mutex
+	started bool
+	// err is the error of the pre-table hook, the table is skipped.
+	err     error
+	pending int
+	last    string
+	failed  bool
+	posted  bool
+}
+
+// tableHooks runs the pre-table hook of every table before its first data
+// file and the post-table hook once they are all restored or failed. A nil
+// *tableHooks runs nothing.
+type tableHooks struct {
+	log     *xlog.Log
+	args    *LoadArgs
+	metrics *Metrics
+
+	mu     sync.Mutex
+	tables map[string]*hookedTable
+	errs   []string
+}
+
+// newTableHooks returns the hooks of the data files, nil if args has none.
+func newTableHooks(log *xlog.Log, args *LoadArgs, files []string) *tableHooks {
+	if args.PreTableHookCommand == "" && args.PostTableHookCommand == "" && args.preTableHook == nil && args.postTableHook == nil {
+		return nil
+	}
+	h := &tableHooks{log: log, args: args, metrics: args.metrics, tables: make(map[string]*hookedTable)}
+	for _, file := range files {
+		db, tbl, _ := parseTableFile(file)
+		t, ok := h.tables[db+"."+tbl]
+		if !ok {
+			t = &hookedTable{}
+			h.tables[db+"."+tbl] = t
+		}
+		t.pending++
+	}
+	return h
+}
+
+// run runs the command then the callback of a hook and records it.
+func (h *tableHooks) run(ctx context.Context, hook string, command string, callback TableHook, e TableEvent) error {
+	if command == "" && callback == nil {
+		return nil
+	}
+	start := time.Now()
+	var err error
+	if command != "" {
+		err = runHookCommand(ctx, command, e)
+	}
+	if err == nil && callback != nil {
+		err = callback(ctx, e)
+	}
+	h.metrics.hookDone(hook, time.Since(start), err)
+	if err != nil {
+		err = wrapf(err, "%s.hook.error:%v", hook, err)
+		h.mu.Lock()
+		h.errs = append(h.errs, fmt.Sprintf("%s.%s: %v", e.Database, e.Table, err))
+		h.mu.Unlock()
+		return err
+	}
+	h.log.Info("restoring.table[%s.%s].%s.hook.done.status[%s].cost[%.2fsec]", e.Database, e.Table, hook, e.Status, time.Since(start).Seconds())
+	return nil
+}
+
+// begin runs the pre-table hook of the table of file if it's the first of
+// its files, the other files wait for it. An error skips the table: none of
+// its files must be restored.
+func (h *tableHooks) begin(ctx context.Context, file string) error {
+	if h == nil {
+		return nil
+	}
+	db, tbl, _ := parseTableFile(file)
+	t := h.tables[db+"."+tbl]
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started {
+		t.started = true
+		t.err = h.run(ctx, preTableHook, h.args.PreTableHookCommand, h.args.preTableHook, TableEvent{Database: db, Table: tbl, File: file, Status: HookStart})
+		if t.err != nil {
+			h.log.Error("restoring.table[%s.%s].skipped:%v", db, tbl, t.err)
+		}
+	}
+	return t.err
+}
+
+// beginUnit runs begin for the files of a restore unit and returns the files
+// to restore, the skipped ones are counted as failed.
+func (h *tableHooks) beginUnit(ctx context.Context, unit []string) []string {
+	if h == nil {
+		return unit
+	}
+	var files []string
+	for _, file := range unit {
+		if err := h.begin(ctx, file); err != nil {
+			h.metrics.fileFailed(file, err)
+			continue
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// end records a restored file, with the error of its restore, and runs the
+// post-table hook after the last file of the table.
+func (h *tableHooks) end(file string, err error) {
+	if h == nil {
+		return
+	}
+	db, tbl, _ := parseTableFile(file)
+	t := h.tables[db+"."+tbl]
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending--
+	t.last = file
+	if err != nil {
+		t.failed = true
+	}
+	if t.pending == 0 {
+		h.post(db, tbl, t)
+	}
+}
+
+// post runs the post-table hook of a table, with t.mu held. It runs without
+// the context of the run, which may be done: the post-table hooks undo what
+// the pre-table hooks did.
+func (h *tableHooks) post(db string, tbl string, t *hookedTable) {
+	if t.posted || t.err != nil {
+		return
+	}
+	t.posted = true
+	status := HookOK
+	if t.failed || t.pending > 0 {
+		status = HookFailed
+	}
+	h.run(context.Background(), postTableHook, h.args.PostTableHookCommand, h.args.postTableHook, TableEvent{Database: db, Table: tbl, File: t.last, Status: status})
+}
+
+// finish runs the post-table hook, with HookFailed, of the tables started
+// whose files were not all restored because the restore stopped.
+func (h *tableHooks) finish() {
+	if h == nil {
+		return
+	}
+	var names []string
+	for name := range h.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := h.tables[name]
+		t.mu.Lock()
+		if t.started {
+			splits := strings.SplitN(name, ".", 2)
+			h.post(splits[0], splits[1], t)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// err returns the failed hooks of the run, nil if none failed.
+func (h *tableHooks) err() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("restoring.table.hooks.failed:\n  %s", strings.Join(h.errs, "\n  "))
+}
+
+// logHookSummary logs the summary line of the hooks of a run, if any ran.
+func logHookSummary(log *xlog.Log, action string, hooks map[string]HookStats) {
+	if len(hooks) == 0 {
+		return
+	}
+	var parts []string
+	for _, hook := range []string{preTableHook, postTableHook} {
+		if s, ok := hooks[hook]; ok {
+			parts = append(parts, fmt.Sprintf("%s[runs:%d,failed:%d,cost:%.2fsec]", hook, s.Runs, s.Failed, s.Seconds))
+		}
+	}
+	logSummary(log, "%s.hooks.%s", action, strings.Join(parts, "."))
+}
@@ -0,0 +1,124 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooksCommand(t *testing.T) {
+	e := TableEvent{Database: "db", Table: "t1", File: "db.t1.00001.sql", Status: HookStart}
+
+	// Environment.
+	{
+		err := runHookCommand(context.Background(), `test "$DB.$TABLE.$FILE.$STATUS" = "db.t1.db.t1.00001.sql.start"`, e)
+		assert.Nil(t, err)
+	}
+
+	// Failure with its output.
+	{
+		err := runHookCommand(context.Background(), "echo no.such.table >&2; exit 3", e)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "no.such.table"))
+	}
+}
+
+func TestHooksTable(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	var mu sync.Mutex
+	var events []TableEvent
+	var running int32
+	record := func(ctx context.Context, e TableEvent) error {
+		assert.Equal(t, int32(1), atomic.AddInt32(&running, 1))
+		defer atomic.AddInt32(&running, -1)
+		time.Sleep(time.Millisecond * 10)
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+		return nil
+	}
+	args := &LoadArgs{preTableHook: record, postTableHook: record}
+	args.metrics = newMetrics(log, "load", nil, new(uint64), nil)
+	files := []string{"db.t1.00001.sql", "db.t1.00002.sql", "db.t1.00003.sql"}
+	h := newTableHooks(log, args, files)
+
+	// The chunks wait for the pre-table hook, it runs once.
+	var wg sync.WaitGroup
+	for _, file := range files {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			assert.Equal(t, []string{file}, h.beginUnit(context.Background(), []string{file}))
+			mu.Lock()
+			assert.Equal(t, 1, len(events))
+			mu.Unlock()
+			h.end(file, nil)
+		}(file)
+	}
+	wg.Wait()
+	h.finish()
+	assert.Nil(t, h.err())
+
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, HookStart, events[0].Status)
+	assert.Equal(t, TableEvent{Database: "db", Table: "t1", File: events[1].File, Status: HookOK}, events[1])
+	r := args.metrics.report(nil)
+	assert.Equal(t, 1, r.Hooks[preTableHook].Runs)
+	assert.Equal(t, 1, r.Hooks[postTableHook].Runs)
+
+	// No hooks.
+	assert.Nil(t, newTableHooks(log, &LoadArgs{}, files))
+}
+
+func TestHooksSkip(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	var posts []TableEvent
+	args := &LoadArgs{
+		preTableHook: func(ctx context.Context, e TableEvent) error {
+			if e.Table == "t1" {
+				return errors.New("mock.hook.error")
+			}
+			return nil
+		},
+		postTableHook: func(ctx context.Context, e TableEvent) error {
+			posts = append(posts, e)
+			return nil
+		},
+	}
+	args.metrics = newMetrics(log, "load", nil, new(uint64), nil)
+	h := newTableHooks(log, args, []string{"db.t1.00001.sql", "db.t1.00002.sql", "db.t2.00001.sql", "db.t2.00002.sql", "db.t3.00001.sql"})
+
+	// t1 skipped, its files failed.
+	{
+		files := h.beginUnit(context.Background(), []string{"db.t1.00001.sql", "db.t2.00001.sql"})
+		assert.Equal(t, []string{"db.t2.00001.sql"}, files)
+		assert.Nil(t, h.beginUnit(context.Background(), []string{"db.t1.00002.sql"}))
+		h.end("db.t2.00001.sql", nil)
+		assert.Equal(t, uint64(2), args.metrics.report(nil).FilesFailed)
+	}
+
+	// The restore stopped: t2 is posted failed, t3 never started.
+	{
+		h.finish()
+		assert.Equal(t, []TableEvent{{Database: "db", Table: "t2", File: "db.t2.00001.sql", Status: HookFailed}}, posts)
+		err := h.err()
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "db.t1: pre_table.hook.error:mock.hook.error"))
+	}
+}
@@ -0,0 +1,301 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+var (
+	// collateRegexp matches a COLLATE clause, of a column, a table or a
+	// database, with its collation.
+	collateRegexp = regexp.MustCompile(`(?i)\bCOLLATE\b\s*=?\s*(\w+)`)
+	// onClauseRegexp matches the ON of a GRANT of privileges, a GRANT without
+	// it grants roles.
+	onClauseRegexp = regexp.MustCompile(`(?i)\sON\s`)
+)
+
+// ServerFeatures are the features of a server the loader compares between the
+// source, see Manifest.ServerFeatures, and the target before it restores.
+type ServerFeatures struct {
+	// CheckConstraints, InvisibleColumns and Roles are set if the version of
+	// the server has them: enforced CHECK constraints, INVISIBLE columns and
+	// the roles of CREATE ROLE and GRANT role TO user.
+	CheckConstraints bool `json:"check_constraints"`
+	InvisibleColumns bool `json:"invisible_columns"`
+	Roles            bool `json:"roles"`
+	// LowerCaseTableNames is the lower_case_table_names of the server.
+	LowerCaseTableNames int `json:"lower_case_table_names"`
+}
+
+// featureVersions are the first versions of MySQL and MariaDB which have a
+// feature of ServerFeatures.
+var featureVersions = []struct {
+	mysql, mariadb serverVersion
+	set            func(f *ServerFeatures)
+}{
+	{serverVersion{major: 8, patch: 16}, serverVersion{major: 10, minor: 2, patch: 1}, func(f *ServerFeatures) { f.CheckConstraints = true }},
+	{serverVersion{major: 8, patch: 23}, serverVersion{major: 10, minor: 3, patch: 3}, func(f *ServerFeatures) { f.InvisibleColumns = true }},
+	{serverVersion{major: 8}, serverVersion{major: 10, patch: 5}, func(f *ServerFeatures) { f.Roles = true }},
+}
+
+// newServerFeatures returns the features of the version v, without its
+// lower_case_table_names.
+func newServerFeatures(v serverVersion) *ServerFeatures {
+	f := &ServerFeatures{}
+	for _, feature := range featureVersions {
+		first := feature.mysql
+		if v.mariadb {
+			first = feature.mariadb
+		}
+		if v.compare(first, true) >= 0 {
+			feature.set(f)
+		}
+	}
+	return f
+}
+
+// String lists the features in the logs.
+func (f *ServerFeatures) String() string {
+	var names []string
+	if f.CheckConstraints {
+		names = append(names, "check constraints")
+	}
+	if f.InvisibleColumns {
+		names = append(names, "invisible columns")
+	}
+	if f.Roles {
+		names = append(names, "roles")
+	}
+	names = append(names, fmt.Sprintf("lower_case_table_names=%d", f.LowerCaseTableNames))
+	return strings.Join(names, ",")
+}
+
+// fetchServerFeatures returns the features of the server of conn, of the
+// VERSION() version.
+func fetchServerFeatures(conn *Connection, version string) (*ServerFeatures, error) {
+	v, ok := parseServerVersion(version)
+	if !ok {
+		return nil, fmt.Errorf("server.version[%s].can.not.be.parsed", version)
+	}
+	f := newServerFeatures(v)
+	qr, err := conn.Fetch("SELECT @@lower_case_table_names")
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+		return nil, fmt.Errorf("server.lower_case_table_names.has.no.row")
+	}
+	if f.LowerCaseTableNames, err = strconv.Atoi(qr.Rows[0][0].String()); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// fetchCollations returns the collations of the server of conn, lower case.
+func fetchCollations(conn *Connection) (map[string]bool, error) {
+	qr, err := conn.Fetch("SELECT COLLATION_NAME FROM information_schema.COLLATIONS")
+	if err != nil {
+		return nil, err
+	}
+	collations := make(map[string]bool)
+	for _, row := range qr.Rows {
+		if len(row) > 0 {
+			collations[strings.ToLower(row[0].String())] = true
+		}
+	}
+	return collations, nil
+}
+
+// unknownCollations returns the collations of the COLLATE clauses of the
+// create statement sql which are not in collations, once each in their order.
+// The string literals, like a COMMENT, are left out.
+func unknownCollations(sql string, collations map[string]bool) []string {
+	var unknown []string
+	seen := make(map[string]bool)
+	for _, match := range collateRegexp.FindAllStringSubmatch(mapLiterals(sql, func(string) string { return "" }), -1) {
+		name := strings.ToLower(match[1])
+		if !collations[name] && !seen[name] {
+			seen[name] = true
+			unknown = append(unknown, match[1])
+		}
+	}
+	return unknown
+}
+
+// roleStatement reports whether a statement of grants.sql needs roles: a
+// GRANT without an ON clause, which grants roles, or a SET DEFAULT ROLE.
+func roleStatement(stmt string) bool {
+	upper := strings.ToUpper(stmt)
+	if strings.HasPrefix(upper, "SET DEFAULT ROLE ") {
+		return true
+	}
+	return strings.HasPrefix(upper, "GRANT ") && !onClauseRegexp.MatchString(quotedNameRegexp.ReplaceAllString(stmt, "``"))
+}
+
+// roleStatements returns the statements of an account of grants.sql which
+// need roles, see roleStatement.
+func roleStatements(statements []string) []string {
+	var found []string
+	for _, stmt := range statements {
+		if roleStatement(stmt) {
+			found = append(found, stmt)
+		}
+	}
+	return found
+}
+
+// incompatibility is a feature of the dump the target lacks, object is the
+// database, the db.table or the account which has it.
+type incompatibility struct {
+	object string
+	reason string
+}
+
+// findIncompatibilities scans the schema files of files, and grants.sql with
+// LoadArgs.Grants, for the features target lacks: the collations it doesn't
+// have, the CHECK constraints, the INVISIBLE columns and the roles. source is
+// nil if the dump didn't record its features, then the names aren't checked
+// for the lower_case_table_names of target, and target is nil if its version
+// is unknown, then only the collations are checked. collations is nil if they
+// are unknown.
+func findIncompatibilities(args *LoadArgs, files *Files, source *ServerFeatures, target *ServerFeatures, collations map[string]bool) ([]incompatibility, error) {
+	var found []incompatibility
+	add := func(object string, format string, a ...interface{}) {
+		found = append(found, incompatibility{object: object, reason: fmt.Sprintf(format, a...)})
+	}
+	folded := func(object string, name string) {
+		if source != nil && target != nil && source.LowerCaseTableNames == 0 && target.LowerCaseTableNames != 0 && strings.ToLower(name) != name {
+			add(object, "the name %s has upper case letters and the target has lower_case_table_names=%d: it's created in lower case, "+
+				"a name of the dump which differs only by its case clashes with it", name, target.LowerCaseTableNames)
+		}
+	}
+
+	for _, path := range files.databases {
+		data, err := readFile(args.store(), path)
+		if err != nil {
+			return nil, err
+		}
+		db := strings.TrimSuffix(filepath.Base(path), dbSuffix)
+		if collations != nil {
+			if unknown := unknownCollations(string(data), collations); len(unknown) > 0 {
+				add(db, "collation %s is not on the target, the CREATE DATABASE fails", strings.Join(unknown, ", "))
+			}
+		}
+		folded(db, db)
+	}
+	for _, path := range files.schemas {
+		s, err := readSchemaFile(args.store(), path)
+		if err != nil {
+			return nil, err
+		}
+		object := s.db + "." + s.table
+		if collations != nil {
+			if unknown := unknownCollations(s.sql, collations); len(unknown) > 0 {
+				add(object, "collation %s is not on the target, the CREATE fails", strings.Join(unknown, ", "))
+			}
+		}
+		if target != nil && !target.CheckConstraints && !args.SkipCheckConstraints {
+			if checks := checkConstraints(s.sql); len(checks) > 0 {
+				add(object, "CHECK constraints %s: the target parses and drops them, the restored table accepts the rows they reject", strings.Join(checks, ", "))
+			}
+		}
+		if target != nil && !target.InvisibleColumns {
+			if columns := invisibleColumns(s.sql); len(columns) > 0 {
+				add(object, "INVISIBLE columns %s: the target creates them visible, SELECT * returns them", strings.Join(columns, ", "))
+			}
+		}
+		folded(object, args.targetTable(s.table))
+	}
+	if args.Grants && target != nil && !target.Roles {
+		data, err := readFile(args.store(), grantsFile)
+		if err != nil {
+			return nil, wrapf(err, "restoring.grants.requires[%s]:%v", grantsFile, err)
+		}
+		accounts, err := parseGrants(string(data))
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range accounts {
+			if a.role {
+				add("role "+a.account, "the target has no roles, the role and its grants are skipped")
+			} else if found := roleStatements(a.statements); len(found) > 0 {
+				add("account "+a.account, "it's granted roles and the target has none, they are skipped: %s", strings.Join(found, "; "))
+			}
+		}
+	}
+	return found, nil
+}
+
+// checkIncompatibilities compares the features of the source server recorded
+// in manifest.json with the ones of the target of conn, then looks for the
+// features of the dump the target lacks, see findIncompatibilities, before any
+// statement. They are warnings, unless LoadArgs.FailOnIncompat which fails
+// the restore with them all. A target whose features can't be read is only
+// checked for what is known, and a dump without the version of its source is
+// not checked, like by checkServerVersion.
+func checkIncompatibilities(log *xlog.Log, conn *Connection, args *LoadArgs, files *Files) error {
+	m, err := readManifest(args.store())
+	if err != nil || m.ServerVersion == "" {
+		log.Info("restoring.source.version[unknown].incompatibilities.not.checked")
+		return nil
+	}
+	source := m.ServerFeatures
+	version, err := fetchServerVersion(conn)
+	if err != nil {
+		log.Warning("restoring.target.version.error.features.not.checked:%v", err)
+	}
+	var target *ServerFeatures
+	if err == nil {
+		if target, err = fetchServerFeatures(conn, version); err != nil {
+			log.Warning("restoring.target.features.error.not.checked:%v", err)
+		}
+	}
+	collations, err := fetchCollations(conn)
+	switch {
+	case err != nil:
+		log.Warning("restoring.target.collations.error.not.checked:%v", err)
+		collations = nil
+	case len(collations) == 0:
+		log.Warning("restoring.target.collations.none.not.checked")
+		collations = nil
+	}
+	if source != nil && target != nil {
+		log.Info("restoring.source.features[%s].target.features[%s]", source, target)
+	}
+
+	found, err := findIncompatibilities(args, files, source, target, collations)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		log.Info("restoring.target.incompatibilities[0]")
+		return nil
+	}
+	lines := make([]string, 0, len(found))
+	for _, i := range found {
+		lines = append(lines, i.object+": "+i.reason)
+	}
+	if args.FailOnIncompat {
+		return fmt.Errorf("restoring.target.version[%s].incompatible[%d], stopped before any statement as FailOnIncompat (-fail-on-incompat) is set:\n  %s",
+			version, len(found), strings.Join(lines, "\n  "))
+	}
+	for _, line := range lines {
+		log.Warning("restoring.target.incompatible:%s", line)
+	}
+	log.Warning("restoring.target.version[%s].incompatibilities[%d].restored.anyway, set FailOnIncompat (-fail-on-incompat) to stop before any statement", version, len(found))
+	return nil
+}
@@ -0,0 +1,242 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// collationsResult is the information_schema.COLLATIONS of a server with the
+// collations.
+func collationsResult(collations ...string) *sqltypes.Result {
+	qr := &sqltypes.Result{Fields: []*querypb.Field{{Name: "COLLATION_NAME", Type: querypb.Type_VARCHAR}}}
+	for _, c := range collations {
+		qr.Rows = append(qr.Rows, []sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(c))})
+	}
+	return qr
+}
+
+func TestServerFeatures(t *testing.T) {
+	tests := []struct {
+		version string
+		want    ServerFeatures
+	}{
+		{"5.7.42-log", ServerFeatures{}},
+		{"8.0.15", ServerFeatures{Roles: true}},
+		{"8.0.16", ServerFeatures{Roles: true, CheckConstraints: true}},
+		{"8.0.32", ServerFeatures{Roles: true, CheckConstraints: true, InvisibleColumns: true}},
+		{"10.0.4-MariaDB", ServerFeatures{}},
+		{"10.2.1-MariaDB", ServerFeatures{Roles: true, CheckConstraints: true}},
+		{"10.6.12-MariaDB-1:10.6.12+maria~ubu2004", ServerFeatures{Roles: true, CheckConstraints: true, InvisibleColumns: true}},
+	}
+	for _, test := range tests {
+		v, ok := parseServerVersion(test.version)
+		assert.True(t, ok)
+		assert.Equal(t, test.want, *newServerFeatures(v), test.version)
+	}
+	f := ServerFeatures{CheckConstraints: true, Roles: true, LowerCaseTableNames: 1}
+	assert.Equal(t, "check constraints,roles,lower_case_table_names=1", f.String())
+}
+
+func TestUnknownCollations(t *testing.T) {
+	collations := map[string]bool{"utf8mb4_general_ci": true, "utf8mb4_bin": true, "latin1_swedish_ci": true}
+	schema := "CREATE TABLE `t1` (\n" +
+		"  `a` varchar(8) COLLATE utf8mb4_bin DEFAULT NULL,\n" +
+		"  `b` varchar(8) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_as_cs DEFAULT 'COLLATE x',\n" +
+		"  `collate_x` int,\n" +
+		"  `c` text COMMENT 'collate utf8mb4_ja_0900_as_cs'\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=UTF8MB4_0900_AI_CI"
+	assert.Equal(t, []string{"utf8mb4_0900_as_cs", "UTF8MB4_0900_AI_CI"}, unknownCollations(schema, collations))
+
+	// A database, once each.
+	db := "CREATE DATABASE IF NOT EXISTS `test` /*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci */ /*!80016 DEFAULT ENCRYPTION='N' */;\n" +
+		"ALTER DATABASE `test` COLLATE utf8mb4_0900_ai_ci;"
+	assert.Equal(t, []string{"utf8mb4_0900_ai_ci"}, unknownCollations(db, collations))
+
+	// All known, or none.
+	assert.Nil(t, unknownCollations("CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=latin1 COLLATE latin1_swedish_ci", collations))
+	assert.Nil(t, unknownCollations("CREATE TABLE `t1` (`a` int) ENGINE=InnoDB", collations))
+}
+
+func TestRoleStatements(t *testing.T) {
+	statements := []string{
+		"CREATE USER IF NOT EXISTS 'app'@'%' IDENTIFIED WITH 'mysql_native_password' AS '*23AE809DDACAF96AF0FD78ED04B6A265E05AA257'",
+		"GRANT USAGE ON *.* TO `app`@`%`",
+		"GRANT SELECT, INSERT ON `shop`.* TO `app`@`%`",
+		"GRANT PROXY ON ``@`` TO `app`@`%`",
+		"GRANT `reader`@`%`,`writer`@`%` TO `app`@`%`",
+		"GRANT `on call`@`%` TO `app`@`%` WITH ADMIN OPTION",
+		"grant `dba` to `app`@`%`",
+		"SET DEFAULT ROLE 'reader'@'%' TO 'app'@'%'",
+	}
+	assert.Equal(t, []string{
+		"GRANT `reader`@`%`,`writer`@`%` TO `app`@`%`",
+		"GRANT `on call`@`%` TO `app`@`%` WITH ADMIN OPTION",
+		"grant `dba` to `app`@`%`",
+		"SET DEFAULT ROLE 'reader'@'%' TO 'app'@'%'",
+	}, roleStatements(statements))
+	assert.Nil(t, roleStatements(statements[:4]))
+}
+
+func TestFindIncompatibilities(t *testing.T) {
+	dir := "/tmp/findincompat"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"Shop-schema-create.sql":  "CREATE DATABASE IF NOT EXISTS `Shop` /*!40100 DEFAULT CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci */;",
+		"Shop.orders-schema.sql":  checkSchema + " COLLATE=utf8mb4_0900_ai_ci;\n",
+		"Shop.Users-schema.sql":   "CREATE TABLE `Users` (`id` int NOT NULL, `secret` int DEFAULT NULL /*!80023 INVISIBLE */) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;\n",
+		"Shop.archive-schema.sql": "CREATE TABLE `archive` (`id` int) ENGINE=InnoDB DEFAULT CHARSET=latin1;\n",
+		grantsFile: "-- role 'reader'@'%'\nCREATE ROLE IF NOT EXISTS 'reader'@'%';\nGRANT SELECT ON `Shop`.* TO `reader`@`%`;\n" +
+			"-- account 'app'@'%'\nCREATE USER IF NOT EXISTS 'app'@'%';\nGRANT USAGE ON *.* TO `app`@`%`;\nGRANT `reader`@`%` TO `app`@`%`;\n" +
+			"-- account 'ro'@'%'\nCREATE USER IF NOT EXISTS 'ro'@'%';\nGRANT SELECT ON *.* TO `ro`@`%`;\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := &LoadArgs{Outdir: dir, storage: NewDirStorage(dir)}
+	files, err := loadFiles(args.store())
+	assert.Nil(t, err)
+	collations := map[string]bool{"utf8mb4_general_ci": true, "latin1_swedish_ci": true}
+	source := newServerFeatures(serverVersion{major: 8, patch: 32})
+	v57 := newServerFeatures(serverVersion{major: 5, minor: 7, patch: 42})
+	v57.LowerCaseTableNames = 1
+
+	// Everything a 5.7 lacks.
+	{
+		args := *args
+		args.Grants = true
+		found, err := findIncompatibilities(&args, files, source, v57, collations)
+		assert.Nil(t, err)
+		assert.Equal(t, []incompatibility{
+			{"Shop", "collation utf8mb4_0900_ai_ci is not on the target, the CREATE DATABASE fails"},
+			{"Shop", "the name Shop has upper case letters and the target has lower_case_table_names=1: it's created in lower case, " +
+				"a name of the dump which differs only by its case clashes with it"},
+			{"Shop.Users", "INVISIBLE columns `secret`: the target creates them visible, SELECT * returns them"},
+			{"Shop.Users", "the name Users has upper case letters and the target has lower_case_table_names=1: it's created in lower case, " +
+				"a name of the dump which differs only by its case clashes with it"},
+			{"Shop.orders", "collation utf8mb4_0900_ai_ci is not on the target, the CREATE fails"},
+			{"Shop.orders", "CHECK constraints `chk_qty`, `chk_price`: the target parses and drops them, the restored table accepts the rows they reject"},
+			{"role 'reader'@'%'", "the target has no roles, the role and its grants are skipped"},
+			{"account 'app'@'%'", "it's granted roles and the target has none, they are skipped: GRANT `reader`@`%` TO `app`@`%`"},
+		}, found)
+	}
+
+	// Unknown features and collations, and the grants aren't restored: only the
+	// names of a dump without features aren't checked.
+	{
+		found, err := findIncompatibilities(args, files, nil, v57, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(found))
+		found, err = findIncompatibilities(args, files, source, nil, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, found)
+	}
+
+	// The CHECK constraints left out aren't lacked.
+	{
+		args := *args
+		args.SkipCheckConstraints = true
+		found, err := findIncompatibilities(&args, files, source, v57, collations)
+		assert.Nil(t, err)
+		for _, i := range found {
+			assert.False(t, strings.HasPrefix(i.reason, "CHECK constraints"), i.reason)
+		}
+		assert.Equal(t, 5, len(found))
+	}
+
+	// An 8.0 target with the collations has none.
+	{
+		args := *args
+		args.Grants = true
+		collations := map[string]bool{"utf8mb4_general_ci": true, "utf8mb4_0900_ai_ci": true}
+		found, err := findIncompatibilities(&args, files, source, source, collations)
+		assert.Nil(t, err)
+		assert.Nil(t, found)
+	}
+}
+
+func TestLoaderIncompat(t *testing.T) {
+	dir := "/tmp/loaderincompat"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     checkSchema + ";\n",
+		"test.t1.00001.sql":      "INSERT INTO `orders` VALUES (1,1,1.00,NULL);\n",
+		manifestFile: `{"version": "0.2.0", "server_version": "8.0.32", "server_features": ` +
+			`{"check_constraints": true, "invisible_columns": true, "roles": true, "lower_case_table_names": 0}, "tables": []}`,
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, AllowVersionDowngrade: true}
+	results := map[string]*sqltypes.Result{
+		"SELECT VERSION()":                                         singleResult("VERSION()", "5.7.42-log"),
+		"SELECT @@lower_case_table_names":                          singleResult("@@lower_case_table_names", "0"),
+		"SELECT COLLATION_NAME FROM information_schema.COLLATIONS": collationsResult("utf8mb4_general_ci"),
+	}
+
+	// The warnings, the restore goes on.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{results: results}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, strings.Contains(buf.String(), "restoring.source.features[check constraints,invisible columns,roles,lower_case_table_names=0].target.features[lower_case_table_names=0]"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.target.incompatible:test.t1: CHECK constraints `chk_qty`, `chk_price`: the target parses and drops them"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.target.version[5.7.42-log].incompatibilities[1].restored.anyway"), buf.String())
+		assert.Contains(t, rec.queries, "INSERT INTO `orders` VALUES (1,1,1.00,NULL)")
+	}
+
+	// FailOnIncompat stops before any statement, and before the version check.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{results: results}
+		args := args
+		args.FailOnIncompat = true
+		args.AllowVersionDowngrade = false
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "restoring.target.version[5.7.42-log].incompatible[1], stopped before any statement as FailOnIncompat (-fail-on-incompat) is set:\n"+
+			"  test.t1: CHECK constraints `chk_qty`, `chk_price`"), err.Error())
+		for _, query := range rec.queries {
+			assert.True(t, strings.HasPrefix(query, "SELECT"), query)
+		}
+	}
+
+	// An 8.0 target passes.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			"SELECT VERSION()":                                         singleResult("VERSION()", "8.0.35"),
+			"SELECT @@lower_case_table_names":                          singleResult("@@lower_case_table_names", "0"),
+			"SELECT COLLATION_NAME FROM information_schema.COLLATIONS": collationsResult("utf8mb4_0900_ai_ci"),
+		}}
+		args := args
+		args.FailOnIncompat = true
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, strings.Contains(buf.String(), "restoring.target.incompatibilities[0]"), buf.String())
+	}
+}
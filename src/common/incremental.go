@@ -0,0 +1,351 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// ManifestIncremental is the place of an incremental dump in its chain, see
+// DumpArgs.IncrementalFrom: the loader restores a full dump then its
+// incrementals in order, LoadArgs.Incrementals.
+type ManifestIncremental struct {
+	// From is the previous dump of the chain, as IncrementalFrom names it.
+	From string `json:"from"`
+	// FromGTIDSet is the GTID set of the previous dump, the link of the chain.
+	FromGTIDSet string `json:"from_gtid_set"`
+	// Since is the snapshot time of the previous dump, the tables changed at
+	// or after it are dumped.
+	Since string `json:"since"`
+	// Sequence is 1 for the first incremental of a full dump, else the one
+	// of the previous dump plus 1.
+	Sequence int `json:"sequence"`
+	// Columns are the IncrementalColumns of the tables, by 'db.table',
+	// dumped from their rows at or after Since only.
+	Columns map[string]string `json:"columns,omitempty"`
+	// Recreated are the tables, 'db.table', created since, or again like by
+	// an ALTER TABLE which rebuilt them: they are dumped with all their rows,
+	// the loader drops them first.
+	Recreated []string `json:"recreated,omitempty"`
+	// Unchanged are the tables, 'db.table', not dumped.
+	Unchanged []string `json:"unchanged,omitempty"`
+}
+
+// The changes of a table since the previous dump of an incremental one, see
+// tableChange.
+const (
+	tableUnchanged = iota
+	tableChanged
+	tableRecreated
+)
+
+// incrementalBase is the previous dump of DumpArgs.IncrementalFrom.
+type incrementalBase struct {
+	manifest *Manifest
+	// columns are the IncrementalColumns of the tables dumped from their
+	// rows at or after the snapshot of the previous dump, by table.
+	columns map[string]string
+}
+
+// since returns the snapshot time of the previous dump.
+func (b *incrementalBase) since() string {
+	return b.manifest.Consistency.SnapshotTime
+}
+
+// incrementalDir returns the dump directory of a DumpArgs.IncrementalFrom,
+// the directory of its manifest.json or itself.
+func incrementalDir(from string) string {
+	if from == manifestFile {
+		return "."
+	}
+	return strings.TrimSuffix(from, "/"+manifestFile)
+}
+
+// readIncrementalBase reads the manifest.json of the previous dump of an
+// incremental one: it must have a consistent point with a GTID set and a
+// snapshot time, and no table left out by a MaxRuntime.
+func readIncrementalBase(from string) (*incrementalBase, error) {
+	s, err := OpenStorage(incrementalDir(from))
+	if err != nil {
+		return nil, wrapf(err, "dumping.incremental.from[%s].error:%v", from, err)
+	}
+	m, err := readManifest(s)
+	if err != nil {
+		return nil, wrapf(err, "dumping.incremental.from[%s].manifest.error:%v", from, err)
+	}
+	switch {
+	case m.Consistency == nil || m.Consistency.GTIDSet == "":
+		return nil, fmt.Errorf("dumping.incremental.from[%s].has.no.gtid.set, it needs a dump with -consistency lock or gtid of a server with GTIDs", from)
+	case m.Consistency.SnapshotTime == "":
+		return nil, fmt.Errorf("dumping.incremental.from[%s].has.no.snapshot.time, it was dumped by an older version", from)
+	case len(m.NotDumped) > 0:
+		return nil, fmt.Errorf("dumping.incremental.from[%s].is.partial.tables[%d].not.dumped, resume it first", from, len(m.NotDumped))
+	}
+	return &incrementalBase{manifest: m, columns: make(map[string]string)}, nil
+}
+
+// tableChange returns how a table changed since the snapshot time of the
+// previous dump, from its information_schema times, empty if unknown:
+// recreated if the previous dump doesn't have it or its CREATE_TIME is at or
+// after since, changed if its UPDATE_TIME is or is unknown, like after a
+// restart of the server. The times have the format of NOW(), they compare as
+// strings.
+func tableChange(dumped bool, updated string, created string, since string) int {
+	switch {
+	case !dumped || (created != "" && created >= since):
+		return tableRecreated
+	case updated == "" || updated >= since:
+		return tableChanged
+	}
+	return tableUnchanged
+}
+
+// incrementalTables returns the tables of the dump of args changed since the
+// previous dump of its IncrementalFrom, read on conn in the snapshot of the
+// dump, and its place in the chain for its manifest.json. point is the one of
+// the dump: its GTID set must hold the one of the previous dump, else the
+// previous dump is not of this server nor of its replication topology. The
+// IncrementalColumns of the changed tables whose MAX is at or after the
+// snapshot time of the previous dump are kept for incrementalWhere, the
+// other tables are unchanged.
+func incrementalTables(log *xlog.Log, conn *Connection, args *DumpArgs, point *ConsistentPoint, tables []string) (*ManifestIncremental, []string, error) {
+	base := args.incremental
+	prev := base.manifest
+	if point == nil || point.GTIDSet == "" {
+		return nil, nil, fmt.Errorf("dumping.incremental.needs.a.gtid.set, the server has no GTIDs")
+	}
+	from := prev.Consistency.GTIDSet
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT GTID_SUBSET('%s', '%s')", EscapeBytes([]byte(from)), EscapeBytes([]byte(point.GTIDSet))))
+	if err != nil {
+		return nil, nil, wrapf(err, "dumping.incremental.gtid.subset.error:%v", err)
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 || qr.Rows[0][0].String() != "1" {
+		return nil, nil, fmt.Errorf("dumping.incremental.from[%s].gtid.set[%s].not.in.the.gtid.set[%s].of.the.server, it's not a dump of this server", args.IncrementalFrom, from, point.GTIDSet)
+	}
+	// MySQL 8.0 caches the times of information_schema.TABLES for a day by
+	// default, the older servers have no cache.
+	if err := conn.Execute("SET SESSION information_schema_stats_expiry=0"); err != nil {
+		log.Info("dumping.incremental.stats.expiry.not.set:%v", err)
+	}
+	qr, err = conn.Fetch(fmt.Sprintf("SELECT TABLE_NAME, UPDATE_TIME, CREATE_TIME FROM information_schema.TABLES WHERE TABLE_SCHEMA='%s'", EscapeBytes([]byte(args.Database))))
+	if err != nil {
+		return nil, nil, wrapf(err, "dumping.incremental.table.times.error:%v", err)
+	}
+	times := make(map[string][2]string)
+	for _, row := range qr.Rows {
+		if len(row) >= 3 {
+			times[row[0].String()] = [2]string{row[1].String(), row[2].String()}
+		}
+	}
+	// The tables of the chain, the ones an incremental left unchanged too.
+	dumped := make(map[string]bool)
+	for _, t := range prev.Tables {
+		if t.Database == args.Database {
+			dumped[t.Table] = true
+		}
+	}
+	if prev.Incremental != nil {
+		for _, name := range prev.Incremental.Unchanged {
+			if db, table := splitTableName(name); db == args.Database {
+				dumped[table] = true
+			}
+		}
+	}
+
+	since := base.since()
+	inc := &ManifestIncremental{From: args.IncrementalFrom, FromGTIDSet: from, Since: since, Sequence: 1}
+	if prev.Incremental != nil {
+		inc.Sequence = prev.Incremental.Sequence + 1
+	}
+	var changed []string
+	for _, table := range tables {
+		name := args.Database + "." + table
+		t := times[table]
+		switch tableChange(dumped[table], t[0], t[1], since) {
+		case tableUnchanged:
+			inc.Unchanged = append(inc.Unchanged, name)
+			continue
+		case tableRecreated:
+			inc.Recreated = append(inc.Recreated, name)
+		case tableChanged:
+			column := args.IncrementalColumns[name]
+			if column == "" {
+				break
+			}
+			qr, err := conn.Fetch(fmt.Sprintf("SELECT MAX(%s) >= '%s' FROM `%s`.`%s`", quoteIdentifier(column), EscapeBytes([]byte(since)), args.Database, table))
+			if err != nil {
+				return nil, nil, wrapf(err, "dumping.incremental.table[%s].column[%s].error:%v", name, column, err)
+			}
+			if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 || qr.Rows[0][0].String() != "1" {
+				inc.Unchanged = append(inc.Unchanged, name)
+				continue
+			}
+			base.columns[table] = column
+			if inc.Columns == nil {
+				inc.Columns = make(map[string]string)
+			}
+			inc.Columns[name] = column
+		}
+		changed = append(changed, table)
+	}
+	log.Info("dumping.incremental[%d].from[%s].since[%s].tables.changed[%d].recreated[%d].unchanged[%d]", inc.Sequence, args.IncrementalFrom, since, len(changed), len(inc.Recreated), len(inc.Unchanged))
+	return inc, changed, nil
+}
+
+// incrementalWhere returns the WHERE selecting the rows of the table an
+// incremental dump reads by its IncrementalColumns, empty for all.
+func (args *DumpArgs) incrementalWhere(table string) string {
+	if args.incremental == nil {
+		return ""
+	}
+	column, ok := args.incremental.columns[table]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s >= '%s'", quoteIdentifier(column), EscapeBytes([]byte(args.incremental.since())))
+}
+
+// rowsWhere returns the WHERE selecting the rows of the table the dump reads,
+// the one of its subset or of its IncrementalColumns, empty for all of them.
+func (args *DumpArgs) rowsWhere(table string) string {
+	if where := args.subsetWhere(table); where != "" {
+		return where
+	}
+	return args.incrementalWhere(table)
+}
+
+// wholeTable reports whether the dump reads every row of a table: not a
+// selection of its partitions, nor of its rows by SubsetSeeds or
+// IncrementalFrom.
+func (args *DumpArgs) wholeTable(table string) bool {
+	return len(args.tablePartitions(table)) == 0 && args.rowsWhere(table) == ""
+}
+
+// readIncrementalChain reads the manifest.json of the dump of dir and of its
+// incrementals, see checkIncrementalChain.
+func readIncrementalChain(dir string, incrementals []string) ([]*Manifest, error) {
+	dirs := append([]string{dir}, incrementals...)
+	chain := make([]*Manifest, 0, len(dirs))
+	for _, d := range dirs {
+		s, err := OpenStorage(d)
+		if err != nil {
+			return nil, err
+		}
+		m, err := readManifest(s)
+		if err != nil {
+			return nil, wrapf(err, "restoring.incremental.dump[%s].manifest.error:%v", d, err)
+		}
+		chain = append(chain, m)
+	}
+	return chain, checkIncrementalChain(dirs, chain)
+}
+
+// checkIncrementalChain checks the manifests of the dumps of dirs restored in
+// this order: the first is a full dump, every other the next incremental of
+// the one before it, from its GTID set.
+func checkIncrementalChain(dirs []string, chain []*Manifest) error {
+	if inc := chain[0].Incremental; inc != nil {
+		return fmt.Errorf("restoring.incremental.base[%s].is.the.incremental[%d].of[%s], restore the chain from its full dump", dirs[0], inc.Sequence, inc.From)
+	}
+	for i := 1; i < len(chain); i++ {
+		prev, inc := chain[i-1], chain[i].Incremental
+		gtid, sequence := "", 0
+		if prev.Consistency != nil {
+			gtid = prev.Consistency.GTIDSet
+		}
+		if prev.Incremental != nil {
+			sequence = prev.Incremental.Sequence
+		}
+		switch {
+		case inc == nil:
+			return fmt.Errorf("restoring.incremental[%s].is.not.an.incremental.dump", dirs[i])
+		case gtid == "":
+			return fmt.Errorf("restoring.incremental.dump[%s].has.no.gtid.set, no incremental follows it", dirs[i-1])
+		case inc.FromGTIDSet != gtid:
+			return fmt.Errorf("restoring.incremental[%s].from.gtid.set[%s].is.not.the.gtid.set[%s].of[%s], the dumps are not in the order of their chain", dirs[i], inc.FromGTIDSet, gtid, dirs[i-1])
+		case inc.Sequence != sequence+1:
+			return fmt.Errorf("restoring.incremental[%s].sequence[%d].does.not.follow.the.sequence[%d].of[%s]", dirs[i], inc.Sequence, sequence, dirs[i-1])
+		}
+	}
+	return nil
+}
+
+// incrementalPasses returns the LoadArgs of the restores of the dump of args
+// and of its Incrementals, in order, chain their manifests. The incrementals
+// keep the existing tables but their Recreated ones, and restore their
+// INSERTs as upserts. The phases after the datas run with the last one.
+func incrementalPasses(args *LoadArgs, chain []*Manifest) []*LoadArgs {
+	dirs := append([]string{args.Outdir}, args.Incrementals...)
+	passes := make([]*LoadArgs, len(dirs))
+	for i, dir := range dirs {
+		pass := *args
+		pass.Outdir = dir
+		pass.Incrementals = nil
+		if i < len(dirs)-1 {
+			pass.Grants = false
+			pass.WarmTables = nil
+			pass.OptimizeTables = nil
+			pass.PostSQL = nil
+		}
+		if i > 0 {
+			pass.incremental = true
+			pass.Volumes = nil
+			pass.ExpectTables = nil
+			pass.CreateIfNotExists = true
+			pass.OverwriteTables = false
+			pass.Upsert = true
+			pass.recreate = make(map[string]bool)
+			for _, name := range chain[i].Incremental.Recreated {
+				pass.recreate[name] = true
+			}
+		}
+		passes[i] = &pass
+	}
+	return passes
+}
+
+// loadIncrementals restores the dump of args then its Incrementals, in
+// order, once their chain is checked, see LoadArgs.Incrementals. The first
+// restore which fails stops the chain.
+func loadIncrementals(ctx context.Context, log *xlog.Log, args *LoadArgs) error {
+	chain, err := readIncrementalChain(args.Outdir, args.Incrementals)
+	if err != nil {
+		return err
+	}
+	for i, pass := range incrementalPasses(args, chain) {
+		if inc := chain[i].Incremental; inc != nil {
+			log.Info("restoring.incremental[%d].dir[%s].since[%s].recreated[%d].unchanged[%d]...", inc.Sequence, pass.Outdir, inc.Since, len(inc.Recreated), len(inc.Unchanged))
+		} else {
+			log.Info("restoring.incremental.base[%s].incrementals[%d]...", pass.Outdir, len(chain)-1)
+		}
+		if err := load(ctx, log, pass); err != nil {
+			return err
+		}
+	}
+	log.Info("restoring.incremental.chain[%d].done", len(chain))
+	return nil
+}
+
+// checkDumpIncremental warns about the restore of an incremental dump on its
+// own: the tables it left unchanged are not in it.
+func checkDumpIncremental(log *xlog.Log, s Storage, args *LoadArgs) {
+	if args.incremental {
+		return
+	}
+	m, err := readManifest(s)
+	if err != nil || m.Incremental == nil {
+		return
+	}
+	log.Warning("restoring.dump.is.the.incremental[%d].of[%s].without.its.unchanged.tables[%d], restore it with -incremental after its chain", m.Incremental.Sequence, m.Incremental.From, len(m.Incremental.Unchanged))
+}
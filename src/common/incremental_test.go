@@ -0,0 +1,332 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableChange(t *testing.T) {
+	const since = "2024-03-01 00:00:00"
+	for _, tc := range []struct {
+		dumped           bool
+		updated, created string
+		want             int
+	}{
+		{true, "2024-02-28 12:00:00", "2024-01-01 00:00:00", tableUnchanged},
+		{true, "2024-03-01 00:00:00", "2024-01-01 00:00:00", tableChanged},
+		{true, "2024-03-05 08:00:00", "2024-01-01 00:00:00", tableChanged},
+		// Unknown, like after a restart.
+		{true, "", "2024-01-01 00:00:00", tableChanged},
+		{true, "", "", tableChanged},
+		{true, "2024-02-28 12:00:00", "2024-03-02 00:00:00", tableRecreated},
+		{false, "2024-02-28 12:00:00", "2024-01-01 00:00:00", tableRecreated},
+	} {
+		assert.Equal(t, tc.want, tableChange(tc.dumped, tc.updated, tc.created, since), tc.updated+"/"+tc.created)
+	}
+}
+
+// incrementalServer answers the queries of incrementalTables.
+type incrementalServer struct {
+	// subset is the GTID_SUBSET of the previous set.
+	subset string
+	// times are the UPDATE_TIME and CREATE_TIME of the tables.
+	times map[string][2]string
+	// max is whether the MAX of the column of a table is at or after since.
+	max     map[string]string
+	queries []string
+}
+
+var maxTableRegexp = regexp.MustCompile("FROM `shop`.`(\\w+)`$")
+
+func (s *incrementalServer) executor(id int) (Executor, error) {
+	return s, nil
+}
+
+func (s *incrementalServer) Execute(query string) error {
+	s.queries = append(s.queries, query)
+	return nil
+}
+
+func (s *incrementalServer) Fetch(query string) (*sqltypes.Result, error) {
+	s.queries = append(s.queries, query)
+	switch {
+	case strings.HasPrefix(query, "SELECT GTID_SUBSET("):
+		return singleResult("GTID_SUBSET", s.subset), nil
+	case strings.HasPrefix(query, "SELECT TABLE_NAME, UPDATE_TIME, CREATE_TIME"):
+		var rows [][]string
+		for table, t := range s.times {
+			rows = append(rows, []string{table, t[0], t[1]})
+		}
+		return stringsResult([]string{"TABLE_NAME", "UPDATE_TIME", "CREATE_TIME"}, rows...), nil
+	case strings.HasPrefix(query, "SELECT MAX("):
+		return stringsResult([]string{"MAX"}, []string{s.max[maxTableRegexp.FindStringSubmatch(query)[1]]}), nil
+	}
+	return stringsResult(nil), nil
+}
+
+func (s *incrementalServer) Ping() error {
+	return nil
+}
+
+func (s *incrementalServer) Close() error {
+	return nil
+}
+
+// incrementalDump runs incrementalTables of the tables of shop from the dump
+// of from on s, at point, and writes the manifest.json of the dump into dir.
+func incrementalDump(t *testing.T, s *incrementalServer, from string, columns map[string]string, point *ConsistentPoint, dir string, tables []string) (*DumpArgs, *ManifestIncremental, []string, error) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := &DumpArgs{Database: "shop", IncrementalFrom: from, IncrementalColumns: columns}
+	var err error
+	if args.incremental, err = readIncrementalBase(from); err != nil {
+		return nil, nil, nil, err
+	}
+	pool, err := NewExecutorPool(log, 1, s.executor)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	inc, changed, err := incrementalTables(log, conn, args, point, tables)
+	pool.Put(conn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	writeTestManifest(t, dir, point, inc, changed)
+	return args, inc, changed, nil
+}
+
+func writeTestManifest(t *testing.T, dir string, point *ConsistentPoint, inc *ManifestIncremental, tables []string) {
+	os.RemoveAll(dir)
+	assert.Nil(t, os.MkdirAll(dir, 0777))
+	m := newManifest()
+	m.Consistency = point
+	m.Incremental = inc
+	for _, table := range tables {
+		m.addTable("shop", table, "CREATE TABLE `"+table+"` (`id` int NOT NULL, PRIMARY KEY (`id`)) ENGINE=InnoDB")
+	}
+	assert.Nil(t, m.write(NewDirStorage(dir)))
+}
+
+// A full dump and two incrementals of it, dumped then chained by the loader.
+func TestIncrementalChain(t *testing.T) {
+	root := "/tmp/incrementaltest"
+	os.RemoveAll(root)
+	base, inc1, inc2 := root+"/base", root+"/inc1", root+"/inc2"
+	const uuid = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	writeTestManifest(t, base, &ConsistentPoint{Mode: ConsistencyLock, GTIDSet: uuid + ":1-100", SnapshotTime: "2024-03-01 00:00:00"}, nil, []string{"t1", "t2", "t3"})
+
+	// The first incremental: t1 and t2 written since, t3 not, t4 created.
+	s := &incrementalServer{
+		subset: "1",
+		times: map[string][2]string{
+			"t1": {"2024-03-01 05:00:00", "2024-01-01 00:00:00"},
+			"t2": {"2024-03-01 06:00:00", "2024-01-01 00:00:00"},
+			"t3": {"2024-02-28 23:59:59", "2024-01-01 00:00:00"},
+			"t4": {"2024-03-01 07:00:00", "2024-03-01 07:00:00"},
+		},
+		max: map[string]string{"t2": "1"},
+	}
+	point1 := &ConsistentPoint{Mode: ConsistencyGTID, GTIDSet: uuid + ":1-150", SnapshotTime: "2024-03-02 00:00:00"}
+	args, inc, changed, err := incrementalDump(t, s, base, map[string]string{"shop.t2": "updated_at"}, point1, inc1, []string{"t1", "t2", "t3", "t4"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"t1", "t2", "t4"}, changed)
+	assert.Equal(t, &ManifestIncremental{
+		From:        base,
+		FromGTIDSet: uuid + ":1-100",
+		Since:       "2024-03-01 00:00:00",
+		Sequence:    1,
+		Columns:     map[string]string{"shop.t2": "updated_at"},
+		Recreated:   []string{"shop.t4"},
+		Unchanged:   []string{"shop.t3"},
+	}, inc)
+	assert.Equal(t, "SELECT GTID_SUBSET('"+uuid+":1-100', '"+uuid+":1-150')", s.queries[0])
+	assert.Equal(t, "SET SESSION information_schema_stats_expiry=0", s.queries[1])
+	assert.Equal(t, "SELECT MAX(`updated_at`) >= '2024-03-01 00:00:00' FROM `shop`.`t2`", s.queries[3])
+	assert.Equal(t, "`updated_at` >= '2024-03-01 00:00:00'", args.rowsWhere("t2"))
+	assert.Equal(t, "", args.rowsWhere("t1"))
+
+	// The second one, from the manifest.json of the first: t3 unchanged by
+	// the first was altered since, t2 was written without a row of its
+	// column since, t1 is unchanged.
+	s = &incrementalServer{
+		subset: "1",
+		times: map[string][2]string{
+			"t1": {"2024-03-01 05:00:00", "2024-01-01 00:00:00"},
+			"t2": {"", "2024-01-01 00:00:00"},
+			"t3": {"2024-02-28 23:59:59", "2024-03-02 01:00:00"},
+			"t4": {"2024-03-02 03:00:00", "2024-03-01 07:00:00"},
+		},
+		max: map[string]string{"t2": "0"},
+	}
+	point2 := &ConsistentPoint{Mode: ConsistencyGTID, GTIDSet: uuid + ":1-180", SnapshotTime: "2024-03-03 00:00:00"}
+	_, inc, changed, err = incrementalDump(t, s, inc1+"/manifest.json", map[string]string{"shop.t2": "updated_at"}, point2, inc2, []string{"t1", "t2", "t3", "t4"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"t3", "t4"}, changed)
+	assert.Equal(t, 2, inc.Sequence)
+	assert.Equal(t, uuid+":1-150", inc.FromGTIDSet)
+	assert.Equal(t, "2024-03-02 00:00:00", inc.Since)
+	assert.Equal(t, []string{"shop.t3"}, inc.Recreated)
+	assert.Equal(t, []string{"shop.t1", "shop.t2"}, inc.Unchanged)
+	assert.Nil(t, inc.Columns)
+
+	// A server which didn't execute the previous set, or has no GTIDs.
+	{
+		_, _, _, err := incrementalDump(t, &incrementalServer{subset: "0"}, inc2, nil, &ConsistentPoint{GTIDSet: "7a1b:1-3", SnapshotTime: "2024-03-04 00:00:00"}, root+"/other", []string{"t1"})
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), ".not.in.the.gtid.set[7a1b:1-3].of.the.server"), err.Error())
+		_, _, _, err = incrementalDump(t, &incrementalServer{subset: "1"}, inc2, nil, &ConsistentPoint{}, root+"/other", []string{"t1"})
+		assert.NotNil(t, err)
+	}
+
+	// The loader restores the chain in its order only.
+	chain, err := readIncrementalChain(base, []string{inc1, inc2})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(chain))
+	for _, tc := range []struct {
+		dir          string
+		incrementals []string
+		want         string
+	}{
+		{base, []string{inc2, inc1}, "restoring.incremental[/tmp/incrementaltest/inc2].from.gtid.set[" + uuid + ":1-150].is.not.the.gtid.set[" + uuid + ":1-100].of[/tmp/incrementaltest/base]"},
+		{base, []string{inc2}, "restoring.incremental[/tmp/incrementaltest/inc2].from.gtid.set"},
+		{base, []string{base}, "restoring.incremental[/tmp/incrementaltest/base].is.not.an.incremental.dump"},
+		{inc1, []string{inc2}, "restoring.incremental.base[/tmp/incrementaltest/inc1].is.the.incremental[1].of[/tmp/incrementaltest/base]"},
+		{base, []string{root + "/none"}, "restoring.incremental.dump[/tmp/incrementaltest/none].manifest.error"},
+	} {
+		_, err := readIncrementalChain(tc.dir, tc.incrementals)
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), tc.want), err.Error())
+	}
+	// A sequence out of order with the right set.
+	{
+		chain[2].Incremental.Sequence = 3
+		err := checkIncrementalChain([]string{base, inc1, inc2}, chain)
+		assert.Equal(t, "restoring.incremental[/tmp/incrementaltest/inc2].sequence[3].does.not.follow.the.sequence[1].of[/tmp/incrementaltest/inc1]", err.Error())
+		chain[2].Incremental.Sequence = 2
+	}
+
+	// The incrementals upsert into the existing tables, the phases after
+	// the datas run with the last one.
+	largs := &LoadArgs{Outdir: base, Incrementals: []string{inc1, inc2}, Grants: true, Upsert: true, PostSQL: []string{"post.sql"}, ExpectTables: []string{"shop"}, OptimizeTables: []string{OptimizeAll}}
+	passes := incrementalPasses(largs, chain)
+	assert.Equal(t, 3, len(passes))
+	assert.Equal(t, base, passes[0].Outdir)
+	assert.False(t, passes[0].incremental)
+	assert.True(t, passes[0].Upsert)
+	assert.Equal(t, []string{"shop"}, passes[0].ExpectTables)
+	assert.False(t, passes[0].Grants || passes[1].Grants)
+	assert.Nil(t, passes[1].PostSQL)
+	assert.Nil(t, passes[1].OptimizeTables)
+	assert.Equal(t, inc2, passes[2].Outdir)
+	assert.True(t, passes[2].Grants)
+	assert.Equal(t, []string{"post.sql"}, passes[2].PostSQL)
+	for i, want := range []map[string]bool{nil, {"shop.t4": true}, {"shop.t3": true}} {
+		assert.Equal(t, want, passes[i].recreate)
+		assert.Nil(t, passes[i].Incrementals)
+		if i > 0 {
+			assert.True(t, passes[i].incremental && passes[i].CreateIfNotExists && passes[i].Upsert)
+			assert.Nil(t, passes[i].ExpectTables)
+		}
+	}
+}
+
+func TestReadIncrementalBase(t *testing.T) {
+	dir := "/tmp/incrementalbasetest"
+	assert.Equal(t, dir, incrementalDir(dir+"/manifest.json"))
+	assert.Equal(t, "s3://backups/shop", incrementalDir("s3://backups/shop/manifest.json"))
+	assert.Equal(t, ".", incrementalDir("manifest.json"))
+
+	for _, tc := range []struct {
+		point *ConsistentPoint
+		want  string
+	}{
+		{nil, "dumping.incremental.from[/tmp/incrementalbasetest].has.no.gtid.set"},
+		{&ConsistentPoint{Mode: ConsistencyLock, BinlogFile: "mysql-bin.000003"}, "dumping.incremental.from[/tmp/incrementalbasetest].has.no.gtid.set"},
+		{&ConsistentPoint{Mode: ConsistencyLock, GTIDSet: "7a1b:1-3"}, "dumping.incremental.from[/tmp/incrementalbasetest].has.no.snapshot.time"},
+	} {
+		writeTestManifest(t, dir, tc.point, nil, []string{"t1"})
+		_, err := readIncrementalBase(dir)
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), tc.want), err.Error())
+	}
+	os.RemoveAll(dir)
+	_, err := readIncrementalBase(dir)
+	assert.NotNil(t, err)
+}
+
+// A parent and a child table referencing it, restored from a full dump and
+// two incrementals: the changed parent rows are updated in place, a REPLACE
+// would delete them first, failing on the child rows of a RESTRICT key or
+// deleting them with a CASCADE one.
+func TestIncrementalForeignKeys(t *testing.T) {
+	root := "/tmp/incrementalfktest"
+	os.RemoveAll(root)
+	base, inc1, inc2 := root+"/base", root+"/inc1", root+"/inc2"
+	const uuid = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+	writeTestManifest(t, base, &ConsistentPoint{Mode: ConsistencyGTID, GTIDSet: uuid + ":1-100", SnapshotTime: "2024-03-01 00:00:00"}, nil, []string{"parent", "child"})
+	writeTestManifest(t, inc1, &ConsistentPoint{Mode: ConsistencyGTID, GTIDSet: uuid + ":1-150", SnapshotTime: "2024-03-02 00:00:00"},
+		&ManifestIncremental{From: base, FromGTIDSet: uuid + ":1-100", Since: "2024-03-01 00:00:00", Sequence: 1, Unchanged: []string{"shop.child"}}, []string{"parent"})
+	writeTestManifest(t, inc2, &ConsistentPoint{Mode: ConsistencyGTID, GTIDSet: uuid + ":1-180", SnapshotTime: "2024-03-03 00:00:00"},
+		&ManifestIncremental{From: inc1, FromGTIDSet: uuid + ":1-150", Since: "2024-03-02 00:00:00", Sequence: 2}, []string{"parent", "child"})
+	parent := "CREATE TABLE `parent` (\n  `id` int NOT NULL,\n  `name` varchar(10) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n"
+	child := "CREATE TABLE `child` (\n  `id` int NOT NULL,\n  `parent_id` int NOT NULL,\n  PRIMARY KEY (`id`),\n  CONSTRAINT `fk_child_parent` FOREIGN KEY (`parent_id`) REFERENCES `parent` (`id`) ON DELETE CASCADE\n) ENGINE=InnoDB;\n"
+	for dir, files := range map[string]map[string]string{
+		base: {
+			"shop.parent-schema.sql": parent,
+			"shop.parent.00001.sql":  "INSERT INTO `parent` VALUES (1,'a'),(2,'b');\n",
+			"shop.child-schema.sql":  child,
+			"shop.child.00001.sql":   "INSERT INTO `child` VALUES (10,1),(11,2);\n",
+		},
+		inc1: {
+			"shop.parent-schema.sql": parent,
+			"shop.parent.00001.sql":  "INSERT INTO `parent` VALUES (1,'a1');\n",
+		},
+		inc2: {
+			"shop.parent-schema.sql": parent,
+			"shop.parent.00001.sql":  "INSERT INTO `parent` VALUES (1,'a2'),(2,'b2');\n",
+			"shop.child-schema.sql":  child,
+			"shop.child.00001.sql":   "INSERT INTO `child` VALUES (11,1),(12,2);\n",
+		},
+	} {
+		files["shop-schema-create.sql"] = "CREATE DATABASE IF NOT EXISTS `shop`;"
+		for name, sql := range files {
+			x := WriteFile(dir+"/"+name, sql)
+			AssertNil(x)
+		}
+	}
+
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	r := &recordingExecutor{}
+	args := LoadArgs{Outdir: base, Incrementals: []string{inc1, inc2}, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+	_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: r.executor}).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, matchingQueries(r.queries, "REPLACE"))
+	// The files of a pass are restored in any order, the passes in order.
+	inserts := matchingQueries(r.queries, "INSERT")
+	assert.Equal(t, 5, len(inserts))
+	sort.Strings(inserts[:2])
+	sort.Strings(inserts[3:])
+	assert.Equal(t, []string{
+		"INSERT INTO `child` VALUES (10,1),(11,2)",
+		"INSERT INTO `parent` VALUES (1,'a'),(2,'b')",
+		"INSERT INTO `parent` VALUES (1,'a1') ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)",
+		"INSERT INTO `child` VALUES (11,1),(12,2) ON DUPLICATE KEY UPDATE `parent_id`=VALUES(`parent_id`)",
+		"INSERT INTO `parent` VALUES (1,'a2'),(2,'b2') ON DUPLICATE KEY UPDATE `name`=VALUES(`name`)",
+	}, inserts)
+}
@@ -0,0 +1,100 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// byteSemaphore bounds the bytes of the data files held in memory at once,
+// see LoadArgs.MaxInFlightBytes, or of the statements being executed, see
+// LoadArgs.MaxMemory. A file or a statement larger than the bound takes all
+// of it, so it runs once nothing else is in flight instead of never.
+type byteSemaphore struct {
+	mu   sync.Mutex
+	ctx  context.Context
+	max  int64
+	used int64
+	// freed is closed, and replaced, by every release, to wake the acquires
+	// waiting for room.
+	freed chan struct{}
+	// waited is the time acquire waited for room.
+	waited time.Duration
+}
+
+// newByteSemaphore bounds the bytes to max until ctx is done, nil if max is
+// less than 1: a nil semaphore bounds nothing.
+func newByteSemaphore(ctx context.Context, max int64) *byteSemaphore {
+	if max < 1 {
+		return nil
+	}
+	return &byteSemaphore{ctx: ctx, max: max, freed: make(chan struct{})}
+}
+
+// acquire waits until n bytes are free and takes them, it returns the bytes
+// to release. It gives up with the error of the ctx of the semaphore once
+// it's done, nothing taken.
+func (s *byteSemaphore) acquire(n int64) (int64, error) {
+	if s == nil {
+		return 0, nil
+	}
+	if n > s.max {
+		n = s.max
+	}
+	var start time.Time
+	for {
+		s.mu.Lock()
+		if s.used+n <= s.max {
+			s.used += n
+			if !start.IsZero() {
+				s.waited += time.Since(start)
+			}
+			s.mu.Unlock()
+			return n, nil
+		}
+		if start.IsZero() {
+			start = time.Now()
+		}
+		freed := s.freed
+		s.mu.Unlock()
+		select {
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			s.waited += time.Since(start)
+			s.mu.Unlock()
+			return 0, s.ctx.Err()
+		case <-freed:
+		}
+	}
+}
+
+// release gives back the bytes of an acquire.
+func (s *byteSemaphore) release(n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used -= n
+	close(s.freed)
+	s.freed = make(chan struct{})
+}
+
+// waitedFor returns the time the workers waited for room.
+func (s *byteSemaphore) waitedFor() time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waited
+}
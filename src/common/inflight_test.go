@@ -0,0 +1,197 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlightBytes(t *testing.T) {
+	s := newByteSemaphore(context.Background(), 100)
+	var mu sync.Mutex
+	var inflight, peak int64
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+			held, err := s.acquire(size)
+			assert.Nil(t, err)
+			defer s.release(held)
+			mu.Lock()
+			inflight += size
+			if inflight > peak {
+				peak = inflight
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			inflight -= size
+			mu.Unlock()
+		}(int64(10 + i*7%50))
+	}
+	wg.Wait()
+	assert.True(t, peak <= 100)
+	assert.True(t, peak > 10)
+	assert.True(t, s.waitedFor() > 0)
+	assert.Equal(t, int64(0), s.used)
+}
+
+func TestInFlightBytesLargeFile(t *testing.T) {
+	s := newByteSemaphore(context.Background(), 100)
+
+	// A file larger than the bound waits for all the others.
+	held, err := s.acquire(30)
+	assert.Nil(t, err)
+	done := make(chan int64)
+	go func() {
+		n, err := s.acquire(500)
+		assert.Nil(t, err)
+		done <- n
+	}()
+	select {
+	case <-done:
+		t.Fatal("acquired with 30 bytes in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.release(held)
+	assert.Equal(t, int64(100), <-done)
+
+	// No bound.
+	var none *byteSemaphore
+	n, err := none.acquire(500)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	none.release(0)
+	assert.Nil(t, newByteSemaphore(context.Background(), 0))
+}
+
+func TestInFlightBytesCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newByteSemaphore(ctx, 100)
+	held, err := s.acquire(80)
+	assert.Nil(t, err)
+
+	// A done ctx stops the wait, nothing taken.
+	done := make(chan error)
+	go func() {
+		_, err := s.acquire(50)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("acquired with 80 bytes in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, held, s.used)
+	s.release(held)
+	assert.Equal(t, int64(0), s.used)
+}
+
+// peakExecutor is a recordingExecutor which takes its time on the INSERTs and
+// records the peak of their bytes in flight at once, the INSERTs of more than
+// bound bytes apart: alone are the bytes in flight with each of them.
+type peakExecutor struct {
+	recordingExecutor
+	inflight int64
+	peak     int64
+	alone    map[int]int64
+	bound    int
+}
+
+func (p *peakExecutor) executor(id int) (Executor, error) {
+	return &peakConn{recordingConn: recordingConn{r: &p.recordingExecutor}, p: p}, nil
+}
+
+type peakConn struct {
+	recordingConn
+	p *peakExecutor
+}
+
+func (c *peakConn) Execute(query string) error {
+	if !strings.HasPrefix(query, "INSERT") {
+		return c.recordingConn.Execute(query)
+	}
+	n := int64(len(query))
+	c.p.mu.Lock()
+	c.p.inflight += n
+	if len(query) > c.p.bound {
+		c.p.alone[len(query)] = c.p.inflight
+	} else if c.p.inflight > c.p.peak {
+		c.p.peak = c.p.inflight
+	}
+	c.p.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.p.mu.Lock()
+	c.p.inflight -= n
+	c.p.mu.Unlock()
+	return c.recordingConn.Execute(query)
+}
+
+func TestLoaderMaxMemory(t *testing.T) {
+	dir := "/tmp/loadermaxmemory"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/shop-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `shop`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/shop.t1-schema.sql", "CREATE TABLE `t1` (`a` text) ENGINE=InnoDB;")
+	AssertNil(x)
+	// Files of 3 statements of 1000 bytes, and one with a statement of 5000
+	// larger than the bound.
+	insert := func(size int) string {
+		head := "INSERT INTO `t1` VALUES ('"
+		return head + strings.Repeat("x", size-len(head)-2) + "')"
+	}
+	for i := 1; i <= 8; i++ {
+		sql := strings.Repeat(insert(1000)+";\n", 3)
+		if i == 8 {
+			sql = insert(1000) + ";\n" + insert(5000) + ";\n"
+		}
+		x := WriteFile(fmt.Sprintf("%s/shop.t1.%05d.sql", dir, i), sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 4, IntervalMs: 500, CreateIfNotExists: true}
+
+	// A bound of 2500 bytes for 4 threads of 1000 bytes statements: 2 at
+	// once, the larger one alone.
+	{
+		args := args
+		args.MaxMemory = 2500
+		p := &peakExecutor{alone: make(map[int]int64), bound: 2500}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: p.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 23, len(matchingQueries(p.queries, "INSERT")))
+		assert.True(t, p.peak <= 2000)
+		assert.True(t, p.peak >= 1000)
+		assert.Equal(t, map[int]int64{5000: 5000}, p.alone)
+	}
+
+	// Without a bound, the threads hold as many as they execute.
+	{
+		p := &peakExecutor{alone: make(map[int]int64), bound: 2500}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: p.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 23, len(matchingQueries(p.queries, "INSERT")))
+		assert.True(t, p.peak > 2000)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+// invisibleRegexp matches the INVISIBLE attribute of a column definition,
+// MySQL 8.0.23 and later show it as '/*!80023 INVISIBLE */'.
+var invisibleRegexp = regexp.MustCompile(`(?i)\bINVISIBLE\b`)
+
+// invisibleColumns returns the quoted names of the INVISIBLE columns of a
+// create table statement, in their order. SELECT * leaves them out, so the
+// dumper has to name them.
+func invisibleColumns(schema string) []string {
+	var columns []string
+	for _, def := range tableDefinitions(schema) {
+		name, attrs, ok := columnDefinition(def)
+		if ok && invisibleRegexp.MatchString(attrs) {
+			columns = append(columns, name)
+		}
+	}
+	return columns
+}
+
+// tableDefinitions returns the definitions of the columns and indexes of a
+// create table statement, split on the commas of its outer parentheses.
+func tableDefinitions(schema string) []string {
+	var defs []string
+	for _, span := range tableDefinitionSpans(schema) {
+		defs = append(defs, strings.TrimSpace(schema[span[0]:span[1]]))
+	}
+	return defs
+}
+
+// tableDefinitionSpans returns the start and the end in schema of the
+// definitions of tableDefinitions, with the spaces around them.
+func tableDefinitionSpans(schema string) [][2]int {
+	var spans [][2]int
+	depth := -1
+	def := 0
+	for i := 0; i < len(schema); {
+		switch schema[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(schema, i)
+			continue
+		case '(':
+			depth++
+			if depth == 0 {
+				def = i + 1
+			}
+		case ')':
+			if depth == 0 {
+				return append(spans, [2]int{def, i})
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				spans = append(spans, [2]int{def, i})
+				def = i + 1
+			}
+		}
+		i++
+	}
+	return spans
+}
+
+// columnDefinition returns the quoted name of the column of def and its
+// attributes with the string literals emptied, so a keyword in a COMMENT or a
+// DEFAULT doesn't match. ok is false if def is an index.
+func columnDefinition(def string) (name string, attrs string, ok bool) {
+	if !strings.HasPrefix(def, "`") {
+		return "", "", false
+	}
+	// A doubled backquote is an escaped one, the name goes on.
+	end := skipQuoted(def, 0)
+	for end < len(def) && def[end] == '`' {
+		end = skipQuoted(def, end)
+	}
+	return def[:end], mapLiterals(def[end:], func(string) string { return "" }), true
+}
+
+// selectColumns returns the select list which reads every column of a table
+// with the create statement schema: '*' and its INVISIBLE columns.
+func selectColumns(schema string) string {
+	columns := invisibleColumns(schema)
+	if len(columns) == 0 {
+		return "*"
+	}
+	return "*, " + strings.Join(columns, ", ")
+}
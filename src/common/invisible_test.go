@@ -0,0 +1,160 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvisibleColumns(t *testing.T) {
+	tests := []struct {
+		schema string
+		want   []string
+	}{
+		{
+			schema: "CREATE TABLE `t1` (`a` int(11) DEFAULT NULL,`b` varchar(100) DEFAULT NULL) ENGINE=InnoDB",
+		},
+		{
+			schema: "CREATE TABLE `t1` (\n" +
+				"  `id` int NOT NULL,\n" +
+				"  `price` decimal(10,2) DEFAULT NULL /*!80023 INVISIBLE */,\n" +
+				"  `kind` enum('a,b','c') DEFAULT 'a,b',\n" +
+				"  `note` varchar(10) DEFAULT 'INVISIBLE' COMMENT 'not, INVISIBLE',\n" +
+				"  `x``y` int DEFAULT NULL /*!80023 INVISIBLE */,\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  KEY `k1` (`kind`) /*!80000 INVISIBLE */\n" +
+				") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			want: []string{"`price`", "`x``y`"},
+		},
+		{
+			schema: "CREATE TABLE `t(1` (`INVISIBLE` int, `b` int INVISIBLE)",
+			want:   []string{"`b`"},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, invisibleColumns(test.schema))
+	}
+	assert.Equal(t, "*", selectColumns(tests[0].schema))
+	assert.Equal(t, "*, `price`, `x``y`", selectColumns(tests[1].schema))
+}
+
+func TestInvisibleRoundTrip(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	create := "CREATE TABLE `t1` (`a` int(11) DEFAULT NULL,`b` int(11) DEFAULT NULL /*!80023 INVISIBLE */) ENGINE=InnoDB"
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Create Table",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(create)),
+			},
+		}}
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "a",
+				Type: querypb.Type_INT32,
+			},
+			{
+				Name: "b",
+				Type: querypb.Type_INT32,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")),
+				sqltypes.MakeTrusted(querypb.Type_INT32, []byte("2")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQuery("show create table `test`.`t1`", schemaResult)
+		fakedbs.AddQuery("select /*backup*/ *, `b` from `test`.`t1`", selectResult)
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create database .*", &sqltypes.Result{})
+		fakedbs.AddQuery(strings.ToLower(create), &sqltypes.Result{})
+		fakedbs.AddQuery("insert into `t1`(`a`,`b`) values\n(1,2)", &sqltypes.Result{})
+	}
+
+	pool, err := NewPool(log, 2, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	dir := "/tmp/invisibleroundtrip"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	// Dump, the invisible column is selected by name and kept invisible in the schema.
+	{
+		args := &DumpArgs{
+			Database:      "test",
+			Outdir:        dir,
+			ChunksizeInMB: 1,
+			StmtSize:      10000,
+		}
+		err := DumpTable(log, conn, args, "t1")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("select /*backup*/ *, `b` from `test`.`t1`"))
+
+		dat, err := ioutil.ReadFile(dir + "/test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT INTO `t1`(`a`,`b`) VALUES\n(1,2);\n", string(dat))
+		dat, err = ioutil.ReadFile(dir + "/test.t1-schema.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, create+";\n", string(dat))
+	}
+
+	// Restore, the table is created invisible column included and the datas go to the named columns.
+	{
+		x := WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`")
+		AssertNil(x)
+		storage := NewDirStorage(dir)
+		args := &LoadArgs{Outdir: dir, storage: storage}
+		files, err := loadFiles(storage)
+		assert.Nil(t, err)
+		err = restoreDatabaseSchema(context.Background(), log, conn, args, files.databases)
+		assert.Nil(t, err)
+		err = restoreTableSchemas(context.Background(), log, pool, args, files.schemas, 1)
+		assert.Nil(t, err)
+		_, err = restoreTable(log, conn, args, files.tables[0])
+		assert.Nil(t, err)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum(strings.ToLower(create)))
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("insert into `t1`(`a`,`b`) values\n(1,2)"))
+	}
+}
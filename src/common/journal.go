@@ -0,0 +1,196 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// journalEntry is a line of LoadArgs.ResumeFile: the first one has the Outdir
+// of the restore, the others a file of the dump restored, or a data file
+// stopped by the MaxRuntime with the offset of its next statement.
+type journalEntry struct {
+	Outdir string `json:"outdir,omitempty"`
+	File   string `json:"file,omitempty"`
+	Offset int    `json:"offset,omitempty"`
+}
+
+// resumeJournal writes the LoadArgs.ResumeFile of a restore, every line
+// synced as its file is restored, so the file is complete up to a crash like
+// the rollbackLog. A nil *resumeJournal writes nothing and skips nothing.
+type resumeJournal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	// done are the files restored by the previous runs, offsets the data
+	// files they stopped in.
+	done    map[string]bool
+	offsets map[string]int
+}
+
+// openResumeJournal opens the resume file path of a restore of outdir, nil if
+// path is empty. With resume the files it records are read and it's appended
+// to, else it's created again.
+func openResumeJournal(log *xlog.Log, path string, outdir string, resume bool) (*resumeJournal, error) {
+	if path == "" {
+		return nil, nil
+	}
+	j := &resumeJournal{path: path, done: make(map[string]bool), offsets: make(map[string]int)}
+	if !resume {
+		return j, j.create(outdir)
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Warning("restoring.resume.no.journal[%s].restoring.all.files", path)
+		return j, j.create(outdir)
+	}
+	if err != nil {
+		return nil, wrapf(err, "restoring.resume.file[%s].error:%v", path, err)
+	}
+	size, err := j.read(log, outdir, data)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		// Not even its first line, it's created again.
+		return j, j.create(outdir)
+	}
+	// The lines are appended after the last one read, a line cut short by
+	// a killed restore is dropped.
+	if size < len(data) {
+		if err := os.Truncate(path, int64(size)); err != nil {
+			return nil, wrapf(err, "restoring.resume.file[%s].error:%v", path, err)
+		}
+	}
+	if j.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, wrapf(err, "restoring.resume.file[%s].error:%v", path, err)
+	}
+	return j, nil
+}
+
+// create creates the file again with the line of outdir.
+func (j *resumeJournal) create(outdir string) error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return wrapf(err, "restoring.resume.file[%s].error:%v", j.path, err)
+	}
+	j.f = f
+	return j.write(journalEntry{Outdir: outdir})
+}
+
+// read reads the entries of the journal data and returns the size of its
+// lines read. A killed restore may have cut the last line short, the reading
+// stops at the first line which is not complete, like readCheckpoint.
+func (j *resumeJournal) read(log *xlog.Log, outdir string, data []byte) (int, error) {
+	size := 0
+	for line := 1; size < len(data); line++ {
+		end := bytes.IndexByte(data[size:], '\n')
+		var e journalEntry
+		if end < 0 || json.Unmarshal(data[size:size+end], &e) != nil {
+			log.Warning("restoring.resume.file[%s].line[%d].truncated.ignoring.the.rest", j.path, line)
+			break
+		}
+		switch {
+		case line == 1:
+			if e.Outdir != outdir {
+				return 0, fmt.Errorf("restoring.resume.file[%s].is.of.the.dump[%s].not[%s]", j.path, e.Outdir, outdir)
+			}
+		case e.Offset > 0:
+			j.offsets[e.File] = e.Offset
+		default:
+			j.done[e.File] = true
+			delete(j.offsets, e.File)
+		}
+		size += end + 1
+	}
+	return size, nil
+}
+
+func (j *resumeJournal) write(e journalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return wrapf(err, "restoring.resume.file[%s].error:%v", j.path, err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return wrapf(err, "restoring.resume.file[%s].error:%v", j.path, err)
+	}
+	return nil
+}
+
+// skip leaves out of files the ones the previous runs restored.
+func (j *resumeJournal) skip(log *xlog.Log, files *Files) {
+	if j == nil {
+		return
+	}
+	left := func(paths []string) []string {
+		var kept []string
+		for _, path := range paths {
+			if !j.done[path] {
+				kept = append(kept, path)
+			}
+		}
+		return kept
+	}
+	databases, schemas, tables := len(files.databases), len(files.schemas), len(files.tables)
+	files.databases = left(files.databases)
+	files.schemas = left(files.schemas)
+	files.tables = left(files.tables)
+	log.Info("restoring.resume.file[%s].skips.databases[%d/%d].schemas[%d/%d].files[%d/%d].stopped.files[%d]", j.path,
+		databases-len(files.databases), databases, schemas-len(files.schemas), schemas, tables-len(files.tables), tables, len(j.offsets))
+}
+
+// offset returns the offset of the statement the data file is restored from,
+// 0 for all of it.
+func (j *resumeJournal) offset(file string) int {
+	if j == nil {
+		return 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.offsets[file]
+}
+
+// restored records the file restored.
+func (j *resumeJournal) restored(file string) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.write(journalEntry{File: file})
+}
+
+// stopped records the data file stopped before its statement at offset, a
+// file stopped before its first statement is restored from its start anyway.
+func (j *resumeJournal) stopped(file string, offset int) error {
+	if j == nil || offset == 0 {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.write(journalEntry{File: file, Offset: offset})
+}
+
+func (j *resumeJournal) close() {
+	if j == nil {
+		return
+	}
+	j.f.Close()
+}
@@ -0,0 +1,129 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeJournal(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/resumejournal"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	path := dir + "/resume.jsonl"
+
+	// The lines are in the file as soon as the files are restored.
+	{
+		j, err := openResumeJournal(log, path, "/data/dump", false)
+		assert.Nil(t, err)
+		assert.Nil(t, j.restored("test-schema-create.sql"))
+		assert.Nil(t, j.restored("test.t1-schema.sql"))
+		assert.Nil(t, j.stopped("test.t1.00001.sql", 120))
+		assert.Nil(t, j.stopped("test.t1.00002.sql", 0))
+		assert.Nil(t, j.restored("test.t1.00003.sql"))
+		j.close()
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"outdir":"/data/dump"}`+"\n"+
+			`{"file":"test-schema-create.sql"}`+"\n"+
+			`{"file":"test.t1-schema.sql"}`+"\n"+
+			`{"file":"test.t1.00001.sql","offset":120}`+"\n"+
+			`{"file":"test.t1.00003.sql"}`+"\n", string(data))
+	}
+
+	// A resume skips them, the stopped file goes on from its offset and the
+	// lines are appended.
+	{
+		j, err := openResumeJournal(log, path, "/data/dump", true)
+		assert.Nil(t, err)
+		files := &Files{
+			databases: []string{"test-schema-create.sql"},
+			schemas:   []string{"test.t1-schema.sql", "test.t2-schema.sql"},
+			tables:    []string{"test.t1.00001.sql", "test.t1.00002.sql", "test.t1.00003.sql", "test.t2.00001.sql"},
+		}
+		j.skip(log, files)
+		assert.Nil(t, files.databases)
+		assert.Equal(t, []string{"test.t2-schema.sql"}, files.schemas)
+		assert.Equal(t, []string{"test.t1.00001.sql", "test.t1.00002.sql", "test.t2.00001.sql"}, files.tables)
+		assert.Equal(t, 120, j.offset("test.t1.00001.sql"))
+		assert.Equal(t, 0, j.offset("test.t1.00002.sql"))
+		assert.Nil(t, j.restored("test.t1.00001.sql"))
+		j.close()
+
+		j, err = openResumeJournal(log, path, "/data/dump", true)
+		assert.Nil(t, err)
+		assert.True(t, j.done["test.t1.00001.sql"])
+		assert.Equal(t, 0, j.offset("test.t1.00001.sql"))
+		j.close()
+	}
+
+	// A cut last line is ignored, the lines before it are kept.
+	{
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		x := WriteFile(path, string(data)+`{"file":"test.t2.000`)
+		AssertNil(x)
+		j, err := openResumeJournal(log, path, "/data/dump", true)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, len(j.done))
+		assert.Nil(t, j.restored("test.t2.00001.sql"))
+		j.close()
+		cut, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, string(data)+`{"file":"test.t2.00001.sql"}`+"\n", string(cut))
+	}
+
+	// The file of another dump is refused.
+	{
+		_, err := openResumeJournal(log, path, "/data/other", true)
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.resume.file[/tmp/resumejournal/resume.jsonl].is.of.the.dump[/data/dump].not[/data/other]", err.Error())
+	}
+
+	// Without resume the file is created again, a resume without the file
+	// creates it.
+	{
+		j, err := openResumeJournal(log, path, "/data/other", false)
+		assert.Nil(t, err)
+		j.close()
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"outdir":"/data/other"}`+"\n", string(data))
+
+		os.Remove(path)
+		j, err = openResumeJournal(log, path, "/data/other", true)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(j.done))
+		j.close()
+		data, err = ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"outdir":"/data/other"}`+"\n", string(data))
+	}
+
+	// Without a file nothing is written nor skipped.
+	{
+		j, err := openResumeJournal(log, "", "/data/dump", true)
+		assert.Nil(t, err)
+		assert.Nil(t, j)
+		assert.Nil(t, j.restored("test.t1.00001.sql"))
+		assert.Equal(t, 0, j.offset("test.t1.00001.sql"))
+		files := &Files{tables: []string{"test.t1.00001.sql"}}
+		j.skip(log, files)
+		assert.Equal(t, []string{"test.t1.00001.sql"}, files.tables)
+		j.close()
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+// jsonlColumnsSuffix ends the sidecar file of a table dumped with FormatJSONL,
+// 'db.table-columns.json', which describes its columns.
+const jsonlColumnsSuffix = "-columns.json"
+
+// notNullFlag is the NOT_NULL_FLAG of the column flags of the protocol.
+const notNullFlag = 1
+
+// The encodings of the values of a FormatJSONL row, see jsonlEncoding.
+const (
+	jsonlNumber  = "number"
+	jsonlString  = "string"
+	jsonlBase64  = "base64"
+	jsonlRFC3339 = "rfc3339"
+	jsonlJSON    = "json"
+)
+
+var (
+	// columnTypeRegexp matches the type of a column definition after its
+	// name, with its length or values and its unsigned and zerofill.
+	columnTypeRegexp = regexp.MustCompile(`(?i)^\s*(\w+(?:\s*\((?:[^()']|'(?:[^'\\]|\\.|'')*')*\))?(?:\s+unsigned)?(?:\s+zerofill)?)`)
+	// timeZoneOffsetRegexp matches a time_zone given as an offset, like +08:00.
+	timeZoneOffsetRegexp = regexp.MustCompile(`^([+-])(\d{1,2}):(\d{2})$`)
+)
+
+// jsonlEncoding returns how a value of the type of v is written in a
+// FormatJSONL row: the numbers bare, the binary strings, BIT and GEOMETRY in
+// base64, DATETIME and TIMESTAMP in RFC 3339, JSON as it is, the others as
+// strings.
+func jsonlEncoding(v sqltypes.Value) string {
+	switch {
+	case isNumber(v):
+		return jsonlNumber
+	case v.Type() == querypb.Type_DATETIME || v.Type() == querypb.Type_TIMESTAMP:
+		return jsonlRFC3339
+	case v.Type() == querypb.Type_JSON:
+		return jsonlJSON
+	case v.IsBinary() || v.Type() == querypb.Type_BIT || v.Type() == querypb.Type_GEOMETRY:
+		return jsonlBase64
+	}
+	return jsonlString
+}
+
+// jsonString returns the JSON string of s.
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// jsonlRowWriter writes a JSON object per row, keyed by the column names.
+// A DATETIME is read in the time zone loc, the session time zone of the dump,
+// and a zero date, which has no RFC 3339 form, is written as a string.
+type jsonlRowWriter struct {
+	loc  *time.Location
+	keys []string
+	buf  []byte
+}
+
+func (w *jsonlRowWriter) BeginTable(table string, columns []string) {
+	w.keys = w.keys[:0]
+	for _, column := range columns {
+		w.keys = append(w.keys, jsonString(column)+":")
+	}
+}
+
+// value encodes a value as JSON.
+func (w *jsonlRowWriter) value(v sqltypes.Value) string {
+	if v.Raw() == nil {
+		return "null"
+	}
+	switch jsonlEncoding(v) {
+	case jsonlNumber, jsonlJSON:
+		return v.String()
+	case jsonlBase64:
+		return `"` + base64.StdEncoding.EncodeToString(v.Raw()) + `"`
+	case jsonlRFC3339:
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", v.String(), w.loc); err == nil {
+			return `"` + t.Format(time.RFC3339Nano) + `"`
+		}
+	}
+	return jsonString(v.String())
+}
+
+func (w *jsonlRowWriter) WriteRow(row []sqltypes.Value) int {
+	n := len(w.buf)
+	w.buf = append(w.buf, '{')
+	for i, v := range row {
+		if i > 0 {
+			w.buf = append(w.buf, ',')
+		}
+		w.buf = append(w.buf, w.keys[i]...)
+		w.buf = append(w.buf, w.value(v)...)
+	}
+	w.buf = append(w.buf, "}\n"...)
+	return len(w.buf) - n
+}
+
+func (w *jsonlRowWriter) EndChunk() []byte {
+	data := w.buf
+	w.buf = nil
+	return data
+}
+
+func (w *jsonlRowWriter) EndTable() {
+	w.buf = nil
+}
+
+// jsonlColumn is a column of the sidecar file of a FormatJSONL table.
+type jsonlColumn struct {
+	Name string `json:"name"`
+	// Type is the type of the column in its create table statement.
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	// Encoding is how its values are written, see jsonlEncoding.
+	Encoding string `json:"encoding"`
+}
+
+// jsonlColumns is the sidecar file of a FormatJSONL table.
+type jsonlColumns struct {
+	Database string         `json:"database"`
+	Table    string         `json:"table"`
+	TimeZone string         `json:"time_zone"`
+	Columns  []*jsonlColumn `json:"columns"`
+}
+
+// writeJSONLColumns writes the sidecar 'db.table-columns.json' of a table
+// dumped with FormatJSONL: its selected columns with their type in the create
+// table statement schema and their encoding.
+func writeJSONLColumns(args *DumpArgs, table string, fields []*querypb.Field, schema string) error {
+	types := make(map[string]string)
+	for _, def := range tableDefinitions(schema) {
+		if name, _, ok := columnDefinition(def); ok {
+			if match := columnTypeRegexp.FindStringSubmatch(def[len(name):]); match != nil {
+				types[strings.Replace(name[1:len(name)-1], "``", "`", -1)] = match[1]
+			}
+		}
+	}
+	columns := &jsonlColumns{Database: args.Database, Table: table, TimeZone: args.timeZone().String()}
+	for _, field := range fields {
+		columns.Columns = append(columns.Columns, &jsonlColumn{
+			Name:     field.Name,
+			Type:     types[field.Name],
+			Nullable: field.Flags&notNullFlag == 0,
+			Encoding: jsonlEncoding(sqltypes.MakeTrusted(field.Type, nil)),
+		})
+	}
+	data, err := json.MarshalIndent(columns, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(args.storage, fmt.Sprintf("%s.%s%s", args.Database, table, jsonlColumnsSuffix), string(data)+"\n")
+}
+
+// timeZone returns the session time zone of the dump, UTC if it's unknown.
+func (args *DumpArgs) timeZone() *time.Location {
+	if args.sessionTimeZone == nil {
+		return time.UTC
+	}
+	return args.sessionTimeZone
+}
+
+// sessionTimeZone returns the time zone of the sessions of conn: its
+// time_zone if it's an offset or a name Go knows, else the offset of the
+// server at this time, as for SYSTEM.
+func sessionTimeZone(conn *Connection) (*time.Location, error) {
+	qr, err := conn.Fetch("SELECT @@session.time_zone, TIMESTAMPDIFF(SECOND, UTC_TIMESTAMP(), NOW())")
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 {
+		return nil, fmt.Errorf("session.time.zone.has.no.row")
+	}
+	name := qr.Rows[0][0].String()
+	if match := timeZoneOffsetRegexp.FindStringSubmatch(name); match != nil {
+		hours, _ := strconv.Atoi(match[2])
+		minutes, _ := strconv.Atoi(match[3])
+		offset := hours*3600 + minutes*60
+		if match[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(name, offset), nil
+	}
+	if name != "SYSTEM" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc, nil
+		}
+	}
+	offset, err := strconv.Atoi(qr.Rows[0][1].String())
+	if err != nil {
+		return nil, fmt.Errorf("session.time.zone[%s].offset.error:%v", name, err)
+	}
+	return time.FixedZone(name, offset), nil
+}
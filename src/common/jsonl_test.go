@@ -0,0 +1,135 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowWriterJSONL(t *testing.T) {
+	w := rowFormats[FormatJSONL].writer(&DumpArgs{sessionTimeZone: time.FixedZone("+08:00", 8*3600)})
+	w.BeginTable("t1", []string{"id", "na\"me", "at", "doc"})
+	row := func(id string, name sqltypes.Value, at string, doc string) []sqltypes.Value {
+		return []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT64, []byte(id)),
+			name,
+			sqltypes.MakeTrusted(querypb.Type_DATETIME, []byte(at)),
+			sqltypes.MakeTrusted(querypb.Type_JSON, []byte(doc)),
+		}
+	}
+
+	// A line per row, the DATETIMEs in the session time zone.
+	line := `{"id":1,"na\"me":"x\ny","at":"2017-09-07T11:44:21.5+08:00","doc":{"a": [1, 2]}}` + "\n"
+	assert.Equal(t, len(line), w.WriteRow(row("1", sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("x\ny")), "2017-09-07 11:44:21.500000", `{"a": [1, 2]}`)))
+	w.WriteRow(row("2", sqltypes.NULL, "0000-00-00 00:00:00", "null"))
+	assert.Equal(t, line+`{"id":2,"na\"me":null,"at":"0000-00-00 00:00:00","doc":null}`+"\n", string(w.EndChunk()))
+
+	// Every line is a JSON object.
+	w.WriteRow(row("3", sqltypes.MakeTrusted(querypb.Type_VARBINARY, []byte{0xff, 0x00}), "2017-09-07 00:00:00", "[]"))
+	var obj map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.EndChunk(), &obj))
+	assert.Equal(t, "/wA=", obj["na\"me"])
+	assert.Equal(t, "2017-09-07T00:00:00+08:00", obj["at"])
+	w.EndTable()
+}
+
+func TestRowWriterJSONLColumns(t *testing.T) {
+	s := NewMemStorage()
+	args := &DumpArgs{Database: "test", storage: s}
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_UINT64, Flags: notNullFlag},
+		{Name: "name", Type: querypb.Type_VARCHAR},
+		{Name: "kind", Type: querypb.Type_ENUM},
+		{Name: "at", Type: querypb.Type_DATETIME},
+		{Name: "data", Type: querypb.Type_BLOB},
+	}
+	schema := "CREATE TABLE `t1` (\n" +
+		"  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,\n" +
+		"  `name` varchar(64) DEFAULT NULL,\n" +
+		"  `kind` enum('a','b(c)','it''s') DEFAULT NULL,\n" +
+		"  `at` datetime(6) DEFAULT NULL,\n" +
+		"  `data` blob,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB"
+	assert.Nil(t, writeJSONLColumns(args, "t1", fields, schema))
+
+	data, err := readFile(s, "test.t1-columns.json")
+	assert.Nil(t, err)
+	var columns jsonlColumns
+	assert.Nil(t, json.Unmarshal(data, &columns))
+	assert.Equal(t, jsonlColumns{
+		Database: "test",
+		Table:    "t1",
+		TimeZone: "UTC",
+		Columns: []*jsonlColumn{
+			{Name: "id", Type: "bigint(20) unsigned", Nullable: false, Encoding: jsonlNumber},
+			{Name: "name", Type: "varchar(64)", Nullable: true, Encoding: jsonlString},
+			{Name: "kind", Type: "enum('a','b(c)','it''s')", Nullable: true, Encoding: jsonlString},
+			{Name: "at", Type: "datetime(6)", Nullable: true, Encoding: jsonlRFC3339},
+			{Name: "data", Type: "blob", Nullable: true, Encoding: jsonlBase64},
+		},
+	}, columns)
+	assert.False(t, volumeFile("test.t1-columns.json"))
+}
+
+func TestJSONLSessionTimeZone(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	query := "select @@session.time_zone, timestampdiff(second, utc_timestamp(), now())"
+	result := func(zone string, offset string) *sqltypes.Result {
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{
+				{Name: "@@session.time_zone", Type: querypb.Type_VARCHAR},
+				{Name: "offset", Type: querypb.Type_INT64},
+			},
+			Rows: [][]sqltypes.Value{{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(zone)),
+				sqltypes.MakeTrusted(querypb.Type_INT64, []byte(offset)),
+			}},
+		}
+	}
+	at := time.Date(2017, 9, 7, 11, 44, 21, 0, time.UTC)
+
+	// An offset.
+	{
+		fakedbs.AddQuery(query, result("-05:30", "-19800"))
+		loc, err := sessionTimeZone(conn)
+		assert.Nil(t, err)
+		_, offset := at.In(loc).Zone()
+		assert.Equal(t, -19800, offset)
+	}
+
+	// SYSTEM, the offset of the server.
+	{
+		fakedbs.AddQuery(query, result("SYSTEM", "7200"))
+		loc, err := sessionTimeZone(conn)
+		assert.Nil(t, err)
+		_, offset := at.In(loc).Zone()
+		assert.Equal(t, 7200, offset)
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The strategies of a chunkKey, by the type of its column.
+const (
+	// chunkKeyInteger cuts the span of MIN to MAX in equal ranges.
+	chunkKeyInteger = "integer"
+	// chunkKeyTemporal cuts the time span of MIN to MAX in equal ranges, of
+	// whole seconds, of whole days for a DATE.
+	chunkKeyTemporal = "temporal"
+	// chunkKeyString samples a boundary every DumpArgs.ChunkRows rows of the
+	// index, see stringKeyRanges.
+	chunkKeyString = "string"
+)
+
+// maxKeyRanges bounds the ranges of a table of DumpArgs.ChunkRows, and so
+// the boundary queries of a string key.
+const maxKeyRanges = 1024
+
+// uniqueKeyRegexp matches a UNIQUE index definition, with its columns.
+var uniqueKeyRegexp = regexp.MustCompile("(?is)^(?:CONSTRAINT\\s+(?:`(?:[^`]|``)*`\\s+)?)?UNIQUE\\b[^(]*\\((.*)\\)")
+
+// chunkKey is the column a table of DumpArgs.ChunkRows is chunked on: the
+// first column of its primary key, or of a unique key on NOT NULL columns.
+type chunkKey struct {
+	// column is quoted, typ is its type lower case, like 'varchar'.
+	column   string
+	typ      string
+	strategy string
+}
+
+// String returns the column:strategy recorded in manifest.json.
+func (k *chunkKey) String() string {
+	return strings.Replace(strings.Trim(k.column, "`"), "``", "`", -1) + ":" + k.strategy
+}
+
+// literal returns the SQL literal of a value of the column.
+func (k *chunkKey) literal(value string) string {
+	if k.strategy == chunkKeyInteger {
+		return value
+	}
+	return "'" + string(EscapeBytes([]byte(value))) + "'"
+}
+
+// keyRange is a range of a chunkKey, from included and to excluded, empty
+// for no bound: the first range has no from, the last no to, so the ranges
+// of a table have every row once.
+type keyRange struct {
+	from string
+	to   string
+}
+
+// where returns the condition of the rows of the range.
+func (r keyRange) where(k *chunkKey) string {
+	var conds []string
+	if r.from != "" {
+		conds = append(conds, fmt.Sprintf("%s >= %s", k.column, k.literal(r.from)))
+	}
+	if r.to != "" {
+		conds = append(conds, fmt.Sprintf("%s < %s", k.column, k.literal(r.to)))
+	}
+	return strings.Join(conds, " and ")
+}
+
+// rangeWhere returns the condition of the rows of where in the range r of
+// the key k, where as is without a key.
+func rangeWhere(where string, k *chunkKey, r keyRange) string {
+	cond := ""
+	if k != nil {
+		cond = r.where(k)
+	}
+	switch {
+	case cond == "":
+		return where
+	case where == "":
+		return cond
+	}
+	return "(" + where + ") and " + cond
+}
+
+// boundaryRanges returns the ranges between the sorted boundaries.
+func boundaryRanges(boundaries []string) []keyRange {
+	if len(boundaries) == 0 {
+		return nil
+	}
+	ranges := make([]keyRange, 0, len(boundaries)+1)
+	from := ""
+	for _, b := range boundaries {
+		ranges = append(ranges, keyRange{from: from, to: b})
+		from = b
+	}
+	return append(ranges, keyRange{from: from})
+}
+
+// keyStrategy returns the strategy of a column type, empty if it has none.
+func keyStrategy(typ string) string {
+	switch typ {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		return chunkKeyInteger
+	case "date", "datetime", "timestamp":
+		return chunkKeyTemporal
+	case "char", "varchar", "binary", "varbinary":
+		return chunkKeyString
+	}
+	return ""
+}
+
+// pickChunkKey returns the chunkKey of the create table statement schema:
+// the first column of the primary key, else of the first unique key whose
+// column is NOT NULL, of a type with a strategy. ok is false if there is
+// none, why tells it.
+func pickChunkKey(schema string) (key *chunkKey, why string, ok bool) {
+	types := make(map[string]string)
+	notNull := make(map[string]bool)
+	var primary, unique []string
+	for _, def := range tableDefinitions(schema) {
+		if name, attrs, ok := columnDefinition(def); ok {
+			fields := strings.Fields(strings.ToLower(attrs))
+			if len(fields) > 0 {
+				types[name] = strings.SplitN(fields[0], "(", 2)[0]
+			}
+			notNull[name] = strings.Contains(strings.ToUpper(attrs), "NOT NULL")
+			if inlinePrimaryKeyRegexp.MatchString(attrs) {
+				primary = append(primary, name)
+			}
+			continue
+		}
+		if match := primaryKeyRegexp.FindStringSubmatch(def); match != nil {
+			if names := quotedNameRegexp.FindAllString(match[1], 1); len(names) > 0 {
+				primary = append(primary, names[0])
+			}
+		} else if match := uniqueKeyRegexp.FindStringSubmatch(def); match != nil {
+			if names := quotedNameRegexp.FindAllString(match[1], 1); len(names) > 0 {
+				unique = append(unique, names[0])
+			}
+		}
+	}
+	candidates := primary
+	for _, name := range unique {
+		if notNull[name] {
+			candidates = append(candidates, name)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, "no.primary.key.nor.unique.key.on.not.null.columns", false
+	}
+	for _, name := range candidates {
+		if strategy := keyStrategy(types[name]); strategy != "" {
+			return &chunkKey{column: name, typ: types[name], strategy: strategy}, "", true
+		}
+	}
+	return nil, fmt.Sprintf("key.column[%s].type[%s].can.not.be.chunked", strings.Trim(candidates[0], "`"), types[candidates[0]]), false
+}
+
+// keyRangeCount returns the ranges of a table of rows rows, about
+// DumpArgs.ChunkRows each, up to maxKeyRanges.
+func keyRangeCount(rows uint64, chunkRows int) int {
+	n := (rows + uint64(chunkRows) - 1) / uint64(chunkRows)
+	if n > maxKeyRanges {
+		n = maxKeyRanges
+	}
+	return int(n)
+}
+
+// tableKeyRanges returns the chunkKey of a table of DumpArgs.ChunkRows and
+// its ranges, nil if it's read at once: without a key, or too small for two
+// ranges. Every boundary query reads the ends of the index of the key, or up
+// to ChunkRows entries of it for a string key.
+func tableKeyRanges(log *xlog.Log, conn *Connection, args *DumpArgs, table string, schema string) (*chunkKey, []keyRange, error) {
+	key, why, ok := pickChunkKey(schema)
+	if !ok {
+		log.Warning("dumping.table[%s.%s].chunk.rows.%s.dumped.at.once", args.Database, table, why)
+		return nil, nil, nil
+	}
+	var boundaries []string
+	var err error
+	if key.strategy == chunkKeyString {
+		boundaries, err = stringKeyBoundaries(conn, args, table, key)
+	} else {
+		boundaries, err = spanKeyBoundaries(conn, args, table, key)
+	}
+	if err != nil {
+		return nil, nil, wrapf(err, "dumping.table[%s.%s].chunk.key[%s].error:%v", args.Database, table, key, err)
+	}
+	ranges := boundaryRanges(boundaries)
+	log.Info("dumping.table[%s.%s].chunk.key[%s].ranges[%d]", args.Database, table, key, len(ranges))
+	if len(ranges) == maxKeyRanges {
+		log.Warning("dumping.table[%s.%s].chunk.key[%s].ranges.capped[%d].the.last.one.has.the.rest", args.Database, table, key, maxKeyRanges)
+	}
+	return key, ranges, nil
+}
+
+// estimatedRows returns the TABLE_ROWS estimate of a table.
+func estimatedRows(conn *Connection, db string, table string) (uint64, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s'", EscapeBytes([]byte(db)), EscapeBytes([]byte(table))))
+	if err != nil {
+		return 0, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+		return 0, nil
+	}
+	n, _ := strconv.ParseUint(qr.Rows[0][0].String(), 10, 64)
+	return n, nil
+}
+
+// spanKeyBoundaries returns the boundaries of an integer or a temporal key:
+// the span of its MIN to its MAX cut in equal steps, as many as the
+// TABLE_ROWS estimate makes ranges. A zero date has no span, none is cut.
+func spanKeyBoundaries(conn *Connection, args *DumpArgs, table string, key *chunkKey) ([]string, error) {
+	rows, err := estimatedRows(conn, args.Database, table)
+	if err != nil {
+		return nil, err
+	}
+	n := keyRangeCount(rows, args.ChunkRows)
+	if n < 2 {
+		return nil, nil
+	}
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM `%s`.`%s`", key.column, key.column, args.Database, table))
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 || qr.Rows[0][0].Raw() == nil {
+		return nil, nil
+	}
+	min, max := qr.Rows[0][0].String(), qr.Rows[0][1].String()
+	if key.strategy == chunkKeyInteger {
+		return integerBoundaries(min, max, n), nil
+	}
+	return temporalBoundaries(min, max, n, key.typ == "date"), nil
+}
+
+// integerBoundaries cuts min to max in n ranges.
+func integerBoundaries(min string, max string, n int) []string {
+	lo, ok1 := new(big.Int).SetString(min, 10)
+	hi, ok2 := new(big.Int).SetString(max, 10)
+	if !ok1 || !ok2 || lo.Cmp(hi) >= 0 {
+		return nil
+	}
+	// step = (hi - lo) / n + 1, so the last boundary is at most hi.
+	step := new(big.Int).Sub(hi, lo)
+	step.Div(step, big.NewInt(int64(n)))
+	step.Add(step, big.NewInt(1))
+	var boundaries []string
+	b := new(big.Int).Add(lo, step)
+	for i := 1; i < n && b.Cmp(hi) <= 0; i++ {
+		boundaries = append(boundaries, b.String())
+		b.Add(b, step)
+	}
+	return boundaries
+}
+
+// temporalBoundaries cuts min to max in n ranges of whole seconds, of whole
+// days for a DATE.
+func temporalBoundaries(min string, max string, n int, date bool) []string {
+	layout := "2006-01-02 15:04:05"
+	unit := time.Second
+	if date {
+		layout = "2006-01-02"
+		unit = 24 * time.Hour
+	}
+	if len(min) < len(layout) || len(max) < len(layout) {
+		return nil
+	}
+	lo, err1 := time.Parse(layout, min[:len(layout)])
+	hi, err2 := time.Parse(layout, max[:len(layout)])
+	if err1 != nil || err2 != nil || !lo.Before(hi) {
+		return nil
+	}
+	step := hi.Sub(lo) / time.Duration(n)
+	step = step - step%unit + unit
+	var boundaries []string
+	for b, i := lo.Add(step), 1; i < n && !b.After(hi); b, i = b.Add(step), i+1 {
+		boundaries = append(boundaries, b.Format(layout))
+	}
+	return boundaries
+}
+
+// stringKeyBoundaries samples the boundaries of a string key: the value
+// ChunkRows entries into its index, then ChunkRows entries past the last
+// boundary, until the index ends or maxKeyRanges. The server compares them,
+// in the collation of the column. Every query reads up to ChunkRows entries
+// of the index.
+func stringKeyBoundaries(conn *Connection, args *DumpArgs, table string, key *chunkKey) ([]string, error) {
+	var boundaries []string
+	for len(boundaries) < maxKeyRanges-1 {
+		query := fmt.Sprintf("SELECT %s FROM `%s`.`%s` ORDER BY %s LIMIT 1 OFFSET %d", key.column, args.Database, table, key.column, args.ChunkRows)
+		if n := len(boundaries); n > 0 {
+			query = fmt.Sprintf("SELECT %s FROM `%s`.`%s` WHERE %s > %s ORDER BY %s LIMIT 1 OFFSET %d", key.column, args.Database, table, key.column, key.literal(boundaries[n-1]), key.column, args.ChunkRows-1)
+		}
+		qr, err := conn.Fetch(query)
+		if err != nil {
+			return nil, err
+		}
+		if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+			break
+		}
+		boundaries = append(boundaries, qr.Rows[0][0].String())
+	}
+	return boundaries, nil
+}
@@ -0,0 +1,301 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPickChunkKey(t *testing.T) {
+	for _, tc := range []struct {
+		schema string
+		want   string
+		why    string
+	}{
+		{"CREATE TABLE `t` (\n  `id` bigint(20) unsigned NOT NULL AUTO_INCREMENT,\n  `a` int(11) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB", "id:integer", ""},
+		{"CREATE TABLE `t` (\n  `id` int NOT NULL PRIMARY KEY,\n  `a` int\n)", "id:integer", ""},
+		// The leading column of a composite primary key.
+		{"CREATE TABLE `t` (\n  `tenant` int NOT NULL,\n  `id` varchar(64) NOT NULL,\n  PRIMARY KEY (`tenant`,`id`)\n) ENGINE=InnoDB", "tenant:integer", ""},
+		{"CREATE TABLE `t` (\n  `uuid` char(36) NOT NULL,\n  PRIMARY KEY (`uuid`)\n) ENGINE=InnoDB", "uuid:string", ""},
+		{"CREATE TABLE `t` (\n  `at` datetime(6) NOT NULL,\n  PRIMARY KEY (`at`)\n) ENGINE=InnoDB", "at:temporal", ""},
+		{"CREATE TABLE `t` (\n  `day` date NOT NULL,\n  PRIMARY KEY (`day`)\n) ENGINE=InnoDB", "day:temporal", ""},
+		// A unique key on a NOT NULL column, not on a nullable one.
+		{"CREATE TABLE `t` (\n  `a` int DEFAULT NULL,\n  `email` varchar(255) NOT NULL,\n  UNIQUE KEY `a` (`a`),\n  UNIQUE KEY `email` (`email`(100))\n) ENGINE=InnoDB", "email:string", ""},
+		{"CREATE TABLE `t` (\n  `a` int DEFAULT NULL,\n  UNIQUE KEY `a` (`a`)\n) ENGINE=InnoDB", "", "no.primary.key.nor.unique.key.on.not.null.columns"},
+		{"CREATE TABLE `t` (\n  `price` decimal(10,2) NOT NULL,\n  PRIMARY KEY (`price`)\n) ENGINE=InnoDB", "", "key.column[price].type[decimal].can.not.be.chunked"},
+		{"CREATE TABLE `t` (\n  `a` int\n) ENGINE=InnoDB", "", "no.primary.key.nor.unique.key.on.not.null.columns"},
+	} {
+		key, why, ok := pickChunkKey(tc.schema)
+		assert.Equal(t, tc.want != "", ok, tc.schema)
+		assert.Equal(t, tc.why, why, tc.schema)
+		if ok {
+			assert.Equal(t, tc.want, key.String(), tc.schema)
+		}
+	}
+}
+
+func TestKeyRangeBoundaries(t *testing.T) {
+	assert.Equal(t, []string{"26", "51", "76"}, integerBoundaries("1", "100", 4))
+	assert.Nil(t, integerBoundaries("5", "5", 4))
+	// A span shorter than the ranges has a range per value.
+	assert.Equal(t, []string{"2", "3"}, integerBoundaries("1", "3", 10))
+	assert.Equal(t, []string{"18446744073709551615"}, integerBoundaries("18446744073709551613", "18446744073709551615", 2))
+
+	assert.Equal(t, []string{"2024-01-01 06:00:00", "2024-01-01 12:00:00", "2024-01-01 18:00:00"}, temporalBoundaries("2024-01-01 00:00:00", "2024-01-01 23:59:59.999999", 4, false))
+	assert.Equal(t, []string{"2024-01-03", "2024-01-05"}, temporalBoundaries("2024-01-01", "2024-01-05", 3, true))
+	assert.Nil(t, temporalBoundaries("0000-00-00 00:00:00", "2024-01-01 00:00:00", 4, false))
+
+	key := &chunkKey{column: "`id`", typ: "int", strategy: chunkKeyInteger}
+	ranges := boundaryRanges([]string{"10", "20"})
+	assert.Equal(t, []keyRange{{to: "10"}, {from: "10", to: "20"}, {from: "20"}}, ranges)
+	assert.Equal(t, "`id` < 10", ranges[0].where(key))
+	assert.Equal(t, "`id` >= 10 and `id` < 20", ranges[1].where(key))
+	assert.Equal(t, "(a = 1) and `id` >= 20", rangeWhere("a = 1", key, ranges[2]))
+	assert.Equal(t, "a = 1", rangeWhere("a = 1", nil, keyRange{}))
+	assert.Nil(t, boundaryRanges(nil))
+
+	name := &chunkKey{column: "`name`", typ: "varchar", strategy: chunkKeyString}
+	assert.Equal(t, "`name` >= 'o\\'brien'", keyRange{from: "o'brien"}.where(name))
+}
+
+// keyServer answers the queries of tableKeyRanges from the sorted keys of a
+// table, compared by less.
+type keyServer struct {
+	keys    []string
+	less    func(a, b string) bool
+	queries int
+}
+
+var (
+	keyOffsetRegexp = regexp.MustCompile(`LIMIT 1 OFFSET (\d+)$`)
+	keyAfterRegexp  = regexp.MustCompile(`WHERE \S+ > '([^']*)'`)
+)
+
+func (s *keyServer) executor(id int) (Executor, error) {
+	return s, nil
+}
+
+func (s *keyServer) Execute(query string) error {
+	return nil
+}
+
+func (s *keyServer) Fetch(query string) (*sqltypes.Result, error) {
+	s.queries++
+	switch {
+	case strings.HasPrefix(query, "SELECT TABLE_ROWS"):
+		return stringsResult([]string{"TABLE_ROWS"}, []string{strconv.Itoa(len(s.keys))}), nil
+	case strings.HasPrefix(query, "SELECT MIN("):
+		return stringsResult([]string{"MIN", "MAX"}, []string{s.keys[0], s.keys[len(s.keys)-1]}), nil
+	}
+	keys := s.keys
+	if match := keyAfterRegexp.FindStringSubmatch(query); match != nil {
+		i := sort.Search(len(keys), func(i int) bool { return s.less(match[1], keys[i]) })
+		keys = keys[i:]
+	}
+	offset, _ := strconv.Atoi(keyOffsetRegexp.FindStringSubmatch(query)[1])
+	if offset >= len(keys) {
+		return stringsResult([]string{"k"}), nil
+	}
+	return stringsResult([]string{"k"}, []string{keys[offset]}), nil
+}
+
+func (s *keyServer) Ping() error {
+	return nil
+}
+
+func (s *keyServer) Close() error {
+	return nil
+}
+
+func TestTableKeyRanges(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	integers := func(a, b string) bool {
+		x, _ := strconv.ParseInt(a, 10, 64)
+		y, _ := strconv.ParseInt(b, 10, 64)
+		return x < y
+	}
+	strs := func(a, b string) bool { return a < b }
+
+	var ids, times, uuids []string
+	for i := 0; i < 10000; i++ {
+		// Gaps in the ids, a burst in the times.
+		ids = append(ids, strconv.Itoa(i*i%7919+i*3))
+		at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * 17 * time.Minute)
+		if i%2 == 0 {
+			at = time.Date(2024, 3, 1, 0, 0, i, 0, time.UTC)
+		}
+		times = append(times, at.Format("2006-01-02 15:04:05"))
+		uuids = append(uuids, fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(i))))[:32])
+	}
+	sort.Slice(ids, func(i, j int) bool { return integers(ids[i], ids[j]) })
+	sort.Strings(times)
+	sort.Strings(uuids)
+
+	for _, tc := range []struct {
+		schema string
+		keys   []string
+		less   func(a, b string) bool
+		// min is the least ranges.
+		min int
+	}{
+		{"CREATE TABLE `t` (\n  `id` bigint NOT NULL,\n  PRIMARY KEY (`id`)\n)", ids, integers, 2},
+		{"CREATE TABLE `t` (\n  `at` datetime NOT NULL,\n  PRIMARY KEY (`at`)\n)", times, strs, 2},
+		{"CREATE TABLE `t` (\n  `uuid` char(36) NOT NULL,\n  PRIMARY KEY (`uuid`)\n)", uuids, strs, 10},
+	} {
+		s := &keyServer{keys: tc.keys, less: tc.less}
+		pool, err := NewExecutorPool(log, 1, s.executor)
+		assert.Nil(t, err)
+		conn := pool.Get()
+		args := &DumpArgs{Database: "test", ChunkRows: 1000}
+		key, ranges, err := tableKeyRanges(log, conn, args, "t", tc.schema)
+		pool.Put(conn)
+		pool.Close()
+		assert.Nil(t, err)
+		assert.True(t, len(ranges) >= tc.min, key.String())
+		assert.True(t, s.queries <= maxKeyRanges+1, key.String())
+
+		// Every row is in exactly one range, the rows of the ranges are the
+		// rows of the table.
+		counts := make([]int, len(ranges))
+		for _, k := range tc.keys {
+			in := 0
+			for i, r := range ranges {
+				if (r.from == "" || !tc.less(k, r.from)) && (r.to == "" || tc.less(k, r.to)) {
+					counts[i]++
+					in++
+				}
+			}
+			assert.Equal(t, 1, in, k)
+		}
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		assert.Equal(t, len(tc.keys), total, key.String())
+		if key.strategy == chunkKeyString {
+			// A sampled boundary every ChunkRows rows.
+			for _, n := range counts[:len(counts)-1] {
+				assert.Equal(t, 1000, n)
+			}
+		}
+	}
+
+	// A table smaller than ChunkRows, or without a key, is read at once.
+	{
+		s := &keyServer{keys: ids[:10], less: integers}
+		pool, err := NewExecutorPool(log, 1, s.executor)
+		assert.Nil(t, err)
+		defer pool.Close()
+		conn := pool.Get()
+		defer pool.Put(conn)
+		args := &DumpArgs{Database: "test", ChunkRows: 1000}
+		_, ranges, err := tableKeyRanges(log, conn, args, "t", "CREATE TABLE `t` (\n  `id` int NOT NULL,\n  PRIMARY KEY (`id`)\n)")
+		assert.Nil(t, err)
+		assert.Nil(t, ranges)
+		key, ranges, err := tableKeyRanges(log, conn, args, "t", "CREATE TABLE `t` (\n  `a` int\n)")
+		assert.Nil(t, err)
+		assert.Nil(t, key)
+		assert.Nil(t, ranges)
+	}
+}
+
+func TestDumpTableKeyRanges(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	const rows = 3000
+	schema := "CREATE TABLE `t1` (\n  `id` int NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB"
+	fakedbs.AddQuery("SELECT TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_SCHEMA='test' AND TABLE_NAME='t1'", &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "TABLE_ROWS", Type: querypb.Type_INT64}},
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, []byte(strconv.Itoa(rows)))}},
+	})
+	fakedbs.AddQuery("SELECT MIN(`id`), MAX(`id`) FROM `test`.`t1`", &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "MIN", Type: querypb.Type_INT64}, {Name: "MAX", Type: querypb.Type_INT64}},
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, []byte("1")), sqltypes.MakeTrusted(querypb.Type_INT64, []byte(strconv.Itoa(rows)))}},
+	})
+
+	pool, err := NewPool(log, 3, server.Addr(), "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	args := &DumpArgs{
+		Database:      "test",
+		Outdir:        "/tmp/dumpkeyrangestest",
+		ChunksizeInMB: 1,
+		StmtSize:      10000,
+		ChunkRows:     1000,
+		pool:          pool,
+	}
+	os.RemoveAll(args.Outdir)
+	AssertNil(os.MkdirAll(args.Outdir, 0777))
+	storage, err := OpenStorage(args.Outdir)
+	assert.Nil(t, err)
+	args.storage = storage
+
+	// The rows of every range, from the ranges the dump cuts.
+	key, ranges, err := tableKeyRanges(log, conn, args, "t1", schema)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(ranges))
+	fields := []*querypb.Field{{Name: "id", Type: querypb.Type_INT32}}
+	for _, r := range ranges {
+		qr := &sqltypes.Result{Fields: fields}
+		from, _ := strconv.Atoi(r.from)
+		to, _ := strconv.Atoi(r.to)
+		for id := 1; id <= rows; id++ {
+			if (r.from == "" || id >= from) && (r.to == "" || id < to) {
+				qr.Rows = append(qr.Rows, []sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(id)))})
+			}
+		}
+		fakedbs.AddQuery("select /*backup*/ * from `test`.`t1` where "+r.where(key), qr)
+	}
+
+	ts, err := dumpTable(log, conn, args, "t1", schema)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(rows), ts.Rows)
+	assert.Equal(t, "id:integer", ts.chunkKey)
+	assert.Equal(t, len(ranges), len(ts.chunks))
+
+	// A data file per range, in the order of the ranges, with every row of
+	// the table once.
+	seen := make(map[string]bool)
+	for i, chunk := range ts.chunks {
+		assert.Equal(t, fmt.Sprintf("test.t1.%05d.00001.sql", i+1), chunk.Name)
+		assert.Equal(t, ranges[i].from, chunk.From)
+		assert.Equal(t, ranges[i].to, chunk.To)
+		data, err := ioutil.ReadFile(args.Outdir + "/" + chunk.Name)
+		assert.Nil(t, err)
+		for _, match := range regexp.MustCompile(`\((\d+)\)`).FindAllStringSubmatch(string(data), -1) {
+			assert.False(t, seen[match[1]], match[1])
+			seen[match[1]] = true
+		}
+	}
+	assert.Equal(t, rows, len(seen))
+	assert.Equal(t, []string{"00001.00002", "00002.00002", "00003.00002", "00004.00001"}, ts.next)
+}
@@ -0,0 +1,245 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The DumpArgs.LagAction values.
+const (
+	// LagActionPause pauses the dump threads while the replica lags.
+	LagActionPause = "pause"
+	// LagActionAbort fails the dump once the replica lags.
+	LagActionAbort = "abort"
+)
+
+// replicaLagInterval is how often the replica lag is checked during a dump
+// or the datas of a load.
+var replicaLagInterval = 5 * time.Second
+
+// replicaLag returns the Seconds_Behind_Source of SHOW REPLICA STATUS, of
+// MySQL 8.0.22 and later, or the Seconds_Behind_Master of SHOW SLAVE STATUS
+// on the servers which don't know the first one, like MariaDB before 10.5.1:
+// the SLAVE one is deprecated and gone from MySQL 8.4. ok is false if it's
+// NULL: the replication is stopped. A server which is not a replica is an
+// error.
+func replicaLag(conn *Connection) (lag int64, ok bool, err error) {
+	qr, err := conn.Fetch("SHOW REPLICA STATUS")
+	if err != nil {
+		if qr, err = conn.Fetch("SHOW SLAVE STATUS"); err != nil {
+			return 0, false, err
+		}
+	}
+	if len(qr.Rows) == 0 {
+		return 0, false, fmt.Errorf("source.is.not.a.replica")
+	}
+	for i, field := range qr.Fields {
+		if field.Name != "Seconds_Behind_Master" && field.Name != "Seconds_Behind_Source" {
+			continue
+		}
+		if i >= len(qr.Rows[0]) || qr.Rows[0][i].Raw() == nil {
+			return 0, false, nil
+		}
+		lag, err := strconv.ParseInt(qr.Rows[0][i].String(), 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return lag, true, nil
+	}
+	return 0, false, fmt.Errorf("replica.status.has.no.seconds.behind.source")
+}
+
+// lagGate holds the dump threads, or the dispatch of the data files of a
+// load, while the replica lags, see DumpArgs.MaxReplicaLag and
+// LoadArgs.MaxReplicaLag. A nil gate never holds.
+type lagGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	// since is when the pause started, total the time of the pauses before.
+	since time.Time
+	total time.Duration
+}
+
+func newLagGate() *lagGate {
+	g := &lagGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// wait returns once the gate is open.
+func (g *lagGate) wait() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.paused {
+		g.cond.Wait()
+	}
+}
+
+// set pauses or opens the gate, it reports whether it changed.
+func (g *lagGate) set(paused bool) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused == paused {
+		return false
+	}
+	g.paused = paused
+	if paused {
+		g.since = time.Now()
+	} else {
+		g.total += time.Since(g.since)
+		g.cond.Broadcast()
+	}
+	return true
+}
+
+// pausedFor returns the time the gate was paused, the pause running too, and
+// whether it's paused.
+func (g *lagGate) pausedFor() (time.Duration, bool) {
+	if g == nil {
+		return 0, false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return g.total + time.Since(g.since), true
+	}
+	return g.total, false
+}
+
+// lagOver reports whether the replica lag of conn is over max seconds, a
+// stopped replication is, with the lag to log.
+func lagOver(conn *Connection, max int) (over bool, lag string, err error) {
+	seconds, ok, err := replicaLag(conn)
+	if err != nil {
+		return false, "", err
+	}
+	if !ok {
+		return true, "NULL", nil
+	}
+	return seconds > int64(max), fmt.Sprintf("%ds", seconds), nil
+}
+
+// lagWatch is the replica a run watches with watchReplicaLag.
+type lagWatch struct {
+	// action starts the logs and the errors, "dumping" or "restoring".
+	action   string
+	address  string
+	user     string
+	password string
+	// max is the lag, in seconds, over which gate is paused, or the run
+	// aborted with abort.
+	max   int
+	abort bool
+	gate  *lagGate
+}
+
+// dumpLagWatch returns the lagWatch of DumpArgs.MaxReplicaLag, the source is
+// the replica.
+func dumpLagWatch(args *DumpArgs) *lagWatch {
+	return &lagWatch{action: "dumping", address: args.Address, user: args.User, password: args.Password,
+		max: args.MaxReplicaLag, abort: args.LagAction == LagActionAbort, gate: args.lag}
+}
+
+// watchReplicaLag checks the replica lag of w with its own connection before
+// the datas and every replicaLagInterval until the returned func is called.
+// Over w.max, w.abort calls abort with the error of the run, else w.gate is
+// held until the lag is back under it: the first check waits for it and
+// fails the run on an error, the next ones only log it. The gate is opened
+// once ctx is done.
+func watchReplicaLag(ctx context.Context, log *xlog.Log, w *lagWatch, abort func(error)) (func(), error) {
+	pool, err := NewPool(log, 1, w.address, w.user, w.password)
+	if err != nil {
+		return nil, err
+	}
+	conn := pool.Get()
+	// check returns the error of a query, or the one aborting the run.
+	check := func() (over bool, aborted error, err error) {
+		over, lag, err := lagOver(conn, w.max)
+		if err != nil {
+			return false, nil, wrapf(err, "%s.replica.lag.error:%v", w.action, err)
+		}
+		switch {
+		case over && w.abort:
+			return true, fmt.Errorf("%s.replica.lag[%s].over.max[%ds].aborted", w.action, lag, w.max), nil
+		case over:
+			if w.gate.set(true) {
+				log.Warning("%s.replica.lag[%s].over.max[%ds].pausing", w.action, lag, w.max)
+			}
+		default:
+			if w.gate.set(false) {
+				paused, _ := w.gate.pausedFor()
+				log.Warning("%s.replica.lag[%s].resuming.paused[%.2fsec]", w.action, lag, paused.Seconds())
+			}
+		}
+		return over, nil, nil
+	}
+
+	over, aborted, err := check()
+	for err == nil && aborted == nil && over {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(replicaLagInterval):
+			over, aborted, err = check()
+		}
+	}
+	if err == nil {
+		err = aborted
+	}
+	if err != nil {
+		pool.Put(conn)
+		pool.Close()
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w.gate.set(false)
+		tick := time.NewTicker(replicaLagInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				// A failed check keeps the gate as it is, the next one may pass.
+				_, aborted, err := check()
+				if err != nil {
+					log.Warning("%v", err)
+				}
+				if aborted != nil {
+					abort(aborted)
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+		pool.Put(conn)
+		pool.Close()
+	}, nil
+}
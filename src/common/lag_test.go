@@ -0,0 +1,162 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLagGate(t *testing.T) {
+	// A nil gate never holds.
+	{
+		var g *lagGate
+		g.wait()
+		paused, ok := g.pausedFor()
+		assert.Equal(t, time.Duration(0), paused)
+		assert.False(t, ok)
+	}
+
+	g := newLagGate()
+	assert.False(t, g.set(false))
+	assert.True(t, g.set(true))
+	assert.False(t, g.set(true))
+
+	// The waiters are released once the gate opens.
+	released := make(chan struct{})
+	go func() {
+		g.wait()
+		close(released)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-released:
+		t.Fatal("wait.returned.while.paused")
+	default:
+	}
+	_, ok := g.pausedFor()
+	assert.True(t, ok)
+
+	assert.True(t, g.set(false))
+	<-released
+	paused, ok := g.pausedFor()
+	assert.False(t, ok)
+	assert.True(t, paused >= 20*time.Millisecond)
+
+	// The pauses add up.
+	g.set(true)
+	time.Sleep(10 * time.Millisecond)
+	g.set(false)
+	total, _ := g.pausedFor()
+	assert.True(t, total >= paused+10*time.Millisecond)
+}
+
+func TestLoadLagGate(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	m := newMetrics(log, "load", nil, new(uint64), nil)
+	g := newLagGate()
+	m.setLagGate(g)
+	assert.Equal(t, "", m.snapshot().Waiting)
+
+	// A paused load is waiting, the time paused is in its report.
+	g.set(true)
+	assert.Equal(t, statusWaitingReplicaLag, m.snapshot().Waiting)
+	time.Sleep(10 * time.Millisecond)
+	g.set(false)
+	assert.Equal(t, "", m.snapshot().Waiting)
+	assert.True(t, m.report(nil).LagPausedSeconds >= 0.01)
+}
+
+func TestReplicaLag(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	status := func(name string, lag sqltypes.Value) *sqltypes.Result {
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{
+				{Name: "Slave_IO_Running", Type: querypb.Type_VARCHAR},
+				{Name: name, Type: querypb.Type_INT64},
+			},
+			Rows: [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("Yes")), lag}},
+		}
+	}
+
+	// Under and over the max.
+	{
+		fakedbs.AddQuery("show slave status", status("Seconds_Behind_Master", sqltypes.MakeTrusted(querypb.Type_INT64, []byte("12"))))
+		over, lag, err := lagOver(conn, 30)
+		assert.Nil(t, err)
+		assert.False(t, over)
+		assert.Equal(t, "12s", lag)
+
+		fakedbs.AddQuery("show slave status", status("Seconds_Behind_Source", sqltypes.MakeTrusted(querypb.Type_INT64, []byte("31"))))
+		over, lag, err = lagOver(conn, 30)
+		assert.Nil(t, err)
+		assert.True(t, over)
+		assert.Equal(t, "31s", lag)
+	}
+
+	// A stopped replication lags.
+	{
+		fakedbs.AddQuery("show slave status", status("Seconds_Behind_Master", sqltypes.NULL))
+		over, lag, err := lagOver(conn, 30)
+		assert.Nil(t, err)
+		assert.True(t, over)
+		assert.Equal(t, "NULL", lag)
+	}
+
+	// Not a replica.
+	{
+		fakedbs.AddQuery("show slave status", &sqltypes.Result{})
+		_, _, err := replicaLag(conn)
+		assert.Equal(t, "source.is.not.a.replica", err.Error())
+	}
+
+	// SHOW REPLICA STATUS first, where the server knows it.
+	{
+		fakedbs.AddQuery("show replica status", status("Seconds_Behind_Source", sqltypes.MakeTrusted(querypb.Type_INT64, []byte("7"))))
+		lag, ok, err := replicaLag(conn)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, int64(7), lag)
+	}
+}
+
+func TestReplicaLagFallback(t *testing.T) {
+	rec := &recordingExecutor{
+		errs: map[string]error{"SHOW REPLICA STATUS": errors.New("You have an error in your SQL syntax")},
+		results: map[string]*sqltypes.Result{"SHOW SLAVE STATUS": {
+			Fields: []*querypb.Field{{Name: "Seconds_Behind_Master", Type: querypb.Type_INT64}},
+			Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, []byte("3"))}},
+		}},
+	}
+	conn := &Connection{ID: 1, exec: &recordingConn{r: rec}}
+	lag, ok, err := replicaLag(conn)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(3), lag)
+	assert.Equal(t, []string{"SHOW REPLICA STATUS", "SHOW SLAVE STATUS"}, rec.queries)
+}
@@ -10,13 +10,13 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/XeLabs/go-mysqlstack/common"
@@ -27,162 +27,1244 @@ type Files struct {
 	databases []string
 	schemas   []string
 	tables    []string
+	// partials are the partial markers of the dump, see partialMarker.
+	partials []string
+	// temps are the temp files of a crashed dump, see tempFile.
+	temps []string
+	// metas are the per-table metadata files of a dump of the C mydumper,
+	// see tableMetaFile.
+	metas []string
 }
 
 var (
 	dbSuffix     = "-schema-create.sql"
 	schemaSuffix = "-schema.sql"
 	tableSuffix  = ".sql"
+
+	// defaultTxnBatchFileMaxBytes is the largest data file eligible for transaction batching.
+	defaultTxnBatchFileMaxBytes int64 = 1024 * 1024
 )
 
-func loadFiles(log *xlog.Log, dir string) *Files {
+func loadFiles(s Storage) (*Files, error) {
 	files := &Files{}
-	if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Panicf("loader.file.walk.error:%+v", err)
-		}
-
-		if !info.IsDir() {
-			switch {
-			case strings.HasSuffix(path, dbSuffix):
-				files.databases = append(files.databases, path)
-			case strings.HasSuffix(path, schemaSuffix):
-				files.schemas = append(files.schemas, path)
-			default:
-				if strings.HasSuffix(path, tableSuffix) {
-					files.tables = append(files.tables, path)
-				}
+	names, err := s.List()
+	if err != nil {
+		return nil, wrapf(err, "loader.file.walk.error:%v", err)
+	}
+	for _, name := range names {
+		switch {
+		case name == grantsFile:
+		case partialMarker(name):
+			files.partials = append(files.partials, name)
+		case tempFile(name):
+			files.temps = append(files.temps, name)
+		case tableMetaFile(name):
+			files.metas = append(files.metas, name)
+		case strings.HasSuffix(name, dbSuffix):
+			files.databases = append(files.databases, name)
+		case strings.HasSuffix(name, schemaSuffix):
+			files.schemas = append(files.schemas, name)
+		default:
+			if strings.HasSuffix(name, tableSuffix) {
+				files.tables = append(files.tables, name)
+			}
+		}
+	}
+	return files, nil
+}
+
+// checkTableFiles checks the data files are all named 'db.table[.part].sql',
+// the restore relies on it.
+func checkTableFiles(files *Files) error {
+	for _, table := range files.tables {
+		if _, _, _, err := ParseTableFile(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterSchemaVersion keeps only the schema and data files of the tables
+// which belong to the schema version in the manifest.
+func filterSchemaVersion(log *xlog.Log, files *Files, s Storage, version string) error {
+	manifest, err := readManifest(s)
+	if err != nil {
+		return wrapf(err, "restoring.schema.version[%s].requires.manifest:%v", version, err)
+	}
+	tables := manifest.schemaVersionTables(version)
+	if len(tables) == 0 {
+		return fmt.Errorf("restoring.schema.version[%s].has.no.tables.in.manifest", version)
+	}
+
+	var schemas []string
+	for _, schema := range files.schemas {
+		if tables[strings.TrimSuffix(filepath.Base(schema), schemaSuffix)] {
+			schemas = append(schemas, schema)
+		}
+	}
+	var datas []string
+	for _, table := range files.tables {
+		db, tbl, _ := parseTableFile(table)
+		if tables[db+"."+tbl] {
+			datas = append(datas, table)
+		}
+	}
+	log.Info("restoring.schema.version[%s].tables[%d/%d].files[%d/%d]", version, len(schemas), len(files.schemas), len(datas), len(files.tables))
+	files.schemas = schemas
+	files.tables = datas
+	return nil
+}
+
+// filterRecentChunks keeps the n highest numbered data files (parts) of every
+// table, the parts are assumed to increase with time: the dumper numbers the
+// chunks in the order the rows are read, the primary key order for InnoDB, so
+// it holds for the tables keyed by an increasing id or a timestamp. The
+// labels of DumpArgs.ChunkBy are ordered by partLess, the latest dates last.
+// The schemas are left as they are, every table is still created.
+func filterRecentChunks(log *xlog.Log, files *Files, n int) {
+	parts := make(map[string][]string)
+	for _, table := range files.tables {
+		db, tbl, _ := parseTableFile(table)
+		parts[db+"."+tbl] = append(parts[db+"."+tbl], table)
+	}
+
+	var datas []string
+	for _, tables := range parts {
+		sort.Slice(tables, func(i, j int) bool {
+			_, _, a := parseTableFile(tables[i])
+			_, _, b := parseTableFile(tables[j])
+			return partLess(b, a)
+		})
+		if len(tables) > n {
+			tables = tables[:n]
+		}
+		datas = append(datas, tables...)
+	}
+	sort.Strings(datas)
+	log.Info("restoring.recent.chunks[%d].tables[%d].files[%d/%d]", n, len(parts), len(datas), len(files.tables))
+	files.tables = datas
+}
+
+// checkExpectTables checks every expected 'db' or 'db.table' is in the dump,
+// a table needs its schema file and at least one data file.
+func checkExpectTables(files *Files, expect []string) error {
+	dbs := make(map[string]bool)
+	for _, db := range files.databases {
+		dbs[strings.TrimSuffix(filepath.Base(db), dbSuffix)] = true
+	}
+	schemas := make(map[string]bool)
+	for _, schema := range files.schemas {
+		schemas[strings.TrimSuffix(filepath.Base(schema), schemaSuffix)] = true
+	}
+	datas := make(map[string]bool)
+	for _, table := range files.tables {
+		if db, tbl, _, err := ParseTableFile(table); err == nil {
+			datas[db+"."+tbl] = true
+		}
+	}
+
+	var problems []string
+	for _, name := range expect {
+		if !strings.Contains(name, ".") {
+			if !dbs[name] {
+				problems = append(problems, fmt.Sprintf("database %s is absent, no %s%s file", name, name, dbSuffix))
 			}
+			continue
 		}
+		switch {
+		case !schemas[name] && !datas[name]:
+			problems = append(problems, fmt.Sprintf("table %s is absent, no schema and no data file", name))
+		case !schemas[name]:
+			problems = append(problems, fmt.Sprintf("table %s has data but its schema is missing, no %s%s file", name, name, schemaSuffix))
+		case !datas[name]:
+			problems = append(problems, fmt.Sprintf("table %s has a schema but its data is missing, no %s[.part]%s file", name, name, tableSuffix))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("restoring.expect.tables.failed, the dump is incomplete:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// checkTableDatabases checks the database of every schema and data file is
+// created by a schema-create file of the dump or already exists on the target:
+// the tables are restored after a 'use' of their database, so a dump missing a
+// schema-create file, or filtered wrong, would otherwise fail on its first
+// table once the restore has started. The target is only asked when a
+// database has no schema-create file.
+func checkTableDatabases(conn *Connection, files *Files) error {
+	created := make(map[string]bool)
+	for _, db := range files.databases {
+		created[strings.TrimSuffix(filepath.Base(db), dbSuffix)] = true
+	}
+	// The first file of every database not created, and its number of files.
+	first := make(map[string]string)
+	count := make(map[string]int)
+	var missing []string
+	check := func(db string, file string) {
+		if created[db] {
+			return
+		}
+		if _, ok := first[db]; !ok {
+			first[db] = filepath.Base(file)
+			missing = append(missing, db)
+		}
+		count[db]++
+	}
+	for _, schema := range files.schemas {
+		check(strings.SplitN(strings.TrimSuffix(filepath.Base(schema), schemaSuffix), ".", 2)[0], schema)
+	}
+	for _, table := range files.tables {
+		db, _, _ := parseTableFile(table)
+		check(db, table)
+	}
+	if len(missing) == 0 {
 		return nil
-	}); err != nil {
-		log.Panicf("loader.file.walk.error:%+v", err)
 	}
-	return files
+
+	qr, err := conn.Fetch("SHOW DATABASES")
+	if err != nil {
+		return wrapf(err, "restoring.check.databases.error:%v", err)
+	}
+	exists := make(map[string]bool)
+	for _, row := range qr.Rows {
+		exists[row[0].String()] = true
+	}
+	var problems []string
+	for _, db := range missing {
+		if !exists[db] {
+			problems = append(problems, fmt.Sprintf("table file %s references database %s which has no %s%s file and doesn't exist on the target (%d files)", first[db], db, db, dbSuffix, count[db]))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("restoring.check.databases.failed, the dump is incomplete or filtered wrong:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
 }
 
-func restoreDatabaseSchema(log *xlog.Log, conn *Connection, dbs []string) {
+func restoreDatabaseSchema(ctx context.Context, log *xlog.Log, conn *Connection, args *LoadArgs, dbs []string) error {
 	for _, db := range dbs {
 		base := filepath.Base(db)
 		name := strings.TrimSuffix(base, dbSuffix)
 
-		data, err := ReadFile(db)
-		AssertNil(err)
-		sql := common.BytesToString(data)
+		data, err := readFile(args.store(), db)
+		if err != nil {
+			return err
+		}
+		sql, ok := managedStatement(log, args, db, common.BytesToString(data), true)
+		if !ok {
+			continue
+		}
+		if args.UpgradeCharset {
+			sql, _ = upgradeCharset(sql, args.UpgradeCollations, args.UpgradeKeyBytes)
+		}
+		if args.DefaultCollation != "" {
+			var old string
+			if sql, old = defaultDatabaseCollation(sql, args.DefaultCollation); !strings.EqualFold(old, args.DefaultCollation) {
+				log.Info("restoring.default.collation.database[%s].collation[%s].to[%s]", name, old, args.DefaultCollation)
+			}
+		}
+		if sql, err = rewriteStatement(args, db, name, "", sql); err != nil {
+			return wrapf(err, "restoring.rewrite.file[%s].error:%v", db, err)
+		}
 
-		err = conn.Execute(sql)
-		AssertNil(err)
+		exists := false
+		if args.rollback != nil {
+			if exists, err = databaseExists(conn, name); err != nil {
+				return err
+			}
+		}
+		logDDL(log, args, db, sql)
+		if err := executeDDL(ctx, log, conn, args, "database["+name+"]", sql); err != nil {
+			logFailedSQL(log, args, db, statement{sql: sql}, err)
+			return err
+		}
+		if !exists {
+			if err := args.rollback.createdDatabase(name); err != nil {
+				return err
+			}
+		}
+		if err := args.journal.restored(db); err != nil {
+			return err
+		}
 		log.Info("restoring.database[%s]", name)
 	}
+	return nil
 }
 
-func restoreTableSchema(log *xlog.Log, conn *Connection, schemas []string) {
-	for _, schema := range schemas {
-		// use
-		base := filepath.Base(schema)
-		name := strings.Trim(base, schemaSuffix)
-		db := strings.Split(name, ".")[0]
-		sql := fmt.Sprintf("use `%s`", db)
-		err := conn.Execute(sql)
-		AssertNil(err)
+// ParseTableFile splits a data file name like 'db.table.00001.sql' into its
+// database, table and part, the part is "0" if the name has none. The part
+// is a number or the label of a DumpArgs.ChunkBy chunk, like 2024-01-15 or
+// 1.5, everything after the table.
+func ParseTableFile(table string) (db string, tbl string, part string, err error) {
+	base := filepath.Base(table)
+	if !strings.HasSuffix(base, tableSuffix) {
+		return "", "", "", fmt.Errorf("table.file[%s].not.ends.with[%s]", table, tableSuffix)
+	}
+	splits := strings.SplitN(strings.TrimSuffix(base, tableSuffix), ".", 3)
+	if len(splits) < 2 || splits[0] == "" || splits[1] == "" || (len(splits) == 3 && splits[2] == "") {
+		return "", "", "", fmt.Errorf("table.file[%s].not.named.as[db.table[.part]%s]", table, tableSuffix)
+	}
+	part = "0"
+	if len(splits) > 2 {
+		part = splits[2]
+	}
+	return splits[0], splits[1], part, nil
+}
+
+// parseTableFile is ParseTableFile for the names checkTableFiles already accepted.
+func parseTableFile(table string) (db string, tbl string, part string) {
+	db, tbl, part, err := ParseTableFile(table)
+	AssertNil(err)
+	return
+}
 
-		data, err := ReadFile(schema)
-		AssertNil(err)
-		sql = common.BytesToString(data)
-		querys := strings.Split(sql, ";\n")
-		for _, query := range querys {
-			if !strings.HasPrefix(query, "/*") && query != "" {
-				err = conn.Execute(query)
-				AssertNil(err)
+// executeTableFile executes all the statements of a data file, with the
+// replacements of args applied to their string literals, and returns the bytes of it.
+// A txn counts the statements of the transaction of a batch, nil for none.
+// The statements before the offset the ResumeFile records for the file are
+// skipped, and a file out of a batch stops before its next statement once
+// the grace period of the MaxRuntime is over, with a *stoppedError.
+// A statement out of a batch whose server went away is retried once conn is
+// reconnected, see failover. The bytes of the file are held of
+// LoadArgs.MaxInFlightBytes from before it's read until its last statement
+// is executed, the bytes of each statement of LoadArgs.MaxMemory from before
+// it's rewritten until it's executed.
+func executeTableFile(log *xlog.Log, conn *Connection, args *LoadArgs, table string, txn *txnCap) (int, error) {
+	if args.inflight != nil {
+		info, err := args.store().Stat(table)
+		if err != nil {
+			return 0, err
+		}
+		inflight, err := args.inflight.acquire(info.Size())
+		if err != nil {
+			return 0, err
+		}
+		defer args.inflight.release(inflight)
+	}
+	data, err := readFile(args.store(), table)
+	if err != nil {
+		return 0, err
+	}
+	sql := common.BytesToString(data)
+	if args.VerifyFileTrailers {
+		if err := verifyFileTrailer(table, sql); err != nil {
+			return 0, err
+		}
+	}
+	body, _ := splitFileTrailer(sql)
+	db, tbl, _, _ := ParseTableFile(table)
+	execute := conn.Execute
+	if args.UsePrepared {
+		execute = func(query string) error { return executePrepared(conn, db, query) }
+	}
+	stmts := splitStatements(body)
+	from := args.journal.offset(table)
+	if from > 0 {
+		log.Info("restoring.file[%s].resumed.at.offset[%d]", table, from)
+	}
+	args.metrics.fileProgress(conn, table, from, len(sql))
+	for _, stmt := range stmts {
+		if strings.HasPrefix(stmt.sql, "/*") || stmt.offset < from {
+			continue
+		}
+		if txn == nil && args.runtime.interrupted() {
+			return 0, &stoppedError{file: table, offset: stmt.offset}
+		}
+		query, ok := managedStatement(log, args, table, stmt.sql, false)
+		if !ok {
+			continue
+		}
+		// The statement as the file has it sizes the copies of it built by
+		// the rewrites and the driver.
+		memory, err := args.memory.acquire(int64(len(query)))
+		if err != nil {
+			return 0, err
+		}
+		executed, err := executeDataStatement(log, conn, args, table, db, tbl, statement{sql: query, offset: stmt.offset}, execute, txn)
+		args.memory.release(memory)
+		if err != nil {
+			return 0, err
+		}
+		if !executed {
+			continue
+		}
+		if args.CaptureWarnings {
+			if err := captureWarnings(log, conn, args, table, stmt.offset); err != nil {
+				return 0, err
+			}
+		}
+		if err := txn.statementDone(conn, table, stmt.offset+len(stmt.sql)); err != nil {
+			return 0, err
+		}
+		args.metrics.fileProgress(conn, table, stmt.offset+len(stmt.sql), len(sql))
+	}
+	return len(sql), nil
+}
+
+// executeDataStatement rewrites the statement of the data file table of
+// db.tbl and executes it, see executeTableFile. It returns false for a
+// statement the proxy skipped.
+func executeDataStatement(log *xlog.Log, conn *Connection, args *LoadArgs, table string, db string, tbl string, stmt statement, execute func(string) error, txn *txnCap) (bool, error) {
+	query := replaceLiterals(stmt.sql, args.Replacements)
+	if upsert := args.upserts[db+"."+tbl]; upsert != nil {
+		query = upsert.rewrite(query)
+	}
+	if fill := args.fills[db+"."+tbl]; fill != nil {
+		query = fill.rewrite(query)
+	}
+	query = renameTables(args, db, query)
+	query, err := rewriteStatement(args, table, db, tbl, query)
+	if err != nil {
+		return false, wrapf(err, "restoring.rewrite.file[%s].offset[%d].error:%v", table, stmt.offset, err)
+	}
+	if args.CheckUTF8 != "" {
+		if err := checkUTF8(log, args, table, stmt.offset, query); err != nil {
+			return false, err
+		}
+	}
+	logData(log, args, table, query)
+	args.limit.wait(query)
+	err = execute(query)
+	for txn == nil && isUnsentError(err) {
+		if ferr := failover(log, conn, args, fmt.Sprintf("file[%s].offset[%d]", table, stmt.offset), err); ferr != nil {
+			return false, ferr
+		}
+		err = execute(query)
+	}
+	if txn == nil && isGoneError(err) {
+		// The statement may have been executed before the server went away,
+		// it's not run again: the file fails, the ResumeFile goes on from it.
+		logFailedSQL(log, args, table, statement{sql: query, offset: stmt.offset}, err)
+		if jerr := args.journal.stopped(table, stmt.offset); jerr != nil {
+			return false, jerr
+		}
+		return false, &CategorizedError{Category: CategoryConnection, Err: fmt.Errorf("restoring.file[%s].offset[%d].server.gone.after.the.statement.was.sent.it.may.have.been.executed:%v", table, stmt.offset, err)}
+	}
+	if err != nil {
+		if proxySkipSet(log, args, table, query, err) {
+			return false, nil
+		}
+		logFailedSQL(log, args, table, statement{sql: query, offset: stmt.offset}, err)
+		return false, checkViolation(table, stmt.offset, err)
+	}
+	return true, nil
+}
+
+// RestoreTableFile restores one data file on conn: the database is taken from
+// the file name and selected with 'use', the statements are executed with the
+// character set of conn (NewPool connects with utf8, as the dumper does).
+// It returns the bytes of the file.
+func RestoreTableFile(log *xlog.Log, conn *Connection, table string) (int, error) {
+	return restoreTableFile(log, conn, &LoadArgs{}, table)
+}
+
+func restoreTableFile(log *xlog.Log, conn *Connection, args *LoadArgs, table string) (int, error) {
+	db, tbl, _, err := ParseTableFile(table)
+	if err != nil {
+		return 0, err
+	}
+
+	loadEvents(log).FileStarted(db, tbl, table, conn.ID)
+	if err := useDatabase(conn, args, db); err != nil {
+		return 0, err
+	}
+
+	bytes, err := executeTableFile(log, conn, args, table, nil)
+	if err != nil {
+		return 0, err
+	}
+	loadEvents(log).FileDone(db, tbl, table, uint64(bytes), conn.ID)
+	return bytes, nil
+}
+
+func restoreTable(log *xlog.Log, conn *Connection, args *LoadArgs, table string) (int, error) {
+	db, tbl, _ := parseTableFile(table)
+	args.metrics.startWork(conn.ID, db+"."+tbl, table)
+	defer args.metrics.endWork(conn.ID)
+
+	bytes, err := restoreTableFile(log, conn, args, table)
+	if _, ok := err.(*stoppedError); ok {
+		return 0, err
+	}
+	if err != nil {
+		args.metrics.fileFailed(table, err)
+		return 0, wrapf(err, "restoring.file[%s].error:%v", table, err)
+	}
+	args.metrics.threadBytes(conn.ID, uint64(bytes))
+	args.metrics.fileDone(table)
+	return bytes, nil
+}
+
+// restoreTableBatch restores a batch of small data files of the same database
+// in one transaction, any failure rollbacks the whole batch. A batch whose
+// server went away runs again once conn is reconnected, see failover, unless
+// the txnCap committed a part of it or its commit may have been executed.
+func restoreTableBatch(log *xlog.Log, conn *Connection, args *LoadArgs, tables []string) (int, error) {
+	db, _, _ := parseTableFile(tables[0])
+	defer args.metrics.endWork(conn.ID)
+
+	var bytes int
+	for {
+		txn := newTxnCap(args)
+		var table string
+		var err error
+		bytes, table, err = executeTableBatch(log, conn, args, db, tables, txn)
+		if isGoneError(err) && txn.commits == 0 {
+			if err = failover(log, conn, args, fmt.Sprintf("batch.database[%s].files[%d]", db, len(tables)), err); err == nil {
+				continue
 			}
 		}
-		log.Info("restoring.schema[%s]", name)
+		if err == nil {
+			break
+		}
+		if table == "" {
+			return 0, err
+		}
+		args.metrics.fileFailed(table, err)
+		conn.Execute("rollback")
+		if txn.commits > 0 {
+			log.Warning("restoring.batch.database[%s].file[%s].thread[%d].commits[%d].kept.the.resume.file.records.them", db, table, conn.ID, txn.commits)
+		}
+		log.Error("restoring.batch.database[%s].file[%s].thread[%d].error.rollback.batch:%+v", db, table, conn.ID, err)
+		return 0, wrapf(err, "restoring.batch.file[%s].error:%v", table, err)
+	}
+	args.metrics.threadBytes(conn.ID, uint64(bytes))
+	for _, table := range tables {
+		args.metrics.fileDone(table)
 	}
+	log.Debug("restoring.batch.database[%s].files[%d].thread[%d].done...", db, len(tables), conn.ID)
+	return bytes, nil
 }
 
-func restoreTable(log *xlog.Log, conn *Connection, table string) int {
+// executeTableBatch executes the data files of a batch in a transaction on
+// conn, it returns the bytes of the files or the file which failed, empty if
+// the begin or the commit did.
+func executeTableBatch(log *xlog.Log, conn *Connection, args *LoadArgs, db string, tables []string, txn *txnCap) (int, string, error) {
+	log.Debug("restoring.batch.database[%s].files[%d].thread[%d]", db, len(tables), conn.ID)
+	if err := useDatabase(conn, args, db); err != nil {
+		return 0, "", err
+	}
+	if err := conn.Execute("begin"); err != nil {
+		return 0, "", err
+	}
 	bytes := 0
-	part := "0"
-	base := filepath.Base(table)
-	name := strings.Trim(base, tableSuffix)
-	splits := strings.Split(name, ".")
-	db := splits[0]
-	tbl := splits[1]
-	if len(splits) > 2 {
-		part = splits[2]
+	for _, table := range tables {
+		_, tbl, _ := parseTableFile(table)
+		args.metrics.startWork(conn.ID, db+"."+tbl, table)
+		n, err := executeTableFile(log, conn, args, table, txn)
+		if err != nil {
+			return 0, table, err
+		}
+		txn.fileDone(table)
+		bytes += n
 	}
+	if err := conn.Execute("commit"); err != nil {
+		if isGoneError(err) && !isUnsentError(err) {
+			return 0, "", &CategorizedError{Category: CategoryConnection, Err: fmt.Errorf("restoring.batch.database[%s].files[%d].server.gone.after.the.commit.was.sent.it.may.have.been.committed:%v", db, len(tables), err)}
+		}
+		return 0, "", err
+	}
+	return bytes, "", nil
+}
 
-	log.Info("restoring.tables[%s].parts[%s].thread[%d]", tbl, part, conn.ID)
-	sql := fmt.Sprintf("use `%s`", db)
-	err := conn.Execute(sql)
-	AssertNil(err)
+// autoIncrements returns the tables of the schemas restored which have an
+// AUTO_INCREMENT counter recorded in the manifest, none without one. The
+// inserted rows only bump a counter up to the largest id in the datas, which
+// may be lower than the counter of the source.
+func autoIncrements(log *xlog.Log, args *LoadArgs, schemas []string) []*ManifestTable {
+	manifest, err := readManifest(args.store())
+	if err != nil {
+		log.Warning("restoring.auto.increment.skipped.no.manifest:%v", err)
+		return nil
+	}
+	restored := make(map[string]bool)
+	for _, schema := range schemas {
+		restored[strings.TrimSuffix(filepath.Base(schema), schemaSuffix)] = true
+	}
+	var tables []*ManifestTable
+	for _, t := range manifest.Tables {
+		if t.AutoIncrement > 0 && restored[t.Database+"."+t.Table] {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
 
-	data, err := ReadFile(table)
-	AssertNil(err)
-	sql = common.BytesToString(data)
-	querys := strings.Split(sql, ";\n")
-	bytes = len(sql)
-	for _, query := range querys {
-		if !strings.HasPrefix(query, "/*") && query != "" {
-			err = conn.Execute(query)
-			AssertNil(err)
+// restoreAutoIncrement sets the AUTO_INCREMENT counter of a restored table.
+func restoreAutoIncrement(log *xlog.Log, conn *Connection, db string, table string, n uint64) error {
+	if err := conn.Execute(fmt.Sprintf("ALTER TABLE `%s`.`%s` AUTO_INCREMENT=%d", db, table, n)); err != nil {
+		return err
+	}
+	log.Info("restoring.table[%s.%s].auto.increment[%d]", db, table, n)
+	return nil
+}
+
+// autoIncrementFinalizer sets the counter of a table of tables once its data
+// files are restored, see tableBarrier.
+func autoIncrementFinalizer(log *xlog.Log, args *LoadArgs, tables []*ManifestTable) tableFinalizer {
+	counters := make(map[string]uint64)
+	for _, t := range tables {
+		counters[t.Database+"."+t.Table] = t.AutoIncrement
+	}
+	return tableFinalizer{name: "auto_increment", run: func(conn *Connection, db string, table string) error {
+		if n := counters[db+"."+table]; n > 0 {
+			return restoreAutoIncrement(log, conn, db, args.targetTable(table), n)
+		}
+		return nil
+	}}
+}
+
+// filesBytes returns the total size of the files.
+func filesBytes(s Storage, files []string) uint64 {
+	var n uint64
+	for _, file := range files {
+		if info, err := s.Stat(file); err == nil {
+			n += uint64(info.Size())
 		}
 	}
-	log.Info("restoring.tables[%s].parts[%s].thread[%d].done...", tbl, part, conn.ID)
-	return bytes
+	return n
 }
 
-func Loader(log *xlog.Log, args *Args) {
-	pool, err := NewPool(log, args.Threads, args.Address, args.User, args.Password)
-	AssertNil(err)
+// unitBatch is how the data files are grouped into the units of the
+// scheduler, see LoadArgs.TxnBatchSize and SmallFileBatch.
+type unitBatch struct {
+	// size is the most files of a batch, less than 2 for no batches.
+	size int
+	// maxBytes is the largest file of a batch.
+	maxBytes int64
+	// txn restores a batch in one transaction, see restoreTableBatch,
+	// otherwise back to back in autocommit, see restoreSmallFiles.
+	txn bool
+}
+
+// unitBatch returns the batches of args: the ones of TxnBatchSize or of
+// SmallFileBatch, which Validate refuses together, none without either.
+func (args *LoadArgs) unitBatch() unitBatch {
+	if args.SmallFileBatch > 1 {
+		return unitBatch{size: args.SmallFileBatch, maxBytes: args.smallFileMaxBytes()}
+	}
+	maxBytes := args.TxnBatchFileMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultTxnBatchFileMaxBytes
+	}
+	return unitBatch{size: args.TxnBatchSize, maxBytes: maxBytes, txn: true}
+}
+
+// restoreUnit restores a unit of the scheduler on conn, a file on its own or
+// a batch of batch. It returns the bytes of the files and how many of them
+// stay restored before the one which failed.
+func restoreUnit(log *xlog.Log, conn *Connection, args *LoadArgs, batch unitBatch, unit []string) (int, int, error) {
+	switch {
+	case len(unit) == 1:
+		n, err := restoreTable(log, conn, args, unit[0])
+		return n, 0, err
+	case batch.txn:
+		n, err := restoreTableBatch(log, conn, args, unit)
+		return n, 0, err
+	default:
+		return restoreSmallFiles(log, conn, args, unit)
+	}
+}
+
+// batchTables groups the data files into restore units.
+// If the batch size is less than 2 every file is a unit on its own, otherwise
+// files not larger than its maxBytes are grouped by database into batches of
+// at most size files, a batch never crosses databases since it runs under one
+// 'use'. A named pipe without a size is a unit on its own.
+func batchTables(s Storage, tables []string, batch unitBatch) [][]string {
+	size, maxBytes := batch.size, batch.maxBytes
+	var units [][]string
+	if size < 2 {
+		for _, table := range tables {
+			units = append(units, []string{table})
+		}
+		return units
+	}
+
+	pending := make(map[string][]string)
+	var dbs []string
+	for _, table := range tables {
+		if info, err := s.Stat(table); err == nil && (info.Size() > maxBytes || unsizedPipe(info)) {
+			units = append(units, []string{table})
+			continue
+		}
+		db, _, _ := parseTableFile(table)
+		if _, ok := pending[db]; !ok {
+			dbs = append(dbs, db)
+		}
+		pending[db] = append(pending[db], table)
+		if len(pending[db]) >= size {
+			units = append(units, pending[db])
+			pending[db] = []string{}
+		}
+	}
+	for _, db := range dbs {
+		if len(pending[db]) > 0 {
+			units = append(units, pending[db])
+		}
+	}
+	return units
+}
+
+// shuffleUnits shuffles the restore units with a source of seed, so the big
+// tables are spread over the run and the same seed gives the same order.
+func shuffleUnits(units [][]string, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	for i := range units {
+		j := r.Intn(i + 1)
+		units[i], units[j] = units[j], units[i]
+	}
+}
+
+// loadPingIdle is the Pool.pingIdle of the pools of a restore: a connection
+// left idle for longer, through the schemas or a hook, is pinged before it
+// restores again.
+const loadPingIdle = 30 * time.Second
+
+// newLoadPool creates the pool of size connections of a restore, on the
+// executors of the LoadConfig if it has some. The connections reconnect to
+// the addresses of the LoadArgs.Address in order, see failover, and are
+// pinged when they are taken after loadPingIdle. With LoadArgs.SkipBinlog
+// they don't write the binlog, a reconnected one either.
+func newLoadPool(log *xlog.Log, args *LoadArgs, size int) (*Pool, error) {
+	var pool *Pool
+	var err error
+	if args.executor != nil {
+		var addresses []string
+		if addresses, err = parseAddresses(args.Address); err != nil {
+			return nil, err
+		}
+		pool, err = newPool(log, size, addresses, executorDial(args.executor))
+	} else {
+		pool, err = NewPool(log, size, args.Address, args.User, args.Password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pool.pingIdle = loadPingIdle
+	if args.SkipBinlog {
+		if err := pool.executeAll("SET sql_log_bin=0"); err != nil {
+			pool.Close()
+			return nil, wrapf(err, "restoring.skip.binlog.error:%v, it needs SUPER or SYSTEM_VARIABLES_ADMIN", err)
+		}
+	}
+	return pool, nil
+}
+
+// load runs a restore with the metrics of args already created, see Loader.Run.
+// The first error of a worker stops the dispatch of the files, the files
+// already being restored are waited for. A done ctx does the same and closes
+// the connections, so the files being restored fail at their next statement.
+// The LoadArgs.PostSQLOnFailure scripts run once it returns an error.
+func load(ctx context.Context, log *xlog.Log, args *LoadArgs) (err error) {
+	postSQL, err := readPostSQL(args.PostSQL)
+	if err != nil {
+		return err
+	}
+	onFailure, err := readPostSQL(args.PostSQLOnFailure)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// The error of the restore is the one returned.
+		if ferr := runPostSQL(log, args, onFailure, true, err); ferr != nil {
+			log.Error("restoring.post.sql.on.failure.error:%v", ferr)
+		}
+	}()
+
+	// The named files give the dump dir if there is none.
+	var names []string
+	if len(args.Files) > 0 {
+		dir, resolved, err := resolveFiles(args.Outdir, args.Files)
+		if err != nil {
+			return err
+		}
+		args.Outdir, names = dir, resolved
+		args.metrics.setFilesOnly(names)
+	}
+	storage, err := openDumpStorage(log, args.Outdir, args.Volumes)
+	if err != nil {
+		return err
+	}
+	storage = limitOpenFiles(storage, args.MaxOpenFiles)
+	args.storage = storage
+	if args.rollback, err = openRollbackLog(args.RollbackFile, args.Outdir); err != nil {
+		return err
+	}
+	defer args.rollback.close(log)
+	if args.journal, err = openResumeJournal(log, args.ResumeFile, args.Outdir, args.Resume); err != nil {
+		return err
+	}
+	defer args.journal.close()
+	args.runtime = newRuntimeLimit(log, "restoring", args.MaxRuntime, args.MaxRuntimeGrace, nil)
+	defer args.runtime.close()
+
+	// cancel stops the restore once the OnProgress callback asks for it.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pool, err := newLoadPool(log, args, args.poolThreads())
+	if err != nil {
+		return err
+	}
 	defer pool.Close()
+	defer pool.CloseOnDone(ctx)()
 
-	files := loadFiles(log, args.Outdir)
+	args.metrics.pool = pool
+	config := *args
+	config.Password = redacted
+	config.Targets = redactTargets(args.Targets)
+	args.metrics.config = &config
+	stop, err := serveRun(log, args.metrics, args.MetricsListen, args.StatusListen, args.StatusToken)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	checkDumpVersion(log, storage)
+	checkDumpPartitions(log, storage)
+	checkDumpFailures(log, storage)
+	checkDumpConsistency(log, storage)
+	checkDumpIncremental(log, storage, args)
+	var files *Files
+	if len(names) > 0 {
+		conn := pool.Get()
+		files, err = namedFiles(log, conn, storage, args, names)
+		pool.Put(conn)
+	} else {
+		files, err = loadFiles(storage)
+	}
+	if err != nil {
+		return err
+	}
+	if storage, err = openPipes(ctx, log, storage, args, files); err != nil {
+		return err
+	}
+	args.storage = storage
+	if err := checkSourceIncludes(log, storage, files, args.ExpandSource); err != nil {
+		return err
+	}
+	if err := checkTableFiles(files); err != nil {
+		return err
+	}
+	notDumpedMarker(storage, files)
+	warnTempFiles(log, files)
+	if err := checkPartialMarkers(log, files, args.AllowPartialDump); err != nil {
+		return err
+	}
+	if err := checkSmokeFiles(log, files, args.AllowSmoke); err != nil {
+		return err
+	}
+	if len(args.ExpectTables) > 0 {
+		if err := checkExpectTables(files, args.ExpectTables); err != nil {
+			return err
+		}
+		log.Info("restoring.expect.tables[%d].all.present", len(args.ExpectTables))
+	}
+	if args.route != nil {
+		if err := filterTarget(log, args, files); err != nil {
+			return err
+		}
+	}
+	if args.SchemaVersion != "" {
+		if err := filterSchemaVersion(log, files, storage, args.SchemaVersion); err != nil {
+			return err
+		}
+	}
+	filter, err := args.tableFilter()
+	if err != nil {
+		return err
+	}
+	if filter != nil {
+		if err := filterTables(log, args, files, storage, filter); err != nil {
+			return err
+		}
+	}
+	if args.RecentChunks > 0 {
+		filterRecentChunks(log, files, args.RecentChunks)
+	}
+	// The lock before the target is touched, a restore it refuses changes nothing.
+	whole := filter == nil && args.route == nil && len(args.Files) == 0
+	unlock, err := lockTarget(log, args, files, whole)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	defer tuneTarget(log, args)()
+	restored := make(map[string]bool)
+	for _, schema := range files.schemas {
+		restored[strings.TrimSuffix(filepath.Base(schema), schemaSuffix)] = true
+	}
+	logCompatibility(log, storage, restored)
+	{
+		// The incompatibilities first, they tell what an older target fails.
+		conn := pool.Get()
+		err := checkIncompatibilities(log, conn, args, files)
+		if err == nil {
+			err = checkServerVersion(log, conn, args)
+		}
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+	}
+	if args.Upsert {
+		if args.upserts, err = readUpsertTables(log, storage, files.schemas, files.tables, args.incremental); err != nil {
+			return err
+		}
+	}
+	if args.CheckUTF8 != "" {
+		if args.utf8Tables, err = readUTF8Tables(log, storage, files.schemas, files.tables); err != nil {
+			return err
+		}
+	}
+	if err := filterEmptyFiles(log, args, storage, files); err != nil {
+		return err
+	}
+	// all are the files of the restore, the phases after the datas check
+	// them all even if the previous runs of a resume restored some.
+	all := *files
+	args.journal.skip(log, files)
+	args.metrics.setFiles(len(files.tables))
+	args.metrics.setTotalBytes(filesBytes(storage, files.tables))
+	if rows := mydumperRows(log, storage, &all); len(rows) > 0 {
+		total := restoredRows(rows, all.schemas)
+		args.metrics.setTotalRows(total)
+		log.Info("restoring.mydumper.metadata.tables[%d].rows[%d]", len(rows), total)
+	}
 
 	// database.
+	phase := args.metrics.phaseStarted("databases")
 	conn := pool.Get()
-	restoreDatabaseSchema(log, conn, files.databases)
+	err = checkTableDatabases(conn, &all)
+	if err == nil {
+		err = restoreDatabaseSchema(ctx, log, conn, args, files.databases)
+	}
 	pool.Put(conn)
+	if err != nil {
+		return err
+	}
+	args.metrics.phaseDone("databases", phase)
 
 	// tables.
-	conn = pool.Get()
-	restoreTableSchema(log, conn, files.schemas)
-	pool.Put(conn)
+	phase = args.metrics.phaseStarted("schemas")
+	if err := restoreTableSchemas(ctx, log, pool, args, files.schemas, args.schemaThreads()); err != nil {
+		return err
+	}
+	args.metrics.phaseDone("schemas", phase)
+	if args.VerifySchema {
+		phase := args.metrics.phaseStarted(verifySchemaPhase)
+		if err := verifySchemas(ctx, log, pool, args, all.schemas); err != nil {
+			return err
+		}
+		args.metrics.phaseDone(verifySchemaPhase, phase)
+	}
+	if args.FillMissingColumns {
+		conn := pool.Get()
+		args.fills, err = readFillTables(log, conn, args, storage, all.schemas, files.tables)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	var finalizers []tableFinalizer
+	var counters []*ManifestTable
+	if args.PreserveAutoIncrement {
+		counters = autoIncrements(log, args, all.schemas)
+		finalizers = append(finalizers, autoIncrementFinalizer(log, args, counters))
+	}
+	barrier := newTableBarrier(log, files.tables, finalizers)
+	if args.DeferConstraints {
+		if err := pool.executeAll("SET foreign_key_checks=0"); err != nil {
+			return err
+		}
+		log.Info("restoring.defer.constraints.foreign.key.checks.off")
+	}
+	var partial *PartialError
+	if len(files.tables) == 0 {
+		log.Info("restoring.schema.only.dump.databases[%d].tables[%d].no.data", len(files.databases), len(files.schemas))
+	} else if err := restoreDatas(ctx, cancel, log, pool, args, files, barrier); err != nil {
+		if partial, _ = err.(*PartialError); partial == nil {
+			return err
+		}
+	}
+
+	// The tables without data files were not finalized by the barrier.
+	if len(counters) > 0 {
+		conn := pool.Get()
+		for _, t := range counters {
+			if barrier.has(t.Database, t.Table) {
+				continue
+			}
+			if err := restoreAutoIncrement(log, conn, t.Database, args.targetTable(t.Table), t.AutoIncrement); err != nil {
+				pool.Put(conn)
+				return err
+			}
+		}
+		pool.Put(conn)
+	}
+	// skipped reports whether the phase is skipped as the MaxRuntime is
+	// reached, it's recorded in partial: a resume runs it.
+	skipped := func(phase string) bool {
+		if partial == nil && args.runtime.reached() {
+			partial = &PartialError{Mode: "load", MaxRuntime: args.MaxRuntime}
+		}
+		if partial == nil {
+			return false
+		}
+		log.Warning("restoring.phase[%s].skipped.by.max.runtime[%v]", phase, args.MaxRuntime)
+		partial.SkippedPhases = append(partial.SkippedPhases, phase)
+		return true
+	}
+	if args.DeferConstraints && !skipped(validatePhase) {
+		phase := args.metrics.phaseStarted(validatePhase)
+		if err := validateConstraints(log, pool, args, all.schemas, all.tables); err != nil {
+			return err
+		}
+		args.metrics.phaseDone(validatePhase, phase)
+	}
+	if args.VerifyChecksums && !skipped("verify") {
+		phase := args.metrics.phaseStarted("verify")
+		if err := verifyChecksums(log, pool, args, all.schemas); err != nil {
+			return err
+		}
+		args.metrics.phaseDone("verify", phase)
+	}
+	if len(args.OptimizeTables) > 0 && !skipped(optimizePhase) {
+		phase := args.metrics.phaseStarted(optimizePhase)
+		if err := optimizeTables(ctx, log, pool, args, all.schemas); err != nil {
+			return err
+		}
+		args.metrics.phaseDone(optimizePhase, phase)
+	}
+	if args.Grants && !skipped("grants") {
+		phase := args.metrics.phaseStarted("grants")
+		conn := pool.Get()
+		err := restoreGrants(log, conn, args)
+		pool.Put(conn)
+		if err != nil {
+			return err
+		}
+		args.metrics.phaseDone("grants", phase)
+	}
+	if len(args.WarmTables) > 0 && !skipped(warmPhase) {
+		phase := args.metrics.phaseStarted(warmPhase)
+		if err := warmTables(ctx, log, pool, args, all.schemas); err != nil {
+			return err
+		}
+		args.metrics.phaseDone(warmPhase, phase)
+	}
+	if len(postSQL) > 0 && !skipped(postSQLPhase) {
+		phase := args.metrics.phaseStarted(postSQLPhase)
+		if err := runPostSQL(log, args, postSQL, false, nil); err != nil {
+			return err
+		}
+		args.metrics.phaseDone(postSQLPhase, phase)
+	}
+	args.metrics.phaseStarted("done")
+	if partial != nil {
+		return partial
+	}
+	return nil
+}
+
+// restoreDatas restores the data files of files on the connections of the
+// pool, the tables are finalized by barrier once their files are restored.
+// cancel stops the restore once the OnProgress callback asks for it. Once the
+// MaxRuntime is reached no file is started, the run returns a *PartialError
+// with the files not started and the ones stopped by the grace period.
+func restoreDatas(ctx context.Context, cancel context.CancelFunc, log *xlog.Log, pool *Pool, args *LoadArgs, files *Files, barrier *tableBarrier) error {
+	storage := args.store()
+	batch := args.unitBatch()
+	units := batchTables(storage, files.tables, batch)
+	if args.UsePrepared {
+		if err := pool.WarmUp(); err != nil {
+			return err
+		}
+		log.Info("restoring.prepared.statements.pool.warmed.up[%d]", args.poolThreads())
+	}
 
 	// Shuffle the tables
-	for i := range files.tables {
-		j := rand.Intn(i + 1)
-		files.tables[i], files.tables[j] = files.tables[j], files.tables[i]
+	seed := args.ShuffleSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
 	}
+	shuffleUnits(units, seed)
+	log.Info("restoring.shuffle.seed[%d].units[%d]", seed, len(units))
+
+	hooks := newTableHooks(log, args, files.tables)
+	args.inflight = newByteSemaphore(ctx, args.MaxInFlightBytes)
+	args.memory = newByteSemaphore(ctx, args.MaxMemory)
+	args.limit = newRateLimit(args)
 
 	var wg sync.WaitGroup
-	var bytes uint64
-	t := time.Now()
-	for _, table := range files.tables {
-		conn := pool.Get()
+	var errs firstError
+	t := args.metrics.phaseStarted("data")
+	args.metrics.threadsStarted(args.dataThreads())
+	limit := newPhaseLimit(args.metrics, "data", args.dataThreads())
+	defer limit.done()
+	stopEvents := args.metrics.collectFileEvents()
+	defer stopEvents()
+
+	if args.ReplicaLagAddress != "" {
+		args.lag = newLagGate()
+		args.metrics.setLagGate(args.lag)
+		w := &lagWatch{action: "restoring", address: args.ReplicaLagAddress, user: args.User, password: args.Password, max: args.MaxReplicaLag, gate: args.lag}
+		stopLag, err := watchReplicaLag(ctx, log, w, nil)
+		if err != nil {
+			return err
+		}
+		defer stopLag()
+	}
+
+	stopTick := tickEvery(time.Millisecond*time.Duration(args.IntervalMs), func() {
+		loadEvents(log).ProgressTick(args.metrics.progressStats(args.dataThreads(), t))
+		if paused, ok := args.lag.pausedFor(); ok {
+			log.Warning("restoring.paused.by.replica.lag.cost[%.2fsec]", paused.Seconds())
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err := args.progress(); err != nil {
+			log.Warning("restoring.stopped.by.progress:%v", err)
+			errs.set(err)
+			cancel()
+		}
+	})
+	defer stopTick()
+
+	// started are the files handed to a thread, stopped the ones stopped by
+	// the grace period of the MaxRuntime, unstarted the ones of a small file
+	// batch after the one stopped.
+	started := make(map[string]bool)
+	var mu sync.Mutex
+	var stopped, unstarted []string
+	sched := newUnitScheduler(units, args.MaxThreadsPerDatabase, args.TableThreads)
+	for {
+		// No unit is dispatched while the replica lags.
+		args.lag.wait()
+		// The unit is taken once a thread is free, the best pick of the cap.
+		conn := limit.get(pool)
+		scheduled, ok := sched.next(conn.db)
+		if !ok {
+			limit.put(pool, conn)
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			errs.set(err)
+		}
+		if errs.get() != nil || args.runtime.reached() {
+			sched.done(scheduled)
+			limit.put(pool, conn)
+			break
+		}
+		for _, file := range scheduled {
+			started[file] = true
+		}
 		wg.Add(1)
-		go func(conn *Connection, table string) {
+		go func(conn *Connection, scheduled []string) {
+			args.metrics.workerStarted()
+			working := limit.working()
 			defer func() {
+				working()
+				sched.done(scheduled)
+				args.metrics.workerDone()
 				wg.Done()
-				pool.Put(conn)
+				limit.put(pool, conn)
 			}()
-			r := restoreTable(log, conn, table)
-			atomic.AddUint64(&bytes, uint64(r))
-		}(conn, table)
+			unit := hooks.beginUnit(ctx, scheduled)
+			if len(unit) == 0 {
+				return
+			}
+			// done are the files of a small file batch restored before
+			// the one which failed.
+			r, done, err := restoreUnit(log, conn, args, batch, unit)
+			args.metrics.addProgress(conn.ID, uint64(r), 0)
+			// A file stopped by the MaxRuntime is not a failure, the
+			// ResumeFile has the statement it goes on from.
+			stop, _ := err.(*stoppedError)
+			if stop != nil {
+				log.Warning("restoring.file[%s].stopped.by.max.runtime.resumes.at.offset[%d]", stop.file, stop.offset)
+				mu.Lock()
+				stopped = append(stopped, stop.file)
+				unstarted = append(unstarted, unit[done+1:]...)
+				mu.Unlock()
+				if jerr := args.journal.stopped(stop.file, stop.offset); jerr != nil {
+					errs.set(jerr)
+				}
+			}
+			restored := unit
+			if err != nil {
+				restored = unit[:done]
+			}
+			for i, file := range restored {
+				// Recorded before the table is finalized, a resume finalizes it again.
+				if jerr := args.journal.restored(file); jerr != nil {
+					err, restored = jerr, restored[:i]
+					break
+				}
+			}
+			for i, file := range unit {
+				// The post-table hook runs once the table is finalized.
+				fileErr := err
+				if i < len(restored) {
+					fileErr = nil
+				}
+				if ferr := barrier.done(conn, file, fileErr); ferr != nil {
+					errs.set(ferr)
+					fileErr = ferr
+				}
+				hooks.end(file, fileErr)
+			}
+			if _, ok := err.(*stoppedError); err != nil && !ok {
+				errs.set(err)
+			}
+		}(conn, scheduled)
 	}
 
-	tick := time.NewTicker(time.Millisecond * time.Duration(args.IntervalMs))
-	defer tick.Stop()
-	go func() {
-		for range tick.C {
-			diff := time.Since(t).Seconds()
-			bytes := float64(atomic.LoadUint64(&bytes) / 1024 / 1024)
-			rates := bytes / diff
-			log.Info("restoring.allbytes[%vMB].time[%.2fsec].rates[%.2fMB/sec]...", bytes, diff, rates)
-		}
-	}()
-
 	wg.Wait()
-	elapsed := time.Since(t).Seconds()
-	log.Info("restoring.all.done.cost[%.2fsec].allbytes[%.2fMB].rate[%.2fMB/s]", elapsed, float64(bytes/1024/1024), (float64(bytes/1024/1024) / elapsed))
+	if args.MaxThreadsPerDatabase > 0 || len(args.TableThreads) > 0 {
+		args.metrics.setThrottled(sched.throttledFor())
+	}
+	if args.inflight != nil {
+		log.Info("restoring.max.in.flight.bytes[%d].waited[%.2fsec]", args.MaxInFlightBytes, args.inflight.waitedFor().Seconds())
+	}
+	if args.memory != nil {
+		log.Info("restoring.max.memory[%d].waited[%.2fsec]", args.MaxMemory, args.memory.waitedFor().Seconds())
+	}
+	if args.limit != nil {
+		logRateLimit(log, args)
+	}
+	if s, ok := storage.(*fileLimitStorage); ok {
+		log.Info("restoring.max.open.files[%d].waited[%.2fsec]", args.MaxOpenFiles, s.waitedFor().Seconds())
+	}
+	hooks.finish()
+	args.metrics.threadsDone()
+	if err := errs.get(); err != nil {
+		return err
+	}
+	if err := hooks.err(); err != nil {
+		return err
+	}
+	if args.runtime.reached() {
+		for _, file := range unstarted {
+			started[file] = false
+		}
+		var notAttempted []string
+		for _, file := range files.tables {
+			if !started[file] {
+				notAttempted = append(notAttempted, file)
+			}
+		}
+		if len(notAttempted) > 0 || len(stopped) > 0 {
+			sort.Strings(stopped)
+			return &PartialError{Mode: "load", MaxRuntime: args.MaxRuntime, NotAttempted: notAttempted, Interrupted: stopped}
+		}
+	}
+	args.metrics.phaseDone("data", t)
+	return nil
 }
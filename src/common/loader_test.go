@@ -10,15 +10,66 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
 	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
 	"github.com/XeLabs/go-mysqlstack/xlog"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestLoader(t *testing.T) {
+func TestLoaderBatchTables(t *testing.T) {
+	dir := "/tmp/loaderbatchtest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	var tables []string
+	for _, name := range []string{"a.t1.00001", "a.t2.00001", "b.t1.00001", "a.t3.00001", "a.big.00001", "b.t2.00001"} {
+		file := fmt.Sprintf("%s/%s.sql", dir, name)
+		data := "INSERT INTO `t` VALUES (1);\n"
+		if strings.Contains(name, "big") {
+			data = strings.Repeat(data, 100)
+		}
+		x := WriteFile(file, data)
+		AssertNil(x)
+		tables = append(tables, file)
+	}
+
+	// No batching.
+	{
+		units := batchTables(NewDirStorage(""), tables, unitBatch{size: 1, maxBytes: 1024})
+		assert.Equal(t, 6, len(units))
+	}
+
+	// Batch by database, big file on its own.
+	{
+		units := batchTables(NewDirStorage(""), tables, unitBatch{size: 2, maxBytes: 1024, txn: true})
+		want := [][]string{
+			{dir + "/a.t1.00001.sql", dir + "/a.t2.00001.sql"},
+			{dir + "/a.big.00001.sql"},
+			{dir + "/b.t1.00001.sql", dir + "/b.t2.00001.sql"},
+			{dir + "/a.t3.00001.sql"},
+		}
+		assert.Equal(t, want, units)
+	}
+
+	// The batches of the arguments, computed once for both kinds.
+	{
+		assert.Equal(t, unitBatch{size: 0, maxBytes: defaultTxnBatchFileMaxBytes, txn: true}, (&LoadArgs{}).unitBatch())
+		assert.Equal(t, unitBatch{size: 8, maxBytes: 4096, txn: true}, (&LoadArgs{TxnBatchSize: 8, TxnBatchFileMaxBytes: 4096}).unitBatch())
+		assert.Equal(t, unitBatch{size: 16, maxBytes: defaultSmallFileMaxBytes}, (&LoadArgs{SmallFileBatch: 16}).unitBatch())
+	}
+}
+
+func TestLoaderTxnBatch(t *testing.T) {
 	log := xlog.NewStdLog(xlog.Level(xlog.DEBUG))
 	fakedbs := driver.NewTestHandler(log)
 	server, err := driver.MockMysqlServer(log, fakedbs)
@@ -29,21 +80,536 @@ func TestLoader(t *testing.T) {
 	// fakedbs.
 	{
 		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
-		fakedbs.AddQuery("create database if not exists `test`", &sqltypes.Result{})
-		fakedbs.AddQuery("create table `t1` (`a` int(11) default null,`b` varchar(100) default null) engine=innodb", &sqltypes.Result{})
+		fakedbs.AddQuery("begin", &sqltypes.Result{})
+		fakedbs.AddQuery("commit", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+	}
+
+	dir := makeTinyTablesDump(100)
+	args := &LoadArgs{
+		Outdir:       dir,
+		User:         "mock",
+		Password:     "mock",
+		Threads:      4,
+		Address:      address,
+		IntervalMs:   500,
+		TxnBatchSize: 10,
+	}
+	// Loader.
+	{
+		_, err := NewLoader(LoadConfig{LoadArgs: *args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 10, fakedbs.GetQueryCalledNum("commit"))
+}
+
+func TestLoaderUseAffinity(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.DEBUG))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQuery("use `tiny`", &sqltypes.Result{})
 		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
 	}
 
-	args := &Args{
-		Outdir:     "/tmp/dumpertest",
+	dir := makeTinyTablesDump(100)
+	args := &LoadArgs{
+		Outdir:     dir,
 		User:       "mock",
 		Password:   "mock",
-		Threads:    16,
+		Threads:    4,
 		Address:    address,
 		IntervalMs: 500,
 	}
 	// Loader.
 	{
-		Loader(log, args)
+		_, err := NewLoader(LoadConfig{LoadArgs: *args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+	}
+	// One 'use' per connection, not per file.
+	assert.True(t, fakedbs.GetQueryCalledNum("use `tiny`") <= 4)
+}
+
+// makeTinyTablesDump writes a dump directory with n one-row tables in database 'tiny'.
+func makeTinyTablesDump(n int) string {
+	dir := "/tmp/loadertinytables"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for i := 0; i < n; i++ {
+		file := fmt.Sprintf("%s/tiny.t%d.00001.sql", dir, i)
+		x := WriteFile(file, fmt.Sprintf("INSERT INTO `t%d`(`a`) VALUES\n(%d);\n", i, i))
+		AssertNil(x)
+	}
+	return dir
+}
+
+func benchmarkLoader(b *testing.B, batch int, prepared bool) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	AssertNil(err)
+	defer server.Close()
+
+	fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+	fakedbs.AddQuery("begin", &sqltypes.Result{})
+	fakedbs.AddQuery("commit", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("prepare .*", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("set .*", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("execute .*", &sqltypes.Result{})
+
+	args := &LoadArgs{
+		Outdir:       makeTinyTablesDump(1000),
+		User:         "mock",
+		Password:     "mock",
+		Threads:      8,
+		Address:      server.Addr(),
+		IntervalMs:   1000,
+		TxnBatchSize: batch,
+		UsePrepared:  prepared,
+	}
+	loader := NewLoader(LoadConfig{LoadArgs: *args, Log: log})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := loader.Run(context.Background())
+		AssertNil(err)
+	}
+}
+
+func BenchmarkLoaderPerTable(b *testing.B) {
+	benchmarkLoader(b, 0, false)
+}
+
+func BenchmarkLoaderTxnBatch100(b *testing.B) {
+	benchmarkLoader(b, 100, false)
+}
+
+func BenchmarkLoaderPrepared(b *testing.B) {
+	benchmarkLoader(b, 0, true)
+}
+
+func TestLoaderShuffleUnits(t *testing.T) {
+	units := func() [][]string {
+		var units [][]string
+		for i := 1; i <= 20; i++ {
+			units = append(units, []string{fmt.Sprintf("db.t%d.sql", i)})
+		}
+		return units
+	}
+
+	a, b, c := units(), units(), units()
+	shuffleUnits(a, 42)
+	shuffleUnits(b, 42)
+	shuffleUnits(c, 43)
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+	assert.NotEqual(t, units(), a)
+	seen := make(map[string]bool)
+	for _, unit := range a {
+		seen[unit[0]] = true
+	}
+	assert.Equal(t, 20, len(seen))
+}
+
+func TestLoaderParseTableFile(t *testing.T) {
+	tests := []struct {
+		file string
+		db   string
+		tbl  string
+		part string
+		err  bool
+	}{
+		{"/tmp/x/test.t1.00001.sql", "test", "t1", "00001", false},
+		{"test.t1.sql", "test", "t1", "0", false},
+		{"sq.sales.00002.sql", "sq", "sales", "00002", false},
+		// The labels of -chunk-by.
+		{"test.events.2024-01-15.sql", "test", "events", "2024-01-15", false},
+		{"test.events.null.sql", "test", "events", "null", false},
+		{"test.prices.-2.5.sql", "test", "prices", "-2.5", false},
+		{"test.t1..sql", "", "", "", true},
+		{"test.sql", "", "", "", true},
+		{"test.t1.00001.txt", "", "", "", true},
+		{".t1.sql", "", "", "", true},
+	}
+	for _, test := range tests {
+		db, tbl, part, err := ParseTableFile(test.file)
+		assert.Equal(t, test.err, err != nil, test.file)
+		assert.Equal(t, test.db, db)
+		assert.Equal(t, test.tbl, tbl)
+		assert.Equal(t, test.part, part)
+	}
+}
+
+func TestLoaderRestoreTableFile(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.DEBUG))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into `t1`.*", &sqltypes.Result{})
+		fakedbs.AddQueryErrorPattern("insert into `t2`.*", errors.New("mock.insert.error"))
+	}
+
+	pool, err := NewPool(log, 1, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	dir := "/tmp/restoretablefiletest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	data := "INSERT INTO `t1`(`a`) VALUES\n(1);\n"
+	x = WriteFile(dir+"/test.t1.00001.sql", data)
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t2.00001.sql", "INSERT INTO `t2`(`a`) VALUES\n(1);\n")
+	AssertNil(x)
+
+	// Ok.
+	{
+		bytes, err := RestoreTableFile(log, conn, dir+"/test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, len(data), bytes)
+	}
+
+	// Execute error.
+	{
+		_, err := RestoreTableFile(log, conn, dir+"/test.t2.00001.sql")
+		assert.NotNil(t, err)
+	}
+
+	// Bad name.
+	{
+		_, err := RestoreTableFile(log, conn, dir+"/test.sql")
+		assert.NotNil(t, err)
+	}
+
+	// Not exists.
+	{
+		_, err := RestoreTableFile(log, conn, dir+"/test.t3.00001.sql")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestLoaderExpectTables(t *testing.T) {
+	dir := "/tmp/expecttablestest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, data := range map[string]string{
+		"test-schema-create.sql":  "create database if not exists `test`;",
+		"test.t1-schema.sql":      "CREATE TABLE `t1` (`a` int);\n",
+		"test.t1.00001.sql":       "INSERT INTO `t1`(`a`) VALUES\n(1);\n",
+		"test.empty-schema.sql":   "CREATE TABLE `empty` (`a` int);\n",
+		"test.noschema.00001.sql": "INSERT INTO `noschema`(`a`) VALUES\n(1);\n",
+		"test.t2-schema.sql":      "CREATE TABLE `t2` (`a` int);\n",
+		"test.t2.00001.sql":       "INSERT INTO `t2`(`a`) VALUES\n(1);\n",
+		"test.t2.00002.sql":       "INSERT INTO `t2`(`a`) VALUES\n(2);\n",
+	} {
+		x := WriteFile(dir+"/"+name, data)
+		AssertNil(x)
+	}
+	files, err := loadFiles(NewDirStorage(dir))
+	assert.Nil(t, err)
+
+	// All present.
+	{
+		err := checkExpectTables(files, []string{"test", "test.t1", "test.t2"})
+		assert.Nil(t, err)
+	}
+
+	// Missing.
+	{
+		err := checkExpectTables(files, []string{"test.t1", "test.empty", "test.noschema", "test.gone", "other"})
+		assert.NotNil(t, err)
+		want := "restoring.expect.tables.failed, the dump is incomplete:\n" +
+			"  table test.empty has a schema but its data is missing, no test.empty[.part].sql file\n" +
+			"  table test.noschema has data but its schema is missing, no test.noschema-schema.sql file\n" +
+			"  table test.gone is absent, no schema and no data file\n" +
+			"  database other is absent, no other-schema-create.sql file"
+		assert.Equal(t, want, err.Error())
+	}
+}
+
+func TestLoaderTableDatabases(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	// fakedbs.
+	{
+		fakedbs.AddQuery("show databases", &sqltypes.Result{
+			Fields: []*querypb.Field{
+				{
+					Name: "Database",
+					Type: querypb.Type_VARCHAR,
+				},
+			},
+			Rows: [][]sqltypes.Value{
+				{
+					sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("other")),
+				},
+			},
+		})
+	}
+
+	pool, err := NewPool(log, 1, server.Addr(), "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	// Every database has its schema-create file, the target isn't asked.
+	{
+		files := &Files{
+			databases: []string{"/tmp/test-schema-create.sql"},
+			schemas:   []string{"/tmp/test.t1-schema.sql"},
+			tables:    []string{"/tmp/test.t1.00001.sql"},
+		}
+		assert.Nil(t, checkTableDatabases(nil, files))
+	}
+
+	// A database on the target is fine, one nowhere fails.
+	{
+		files := &Files{
+			databases: []string{"/tmp/test-schema-create.sql"},
+			schemas:   []string{"/tmp/gone.t1-schema.sql", "/tmp/other.t2-schema.sql", "/tmp/test.t1-schema.sql"},
+			tables:    []string{"/tmp/gone.t1.00001.sql", "/tmp/gone.t1.00002.sql", "/tmp/lost.t3.00001.sql", "/tmp/other.t2.00001.sql"},
+		}
+		err := checkTableDatabases(conn, files)
+		assert.NotNil(t, err)
+		want := "restoring.check.databases.failed, the dump is incomplete or filtered wrong:\n" +
+			"  table file gone.t1-schema.sql references database gone which has no gone-schema-create.sql file and doesn't exist on the target (3 files)\n" +
+			"  table file lost.t3.00001.sql references database lost which has no lost-schema-create.sql file and doesn't exist on the target (1 files)"
+		assert.Equal(t, want, err.Error())
+	}
+}
+
+func TestLoaderRecentChunks(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	files := &Files{
+		schemas: []string{"/tmp/test.t1-schema.sql", "/tmp/test.t2-schema.sql", "/tmp/test.t3-schema.sql"},
+		tables: []string{
+			"/tmp/test.t1.00009.sql",
+			"/tmp/test.t1.00010.sql",
+			"/tmp/test.t1.00002.sql",
+			"/tmp/test.t1.00001.sql",
+			"/tmp/test.t2.00001.sql",
+			"/tmp/test.t3.sql",
+		},
+	}
+	filterRecentChunks(log, files, 2)
+	want := []string{
+		"/tmp/test.t1.00009.sql",
+		"/tmp/test.t1.00010.sql",
+		"/tmp/test.t2.00001.sql",
+		"/tmp/test.t3.sql",
+	}
+	assert.Equal(t, want, files.tables)
+	assert.Equal(t, 3, len(files.schemas))
+
+	// The labels of -chunk-by, the latest dates.
+	files.tables = []string{
+		"/tmp/test.t1.2024-01-15.sql",
+		"/tmp/test.t1.2023-12-31.sql",
+		"/tmp/test.t1.null.sql",
+		"/tmp/test.t1.2024-01-02.sql",
+	}
+	filterRecentChunks(log, files, 2)
+	assert.Equal(t, []string{"/tmp/test.t1.2024-01-02.sql", "/tmp/test.t1.2024-01-15.sql"}, files.tables)
+}
+
+func TestLoaderPreserveAutoIncrement(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("alter table .*", &sqltypes.Result{})
+	}
+
+	// The max id in the datas is 5, the counter of the source is 100.
+	dir := "/tmp/preserveautoincrementtest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`id` int NOT NULL AUTO_INCREMENT, PRIMARY KEY (`id`)) ENGINE=InnoDB AUTO_INCREMENT=6;\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`id`) VALUES\n(1),\n(5);\n")
+	AssertNil(x)
+	m := newManifest()
+	m.addTable("test", "t1", "CREATE TABLE `t1` (`id` int NOT NULL AUTO_INCREMENT, PRIMARY KEY (`id`)) ENGINE=InnoDB AUTO_INCREMENT=6")
+	m.addTable("test", "t2", "CREATE TABLE `t2` (`id` int NOT NULL AUTO_INCREMENT, PRIMARY KEY (`id`)) ENGINE=InnoDB AUTO_INCREMENT=6")
+	m.setAutoIncrement("test", "t1", 100)
+	m.setAutoIncrement("test", "t2", 200)
+	x = m.write(NewDirStorage(dir))
+	AssertNil(x)
+
+	args := &LoadArgs{
+		Outdir:                dir,
+		User:                  "mock",
+		Password:              "mock",
+		Threads:               2,
+		Address:               address,
+		IntervalMs:            500,
+		PreserveAutoIncrement: true,
+	}
+	_, err = NewLoader(LoadConfig{LoadArgs: *args, Log: log}).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("alter table `test`.`t1` auto_increment=100"))
+	// t2 is not in the dump files.
+	assert.Equal(t, 0, fakedbs.GetQueryCalledNum("alter table `test`.`t2` auto_increment=200"))
+}
+
+func TestLoaderExecutor(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/loaderexecutor"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\nINSERT INTO `t1` VALUES (2);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+
+	// The statements in order, without a server.
+	{
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), report.FilesDone)
+		want := []string{
+			"CREATE DATABASE IF NOT EXISTS `test`;",
+			"use `test`",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB",
+			"INSERT INTO `t1` VALUES (1)",
+			"INSERT INTO `t1` VALUES (2)",
+		}
+		assert.Equal(t, want, rec.queries)
+	}
+
+	// A failed statement fails the restore.
+	{
+		rec := &recordingExecutor{errs: map[string]error{"INSERT INTO `t1` VALUES (2)": errors.New("mock.duplicate.key")}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "mock.duplicate.key"))
+	}
+}
+
+func TestLoaderSchemaOnly(t *testing.T) {
+	dir := "/tmp/loaderschemaonly"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (`a` int) ENGINE=InnoDB;\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+
+	buf := &bytes.Buffer{}
+	log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+	rec := &recordingExecutor{}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500}
+	report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, RunOK, report.Status)
+	assert.Equal(t, uint64(0), report.FilesTotal)
+	assert.Contains(t, rec.queries, "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB")
+	assert.Contains(t, rec.queries, "CREATE TABLE `t2` (`a` int) ENGINE=InnoDB")
+
+	// The data phase is skipped.
+	_, ok := report.PhaseSeconds["data"]
+	assert.False(t, ok)
+	assert.True(t, strings.Contains(buf.String(), "restoring.schema.only.dump.databases[1].tables[2].no.data"), buf.String())
+	assert.False(t, strings.Contains(buf.String(), "restoring.shuffle.seed"), buf.String())
+
+	LogReport(log, report)
+	assert.True(t, strings.Contains(buf.String(), "restoring.all.done.schema.only.cost["), buf.String())
+	assert.False(t, strings.Contains(buf.String(), "allbytes[0.00MB]"), buf.String())
+}
+
+func TestLoaderSkipBinlog(t *testing.T) {
+	dir := "/tmp/loaderskipbinlog"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1),(2);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500}
+
+	// Every connection turns the binlog off before any statement.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.SkipBinlog = true
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, "SET sql_log_bin=0", rec.queries[0])
+		n := 0
+		for _, query := range rec.queries {
+			if query == "SET sql_log_bin=0" {
+				n++
+			}
+		}
+		assert.Equal(t, args.poolThreads(), n)
+	}
+
+	// A target refusing it fails the restore before any statement.
+	{
+		rec := &recordingExecutor{errs: map[string]error{"SET sql_log_bin=0": errors.New("Access denied; you need (at least one of) the SUPER or SYSTEM_VARIABLES_ADMIN privilege(s) for this operation (errno 1227)")}}
+		args := args
+		args.SkipBinlog = true
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "restoring.skip.binlog.error:Access denied"), err.Error())
+		assert.NotContains(t, rec.queries, "INSERT INTO `t1` VALUES (1),(2)")
+	}
+
+	// Off by default.
+	{
+		rec := &recordingExecutor{}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.NotContains(t, rec.queries, "SET sql_log_bin=0")
 	}
 }
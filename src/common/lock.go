@@ -0,0 +1,212 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// lockPrefix prefixes the names of the advisory locks of the databases
+// restored, see LoadArgs.Lock.
+const lockPrefix = "go-mydumper:"
+
+// globalLockName is the lock a restore of the whole dump takes besides the
+// ones of its databases, see lockTarget. It has no ':', no database lock is
+// named the same.
+const globalLockName = "go-mydumper"
+
+// maxLockNameBytes is the longest name GET_LOCK takes.
+const maxLockNameBytes = 64
+
+// lockInfoTable is where the holders of the locks record themselves, for a
+// restore refused by a lock to tell who holds it.
+const (
+	lockInfoDatabase = "go_mydumper"
+	lockInfoTable    = "`go_mydumper`.`locks`"
+)
+
+// lockName returns the name of the lock of the database db, one too long is
+// named by the CRC32 of db.
+func lockName(db string) string {
+	if name := lockPrefix + db; len(name) <= maxLockNameBytes {
+		return name
+	}
+	return fmt.Sprintf("%s%08x", lockPrefix, crc32.ChecksumIEEE([]byte(db)))
+}
+
+// lockedDatabases returns the databases the files restore into, sorted: the
+// filters of the restore are applied to files, so a restore of a database
+// locks only it.
+func lockedDatabases(files *Files) []string {
+	seen := make(map[string]bool)
+	for _, db := range files.databases {
+		seen[strings.TrimSuffix(filepath.Base(db), dbSuffix)] = true
+	}
+	for _, schema := range files.schemas {
+		seen[strings.Split(filepath.Base(schema), ".")[0]] = true
+	}
+	for _, table := range files.tables {
+		db, _, _ := parseTableFile(table)
+		seen[db] = true
+	}
+	dbs := make([]string, 0, len(seen))
+	for db := range seen {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+// lockTarget takes the lock of every database of files with
+// GET_LOCK('go-mydumper:db', 0), see LoadArgs.Lock, and returns the func which
+// releases them: it must be deferred once the restore starts so any exit
+// releases them. A restore of the whole dump, whole, takes globalLockName
+// first, two of them refuse each other even into different databases. The
+// locks are held by a connection of their own, a killed restore releases them
+// as the target closes it. A lock held by another restore fails it with who
+// holds it, unless LoadArgs.ForceLock. A MySQL older than 5.7 holds a single
+// lock per connection, a GET_LOCK releases the one before, so a restore which
+// takes more than one fails there before any.
+func lockTarget(log *xlog.Log, args *LoadArgs, files *Files, whole bool) (func(), error) {
+	none := func() {}
+	if !args.Lock {
+		return none, nil
+	}
+	pool, err := newLoadPool(log, args, 1)
+	if err != nil {
+		return none, err
+	}
+	conn := pool.Get()
+	var held []string
+	release := func() {
+		for _, name := range held {
+			escaped := EscapeBytes([]byte(name))
+			if err := conn.Execute(fmt.Sprintf("DELETE FROM %s WHERE name='%s' AND connection_id=CONNECTION_ID()", lockInfoTable, escaped)); err != nil {
+				log.Warning("restoring.lock[%s].info.not.deleted:%v", name, err)
+			}
+			if _, err := conn.Fetch(fmt.Sprintf("SELECT RELEASE_LOCK('%s')", escaped)); err != nil {
+				log.Warning("restoring.lock[%s].release.error, it's released once the connection closes:%v", name, err)
+			}
+		}
+		pool.Put(conn)
+		pool.Close()
+	}
+
+	var names, owners []string
+	if whole {
+		names = append(names, globalLockName)
+		owners = append(owners, "server")
+	}
+	for _, db := range lockedDatabases(files) {
+		names = append(names, lockName(db))
+		owners = append(owners, fmt.Sprintf("database[%s]", db))
+	}
+	if len(names) > 1 {
+		if err := checkMultipleLocks(log, conn); err != nil {
+			release()
+			return none, err
+		}
+	}
+
+	var problems []string
+	record := true
+	for i, name := range names {
+		escaped := EscapeBytes([]byte(name))
+		qr, err := conn.Fetch(fmt.Sprintf("SELECT GET_LOCK('%s', 0)", escaped))
+		if err != nil {
+			release()
+			return none, wrapf(err, "restoring.lock[%s].error:%v", name, err)
+		}
+		if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 || qr.Rows[0][0].String() != "1" {
+			holder := lockHolder(conn, name)
+			if args.ForceLock {
+				log.Warning("restoring.lock[%s].of.%s.held.by.%s.FORCED:the.restores.may.interleave.their.DDL", name, owners[i], holder)
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("lock[%s].of.%s.held.by.%s", name, owners[i], holder))
+			continue
+		}
+		held = append(held, name)
+		if record {
+			if err := recordLock(conn, args, name); err != nil {
+				log.Warning("restoring.lock.info.not.recorded, a refused restore can't tell who holds the lock:%v", err)
+				record = false
+			}
+		}
+	}
+	if len(problems) > 0 {
+		release()
+		return none, fmt.Errorf("restoring.locked:%s:another restore runs into the databases, wait for it or force the lock", strings.Join(problems, ","))
+	}
+	log.Info("restoring.lock.databases[%d].held[%s]", len(held), strings.Join(held, ","))
+	return release, nil
+}
+
+// checkMultipleLocks fails on a MySQL older than 5.7, where a GET_LOCK
+// releases the lock the connection held. A version which can't be fetched
+// or parsed is taken as a newer one, with a warning.
+func checkMultipleLocks(log *xlog.Log, conn *Connection) error {
+	version, err := fetchServerVersion(conn)
+	if err != nil {
+		log.Warning("restoring.lock.target.version.error.taken.as.5.7.or.later:%v", err)
+		return nil
+	}
+	v, ok := parseServerVersion(version)
+	if !ok {
+		log.Warning("restoring.lock.target.version[%s].not.parsed.taken.as.5.7.or.later", version)
+		return nil
+	}
+	if v.mariadb || v.compare(serverVersion{major: 5, minor: 7}, false) >= 0 {
+		return nil
+	}
+	return fmt.Errorf("restoring.lock.target.version[%s].holds.one.lock.per.connection:MySQL before 5.7 can't hold the locks of several databases, filter the restore to one database or restore without -lock", version)
+}
+
+// recordLock records the restore as the holder of the lock name in
+// lockInfoTable, with the connection which holds it.
+func recordLock(conn *Connection, args *LoadArgs, name string) error {
+	host, _ := os.Hostname()
+	queries := []string{
+		fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", lockInfoDatabase),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (name VARCHAR(64) NOT NULL PRIMARY KEY, connection_id BIGINT UNSIGNED NOT NULL, host VARCHAR(255) NOT NULL, pid INT NOT NULL, dir VARCHAR(1024) NOT NULL, started DATETIME NOT NULL)", lockInfoTable),
+		fmt.Sprintf("REPLACE INTO %s VALUES ('%s', CONNECTION_ID(), '%s', %d, '%s', NOW())", lockInfoTable, EscapeBytes([]byte(name)), EscapeBytes([]byte(host)), os.Getpid(), EscapeBytes([]byte(args.Outdir))),
+	}
+	for _, query := range queries {
+		if err := conn.Execute(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockHolder returns who holds the lock name: the connection of IS_USED_LOCK
+// and what it recorded in lockInfoTable, if it did.
+func lockHolder(conn *Connection, name string) string {
+	escaped := EscapeBytes([]byte(name))
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT IS_USED_LOCK('%s')", escaped))
+	if err != nil || len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 || qr.Rows[0][0].String() == "" {
+		return "unknown"
+	}
+	id := qr.Rows[0][0].String()
+	holder := fmt.Sprintf("connection[%s]", id)
+	qr, err = conn.Fetch(fmt.Sprintf("SELECT host, pid, dir, started FROM %s WHERE name='%s' AND connection_id=%s", lockInfoTable, escaped, id))
+	if err != nil || len(qr.Rows) == 0 || len(qr.Rows[0]) < 4 {
+		return holder
+	}
+	row := qr.Rows[0]
+	return fmt.Sprintf("%s.host[%s].pid[%s].dir[%s].since[%s]", holder, row[0].String(), row[1].String(), row[2].String(), row[3].String())
+}
@@ -0,0 +1,130 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockName(t *testing.T) {
+	assert.Equal(t, "go-mydumper:shop", lockName("shop"))
+	long := strings.Repeat("d", 60)
+	assert.Equal(t, "go-mydumper:"+fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(long))), lockName(long))
+	assert.True(t, len(lockName(long)) <= maxLockNameBytes)
+}
+
+func TestLoaderLock(t *testing.T) {
+	dir := "/tmp/loaderlock"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"shop-schema-create.sql":  "CREATE DATABASE IF NOT EXISTS `shop`;",
+		"shop.t1-schema.sql":      "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"shop.t1.00001.sql":       "INSERT INTO `t1` VALUES (1);\n",
+		"audit-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `audit`;",
+		"audit.t2-schema.sql":     "CREATE TABLE `t2` (`a` int) ENGINE=InnoDB;\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, Lock: true}
+	held := func(qr *sqltypes.Result) map[string]*sqltypes.Result {
+		return map[string]*sqltypes.Result{
+			"SELECT GET_LOCK('go-mydumper', 0)":       intsResult([]string{"GET_LOCK"}, []string{"1"}),
+			"SELECT GET_LOCK('go-mydumper:audit', 0)": intsResult([]string{"GET_LOCK"}, []string{"1"}),
+			"SELECT GET_LOCK('go-mydumper:shop', 0)":  qr,
+			"SELECT IS_USED_LOCK('go-mydumper:shop')": intsResult([]string{"IS_USED_LOCK"}, []string{"42"}),
+			"SELECT host, pid, dir, started FROM `go_mydumper`.`locks` WHERE name='go-mydumper:shop' AND connection_id=42": stringsResult([]string{"host", "pid", "dir", "started"},
+				[]string{"ops1", "4242", "/backups/other", "2026-10-15 09:00:00"}),
+		}
+	}
+
+	// The global lock of a restore of the whole dump and the locks of the
+	// databases are taken, recorded, then released once the restore is
+	// done.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		rec := &recordingExecutor{results: held(intsResult([]string{"GET_LOCK"}, []string{"1"}))}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"SELECT GET_LOCK('go-mydumper', 0)", "SELECT GET_LOCK('go-mydumper:audit', 0)", "SELECT GET_LOCK('go-mydumper:shop', 0)"}, matchingQueries(rec.queries, "SELECT GET_LOCK"))
+		assert.Equal(t, 3, len(matchingQueries(rec.queries, "REPLACE INTO `go_mydumper`.`locks` VALUES ('go-mydumper")))
+		assert.Equal(t, []string{
+			"DELETE FROM `go_mydumper`.`locks` WHERE name='go-mydumper' AND connection_id=CONNECTION_ID()",
+			"SELECT RELEASE_LOCK('go-mydumper')",
+			"DELETE FROM `go_mydumper`.`locks` WHERE name='go-mydumper:audit' AND connection_id=CONNECTION_ID()",
+			"SELECT RELEASE_LOCK('go-mydumper:audit')",
+			"DELETE FROM `go_mydumper`.`locks` WHERE name='go-mydumper:shop' AND connection_id=CONNECTION_ID()",
+			"SELECT RELEASE_LOCK('go-mydumper:shop')",
+		}, rec.queries[len(rec.queries)-6:])
+		assert.Equal(t, 1, len(matchingQueries(rec.queries, "INSERT INTO `t1`")))
+	}
+
+	// A lock held by another restore refuses the restore before any
+	// statement, with who holds it, the locks taken are released.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		rec := &recordingExecutor{results: held(intsResult([]string{"GET_LOCK"}, []string{"0"}))}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.locked:lock[go-mydumper:shop].of.database[shop].held.by.connection[42].host[ops1].pid[4242].dir[/backups/other].since[2026-10-15 09:00:00]:another restore runs into the databases, wait for it or force the lock", err.Error())
+		assert.Nil(t, matchingQueries(rec.queries, "CREATE TABLE `t"))
+		assert.Equal(t, []string{"SELECT RELEASE_LOCK('go-mydumper')", "SELECT RELEASE_LOCK('go-mydumper:audit')"}, matchingQueries(rec.queries, "SELECT RELEASE_LOCK"))
+	}
+
+	// A MySQL before 5.7 holds one lock per connection: a restore which
+	// takes several is refused before any, one which takes one runs.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		results := held(intsResult([]string{"GET_LOCK"}, []string{"1"}))
+		results["SELECT VERSION()"] = stringsResult([]string{"VERSION()"}, []string{"5.6.51-log"})
+		rec := &recordingExecutor{results: results}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.lock.target.version[5.6.51-log].holds.one.lock.per.connection:MySQL before 5.7 can't hold the locks of several databases, filter the restore to one database or restore without -lock", err.Error())
+		assert.Nil(t, matchingQueries(rec.queries, "SELECT GET_LOCK"))
+		assert.Nil(t, matchingQueries(rec.queries, "CREATE TABLE `t"))
+
+		rec = &recordingExecutor{results: results}
+		args := args
+		args.Filter = "database = shop"
+		_, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"SELECT GET_LOCK('go-mydumper:shop', 0)"}, matchingQueries(rec.queries, "SELECT GET_LOCK"))
+	}
+
+	// Forced, with a warning, and the lock of a restore filtered to a
+	// database is only its lock.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{results: held(intsResult([]string{"GET_LOCK"}, []string{"0"}))}
+		args := args
+		args.ForceLock = true
+		args.Filter = "database = shop"
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"SELECT GET_LOCK('go-mydumper:shop', 0)"}, matchingQueries(rec.queries, "SELECT GET_LOCK"))
+		assert.True(t, strings.Contains(buf.String(), "restoring.lock[go-mydumper:shop].of.database[shop].held.by.connection[42].host[ops1].pid[4242].dir[/backups/other].since[2026-10-15 09:00:00].FORCED:the.restores.may.interleave.their.DDL"), buf.String())
+		assert.Nil(t, matchingQueries(rec.queries, "SELECT RELEASE_LOCK"))
+		assert.Equal(t, 1, len(matchingQueries(rec.queries, "INSERT INTO `t1`")))
+	}
+}
@@ -0,0 +1,169 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The lock modes of DumpArgs.LockMode, how ConsistencyLock blocks the
+// commits while the snapshots start.
+const (
+	// LockModeAuto takes the backup locks of the server if it has them, else
+	// FLUSH TABLES WITH READ LOCK.
+	LockModeAuto = "auto"
+	// LockModeFTWRL takes FLUSH TABLES WITH READ LOCK, on any server.
+	LockModeFTWRL = "ftwrl"
+	// LockModeBackup takes the backup locks of Percona Server or MariaDB, a
+	// server without them fails the dump.
+	LockModeBackup = "backup-lock"
+	// LockModeNone takes no lock: the snapshots start at about the same
+	// point, a commit in between makes them differ.
+	LockModeNone = "none"
+)
+
+// The backup locks of the servers, see backupLockSupport.
+const (
+	// backupLockPercona is LOCK TABLES FOR BACKUP and LOCK BINLOG FOR
+	// BACKUP, of Percona Server 5.6.16 to 5.7.
+	backupLockPercona = "percona"
+	// backupLockMariaDB is BACKUP STAGE BLOCK_COMMIT, of MariaDB 10.4.1.
+	backupLockMariaDB = "mariadb"
+)
+
+// perconaVersionRegexp matches the release suffix of a Percona Server
+// VERSION(), like '5.7.42-45-log' or '5.6.51-91.0', not the '-log' or the
+// '-0ubuntu0.18.04.1' of MySQL.
+var perconaVersionRegexp = regexp.MustCompile(`^\d+\.\d+\.\d+-\d+(\.\d+)?(-|$)`)
+
+// backupLockSupport returns the backup locks of the server of the VERSION()
+// and the @@version_comment, empty if it has none the dump can use. Percona
+// Server 8.0 has no LOCK BINLOG FOR BACKUP, its backup locks don't block the
+// commits.
+func backupLockSupport(version string, comment string) string {
+	v, ok := parseServerVersion(version)
+	if !ok {
+		return ""
+	}
+	switch {
+	case v.mariadb || strings.Contains(strings.ToLower(comment), "mariadb"):
+		if v.compare(serverVersion{major: 10, minor: 4, patch: 1}, true) >= 0 {
+			return backupLockMariaDB
+		}
+	case strings.Contains(strings.ToLower(comment), "percona") || perconaVersionRegexp.MatchString(version):
+		if v.compare(serverVersion{major: 5, minor: 6, patch: 16}, true) >= 0 && v.compare(serverVersion{major: 8}, false) < 0 {
+			return backupLockPercona
+		}
+	}
+	return ""
+}
+
+// snapshotLock is the lock lockedSnapshots starts the snapshots under.
+type snapshotLock struct {
+	// mode is the LockMode taken, recorded in ConsistentPoint.LockMode.
+	mode string
+	// name names the lock in the logs.
+	name string
+	// acquire and release take and release the lock on the coordinator.
+	acquire func(log *xlog.Log, conns []*Connection, timeout time.Duration) error
+	release []string
+}
+
+var (
+	ftwrlLock   = &snapshotLock{mode: LockModeFTWRL, name: "read.lock", acquire: flushWithReadLock, release: []string{"UNLOCK TABLES"}}
+	noLock      = &snapshotLock{mode: LockModeNone, name: "no.lock", acquire: func(*xlog.Log, []*Connection, time.Duration) error { return nil }}
+	perconaLock = newBackupLock([]string{"UNLOCK BINLOG", "UNLOCK TABLES"}, "LOCK TABLES FOR BACKUP", "LOCK BINLOG FOR BACKUP")
+	mariadbLock = newBackupLock([]string{"BACKUP STAGE END"}, "BACKUP STAGE START", "BACKUP STAGE BLOCK_COMMIT")
+)
+
+// newBackupLock returns the snapshotLock of a backup lock taken with the
+// statements and released with release.
+func newBackupLock(release []string, stmts ...string) *snapshotLock {
+	return &snapshotLock{mode: LockModeBackup, name: "backup.lock", acquire: backupLock(release, stmts...), release: release}
+}
+
+// backupLock returns the acquire of a snapshotLock taking a backup lock with
+// the statements, in order, watched like the global read lock: one failed or
+// killed after another took its part releases the lock with release.
+func backupLock(release []string, stmts ...string) func(log *xlog.Log, conns []*Connection, timeout time.Duration) error {
+	return func(log *xlog.Log, conns []*Connection, timeout time.Duration) error {
+		name := fmt.Sprintf("backup.lock[%s]", strings.Join(stmts, ","))
+		return watchedLock(log, conns, timeout, name, func(coordinator *Connection) (bool, error) {
+			for i, stmt := range stmts {
+				if err := coordinator.Execute(stmt); err != nil {
+					return i > 0, fmt.Errorf("dumping.consistency.backup.lock[%s].error:%v, it needs the RELOAD privilege", stmt, err)
+				}
+			}
+			return true, nil
+		}, release)
+	}
+}
+
+// chooseSnapshotLock returns the lock of the LockMode mode, probing the
+// server of conn for its backup locks with LockModeAuto and LockModeBackup.
+// A server without them falls back to FLUSH TABLES WITH READ LOCK with
+// LockModeAuto, fails the dump with LockModeBackup.
+func chooseSnapshotLock(log *xlog.Log, conn *Connection, mode string) (*snapshotLock, error) {
+	switch mode {
+	case LockModeFTWRL:
+		return ftwrlLock, nil
+	case LockModeNone:
+		log.Warning("dumping.consistency[lock].lock.mode[none]:the.snapshots.start.without.a.lock,a.commit.in.between.makes.them.differ")
+		return noLock, nil
+	}
+	version, comment, logBin, err := probeBackupLock(conn)
+	support := ""
+	reason := ""
+	switch {
+	case err != nil:
+		reason = fmt.Sprintf("probe.error:%v", err)
+	default:
+		support = backupLockSupport(version, comment)
+		if support == "" {
+			reason = fmt.Sprintf("server[%s %s].has.none", version, comment)
+		} else if support == backupLockPercona && !logBin {
+			// LOCK BINLOG FOR BACKUP blocks the commits through the binlog.
+			support = ""
+			reason = fmt.Sprintf("server[%s %s].log_bin.off", version, comment)
+		}
+	}
+	switch {
+	case support == backupLockPercona:
+		log.Info("dumping.consistency[lock].lock.mode[%s].percona.backup.locks", mode)
+		return perconaLock, nil
+	case support == backupLockMariaDB:
+		log.Info("dumping.consistency[lock].lock.mode[%s].mariadb.backup.stage", mode)
+		return mariadbLock, nil
+	case mode == LockModeBackup:
+		return nil, fmt.Errorf("dumping.consistency.lock.mode[%s].not.supported.%s:it needs Percona Server 5.6.16 to 5.7 with the binlog on or MariaDB 10.4.1 or later, use -lock-mode %s or %s", mode, reason, LockModeAuto, LockModeFTWRL)
+	}
+	log.Info("dumping.consistency[lock].lock.mode[%s].no.backup.locks.%s.using[%s]", mode, reason, LockModeFTWRL)
+	return ftwrlLock, nil
+}
+
+// probeBackupLock returns the VERSION(), the @@version_comment and the
+// @@log_bin of the server of conn.
+func probeBackupLock(conn *Connection) (string, string, bool, error) {
+	qr, err := conn.Fetch("SELECT @@version, @@version_comment, @@log_bin")
+	if err != nil {
+		return "", "", false, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 3 {
+		return "", "", false, fmt.Errorf("server.version.has.no.row")
+	}
+	row := qr.Rows[0]
+	logBin := row[2].String()
+	return row[0].String(), row[1].String(), logBin == "1" || strings.EqualFold(logBin, "ON"), nil
+}
@@ -0,0 +1,179 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupLockSupport(t *testing.T) {
+	// The VERSION() and @@version_comment of the servers.
+	for _, tc := range []struct {
+		version string
+		comment string
+		want    string
+	}{
+		{"8.0.32", "MySQL Community Server - GPL", ""},
+		{"5.7.42-log", "MySQL Community Server (GPL)", ""},
+		{"5.7.42-0ubuntu0.18.04.1", "(Ubuntu)", ""},
+		{"5.6.51-91.0", "Percona Server (GPL), Release 91.0, Revision b59139e", backupLockPercona},
+		{"5.6.15-63.0", "Percona Server (GPL), Release 63.0, Revision 519", ""},
+		{"5.7.42-45-log", "Percona Server (GPL), Release 45, Revision 6e5b1ec8b6b", backupLockPercona},
+		{"5.7.43-47-57-log", "Percona XtraDB Cluster (GPL), Release rel47, Revision 2a0b3ba, WSREP version 31.65, wsrep_31.65", backupLockPercona},
+		{"5.7.42-45", "", backupLockPercona},
+		{"8.0.34-26", "Percona Server (GPL), Release 26, Revision 0fe62c85", ""},
+		{"10.6.12-MariaDB-1:10.6.12+maria~ubu2004", "mariadb.org binary distribution", backupLockMariaDB},
+		{"10.4.1-MariaDB", "MariaDB Server", backupLockMariaDB},
+		{"10.3.39-MariaDB-log", "MariaDB Server", ""},
+		{"unknown", "", ""},
+	} {
+		assert.Equal(t, tc.want, backupLockSupport(tc.version, tc.comment), tc.version)
+	}
+}
+
+func TestConsistencyLockModes(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	const gtid = "3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5"
+	snapshots := func(mode string, s *snapshotServer) (*ConsistentPoint, error) {
+		s.gtid = func(int) string { return gtid }
+		pool, err := NewExecutorPool(log, 2, s.executor)
+		AssertNil(err)
+		defer pool.Close()
+		return startSnapshots(log, pool, &DumpArgs{Consistency: ConsistencyLock, LockMode: mode})
+	}
+	percona := func() *snapshotServer {
+		return &snapshotServer{version: "5.7.42-45-log", comment: "Percona Server (GPL), Release 45, Revision 6e5b1ec8b6b", logBin: "1"}
+	}
+
+	// Percona Server: the snapshots start under the backup locks.
+	{
+		s := percona()
+		point, err := snapshots(LockModeAuto, s)
+		assert.Nil(t, err)
+		assert.Equal(t, LockModeBackup, point.LockMode)
+		want := []string{
+			"0:SET SESSION lock_wait_timeout=60",
+			"0:LOCK TABLES FOR BACKUP",
+			"0:LOCK BINLOG FOR BACKUP",
+			"0:START TRANSACTION WITH CONSISTENT SNAPSHOT",
+			"1:START TRANSACTION WITH CONSISTENT SNAPSHOT",
+			"0:SHOW MASTER STATUS",
+			"0:UNLOCK BINLOG",
+			"0:UNLOCK TABLES",
+		}
+		assert.Equal(t, want, s.statements[2:])
+		assert.Equal(t, 0, s.count("FLUSH TABLES WITH READ LOCK"))
+	}
+
+	// MariaDB: BACKUP STAGE.
+	{
+		s := &snapshotServer{version: "10.6.12-MariaDB-log", comment: "MariaDB Server", logBin: "0"}
+		point, err := snapshots(LockModeBackup, s)
+		assert.Nil(t, err)
+		assert.Equal(t, LockModeBackup, point.LockMode)
+		assert.Equal(t, 1, s.count("BACKUP STAGE BLOCK_COMMIT"))
+		assert.True(t, s.statementIndex("0:BACKUP STAGE BLOCK_COMMIT") < s.statementIndex("1:START TRANSACTION WITH CONSISTENT SNAPSHOT"))
+		assert.True(t, s.statementIndex("0:BACKUP STAGE END") > s.statementIndex("0:SHOW MASTER STATUS"))
+	}
+
+	// A backup lock waits for the long queries like the global read lock,
+	// it's bounded and killed the same way, the part taken is released.
+	{
+		s := percona()
+		s.blocked = make(chan struct{})
+		s.blockOn = "LOCK BINLOG FOR BACKUP"
+		pool, err := NewExecutorPool(log, 2, s.executor)
+		AssertNil(err)
+		_, err = startSnapshots(log, pool, &DumpArgs{Consistency: ConsistencyLock, LockMode: LockModeBackup, LockWaitTimeout: 1})
+		pool.Close()
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "dumping.consistency.backup.lock[LOCK TABLES FOR BACKUP,LOCK BINLOG FOR BACKUP].timeout[1s], the queries blocking it:\n  id[42]"), err.Error())
+		assert.Equal(t, 1, s.count("KILL QUERY 100"))
+		assert.Equal(t, 1, s.count("UNLOCK TABLES"))
+		assert.Equal(t, 0, s.count(startSnapshot))
+
+		s = &snapshotServer{version: "10.6.12-MariaDB-log", comment: "MariaDB Server", blocked: make(chan struct{}), blockOn: "BACKUP STAGE START"}
+		pool, err = NewExecutorPool(log, 2, s.executor)
+		AssertNil(err)
+		_, err = startSnapshots(log, pool, &DumpArgs{Consistency: ConsistencyLock, LockMode: LockModeBackup, LockWaitTimeout: 1})
+		pool.Close()
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "dumping.consistency.backup.lock[BACKUP STAGE START,BACKUP STAGE BLOCK_COMMIT].timeout[1s]"), err.Error())
+		assert.Equal(t, 1, s.count("KILL QUERY 100"))
+		assert.Equal(t, 0, s.count("BACKUP STAGE END"))
+	}
+
+	// With tables out of the snapshots the lock is held for them, but with
+	// none.
+	for _, mode := range []string{LockModeBackup, LockModeFTWRL, LockModeNone} {
+		s := percona()
+		s.gtid = func(int) string { return gtid }
+		pool, err := NewExecutorPool(log, 2, s.executor)
+		AssertNil(err)
+		args := &DumpArgs{Consistency: ConsistencyLock, LockMode: mode, nonTransactional: true}
+		_, err = startSnapshots(log, pool, args)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, s.count("UNLOCK TABLES"), mode)
+		if mode == LockModeNone {
+			assert.Nil(t, args.heldLock, mode)
+		} else {
+			assert.True(t, args.heldLock.held(), mode)
+			assert.Equal(t, TableReadLock, tableConsistency(args, "MyISAM"))
+			assert.Nil(t, args.heldLock.release())
+			assert.Equal(t, 1, s.count("UNLOCK TABLES"), mode)
+		}
+		pool.Close()
+	}
+
+	// Percona Server without the binlog, MySQL, a failed probe: auto falls
+	// back to FLUSH TABLES WITH READ LOCK.
+	for _, s := range []*snapshotServer{
+		{version: "5.7.42-45-log", comment: "Percona Server (GPL), Release 45, Revision 6e5b1ec8b6b", logBin: "0"},
+		{version: "8.0.32", comment: "MySQL Community Server - GPL", logBin: "1"},
+		{},
+	} {
+		point, err := snapshots(LockModeAuto, s)
+		assert.Nil(t, err)
+		assert.Equal(t, LockModeFTWRL, point.LockMode)
+		assert.Equal(t, 1, s.count("FLUSH TABLES WITH READ LOCK"))
+		assert.Equal(t, 0, s.count("LOCK TABLES FOR BACKUP"))
+	}
+
+	// backup-lock fails on a server without them, before any lock.
+	{
+		s := &snapshotServer{version: "8.0.32", comment: "MySQL Community Server - GPL", logBin: "1"}
+		_, err := snapshots(LockModeBackup, s)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "dumping.consistency.lock.mode[backup-lock].not.supported.server[8.0.32 MySQL Community Server - GPL].has.none")
+		assert.Equal(t, 0, s.count(startSnapshot))
+	}
+
+	// ftwrl doesn't probe, none takes no lock.
+	{
+		s := percona()
+		point, err := snapshots(LockModeFTWRL, s)
+		assert.Nil(t, err)
+		assert.Equal(t, LockModeFTWRL, point.LockMode)
+		assert.Equal(t, 1, s.count("FLUSH TABLES WITH READ LOCK"))
+
+		s = percona()
+		point, err = snapshots(LockModeNone, s)
+		assert.Nil(t, err)
+		assert.Equal(t, LockModeNone, point.LockMode)
+		assert.Equal(t, 0, s.count("FLUSH TABLES WITH READ LOCK"))
+		assert.Equal(t, 0, s.count("LOCK TABLES FOR BACKUP"))
+		assert.Equal(t, 2, s.count(startSnapshot))
+		assert.Equal(t, 0, s.count("UNLOCK TABLES"))
+	}
+}
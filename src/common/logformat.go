@@ -0,0 +1,247 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// Log levels by name, the rank is used by the JSON log to filter the events.
+var logLevels = map[string]struct {
+	level xlog.LogLevel
+	rank  int
+}{
+	"debug":   {xlog.DEBUG, 0},
+	"info":    {xlog.INFO, 1},
+	"":        {xlog.INFO, 1},
+	"warn":    {xlog.WARNING, 2},
+	"warning": {xlog.WARNING, 2},
+	"error":   {xlog.ERROR, 3},
+}
+
+// NewLog returns a log writing to w at the named level (debug|info|warn|error)
+// in the named format: "text" (the default) is the xlog line format, "json"
+// writes one JSON object per line, see logEvent for the fields.
+func NewLog(w io.Writer, level string, format string) (*xlog.Log, error) {
+	l, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q, must be debug|info|warn|error", level)
+	}
+	switch format {
+	case "text", "":
+		return xlog.NewXLog(w, xlog.Level(l.level)), nil
+	case "json":
+		log := xlog.NewXLog(&jsonLog{w: w, rank: l.rank, runID: newRunID()}, xlog.Level(l.level))
+		log.SetFlags(0)
+		return log, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, must be text|json", format)
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// LogRunID returns the run_id of a JSON log, empty for a text log.
+func LogRunID(log *xlog.Log) string {
+	if j, ok := log.Writer().(*jsonLog); ok {
+		return j.runID
+	}
+	return ""
+}
+
+// logEvent is one line of the JSON log. The field names are stable, tools
+// may rely on them:
+//
+//	ts      RFC 3339 time in UTC with nanoseconds
+//	level   debug|info|warning|error|summary
+//	msg     the event name, like "dumping.table.done", or the text of a plain log line
+//	db      database of the event
+//	table   table of the event
+//	file    dump file of the event
+//	bytes   bytes of the file, of the table or of the whole run, see the event
+//	rows    rows of the table or of the whole run, dumper events only
+//	elapsed seconds since the start of the run, progress events only
+//	thread  connection id of the event
+//	run_id  random id of the process run, the same on every line
+type logEvent struct {
+	TS      string   `json:"ts"`
+	Level   string   `json:"level"`
+	Msg     string   `json:"msg"`
+	DB      string   `json:"db,omitempty"`
+	Table   string   `json:"table,omitempty"`
+	File    string   `json:"file,omitempty"`
+	Bytes   *uint64  `json:"bytes,omitempty"`
+	Rows    *uint64  `json:"rows,omitempty"`
+	Elapsed *float64 `json:"elapsed,omitempty"`
+	Thread  *int     `json:"thread,omitempty"`
+	// TablesDone, TablesTotal, Active and ETA are the ones of a dump
+	// progress tick, see progressStats.
+	TablesDone  *uint64  `json:"tables_done,omitempty"`
+	TablesTotal *uint64  `json:"tables_total,omitempty"`
+	Active      *int64   `json:"active_threads,omitempty"`
+	ETA         *float64 `json:"eta_seconds,omitempty"`
+	// Files are the largest files of a load progress tick being restored,
+	// with their percent.
+	Files []string `json:"files,omitempty"`
+	RunID string   `json:"run_id"`
+}
+
+// jsonLog is the writer of a JSON xlog: the plain log lines are wrapped into
+// a logEvent with the msg only, the typed events are written by emit.
+type jsonLog struct {
+	mu    sync.Mutex
+	w     io.Writer
+	rank  int
+	runID string
+}
+
+// xlogLineRegexp matches an xlog line without the time and file prefix: '[INFO] msg'.
+var xlogLineRegexp = regexp.MustCompile(`(?s)^\s*\[([A-Z]+)\]\s*(.*?)\s*$`)
+
+func (j *jsonLog) Write(p []byte) (int, error) {
+	ev := &logEvent{Level: "info", Msg: strings.TrimSpace(string(p))}
+	if match := xlogLineRegexp.FindStringSubmatch(string(p)); match != nil {
+		ev.Level = strings.ToLower(match[1])
+		ev.Msg = match[2]
+	}
+	if err := j.write(ev); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (j *jsonLog) emit(level string, ev *logEvent) {
+	if logLevels[level].rank < j.rank {
+		return
+	}
+	ev.Level = level
+	j.write(ev)
+}
+
+func (j *jsonLog) write(ev *logEvent) error {
+	ev.TS = time.Now().UTC().Format(time.RFC3339Nano)
+	ev.RunID = j.runID
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(append(data, '\n'))
+	return err
+}
+
+// events is the typed logging of the dumper and the loader progress.
+// Every progress line goes through one of its methods, so the text lines and
+// the JSON fields can't drift apart between the call sites.
+type events struct {
+	log *xlog.Log
+	// action is "dumping" or "restoring", the prefix of the lines.
+	action string
+}
+
+func dumpEvents(log *xlog.Log) events {
+	return events{log: log, action: "dumping"}
+}
+
+func loadEvents(log *xlog.Log) events {
+	return events{log: log, action: "restoring"}
+}
+
+// json returns the JSON writer of the log, nil if the log is a text one.
+func (e events) json() *jsonLog {
+	j, _ := e.log.Writer().(*jsonLog)
+	return j
+}
+
+// TableStarted is logged when a thread starts on the datas of a table.
+func (e events) TableStarted(db string, table string, thread int) {
+	if j := e.json(); j != nil {
+		j.emit("info", &logEvent{Msg: e.action + ".table.started", DB: db, Table: table, Thread: &thread})
+		return
+	}
+	e.log.Info("%s.table[%s.%s].datas.thread[%d]...", e.action, db, table, thread)
+}
+
+// TableDone is logged when all the datas of a table are done.
+func (e events) TableDone(db string, table string, rows uint64, bytes uint64, thread int) {
+	if j := e.json(); j != nil {
+		j.emit("info", &logEvent{Msg: e.action + ".table.done", DB: db, Table: table, Rows: &rows, Bytes: &bytes, Thread: &thread})
+		return
+	}
+	e.log.Info("%s.table[%s.%s].done.allrows[%v].allbytes[%vMB].thread[%d]...", e.action, db, table, rows, (bytes / 1024 / 1024), thread)
+}
+
+// FileStarted is logged when a thread starts on a data file.
+func (e events) FileStarted(db string, table string, file string, thread int) {
+	if j := e.json(); j != nil {
+		j.emit("debug", &logEvent{Msg: e.action + ".file.started", DB: db, Table: table, File: file, Thread: &thread})
+		return
+	}
+	e.log.Debug("%s.table[%s.%s].file[%s].thread[%d]", e.action, db, table, file, thread)
+}
+
+// FileDone is logged when a data file is written or restored, bytes are the bytes of the file.
+func (e events) FileDone(db string, table string, file string, bytes uint64, thread int) {
+	if j := e.json(); j != nil {
+		j.emit("debug", &logEvent{Msg: e.action + ".file.done", DB: db, Table: table, File: file, Bytes: &bytes, Thread: &thread})
+		return
+	}
+	e.log.Debug("%s.table[%s.%s].file[%s].bytes[%v].thread[%d].done...", e.action, db, table, file, bytes, thread)
+}
+
+// ProgressTick is the periodic progress of the whole run, the loader doesn't
+// count rows. A dump adds its tables, its active threads and its ETA.
+func (e events) ProgressTick(s progressStats) {
+	mb := float64(s.bytes / 1024 / 1024)
+	eta, known := s.eta()
+	if j := e.json(); j != nil {
+		ev := &logEvent{Msg: e.action + ".progress", Bytes: &s.bytes, Elapsed: &s.elapsed, Files: s.files}
+		if e.action == "dumping" {
+			ev.Rows = &s.rows
+			ev.TablesDone, ev.TablesTotal, ev.Active = &s.tablesDone, &s.tables, &s.active
+			if known {
+				ev.ETA = &eta
+			}
+		}
+		j.emit("info", ev)
+		return
+	}
+	if e.action == "dumping" {
+		left := "unknown"
+		if known {
+			left = fmt.Sprintf("%.0fsec", eta)
+		}
+		_, rows := s.rates()
+		e.log.Info("%s.allbytes[%vMB].allrows[%v].time[%.2fsec].rates[%.2fMB/sec].rows[%.0f/sec].tables[%d/%d].threads[%d/%d].eta[%s]...",
+			e.action, mb, s.rows, s.elapsed, mb/s.elapsed, rows, s.tablesDone, s.tables, s.active, s.threads, left)
+		return
+	}
+	if len(s.files) > 0 {
+		e.log.Info("%s.allbytes[%vMB].time[%.2fsec].rates[%.2fMB/sec].files[%s]...", e.action, mb, s.elapsed, mb/s.elapsed, strings.Join(s.files, ","))
+		return
+	}
+	e.log.Info("%s.allbytes[%vMB].time[%.2fsec].rates[%.2fMB/sec]...", e.action, mb, s.elapsed, mb/s.elapsed)
+}
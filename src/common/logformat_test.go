@@ -0,0 +1,120 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// decodeLogLines decodes every line of a JSON log.
+func decodeLogLines(t *testing.T, out string) []map[string]interface{} {
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		ev := make(map[string]interface{})
+		err := json.Unmarshal([]byte(line), &ev)
+		assert.Nil(t, err, line)
+		events = append(events, ev)
+	}
+	return events
+}
+
+func logKeys(ev map[string]interface{}) []string {
+	var keys []string
+	for k := range ev {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestLogFormatJSON(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "debug", "json")
+	assert.Nil(t, err)
+
+	log.Info("plain.line[%d]", 1)
+	dumpEvents(log).TableStarted("test", "t1", 1)
+	dumpEvents(log).FileDone("test", "t1", "/tmp/test.t1.00001.sql", 100, 1)
+	dumpEvents(log).TableDone("test", "t1", 10, 100, 1)
+	dumpEvents(log).ProgressTick(progressStats{bytes: 100, rows: 10, elapsed: 0.5, tablesDone: 1, tables: 2, active: 1, threads: 2})
+	loadEvents(log).FileStarted("test", "t1", "/tmp/test.t1.00001.sql", 2)
+	loadEvents(log).ProgressTick(progressStats{bytes: 100, elapsed: 0.5})
+	log.Warning("warn.line")
+	logSummary(log, "dumping.all.done")
+
+	events := decodeLogLines(t, out.String())
+	assert.Equal(t, 9, len(events))
+	want := []struct {
+		level string
+		msg   string
+		keys  []string
+	}{
+		{"info", "plain.line[1]", []string{"level", "msg", "run_id", "ts"}},
+		{"info", "dumping.table.started", []string{"db", "level", "msg", "run_id", "table", "thread", "ts"}},
+		{"debug", "dumping.file.done", []string{"bytes", "db", "file", "level", "msg", "run_id", "table", "thread", "ts"}},
+		{"info", "dumping.table.done", []string{"bytes", "db", "level", "msg", "rows", "run_id", "table", "thread", "ts"}},
+		{"info", "dumping.progress", []string{"active_threads", "bytes", "elapsed", "eta_seconds", "level", "msg", "rows", "run_id", "tables_done", "tables_total", "ts"}},
+		{"debug", "restoring.file.started", []string{"db", "file", "level", "msg", "run_id", "table", "thread", "ts"}},
+		{"info", "restoring.progress", []string{"bytes", "elapsed", "level", "msg", "run_id", "ts"}},
+		{"warning", "warn.line", []string{"level", "msg", "run_id", "ts"}},
+		{"summary", "dumping.all.done", []string{"level", "msg", "run_id", "ts"}},
+	}
+	runID := events[0]["run_id"]
+	assert.NotEqual(t, "", runID)
+	for i, w := range want {
+		ev := events[i]
+		assert.Equal(t, w.level, ev["level"])
+		assert.Equal(t, w.msg, ev["msg"])
+		assert.Equal(t, w.keys, logKeys(ev))
+		assert.Equal(t, runID, ev["run_id"])
+		_, err := time.Parse(time.RFC3339Nano, ev["ts"].(string))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, "test", events[2]["db"])
+	assert.Equal(t, "t1", events[2]["table"])
+	assert.Equal(t, float64(100), events[2]["bytes"])
+	assert.Equal(t, float64(1), events[2]["thread"])
+}
+
+func TestLogFormatLevel(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "info", "json")
+	assert.Nil(t, err)
+
+	// Debug events are filtered.
+	loadEvents(log).FileDone("test", "t1", "/tmp/test.t1.00001.sql", 100, 1)
+	log.Debug("debug.line")
+	assert.Equal(t, "", out.String())
+
+	dumpEvents(log).TableStarted("test", "t1", 0)
+	events := decodeLogLines(t, out.String())
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, float64(0), events[0]["thread"])
+}
+
+func TestLogFormatText(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "", "")
+	assert.Nil(t, err)
+	dumpEvents(log).TableDone("test", "t1", 10, 2*1024*1024, 1)
+	assert.True(t, strings.Contains(out.String(), "dumping.table[test.t1].done.allrows[10].allbytes[2MB].thread[1]..."))
+
+	_, err = NewLog(out, "trace", "")
+	assert.NotNil(t, err)
+	_, err = NewLog(out, "", "xml")
+	assert.NotNil(t, err)
+}
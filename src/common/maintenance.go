@@ -0,0 +1,103 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// restoredSchemas returns the schema files of the restored tables names,
+// 'db.table' names in their order, or all of them for names OptimizeAll. A
+// name not in the dump is a warning of the phase.
+func restoredSchemas(log *xlog.Log, args *LoadArgs, phase string, schemas []string, names []string) ([]*schemaFile, error) {
+	paths := make(map[string]string)
+	var all []string
+	for _, schema := range schemas {
+		name := strings.TrimSuffix(filepath.Base(schema), schemaSuffix)
+		paths[name] = schema
+		all = append(all, name)
+	}
+	if len(names) == 1 && names[0] == OptimizeAll {
+		names = all
+	}
+	var tables []*schemaFile
+	for _, name := range names {
+		path, ok := paths[name]
+		if !ok {
+			log.Warning("restoring.%s.table[%s].not.in.dump,skipped", phase, name)
+			continue
+		}
+		schema, err := readSchemaFile(args.store(), path)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, schema)
+	}
+	return tables, nil
+}
+
+// keptTables returns the 'db.table' names of names which are kept, all of
+// them for OptimizeAll.
+func keptTables(names []string, kept map[string]bool) []string {
+	if len(names) == 1 && names[0] == OptimizeAll {
+		return names
+	}
+	var tables []string
+	for _, name := range names {
+		if kept[name] {
+			tables = append(tables, name)
+		}
+	}
+	return tables
+}
+
+// forEachTable runs fn for the tables in their order on threads connections
+// of the pool, at least 1 and at most the LoadArgs.PostThreads, for the
+// phase: the phases run on the tables once the restore is done, like the
+// warm-up and the optimize, share it. Once ctx is done the connections are closed, which kills the
+// statements running, fn is still called for the tables left, with ctx done,
+// to record them.
+func forEachTable(ctx context.Context, pool *Pool, args *LoadArgs, phase string, threads int, tables []*schemaFile, fn func(conn *Connection, schema *schemaFile)) {
+	if threads < 1 {
+		threads = 1
+	}
+	if post := args.postThreads(); threads > post {
+		threads = post
+	}
+	limit := newPhaseLimit(args.metrics, phase, threads)
+	defer limit.done()
+	var wg sync.WaitGroup
+	work := make(chan *schemaFile)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := limit.get(pool)
+			defer limit.put(pool, conn)
+			stop := closeConnOnDone(ctx, conn)
+			defer stop()
+			for schema := range work {
+				working := limit.working()
+				fn(conn, schema)
+				working()
+			}
+		}()
+	}
+	for _, schema := range tables {
+		work <- schema
+	}
+	close(work)
+	wg.Wait()
+}
@@ -0,0 +1,103 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+const (
+	// definerUser is a user of an account, quoted with `, ' or " (a doubled
+	// quote is an escaped one) or not.
+	definerUser = "(`(?:[^`]|``)*`|'(?:[^']|'')*'|\"(?:[^\"]|\"\")*\"|[\\w.$-]+)"
+	// definerHost is a host of an account, quoted or not.
+	definerHost = "(`(?:[^`]|``)*`|'(?:[^']|'')*'|\"(?:[^\"]|\"\")*\"|[\\w.%:-]+)"
+)
+
+// definerRegexp matches a DEFINER=user@host clause of a view, routine, trigger
+// or event, the user and host quoted or not, also inside a versioned comment.
+var definerRegexp = regexp.MustCompile("(?i)DEFINER\\s*=\\s*" + definerUser + "\\s*@\\s*" + definerHost)
+
+// definerAccountRegexp matches a LoadArgs.DefinerUser.
+var definerAccountRegexp = regexp.MustCompile("^" + definerUser + "\\s*@\\s*" + definerHost + "$")
+
+// privilegedSetRegexp matches the SET statements which need SUPER (or
+// SYSTEM_VARIABLES_ADMIN) on the target: any global variable and the session
+// variables of the binlog and the replication, like the header of a mysqldump
+// with GTIDs.
+var privilegedSetRegexp = regexp.MustCompile(`(?is)^SET\b.*\b(GLOBAL|PERSIST|PERSIST_ONLY|SQL_LOG_BIN|GTID_PURGED|GTID_NEXT|READ_ONLY|SUPER_READ_ONLY)\b`)
+
+// rewriteDefiner replaces the DEFINER=user@host clauses of a statement with
+// DEFINER=definer, CURRENT_USER or an account of definerAccount.
+func rewriteDefiner(query string, definer string) string {
+	return definerRegexp.ReplaceAllLiteralString(query, "DEFINER="+definer)
+}
+
+// definerAccount returns the account 'user'@'host' of a LoadArgs.DefinerUser
+// like 'app@%', ok is false if it isn't one.
+func definerAccount(s string) (account string, ok bool) {
+	user, host, ok := accountParts(s)
+	if !ok {
+		return "", false
+	}
+	return quoteAccount(user, host), true
+}
+
+// accountParts splits an account user@host, the user and the host quoted or
+// not, into its unquoted user and host, ok is false if it isn't one.
+func accountParts(s string) (user string, host string, ok bool) {
+	match := definerAccountRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return "", "", false
+	}
+	unquote := func(part string) string {
+		if q := part[0]; q == '`' || q == '\'' || q == '"' {
+			return strings.Replace(part[1:len(part)-1], string([]byte{q, q}), string(q), -1)
+		}
+		return part
+	}
+	return unquote(match[1]), unquote(match[2]), true
+}
+
+// quoteAccount returns the account 'user'@'host'.
+func quoteAccount(user string, host string) string {
+	return "'" + strings.Replace(user, "'", "''", -1) + "'@'" + strings.Replace(host, "'", "''", -1) + "'"
+}
+
+// isPrivilegedSet reports whether query is a SET statement which needs SUPER.
+func isPrivilegedSet(query string) bool {
+	return privilegedSetRegexp.MatchString(query)
+}
+
+// managedStatement applies the RewriteDefiners and SkipPrivilegedSets
+// workarounds of args (or ManagedMode) to a statement of file, ok is false if
+// the statement must not be executed. The definers are rewritten to the
+// DefinerUser if it's set, else to CURRENT_USER, only in the schema
+// statements, ddl, never in the datas.
+func managedStatement(log *xlog.Log, args *LoadArgs, file string, query string, ddl bool) (string, bool) {
+	if (args.ManagedMode || args.SkipPrivilegedSets) && isPrivilegedSet(query) {
+		log.Warning("restoring.managed.skip.privileged.set.file[%s]:%s", file, redactSQL(query, args.logSQLMaxBytes()))
+		return query, false
+	}
+	if ddl && (args.ManagedMode || args.RewriteDefiners || args.DefinerUser != "") {
+		definer := "CURRENT_USER"
+		if args.DefinerUser != "" {
+			definer, _ = definerAccount(args.DefinerUser)
+		}
+		if rewritten := rewriteDefiner(query, definer); rewritten != query {
+			log.Info("restoring.managed.definer.rewritten.to[%s].file[%s]", definer, file)
+			return rewritten, true
+		}
+	}
+	return query, true
+}
@@ -0,0 +1,200 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagedRewriteDefiner(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			query: "CREATE ALGORITHM=UNDEFINED DEFINER=`root`@`%` SQL SECURITY DEFINER VIEW `v1` AS select 1",
+			want:  "CREATE ALGORITHM=UNDEFINED DEFINER=CURRENT_USER SQL SECURITY DEFINER VIEW `v1` AS select 1",
+		},
+		{
+			query: "CREATE DEFINER='admin'@'10.0.%' PROCEDURE `p1`() BEGIN SELECT 1; END",
+			want:  "CREATE DEFINER=CURRENT_USER PROCEDURE `p1`() BEGIN SELECT 1; END",
+		},
+		{
+			query: "CREATE /*!50017 DEFINER = root@localhost*/ TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW SET NEW.a = 1",
+			want:  "CREATE /*!50017 DEFINER=CURRENT_USER*/ TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW SET NEW.a = 1",
+		},
+		{
+			query: "CREATE DEFINER=CURRENT_USER VIEW `v2` AS select 1",
+			want:  "CREATE DEFINER=CURRENT_USER VIEW `v2` AS select 1",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, rewriteDefiner(test.query, "CURRENT_USER"))
+	}
+}
+
+func TestManagedDefinerUser(t *testing.T) {
+	account, ok := definerAccount("app@%")
+	assert.True(t, ok)
+	assert.Equal(t, "'app'@'%'", account)
+
+	// Every object type.
+	{
+		tests := []struct {
+			query string
+			want  string
+		}{
+			{
+				query: "CREATE ALGORITHM=UNDEFINED DEFINER=`root`@`%` SQL SECURITY DEFINER VIEW `v1` AS select 1",
+				want:  "CREATE ALGORITHM=UNDEFINED DEFINER='app'@'%' SQL SECURITY DEFINER VIEW `v1` AS select 1",
+			},
+			{
+				query: "/*!50003 CREATE*/ /*!50017 DEFINER=`root`@`localhost`*/ /*!50003 TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW SET NEW.a = 1 */",
+				want:  "/*!50003 CREATE*/ /*!50017 DEFINER='app'@'%'*/ /*!50003 TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW SET NEW.a = 1 */",
+			},
+			{
+				query: "CREATE DEFINER=`admin`@`10.0.%` PROCEDURE `p1`() SQL SECURITY DEFINER BEGIN SELECT 1; END",
+				want:  "CREATE DEFINER='app'@'%' PROCEDURE `p1`() SQL SECURITY DEFINER BEGIN SELECT 1; END",
+			},
+			{
+				query: "CREATE DEFINER=`admin`@`%` FUNCTION `f1`() RETURNS int DETERMINISTIC RETURN 1",
+				want:  "CREATE DEFINER='app'@'%' FUNCTION `f1`() RETURNS int DETERMINISTIC RETURN 1",
+			},
+			{
+				query: "/*!50106 CREATE*/ /*!50117 DEFINER=`root`@`localhost`*/ /*!50106 EVENT `e1` ON SCHEDULE EVERY 1 DAY DO DELETE FROM `t1` */",
+				want:  "/*!50106 CREATE*/ /*!50117 DEFINER='app'@'%'*/ /*!50106 EVENT `e1` ON SCHEDULE EVERY 1 DAY DO DELETE FROM `t1` */",
+			},
+		}
+		for _, test := range tests {
+			assert.Equal(t, test.want, rewriteDefiner(test.query, account))
+		}
+	}
+
+	// Unusual quoting and whitespace.
+	{
+		tests := []struct {
+			query string
+			want  string
+		}{
+			{
+				query: "CREATE DEFINER=`we``ird`@`%` VIEW `v1` AS select 1",
+				want:  "CREATE DEFINER='app'@'%' VIEW `v1` AS select 1",
+			},
+			{
+				query: "CREATE DEFINER='o''brien'@'host.example.com' VIEW `v1` AS select 1",
+				want:  "CREATE DEFINER='app'@'%' VIEW `v1` AS select 1",
+			},
+			{
+				query: "CREATE definer\n  =\t\"ansi\" @ \"::1\" VIEW `v1` AS select 1",
+				want:  "CREATE DEFINER='app'@'%' VIEW `v1` AS select 1",
+			},
+			{
+				query: "CREATE DEFINER = app-svc@192.168.0.1 VIEW `v1` AS select 'DEFINER'",
+				want:  "CREATE DEFINER='app'@'%' VIEW `v1` AS select 'DEFINER'",
+			},
+		}
+		for _, test := range tests {
+			assert.Equal(t, test.want, rewriteDefiner(test.query, account))
+		}
+	}
+
+	// The accounts given.
+	{
+		for s, want := range map[string]string{
+			"'svc'@'10.%'":      "'svc'@'10.%'",
+			"`svc`@`%`":         "'svc'@'%'",
+			" svc @ localhost ": "'svc'@'localhost'",
+			"`o'brien`@`%`":     "'o''brien'@'%'",
+		} {
+			account, ok := definerAccount(s)
+			assert.True(t, ok, s)
+			assert.Equal(t, want, account)
+		}
+		for _, s := range []string{"", "app", "@%", "app@", "a b@%"} {
+			_, ok := definerAccount(s)
+			assert.False(t, ok, s)
+		}
+	}
+}
+
+func TestManagedPrivilegedSet(t *testing.T) {
+	for _, query := range []string{
+		"SET @@SESSION.SQL_LOG_BIN= 0",
+		"SET sql_log_bin=1",
+		"SET @@GLOBAL.GTID_PURGED=/*!80000 '+'*/ 'uuid:1-10'",
+		"SET GLOBAL read_only = 0",
+		"set global super_read_only=off",
+		"SET PERSIST max_connections=100",
+		"SET @@gtid_next='AUTOMATIC'",
+	} {
+		assert.True(t, isPrivilegedSet(query), query)
+	}
+	for _, query := range []string{
+		"SET NAMES utf8mb4",
+		"SET @global_x = 1",
+		"SET foreign_key_checks=0",
+		"INSERT INTO `t1` VALUES ('SET GLOBAL')",
+	} {
+		assert.False(t, isPrivilegedSet(query), query)
+	}
+}
+
+func TestManagedStatement(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	view := "CREATE DEFINER=`root`@`%` VIEW `v1` AS select 1"
+	set := "SET @@SESSION.SQL_LOG_BIN= 0"
+
+	// Off.
+	{
+		args := &LoadArgs{}
+		query, ok := managedStatement(log, args, "f", view, true)
+		assert.True(t, ok)
+		assert.Equal(t, view, query)
+		_, ok = managedStatement(log, args, "f", set, false)
+		assert.True(t, ok)
+	}
+
+	// Managed mode.
+	{
+		args := &LoadArgs{ManagedMode: true}
+		query, ok := managedStatement(log, args, "f", view, true)
+		assert.True(t, ok)
+		assert.Equal(t, "CREATE DEFINER=CURRENT_USER VIEW `v1` AS select 1", query)
+		_, ok = managedStatement(log, args, "f", set, false)
+		assert.False(t, ok)
+		// Never in the datas.
+		query, ok = managedStatement(log, args, "f", "INSERT INTO `t1` VALUES ('DEFINER=`a`@`b`')", false)
+		assert.True(t, ok)
+		assert.Equal(t, "INSERT INTO `t1` VALUES ('DEFINER=`a`@`b`')", query)
+	}
+
+	// A definer user, even without the managed mode.
+	{
+		args := &LoadArgs{DefinerUser: "app@%"}
+		query, ok := managedStatement(log, args, "f", view, true)
+		assert.True(t, ok)
+		assert.Equal(t, "CREATE DEFINER='app'@'%' VIEW `v1` AS select 1", query)
+		args.ManagedMode = true
+		query, _ = managedStatement(log, args, "f", view, true)
+		assert.Equal(t, "CREATE DEFINER='app'@'%' VIEW `v1` AS select 1", query)
+	}
+
+	// One workaround only.
+	{
+		args := &LoadArgs{SkipPrivilegedSets: true}
+		query, _ := managedStatement(log, args, "f", view, true)
+		assert.Equal(t, view, query)
+		_, ok := managedStatement(log, args, "f", set, false)
+		assert.False(t, ok)
+	}
+}
@@ -0,0 +1,331 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const manifestFile = "manifest.json"
+
+// Manifest is the manifest.json written by the dumper next to the metadata file,
+// it's the machine readable description of the dump:
+//
+//	{
+//	  "version": "0.2.0",
+//	  "server_version": "8.0.32",
+//	  "server_features": {"check_constraints": true, "invisible_columns": true, "roles": true, "lower_case_table_names": 0},
+//	  "tables": [
+//	    {"database": "test", "table": "t1", "schema_versions": ["v1", "v2"]},
+//	    {"database": "test", "table": "t2"}
+//	  ]
+//	}
+//
+// The manifest is optional for the loader, it's only read by the features which need it.
+type Manifest struct {
+	mu sync.Mutex
+	// index is Tables by 'db.table', see table.
+	index map[string]*ManifestTable
+
+	// Version is the version of the tool which wrote the dump.
+	Version string `json:"version"`
+	// ServerVersion is the VERSION() of the source server, like '8.0.32' or
+	// '10.6.12-MariaDB', the loader checks the target against it.
+	ServerVersion string `json:"server_version,omitempty"`
+	// ServerFeatures are the features of the source server, the loader
+	// compares them with the ones of the target.
+	ServerFeatures *ServerFeatures `json:"server_features,omitempty"`
+	// Consistency is the point of the snapshot of a dump with
+	// DumpArgs.Consistency, nil without one.
+	Consistency *ConsistentPoint `json:"consistency,omitempty"`
+	Tables      []*ManifestTable `json:"tables"`
+	// VolumeFiles are the data files of a dump spread on DumpArgs.Volumes,
+	// with the path of the volume of each, none if the dump has no volumes.
+	VolumeFiles map[string]string `json:"volume_files,omitempty"`
+	// Compatibility are the features of the tables which may not restore
+	// faithfully, the same as compatibility-report.txt.
+	Compatibility []*CompatibilityWarning `json:"compatibility,omitempty"`
+	// NotDumped are the tables, 'db.table', a dump stopped by its
+	// DumpArgs.MaxRuntime did not finish, the loader refuses the dump as a
+	// partial one until a dump with DumpArgs.Resume finishes them.
+	NotDumped []string `json:"not_dumped,omitempty"`
+	// Subset is the walk of the subset of a dump with DumpArgs.SubsetSeeds,
+	// nil without one.
+	Subset *ManifestSubset `json:"subset,omitempty"`
+	// Incremental is the chain of a dump with DumpArgs.IncrementalFrom, nil
+	// for a full dump.
+	Incremental *ManifestIncremental `json:"incremental,omitempty"`
+	// Progress are the totals of the data phase of the dump.
+	Progress *DumpProgress `json:"progress,omitempty"`
+	// ExpiresAt is when the dump may be pruned, the start of the dump plus
+	// its DumpArgs.Retention, nil if it never expires. Hold is set by hand
+	// to keep a dump past its expiry, see Prune.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Hold      bool       `json:"hold,omitempty"`
+}
+
+// ManifestTable is one dumped table.
+type ManifestTable struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	// SchemaVersions are the schema versions the table belongs to, taken from
+	// a 'schema_versions=v1,v2' tag in the table COMMENT.
+	SchemaVersions []string `json:"schema_versions,omitempty"`
+	// Stats are the figures of the data dump, the same as the line in stats.tsv.
+	Stats *TableStats `json:"stats,omitempty"`
+	// Consistency is how the datas were read, TableSnapshot, TableReadLock or
+	// TableNoSnapshot, empty for a dump older than the record.
+	Consistency string `json:"consistency,omitempty"`
+	// Empty is set for a table dumped whole without any row, not for a
+	// selection of its partitions or rows, see DumpArgs.SkipEmptyFiles.
+	Empty bool `json:"empty,omitempty"`
+	// AutoIncrement is the AUTO_INCREMENT counter read after the datas were
+	// dumped, so it's past every id in the dump.
+	AutoIncrement uint64 `json:"auto_increment,omitempty"`
+	// Checksum is the CHECKSUM TABLE read after the datas were dumped, with
+	// DumpArgs.Checksum, nil if there is none.
+	Checksum *uint64 `json:"checksum,omitempty"`
+	// Paranoid is the check of the data files against the table, with
+	// DumpArgs.Paranoid, nil without it.
+	Paranoid *ParanoidCheck `json:"paranoid,omitempty"`
+	// Failed is why the table failed to dump, with DumpArgs.CheckSchemaChanges:
+	// its files are there but may not restore it as it was.
+	Failed string `json:"failed,omitempty"`
+	// Partitions are the only partitions of the table dumped, with
+	// DumpArgs.Partitions, none if all of it is.
+	Partitions []string `json:"partitions,omitempty"`
+	// ChunkBy is the column[:interval] the datas were chunked by, with
+	// DumpArgs.ChunkBy, and Chunks its range in every data file.
+	ChunkBy string `json:"chunk_by,omitempty"`
+	// ChunkKey is the column:strategy of the key the datas were read by in
+	// ranges, with DumpArgs.ChunkRows, and Chunks the range of every data
+	// file: no From for the first one, no To for the last one.
+	ChunkKey string          `json:"chunk_key,omitempty"`
+	Chunks   []ManifestChunk `json:"chunks,omitempty"`
+}
+
+// ManifestChunk is a data file of a table dumped with DumpArgs.ChunkBy: its
+// rows have the column From included to To excluded, like 2024-01-15 to
+// 2024-01-16, neither for the NULLs or a zero date. With DumpArgs.ChunkRows
+// they are the range of its key.
+type ManifestChunk struct {
+	File string `json:"file"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+}
+
+// schemaVersionsTag matches the tag in a table comment, like: COMMENT='orders, schema_versions=v1,v2'.
+var schemaVersionsTag = regexp.MustCompile(`schema_versions=([\w.-]+(?:,[\w.-]+)*)`)
+
+func newManifest() *Manifest {
+	return &Manifest{Version: Version}
+}
+
+// addTable records a dumped table with the schema version tags of its create statement.
+func (m *Manifest) addTable(db string, table string, schema string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.table(db, table)
+	if match := schemaVersionsTag.FindStringSubmatch(tableComment(schema)); match != nil {
+		t.SchemaVersions = strings.Split(match[1], ",")
+	}
+}
+
+// table returns the table db.table of Tables, appended if it's not there
+// yet, m.mu must be held. The index is built on the first call, for a
+// manifest read with its Tables.
+func (m *Manifest) table(db string, table string) *ManifestTable {
+	if m.index == nil {
+		m.index = make(map[string]*ManifestTable, len(m.Tables))
+		for _, t := range m.Tables {
+			m.index[t.Database+"."+t.Table] = t
+		}
+	}
+	key := db + "." + table
+	t := m.index[key]
+	if t == nil {
+		t = &ManifestTable{Database: db, Table: table}
+		m.Tables = append(m.Tables, t)
+		m.index[key] = t
+	}
+	return t
+}
+
+// setStats records the stats of a dumped table, whole if all its rows were
+// dumped: only then are no rows an empty table, a selection of its
+// partitions or of its rows may have none of a table which has some.
+func (m *Manifest) setStats(db string, table string, stats *TableStats, whole bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.table(db, table)
+	t.Stats = stats
+	t.Empty = whole && stats.Rows == 0
+}
+
+// setAutoIncrement records the AUTO_INCREMENT counter of a dumped table.
+func (m *Manifest) setAutoIncrement(db string, table string, n uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.table(db, table).AutoIncrement = n
+}
+
+// setPartitions records the partitions a table was dumped with.
+func (m *Manifest) setPartitions(db string, table string, partitions []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.table(db, table).Partitions = partitions
+}
+
+// setChunks records the column a table was chunked by and the range of each
+// of its data files.
+func (m *Manifest) setChunks(db string, table string, chunkBy string, chunks []checkpointChunk) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.table(db, table)
+	t.ChunkBy = chunkBy
+	t.Chunks = nil
+	for _, c := range chunks {
+		t.Chunks = append(t.Chunks, ManifestChunk{File: c.Name, From: c.From, To: c.To})
+	}
+}
+
+// setChunkKey records the key a table was read by with DumpArgs.ChunkRows
+// and the range of each of its data files.
+func (m *Manifest) setChunkKey(db string, table string, key string, chunks []checkpointChunk) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t := m.table(db, table)
+	t.ChunkKey = key
+	t.Chunks = nil
+	for _, c := range chunks {
+		t.Chunks = append(t.Chunks, ManifestChunk{File: c.Name, From: c.From, To: c.To})
+	}
+}
+
+// setChecksum records the CHECKSUM TABLE of a dumped table.
+func (m *Manifest) setChecksum(db string, table string, sum uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.table(db, table).Checksum = &sum
+}
+
+// setParanoid records the paranoid check of a dumped table.
+func (m *Manifest) setParanoid(db string, table string, check *ParanoidCheck) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.table(db, table).Paranoid = check
+}
+
+// setFailed records why a dumped table failed.
+func (m *Manifest) setFailed(db string, table string, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.table(db, table).Failed = reason
+}
+
+// failedTables returns the tables setFailed recorded, as 'db.table'.
+func (m *Manifest) failedTables() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var failed []string
+	for _, t := range m.Tables {
+		if t.Failed != "" {
+			failed = append(failed, t.Database+"."+t.Table)
+		}
+	}
+	return failed
+}
+
+// addCompatibility records why a dumped table may not restore faithfully.
+func (m *Manifest) addCompatibility(db string, table string, reasons []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, reason := range reasons {
+		m.Compatibility = append(m.Compatibility, &CompatibilityWarning{Database: db, Table: table, Reason: reason})
+	}
+}
+
+// tableComment returns the table level COMMENT of a create table statement.
+func tableComment(schema string) string {
+	options := tableOptions(schema)
+	start := strings.Index(options, "COMMENT='")
+	if start < 0 {
+		return ""
+	}
+	return options[start+len("COMMENT='"):]
+}
+
+func (m *Manifest) write(s Storage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.Slice(m.Tables, func(i, j int) bool {
+		a, b := m.Tables[i], m.Tables[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Table < b.Table
+	})
+	sort.SliceStable(m.Compatibility, func(i, j int) bool {
+		a, b := m.Compatibility[i], m.Compatibility[j]
+		if a.Database != b.Database {
+			return a.Database < b.Database
+		}
+		return a.Table < b.Table
+	})
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(s, manifestFile, string(data)+"\n")
+}
+
+// readManifest reads the manifest.json of the dump.
+func readManifest(s Storage) (*Manifest, error) {
+	data, err := readFile(s, manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("manifest[%s].parse.error:%v", manifestFile, err)
+	}
+	return m, nil
+}
+
+// schemaVersionTables returns the 'db.table' set of the tables which belong to the schema version.
+func (m *Manifest) schemaVersionTables(version string) map[string]bool {
+	tables := make(map[string]bool)
+	for _, t := range m.Tables {
+		for _, v := range t.SchemaVersions {
+			if v == version {
+				tables[t.Database+"."+t.Table] = true
+			}
+		}
+	}
+	return tables
+}
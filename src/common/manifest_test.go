@@ -0,0 +1,91 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestSchemaVersions(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	dir := "/tmp/manifesttest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	m := newManifest()
+	m.addTable("test", "t2", "CREATE TABLE `t2` (`a` int(11) COMMENT 'schema_versions=v9') ENGINE=InnoDB COMMENT='new, schema_versions=v2'")
+	m.addTable("test", "t1", "CREATE TABLE `t1` (`a` int(11)) ENGINE=InnoDB COMMENT='schema_versions=v1,v2'")
+	m.addTable("test", "t3", "CREATE TABLE `t3` (`a` int(11) COMMENT 'schema_versions=v1') ENGINE=InnoDB")
+	x = m.write(NewDirStorage(dir))
+	AssertNil(x)
+
+	got, err := readManifest(NewDirStorage(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, Version, got.Version)
+	assert.Equal(t, 3, len(got.Tables))
+	assert.Equal(t, "t1", got.Tables[0].Table)
+	assert.Equal(t, []string{"v1", "v2"}, got.Tables[0].SchemaVersions)
+	assert.Equal(t, []string{"v2"}, got.Tables[1].SchemaVersions)
+	// Column comments are not table tags.
+	assert.Equal(t, 0, len(got.Tables[2].SchemaVersions))
+
+	assert.Equal(t, map[string]bool{"test.t1": true}, got.schemaVersionTables("v1"))
+	assert.Equal(t, map[string]bool{"test.t1": true, "test.t2": true}, got.schemaVersionTables("v2"))
+
+	// Filter the files.
+	{
+		files := &Files{
+			schemas: []string{dir + "/test.t1-schema.sql", dir + "/test.t2-schema.sql", dir + "/test.t3-schema.sql"},
+			tables:  []string{dir + "/test.t1.00001.sql", dir + "/test.t2.00001.sql", dir + "/test.t3.00001.sql", dir + "/test.t1.00002.sql"},
+		}
+		err := filterSchemaVersion(log, files, NewDirStorage(dir), "v1")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{dir + "/test.t1-schema.sql"}, files.schemas)
+		assert.Equal(t, []string{dir + "/test.t1.00001.sql", dir + "/test.t1.00002.sql"}, files.tables)
+	}
+
+	// Unknown version.
+	{
+		err := filterSchemaVersion(log, &Files{}, NewDirStorage(dir), "v3")
+		assert.NotNil(t, err)
+	}
+
+	// No manifest.
+	{
+		err := filterSchemaVersion(log, &Files{}, NewDirStorage("/tmp"), "v1")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestManifestTableIndex(t *testing.T) {
+	m := newManifest()
+	m.addTable("test", "t1", "CREATE TABLE `t1` (`a` int(11)) ENGINE=InnoDB")
+	m.setAutoIncrement("test", "t1", 10)
+	m.setFailed("test", "t1", "schema.changed")
+	// A table set before it's added is added once.
+	m.setChecksum("test", "t2", 42)
+	m.addTable("test", "t2", "CREATE TABLE `t2` (`a` int(11)) ENGINE=InnoDB COMMENT='schema_versions=v1'")
+	assert.Equal(t, 2, len(m.Tables))
+	assert.Equal(t, uint64(10), m.Tables[0].AutoIncrement)
+	assert.Equal(t, "schema.changed", m.Tables[0].Failed)
+	assert.Equal(t, uint64(42), *m.Tables[1].Checksum)
+	assert.Equal(t, []string{"v1"}, m.Tables[1].SchemaVersions)
+
+	// A manifest read with its tables is indexed on its first set.
+	read := &Manifest{Tables: []*ManifestTable{{Database: "test", Table: "t1"}}}
+	read.setParanoid("test", "t1", &ParanoidCheck{TableRows: 3})
+	assert.Equal(t, 1, len(read.Tables))
+	assert.Equal(t, uint64(3), read.Tables[0].Paranoid.TableRows)
+}
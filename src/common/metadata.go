@@ -0,0 +1,109 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+const (
+	metaFile = "metadata"
+
+	metaStarted   = "Started dump at"
+	metaVersion   = "Version"
+	metaGitCommit = "Git commit"
+	metaBuildDate = "Build date"
+	metaGoVersion = "Go version"
+)
+
+// metaData returns the content of the metadata file, one 'key: value' per line
+// as the 'Started dump at:' line of maxbube/mydumper.
+func metaData() string {
+	lines := []string{
+		fmt.Sprintf("%s: %s", metaStarted, time.Now().Format("2006-01-02 15:04:05")),
+		fmt.Sprintf("%s: %s", metaVersion, Version),
+		fmt.Sprintf("%s: %s", metaGitCommit, GitCommit),
+		fmt.Sprintf("%s: %s", metaBuildDate, BuildDate),
+		fmt.Sprintf("%s: %s", metaGoVersion, runtime.Version()),
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// readMetaData parses the metadata file of the dump, a missing file is an empty map.
+func readMetaData(s Storage) map[string]string {
+	meta := make(map[string]string)
+	data, err := readFile(s, metaFile)
+	if err != nil {
+		return meta
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 {
+			meta[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	return meta
+}
+
+// partialSuffix ends the files of a dump not done writing: mydumper writes
+// its metadata.partial while it dumps and renames it to metadata on success.
+const partialSuffix = ".partial"
+
+// partialMarker reports whether the file name is a partial marker of a dump
+// which was still running or failed: metadata.partial, .metadata.partial or
+// any other '*.partial' file.
+func partialMarker(name string) bool {
+	return strings.HasSuffix(name, partialSuffix)
+}
+
+// checkPartialMarkers refuses to restore a dump with partial markers, unless
+// allow is set, then they are logged as warnings.
+func checkPartialMarkers(log *xlog.Log, files *Files, allow bool) error {
+	if len(files.partials) == 0 {
+		return nil
+	}
+	if !allow {
+		return fmt.Errorf("restoring.dump.is.partial, the dump was still running or failed (allow it with AllowPartialDump):\n  partial markers: %s", strings.Join(files.partials, ", "))
+	}
+	for _, name := range files.partials {
+		log.Warning("restoring.dump.partial.marker[%s].restored.anyway", name)
+	}
+	return nil
+}
+
+// notDumpedMarker adds the tables the manifest.json of a dump stopped by its
+// DumpArgs.MaxRuntime lists as not dumped to the partial markers of files.
+func notDumpedMarker(s Storage, files *Files) {
+	m, err := readManifest(s)
+	if err != nil || len(m.NotDumped) == 0 {
+		return
+	}
+	files.partials = append(files.partials, fmt.Sprintf("%s (not dumped: %s)", manifestFile, strings.Join(m.NotDumped, ", ")))
+}
+
+// checkDumpVersion logs the version which produced the dump and warns if it's
+// from a newer major version than the loader.
+func checkDumpVersion(log *xlog.Log, s Storage) {
+	meta := readMetaData(s)
+	version, ok := meta[metaVersion]
+	if !ok {
+		log.Info("restoring.dump.version[unknown].loader.version[%s]", Version)
+		return
+	}
+	log.Info("restoring.dump.version[%s].commit[%s].loader.version[%s].commit[%s]", version, meta[metaGitCommit], Version, GitCommit)
+	if majorVersion(version) > majorVersion(Version) {
+		log.Warning("restoring.dump.from.newer.major.version[%s].than.loader[%s].may.not.restore.correctly", version, Version)
+	}
+}
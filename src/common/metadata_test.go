@@ -0,0 +1,93 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetaData(t *testing.T) {
+	dir := "/tmp/metadatatest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	// Missing.
+	{
+		meta := readMetaData(NewDirStorage(dir))
+		assert.Equal(t, 0, len(meta))
+	}
+
+	{
+		writeMetaData(&DumpArgs{Outdir: dir, storage: NewDirStorage(dir)})
+		meta := readMetaData(NewDirStorage(dir))
+		assert.Equal(t, Version, meta[metaVersion])
+		assert.Equal(t, GitCommit, meta[metaGitCommit])
+		assert.Equal(t, BuildDate, meta[metaBuildDate])
+		assert.True(t, strings.HasPrefix(meta[metaGoVersion], "go"))
+		assert.NotEqual(t, "", meta[metaStarted])
+	}
+}
+
+func TestMajorVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		major   int
+	}{
+		{"0.2.0", 0},
+		{"v1.2.3", 1},
+		{"12", 12},
+		{"dev", -1},
+		{"", -1},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.major, majorVersion(test.version))
+	}
+	assert.True(t, strings.Contains(VersionString(), Version))
+}
+
+func TestMetaDataPartial(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	assert.True(t, partialMarker("metadata.partial"))
+	assert.True(t, partialMarker(".metadata.partial"))
+	assert.True(t, partialMarker("test.t1.00001.sql.partial"))
+	assert.False(t, partialMarker("metadata"))
+	assert.False(t, partialMarker("test.partial-schema.sql"))
+
+	s := NewMemStorage()
+	assert.Nil(t, writeFile(s, "test-schema-create.sql", "create database"))
+	assert.Nil(t, writeFile(s, "test.t1.00001.sql", "insert"))
+
+	// A complete dump.
+	{
+		files, err := loadFiles(s)
+		assert.Nil(t, err)
+		assert.Nil(t, checkPartialMarkers(log, files, false))
+	}
+
+	// Refused, or allowed with a warning.
+	{
+		assert.Nil(t, writeFile(s, ".metadata.partial", "Started dump at: 2017-10-13 10:11:12"))
+		assert.Nil(t, writeFile(s, "metadata.partial", "Started dump at: 2017-10-13 10:11:12"))
+		files, err := loadFiles(s)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{".metadata.partial", "metadata.partial"}, files.partials)
+		assert.Equal(t, []string{"test.t1.00001.sql"}, files.tables)
+		err = checkPartialMarkers(log, files, false)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "partial markers: .metadata.partial, metadata.partial"))
+		assert.Nil(t, checkPartialMarkers(log, files, true))
+	}
+}
@@ -0,0 +1,698 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// Metrics are the live counters of one dump or load run, served in the
+// Prometheus text format by the -metrics-listen endpoint.
+// The bytes and rows are the atomic counters of the run plus the
+// workerCounters the workers add to, the other counters are updated by the
+// workers. All the methods accept a nil
+// *Metrics, so the functions exported for library use work without one.
+type Metrics struct {
+	mode  string
+	runID string
+	start time.Time
+	pool  *Pool
+	bytes *uint64
+	rows  *uint64
+	// counters are the bytes and rows the workers add, see addProgress.
+	counters workerCounters
+	// events is the chan fileEvent of the collector of the data phase, nil
+	// without one, see collectFileEvents.
+	events atomic.Value
+
+	// target is the LoadArgs.Targets name of the run of a load with targets.
+	target string
+
+	files       uint64
+	filesDone   uint64
+	filesFailed uint64
+	totalBytes  uint64
+	// totalRows are the rows the run will restore, known from the metadata
+	// files of a dump of the C mydumper only, see mydumperRows.
+	totalRows  uint64
+	tables     uint64
+	tablesDone uint64
+	workers    int64
+	retries    uint64
+	// noSnapshot are the tables of a dump read without a snapshot, see
+	// TableNoSnapshot.
+	noSnapshot uint64
+	// reconnects are the connections of a load connected again once their
+	// server went away, failovers the times they moved to another address.
+	reconnects uint64
+	failovers  uint64
+	// smallBatches are the LoadArgs.SmallFileBatch batches of a load
+	// restored, smallFiles their files.
+	smallBatches uint64
+	smallFiles   uint64
+	// emptyMarkers and emptyFiles are the data files of a load without any
+	// row taken out of it, see filterEmptyFiles.
+	emptyMarkers uint64
+	emptyFiles   uint64
+	// throttled is the time the threads of a load waited on
+	// LoadArgs.MaxThreadsPerDatabase, or of a dump on DumpArgs.MaxReplicaLag,
+	// in nanoseconds.
+	throttled int64
+	// readOnlyWaits are the threads waiting for a read-only target to become
+	// writable, see waitWritable.
+	readOnlyWaits int64
+	// lag is the gate of the replica lag of the run, nil if it watches none.
+	lag *lagGate
+	// filesOnly are the LoadArgs.Files of a load restoring them only.
+	filesOnly []string
+
+	// config is the effective configuration of the run, passwords redacted.
+	config interface{}
+	// progress is the ProgressFile of the run, nil without one.
+	progress *progressFile
+
+	mu       sync.Mutex
+	current  string
+	phases   []string
+	phase    map[string]float64
+	inflight map[int]*tableState
+	errs     []string
+	// failures count the failed files by ErrorCategory.
+	failures map[ErrorCategory]uint64
+	hooks    map[string]*HookStats
+	// warm are the warm-up durations of LoadArgs.WarmTables by table, in
+	// seconds, and warmSkips the tables the skipped phase didn't warm.
+	warm      map[string]float64
+	warmSkips []string
+	// optimize are the rebuild durations of LoadArgs.OptimizeTables by table,
+	// in seconds, and optimizeFails the tables which failed to rebuild.
+	optimize      map[string]float64
+	optimizeFails []string
+	// smoke are the outcomes of the tables of DumpArgs.SmokeTest.
+	smoke []SmokeTable
+	// phaseThreads are the concurrency of the phases of a load, in their
+	// order, see phaseLimit.
+	phaseThreads []PhaseThreads
+	// warnings count the warnings of the data statements of a load by level
+	// and code, warned are the 'table:kind' already logged, tableWarnings
+	// the ones of every table, see LoadArgs.CaptureWarnings.
+	warnings      map[string]uint64
+	warned        map[string]bool
+	tableWarnings map[string]*TableWarnings
+	// encoding count the encoding problems of the values of a load by kind,
+	// encodingSeen are the 'table:kind' already logged, see LoadArgs.CheckUTF8.
+	encoding     map[string]uint64
+	encodingSeen map[string]bool
+	// suspicious are the data files without any row of the tables the
+	// manifest counts rows for, see filterEmptyFiles.
+	suspicious []string
+	// postSQL are the runs of the post-restore scripts, see runPostSQL.
+	postSQL []PostSQLRun
+	// targets are the reports of the runs of a load with LoadArgs.Targets by
+	// target.
+	targets map[string]Report
+	// skips are the phases which can be skipped while they run, a channel is
+	// closed once its phase is asked to be skipped.
+	skips map[string]chan struct{}
+	// cancel cancels the context of the run for a POST /cancel, nil if the
+	// run can't be cancelled, cancelled is 1 once it was.
+	cancel    context.CancelFunc
+	cancelled int32
+
+	// now is the clock of the thread accounting, replaced by the tests.
+	now        func() time.Time
+	threads    map[int]*threadUsage
+	threadsEnd time.Time
+}
+
+// maxRecentErrors is how many of the last errors the status keeps.
+const maxRecentErrors = 10
+
+// tableState is what a worker is busy on.
+type tableState struct {
+	Thread  int       `json:"thread"`
+	Table   string    `json:"table"`
+	File    string    `json:"file,omitempty"`
+	Started time.Time `json:"started"`
+	// FileBytes is the size of the File of a load, BytesDone the bytes of
+	// its statements executed so far and Percent, of the status only, the
+	// share of them, see fileProgress.
+	FileBytes uint64   `json:"file_bytes,omitempty"`
+	BytesDone uint64   `json:"bytes_done,omitempty"`
+	Percent   *float64 `json:"percent,omitempty"`
+}
+
+// newMetrics creates the metrics of a run, mode is "dump" or "load".
+// rows may be nil if the run doesn't count rows.
+func newMetrics(log *xlog.Log, mode string, pool *Pool, bytes *uint64, rows *uint64) *Metrics {
+	runID := LogRunID(log)
+	if runID == "" {
+		runID = newRunID()
+	}
+	return &Metrics{
+		mode:     mode,
+		runID:    runID,
+		start:    time.Now(),
+		pool:     pool,
+		bytes:    bytes,
+		rows:     rows,
+		counters: newWorkerCounters(),
+		phase:    make(map[string]float64),
+		skips:    map[string]chan struct{}{warmPhase: make(chan struct{}), optimizePhase: make(chan struct{})},
+
+		inflight: make(map[int]*tableState),
+		now:      time.Now,
+		threads:  make(map[int]*threadUsage),
+	}
+}
+
+func (m *Metrics) setFiles(n int) {
+	if m != nil {
+		atomic.StoreUint64(&m.files, uint64(n))
+	}
+}
+
+func (m *Metrics) addFiles(n int) {
+	if m != nil {
+		atomic.AddUint64(&m.files, uint64(n))
+	}
+}
+
+func (m *Metrics) fileDone(file string) {
+	if m != nil {
+		m.fileEvent(fileEvent{file: file})
+	}
+}
+
+func (m *Metrics) fileFailed(file string, err error) {
+	if m != nil {
+		m.fileEvent(fileEvent{file: file, err: err})
+	}
+}
+
+// setTotalBytes sets the bytes the run will restore, or a dump is estimated
+// to write, see estimateTableBytes.
+func (m *Metrics) setTotalBytes(n uint64) {
+	if m != nil {
+		atomic.StoreUint64(&m.totalBytes, n)
+	}
+}
+
+// setTotalRows sets the rows the run will restore.
+func (m *Metrics) setTotalRows(n uint64) {
+	if m != nil {
+		atomic.StoreUint64(&m.totalRows, n)
+	}
+}
+
+func (m *Metrics) setTables(n int) {
+	if m != nil {
+		atomic.StoreUint64(&m.tables, uint64(n))
+	}
+}
+
+func (m *Metrics) tableDone() {
+	if m != nil {
+		atomic.AddUint64(&m.tablesDone, 1)
+	}
+}
+
+// tableConsistency counts a table of a dump read as consistency says.
+func (m *Metrics) tableConsistency(consistency string) {
+	if m != nil && consistency == TableNoSnapshot {
+		atomic.AddUint64(&m.noSnapshot, 1)
+	}
+}
+
+// startWork records the table (and file) the worker of thread is busy on, until endWork.
+func (m *Metrics) startWork(thread int, table string, file string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	m.inflight[thread] = &tableState{Thread: thread, Table: table, File: file, Started: now}
+	m.threadBusy(thread, now)
+}
+
+func (m *Metrics) endWork(thread int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.inflight, thread)
+	m.threadIdle(thread, m.now())
+}
+
+func (m *Metrics) addError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errs = append(m.errs, err.Error())
+	if len(m.errs) > maxRecentErrors {
+		m.errs = m.errs[len(m.errs)-maxRecentErrors:]
+	}
+}
+
+func (m *Metrics) workerStarted() {
+	if m != nil {
+		atomic.AddInt64(&m.workers, 1)
+	}
+}
+
+func (m *Metrics) workerDone() {
+	if m != nil {
+		atomic.AddInt64(&m.workers, -1)
+	}
+}
+
+func (m *Metrics) retry(err error) {
+	if m != nil {
+		atomic.AddUint64(&m.retries, 1)
+		m.addError(err)
+		m.progressEvent(&ProgressEvent{Event: ProgressError, Error: err.Error(), Category: ErrorCategoryOf(err)}, false)
+	}
+}
+
+// smallFilesDone records a small file batch of n files restored.
+func (m *Metrics) smallFilesDone(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.smallBatches, 1)
+	atomic.AddUint64(&m.smallFiles, uint64(n))
+}
+
+// emptyFile records a data file of kind emptyTableMarker or noStatements
+// taken out of the load, suspicious if its table has rows in the manifest.
+func (m *Metrics) emptyFile(name string, kind string, suspicious bool) {
+	if m == nil {
+		return
+	}
+	if suspicious {
+		m.mu.Lock()
+		m.suspicious = append(m.suspicious, name)
+		m.mu.Unlock()
+		return
+	}
+	if kind == emptyTableMarker {
+		atomic.AddUint64(&m.emptyMarkers, 1)
+	} else {
+		atomic.AddUint64(&m.emptyFiles, 1)
+	}
+}
+
+// postSQLDone records the run of a post-restore script.
+func (m *Metrics) postSQLDone(run PostSQLRun) {
+	if m != nil {
+		m.mu.Lock()
+		m.postSQL = append(m.postSQL, run)
+		m.mu.Unlock()
+	}
+}
+
+// reconnected records a connection connected again, moved to another
+// address if moved.
+func (m *Metrics) reconnected(moved bool) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.reconnects, 1)
+	if moved {
+		atomic.AddUint64(&m.failovers, 1)
+	}
+}
+
+// phaseStarted records the phase the run is in.
+func (m *Metrics) phaseStarted(phase string) time.Time {
+	if m != nil {
+		m.mu.Lock()
+		m.current = phase
+		m.mu.Unlock()
+		if m.progress != nil {
+			m.progressEvent(&ProgressEvent{Event: ProgressPhase, Phase: phase, Status: m.progressStatus()}, true)
+		}
+	}
+	return time.Now()
+}
+
+// phaseDone records the duration of a phase started at start.
+func (m *Metrics) phaseDone(phase string, start time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.phase[phase]; !ok {
+		m.phases = append(m.phases, phase)
+	}
+	m.phase[phase] = time.Since(start).Seconds()
+}
+
+// setThrottled records the time the threads waited on the per database cap,
+// or on the replica lag.
+func (m *Metrics) setThrottled(d time.Duration) {
+	if m != nil {
+		atomic.StoreInt64(&m.throttled, int64(d))
+	}
+}
+
+// setFilesOnly records the only data files the load restores.
+func (m *Metrics) setFilesOnly(names []string) {
+	if m != nil {
+		m.mu.Lock()
+		m.filesOnly = names
+		m.mu.Unlock()
+	}
+}
+
+// setLagGate sets the gate of the replica lag the run watches.
+func (m *Metrics) setLagGate(g *lagGate) {
+	if m != nil {
+		m.mu.Lock()
+		m.lag = g
+		m.mu.Unlock()
+	}
+}
+
+// waitingWritable adds n to the threads waiting for a read-only target.
+func (m *Metrics) waitingWritable(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.readOnlyWaits, n)
+	}
+}
+
+// hookDone records a run of a hook which took d.
+func (m *Metrics) hookDone(hook string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.hooks == nil {
+		m.hooks = make(map[string]*HookStats)
+	}
+	s, ok := m.hooks[hook]
+	if !ok {
+		s = &HookStats{}
+		m.hooks[hook] = s
+	}
+	s.Runs++
+	if err != nil {
+		s.Failed++
+	}
+	s.Seconds += d.Seconds()
+}
+
+// statementWarning counts a warning of kind, like 'Warning 1265', of a data
+// statement of table, and keeps its message if table has fewer than
+// messages. It returns whether it's the first of kind of table, and the
+// warnings of table so far.
+func (m *Metrics) statementWarning(table string, kind string, message string, messages int) (bool, uint64) {
+	if m == nil {
+		return true, 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tw := m.tableWarning(table)
+	tw.Total++
+	tw.Counts[kind]++
+	if len(tw.Messages) < messages {
+		tw.Messages = append(tw.Messages, message)
+	}
+	return firstOfKind(m.warnings, m.warned, table, kind), tw.Total
+}
+
+// unlistedWarnings counts n warnings of table SHOW WARNINGS didn't list, it
+// returns the warnings of the table.
+func (m *Metrics) unlistedWarnings(table string, n uint64) uint64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tw := m.tableWarning(table)
+	tw.Total += n
+	tw.Counts[warningUnlisted] += n
+	m.warnings[warningUnlisted] += n
+	return tw.Total
+}
+
+// tableWarning returns the warnings of table, m.mu held.
+func (m *Metrics) tableWarning(table string) *TableWarnings {
+	if m.warnings == nil {
+		m.warnings = make(map[string]uint64)
+		m.warned = make(map[string]bool)
+		m.tableWarnings = make(map[string]*TableWarnings)
+	}
+	tw, ok := m.tableWarnings[table]
+	if !ok {
+		tw = &TableWarnings{Counts: make(map[string]uint64)}
+		m.tableWarnings[table] = tw
+	}
+	return tw
+}
+
+// encodingProblem counts an encoding problem of kind of a value of table, it
+// returns whether it's the first of kind of table.
+func (m *Metrics) encodingProblem(table string, kind string) bool {
+	if m == nil {
+		return true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.encoding == nil {
+		m.encoding = make(map[string]uint64)
+		m.encodingSeen = make(map[string]bool)
+	}
+	return firstOfKind(m.encoding, m.encodingSeen, table, kind)
+}
+
+// firstOfKind counts kind in counts and returns whether it's the first of
+// kind of table, the ones of seen.
+func firstOfKind(counts map[string]uint64, seen map[string]bool, table string, kind string) bool {
+	counts[kind]++
+	if seen[table+":"+kind] {
+		return false
+	}
+	seen[table+":"+kind] = true
+	return true
+}
+
+// targetDone records the report of the run of the target name.
+func (m *Metrics) targetDone(name string, r Report) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.targets == nil {
+		m.targets = make(map[string]Report)
+	}
+	m.targets[name] = r
+}
+
+// warmDone records the warm-up of a table which took d.
+func (m *Metrics) warmDone(table string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.warm == nil {
+		m.warm = make(map[string]float64)
+	}
+	m.warm[table] = d.Seconds()
+}
+
+// warmSkipped records a table the skipped warm-up didn't warm.
+func (m *Metrics) warmSkipped(table string) {
+	if m != nil {
+		m.mu.Lock()
+		m.warmSkips = append(m.warmSkips, table)
+		m.mu.Unlock()
+	}
+}
+
+// optimizeDone records the rebuild of a table which took d.
+func (m *Metrics) optimizeDone(table string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.optimize == nil {
+		m.optimize = make(map[string]float64)
+	}
+	m.optimize[table] = d.Seconds()
+}
+
+// optimizeFailed records a table which failed to rebuild.
+func (m *Metrics) optimizeFailed(table string) {
+	if m != nil {
+		m.mu.Lock()
+		m.optimizeFails = append(m.optimizeFails, table)
+		m.mu.Unlock()
+	}
+}
+
+// skipPhase asks the run to skip phase, if it's not done yet. It's false if
+// the phase can't be skipped.
+func (m *Metrics) skipPhase(phase string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	skip, ok := m.skips[phase]
+	if !ok {
+		return false
+	}
+	select {
+	case <-skip:
+	default:
+		close(skip)
+	}
+	return true
+}
+
+// cancelRun cancels the run as a cancel of its context does. It's false if
+// the run can't be cancelled.
+func (m *Metrics) cancelRun() bool {
+	if m.cancel == nil {
+		return false
+	}
+	atomic.StoreInt32(&m.cancelled, 1)
+	m.cancel()
+	return true
+}
+
+// skipped returns a channel closed once phase is asked to be skipped, it's
+// never closed for a nil *Metrics.
+func (m *Metrics) skipped(phase string) <-chan struct{} {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.skips[phase]
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var n int64
+	var err error
+	labels := fmt.Sprintf(`mode="%s",run_id="%s"`, m.mode, m.runID)
+	metric := func(name string, typ string, help string, values ...string) {
+		if err != nil {
+			return
+		}
+		var c int
+		c, err = fmt.Fprintf(w, "# HELP go_mydumper_%s %s\n# TYPE go_mydumper_%s %s\n", name, help, name, typ)
+		n += int64(c)
+		for i := 0; i+1 < len(values) && err == nil; i += 2 {
+			c, err = fmt.Fprintf(w, "go_mydumper_%s{%s%s} %s\n", name, labels, values[i], values[i+1])
+			n += int64(c)
+		}
+	}
+
+	bytes := m.bytesDone()
+	elapsed := time.Since(m.start).Seconds()
+	metric("bytes_total", "counter", "Bytes of SQL dumped or restored.", "", fmt.Sprint(bytes))
+	if m.rows != nil {
+		metric("rows_total", "counter", "Rows dumped.", "", fmt.Sprint(m.rowsDone()))
+	}
+	if rows := atomic.LoadUint64(&m.totalRows); rows > 0 {
+		metric("rows_expected", "gauge", "Rows the metadata files of a dump of the C mydumper record for the tables restored.", "", fmt.Sprint(rows))
+	}
+	metric("files", "gauge", "Data files known so far, for a dump it grows as the tables are chunked.", "", fmt.Sprint(atomic.LoadUint64(&m.files)))
+	metric("files_completed_total", "counter", "Data files written or restored.", "", fmt.Sprint(atomic.LoadUint64(&m.filesDone)))
+	metric("files_failed_total", "counter", "Data files which failed.", "", fmt.Sprint(atomic.LoadUint64(&m.filesFailed)))
+	metric("active_workers", "gauge", "Workers busy on a table or a data file.", "", fmt.Sprint(atomic.LoadInt64(&m.workers)))
+	size, idle := m.pool.Stats()
+	metric("pool_connections", "gauge", "Connections of the pool by state, a connection is never dropped so none is dead.",
+		`,state="idle"`, fmt.Sprint(idle), `,state="busy"`, fmt.Sprint(size-idle), `,state="dead"`, "0")
+	metric("retries_total", "counter", "Statements retried after a deadlock, a lock wait timeout, a read-only target or a server gone away.", "", fmt.Sprint(atomic.LoadUint64(&m.retries)))
+	metric("reconnects_total", "counter", "Connections of a load connected again once their server went away.", "", fmt.Sprint(atomic.LoadUint64(&m.reconnects)))
+	metric("failovers_total", "counter", "Times the connections of a load moved to another of its addresses.", "", fmt.Sprint(atomic.LoadUint64(&m.failovers)))
+	metric("small_file_batches_total", "counter", "Small file batches of a load restored.", "", fmt.Sprint(atomic.LoadUint64(&m.smallBatches)))
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(bytes) / elapsed
+	}
+	metric("rate_bytes_per_second", "gauge", "Average rate since the start of the run.", "", fmt.Sprintf("%.2f", rate))
+
+	m.mu.Lock()
+	var phases []string
+	for _, phase := range m.phases {
+		phases = append(phases, fmt.Sprintf(`,phase="%s"`, phase), fmt.Sprintf("%.3f", m.phase[phase]))
+	}
+	m.mu.Unlock()
+	metric("phase_duration_seconds", "gauge", "Duration of the finished phases of the run.", phases...)
+	return n, err
+}
+
+// serveMetrics serves the metrics on listen at /metrics until the returned stop is called.
+func serveMetrics(log *xlog.Log, listen string, m *Metrics) (func(), error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	})
+	return serveHTTP(log, "metrics", listen, mux)
+}
+
+// serveHTTP serves handler on listen until the returned stop is called,
+// stop waits for the in flight requests to finish.
+func serveHTTP(log *xlog.Log, name string, listen string, handler http.Handler) (func(), error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(l)
+	log.Info("%s.listen[%s]", name, l.Addr())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+// tickEvery calls fn every interval until the returned stop is called, stop
+// waits for the goroutine to return.
+func tickEvery(interval time.Duration, fn func()) func() {
+	tick := time.NewTicker(interval)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-tick.C:
+				fn()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		tick.Stop()
+		close(stop)
+		<-done
+	}
+}
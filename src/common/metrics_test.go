@@ -0,0 +1,125 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "info", "json")
+	assert.Nil(t, err)
+
+	pool := &Pool{conns: make(chan *Connection, 4)}
+	pool.conns <- &Connection{ID: 0}
+	var allbytes, allrows uint64 = 1024, 10
+	m := newMetrics(log, "dump", pool, &allbytes, &allrows)
+	assert.Equal(t, LogRunID(log), m.runID)
+
+	m.addFiles(3)
+	m.fileDone("test.t1.00001.sql")
+	m.fileDone("test.t1.00001.sql")
+	m.fileFailed("/tmp/test.t1.00001.sql", errors.New("mock.error"))
+	m.workerStarted()
+	m.retry(errors.New("mock.deadlock"))
+	m.phaseDone("schema", time.Now())
+
+	buf := &bytes.Buffer{}
+	_, err = m.WriteTo(buf)
+	assert.Nil(t, err)
+	got := buf.String()
+	labels := `{mode="dump",run_id="` + m.runID + `"`
+	for _, want := range []string{
+		"# TYPE go_mydumper_bytes_total counter",
+		"go_mydumper_bytes_total" + labels + "} 1024",
+		"go_mydumper_rows_total" + labels + "} 10",
+		"go_mydumper_files" + labels + "} 3",
+		"go_mydumper_files_completed_total" + labels + "} 2",
+		"go_mydumper_files_failed_total" + labels + "} 1",
+		"go_mydumper_active_workers" + labels + "} 1",
+		"go_mydumper_pool_connections" + labels + `,state="idle"} 1`,
+		"go_mydumper_pool_connections" + labels + `,state="busy"} 3`,
+		"go_mydumper_retries_total" + labels + "} 1",
+		"go_mydumper_phase_duration_seconds" + labels + `,phase="schema"}`,
+		"go_mydumper_rate_bytes_per_second" + labels + "}",
+	} {
+		assert.True(t, strings.Contains(got, want), want)
+	}
+
+	// The loader doesn't count rows.
+	{
+		m := newMetrics(xlog.NewStdLog(xlog.Level(xlog.ERROR)), "load", pool, &allbytes, nil)
+		assert.NotEqual(t, "", m.runID)
+		buf := &bytes.Buffer{}
+		m.WriteTo(buf)
+		assert.False(t, strings.Contains(buf.String(), "rows_total"))
+	}
+
+	// A nil *Metrics is a no-op.
+	{
+		var m *Metrics
+		m.fileDone("test.t1.00001.sql")
+		m.workerStarted()
+		m.phaseDone("data", time.Now())
+	}
+}
+
+func TestMetricsServe(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	pool := &Pool{conns: make(chan *Connection, 1)}
+	var allbytes uint64 = 42
+	m := newMetrics(log, "load", pool, &allbytes, nil)
+
+	address := "127.0.0.1:19104"
+	stop, err := serveMetrics(log, address, m)
+	assert.Nil(t, err)
+
+	resp, err := http.Get("http://" + address + "/metrics")
+	assert.Nil(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(body), `go_mydumper_bytes_total{mode="load",run_id="`+m.runID+`"} 42`))
+
+	// Shut down, the port is free again.
+	stop()
+	_, err = http.Get("http://" + address + "/metrics")
+	assert.NotNil(t, err)
+	stop, err = serveMetrics(log, address, m)
+	assert.Nil(t, err)
+	stop()
+}
+
+func TestMetricsTickEvery(t *testing.T) {
+	var n int32
+	goroutines := runtime.NumGoroutine()
+	stop := tickEvery(time.Millisecond, func() { atomic.AddInt32(&n, 1) })
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	ticks := atomic.LoadInt32(&n)
+	assert.True(t, ticks > 0)
+
+	// Nothing ticks after stop, the goroutine is gone.
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, ticks, atomic.LoadInt32(&n))
+	assert.True(t, runtime.NumGoroutine() <= goroutines)
+}
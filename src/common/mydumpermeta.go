@@ -0,0 +1,151 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// tableMetaSuffixes end the per-table metadata files of the C mydumper with
+// the rows of the table, 'db.table-metadata' of 0.10 and 0.11, or
+// 'db.table.metadata'. The loader never executes them.
+var tableMetaSuffixes = []string{"-metadata", ".metadata"}
+
+// metaSectionRegexp matches the section of a table in the metadata file of
+// the C mydumper 0.12 and later, like [`db`.`table`].
+var metaSectionRegexp = regexp.MustCompile("^\\[`((?:[^`]|``)+)`\\.`((?:[^`]|``)+)`\\]$")
+
+// tableMetaFile reports whether the file name is a per-table metadata file
+// of the C mydumper.
+func tableMetaFile(name string) bool {
+	base := filepath.Base(name)
+	for _, suffix := range tableMetaSuffixes {
+		if strings.HasSuffix(base, suffix) && strings.Count(strings.TrimSuffix(base, suffix), ".") == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// tableMetaName returns the 'db.table' of a per-table metadata file.
+func tableMetaName(name string) string {
+	base := filepath.Base(name)
+	for _, suffix := range tableMetaSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return strings.TrimSuffix(base, suffix)
+		}
+	}
+	return base
+}
+
+// parseTableMeta returns the rows of the content of a per-table metadata
+// file: the count alone, as 0.10 and 0.11 write it, or a 'rows = N' line.
+func parseTableMeta(data string) (uint64, bool) {
+	if n, err := strconv.ParseUint(strings.TrimSpace(data), 10, 64); err == nil {
+		return n, true
+	}
+	for _, line := range strings.Split(data, "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "rows" {
+			if n, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 64); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// parseMetaSections returns the rows of the tables by 'db.table' of the
+// sections of the content of a metadata file of the C mydumper 0.12 and
+// later, none for the 'Started dump at:' file of the older ones.
+func parseMetaSections(data string) map[string]uint64 {
+	rows := make(map[string]uint64)
+	table := ""
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			table = ""
+			if match := metaSectionRegexp.FindStringSubmatch(line); match != nil {
+				table = strings.Replace(match[1], "``", "`", -1) + "." + strings.Replace(match[2], "``", "`", -1)
+			}
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if table == "" || len(kv) != 2 || strings.TrimSpace(kv[0]) != "rows" {
+			continue
+		}
+		if n, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 10, 64); err == nil {
+			rows[table] = n
+		}
+	}
+	return rows
+}
+
+// mydumperRows returns the rows of the tables by 'db.table' the metadata
+// files of a dump of the C mydumper record, the per-table files of files and
+// the sections of the metadata file, the per-table file first. A dump of
+// go-mydumper has none, its rows are in manifest.json.
+func mydumperRows(log *xlog.Log, s Storage, files *Files) map[string]uint64 {
+	rows := make(map[string]uint64)
+	if data, err := readFile(s, metaFile); err == nil {
+		for table, n := range parseMetaSections(string(data)) {
+			rows[table] = n
+		}
+	}
+	for _, name := range files.metas {
+		data, err := readFile(s, name)
+		if err != nil {
+			log.Warning("restoring.mydumper.metadata[%s].read.error:%v", name, err)
+			continue
+		}
+		n, ok := parseTableMeta(string(data))
+		if !ok {
+			log.Warning("restoring.mydumper.metadata[%s].has.no.rows", name)
+			continue
+		}
+		rows[tableMetaName(name)] = n
+	}
+	return rows
+}
+
+// mydumperManifest returns a manifest of the rows of the tables the metadata
+// files of a dump of the C mydumper record, for LoadArgs.VerifyChecksums to
+// compare their COUNT(*): nil if they record none.
+func mydumperManifest(rows map[string]uint64) *Manifest {
+	if len(rows) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(rows))
+	for name := range rows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m := newManifest()
+	for _, name := range names {
+		db, table := splitTableName(name)
+		m.Tables = append(m.Tables, &ManifestTable{Database: db, Table: table, Stats: &TableStats{Rows: rows[name]}})
+	}
+	return m
+}
+
+// restoredRows returns the sum of the rows of the restored schemas.
+func restoredRows(rows map[string]uint64, schemas []string) uint64 {
+	var total uint64
+	for _, schema := range schemas {
+		total += rows[strings.TrimSuffix(filepath.Base(schema), schemaSuffix)]
+	}
+	return total
+}
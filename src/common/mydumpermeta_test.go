@@ -0,0 +1,93 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableMetaFile(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		want bool
+	}{
+		{"shop.orders-metadata", true},
+		{"shop.orders.metadata", true},
+		{"metadata", false},
+		{"metadata.partial", false},
+		{"shop.orders.00000.sql", false},
+		{"shop.metadata.sql", false},
+		{"shop-schema-create.sql", false},
+	} {
+		assert.Equal(t, tc.want, tableMetaFile(tc.name), tc.name)
+	}
+	assert.Equal(t, "shop.orders", tableMetaName("shop.orders-metadata"))
+
+	n, ok := parseTableMeta("1024")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1024), n)
+	n, ok = parseTableMeta("real_table_name=t\nrows = 7\n")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), n)
+	_, ok = parseTableMeta("garbage")
+	assert.False(t, ok)
+
+	rows := parseMetaSections("[config]\nrows = 9\n[`a``b`.`t`]\nrows = 5\n[source]\nFile = mysql-bin.000001\n")
+	assert.Equal(t, map[string]uint64{"a`b.t": 5}, rows)
+	assert.Equal(t, 0, len(parseMetaSections("Started dump at: 2021-03-04 10:21:36\n")))
+}
+
+// The dumps of testdata are laid out as the C mydumper writes them: 0.11 has
+// the 'Started dump at:' metadata file and a '-metadata' file per table, 0.15
+// the rows of the tables in the sections of its metadata file.
+func TestMydumperMetadata(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	for _, dir := range []string{"testdata/mydumper-0.11", "testdata/mydumper-0.15"} {
+		s, err := OpenStorage(dir)
+		assert.Nil(t, err)
+		files, err := loadFiles(s)
+		assert.Nil(t, err)
+		// The metadata files are never restored.
+		sort.Strings(files.tables)
+		assert.Equal(t, 2, len(files.tables), dir)
+		for _, table := range files.tables {
+			assert.False(t, tableMetaFile(table), table)
+		}
+		assert.Nil(t, checkTableFiles(files))
+		assert.Equal(t, 2, len(files.schemas), dir)
+
+		rows := mydumperRows(log, s, files)
+		assert.Equal(t, map[string]uint64{"shop.orders": 3, "shop.customers": 2}, rows, dir)
+		assert.Equal(t, uint64(5), restoredRows(rows, files.schemas), dir)
+		assert.Equal(t, uint64(3), restoredRows(rows, []string{"shop.orders-schema.sql"}), dir)
+
+		m := mydumperManifest(rows)
+		assert.Equal(t, 2, len(m.Tables))
+		assert.Equal(t, "customers", m.Tables[0].Table)
+		assert.Equal(t, uint64(2), m.Tables[0].Stats.Rows)
+		assert.Equal(t, "", verifyMethod(&ManifestTable{}, "InnoDB"))
+		assert.Equal(t, verifyCount, verifyMethod(m.Tables[0], "InnoDB"))
+	}
+	assert.Equal(t, 2, len(mustLoadFiles(t, "testdata/mydumper-0.11").metas))
+	assert.Equal(t, 0, len(mustLoadFiles(t, "testdata/mydumper-0.15").metas))
+	assert.Nil(t, mydumperManifest(nil))
+}
+
+func mustLoadFiles(t *testing.T, dir string) *Files {
+	s, err := OpenStorage(dir)
+	assert.Nil(t, err)
+	files, err := loadFiles(s)
+	assert.Nil(t, err)
+	return files
+}
@@ -0,0 +1,71 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fileLimitStorage bounds the files of a storage open at once for reading,
+// see LoadArgs.MaxOpenFiles: Open waits for a free slot, the Close of the file
+// frees it.
+type fileLimitStorage struct {
+	Storage
+	slots chan struct{}
+	// waited is the time Open waited for a slot, in nanoseconds.
+	waited int64
+}
+
+// limitOpenFiles bounds the files of s open at once to max, s is returned as
+// it is if max is less than 1.
+func limitOpenFiles(s Storage, max int) Storage {
+	if max < 1 {
+		return s
+	}
+	return &fileLimitStorage{Storage: s, slots: make(chan struct{}, max)}
+}
+
+// Open waits for a slot and opens the file, the slot is freed if it fails.
+func (s *fileLimitStorage) Open(name string) (io.ReadCloser, error) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		start := time.Now()
+		s.slots <- struct{}{}
+		atomic.AddInt64(&s.waited, int64(time.Since(start)))
+	}
+	r, err := s.Storage.Open(name)
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	return &limitedFile{ReadCloser: r, slots: s.slots}, nil
+}
+
+// waitedFor returns the time the readers waited for a slot.
+func (s *fileLimitStorage) waitedFor() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.waited))
+}
+
+// limitedFile is a file of a fileLimitStorage, its first Close frees its slot.
+type limitedFile struct {
+	io.ReadCloser
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (f *limitedFile) Close() error {
+	err := f.ReadCloser.Close()
+	f.once.Do(func() { <-f.slots })
+	return err
+}
@@ -0,0 +1,111 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingStorage counts the files open at once and keeps the peak.
+type countingStorage struct {
+	Storage
+	open int64
+	peak int64
+}
+
+func (s *countingStorage) Open(name string) (io.ReadCloser, error) {
+	r, err := s.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	n := atomic.AddInt64(&s.open, 1)
+	for {
+		peak := atomic.LoadInt64(&s.peak)
+		if n <= peak || atomic.CompareAndSwapInt64(&s.peak, peak, n) {
+			break
+		}
+	}
+	// Hold the file a bit, so the readers overlap.
+	time.Sleep(time.Millisecond)
+	return &countingFile{ReadCloser: r, open: &s.open}, nil
+}
+
+type countingFile struct {
+	io.ReadCloser
+	open *int64
+}
+
+func (f *countingFile) Close() error {
+	atomic.AddInt64(f.open, -1)
+	return f.ReadCloser.Close()
+}
+
+func TestLimitOpenFiles(t *testing.T) {
+	dir := "/tmp/limitopenfiles"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for i := 1; i <= 200; i++ {
+		x := WriteFile(fmt.Sprintf("%s/test.t1.%05d.sql", dir, i), "INSERT INTO `t1` VALUES (1);\n")
+		AssertNil(x)
+	}
+
+	// 32 readers, at most 4 files open at once, all closed once read.
+	{
+		counting := &countingStorage{Storage: NewDirStorage(dir)}
+		s := limitOpenFiles(counting, 4)
+		var wg sync.WaitGroup
+		ch := make(chan string)
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for name := range ch {
+					data, err := readFile(s, name)
+					assert.Nil(t, err)
+					assert.Equal(t, "INSERT INTO `t1` VALUES (1);\n", string(data))
+				}
+			}()
+		}
+		for i := 1; i <= 200; i++ {
+			ch <- fmt.Sprintf("test.t1.%05d.sql", i)
+		}
+		close(ch)
+		wg.Wait()
+		assert.True(t, counting.peak <= 4, "peak %d", counting.peak)
+		assert.Equal(t, int64(0), counting.open)
+		assert.True(t, s.(*fileLimitStorage).waitedFor() > 0)
+	}
+
+	// A failed open frees its slot.
+	{
+		s := limitOpenFiles(NewDirStorage(dir), 1)
+		for i := 0; i < 3; i++ {
+			_, err := readFile(s, "test.missing.00001.sql")
+			assert.True(t, os.IsNotExist(err))
+		}
+		_, err := readFile(s, "test.t1.00001.sql")
+		assert.Nil(t, err)
+	}
+
+	// No bound.
+	{
+		s := NewDirStorage(dir)
+		assert.Equal(t, s, limitOpenFiles(s, 0))
+	}
+}
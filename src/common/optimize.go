@@ -0,0 +1,124 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+const (
+	// optimizePhase is the phase of a load rebuilding LoadArgs.OptimizeTables,
+	// it can be skipped while it runs, see Metrics.skipPhase.
+	optimizePhase = "optimize"
+	// OptimizeAll as the only LoadArgs.OptimizeTables rebuilds every restored
+	// table.
+	OptimizeAll = "all"
+)
+
+// optimizeQuery returns the statement rebuilding the restored table db.table
+// of the create table statement schema and whether it returns rows: an
+// InnoDB table, the default engine, is rebuilt by an ALTER TABLE FORCE, the
+// others by an OPTIMIZE TABLE.
+func optimizeQuery(args *LoadArgs, db string, table string, schema string) (string, bool) {
+	engine := args.ForceEngine
+	if engine == "" {
+		if match := engineOptionRegexp.FindStringSubmatch(tableOptions(schema)); match != nil {
+			engine = match[1]
+		}
+	}
+	if engine == "" || strings.EqualFold(engine, "InnoDB") {
+		return fmt.Sprintf("ALTER TABLE `%s`.`%s` FORCE", db, table), false
+	}
+	return fmt.Sprintf("OPTIMIZE TABLE `%s`.`%s`", db, table), true
+}
+
+// optimizeTable rebuilds a restored table, an OPTIMIZE TABLE fails with the
+// text of its first error row.
+func optimizeTable(conn *Connection, args *LoadArgs, schema *schemaFile) error {
+	query, rows := optimizeQuery(args, schema.db, args.targetTable(schema.table), schema.sql)
+	if !rows {
+		return conn.Execute(query)
+	}
+	qr, err := conn.Fetch(query)
+	if err != nil {
+		return err
+	}
+	for _, row := range qr.Rows {
+		if len(row) >= 4 && strings.EqualFold(row[2].String(), "error") {
+			return fmt.Errorf("%s", row[3].String())
+		}
+	}
+	return nil
+}
+
+// optimizeTables rebuilds the tables of args.OptimizeTables once the restore
+// is done, in their order, with args.OptimizeThreads connections of the pool,
+// on the machinery of the warm-up, see forEachTable. A rebuild is best effort:
+// a table not in the dump or a failed rebuild is a warning, the failed tables
+// are in the report. Once the phase is skipped no table is started and the
+// connections are closed, which kills the rebuilds running.
+func optimizeTables(ctx context.Context, log *xlog.Log, pool *Pool, args *LoadArgs, schemas []string) error {
+	tables, err := restoredSchemas(log, args, optimizePhase, schemas, args.OptimizeTables)
+	if err != nil {
+		return err
+	}
+	skip := args.metrics.skipped(optimizePhase)
+	optimizeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-skip:
+			log.Warning("restoring.optimize.skipped")
+			cancel()
+		case <-optimizeCtx.Done():
+		}
+	}()
+
+	forEachTable(optimizeCtx, pool, args, optimizePhase, args.OptimizeThreads, tables, func(conn *Connection, schema *schemaFile) {
+		select {
+		case <-skip:
+			return
+		default:
+		}
+		if optimizeCtx.Err() != nil {
+			return
+		}
+		start := time.Now()
+		err := optimizeTable(conn, args, schema)
+		switch {
+		case optimizeCtx.Err() != nil:
+		case err != nil:
+			args.metrics.optimizeFailed(schema.key())
+			log.Warning("restoring.optimize.table[%s].error:%v", schema.key(), err)
+		default:
+			args.metrics.optimizeDone(schema.key(), time.Since(start))
+			log.Info("restoring.optimize.table[%s].done.cost[%.2fsec]", schema.key(), time.Since(start).Seconds())
+		}
+	})
+	return ctx.Err()
+}
+
+// logOptimizeSummary logs the summary line of the rebuilds of a load, none if
+// it rebuilt nothing.
+func logOptimizeSummary(log *xlog.Log, action string, seconds map[string]float64, failed []string) {
+	if len(seconds) == 0 && len(failed) == 0 {
+		return
+	}
+	var cost float64
+	for _, s := range seconds {
+		cost += s
+	}
+	logSummary(log, "%s.optimize.tables[%d].cost[%.2fsec].failed[%d]", action, len(seconds), cost, len(failed))
+}
@@ -0,0 +1,145 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimizeQuery(t *testing.T) {
+	tests := []struct {
+		schema string
+		force  string
+		query  string
+		rows   bool
+	}{
+		{"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8", "", "ALTER TABLE `db`.`t1` FORCE", false},
+		{"CREATE TABLE `t1` (`a` int) engine = innodb", "", "ALTER TABLE `db`.`t1` FORCE", false},
+		{"CREATE TABLE `t1` (`a` int)", "", "ALTER TABLE `db`.`t1` FORCE", false},
+		{"CREATE TABLE `t1` (`a` int) ENGINE=MyISAM", "", "OPTIMIZE TABLE `db`.`t1`", true},
+		{"CREATE TABLE `t1` (`a` int) ENGINE=MyISAM", "InnoDB", "ALTER TABLE `db`.`t1` FORCE", false},
+		{"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB", "Aria", "OPTIMIZE TABLE `db`.`t1`", true},
+		// An ENGINE in a comment of a column isn't the engine of the table.
+		{"CREATE TABLE `t1` (`a` int COMMENT 'ENGINE=MyISAM')", "", "ALTER TABLE `db`.`t1` FORCE", false},
+	}
+	for _, test := range tests {
+		args := &LoadArgs{ForceEngine: test.force}
+		query, rows := optimizeQuery(args, "db", "t1", test.schema)
+		assert.Equal(t, test.query, query, test.schema)
+		assert.Equal(t, test.rows, rows, test.schema)
+	}
+}
+
+func TestLoaderOptimizeTables(t *testing.T) {
+	dir := "/tmp/loaderoptimize"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	files := map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (`a` int) ENGINE=MyISAM;\n",
+		"test.t3-schema.sql":     "CREATE TABLE `t3` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\n",
+		"test.t2.00001.sql":      "INSERT INTO `t2` VALUES (1);\n",
+		"test.t3.00001.sql":      "INSERT INTO `t3` VALUES (1);\n",
+	}
+	for name, sql := range files {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 4, IntervalMs: 1000}
+	optimizeResult := func(msgType string, msgText string) *sqltypes.Result {
+		var fields []*querypb.Field
+		for _, name := range []string{"Table", "Op", "Msg_type", "Msg_text"} {
+			fields = append(fields, &querypb.Field{Name: name, Type: querypb.Type_VARCHAR})
+		}
+		var row []sqltypes.Value
+		for _, v := range []string{"test.t2", "optimize", msgType, msgText} {
+			row = append(row, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+		}
+		return &sqltypes.Result{Fields: fields, Rows: [][]sqltypes.Value{row}}
+	}
+
+	// The listed tables are rebuilt in their order after the datas, the ones
+	// not in the dump are a warning.
+	{
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"OPTIMIZE TABLE `test`.`t2`": optimizeResult("status", "OK")}}
+		args := args
+		args.OptimizeTables = []string{"test.t2", "test.t9", "test.t1"}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		rebuilds := append(matchingQueries(rec.queries, "OPTIMIZE"), matchingQueries(rec.queries, "ALTER")...)
+		assert.Equal(t, []string{"OPTIMIZE TABLE `test`.`t2`", "ALTER TABLE `test`.`t1` FORCE"}, rebuilds)
+		assert.Equal(t, 2, len(report.OptimizeSeconds))
+		assert.Nil(t, report.OptimizeFailed)
+		_, ok := report.PhaseSeconds[optimizePhase]
+		assert.True(t, ok)
+		last := rec.queries[len(rec.queries)-1]
+		assert.Equal(t, "ALTER TABLE `test`.`t1` FORCE", last)
+	}
+
+	// All the restored tables, the failed rebuilds are in the report.
+	{
+		rec := &recordingExecutor{
+			results: map[string]*sqltypes.Result{"OPTIMIZE TABLE `test`.`t2`": optimizeResult("error", "Table is marked as crashed")},
+			errs:    map[string]error{"ALTER TABLE `test`.`t3` FORCE": sqldb.NewSQLError(1114, "The table 't3' is full")},
+		}
+		args := args
+		args.OptimizeTables = []string{OptimizeAll}
+		args.OptimizeThreads = 8
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		assert.Equal(t, 3, len(matchingQueries(rec.queries, "OPTIMIZE"))+len(matchingQueries(rec.queries, "ALTER")))
+		_, ok := report.OptimizeSeconds["test.t1"]
+		assert.True(t, ok)
+		assert.Equal(t, 1, len(report.OptimizeSeconds))
+		sort.Strings(report.OptimizeFailed)
+		assert.Equal(t, []string{"test.t2", "test.t3"}, report.OptimizeFailed)
+	}
+
+	// A filter only rebuilds the restored tables.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.Filter = "table = t3"
+		args.OptimizeTables = []string{"test.t1", "test.t3"}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"ALTER TABLE `test`.`t3` FORCE"}, matchingQueries(rec.queries, "ALTER"))
+	}
+
+	// Skipped before it starts, nothing is rebuilt.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.OptimizeTables = []string{OptimizeAll}
+		args.metrics = newMetrics(log, "load", nil, new(uint64), nil)
+		args.metrics.skipPhase(optimizePhase)
+		pool, err := NewExecutorPool(log, 2, rec.executor)
+		assert.Nil(t, err)
+		defer pool.Close()
+		err = optimizeTables(context.Background(), log, pool, &args, []string{dir + "/test.t1-schema.sql"})
+		assert.Nil(t, err)
+		assert.Nil(t, matchingQueries(rec.queries, "ALTER"))
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"strings"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+// ParanoidCheck compares the rows of the data files of a table with the
+// table read again in the snapshot of the dump, see DumpArgs.Paranoid.
+type ParanoidCheck struct {
+	// Key are the columns of the primary key the sums are of the CRC32 of,
+	// none if the table has none: only the rows are compared.
+	Key []string `json:"key,omitempty"`
+	// Chunks, ChunkRows and ChunkSum are the data files and what their rows
+	// add up to, counted while they were written.
+	Chunks    int    `json:"chunks"`
+	ChunkRows uint64 `json:"chunk_rows"`
+	ChunkSum  uint64 `json:"chunk_sum"`
+	// TableRows and TableSum are the COUNT(*) and the SUM(CRC32(key)) of the table.
+	TableRows uint64 `json:"table_rows"`
+	TableSum  uint64 `json:"table_sum"`
+	Match     bool   `json:"match"`
+}
+
+// paranoidKey is the primary key of a table dumped with DumpArgs.Paranoid.
+type paranoidKey struct {
+	names []string
+	// indexes are the ones of the columns in the rows.
+	indexes []int
+	// expr is the SQL of the CRC32 of the key, the same as crc: the columns
+	// joined with commas, the strings converted to the utf8 the rows are read in.
+	expr string
+}
+
+// newParanoidKey returns the primary key of the create statement schema
+// among the fields of the rows, nil if the table has none.
+func newParanoidKey(schema string, fields []*querypb.Field) *paranoidKey {
+	var quoted []string
+	for _, def := range tableDefinitions(schema) {
+		if name, attrs, ok := columnDefinition(def); ok {
+			if inlinePrimaryKeyRegexp.MatchString(attrs) {
+				quoted = append(quoted, name)
+			}
+			continue
+		}
+		if match := primaryKeyRegexp.FindStringSubmatch(def); match != nil {
+			quoted = append(quoted, quotedNameRegexp.FindAllString(match[1], -1)...)
+		}
+	}
+	if len(quoted) == 0 {
+		return nil
+	}
+	k := &paranoidKey{}
+	var exprs []string
+	for _, q := range quoted {
+		name := unquoteIdentifier(q)
+		index := -1
+		for i, f := range fields {
+			if f.Name == name {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return nil
+		}
+		k.names = append(k.names, name)
+		k.indexes = append(k.indexes, index)
+		if sqltypes.MakeTrusted(fields[index].Type, nil).IsText() {
+			exprs = append(exprs, fmt.Sprintf("CONVERT(%s USING utf8)", q))
+		} else {
+			exprs = append(exprs, q)
+		}
+	}
+	if len(exprs) == 1 {
+		k.expr = fmt.Sprintf("CRC32(%s)", exprs[0])
+	} else {
+		k.expr = fmt.Sprintf("CRC32(CONCAT_WS(',', %s))", strings.Join(exprs, ", "))
+	}
+	return k
+}
+
+// crc returns the CRC32 of the key of the row.
+func (k *paranoidKey) crc(row []sqltypes.Value) uint64 {
+	if len(k.indexes) == 1 {
+		return uint64(crc32.ChecksumIEEE(row[k.indexes[0]].Raw()))
+	}
+	parts := make([][]byte, 0, len(k.indexes))
+	for _, i := range k.indexes {
+		parts = append(parts, row[i].Raw())
+	}
+	return uint64(crc32.ChecksumIEEE(bytes.Join(parts, []byte(","))))
+}
+
+// paranoidSums are the rows and the sum of the CRC32 of their keys of the
+// data files of a table, added up chunk by chunk as the rows are written:
+// the rows of a chunk count once the chunk is, so a row lost between two
+// chunks is missing from them.
+type paranoidSums struct {
+	key *paranoidKey
+	// rows and sum are the ones of the chunk being written.
+	rows uint64
+	sum  uint64
+	// chunks, chunkRows and chunkSum are the ones of the chunks written.
+	chunks    int
+	chunkRows uint64
+	chunkSum  uint64
+}
+
+func newParanoidSums(schema string, fields []*querypb.Field) *paranoidSums {
+	return &paranoidSums{key: newParanoidKey(schema, fields)}
+}
+
+// add counts a row written to the chunk.
+func (p *paranoidSums) add(row []sqltypes.Value) {
+	if p == nil {
+		return
+	}
+	p.rows++
+	if p.key != nil {
+		p.sum += p.key.crc(row)
+	}
+}
+
+// endChunk adds the chunk written to the chunks.
+func (p *paranoidSums) endChunk() {
+	if p == nil {
+		return
+	}
+	p.chunks++
+	p.chunkRows += p.rows
+	p.chunkSum += p.sum
+	p.rows, p.sum = 0, 0
+}
+
+// merge adds the chunks of q, of another key range of the table.
+func (p *paranoidSums) merge(q *paranoidSums) {
+	p.chunks += q.chunks
+	p.chunkRows += q.chunkRows
+	p.chunkSum += q.chunkSum
+}
+
+// check reads the COUNT(*) and the SUM(CRC32(key)) of the table on conn, in
+// the snapshot the rows were read in, with the same partitions and WHERE, and
+// compares them with the chunks.
+func (p *paranoidSums) check(conn *Connection, args *DumpArgs, table string) (*ParanoidCheck, error) {
+	selects := "COUNT(*)"
+	if p.key != nil {
+		selects += fmt.Sprintf(", SUM(%s)", p.key.expr)
+	}
+	query := fmt.Sprintf("SELECT %s FROM `%s`.`%s`", selects, args.Database, table) + partitionClause(args.tablePartitions(table))
+	if where := args.rowsWhere(table); where != "" {
+		query += " WHERE " + where
+	}
+	qr, err := conn.Fetch(query)
+	if err != nil {
+		return nil, wrapf(err, "dumping.table[%s.%s].paranoid.check.error:%v", args.Database, table, err)
+	}
+	c := &ParanoidCheck{Chunks: p.chunks, ChunkRows: p.chunkRows, ChunkSum: p.chunkSum}
+	if p.key != nil {
+		c.Key = p.key.names
+	}
+	if len(qr.Rows) > 0 && len(qr.Rows[0]) > 0 {
+		row := qr.Rows[0]
+		c.TableRows, _ = strconv.ParseUint(row[0].String(), 10, 64)
+		if len(row) > 1 {
+			// The SUM of no rows is NULL.
+			c.TableSum, _ = strconv.ParseUint(row[1].String(), 10, 64)
+		}
+	}
+	c.Match = c.ChunkRows == c.TableRows && c.ChunkSum == c.TableSum
+	return c, nil
+}
@@ -0,0 +1,126 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"hash/crc32"
+	"strconv"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParanoidKey(t *testing.T) {
+	fields := []*querypb.Field{
+		{Name: "id", Type: querypb.Type_INT32},
+		{Name: "name", Type: querypb.Type_VARCHAR},
+		{Name: "region", Type: querypb.Type_INT32},
+	}
+	row := []sqltypes.Value{
+		sqltypes.MakeTrusted(querypb.Type_INT32, []byte("7")),
+		sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("bob")),
+		sqltypes.MakeTrusted(querypb.Type_INT32, []byte("2")),
+	}
+
+	// A primary key of a column.
+	{
+		k := newParanoidKey("CREATE TABLE `t1` (\n  `id` int NOT NULL PRIMARY KEY,\n  `name` varchar(8)\n) ENGINE=InnoDB", fields)
+		assert.Equal(t, []string{"id"}, k.names)
+		assert.Equal(t, "CRC32(`id`)", k.expr)
+		assert.Equal(t, uint64(crc32.ChecksumIEEE([]byte("7"))), k.crc(row))
+	}
+
+	// A composite one, the strings converted.
+	{
+		k := newParanoidKey("CREATE TABLE `t1` (\n  `id` int NOT NULL,\n  `name` varchar(8),\n  `region` int,\n  PRIMARY KEY (`region`,`name`)\n) ENGINE=InnoDB", fields)
+		assert.Equal(t, []string{"region", "name"}, k.names)
+		assert.Equal(t, "CRC32(CONCAT_WS(',', `region`, CONVERT(`name` USING utf8)))", k.expr)
+		assert.Equal(t, uint64(crc32.ChecksumIEEE([]byte("2,bob"))), k.crc(row))
+	}
+
+	// None without a primary key, or with one not among the fields.
+	{
+		assert.Nil(t, newParanoidKey("CREATE TABLE `t1` (\n  `id` int,\n  KEY `k` (`id`)\n) ENGINE=InnoDB", fields))
+		assert.Nil(t, newParanoidKey("CREATE TABLE `t1` (\n  `uuid` int NOT NULL,\n  PRIMARY KEY (`uuid`)\n) ENGINE=InnoDB", fields))
+	}
+}
+
+func TestParanoidSums(t *testing.T) {
+	fields := []*querypb.Field{{Name: "id", Type: querypb.Type_INT32}}
+	schema := "CREATE TABLE `t1` (\n  `id` int NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB"
+	row := func(id string) []sqltypes.Value {
+		return []sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_INT32, []byte(id))}
+	}
+	crc := func(id string) uint64 { return uint64(crc32.ChecksumIEEE([]byte(id))) }
+
+	// The rows count once their chunk is written.
+	p := newParanoidSums(schema, fields)
+	p.add(row("1"))
+	p.add(row("2"))
+	p.endChunk()
+	p.add(row("3"))
+	p.endChunk()
+	p.add(row("4"))
+	assert.Equal(t, 2, p.chunks)
+	assert.Equal(t, uint64(3), p.chunkRows)
+	assert.Equal(t, crc("1")+crc("2")+crc("3"), p.chunkSum)
+
+	// Nil sums, of a dump without -paranoid, count nothing.
+	var none *paranoidSums
+	none.add(row("1"))
+	none.endChunk()
+
+	args := &DumpArgs{Database: "shop", Partitions: map[string][]string{"shop.t1": {"p0", "p1"}}}
+	query := "SELECT COUNT(*), SUM(CRC32(`id`)) FROM `shop`.`t1` PARTITION (`p0`,`p1`)"
+
+	// The table matches the chunks.
+	{
+		sum := crc("1") + crc("2") + crc("3")
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			query: intsResult([]string{"COUNT(*)", "SUM"}, []string{"3", strconv.FormatUint(sum, 10)}),
+		}}
+		conn := &Connection{exec: &recordingConn{r: rec}}
+		c, err := p.check(conn, args, "t1")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{query}, rec.queries)
+		assert.Equal(t, []string{"id"}, c.Key)
+		assert.Equal(t, uint64(3), c.TableRows)
+		assert.Equal(t, sum, c.TableSum)
+		assert.True(t, c.Match)
+	}
+
+	// A row missing from the chunks doesn't.
+	{
+		sum := crc("1") + crc("2") + crc("3") + crc("4")
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			query: intsResult([]string{"COUNT(*)", "SUM"}, []string{"4", strconv.FormatUint(sum, 10)}),
+		}}
+		c, err := p.check(&Connection{exec: &recordingConn{r: rec}}, args, "t1")
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(4), c.TableRows)
+		assert.False(t, c.Match)
+	}
+
+	// An empty table, without a key: the SUM of no rows is NULL.
+	{
+		empty := newParanoidSums("CREATE TABLE `t2` (\n  `id` int\n) ENGINE=InnoDB", fields)
+		empty.endChunk()
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			"SELECT COUNT(*) FROM `shop`.`t2`": intsResult([]string{"COUNT(*)"}, []string{"0"}),
+		}}
+		c, err := empty.check(&Connection{exec: &recordingConn{r: rec}}, args, "t2")
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"SELECT COUNT(*) FROM `shop`.`t2`"}, rec.queries)
+		assert.Nil(t, c.Key)
+		assert.True(t, c.Match)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// metaPartitions starts the metadata line of a table dumped with
+// DumpArgs.Partitions, like 'Partitions of db.t1: p202401,p202402'.
+const metaPartitions = "Partitions of"
+
+// tablePartitions returns the DumpArgs.Partitions of a table of the dumped
+// database, none if all of it is dumped.
+func (args *DumpArgs) tablePartitions(table string) []string {
+	return args.Partitions[args.Database+"."+table]
+}
+
+// partitionTables returns the 'db.table' names of the DumpArgs.Partitions,
+// sorted.
+func (args *DumpArgs) partitionTables() []string {
+	names := make([]string, 0, len(args.Partitions))
+	for name := range args.Partitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// partitionClause returns the PARTITION clause selecting the partitions, or
+// subpartitions, names of a table, empty for none.
+func partitionClause(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, "`"+name+"`")
+	}
+	return " PARTITION (" + strings.Join(quoted, ",") + ")"
+}
+
+// checkPartitions checks the DumpArgs.Partitions against the partitions and
+// subpartitions of information_schema.PARTITIONS, before anything is dumped:
+// a table which doesn't exist or isn't partitioned, or a partition it
+// doesn't have, fails the dump.
+func checkPartitions(log *xlog.Log, conn *Connection, args *DumpArgs) error {
+	for _, name := range args.partitionTables() {
+		db, table := splitTableName(name)
+		qr, err := conn.Fetch(fmt.Sprintf("SELECT PARTITION_NAME, SUBPARTITION_NAME FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s'",
+			EscapeBytes([]byte(db)), EscapeBytes([]byte(table))))
+		if err != nil {
+			return err
+		}
+		if len(qr.Rows) == 0 {
+			return fmt.Errorf("dumping.partitions.table[%s].does.not.exist", name)
+		}
+		known := make(map[string]bool)
+		var partitions []string
+		for _, row := range qr.Rows {
+			for _, v := range row {
+				if v.Raw() == nil || known[v.String()] {
+					continue
+				}
+				known[v.String()] = true
+				partitions = append(partitions, v.String())
+			}
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("dumping.partitions.table[%s].is.not.partitioned", name)
+		}
+		var unknown []string
+		for _, p := range args.Partitions[name] {
+			if !known[p] {
+				unknown = append(unknown, p)
+			}
+		}
+		if len(unknown) > 0 {
+			return fmt.Errorf("dumping.partitions.table[%s].unknown.partitions[%s].the.table.has[%s]", name, strings.Join(unknown, ","), strings.Join(partitions, ","))
+		}
+		log.Info("dumping.partitions.table[%s].partitions[%s/%d]", name, strings.Join(args.Partitions[name], ","), len(partitions))
+	}
+	return nil
+}
+
+// splitTableName splits a 'db.table' name at its first dot.
+func splitTableName(name string) (string, string) {
+	splits := strings.SplitN(name, ".", 2)
+	if len(splits) != 2 {
+		return name, ""
+	}
+	return splits[0], splits[1]
+}
+
+// partitionsMetaData returns the metadata lines of the DumpArgs.Partitions,
+// one per table.
+func partitionsMetaData(args *DumpArgs) string {
+	var lines string
+	for _, name := range args.partitionTables() {
+		lines += fmt.Sprintf("%s %s: %s\n", metaPartitions, name, strings.Join(args.Partitions[name], ","))
+	}
+	return lines
+}
+
+// checkDumpPartitions warns about the tables of the dump the manifest
+// records as dumped with DumpArgs.Partitions: only the rows of these
+// partitions are restored, the schema is the whole table's.
+func checkDumpPartitions(log *xlog.Log, s Storage) {
+	m, err := readManifest(s)
+	if err != nil {
+		return
+	}
+	for _, t := range m.Tables {
+		if len(t.Partitions) > 0 {
+			log.Warning("restoring.table[%s.%s].dumped.partitions.only[%s],the.other.partitions.are.restored.empty", t.Database, t.Table, strings.Join(t.Partitions, ","))
+		}
+	}
+}
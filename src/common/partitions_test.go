@@ -0,0 +1,101 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionClause(t *testing.T) {
+	assert.Equal(t, "", partitionClause(nil))
+	assert.Equal(t, " PARTITION (`p202401`)", partitionClause([]string{"p202401"}))
+	assert.Equal(t, " PARTITION (`p202401`,`p202402sp0`)", partitionClause([]string{"p202401", "p202402sp0"}))
+}
+
+func TestCheckPartitions(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	partitionsResult := func(rows ...[]string) *sqltypes.Result {
+		qr := &sqltypes.Result{Fields: []*querypb.Field{
+			{Name: "PARTITION_NAME", Type: querypb.Type_VARCHAR},
+			{Name: "SUBPARTITION_NAME", Type: querypb.Type_VARCHAR},
+		}}
+		for _, row := range rows {
+			var values []sqltypes.Value
+			for _, v := range row {
+				if v == "" {
+					values = append(values, sqltypes.NULL)
+					continue
+				}
+				values = append(values, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+			}
+			qr.Rows = append(qr.Rows, values)
+		}
+		return qr
+	}
+	query := func(table string) string {
+		return "SELECT PARTITION_NAME, SUBPARTITION_NAME FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA='test' AND TABLE_NAME='" + table + "'"
+	}
+	rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+		query("facts"):  partitionsResult([]string{"p202401", "p202401sp0"}, []string{"p202401", "p202401sp1"}, []string{"p202402", "p202402sp0"}),
+		query("plain"):  partitionsResult([]string{"", ""}),
+		query("gone"):   partitionsResult(),
+		query("events"): partitionsResult([]string{"p0", ""}, []string{"p1", ""}),
+	}}
+	pool, err := NewExecutorPool(log, 1, rec.executor)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	tests := []struct {
+		partitions map[string][]string
+		err        string
+	}{
+		{map[string][]string{"test.facts": {"p202402", "p202401sp1"}, "test.events": {"p1"}}, ""},
+		{map[string][]string{"test.facts": {"p202401", "p202403"}}, "dumping.partitions.table[test.facts].unknown.partitions[p202403].the.table.has[p202401,p202401sp0,p202401sp1,p202402,p202402sp0]"},
+		{map[string][]string{"test.plain": {"p0"}}, "dumping.partitions.table[test.plain].is.not.partitioned"},
+		{map[string][]string{"test.gone": {"p0"}}, "dumping.partitions.table[test.gone].does.not.exist"},
+	}
+	for _, test := range tests {
+		args := &DumpArgs{Database: "test", Partitions: test.partitions}
+		err := checkPartitions(log, conn, args)
+		if test.err == "" {
+			assert.Nil(t, err)
+			continue
+		}
+		assert.NotNil(t, err)
+		assert.Equal(t, test.err, err.Error())
+	}
+}
+
+func TestPartitionsMetaData(t *testing.T) {
+	args := &DumpArgs{Database: "test", Partitions: map[string][]string{"test.t2": {"p1"}, "test.t1": {"p202401", "p202402"}}}
+	assert.Equal(t, "Partitions of test.t1: p202401,p202402\nPartitions of test.t2: p1\n", partitionsMetaData(args))
+	assert.Equal(t, []string{"p202401", "p202402"}, args.tablePartitions("t1"))
+	assert.Nil(t, args.tablePartitions("t3"))
+
+	dir := "/tmp/partitionsmetadata"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	storage, err := OpenStorage(dir)
+	assert.Nil(t, err)
+	args.storage = storage
+	assert.Nil(t, writeMetaData(args))
+	meta := readMetaData(storage)
+	assert.Equal(t, Version, meta[metaVersion])
+	assert.Equal(t, "p202401,p202402", meta[metaPartitions+" test.t1"])
+}
@@ -0,0 +1,118 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// PasswordEnv is our own password environment variable, preferred over MYSQL_PWD.
+	PasswordEnv = "GO_MYDUMPER_PASSWORD"
+	// MySQLPasswordEnv is the mysql client compatible password environment variable.
+	MySQLPasswordEnv = "MYSQL_PWD"
+)
+
+// PasswordOptions holds every place a password may come from.
+// The sources are tried in this order, the first non-empty one wins:
+//  1. Flag: the -p command line value
+//  2. File: the first line of -password-file, which must be mode 0600 (or stricter)
+//  3. Ask: an interactive hidden prompt, only if -ask-password is set and stdin is a TTY
+//  4. the GO_MYDUMPER_PASSWORD environment variable
+//  5. the MYSQL_PWD environment variable
+type PasswordOptions struct {
+	Flag string
+	File string
+	Ask  bool
+}
+
+// ResolvePassword returns the password and a description of the source it came from.
+// The source is safe to log, the password never is.
+func ResolvePassword(opts *PasswordOptions) (string, string, error) {
+	if opts.Flag != "" {
+		return opts.Flag, "command line", nil
+	}
+	if opts.File != "" {
+		passwd, err := readPasswordFile(opts.File)
+		if err != nil {
+			return "", "", err
+		}
+		return passwd, fmt.Sprintf("file[%s]", opts.File), nil
+	}
+	if opts.Ask {
+		passwd, err := promptPassword()
+		if err != nil {
+			return "", "", err
+		}
+		return passwd, "prompt", nil
+	}
+	if passwd := os.Getenv(PasswordEnv); passwd != "" {
+		return passwd, "env[" + PasswordEnv + "]", nil
+	}
+	if passwd := os.Getenv(MySQLPasswordEnv); passwd != "" {
+		return passwd, "env[" + MySQLPasswordEnv + "]", nil
+	}
+	return "", "none", nil
+}
+
+func readPasswordFile(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("password.file[%s].mode[%#o].must.not.be.accessible.by.group.or.others(use chmod 600)", file, info.Mode().Perm())
+	}
+	data, err := ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	line := strings.SplitN(string(data), "\n", 2)[0]
+	return strings.TrimRight(line, "\r"), nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+func promptPassword() (string, error) {
+	if !isTerminal(os.Stdin) {
+		return "", errors.New("password.prompt.requires.stdin.to.be.a.terminal")
+	}
+	fmt.Fprint(os.Stderr, "Enter password: ")
+	if err := stty("-echo"); err != nil {
+		return "", err
+	}
+	defer func() {
+		stty("echo")
+		fmt.Fprintln(os.Stderr)
+	}()
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,80 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvePassword(t *testing.T) {
+	file := "/tmp/mydumper.passwd"
+	defer os.Remove(file)
+	err := WriteFile(file, "filepwd\nsecondline\n")
+	assert.Nil(t, err)
+	err = os.Chmod(file, 0600)
+	assert.Nil(t, err)
+
+	os.Setenv(PasswordEnv, "ourpwd")
+	os.Setenv(MySQLPasswordEnv, "mysqlpwd")
+	defer os.Unsetenv(PasswordEnv)
+	defer os.Unsetenv(MySQLPasswordEnv)
+
+	tests := []struct {
+		opts   *PasswordOptions
+		passwd string
+		source string
+	}{
+		{&PasswordOptions{Flag: "flagpwd", File: file}, "flagpwd", "command line"},
+		{&PasswordOptions{File: file}, "filepwd", "file[/tmp/mydumper.passwd]"},
+		{&PasswordOptions{}, "ourpwd", "env[GO_MYDUMPER_PASSWORD]"},
+	}
+	for _, test := range tests {
+		passwd, source, err := ResolvePassword(test.opts)
+		assert.Nil(t, err)
+		assert.Equal(t, test.passwd, passwd)
+		assert.Equal(t, test.source, source)
+	}
+
+	// MYSQL_PWD.
+	{
+		os.Unsetenv(PasswordEnv)
+		passwd, source, err := ResolvePassword(&PasswordOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, "mysqlpwd", passwd)
+		assert.Equal(t, "env[MYSQL_PWD]", source)
+	}
+
+	// Nothing.
+	{
+		os.Unsetenv(MySQLPasswordEnv)
+		passwd, source, err := ResolvePassword(&PasswordOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, "", passwd)
+		assert.Equal(t, "none", source)
+	}
+}
+
+func TestResolvePasswordFileMode(t *testing.T) {
+	file := "/tmp/mydumper.passwd.open"
+	defer os.Remove(file)
+	err := WriteFile(file, "filepwd")
+	assert.Nil(t, err)
+	err = os.Chmod(file, 0644)
+	assert.Nil(t, err)
+
+	_, _, err = ResolvePassword(&PasswordOptions{File: file})
+	assert.NotNil(t, err)
+
+	_, _, err = ResolvePassword(&PasswordOptions{File: "/xxu01/passwd"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,127 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// geteuid is os.Geteuid, replaced by the tests.
+var geteuid = os.Geteuid
+
+// filePerm is the mode and the owner of the files and the directories a dump
+// creates, see DumpArgs.FileMode, DirMode and Chown. They are set once a file
+// is created, so the umask of the process doesn't change them.
+type filePerm struct {
+	fileMode os.FileMode
+	dirMode  os.FileMode
+	// uid and gid are the owner, -1 without a Chown.
+	uid int
+	gid int
+}
+
+// parseOwner parses a 'uid:gid' owner, both numeric.
+func parseOwner(owner string) (int, int, error) {
+	splits := strings.Split(owner, ":")
+	if len(splits) != 2 {
+		return 0, 0, fmt.Errorf("owner %q is not uid:gid", owner)
+	}
+	uid, err := strconv.Atoi(splits[0])
+	if err != nil || uid < 0 {
+		return 0, 0, fmt.Errorf("owner %q has no numeric uid", owner)
+	}
+	gid, err := strconv.Atoi(splits[1])
+	if err != nil || gid < 0 {
+		return 0, 0, fmt.Errorf("owner %q has no numeric gid", owner)
+	}
+	return uid, gid, nil
+}
+
+// filePerm returns the filePerm of args, nil if it sets none. A Chown which
+// doesn't parse is left out, Validate reports it.
+func (args *DumpArgs) filePerm() *filePerm {
+	if args.FileMode == 0 && args.DirMode == 0 && args.Chown == "" {
+		return nil
+	}
+	p := &filePerm{fileMode: args.FileMode, dirMode: args.DirMode, uid: -1, gid: -1}
+	if uid, gid, err := parseOwner(args.Chown); err == nil {
+		p.uid, p.gid = uid, gid
+	}
+	return p
+}
+
+// makeOutdir creates the Outdir of args with its parents if ForceMkdir is set
+// and it does not exist, with the DirMode and the owner of args. A storage
+// location is left to its storage.
+func (args *DumpArgs) makeOutdir() error {
+	if !args.ForceMkdir || args.Outdir == "" || storageScheme(args.Outdir) != "" {
+		return nil
+	}
+	if _, err := os.Stat(args.Outdir); !os.IsNotExist(err) {
+		return nil
+	}
+	if err := args.filePerm().mkdirAll(args.Outdir); err != nil {
+		return fmt.Errorf("dumping.outdir[%s].mkdir.error:%v", args.Outdir, err)
+	}
+	return nil
+}
+
+// apply sets mode, if not 0, and the owner of path.
+func (p *filePerm) apply(path string, mode os.FileMode) error {
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if p.uid >= 0 {
+		return os.Chown(path, p.uid, p.gid)
+	}
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents like os.MkdirAll, with the
+// mode and the owner of p for each one created. The existing ones are left
+// as they are. A nil p creates them as the umask makes them.
+func (p *filePerm) mkdirAll(dir string) error {
+	if p == nil {
+		return os.MkdirAll(dir, 0777)
+	}
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := p.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return p.apply(dir, p.dirMode)
+}
+
+// withPerm returns the storage s creating its files with the mode and the
+// owner of p if it's a directory, other storages as they are.
+func withPerm(s Storage, p *filePerm) Storage {
+	if d, ok := s.(*dirStorage); ok && p != nil {
+		return &dirStorage{dir: d.dir, perm: p}
+	}
+	return s
+}
@@ -0,0 +1,120 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOwner(t *testing.T) {
+	tests := []struct {
+		owner string
+		uid   int
+		gid   int
+		err   bool
+	}{
+		{"1000:1000", 1000, 1000, false},
+		{"0:34", 0, 34, false},
+		{"1000", 0, 0, true},
+		{"backup:backup", 0, 0, true},
+		{"1000:-1", 0, 0, true},
+		{"1000:1000:1", 0, 0, true},
+	}
+	for _, test := range tests {
+		uid, gid, err := parseOwner(test.owner)
+		assert.Equal(t, test.err, err != nil, test.owner)
+		assert.Equal(t, test.uid, uid, test.owner)
+		assert.Equal(t, test.gid, gid, test.owner)
+	}
+}
+
+func TestFilePerm(t *testing.T) {
+	dir := "/tmp/filepermtest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	// The modes are set whatever the umask.
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	mode := func(path string) os.FileMode {
+		info, err := os.Stat(path)
+		assert.Nil(t, err)
+		return info.Mode().Perm()
+	}
+
+	// None set.
+	{
+		args := &DumpArgs{}
+		assert.Nil(t, args.filePerm())
+		s := withPerm(NewDirStorage(dir), args.filePerm())
+		x := writeFile(s, "metadata", "")
+		AssertNil(x)
+		assert.Equal(t, os.FileMode(0600), mode(dir+"/metadata"))
+	}
+
+	// The files and the directories created.
+	{
+		args := &DumpArgs{FileMode: 0640, DirMode: 0750}
+		x := args.filePerm().mkdirAll(dir + "/dump/shop")
+		AssertNil(x)
+		assert.Equal(t, os.FileMode(0750), mode(dir+"/dump"))
+		assert.Equal(t, os.FileMode(0750), mode(dir+"/dump/shop"))
+		s := withPerm(NewDirStorage(dir+"/dump/shop"), args.filePerm())
+		for _, name := range []string{"shop.t1-schema.sql", "shop.t1.00001.sql", manifestFile} {
+			x := writeFile(s, name, "x")
+			AssertNil(x)
+			assert.Equal(t, os.FileMode(0640), mode(dir+"/dump/shop/"+name))
+		}
+		// A file written again keeps it.
+		x = writeFile(s, manifestFile, "y")
+		AssertNil(x)
+		assert.Equal(t, os.FileMode(0640), mode(dir+"/dump/shop/"+manifestFile))
+
+		// The existing directories are left as they are.
+		x = os.Chmod(dir+"/dump", 0700)
+		AssertNil(x)
+		args.DirMode = 0755
+		x = args.filePerm().mkdirAll(dir + "/dump/other")
+		AssertNil(x)
+		assert.Equal(t, os.FileMode(0700), mode(dir+"/dump"))
+		assert.Equal(t, os.FileMode(0755), mode(dir+"/dump/other"))
+	}
+
+	// The owner, root only gives a file away.
+	if os.Geteuid() == 0 {
+		args := &DumpArgs{Chown: "1234:5678", ForceMkdir: true, Outdir: dir + "/owned"}
+		x := args.filePerm().mkdirAll(args.Outdir)
+		AssertNil(x)
+		x = writeFile(withPerm(NewDirStorage(args.Outdir), args.filePerm()), "metadata", "")
+		AssertNil(x)
+		for _, path := range []string{args.Outdir, args.Outdir + "/metadata"} {
+			info, err := os.Stat(path)
+			assert.Nil(t, err)
+			st := info.Sys().(*syscall.Stat_t)
+			assert.Equal(t, uint32(1234), st.Uid, path)
+			assert.Equal(t, uint32(5678), st.Gid, path)
+		}
+	}
+
+	// Not root.
+	{
+		defer func(f func() int) { geteuid = f }(geteuid)
+		geteuid = func() int { return 1000 }
+		args := &DumpArgs{User: "mock", Address: "127.0.0.1:3306", Database: "test", Outdir: dir, Threads: 1, ChunksizeInMB: 1, StmtSize: 1, IntervalMs: 1000, Chown: "1234:5678"}
+		err := args.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"chown requires running as root, only root can give a file away"}, err.(*ValidationError).Problems)
+	}
+}
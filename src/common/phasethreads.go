@@ -0,0 +1,165 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// PhaseThreads is the concurrency of a phase of a load, in the summary: the
+// connections it may hold at once and the most it held.
+type PhaseThreads struct {
+	Phase   string `json:"phase"`
+	Threads int    `json:"threads"`
+	Peak    int    `json:"peak"`
+}
+
+// schemaThreads returns the connections creating the table schemas, at least
+// 1, see LoadArgs.SchemaThreads.
+func (args *LoadArgs) schemaThreads() int {
+	if args.SchemaThreads < 1 {
+		return 1
+	}
+	return args.SchemaThreads
+}
+
+// dataThreads returns the connections restoring the data files,
+// LoadArgs.DataThreads or Threads.
+func (args *LoadArgs) dataThreads() int {
+	if args.DataThreads > 0 {
+		return args.DataThreads
+	}
+	return args.Threads
+}
+
+// postThreads returns the connections of the phases after the datas,
+// LoadArgs.PostThreads or Threads.
+func (args *LoadArgs) postThreads() int {
+	if args.PostThreads > 0 {
+		return args.PostThreads
+	}
+	return args.Threads
+}
+
+// poolThreads returns the size of the pool of a load, the most threads of
+// its phases: they draw from it, each capped by its own threads.
+func (args *LoadArgs) poolThreads() int {
+	n := args.schemaThreads()
+	if d := args.dataThreads(); d > n {
+		n = d
+	}
+	if p := args.postThreads(); p > n {
+		n = p
+	}
+	return n
+}
+
+// phaseLimit caps the connections a phase of a load takes from the shared
+// pool, and records the most of them working at once: a connection taken to
+// wait for work, like the next data file, doesn't count until it has some.
+type phaseLimit struct {
+	m       *Metrics
+	phase   string
+	threads int
+	slots   chan struct{}
+
+	mu     sync.Mutex
+	active int
+	peak   int
+}
+
+// newPhaseLimit returns the limit of threads connections of the phase.
+func newPhaseLimit(m *Metrics, phase string, threads int) *phaseLimit {
+	if threads < 1 {
+		threads = 1
+	}
+	return &phaseLimit{m: m, phase: phase, threads: threads, slots: make(chan struct{}, threads)}
+}
+
+// get takes a connection of the pool once the phase holds less than its
+// threads.
+func (l *phaseLimit) get(pool *Pool) *Connection {
+	l.slots <- struct{}{}
+	return pool.Get()
+}
+
+// put returns a connection taken by get.
+func (l *phaseLimit) put(pool *Pool, conn *Connection) {
+	pool.Put(conn)
+	<-l.slots
+}
+
+// working counts a connection of the phase working until the func it
+// returns is called.
+func (l *phaseLimit) working() func() {
+	l.mu.Lock()
+	l.active++
+	if l.active > l.peak {
+		l.peak = l.active
+	}
+	l.mu.Unlock()
+	return func() {
+		l.mu.Lock()
+		l.active--
+		l.mu.Unlock()
+	}
+}
+
+// done records the concurrency of the phase in the metrics, once all its
+// connections are returned.
+func (l *phaseLimit) done() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m.phaseThreadsDone(PhaseThreads{Phase: l.phase, Threads: l.threads, Peak: l.peak})
+}
+
+// phaseThreadsDone records the concurrency of a phase, the one of a phase
+// run again replaced.
+func (m *Metrics) phaseThreadsDone(pt PhaseThreads) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.phaseThreads {
+		if m.phaseThreads[i].Phase == pt.Phase {
+			m.phaseThreads[i] = pt
+			return
+		}
+	}
+	m.phaseThreads = append(m.phaseThreads, pt)
+}
+
+// phaseConcurrency returns the concurrency of the phases, in their order.
+func (m *Metrics) phaseConcurrency() []PhaseThreads {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]PhaseThreads(nil), m.phaseThreads...)
+}
+
+// logPhaseThreadsSummary logs the most connections every phase held and its
+// threads, like 'restoring.phase.threads[schemas:2/2,data:16/16,verify:4/8]'.
+func logPhaseThreadsSummary(log *xlog.Log, action string, phases []PhaseThreads) {
+	if len(phases) == 0 {
+		return
+	}
+	buf := &bytes.Buffer{}
+	for i, pt := range phases {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s:%d/%d", pt.Phase, pt.Peak, pt.Threads)
+	}
+	logSummary(log, "%s.phase.threads[%s]", action, buf.String())
+}
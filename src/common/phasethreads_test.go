@@ -0,0 +1,107 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhaseThreadsPool(t *testing.T) {
+	for _, tc := range []struct {
+		args               LoadArgs
+		schema, data, post int
+		pool               int
+	}{
+		{LoadArgs{Threads: 16, SchemaThreads: 4}, 4, 16, 16, 16},
+		{LoadArgs{Threads: 16}, 1, 16, 16, 16},
+		{LoadArgs{Threads: 4, SchemaThreads: 2, DataThreads: 32, PostThreads: 8}, 2, 32, 8, 32},
+		{LoadArgs{Threads: 16, SchemaThreads: 1, DataThreads: 4, PostThreads: 2}, 1, 4, 2, 4},
+		{LoadArgs{Threads: 2, SchemaThreads: 8}, 8, 2, 2, 8},
+	} {
+		assert.Equal(t, tc.schema, tc.args.schemaThreads())
+		assert.Equal(t, tc.data, tc.args.dataThreads())
+		assert.Equal(t, tc.post, tc.args.postThreads())
+		assert.Equal(t, tc.pool, tc.args.poolThreads())
+	}
+}
+
+func TestPhaseLimit(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	r := &recordingExecutor{}
+	pool, err := NewExecutorPool(log, 8, r.executor)
+	assert.Nil(t, err)
+	defer pool.Close()
+	m := newMetrics(log, "load", pool, new(uint64), nil)
+
+	// Two phases of the same pool, capped by their own threads.
+	for _, phase := range []struct {
+		name    string
+		threads int
+	}{{"data", 8}, {"verify", 3}} {
+		limit := newPhaseLimit(m, phase.name, phase.threads)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		active, most := 0, 0
+		for i := 0; i < 20; i++ {
+			conn := limit.get(pool)
+			wg.Add(1)
+			go func(conn *Connection) {
+				defer wg.Done()
+				defer limit.put(pool, conn)
+				defer limit.working()()
+				mu.Lock()
+				active++
+				if active > most {
+					most = active
+				}
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mu.Lock()
+				active--
+				mu.Unlock()
+			}(conn)
+		}
+		wg.Wait()
+		limit.done()
+		assert.True(t, most <= phase.threads, phase.name)
+	}
+	phases := m.phaseConcurrency()
+	assert.Equal(t, 2, len(phases))
+	assert.Equal(t, "data", phases[0].Phase)
+	assert.Equal(t, 8, phases[0].Threads)
+	assert.True(t, phases[0].Peak >= 1 && phases[0].Peak <= 8)
+	assert.Equal(t, "verify", phases[1].Phase)
+	assert.True(t, phases[1].Peak >= 1 && phases[1].Peak <= 3)
+
+	// A connection waiting for work doesn't count.
+	{
+		limit := newPhaseLimit(m, "schemas", 4)
+		conns := []*Connection{limit.get(pool), limit.get(pool)}
+		stop := limit.working()
+		stop()
+		for _, conn := range conns {
+			limit.put(pool, conn)
+		}
+		limit.done()
+		assert.Equal(t, PhaseThreads{Phase: "schemas", Threads: 4, Peak: 1}, m.phaseConcurrency()[2])
+	}
+
+	buf := &bytes.Buffer{}
+	blog, err := NewLog(buf, "info", "")
+	assert.Nil(t, err)
+	logPhaseThreadsSummary(blog, "restoring", []PhaseThreads{{"schemas", 2, 2}, {"data", 16, 16}, {"verify", 8, 4}})
+	assert.Contains(t, buf.String(), "restoring.phase.threads[schemas:2/2,data:16/16,verify:4/8]")
+}
@@ -0,0 +1,158 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// isPipe reports whether info is a named pipe (FIFO).
+func isPipe(info os.FileInfo) bool {
+	return info.Mode()&os.ModeNamedPipe != 0
+}
+
+// unsizedPipe reports whether info is a named pipe the manifest has no size
+// for, it's never batched: its size is unknown.
+func unsizedPipe(info os.FileInfo) bool {
+	return isPipe(info) && info.Size() == 0
+}
+
+// pipeInfo is the os.FileInfo of a named pipe with its size from the manifest.
+type pipeInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi *pipeInfo) Size() int64 { return fi.size }
+
+// fifoStorage is the storage of a restore whose data files are named pipes,
+// see LoadArgs.AllowPipes: Stat gives the size of a pipe from the manifest,
+// and a pipe opened again, like by a transaction batch run again after a
+// failover, is fed again by the pipe reopen hook first or fails.
+type fifoStorage struct {
+	Storage
+	ctx  context.Context
+	log  *xlog.Log
+	args *LoadArgs
+	// sizes are the pipes of the dump with their sizes, 0 if the manifest
+	// has none.
+	sizes map[string]int64
+
+	mu     sync.Mutex
+	opened map[string]bool
+}
+
+// openPipes checks the files of a restore for named pipes and returns the
+// storage to read them from: s as it is if there is none. A pipe fails the
+// run without LoadArgs.AllowPipes, and a schema file which is one always
+// does: the schemas are read more than once. The size of a pipe is the bytes
+// of its table in the manifest by data file, if the dump has one.
+func openPipes(ctx context.Context, log *xlog.Log, s Storage, args *LoadArgs, files *Files) (Storage, error) {
+	for _, list := range [][]string{files.databases, files.schemas} {
+		for _, name := range list {
+			if info, err := s.Stat(name); err == nil && isPipe(info) {
+				return nil, fmt.Errorf("restoring.file[%s].is.a.named.pipe:only.the.data.files.can.be.pipes,the.schemas.are.read.more.than.once", name)
+			}
+		}
+	}
+	sizes := make(map[string]int64)
+	for _, name := range files.tables {
+		if info, err := s.Stat(name); err == nil && isPipe(info) {
+			if !args.AllowPipes {
+				return nil, fmt.Errorf("restoring.file[%s].is.a.named.pipe,set.AllowPipes(-allow-pipes).to.read.it", name)
+			}
+			sizes[name] = 0
+		}
+	}
+	if len(sizes) == 0 {
+		return s, nil
+	}
+
+	sized := 0
+	if m, err := readManifest(s); err == nil {
+		tables := make(map[string]*TableStats)
+		for _, t := range m.Tables {
+			if t.Stats != nil && t.Stats.Files > 0 {
+				tables[t.Database+"."+t.Table] = t.Stats
+			}
+		}
+		for name := range sizes {
+			db, tbl, _ := parseTableFile(name)
+			if stats, ok := tables[db+"."+tbl]; ok {
+				sizes[name] = int64(stats.Bytes) / int64(stats.Files)
+				sized++
+			}
+		}
+	}
+	log.Info("restoring.pipes[%d].sized.by.the.manifest[%d].reopen.hook[%v]", len(sizes), sized, args.PipeReopenCommand != "" || args.pipeReopenHook != nil)
+	return &fifoStorage{Storage: s, ctx: ctx, log: log, args: args, sizes: sizes, opened: make(map[string]bool)}, nil
+}
+
+// Stat returns the size of a pipe from the manifest, 0 if it has none.
+func (s *fifoStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := s.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if size, ok := s.sizes[name]; ok && isPipe(info) {
+		return &pipeInfo{FileInfo: info, size: size}, nil
+	}
+	return info, nil
+}
+
+// Open opens a file, a pipe already read is fed again by the pipe reopen
+// hook first: without one it fails.
+func (s *fifoStorage) Open(name string) (io.ReadCloser, error) {
+	if _, ok := s.sizes[name]; !ok {
+		return s.Storage.Open(name)
+	}
+	s.mu.Lock()
+	again := s.opened[name]
+	s.opened[name] = true
+	s.mu.Unlock()
+	if again {
+		if err := s.reopen(name); err != nil {
+			return nil, err
+		}
+	}
+	return s.Storage.Open(name)
+}
+
+// reopen runs the command then the callback of the pipe reopen hook for a
+// pipe read again and records it.
+func (s *fifoStorage) reopen(name string) error {
+	command, callback := s.args.PipeReopenCommand, s.args.pipeReopenHook
+	if command == "" && callback == nil {
+		return fmt.Errorf("restoring.pipe[%s].was.already.read.and.can't.be.read.again,set.PipeReopenCommand(-pipe-reopen-command).to.feed.it.again", name)
+	}
+	db, tbl, _ := parseTableFile(name)
+	e := TableEvent{Database: db, Table: tbl, File: name, Status: HookReopen}
+	start := time.Now()
+	var err error
+	if command != "" {
+		err = runHookCommand(s.ctx, command, e)
+	}
+	if err == nil && callback != nil {
+		err = callback(s.ctx, e)
+	}
+	s.args.metrics.hookDone(pipeReopenHook, time.Since(start), err)
+	if err != nil {
+		return wrapf(err, "restoring.pipe[%s].%s.hook.error:%v", name, pipeReopenHook, err)
+	}
+	s.log.Warning("restoring.pipe[%s].read.again.%s.hook.done.cost[%.2fsec]", name, pipeReopenHook, time.Since(start).Seconds())
+	return nil
+}
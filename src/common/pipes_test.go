@@ -0,0 +1,173 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// feedPipe writes data to the named pipe once a reader opens it.
+func feedPipe(path string, data string) chan error {
+	done := make(chan error, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			done <- err
+			return
+		}
+		_, err = f.WriteString(data)
+		f.Close()
+		done <- err
+	}()
+	return done
+}
+
+func TestOpenPipes(t *testing.T) {
+	dir := "/tmp/openpipes"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\n")
+	AssertNil(x)
+	for _, name := range []string{"test.t1.00002.sql", "test.t2.00001.sql"} {
+		x = syscall.Mkfifo(dir+"/"+name, 0644)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	s := NewDirStorage(dir)
+	files, err := loadFiles(s)
+	assert.Nil(t, err)
+
+	// A pipe needs AllowPipes.
+	{
+		_, err := openPipes(context.Background(), log, s, &LoadArgs{}, files)
+		assert.NotNil(t, err)
+	}
+
+	// Without a manifest the pipes have no size, they are never batched.
+	{
+		fifos, err := openPipes(context.Background(), log, s, &LoadArgs{AllowPipes: true}, files)
+		assert.Nil(t, err)
+		info, err := fifos.Stat("test.t1.00002.sql")
+		assert.Nil(t, err)
+		assert.True(t, unsizedPipe(info))
+		want := [][]string{{"test.t1.00002.sql"}, {"test.t2.00001.sql"}, {"test.t1.00001.sql"}}
+		assert.Equal(t, want, batchTables(fifos, files.tables, unitBatch{size: 10, maxBytes: 1024, txn: true}))
+	}
+
+	// The manifest sizes them by data file of their table.
+	{
+		m := newManifest()
+		m.Tables = []*ManifestTable{{Database: "test", Table: "t1", Stats: &TableStats{Bytes: 600, Files: 2}}}
+		x := m.write(s)
+		AssertNil(x)
+		files, err := loadFiles(s)
+		assert.Nil(t, err)
+		fifos, err := openPipes(context.Background(), log, s, &LoadArgs{AllowPipes: true}, files)
+		assert.Nil(t, err)
+		info, err := fifos.Stat("test.t1.00002.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(300), info.Size())
+		info, err = fifos.Stat("test.t2.00001.sql")
+		assert.Nil(t, err)
+		assert.True(t, unsizedPipe(info))
+		want := [][]string{{"test.t2.00001.sql"}, {"test.t1.00001.sql", "test.t1.00002.sql"}}
+		assert.Equal(t, want, batchTables(fifos, files.tables, unitBatch{size: 10, maxBytes: 1024, txn: true}))
+		assert.Equal(t, uint64(300+29), filesBytes(fifos, files.tables))
+	}
+
+	// A schema file can't be a pipe.
+	{
+		x := syscall.Mkfifo(dir+"/test.t2-schema.sql", 0644)
+		AssertNil(x)
+		files, err := loadFiles(s)
+		assert.Nil(t, err)
+		_, err = openPipes(context.Background(), log, s, &LoadArgs{AllowPipes: true}, files)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestFifoStorageOpen(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	mem := NewMemStorage()
+	for _, name := range []string{"test.t1.00001.sql", "test.t1.00002.sql"} {
+		x := writeFile(mem, name, "INSERT INTO `t1` VALUES (1);\n")
+		AssertNil(x)
+	}
+	sizes := map[string]int64{"test.t1.00001.sql": 0}
+
+	// A pipe is read once without a reopen hook, the other files as often
+	// as they are.
+	{
+		s := &fifoStorage{Storage: mem, ctx: context.Background(), log: log, args: &LoadArgs{}, sizes: sizes, opened: make(map[string]bool)}
+		_, err := readFile(s, "test.t1.00001.sql")
+		assert.Nil(t, err)
+		_, err = readFile(s, "test.t1.00001.sql")
+		assert.NotNil(t, err)
+		for i := 0; i < 2; i++ {
+			_, err := readFile(s, "test.t1.00002.sql")
+			assert.Nil(t, err)
+		}
+	}
+
+	// The reopen hook feeds it again, its error fails the read.
+	{
+		var events []TableEvent
+		var fail error
+		args := &LoadArgs{pipeReopenHook: func(ctx context.Context, e TableEvent) error {
+			events = append(events, e)
+			return fail
+		}}
+		args.metrics = newMetrics(log, "load", nil, new(uint64), nil)
+		s := &fifoStorage{Storage: mem, ctx: context.Background(), log: log, args: args, sizes: sizes, opened: make(map[string]bool)}
+		for i := 0; i < 2; i++ {
+			_, err := readFile(s, "test.t1.00001.sql")
+			assert.Nil(t, err)
+		}
+		fail = errors.New("mock.error")
+		_, err := readFile(s, "test.t1.00001.sql")
+		assert.NotNil(t, err)
+		assert.Equal(t, []TableEvent{
+			{Database: "test", Table: "t1", File: "test.t1.00001.sql", Status: HookReopen},
+			{Database: "test", Table: "t1", File: "test.t1.00001.sql", Status: HookReopen},
+		}, events)
+		assert.Equal(t, HookStats{Runs: 2, Failed: 1, Seconds: args.metrics.hooks[pipeReopenHook].Seconds}, *args.metrics.hooks[pipeReopenHook])
+	}
+}
+
+func TestLoaderPipes(t *testing.T) {
+	dir := "/tmp/loaderpipes"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n")
+	AssertNil(x)
+	x = syscall.Mkfifo(dir+"/test.t1.00001.sql", 0644)
+	AssertNil(x)
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 1000, AllowPipes: true}
+
+	rec := &recordingExecutor{}
+	fed := feedPipe(dir+"/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\nINSERT INTO `t1` VALUES (2);\n")
+	report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, <-fed)
+	assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1)", "INSERT INTO `t1` VALUES (2)"}, matchingQueries(rec.queries, "INSERT"))
+	assert.Equal(t, uint64(1), report.FilesDone)
+}
@@ -0,0 +1,199 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The LoadArgs.Placement of the databases on the targets.
+const (
+	// PlacementRoundRobin deals the databases of the dump, by name, to the
+	// Address then the Targets by name, in turn.
+	PlacementRoundRobin = "round-robin"
+	// PlacementFile reads the target of every database of the dump from
+	// the LoadArgs.PlacementFile.
+	PlacementFile = "file"
+)
+
+// qualifiedNameRegexp matches the first part of a qualified name in a
+// schema, like `shop` of `shop`.`orders`.`id`: the database a view selects
+// from or a foreign key references.
+var qualifiedNameRegexp = regexp.MustCompile("`((?:[^`]|``)+)`\\s*\\.\\s*`")
+
+// targetNames returns the names of the targets of a load with targets in
+// the order they are restored: the DefaultTarget then the others by name.
+func targetNames(targets map[string]LoadTarget) []string {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultTarget}, names...)
+}
+
+// dumpDatabases returns the databases of the files, sorted.
+func dumpDatabases(files *Files) []string {
+	seen := make(map[string]bool)
+	var dbs []string
+	add := func(db string) {
+		if !seen[db] {
+			seen[db] = true
+			dbs = append(dbs, db)
+		}
+	}
+	for _, file := range files.databases {
+		add(strings.TrimSuffix(filepath.Base(file), dbSuffix))
+	}
+	for _, schema := range files.schemas {
+		db, _ := splitTableName(strings.TrimSuffix(filepath.Base(schema), schemaSuffix))
+		add(db)
+	}
+	for _, table := range files.tables {
+		db, _, _ := parseTableFile(table)
+		add(db)
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+// readPlacementFile reads the 'db target' lines of the LoadArgs.PlacementFile,
+// the target a name of the targets or the address of one of them, the
+// default port may be left out. The empty lines and the ones starting with
+// '#' are skipped.
+func readPlacementFile(args *LoadArgs) (map[string]string, error) {
+	f, err := os.Open(args.PlacementFile)
+	if err != nil {
+		return nil, wrapf(err, "restoring.placement.file[%s].error:%v", args.PlacementFile, err)
+	}
+	defer f.Close()
+
+	names := map[string]string{DefaultTarget: DefaultTarget, args.Address: DefaultTarget}
+	for name, target := range args.Targets {
+		names[name] = name
+		names[target.Address] = name
+	}
+	placed := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("restoring.placement.file[%s].line[%d].must.be[db target]", args.PlacementFile, line)
+		}
+		name, ok := names[fields[1]]
+		if !ok {
+			// An address without the default port.
+			if address, err := ParseAddress(fields[1], DefaultPort); err == nil {
+				name, ok = names[address]
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("restoring.placement.file[%s].line[%d].target[%s].not.in.targets", args.PlacementFile, line, fields[1])
+		}
+		if _, ok := placed[fields[0]]; ok {
+			return nil, fmt.Errorf("restoring.placement.file[%s].line[%d].database[%s].placed.twice", args.PlacementFile, line, fields[0])
+		}
+		placed[fields[0]] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, wrapf(err, "restoring.placement.file[%s].error:%v", args.PlacementFile, err)
+	}
+	return placed, nil
+}
+
+// placeDatabases places every database of the dump, with all its tables, on
+// a target by LoadArgs.Placement and returns the classifier of the
+// placement. It checks before any statement that every database has a
+// target and that no schema refers to a database placed on another one,
+// like a view selecting from it or a foreign key: it would fail on its
+// target.
+func placeDatabases(log *xlog.Log, args *LoadArgs) (TableClassifier, error) {
+	storage, err := openDumpStorage(log, args.Outdir, args.Volumes)
+	if err != nil {
+		return nil, err
+	}
+	files, err := loadFiles(storage)
+	if err != nil {
+		return nil, err
+	}
+	dbs := dumpDatabases(files)
+	names := targetNames(args.Targets)
+
+	placed := make(map[string]string)
+	switch args.Placement {
+	case PlacementRoundRobin:
+		for i, db := range dbs {
+			placed[db] = names[i%len(names)]
+		}
+	case PlacementFile:
+		if placed, err = readPlacementFile(args); err != nil {
+			return nil, err
+		}
+		for _, db := range dbs {
+			if _, ok := placed[db]; !ok {
+				return nil, fmt.Errorf("restoring.placement.database[%s].not.in.the.placement.file[%s]", db, args.PlacementFile)
+			}
+		}
+	}
+	if err := checkPlacementReferences(storage, files.schemas, placed); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int)
+	for _, db := range dbs {
+		counts[placed[db]]++
+	}
+	for _, name := range names {
+		log.Info("restoring.placement[%s].target[%s].databases[%d]", args.Placement, name, counts[name])
+	}
+	return func(db string, table string) string {
+		return placed[db]
+	}, nil
+}
+
+// checkPlacementReferences checks no schema refers to a database of the
+// dump placed on another target than its own, all of them are reported.
+func checkPlacementReferences(s Storage, schemas []string, placed map[string]string) error {
+	var problems []string
+	for _, schema := range schemas {
+		name := strings.TrimSuffix(filepath.Base(schema), schemaSuffix)
+		db, _ := splitTableName(name)
+		data, err := readFile(s, schema)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		for _, match := range qualifiedNameRegexp.FindAllStringSubmatch(string(data), -1) {
+			ref := strings.Replace(match[1], "``", "`", -1)
+			target, ok := placed[ref]
+			if !ok || ref == db || target == placed[db] || seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			problems = append(problems, fmt.Sprintf("%s[%s].refers.to.%s[%s]", name, placed[db], ref, target))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("restoring.placement.cross.target.references:%s", strings.Join(problems, ","))
+	}
+	return nil
+}
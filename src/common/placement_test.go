@@ -0,0 +1,137 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPlacementFile(t *testing.T) {
+	file := "/tmp/placementtest.txt"
+	args := &LoadArgs{Address: "10.0.0.1:3306", PlacementFile: file, Targets: map[string]LoadTarget{
+		"small2": {Address: "10.0.0.2:3306"},
+	}}
+	tests := []struct {
+		data   string
+		placed map[string]string
+		err    bool
+	}{
+		{"# tenants\ntenant1 default\n\ntenant2 small2\ntenant3 10.0.0.2:3306\ntenant4 10.0.0.1\n",
+			map[string]string{"tenant1": DefaultTarget, "tenant2": "small2", "tenant3": "small2", "tenant4": DefaultTarget}, false},
+		{"tenant1 small3\n", nil, true},
+		{"tenant1\n", nil, true},
+		{"tenant1 default\ntenant1 small2\n", nil, true},
+	}
+	for _, test := range tests {
+		x := WriteFile(file, test.data)
+		AssertNil(x)
+		placed, err := readPlacementFile(args)
+		assert.Equal(t, test.err, err != nil, test.data)
+		assert.Equal(t, test.placed, placed, test.data)
+	}
+}
+
+func TestLoaderPlacement(t *testing.T) {
+	dir := "/tmp/loaderplacement"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"tenant1-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `tenant1`;",
+		"tenant1.users-schema.sql":  "CREATE TABLE `users` (`a` int) ENGINE=InnoDB;\n",
+		"tenant1.users.00001.sql":   "INSERT INTO `users` VALUES (1);\n",
+		"tenant2-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `tenant2`;",
+		"tenant2.users-schema.sql":  "CREATE TABLE `users` (`a` int) ENGINE=InnoDB;\n",
+		"tenant2.users.00001.sql":   "INSERT INTO `users` VALUES (2);\n",
+		"tenant2.v1-schema.sql":     "CREATE ALGORITHM=UNDEFINED DEFINER=`root`@`%` SQL SECURITY DEFINER VIEW `v1` AS select `tenant2`.`users`.`a` AS `a` from `tenant2`.`users`;\n",
+		"tenant3-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `tenant3`;",
+		"tenant3.users-schema.sql":  "CREATE TABLE `users` (`a` int) ENGINE=InnoDB;\n",
+		"tenant3.users.00001.sql":   "INSERT INTO `users` VALUES (3);\n",
+		"tenant4-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `tenant4`;",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "10.0.0.1:3306", Threads: 2, IntervalMs: 500}
+
+	// Round robin: every database with all its tables on one target, the
+	// databases without tables too.
+	{
+		small1 := &recordingExecutor{}
+		small2 := &recordingExecutor{}
+		args := args
+		args.Placement = PlacementRoundRobin
+		args.Targets = map[string]LoadTarget{"small2": {Address: "10.0.0.2:3306", User: "mock", Executor: small2.executor}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: small1.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"CREATE DATABASE IF NOT EXISTS `tenant1`;", "CREATE DATABASE IF NOT EXISTS `tenant3`;"}, matchingQueries(small1.queries, "CREATE DATABASE"))
+		inserts := matchingQueries(small1.queries, "INSERT")
+		sort.Strings(inserts)
+		assert.Equal(t, []string{"INSERT INTO `users` VALUES (1)", "INSERT INTO `users` VALUES (3)"}, inserts)
+		assert.Equal(t, []string{"CREATE DATABASE IF NOT EXISTS `tenant2`;", "CREATE DATABASE IF NOT EXISTS `tenant4`;"}, matchingQueries(small2.queries, "CREATE DATABASE"))
+		assert.Equal(t, []string{"INSERT INTO `users` VALUES (2)"}, matchingQueries(small2.queries, "INSERT"))
+		assert.Equal(t, 1, len(matchingQueries(small2.queries, "CREATE ALGORITHM")))
+		assert.Equal(t, uint64(2), report.Targets[DefaultTarget].FilesDone)
+		assert.Equal(t, uint64(1), report.Targets["small2"].FilesDone)
+	}
+
+	// A placement file, a view of a database placed elsewhere fails before
+	// any statement.
+	{
+		file := dir + "/placement.txt"
+		x := WriteFile(file, "tenant1 default\ntenant2 small2\ntenant3 10.0.0.2:3306\ntenant4 small2\n")
+		AssertNil(x)
+		x = WriteFile(dir+"/tenant1.v2-schema.sql", "CREATE ALGORITHM=UNDEFINED DEFINER=`root`@`%` SQL SECURITY DEFINER VIEW `v2` AS select `tenant3`.`users`.`a` AS `a` from `tenant3`.`users`;\n")
+		AssertNil(x)
+		defer os.Remove(dir + "/tenant1.v2-schema.sql")
+		small1 := &recordingExecutor{}
+		small2 := &recordingExecutor{}
+		args := args
+		args.Placement = PlacementFile
+		args.PlacementFile = file
+		args.Targets = map[string]LoadTarget{"small2": {Address: "10.0.0.2:3306", User: "mock", Executor: small2.executor}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: small1.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.placement.cross.target.references:tenant1.v2[default].refers.to.tenant3[small2]", err.Error())
+		assert.Nil(t, small1.queries)
+		assert.Nil(t, small2.queries)
+
+		// On the same target.
+		x = WriteFile(file, "tenant1 default\ntenant2 small2\ntenant3 default\ntenant4 small2\n")
+		AssertNil(x)
+		_, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: small1.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(matchingQueries(small1.queries, "CREATE ALGORITHM")))
+
+		// A database missing in the file.
+		x = WriteFile(file, "tenant1 default\ntenant2 small2\n")
+		AssertNil(x)
+		_, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: small1.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.placement.database[tenant3].not.in.the.placement.file["+file+"]", err.Error())
+	}
+
+	// A placement with a classifier.
+	{
+		args := args
+		args.Placement = PlacementRoundRobin
+		args.Targets = map[string]LoadTarget{"small2": {Address: "10.0.0.2:3306", User: "mock"}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Classifier: func(db string, table string) string { return "" }}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.classifier.and.placement.can.not.be.set.together", err.Error())
+	}
+}
@@ -10,7 +10,13 @@
 package common
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/XeLabs/go-mysqlstack/driver"
 	"github.com/XeLabs/go-mysqlstack/xlog"
@@ -22,39 +28,263 @@ type Pool struct {
 	mu    sync.RWMutex
 	log   *xlog.Log
 	conns chan *Connection
+	// all are the connections of the pool, taken or not, see CloseOnDone.
+	all []*Connection
+
+	// addresses are the addresses a connection is dialed to in order, from
+	// current: the last one which worked, see reconnect.
+	addresses []string
+	current   int
+	dial      dialFunc
+	// session are the statements of executeAll, run again on a reconnected
+	// connection.
+	session []string
+	// done is set once CloseOnDone closed the connections, they are not
+	// reconnected any more.
+	done bool
+	// pingIdle is how long a connection may stay idle before it's pinged
+	// when it's taken again, see revive, 0 never.
+	pingIdle time.Duration
+}
+
+// dialFunc connects the connection id of a pool to address.
+type dialFunc func(id int, address string) (*Connection, error)
+
+// errPoolDone is the error of a reconnect of a pool whose context is done.
+var errPoolDone = errors.New("pool.done.no.reconnect")
+
+// SplitAddresses returns the addresses of a comma separated list, like the
+// LoadArgs.Address of the two addresses of an HA pair.
+func SplitAddresses(address string) []string {
+	var addresses []string
+	for _, a := range strings.Split(address, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addresses = append(addresses, a)
+		}
+	}
+	return addresses
 }
 
+// Executor runs the statements of a connection on a server. A Connection is
+// one, on the driver connection it dialed or on the Executor it wraps, see
+// NewExecutorPool: a test can restore through a mock which records the
+// statements, fails some or checks their order, without a server.
+type Executor interface {
+	Execute(query string) error
+	Fetch(query string) (*sqltypes.Result, error)
+	Ping() error
+	// Close closes the executor, it may be called again.
+	Close() error
+}
+
+// ExecutorFunc returns the Executor of the connection id of a pool.
+type ExecutorFunc func(id int) (Executor, error)
+
 type Connection struct {
 	ID     int
 	client driver.Conn
+	// exec runs the statements instead of client if it's set, see NewExecutorPool.
+	exec Executor
+
+	// prepared are the statement names prepared on the connection by shape, see executePrepared.
+	prepared map[string]string
+	// db is the current database selected by Use, empty if unknown.
+	db string
+	// pool is the pool of the connection, see reconnect.
+	pool *Pool
+	// idle is when the connection was last put back in its pool.
+	idle time.Time
 }
 
+// changeDatabaseRegexp matches the statements which may change the current
+// database of the connection behind Use.
+var changeDatabaseRegexp = regexp.MustCompile(`(?is)^\s*(use\b|drop\s+(database|schema)\b)`)
+
 func (conn *Connection) Execute(query string) error {
+	if changeDatabaseRegexp.MatchString(query) {
+		conn.db = ""
+	}
+	if conn.exec != nil {
+		return conn.exec.Execute(query)
+	}
 	return conn.client.Exec(query)
 }
 
+// Use selects the database db, the 'use' is only sent if it's not the
+// current database of the connection already.
+func (conn *Connection) Use(db string) error {
+	if conn.db == db {
+		return nil
+	}
+	if err := conn.Execute(fmt.Sprintf("use `%s`", db)); err != nil {
+		return err
+	}
+	conn.db = db
+	return nil
+}
+
+func (conn *Connection) Ping() error {
+	if conn.exec != nil {
+		return conn.exec.Ping()
+	}
+	return conn.client.Ping()
+}
+
 func (conn *Connection) Fetch(query string) (*sqltypes.Result, error) {
+	if conn.exec != nil {
+		return conn.exec.Fetch(query)
+	}
 	return conn.client.FetchAll(query, -1)
 }
 
+// StreamFetch streams the rows of query, only a dialed connection can.
 func (conn *Connection) StreamFetch(query string) (driver.Rows, error) {
+	if conn.exec != nil {
+		return nil, errors.New("connection.executor.can.not.stream")
+	}
 	return conn.client.Query(query)
 }
 
+// Close closes the connection, it may be called again.
+func (conn *Connection) Close() error {
+	if conn.exec != nil {
+		return conn.exec.Close()
+	}
+	if conn.client.Closed() {
+		return nil
+	}
+	return conn.client.Close()
+}
+
+// NewPool creates a pool of cap connections dialed to address, or to the
+// first of its comma separated addresses which can be, see SplitAddresses.
+// An address without a port is on the DefaultPort, see ParseAddress.
 func NewPool(log *xlog.Log, cap int, address string, user string, password string) (*Pool, error) {
-	conns := make(chan *Connection, cap)
-	for i := 0; i < cap; i++ {
+	addresses, err := parseAddresses(address)
+	if err != nil {
+		return nil, err
+	}
+	return newPool(log, cap, addresses, func(id int, address string) (*Connection, error) {
 		client, err := driver.NewConn(user, password, address, "", "utf8")
 		if err != nil {
 			return nil, err
 		}
-		conns <- &Connection{ID: i, client: client}
+		return &Connection{ID: id, client: client}, nil
+	})
+}
+
+// NewExecutorPool creates a pool of cap connections on the executors of
+// newExecutor instead of dialing a server.
+func NewExecutorPool(log *xlog.Log, cap int, newExecutor ExecutorFunc) (*Pool, error) {
+	return newPool(log, cap, []string{""}, executorDial(newExecutor))
+}
+
+// executorDial dials the executors of newExecutor, whatever the address.
+func executorDial(newExecutor ExecutorFunc) dialFunc {
+	return func(id int, address string) (*Connection, error) {
+		exec, err := newExecutor(id)
+		if err != nil {
+			return nil, err
+		}
+		return &Connection{ID: id, exec: exec}, nil
 	}
+}
 
-	return &Pool{
-		log:   log,
-		conns: conns,
-	}, nil
+// newPool creates a pool of cap connections, each dialed to the first of the
+// addresses which can be.
+func newPool(log *xlog.Log, cap int, addresses []string, dial dialFunc) (*Pool, error) {
+	p := &Pool{
+		log:       log,
+		conns:     make(chan *Connection, cap),
+		all:       make([]*Connection, 0, cap),
+		addresses: addresses,
+		dial:      dial,
+	}
+	for i := 0; i < cap; i++ {
+		conn := &Connection{ID: i, pool: p}
+		if _, err := p.connect(conn, nil); err != nil {
+			for _, conn := range p.all {
+				conn.Close()
+			}
+			return nil, err
+		}
+		p.conns <- conn
+		p.all = append(p.all, conn)
+	}
+	return p, nil
+}
+
+// connect dials conn to the first of the addresses from the current one
+// which can be and which accept takes, nil takes any: the pool then sticks to
+// it. The session statements are run again on it, and the database conn was
+// in is selected again. It returns whether the pool moved to another address.
+func (p *Pool) connect(conn *Connection, accept func(*Connection) error) (bool, error) {
+	p.mu.Lock()
+	start, session := p.current, append([]string(nil), p.session...)
+	p.mu.Unlock()
+	var failed []string
+	var last error
+	for i := range p.addresses {
+		k := (start + i) % len(p.addresses)
+		c, err := p.dial(conn.ID, p.addresses[k])
+		if err == nil && accept != nil {
+			err = accept(c)
+		}
+		for _, query := range session {
+			if err == nil {
+				err = c.Execute(query)
+			}
+		}
+		if err == nil && conn.db != "" {
+			err = c.Use(conn.db)
+		}
+		if err != nil {
+			if c != nil {
+				c.Close()
+			}
+			failed = append(failed, fmt.Sprintf("%s:%v", p.addresses[k], err))
+			last = err
+			continue
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.done {
+			c.Close()
+			return false, errPoolDone
+		}
+		conn.client, conn.exec, conn.prepared = c.client, c.exec, nil
+		moved := p.current != k
+		p.current = k
+		if i > 0 {
+			p.log.Warning("pool.thread[%d].address[%s].unusable.connected.to[%s]", conn.ID, strings.Join(failed, ","), p.addresses[k])
+		}
+		return moved, nil
+	}
+	if len(p.addresses) == 1 {
+		return false, last
+	}
+	return false, fmt.Errorf("pool.thread[%d].no.address.usable[%s]", conn.ID, strings.Join(failed, ","))
+}
+
+// reconnect closes conn and connects it again, see connect, once its server
+// went away. It fails with errPoolDone once CloseOnDone closed the pool.
+func (p *Pool) reconnect(conn *Connection, accept func(*Connection) error) (bool, error) {
+	p.mu.RLock()
+	done := p.done
+	p.mu.RUnlock()
+	if done {
+		return false, errPoolDone
+	}
+	conn.Close()
+	return p.connect(conn, accept)
+}
+
+// address returns the address the pool sticks to.
+func (p *Pool) address() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.addresses[p.current]
 }
 
 func (p *Pool) Get() *Connection {
@@ -63,9 +293,44 @@ func (p *Pool) Get() *Connection {
 		return nil
 	}
 	conn := <-conns
+	p.revive(conn)
 	return conn
 }
 
+// TryGet returns an idle connection of the pool, nil if they are all taken.
+func (p *Pool) TryGet() *Connection {
+	conns := p.getConns()
+	if conns == nil {
+		return nil
+	}
+	select {
+	case conn := <-conns:
+		p.revive(conn)
+		return conn
+	default:
+		return nil
+	}
+}
+
+// revive pings conn if it was idle for longer than the pingIdle of the pool,
+// and connects it again if the ping fails, see reconnect: the server may
+// have closed it past its wait_timeout, or restarted. A connection which
+// can't be reconnected is returned as it is, its next statement fails.
+func (p *Pool) revive(conn *Connection) {
+	if conn == nil || p.pingIdle <= 0 || conn.idle.IsZero() || time.Since(conn.idle) < p.pingIdle {
+		return
+	}
+	err := conn.Ping()
+	if err == nil {
+		return
+	}
+	if _, rerr := p.reconnect(conn, nil); rerr != nil {
+		p.log.Warning("pool.thread[%d].idle[%v].ping.error:%v.reconnect.error:%v", conn.ID, time.Since(conn.idle), err, rerr)
+		return
+	}
+	p.log.Warning("pool.thread[%d].idle[%v].ping.error:%v.reconnected", conn.ID, time.Since(conn.idle), err)
+}
+
 func (p *Pool) Put(conn *Connection) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -73,6 +338,7 @@ func (p *Pool) Put(conn *Connection) {
 	if p.conns == nil {
 		return
 	}
+	conn.idle = time.Now()
 	p.conns <- conn
 }
 
@@ -82,11 +348,93 @@ func (p *Pool) Close() {
 
 	close(p.conns)
 	for conn := range p.conns {
-		conn.client.Close()
+		conn.Close()
 	}
 	p.conns = nil
 }
 
+// CloseOnDone closes every connection of the pool, the taken ones too, once
+// ctx is done: a query blocked on the server fails at once instead of pinning
+// the shutdown, and so do all the next ones. The connections are left in the
+// pool, Close still has to be called.
+// The returned func stops the watch, it must be called before Close.
+func (p *Pool) CloseOnDone(ctx context.Context) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			p.log.Warning("pool.context.done[%v].closing.connections[%d]", ctx.Err(), len(p.all))
+			p.mu.Lock()
+			p.done = true
+			for _, conn := range p.all {
+				conn.Close()
+			}
+			p.mu.Unlock()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// WarmUp pings every connection of the pool once, so the first statements
+// don't pay for a connection the server was slow to set up.
+// It must run while no connection is taken.
+func (p *Pool) WarmUp() error {
+	size, _ := p.Stats()
+	conns := make([]*Connection, 0, size)
+	defer func() {
+		for _, conn := range conns {
+			p.Put(conn)
+		}
+	}()
+	for i := 0; i < size; i++ {
+		conn := p.Get()
+		conns = append(conns, conn)
+		if err := conn.Ping(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeAll executes query once on every connection of the pool, like a SET
+// of the session, and on the connections reconnected later. It must run while
+// no connection is taken.
+func (p *Pool) executeAll(query string) error {
+	p.mu.Lock()
+	p.session = append(p.session, query)
+	p.mu.Unlock()
+	size, _ := p.Stats()
+	conns := make([]*Connection, 0, size)
+	defer func() {
+		for _, conn := range conns {
+			p.Put(conn)
+		}
+	}()
+	for i := 0; i < size; i++ {
+		conn := p.Get()
+		conns = append(conns, conn)
+		if err := conn.Execute(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the number of connections of the pool and how many of them are idle.
+func (p *Pool) Stats() (size int, idle int) {
+	conns := p.getConns()
+	if conns == nil {
+		return 0, 0
+	}
+	return cap(conns), len(conns)
+}
+
 func (p *Pool) getConns() chan *Connection {
 	p.mu.Lock()
 	defer p.mu.Unlock()
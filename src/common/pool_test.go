@@ -96,3 +96,74 @@ func TestPool(t *testing.T) {
 
 	wg.Wait()
 }
+
+// recordingExecutor records the statements of all the connections of a
+// pool, in order, and fails the ones of errs.
+type recordingExecutor struct {
+	mu      sync.Mutex
+	queries []string
+	errs    map[string]error
+	// results are the results of the Fetch of a query, an empty one if none.
+	results map[string]*sqltypes.Result
+	closed  int
+}
+
+func (r *recordingExecutor) executor(id int) (Executor, error) {
+	return &recordingConn{r: r}, nil
+}
+
+func (r *recordingExecutor) record(query string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, query)
+	return r.errs[query]
+}
+
+type recordingConn struct {
+	r *recordingExecutor
+}
+
+func (c *recordingConn) Execute(query string) error {
+	return c.r.record(query)
+}
+
+func (c *recordingConn) Fetch(query string) (*sqltypes.Result, error) {
+	if err := c.r.record(query); err != nil {
+		return nil, err
+	}
+	if qr, ok := c.r.results[query]; ok {
+		return qr, nil
+	}
+	return &sqltypes.Result{}, nil
+}
+
+func (c *recordingConn) Ping() error {
+	return nil
+}
+
+func (c *recordingConn) Close() error {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	c.r.closed++
+	return nil
+}
+
+func TestExecutorPool(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	rec := &recordingExecutor{}
+	pool, err := NewExecutorPool(log, 2, rec.executor)
+	assert.Nil(t, err)
+
+	conn := pool.Get()
+	assert.Nil(t, conn.Use("test"))
+	assert.Nil(t, conn.Use("test"))
+	assert.Nil(t, conn.Execute("INSERT INTO `t1` VALUES (1)"))
+	_, err = conn.Fetch("SELECT 1")
+	assert.Nil(t, err)
+	_, err = conn.StreamFetch("SELECT 1")
+	assert.NotNil(t, err)
+	pool.Put(conn)
+	pool.Close()
+	assert.Equal(t, []string{"use `test`", "INSERT INTO `t1` VALUES (1)", "SELECT 1"}, rec.queries)
+	assert.Equal(t, 2, rec.closed)
+}
@@ -0,0 +1,148 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// postSQLPhase is the phase of a load running the LoadArgs.PostSQL scripts.
+const postSQLPhase = "post_sql"
+
+// PostSQLRun is the run of a script of LoadArgs.PostSQL or PostSQLOnFailure.
+type PostSQLRun struct {
+	Script string `json:"script"`
+	// OnFailure is set for a script of LoadArgs.PostSQLOnFailure.
+	OnFailure bool `json:"on_failure,omitempty"`
+	// Statements are the statements executed, the failed one too.
+	Statements   int     `json:"statements"`
+	RowsAffected uint64  `json:"rows_affected"`
+	Seconds      float64 `json:"seconds"`
+	// Error is the error of the failed statement, the script stopped there.
+	Error string `json:"error,omitempty"`
+}
+
+// postSQLScript is a script read before the restore, its statements split
+// as the ones of a dump file.
+type postSQLScript struct {
+	path       string
+	statements []statement
+}
+
+// readPostSQL reads and splits the scripts of paths, up front: a missing
+// one fails the load before anything is restored. The line comments after
+// the last statement are dropped, the server rejects an empty query.
+func readPostSQL(paths []string) ([]postSQLScript, error) {
+	var scripts []postSQLScript
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, wrapf(err, "restoring.post.sql[%s].read.error:%v", path, err)
+		}
+		script := postSQLScript{path: path}
+		for _, stmt := range splitStatements(string(data)) {
+			if lineComments(stmt.sql) {
+				continue
+			}
+			script.statements = append(script.statements, stmt)
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+// lineComments reports whether every line of sql is a line comment.
+func lineComments(sql string) bool {
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// runPostSQL runs the scripts in order on a connection of their own, in the
+// LoadArgs.PostSQLDatabase if set, once the restore returned restoreErr. The
+// session variables @go_mydumper_status and @go_mydumper_error hold its
+// status and error first, so a script of LoadArgs.PostSQLOnFailure can tell
+// what happened. The first failed statement stops the scripts, its error is
+// returned with the script, the statement and its offset.
+func runPostSQL(log *xlog.Log, args *LoadArgs, scripts []postSQLScript, onFailure bool, restoreErr error) error {
+	if len(scripts) == 0 {
+		return nil
+	}
+	pool, err := newLoadPool(log, args, 1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	if args.PostSQLDatabase != "" {
+		if err := conn.Use(args.PostSQLDatabase); err != nil {
+			return wrapf(err, "restoring.post.sql.use.database[%s].error:%v", args.PostSQLDatabase, err)
+		}
+	}
+	var restoreError string
+	if restoreErr != nil {
+		restoreError = restoreErr.Error()
+	}
+	status := fmt.Sprintf("SET @go_mydumper_status='%s', @go_mydumper_error='%s'", runStatus(restoreErr), EscapeBytes([]byte(restoreError)))
+	if err := conn.Execute(status); err != nil {
+		return wrapf(err, "restoring.post.sql.set.status.error:%v", err)
+	}
+	for _, script := range scripts {
+		run := PostSQLRun{Script: script.path, OnFailure: onFailure}
+		start := time.Now()
+		for i, stmt := range script.statements {
+			run.Statements++
+			qr, err := conn.Fetch(stmt.sql)
+			if err != nil {
+				run.Seconds = time.Since(start).Seconds()
+				run.Error = err.Error()
+				args.metrics.postSQLDone(run)
+				log.Error("restoring.post.sql[%s].statement[%d].offset[%d].failed:%s", script.path, i+1, stmt.offset, redactSQL(stmt.sql, args.logSQLMaxBytes()))
+				return wrapf(err, "restoring.post.sql[%s].statement[%d].offset[%d].error:%v", script.path, i+1, stmt.offset, err)
+			}
+			run.RowsAffected += qr.RowsAffected
+		}
+		run.Seconds = time.Since(start).Seconds()
+		args.metrics.postSQLDone(run)
+		log.Info("restoring.post.sql[%s].done.statements[%d].rows.affected[%d].cost[%.2fsec]", script.path, run.Statements, run.RowsAffected, run.Seconds)
+	}
+	return nil
+}
+
+// logPostSQLSummary logs the summary line of the post-restore scripts of a
+// load, and the failed one.
+func logPostSQLSummary(log *xlog.Log, action string, runs []PostSQLRun) {
+	if len(runs) == 0 {
+		return
+	}
+	var statements int
+	var cost float64
+	for _, run := range runs {
+		statements += run.Statements
+		cost += run.Seconds
+	}
+	logSummary(log, "%s.post.sql.scripts[%d].statements[%d].cost[%.2fsec]", action, len(runs), statements, cost)
+	for _, run := range runs {
+		if run.Error != "" {
+			logSummary(log, "%s.post.sql[%s].failed.at.statement[%d]:%s", action, run.Script, run.Statements, run.Error)
+		}
+	}
+}
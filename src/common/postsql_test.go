@@ -0,0 +1,109 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadPostSQL(t *testing.T) {
+	dir := "/tmp/readpostsql"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/a.sql", "UPDATE `t1` SET `b`='x;y';\n# the stats\nANALYZE TABLE `t1`;\n-- done\n")
+	AssertNil(x)
+
+	scripts, err := readPostSQL([]string{dir + "/a.sql"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(scripts))
+	assert.Equal(t, 2, len(scripts[0].statements))
+	assert.Equal(t, "UPDATE `t1` SET `b`='x;y'", scripts[0].statements[0].sql)
+	assert.Equal(t, "# the stats\nANALYZE TABLE `t1`", scripts[0].statements[1].sql)
+
+	_, err = readPostSQL([]string{dir + "/a.sql", dir + "/missing.sql"})
+	assert.NotNil(t, err)
+}
+
+func TestLoaderPostSQL(t *testing.T) {
+	dir := "/tmp/loaderpostsql"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir+"/dump", 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"dump/test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"dump/test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"dump/test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\n",
+		"first.sql":                   "UPDATE `t1` SET `a`=2;\n-- the stats\nANALYZE TABLE `t1`;\n",
+		"second.sql":                  "INSERT INTO `done` VALUES (NOW());\n",
+		"failure.sql":                 "INSERT INTO `failed` VALUES (@go_mydumper_status, @go_mydumper_error);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir + "/dump", User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500}
+	args.PostSQL = []string{dir + "/first.sql", dir + "/second.sql"}
+	args.PostSQLOnFailure = []string{dir + "/failure.sql"}
+	args.PostSQLDatabase = "test"
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+
+	// The scripts run in order once the restore is done, the on failure
+	// ones don't.
+	{
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"UPDATE `t1` SET `a`=2": {RowsAffected: 3}}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(report.PostSQL))
+		assert.Equal(t, PostSQLRun{Script: dir + "/first.sql", Statements: 2, RowsAffected: 3, Seconds: report.PostSQL[0].Seconds}, report.PostSQL[0])
+		assert.Equal(t, 1, report.PostSQL[1].Statements)
+		assert.Equal(t, []string{"SET @go_mydumper_status='ok', @go_mydumper_error=''"}, matchingQueries(rec.queries, "SET @go_mydumper_status"))
+		assert.Equal(t, 1, len(matchingQueries(rec.queries, "-- the stats\nANALYZE TABLE")))
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "INSERT INTO `failed`")))
+		last := len(rec.queries) - 1
+		assert.Equal(t, "INSERT INTO `done` VALUES (NOW())", rec.queries[last])
+		assert.Equal(t, "use `test`", rec.queries[last-4])
+		LogReport(log, report)
+	}
+
+	// A failed statement stops the scripts, fails the load and runs the on
+	// failure ones.
+	{
+		rec := &recordingExecutor{errs: map[string]error{"-- the stats\nANALYZE TABLE `t1`": errors.New("mock.analyze.error")}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "restoring.post.sql["+dir+"/first.sql].statement[2].offset[23].error:mock.analyze.error")
+		assert.Equal(t, RunFailed, report.Status)
+		assert.Equal(t, 2, len(report.PostSQL))
+		assert.Equal(t, "mock.analyze.error", report.PostSQL[0].Error)
+		assert.True(t, report.PostSQL[1].OnFailure)
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "INSERT INTO `done`")))
+		assert.Equal(t, 1, len(matchingQueries(rec.queries, "SET @go_mydumper_status='failed'")))
+		assert.Equal(t, 1, len(matchingQueries(rec.queries, "INSERT INTO `failed`")))
+		LogReport(log, report)
+	}
+
+	// A failed restore runs no post sql script but the on failure ones.
+	{
+		rec := &recordingExecutor{errs: map[string]error{"INSERT INTO `t1` VALUES (1)": errors.New("mock.insert.error")}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, len(report.PostSQL))
+		assert.True(t, report.PostSQL[0].OnFailure)
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "UPDATE `t1`")))
+		assert.Equal(t, 1, len(matchingQueries(rec.queries, "INSERT INTO `failed`")))
+	}
+}
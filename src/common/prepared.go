@@ -0,0 +1,185 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxPreparedPerConn caps the prepared statements of a connection, the
+	// server wide max_prepared_stmt_count is 16382 by default.
+	maxPreparedPerConn = 128
+	// maxPlaceholders is the most parameters a prepared statement takes.
+	maxPlaceholders = 65535
+)
+
+// insertShape splits a data INSERT like the dumper writes them,
+// 'INSERT INTO `t`(`a`,`b`) VALUES\n(1,'x'),\n(2,NULL)', into its shape, the
+// statement with every value replaced by a '?', and its values as SQL literals.
+// ok is false for anything else: other statements, expressions as values,
+// rows of different lengths or trailing clauses like ON DUPLICATE KEY UPDATE.
+func insertShape(query string) (shape string, values []string, ok bool) {
+	if len(query) < 6 || !strings.EqualFold(query[:6], "INSERT") {
+		return "", nil, false
+	}
+	i := valuesKeyword(query)
+	if i < 0 {
+		return "", nil, false
+	}
+	prefix := query[:i+len("VALUES")]
+	i += len("VALUES")
+
+	rows, cols := 0, -1
+	for {
+		i = skipSpaces(query, i)
+		if i >= len(query) || query[i] != '(' {
+			return "", nil, false
+		}
+		i++
+		n := 0
+		for {
+			i = skipSpaces(query, i)
+			if i >= len(query) {
+				return "", nil, false
+			}
+			j := i
+			switch c := query[i]; c {
+			case '\'', '"':
+				// A doubled quote is an escaped one, the literal goes on.
+				for j = skipQuoted(query, j); j < len(query) && query[j] == c; {
+					j = skipQuoted(query, j)
+				}
+			default:
+				for j < len(query) && query[j] != ',' && query[j] != ')' && !isSpace(query[j]) {
+					if query[j] == '(' || query[j] == '\'' || query[j] == '"' || query[j] == '`' {
+						return "", nil, false
+					}
+					j++
+				}
+			}
+			if j == i {
+				return "", nil, false
+			}
+			values = append(values, query[i:j])
+			n++
+			i = skipSpaces(query, j)
+			if i < len(query) && query[i] == ',' {
+				i++
+				continue
+			}
+			if i < len(query) && query[i] == ')' {
+				i++
+				break
+			}
+			return "", nil, false
+		}
+		if cols == -1 {
+			cols = n
+		} else if n != cols {
+			return "", nil, false
+		}
+		rows++
+		i = skipSpaces(query, i)
+		if i == len(query) {
+			break
+		}
+		if query[i] != ',' {
+			return "", nil, false
+		}
+		i++
+	}
+
+	buf := bytes.NewBufferString(prefix)
+	row := "(" + strings.Repeat("?,", cols-1) + "?)"
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(row)
+	}
+	return buf.String(), values, true
+}
+
+// valuesKeyword returns the index of the VALUES keyword of an INSERT, outside
+// of quotes and identifiers, -1 if there is none.
+func valuesKeyword(query string) int {
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(query, i)
+		case (c == 'V' || c == 'v') && i > 0 && len(query)-i > len("VALUES") &&
+			strings.EqualFold(query[i:i+len("VALUES")], "VALUES") &&
+			(isSpace(query[i-1]) || query[i-1] == ')' || query[i-1] == '`') &&
+			(isSpace(query[i+len("VALUES")]) || query[i+len("VALUES")] == '('):
+			return i
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func skipSpaces(s string, i int) int {
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+// executePrepared executes a data INSERT of database db through a prepared
+// statement of its shape, prepared once per connection and shape.
+// The driver only speaks the text protocol, so the statement is prepared with
+// PREPARE and its values are bound with user variables: 'SET @gomydumper_p1=...'
+// then 'EXECUTE ... USING @gomydumper_p1,...'. The statements which have no
+// shape, or too many values, are executed as they are.
+func executePrepared(conn *Connection, db string, query string) error {
+	shape, values, ok := insertShape(query)
+	if !ok || len(values) > maxPlaceholders {
+		return conn.Execute(query)
+	}
+
+	key := db + "." + shape
+	name, ok := conn.prepared[key]
+	if !ok {
+		if len(conn.prepared) >= maxPreparedPerConn {
+			return conn.Execute(query)
+		}
+		name = fmt.Sprintf("gomydumper_stmt%d", len(conn.prepared)+1)
+		if err := conn.Execute(fmt.Sprintf("PREPARE %s FROM '%s'", name, EscapeBytes([]byte(shape)))); err != nil {
+			return err
+		}
+		if conn.prepared == nil {
+			conn.prepared = make(map[string]string)
+		}
+		conn.prepared[key] = name
+	}
+
+	set := bytes.NewBufferString("SET ")
+	using := bytes.NewBufferString("EXECUTE " + name + " USING ")
+	for i, v := range values {
+		if i > 0 {
+			set.WriteByte(',')
+			using.WriteByte(',')
+		}
+		fmt.Fprintf(set, "@gomydumper_p%d=%s", i+1, v)
+		fmt.Fprintf(using, "@gomydumper_p%d", i+1)
+	}
+	if err := conn.Execute(set.String()); err != nil {
+		return err
+	}
+	return conn.Execute(using.String())
+}
@@ -0,0 +1,102 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreparedInsertShape(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		shape  string
+		values []string
+	}{
+		{
+			name:   "dumper insert",
+			query:  "INSERT INTO `t1`(`a`,`b`) VALUES\n(1,\"x, (y)\"),\n(NULL,'it''s')",
+			shape:  "INSERT INTO `t1`(`a`,`b`) VALUES(?,?),(?,?)",
+			values: []string{"1", "\"x, (y)\"", "NULL", "'it''s'"},
+		},
+		{
+			name:   "values in identifiers",
+			query:  "insert into `values`(`values`) values ( -1.5 , 'a\\'b' )",
+			shape:  "insert into `values`(`values`) values(?,?)",
+			values: []string{"-1.5", "'a\\'b'"},
+		},
+		{name: "not an insert", query: "SET NAMES utf8"},
+		{name: "expression", query: "INSERT INTO `t1`(`a`) VALUES\n(NOW())"},
+		{name: "introducer", query: "INSERT INTO `t1`(`a`) VALUES\n(_binary'x')"},
+		{name: "rows of different lengths", query: "INSERT INTO `t1` VALUES (1,2),(3)"},
+		{name: "trailing clause", query: "INSERT INTO `t1`(`a`) VALUES (1) ON DUPLICATE KEY UPDATE `a`=1"},
+		{name: "no values", query: "INSERT INTO `t1` SELECT * FROM `t2`"},
+		{name: "unterminated", query: "INSERT INTO `t1`(`a`) VALUES (1,'x"},
+	}
+	for _, test := range tests {
+		shape, values, ok := insertShape(test.query)
+		assert.Equal(t, test.shape != "", ok, test.name)
+		assert.Equal(t, test.shape, shape, test.name)
+		assert.Equal(t, test.values, values, test.name)
+	}
+}
+
+func TestPreparedLoader(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("prepare .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("set .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("execute .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+	}
+
+	pool, err := NewPool(log, 1, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	err = pool.WarmUp()
+	assert.Nil(t, err)
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	dir := "/tmp/preparedloadertest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", strings.Repeat("INSERT INTO `t1`(`a`,`b`) VALUES\n(1,'x');\n", 3)+"INSERT INTO `t1`(`a`,`b`) VALUES\n(2,NOW());\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/other.t1.00001.sql", "INSERT INTO `t1`(`a`,`b`) VALUES\n(1,'x');\n")
+	AssertNil(x)
+
+	args := &LoadArgs{UsePrepared: true}
+	restoreTable(log, conn, args, dir+"/test.t1.00001.sql")
+	restoreTable(log, conn, args, dir+"/other.t1.00001.sql")
+	// Prepared once per database and shape.
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("prepare gomydumper_stmt1 from 'insert into `t1`(`a`,`b`) values(?,?)'"))
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("prepare gomydumper_stmt2 from 'insert into `t1`(`a`,`b`) values(?,?)'"))
+	assert.Equal(t, 4, fakedbs.GetQueryCalledNum("set @gomydumper_p1=1,@gomydumper_p2='x'"))
+	assert.Equal(t, 3, fakedbs.GetQueryCalledNum("execute gomydumper_stmt1 using @gomydumper_p1,@gomydumper_p2"))
+	// No shape, executed as it is.
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("insert into `t1`(`a`,`b`) values\n(2,now())"))
+}
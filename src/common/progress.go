@@ -0,0 +1,40 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrCancel returned by a ProgressFunc stops the restore as a cancel of its
+// context does: Loader.Run returns context.Canceled and the status is
+// RunCancelled.
+var ErrCancel = errors.New("cancel")
+
+// ProgressFunc is the LoadConfig.OnProgress callback, st is a snapshot of the
+// progress, the same as /status, it may be kept. An error stops the restore.
+type ProgressFunc func(st *Status) error
+
+// progress calls the OnProgress callback of the run, if any, and returns the
+// error stopping the restore.
+func (args *LoadArgs) progress() error {
+	if args.onProgress == nil {
+		return nil
+	}
+	err := args.onProgress(args.metrics.snapshot())
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrCancel:
+		return context.Canceled
+	}
+	return wrapf(err, "restoring.progress.error:%v", err)
+}
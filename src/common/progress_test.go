@@ -0,0 +1,118 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressCallback(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	args := &LoadArgs{}
+	args.metrics = newMetrics(log, "load", nil, new(uint64), nil)
+
+	// No callback.
+	assert.Nil(t, args.progress())
+
+	// The snapshot of the run.
+	var got *Status
+	args.onProgress = func(st *Status) error {
+		got = st
+		return nil
+	}
+	assert.Nil(t, args.progress())
+	assert.Equal(t, "load", got.Mode)
+
+	// ErrCancel is a cancel, another error is kept.
+	args.onProgress = func(st *Status) error { return ErrCancel }
+	assert.Equal(t, context.Canceled, args.progress())
+	args.onProgress = func(st *Status) error { return errors.New("budget.exceeded") }
+	assert.Equal(t, "restoring.progress.error:budget.exceeded", args.progress().Error())
+}
+
+func TestAPILoaderOnProgress(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryDelay("insert into `t1`(`a`) values\n(1)", &sqltypes.Result{}, 2000)
+	}
+
+	dir := "/tmp/apiloaderonprogress"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int);\n")
+	AssertNil(x)
+	for i := 1; i <= 8; i++ {
+		x = WriteFile(fmt.Sprintf("%s/test.t1.%05d.sql", dir, i), "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+		AssertNil(x)
+	}
+
+	run := func(result error) (Report, error, int32) {
+		var calls int32
+		cfg := LoadConfig{
+			LoadArgs: LoadArgs{
+				Outdir:     dir,
+				User:       "mock",
+				Password:   "mock",
+				Threads:    2,
+				Address:    address,
+				IntervalMs: 50,
+			},
+			Log: log,
+			OnProgress: func(st *Status) error {
+				if atomic.AddInt32(&calls, 1) < 3 {
+					return nil
+				}
+				return result
+			},
+		}
+		report, err := NewLoader(cfg).Run(context.Background())
+		return report, err, atomic.LoadInt32(&calls)
+	}
+
+	// ErrCancel stops the blocked inserts as a cancel, no more calls.
+	{
+		start := time.Now()
+		report, err, calls := run(ErrCancel)
+		assert.True(t, time.Since(start) < time.Second, "cancelled run took %v", time.Since(start))
+		assert.Equal(t, context.Canceled, err)
+		assert.Equal(t, RunCancelled, report.Status)
+		assert.Equal(t, int32(3), calls)
+	}
+
+	// Another error fails the run.
+	{
+		report, err, _ := run(errors.New("budget.exceeded"))
+		assert.Equal(t, "restoring.progress.error:budget.exceeded", err.Error())
+		assert.Equal(t, RunFailed, report.Status)
+	}
+}
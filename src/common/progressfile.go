@@ -0,0 +1,170 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The ProgressEvent.Event of the lines of a ProgressFile.
+const (
+	// ProgressPhase is a phase started, like "schemas" or "data", with the
+	// Status; the phase "done" is the last one of a run which succeeded.
+	ProgressPhase = "phase"
+	// ProgressFileDone is a data file written or restored.
+	ProgressFileDone = "file.done"
+	// ProgressFileFailed is a data file which failed, with the Error.
+	ProgressFileFailed = "file.failed"
+	// ProgressTick is the periodic Status of the run, every IntervalMs.
+	ProgressTick = "tick"
+	// ProgressError is an error the run retried, like a deadlock.
+	ProgressError = "error"
+	// ProgressEnd is the last line of a run, with its Report.
+	ProgressEnd = "end"
+)
+
+// ProgressEvent is one line of the ProgressFile of a dump or a load. The
+// field names are stable, tools may rely on them: the Status is the one
+// served at /status by StatusListen, without its config, and the Report the
+// one Run returns.
+type ProgressEvent struct {
+	TS     string  `json:"ts"`
+	RunID  string  `json:"run_id"`
+	Mode   string  `json:"mode"`
+	Target string  `json:"target,omitempty"`
+	Event  string  `json:"event"`
+	Phase  string  `json:"phase,omitempty"`
+	File   string  `json:"file,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+	Report *Report `json:"report,omitempty"`
+	// Category is the ErrorCategory of the Error.
+	Category ErrorCategory `json:"category,omitempty"`
+}
+
+// progressFile appends the ProgressEvents of a run to its file. Every event
+// is one Write of a whole line to a file opened for appending, so a tailer
+// never reads half a line, and the file is synced at the phase boundaries,
+// so what a crash leaves of it is whole up to the last phase started.
+type progressFile struct {
+	log *xlog.Log
+	mu  sync.Mutex
+	f   *os.File
+	// m are the metrics the ticks are of, the ones of the target being
+	// restored for a load with LoadArgs.Targets.
+	m *Metrics
+	// failed is set once a write failed, the next ones are dropped.
+	failed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// openProgress opens the ProgressFile path of the run of m, nothing if path
+// is empty, and writes its ticks every interval until closeProgress.
+func (m *Metrics) openProgress(log *xlog.Log, path string, interval time.Duration) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p := &progressFile{log: log, f: f, m: m, stop: make(chan struct{}), done: make(chan struct{})}
+	m.progress = p
+	go func() {
+		defer close(p.done)
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				p.mu.Lock()
+				cur := p.m
+				p.mu.Unlock()
+				cur.progressEvent(&ProgressEvent{Event: ProgressTick, Status: cur.progressStatus()}, false)
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// follow makes the ticks of the progress file of m be of the run of target,
+// a target of a load with LoadArgs.Targets, which writes its events to it.
+func (m *Metrics) follow(target *Metrics) {
+	if m == nil || m.progress == nil {
+		return
+	}
+	target.progress = m.progress
+	m.progress.mu.Lock()
+	m.progress.m = target
+	m.progress.mu.Unlock()
+}
+
+// closeProgress writes the last line of the run, with its report, syncs
+// and closes the progress file of m.
+func (m *Metrics) closeProgress(r Report) {
+	if m == nil || m.progress == nil {
+		return
+	}
+	p := m.progress
+	close(p.stop)
+	<-p.done
+	m.progressEvent(&ProgressEvent{Event: ProgressEnd, Report: &r}, true)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.f.Close(); err != nil && !p.failed {
+		p.log.Warning("progress.file[%s].close.error:%v", p.f.Name(), err)
+	}
+	p.failed = true
+}
+
+// progressStatus returns the Status of an event, without the config.
+func (m *Metrics) progressStatus() *Status {
+	st := m.snapshot()
+	st.Config = nil
+	return st
+}
+
+// progressEvent appends ev to the progress file of m, if it has one, and
+// syncs it if sync. A failed write is logged once, the progress file is then
+// given up, the run goes on.
+func (m *Metrics) progressEvent(ev *ProgressEvent, sync bool) {
+	if m == nil || m.progress == nil {
+		return
+	}
+	p := m.progress
+	ev.TS = time.Now().UTC().Format(time.RFC3339Nano)
+	ev.RunID = m.runID
+	ev.Mode = m.mode
+	ev.Target = m.target
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failed {
+		return
+	}
+	if _, err = p.f.Write(append(data, '\n')); err == nil && sync {
+		err = p.f.Sync()
+	}
+	if err != nil {
+		p.failed = true
+		p.log.Warning("progress.file[%s].write.error.given.up:%v", p.f.Name(), err)
+	}
+}
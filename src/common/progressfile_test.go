@@ -0,0 +1,144 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// readProgressFile returns the events of a progress file, every line must
+// be a whole JSON object.
+func readProgressFile(t *testing.T, path string) []ProgressEvent {
+	data, err := ReadFile(path)
+	assert.Nil(t, err)
+	var events []ProgressEvent
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var ev ProgressEvent
+		assert.Nil(t, json.Unmarshal([]byte(line), &ev), line)
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestLoaderProgressFile(t *testing.T) {
+	dir := "/tmp/loaderprogressfile"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	files := map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+	}
+	for i := 1; i <= 20; i++ {
+		files[fmt.Sprintf("test.t1.%05d.sql", i)] = fmt.Sprintf("INSERT INTO `t1` VALUES (%d);\n", i)
+	}
+	for name, sql := range files {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	path := dir + ".progress.jsonl"
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 4, IntervalMs: 1, ProgressFile: path}
+
+	// The phases, the files and the end of the run, one whole line each.
+	{
+		os.Remove(path)
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		events := readProgressFile(t, path)
+		var phases []string
+		done := 0
+		for _, ev := range events {
+			assert.Equal(t, report.RunID, ev.RunID)
+			assert.Equal(t, "load", ev.Mode)
+			switch ev.Event {
+			case ProgressPhase:
+				phases = append(phases, ev.Phase)
+				assert.NotNil(t, ev.Status)
+				assert.Nil(t, ev.Status.Config)
+			case ProgressFileDone:
+				done++
+			}
+		}
+		assert.Equal(t, []string{"databases", "schemas", "data", "done"}, phases)
+		assert.Equal(t, 20, done)
+		last := events[len(events)-1]
+		assert.Equal(t, ProgressEnd, last.Event)
+		assert.Equal(t, RunOK, last.Report.Status)
+		assert.Equal(t, uint64(20), last.Report.FilesDone)
+	}
+
+	// A failed file and the failed run, appended to the same file.
+	{
+		before := len(readProgressFile(t, path))
+		rec := &recordingExecutor{errs: map[string]error{"INSERT INTO `t1` VALUES (7)": sqldb.NewSQLError(1062, "Duplicate entry '7' for key 'PRIMARY'")}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		events := readProgressFile(t, path)[before:]
+		var failed []ProgressEvent
+		for _, ev := range events {
+			if ev.Event == ProgressFileFailed {
+				failed = append(failed, ev)
+			}
+		}
+		assert.Equal(t, 1, len(failed))
+		assert.Equal(t, "test.t1.00007.sql", failed[0].File)
+		assert.True(t, strings.Contains(failed[0].Error, "Duplicate entry '7'"), failed[0].Error)
+		last := events[len(events)-1]
+		assert.Equal(t, ProgressEnd, last.Event)
+		assert.Equal(t, RunFailed, last.Report.Status)
+	}
+
+	// A progress file which can't be opened fails the run before it starts.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.ProgressFile = dir
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Nil(t, rec.queries)
+	}
+}
+
+func TestProgressFileTicks(t *testing.T) {
+	path := "/tmp/progressfileticks.jsonl"
+	os.Remove(path)
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	var bytes uint64 = 42
+	m := newMetrics(log, "load", nil, &bytes, nil)
+	assert.Nil(t, m.openProgress(log, path, 1))
+	for {
+		data, err := ReadFile(path)
+		assert.Nil(t, err)
+		if strings.Count(string(data), "\n") >= 3 {
+			break
+		}
+	}
+	m.closeProgress(m.report(nil))
+	// A closed progress file takes no more events.
+	m.fileDone("test.t1.00001.sql")
+
+	events := readProgressFile(t, path)
+	for _, ev := range events[:len(events)-1] {
+		assert.Equal(t, ProgressTick, ev.Event)
+		assert.Equal(t, uint64(42), ev.Status.BytesDone)
+	}
+	assert.Equal(t, ProgressEnd, events[len(events)-1].Event)
+}
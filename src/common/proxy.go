@@ -0,0 +1,172 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The LoadArgs.Compat values.
+const (
+	// CompatProxy restores through a sharding proxy, like Vitess or ProxySQL.
+	CompatProxy = "proxy"
+)
+
+// qualifyTablesRewrite is the builtin rewrite CompatProxy applies first.
+const qualifyTablesRewrite = "qualify-tables"
+
+// defaultProxyTxnMaxStatements is the LoadArgs.TxnMaxStatements of
+// CompatProxy if it's 0.
+const defaultProxyTxnMaxStatements = 100
+
+var (
+	// insertHeadRegexp matches the head of an INSERT or REPLACE statement up
+	// to its table.
+	insertHeadRegexp = regexp.MustCompile(`(?is)^\s*(?:INSERT|REPLACE)(?:\s+(?:LOW_PRIORITY|DELAYED|HIGH_PRIORITY|IGNORE))*(?:\s+INTO)?\s+`)
+	// setRegexp matches a SET statement.
+	setRegexp = regexp.MustCompile(`(?is)^\s*SET\b`)
+	// bareIdentifierRegexp matches an identifier which is not quoted.
+	bareIdentifierRegexp = regexp.MustCompile(`^[\w$]+`)
+)
+
+// quoteIdentifier quotes name with backquotes.
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// qualifyTables names the database of the statement in the table of an
+// INSERT, a REPLACE or a CREATE TABLE: `t` becomes `db`.`t`, so it runs
+// without a 'use'. A table which already names its database is left as it is.
+func qualifyTables(stmt Statement) (string, error) {
+	query := stmt.SQL
+	var head []int
+	switch stmt.Kind {
+	case StatementCreateTable:
+		head = createTableRegexp.FindStringIndex(query)
+	case StatementInsert:
+		head = insertHeadRegexp.FindStringIndex(query)
+	}
+	if head == nil || stmt.Database == "" {
+		return query, nil
+	}
+	at := head[1]
+	end := at
+	switch {
+	case at < len(query) && query[at] == '`':
+		end = skipQuoted(query, at)
+		for end < len(query) && query[end] == '`' {
+			end = skipQuoted(query, end)
+		}
+	default:
+		end += len(bareIdentifierRegexp.FindString(query[at:]))
+	}
+	if end == at || (end < len(query) && query[end] == '.') {
+		return query, nil
+	}
+	return query[:at] + quoteIdentifier(stmt.Database) + "." + query[at:], nil
+}
+
+// useDatabase selects the database db on conn, but with CompatProxy: the
+// statements name it, see qualifyTables.
+func useDatabase(conn *Connection, args *LoadArgs, db string) error {
+	if args.Compat == CompatProxy {
+		return nil
+	}
+	return conn.Use(db)
+}
+
+// proxySkipSet reports whether the statement query of file which failed with
+// err is a SET the proxy of CompatProxy doesn't support, it's then skipped
+// with a warning.
+func proxySkipSet(log *xlog.Log, args *LoadArgs, file string, query string, err error) bool {
+	if args.Compat != CompatProxy || !setRegexp.MatchString(query) {
+		return false
+	}
+	log.Warning("restoring.proxy.skip.set.file[%s]:%s, error:%v", file, redactSQL(query, args.logSQLMaxBytes()), err)
+	return true
+}
+
+// txnMaxStatements returns the statements of a transaction of a batch before
+// it's committed, 0 for no cap.
+func (args *LoadArgs) txnMaxStatements() int {
+	if args.TxnMaxStatements == 0 && args.Compat == CompatProxy {
+		return defaultProxyTxnMaxStatements
+	}
+	return args.TxnMaxStatements
+}
+
+// txnCap commits the transaction of a batch every max statements, or once it
+// has been open for maxTime, and begins the next one, see
+// LoadArgs.TxnMaxStatements and TxnMaxTimeMs. A nil txnCap never commits.
+// Every commit is recorded in the journal, so a batch which fails after one
+// is resumed after what it committed instead of restored again whole.
+type txnCap struct {
+	max     int
+	n       int
+	maxTime time.Duration
+	// began is when the transaction began.
+	began time.Time
+	// commits are the transactions committed so far.
+	commits int
+	journal *resumeJournal
+	// done are the files of the batch executed since the last commit.
+	done []string
+}
+
+// newTxnCap returns the txnCap of a transaction of a batch beginning now.
+func newTxnCap(args *LoadArgs) *txnCap {
+	return &txnCap{max: args.txnMaxStatements(), maxTime: time.Duration(args.TxnMaxTimeMs) * time.Millisecond, began: time.Now(), journal: args.journal}
+}
+
+// fileDone counts the data file executed in the transaction.
+func (c *txnCap) fileDone(file string) {
+	if c == nil {
+		return
+	}
+	c.done = append(c.done, file)
+}
+
+// statementDone counts a statement of the data file executed in the
+// transaction of conn, next is the offset of the statement after it. A commit
+// lost once it was sent may have been executed, it fails with an error which
+// isn't a gone one, so the batch isn't run again.
+func (c *txnCap) statementDone(conn *Connection, file string, next int) error {
+	if c == nil || (c.max < 1 && c.maxTime <= 0) {
+		return nil
+	}
+	c.n++
+	if (c.max < 1 || c.n < c.max) && (c.maxTime <= 0 || time.Since(c.began) < c.maxTime) {
+		return nil
+	}
+	c.n = 0
+	if err := conn.Execute("commit"); err != nil {
+		if isGoneError(err) && !isUnsentError(err) {
+			return &CategorizedError{Category: CategoryConnection, Err: fmt.Errorf("restoring.file[%s].offset[%d].server.gone.after.the.commit.was.sent.it.may.have.been.committed:%v", file, next, err)}
+		}
+		return err
+	}
+	c.commits++
+	for _, done := range c.done {
+		if err := c.journal.restored(done); err != nil {
+			return err
+		}
+	}
+	c.done = nil
+	if err := c.journal.stopped(file, next); err != nil {
+		return err
+	}
+	c.began = time.Now()
+	return conn.Execute("begin")
+}
@@ -0,0 +1,201 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyQualifyTables(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"INSERT INTO `t1`(`a`) VALUES\n(1)", "INSERT INTO `test`.`t1`(`a`) VALUES\n(1)"},
+		{"INSERT IGNORE INTO `t``x` VALUES (1)", "INSERT IGNORE INTO `test`.`t``x` VALUES (1)"},
+		{"replace low_priority t1 values (1)", "replace low_priority `test`.t1 values (1)"},
+		{"CREATE TABLE `t1` (\n  `a` int\n) ENGINE=InnoDB", "CREATE TABLE `test`.`t1` (\n  `a` int\n) ENGINE=InnoDB"},
+		{"CREATE TABLE IF NOT EXISTS `t1` (`a` int)", "CREATE TABLE IF NOT EXISTS `test`.`t1` (`a` int)"},
+		// Already qualified.
+		{"INSERT INTO `other`.`t1` VALUES (1)", "INSERT INTO `other`.`t1` VALUES (1)"},
+		{"INSERT INTO other.t1 VALUES (1)", "INSERT INTO other.t1 VALUES (1)"},
+		// Not a table statement.
+		{"SET NAMES utf8mb4", "SET NAMES utf8mb4"},
+	}
+	for _, test := range tests {
+		stmt := Statement{Kind: statementKind(test.query), Database: "test", SQL: test.query}
+		got, err := qualifyTables(stmt)
+		assert.Nil(t, err)
+		assert.Equal(t, test.want, got)
+	}
+
+	// A database with a backquote.
+	got, _ := qualifyTables(Statement{Kind: StatementInsert, Database: "a`b", SQL: "INSERT INTO `t1` VALUES (1)"})
+	assert.Equal(t, "INSERT INTO `a``b`.`t1` VALUES (1)", got)
+
+	// CompatProxy qualifies before the other rewrites.
+	args := &LoadArgs{Compat: CompatProxy, Rewrites: []string{"utf8mb3-to-utf8mb4"}}
+	got, err := rewriteStatement(args, "test.t1-schema.sql", "test", "t1", "CREATE TABLE `t1` (`a` varchar(8)) DEFAULT CHARSET=utf8")
+	assert.Nil(t, err)
+	assert.Equal(t, "CREATE TABLE `test`.`t1` (`a` varchar(8)) DEFAULT CHARSET=utf8mb4", got)
+
+	assert.Equal(t, defaultProxyTxnMaxStatements, args.txnMaxStatements())
+	args.TxnMaxStatements = 10
+	assert.Equal(t, 10, args.txnMaxStatements())
+	assert.Equal(t, 0, (&LoadArgs{}).txnMaxStatements())
+}
+
+func TestTxnCapMaxTime(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	rec := &recordingExecutor{}
+	pool, err := NewExecutorPool(log, 1, rec.executor)
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	// An open transaction older than the cap is committed after its statement.
+	{
+		txn := newTxnCap(&LoadArgs{TxnMaxTimeMs: 1})
+		time.Sleep(2 * time.Millisecond)
+		assert.Nil(t, txn.statementDone(conn, "test.t1.00001.sql", 1))
+		assert.Equal(t, 1, txn.commits)
+		assert.Equal(t, []string{"commit", "begin"}, rec.queries)
+	}
+
+	// A younger one is not, the statements cap still applies.
+	{
+		rec.queries = nil
+		txn := newTxnCap(&LoadArgs{TxnMaxTimeMs: 60000, TxnMaxStatements: 2})
+		assert.Nil(t, txn.statementDone(conn, "test.t1.00001.sql", 1))
+		assert.Equal(t, 0, txn.commits)
+		assert.Nil(t, txn.statementDone(conn, "test.t1.00001.sql", 1))
+		assert.Equal(t, 1, txn.commits)
+		assert.Equal(t, []string{"commit", "begin"}, rec.queries)
+	}
+}
+
+func TestTxnCapJournal(t *testing.T) {
+	dir := "/tmp/txncapjournal"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\nINSERT INTO `t1` VALUES (2);\n",
+		"test.t1.00002.sql":      "INSERT INTO `t1` VALUES (3);\nINSERT INTO `t1` VALUES (4);\n",
+		"test.t1.00003.sql":      "INSERT INTO `t1` VALUES (5);\nINSERT INTO `t1` VALUES (6);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500,
+		TxnBatchSize: 3, TxnMaxStatements: 2, ResumeFile: dir + "/resume.jsonl"}
+
+	// Every commit of the batch records the files it holds and the
+	// statement it ended, a failure after them rolls back the rest only.
+	{
+		rec := &recordingExecutor{errs: map[string]error{"INSERT INTO `t1` VALUES (6)": errors.New("mock.insert.error")}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		journal, x := ioutil.ReadFile(args.ResumeFile)
+		AssertNil(x)
+		assert.True(t, strings.HasSuffix(string(journal), `{"file":"test.t1.00001.sql","offset":56}
+{"file":"test.t1.00001.sql"}
+{"file":"test.t1.00002.sql","offset":56}
+`), string(journal))
+	}
+
+	// The resume goes on after what was committed.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.Resume = true
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (5)", "INSERT INTO `t1` VALUES (6)"}, matchingQueries(rec.queries, "INSERT"))
+	}
+}
+
+func TestLoaderProxyCompat(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs: the proxy refuses 'use' and the session variables.
+	{
+		fakedbs.AddQueryErrorPattern("use .*", errors.New("mock.use.unsupported"))
+		fakedbs.AddQueryErrorPattern("set .*", errors.New("mock.set.unsupported"))
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into `test`.*", &sqltypes.Result{})
+		fakedbs.AddQuery("begin", &sqltypes.Result{})
+		fakedbs.AddQuery("commit", &sqltypes.Result{})
+	}
+
+	dir := "/tmp/loaderproxy"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n")
+	AssertNil(x)
+	for i := 1; i <= 2; i++ {
+		x = WriteFile(fmt.Sprintf("%s/test.t1.%05d.sql", dir, i), "SET FOREIGN_KEY_CHECKS=0;\nINSERT INTO `t1`(`a`) VALUES\n(1);\nINSERT INTO `t1`(`a`) VALUES\n(2);\nINSERT INTO `t1`(`a`) VALUES\n(3);\n")
+		AssertNil(x)
+	}
+
+	args := LoadArgs{
+		Outdir:           dir,
+		User:             "mock",
+		Password:         "mock",
+		Address:          address,
+		Threads:          1,
+		IntervalMs:       500,
+		TxnBatchSize:     2,
+		TxnMaxStatements: 2,
+	}
+
+	// Without it, the 'use' fails.
+	{
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+	}
+
+	// With it, no 'use', qualified tables, the SETs skipped and a commit every 2 inserts.
+	{
+		args.Compat = CompatProxy
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(2), report.FilesDone)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("create table `test`.`t1` (`a` int) engine=innodb"))
+		assert.Equal(t, 6, fakedbs.GetQueryCalledNum("insert into `test`.`t1`(`a`) values\n(1)")+
+			fakedbs.GetQueryCalledNum("insert into `test`.`t1`(`a`) values\n(2)")+
+			fakedbs.GetQueryCalledNum("insert into `test`.`t1`(`a`) values\n(3)"))
+		assert.Equal(t, 4, fakedbs.GetQueryCalledNum("commit"))
+	}
+}
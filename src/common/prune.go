@@ -0,0 +1,218 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The PruneRun.Action of a run.
+const (
+	// PruneKeep is a run kept, see PruneRun.Reason.
+	PruneKeep = "keep"
+	// PruneExpired is a run past its expiry a dry run would delete.
+	PruneExpired = "expired"
+	// PruneDeleted is a run past its expiry deleted.
+	PruneDeleted = "deleted"
+)
+
+// PruneArgs are the arguments of Prune.
+type PruneArgs struct {
+	// Dir is the directory of the dump runs, a sub directory each, or the
+	// location of its storage like a bucket prefix.
+	Dir string
+	// Confirm deletes the expired runs, Prune only reports them without it.
+	Confirm bool
+	// Now is the time the expiries are compared with, the current time if
+	// zero.
+	Now time.Time
+}
+
+// PruneRun is a run of PruneArgs.Dir and what Prune did with it.
+type PruneRun struct {
+	Name      string
+	Files     int
+	Bytes     int64
+	ExpiresAt *time.Time
+	Action    string
+	// Reason is why a run is kept.
+	Reason string
+}
+
+// PruneReport are the runs Prune found, by name.
+type PruneReport struct {
+	Confirm bool
+	Runs    []PruneRun
+}
+
+// WriteReport writes the report, a line of totals then a line per run: the
+// bytes are the ones of the runs expired or deleted.
+func (r *PruneReport) WriteReport(w io.Writer) error {
+	mode := "dry-run"
+	if r.Confirm {
+		mode = "confirmed"
+	}
+	var expired, deleted, kept int
+	var bytes int64
+	for _, run := range r.Runs {
+		switch run.Action {
+		case PruneExpired:
+			expired++
+			bytes += run.Bytes
+		case PruneDeleted:
+			deleted++
+			bytes += run.Bytes
+		default:
+			kept++
+		}
+	}
+	if _, err := fmt.Fprintf(w, "prune %s: runs %d, expired %d, deleted %d, kept %d, bytes %d\n", mode, len(r.Runs), expired, deleted, kept, bytes); err != nil {
+		return err
+	}
+	for _, run := range r.Runs {
+		line := fmt.Sprintf("  %s %s", run.Name, run.Action)
+		if run.ExpiresAt != nil {
+			line += " expires_at " + run.ExpiresAt.Format(time.RFC3339)
+		}
+		if run.Reason != "" {
+			line += ": " + run.Reason
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneRun sets the Action of a run of PruneArgs.Dir from its manifest.json,
+// and the Reason it's kept: a run without a manifest, or one which doesn't
+// parse, is never deleted, it may be a dump being written or no dump at all.
+func pruneRun(s Storage, run *PruneRun, now time.Time) {
+	run.Action = PruneKeep
+	data, err := readFile(s, run.Name+"/"+manifestFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			run.Reason = "no " + manifestFile + ", it may not be a dump or a dump being written"
+		} else {
+			run.Reason = fmt.Sprintf("%s can not be read: %v", manifestFile, err)
+		}
+		return
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		run.Reason = fmt.Sprintf("%s does not parse: %v", manifestFile, err)
+		return
+	}
+	run.ExpiresAt = m.ExpiresAt
+	switch {
+	case m.Hold:
+		run.Reason = "on hold"
+	case m.ExpiresAt == nil:
+		run.Reason = "no expiry"
+	case now.Before(*m.ExpiresAt):
+		run.Reason = "not expired"
+	default:
+		run.Action = PruneExpired
+	}
+}
+
+// Prune deletes the dump runs of args.Dir past the expires_at of their
+// manifest.json, see DumpArgs.Retention: every sub directory is a run. A run
+// without a manifest, or with hold set, is kept. Without args.Confirm it's a
+// dry run, the expired runs are only reported. The files of a run are removed
+// through its storage, which must be a Remover, the manifest last: a prune
+// stopped half way deletes the rest next time. The runs spread on volumes
+// only lose the files of their directory.
+func Prune(log *xlog.Log, args PruneArgs) (*PruneReport, error) {
+	storage, err := OpenStorage(args.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := storage.List()
+	if err != nil {
+		return nil, wrapf(err, "prune.dir[%s].walk.error:%v", args.Dir, err)
+	}
+	now := args.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	// The files of every run, the ones at the top are no run's.
+	files := make(map[string][]string)
+	for _, name := range names {
+		i := strings.Index(name, "/")
+		if i < 0 {
+			if name == manifestFile {
+				return nil, &CategorizedError{Category: CategoryInvalid, Err: fmt.Errorf("prune.dir[%s].is.a.dump:prune.takes.the.directory.of.the.runs", args.Dir)}
+			}
+			continue
+		}
+		files[name[:i]] = append(files[name[:i]], name)
+	}
+	report := &PruneReport{Confirm: args.Confirm}
+	for name, runFiles := range files {
+		run := PruneRun{Name: name, Files: len(runFiles)}
+		for _, file := range runFiles {
+			if info, err := storage.Stat(file); err == nil {
+				run.Bytes += info.Size()
+			}
+		}
+		pruneRun(storage, &run, now)
+		report.Runs = append(report.Runs, run)
+	}
+	sort.Slice(report.Runs, func(i, j int) bool { return report.Runs[i].Name < report.Runs[j].Name })
+
+	for i := range report.Runs {
+		run := &report.Runs[i]
+		switch {
+		case run.Action == PruneKeep:
+			log.Info("prune.run[%s].kept:%s", run.Name, run.Reason)
+			continue
+		case !args.Confirm:
+			log.Info("prune.run[%s].expired.at[%s].files[%d].bytes[%d].dry.run", run.Name, run.ExpiresAt.Format(time.RFC3339), run.Files, run.Bytes)
+			continue
+		}
+		remover, ok := storage.(Remover)
+		if !ok {
+			return report, &CategorizedError{Category: CategoryInvalid, Err: fmt.Errorf("prune.dir[%s].storage.can.not.remove.files", args.Dir)}
+		}
+		if err := removeRun(remover, files[run.Name], run.Name); err != nil {
+			return report, &CategorizedError{Category: CategoryStorage, Err: err}
+		}
+		run.Action = PruneDeleted
+		log.Warning("prune.run[%s].expired.at[%s].deleted.files[%d].bytes[%d]", run.Name, run.ExpiresAt.Format(time.RFC3339), run.Files, run.Bytes)
+	}
+	return report, nil
+}
+
+// removeRun removes the files of a run, its manifest.json last.
+func removeRun(s Remover, files []string, run string) error {
+	manifest := run + "/" + manifestFile
+	for _, name := range files {
+		if name == manifest {
+			continue
+		}
+		if err := s.Remove(name); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("prune.run[%s].remove[%s].error:%v", run, name, err)
+		}
+	}
+	if err := s.Remove(manifest); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("prune.run[%s].remove[%s].error:%v", run, manifest, err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrune(t *testing.T) {
+	dir := "/tmp/prune"
+	os.RemoveAll(dir)
+	for _, run := range []string{"old", "held", "forever", "fresh", "nomanifest", "broken"} {
+		x := os.MkdirAll(dir+"/"+run+"/test", 0777)
+		AssertNil(x)
+		x = WriteFile(dir+"/"+run+"/test/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\n")
+		AssertNil(x)
+	}
+	for run, manifest := range map[string]string{
+		"old":     `{"version":"1.0.0","tables":[],"expires_at":"2026-01-01T00:00:00Z"}`,
+		"held":    `{"version":"1.0.0","tables":[],"expires_at":"2026-01-01T00:00:00Z","hold":true}`,
+		"forever": `{"version":"1.0.0","tables":[]}`,
+		"fresh":   `{"version":"1.0.0","tables":[],"expires_at":"2026-03-01T00:00:00Z"}`,
+		"broken":  `{"version":`,
+	} {
+		x := WriteFile(dir+"/"+run+"/manifest.json", manifest)
+		AssertNil(x)
+	}
+	x := WriteFile(dir+"/README", "the dumps of the night")
+	AssertNil(x)
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	now := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	// A dry run deletes nothing.
+	{
+		report, err := Prune(log, PruneArgs{Dir: dir, Now: now})
+		assert.Nil(t, err)
+		actions := make(map[string]string)
+		for _, run := range report.Runs {
+			actions[run.Name] = run.Action
+		}
+		assert.Equal(t, map[string]string{"broken": PruneKeep, "forever": PruneKeep, "fresh": PruneKeep, "held": PruneKeep, "nomanifest": PruneKeep, "old": PruneExpired}, actions)
+		_, err = os.Stat(dir + "/old/manifest.json")
+		assert.Nil(t, err)
+
+		out := &bytes.Buffer{}
+		assert.Nil(t, report.WriteReport(out))
+		want := "prune dry-run: runs 6, expired 1, deleted 0, kept 5, bytes 96\n" +
+			"  broken keep: manifest.json does not parse: unexpected end of JSON input\n" +
+			"  forever keep: no expiry\n" +
+			"  fresh keep expires_at 2026-03-01T00:00:00Z: not expired\n" +
+			"  held keep expires_at 2026-01-01T00:00:00Z: on hold\n" +
+			"  nomanifest keep: no manifest.json, it may not be a dump or a dump being written\n" +
+			"  old expired expires_at 2026-01-01T00:00:00Z\n"
+		assert.Equal(t, want, out.String())
+	}
+
+	// A confirmed one deletes the expired run and its directories.
+	{
+		report, err := Prune(log, PruneArgs{Dir: dir, Now: now, Confirm: true})
+		assert.Nil(t, err)
+		assert.Equal(t, PruneDeleted, report.Runs[5].Action)
+		assert.Equal(t, 2, report.Runs[5].Files)
+		_, err = os.Stat(dir + "/old")
+		assert.True(t, os.IsNotExist(err))
+		for _, run := range []string{"held", "forever", "fresh", "nomanifest", "broken"} {
+			_, err = os.Stat(dir + "/" + run + "/test/test.t1.00001.sql")
+			assert.Nil(t, err)
+		}
+		_, err = os.Stat(dir + "/README")
+		assert.Nil(t, err)
+	}
+
+	// A dump is no directory of runs.
+	{
+		_, err := Prune(log, PruneArgs{Dir: dir + "/fresh", Now: now, Confirm: true})
+		assert.NotNil(t, err)
+		assert.Equal(t, CategoryInvalid, ErrorCategoryOf(err))
+	}
+}
+
+func TestPruneStorage(t *testing.T) {
+	s, err := OpenStorage("mem://prune")
+	assert.Nil(t, err)
+	AssertNil(writeFile(s, "a/manifest.json", `{"version":"1.0.0","tables":[],"expires_at":"2026-01-01T00:00:00Z"}`))
+	AssertNil(writeFile(s, "a/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\n"))
+	AssertNil(writeFile(s, "b/manifest.json", `{"version":"1.0.0","tables":[]}`))
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+
+	report, err := Prune(log, PruneArgs{Dir: "mem://prune", Now: time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC), Confirm: true})
+	assert.Nil(t, err)
+	assert.Equal(t, PruneDeleted, report.Runs[0].Action)
+	names, err := s.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b/manifest.json"}, names)
+}
@@ -0,0 +1,159 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// tokenBucket lets rate units, bytes or rows, a second through, with a burst
+// of one second. A take larger than what's left runs the bucket into debt
+// and waits for it to be paid back, so a statement larger than the burst
+// still goes through, at the rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+	// waited is the time take waited for tokens.
+	waited time.Duration
+
+	// now and sleep are the clock, replaced by the tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// newTokenBucket lets rate units a second through, nil if rate is less than
+// 1: a nil bucket lets everything through.
+func newTokenBucket(rate int64) *tokenBucket {
+	if rate < 1 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), now: time.Now, sleep: time.Sleep}
+}
+
+// take takes n units, it waits until the bucket has them.
+func (b *tokenBucket) take(n int64) {
+	if b == nil || n < 1 {
+		return
+	}
+	b.mu.Lock()
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+		b.waited += wait
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		b.sleep(wait)
+	}
+}
+
+// waitedFor returns the time the takes waited for tokens.
+func (b *tokenBucket) waitedFor() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.waited
+}
+
+// rateLimit throttles the data statements of a load to LoadArgs.MaxBytesPerSec
+// or MaxRowsPerSec, a nil one throttles nothing.
+type rateLimit struct {
+	bucket *tokenBucket
+	// rows counts the rows of the statements instead of their bytes.
+	rows bool
+}
+
+// newRateLimit returns the rateLimit of args, nil if it sets no limit.
+func newRateLimit(args *LoadArgs) *rateLimit {
+	switch {
+	case args.MaxRowsPerSec > 0:
+		return &rateLimit{bucket: newTokenBucket(args.MaxRowsPerSec), rows: true}
+	case args.MaxBytesPerSec > 0:
+		return &rateLimit{bucket: newTokenBucket(args.MaxBytesPerSec)}
+	}
+	return nil
+}
+
+// wait waits until the data statement query can be executed.
+func (l *rateLimit) wait(query string) {
+	if l == nil {
+		return
+	}
+	if l.rows {
+		l.bucket.take(int64(insertRows(query)))
+		return
+	}
+	l.bucket.take(int64(len(query)))
+}
+
+// waitedFor returns the time the statements waited.
+func (l *rateLimit) waitedFor() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.bucket.waitedFor()
+}
+
+// logRateLimit logs the time the statements of a load waited on its limit.
+func logRateLimit(log *xlog.Log, args *LoadArgs) {
+	if args.limit.rows {
+		log.Info("restoring.max.rows.per.sec[%d].waited[%.2fsec]", args.MaxRowsPerSec, args.limit.waitedFor().Seconds())
+		return
+	}
+	log.Info("restoring.max.bytes.per.sec[%d].waited[%.2fsec]", args.MaxBytesPerSec, args.limit.waitedFor().Seconds())
+}
+
+// insertRows returns the rows of the VALUES tuples of an INSERT or a REPLACE,
+// 0 for the other statements and an INSERT ... SELECT.
+func insertRows(query string) int {
+	if !insertRegexp.MatchString(query) {
+		return 0
+	}
+	i := valuesKeyword(query)
+	if i < 0 {
+		return 0
+	}
+	rows, depth := 0, 0
+	for i += len("VALUES"); i < len(query); {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(query, i)
+			continue
+		case c == '(':
+			if depth == 0 {
+				rows++
+			}
+			depth++
+		case c == ')':
+			depth--
+		case depth == 0 && c != ',' && !isSpace(c):
+			// The tuples end, like at an ON DUPLICATE KEY UPDATE.
+			return rows
+		}
+		i++
+	}
+	return rows
+}
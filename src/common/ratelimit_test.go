@@ -0,0 +1,107 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertRows(t *testing.T) {
+	tests := []struct {
+		query string
+		rows  int
+	}{
+		{"INSERT INTO `t1`(`a`,`b`) VALUES\n(1,'x'),\n(2,NULL)", 2},
+		{"INSERT INTO `t1` VALUES (1,'(a),(b)'),(2,CONCAT('x', \"y)\")),(3,NOW())", 3},
+		{"REPLACE INTO `t1` VALUES(1)", 1},
+		{"INSERT INTO `t1` VALUES (1,'a'),(2,'b') ON DUPLICATE KEY UPDATE `b`=VALUES(`b`)", 2},
+		{"INSERT INTO `values` SELECT * FROM `t2`", 0},
+		{"SET NAMES utf8mb4", 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.rows, insertRows(test.query), test.query)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	var slept []time.Duration
+	b := newTokenBucket(100)
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+
+	// A second of burst goes through at once.
+	b.take(100)
+	assert.Nil(t, slept)
+
+	// Then the rate, a take larger than the burst too.
+	b.take(50)
+	b.take(200)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, 2 * time.Second}, slept)
+	assert.Equal(t, 2500*time.Millisecond, b.waitedFor())
+
+	// Idle time refills the bucket up to the burst only.
+	now = now.Add(time.Hour)
+	slept = nil
+	b.take(100)
+	b.take(10)
+	assert.Equal(t, []time.Duration{100 * time.Millisecond}, slept)
+
+	// A nil bucket lets everything through.
+	var none *tokenBucket
+	none.take(1 << 30)
+	assert.Nil(t, newTokenBucket(0))
+}
+
+func TestLoaderMaxRowsPerSec(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/loadermaxrowspersec"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1),(2),(3),(4),(5),(6),(7),(8),(9),(10);\nINSERT INTO `t1` VALUES (11),(12),(13),(14),(15),(16),(17),(18),(19),(20);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+
+	// 20 rows at 40 rows a second: the burst takes 40, nothing waits.
+	{
+		args := args
+		args.MaxRowsPerSec = 40
+		start := time.Now()
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: (&recordingExecutor{}).executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, time.Since(start) < 200*time.Millisecond)
+	}
+
+	// 20 rows at 10 rows a second: the second INSERT waits a second.
+	{
+		args := args
+		args.MaxRowsPerSec = 10
+		start := time.Now()
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: (&recordingExecutor{}).executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.True(t, time.Since(start) >= 900*time.Millisecond, "%v", time.Since(start))
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// defaultReadOnlyMaxWait is the LoadArgs.ReadOnlyMaxWait if it's 0.
+const defaultReadOnlyMaxWait = 300 * time.Second
+
+var (
+	// readOnlyBackoff is the wait before the first check of a read-only
+	// target, doubled at each check up to readOnlyMaxBackoff.
+	readOnlyBackoff    = time.Second
+	readOnlyMaxBackoff = 30 * time.Second
+)
+
+// readOnlyMaxWait returns the ReadOnlyMaxWait of args, the default if unset.
+func (args *LoadArgs) readOnlyMaxWait() time.Duration {
+	if args.ReadOnlyMaxWait > 0 {
+		return time.Duration(args.ReadOnlyMaxWait) * time.Second
+	}
+	return defaultReadOnlyMaxWait
+}
+
+// targetReadOnly reports whether the target of conn refuses the writes: its
+// super_read_only, or its read_only on the servers without it (MariaDB).
+func targetReadOnly(conn *Connection) (bool, error) {
+	qr, err := conn.Fetch("SELECT @@global.super_read_only, @@global.read_only")
+	if err != nil {
+		if qr, err = conn.Fetch("SELECT @@global.read_only"); err != nil {
+			return false, err
+		}
+	}
+	if len(qr.Rows) == 0 {
+		return false, fmt.Errorf("read.only.check.returned.no.rows")
+	}
+	for _, v := range qr.Rows[0] {
+		if v.String() != "0" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// waitWritable waits for the target of conn to become writable once the
+// statement of what failed with err, a read-only error: the target is checked
+// with a growing backoff, up to the readOnlyMaxWait of args. It returns nil
+// once the target is writable, the statement is then retried. err is returned
+// as it is if the target is writable right away, it was refused for another
+// reason, like --secure-file-priv. A done ctx stops the wait with its error.
+func waitWritable(ctx context.Context, log *xlog.Log, conn *Connection, args *LoadArgs, what string, err error) error {
+	if readOnly, cerr := targetReadOnly(conn); cerr == nil && !readOnly {
+		return err
+	}
+	args.metrics.retry(err)
+	args.metrics.waitingWritable(1)
+	defer args.metrics.waitingWritable(-1)
+
+	max := args.readOnlyMaxWait()
+	start := time.Now()
+	backoff := readOnlyBackoff
+	for {
+		waited := time.Since(start)
+		if waited >= max {
+			return wrapf(err, "restoring.%s.target.still.read.only.after[%v]:%v", what, max, err)
+		}
+		if backoff > max-waited {
+			backoff = max - waited
+		}
+		log.Warning("restoring.%s.waiting.for.target.to.become.writable.waited[%v].next.check.after[%v].thread[%d]:%v", what, waited.Round(time.Second), backoff, conn.ID, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		readOnly, cerr := targetReadOnly(conn)
+		if cerr != nil {
+			log.Warning("restoring.%s.read.only.check.error.thread[%d]:%v", what, conn.ID, cerr)
+		} else if !readOnly {
+			log.Warning("restoring.%s.target.writable.after[%v].resuming.thread[%d]", what, time.Since(start).Round(time.Second), conn.ID)
+			return nil
+		}
+		if backoff *= 2; backoff > readOnlyMaxBackoff {
+			backoff = readOnlyMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyWait(t *testing.T) {
+	assert.True(t, isReadOnlyError(sqldb.NewSQLError(erOptionPreventsStatement, "The MySQL server is running with the --super-read-only option so it cannot execute this statement")))
+	assert.True(t, isReadOnlyError(sqldb.NewSQLError(erReadOnlyMode, "Running in read-only mode")))
+	assert.False(t, isReadOnlyError(sqldb.NewSQLError(erLockDeadlock, "Deadlock found when trying to get lock")))
+
+	assert.Equal(t, defaultReadOnlyMaxWait, (&LoadArgs{}).readOnlyMaxWait())
+	assert.Equal(t, 10*time.Second, (&LoadArgs{ReadOnlyMaxWait: 10}).readOnlyMaxWait())
+
+	// The status says why the run doesn't move.
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	var allbytes uint64
+	m := newMetrics(log, "load", &Pool{conns: make(chan *Connection, 1)}, &allbytes, nil)
+	assert.Equal(t, "", m.snapshot().Waiting)
+	m.waitingWritable(1)
+	assert.Equal(t, "waiting for target to become writable", m.snapshot().Waiting)
+	m.waitingWritable(-1)
+	assert.Equal(t, "", m.snapshot().Waiting)
+}
+
+func TestSchemaReadOnlyTarget(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	defer func(backoff time.Duration) { readOnlyBackoff = backoff }(readOnlyBackoff)
+	readOnlyBackoff = 10 * time.Millisecond
+
+	readOnly := func(v string) *sqltypes.Result {
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{
+				{Name: "@@global.super_read_only", Type: querypb.Type_INT64},
+				{Name: "@@global.read_only", Type: querypb.Type_INT64},
+			},
+			Rows: [][]sqltypes.Value{{
+				sqltypes.MakeTrusted(querypb.Type_INT64, []byte(v)),
+				sqltypes.MakeTrusted(querypb.Type_INT64, []byte(v)),
+			}},
+		}
+	}
+	const check = "select @@global.super_read_only, @@global.read_only"
+	refused := sqldb.NewSQLError(erOptionPreventsStatement, "The MySQL server is running with the --super-read-only option so it cannot execute this statement")
+
+	dir := "/tmp/schemareadonlytest"
+	writeSchemaFiles(dir, map[string]string{
+		"test.t1": "CREATE TABLE `t1` (`id` int) ENGINE=InnoDB;\n",
+		"test.t2": "CREATE TABLE `t2` (`id` int) ENGINE=InnoDB;\n",
+	})
+	storage := NewDirStorage(dir)
+	files, err := loadFiles(storage)
+	assert.Nil(t, err)
+
+	pool, err := NewPool(log, 1, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	// The failover flips the target to super_read_only while t2 is created
+	// and back, t2 is created once it's writable and t1 is not created again.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQuery("create table `t1` (`id` int) engine=innodb", &sqltypes.Result{})
+		fakedbs.AddQueryError("create table `t2` (`id` int) engine=innodb", refused)
+		fakedbs.AddQuery(check, readOnly("1"))
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			fakedbs.ResetErrors()
+			fakedbs.AddQuery("create table `t2` (`id` int) engine=innodb", &sqltypes.Result{})
+			fakedbs.AddQuery(check, readOnly("0"))
+		}()
+
+		err := restoreTableSchemas(context.Background(), log, pool, &LoadArgs{storage: storage, ReadOnlyMaxWait: 10}, files.schemas, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("create table `t1` (`id` int) engine=innodb"))
+		assert.Equal(t, 2, fakedbs.GetQueryCalledNum("create table `t2` (`id` int) engine=innodb"))
+	}
+
+	// It stays read-only, the restore fails after the max wait.
+	{
+		fakedbs.ResetAll()
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryErrorPattern("create table .*", refused)
+		fakedbs.AddQuery(check, readOnly("1"))
+		start := time.Now()
+		err := restoreTableSchemas(context.Background(), log, pool, &LoadArgs{storage: storage, ReadOnlyMaxWait: 1}, files.schemas, 1)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "target.still.read.only.after[1s]"))
+		assert.True(t, time.Since(start) >= time.Second)
+	}
+
+	// A cancelled restore stops waiting at once.
+	{
+		fakedbs.ResetAll()
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryErrorPattern("create table .*", refused)
+		fakedbs.AddQuery(check, readOnly("1"))
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		err := restoreTableSchemas(ctx, log, pool, &LoadArgs{storage: storage, ReadOnlyMaxWait: 10}, files.schemas, 1)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), context.Canceled.Error()))
+		assert.True(t, time.Since(start) < time.Second)
+	}
+
+	// A 1290 of a writable target is not waited on.
+	{
+		fakedbs.ResetAll()
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryErrorPattern("create table .*", refused)
+		fakedbs.AddQuery(check, readOnly("0"))
+		err := restoreTableSchemas(context.Background(), log, pool, &LoadArgs{storage: storage}, files.schemas, 1)
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("create table `t1` (`id` int) engine=innodb"))
+	}
+}
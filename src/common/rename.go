@@ -0,0 +1,134 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+// maxIdentifierBytes is the longest table name MySQL accepts.
+const maxIdentifierBytes = 64
+
+var (
+	// dropTableHeadRegexp matches the head of a DROP TABLE statement up to its table.
+	dropTableHeadRegexp = regexp.MustCompile(`(?is)^\s*DROP\s+(?:TEMPORARY\s+)?TABLE\s+(?:IF\s+EXISTS\s+)?`)
+	// constraintNameRegexp matches the CONSTRAINT keyword before a quoted
+	// constraint name.
+	constraintNameRegexp = regexp.MustCompile("(?i)^CONSTRAINT\\s+`")
+	// referencesTableRegexp matches the REFERENCES keyword before the table of
+	// a FOREIGN KEY.
+	referencesTableRegexp = regexp.MustCompile(`(?i)^REFERENCES\s+`)
+)
+
+// targetTable returns the name the table of the dump is restored as, with
+// LoadArgs.TablePrefix and TableSuffix.
+func (args *LoadArgs) targetTable(table string) string {
+	return args.TablePrefix + table + args.TableSuffix
+}
+
+// renameTables rewrites the table names of the statement query of a file of
+// the database db for LoadArgs.TablePrefix and TableSuffix: the table of a
+// CREATE TABLE, an INSERT, a REPLACE or a DROP TABLE, named alone or with its
+// database, and in a CREATE TABLE the tables of db its foreign keys reference
+// and the constraint names, which are unique in a database. The other
+// statements are left as they are.
+func renameTables(args *LoadArgs, db string, query string) string {
+	if args.TablePrefix == "" && args.TableSuffix == "" {
+		return query
+	}
+	var head []int
+	kind := statementKind(query)
+	switch kind {
+	case StatementCreateTable:
+		head = createTableRegexp.FindStringIndex(query)
+	case StatementInsert:
+		head = insertHeadRegexp.FindStringIndex(query)
+	default:
+		head = dropTableHeadRegexp.FindStringIndex(query)
+	}
+	if head == nil {
+		return query
+	}
+	query, _ = renameTableAt(args, db, query, head[1], true)
+	if kind != StatementCreateTable {
+		return query
+	}
+
+	for i := head[1]; i < len(query); {
+		switch query[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(query, i)
+			continue
+		}
+		if i > 0 && isWordByte(query[i-1]) {
+			i++
+			continue
+		}
+		if match := constraintNameRegexp.FindStringIndex(query[i:]); match != nil {
+			at := i + match[1] - 1
+			end := identifierEnd(query, at)
+			name := args.targetTable(unquoteIdentifier(query[at:end]))
+			query = query[:at] + quoteIdentifier(name) + query[end:]
+			i = at + len(quoteIdentifier(name))
+			continue
+		}
+		if match := referencesTableRegexp.FindStringIndex(query[i:]); match != nil {
+			query, i = renameTableAt(args, db, query, i+match[1], false)
+			continue
+		}
+		i++
+	}
+	return query
+}
+
+// renameTableAt renames the table named at the index at of query, `t`, t or
+// `d`.`t`: always if head, else only if it's a table of db. It returns the
+// statement and the index after the table name.
+func renameTableAt(args *LoadArgs, db string, query string, at int, head bool) (string, int) {
+	first := identifierEnd(query, at)
+	if first == at {
+		return query, at
+	}
+	start, end := at, first
+	qualified := false
+	if first < len(query) && query[first] == '.' {
+		if second := identifierEnd(query, first+1); second > first+1 {
+			qualified = true
+			start, end = first+1, second
+		}
+	}
+	if !head && qualified && unquoteIdentifier(query[at:first]) != db {
+		return query, end
+	}
+	name := quoteIdentifier(args.targetTable(unquoteIdentifier(query[start:end])))
+	return query[:start] + name + query[end:], start + len(name)
+}
+
+// identifierEnd returns the index after the identifier at the index at of
+// query, quoted or bare, at if there is none.
+func identifierEnd(query string, at int) int {
+	if at < len(query) && query[at] == '`' {
+		end := skipQuoted(query, at)
+		for end < len(query) && query[end] == '`' {
+			end = skipQuoted(query, end)
+		}
+		return end
+	}
+	return at + len(bareIdentifierRegexp.FindString(query[at:]))
+}
+
+// unquoteIdentifier returns the name of the identifier, quoted or bare.
+func unquoteIdentifier(identifier string) string {
+	if len(identifier) >= 2 && identifier[0] == '`' && identifier[len(identifier)-1] == '`' {
+		return strings.Replace(identifier[1:len(identifier)-1], "``", "`", -1)
+	}
+	return identifier
+}
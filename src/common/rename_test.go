@@ -0,0 +1,132 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameTables(t *testing.T) {
+	args := &LoadArgs{TablePrefix: "test_", TableSuffix: "_v2"}
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB",
+			"CREATE TABLE `test_t1_v2` (`a` int) ENGINE=InnoDB",
+		},
+		{
+			"CREATE TABLE IF NOT EXISTS `db1`.`t1` (`a` int)",
+			"CREATE TABLE IF NOT EXISTS `db1`.`test_t1_v2` (`a` int)",
+		},
+		{
+			"INSERT INTO `t1` VALUES (1,'INSERT INTO `t1`')",
+			"INSERT INTO `test_t1_v2` VALUES (1,'INSERT INTO `t1`')",
+		},
+		{
+			"REPLACE INTO db1.t1(`a`) VALUES (1)",
+			"REPLACE INTO db1.`test_t1_v2`(`a`) VALUES (1)",
+		},
+		{
+			"DROP TABLE IF EXISTS `t1`",
+			"DROP TABLE IF EXISTS `test_t1_v2`",
+		},
+		{
+			"INSERT INTO `we``ird` VALUES (1)",
+			"INSERT INTO `test_we``ird_v2` VALUES (1)",
+		},
+		// The foreign keys of the database and the constraint names.
+		{
+			"CREATE TABLE `posts` (\n" +
+				"  `id` int NOT NULL,\n" +
+				"  `blog` int NOT NULL,\n" +
+				"  `user` int NOT NULL,\n" +
+				"  `note` varchar(64) DEFAULT 'CONSTRAINT `x` REFERENCES `y`',\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  CONSTRAINT `fk_blog` FOREIGN KEY (`blog`) REFERENCES `blogs` (`id`) ON DELETE CASCADE,\n" +
+				"  CONSTRAINT `fk_self` FOREIGN KEY (`id`) REFERENCES `db1`.`posts` (`id`),\n" +
+				"  CONSTRAINT `fk_user` FOREIGN KEY (`user`) REFERENCES `accounts`.`users` (`id`),\n" +
+				"  CONSTRAINT `chk_id` CHECK (`id` > 0)\n" +
+				") ENGINE=InnoDB",
+			"CREATE TABLE `test_posts_v2` (\n" +
+				"  `id` int NOT NULL,\n" +
+				"  `blog` int NOT NULL,\n" +
+				"  `user` int NOT NULL,\n" +
+				"  `note` varchar(64) DEFAULT 'CONSTRAINT `x` REFERENCES `y`',\n" +
+				"  PRIMARY KEY (`id`),\n" +
+				"  CONSTRAINT `test_fk_blog_v2` FOREIGN KEY (`blog`) REFERENCES `test_blogs_v2` (`id`) ON DELETE CASCADE,\n" +
+				"  CONSTRAINT `test_fk_self_v2` FOREIGN KEY (`id`) REFERENCES `db1`.`test_posts_v2` (`id`),\n" +
+				"  CONSTRAINT `test_fk_user_v2` FOREIGN KEY (`user`) REFERENCES `accounts`.`users` (`id`),\n" +
+				"  CONSTRAINT `test_chk_id_v2` CHECK (`id` > 0)\n" +
+				") ENGINE=InnoDB",
+		},
+		// The other statements are left as they are.
+		{
+			"CREATE TRIGGER `tr` BEFORE INSERT ON `t1` FOR EACH ROW SET NEW.a = 1",
+			"CREATE TRIGGER `tr` BEFORE INSERT ON `t1` FOR EACH ROW SET NEW.a = 1",
+		},
+		{
+			"SET NAMES utf8mb4",
+			"SET NAMES utf8mb4",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.out, renameTables(args, "db1", test.in))
+	}
+
+	// No prefix nor suffix.
+	{
+		assert.Equal(t, "INSERT INTO `t1` VALUES (1)", renameTables(&LoadArgs{}, "db1", "INSERT INTO `t1` VALUES (1)"))
+	}
+}
+
+func TestLoaderTablePrefix(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/loadertableprefix"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.blogs-schema.sql":  "CREATE TABLE `blogs` (`id` int NOT NULL, PRIMARY KEY (`id`)) ENGINE=InnoDB;\n",
+		"test.blogs.00001.sql":   "INSERT INTO `blogs` VALUES (1);\n",
+		"test.posts-schema.sql":  "CREATE TABLE `posts` (`id` int NOT NULL, `blog` int NOT NULL, PRIMARY KEY (`id`), CONSTRAINT `fk_blog` FOREIGN KEY (`blog`) REFERENCES `blogs` (`id`)) ENGINE=InnoDB;\n",
+		"test.posts.00001.sql":   "INSERT INTO `posts` VALUES (1,1);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+
+	// The tables, the foreign key and its target and the datas are all renamed.
+	rec := &recordingExecutor{}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, TablePrefix: "test_", OverwriteTables: true}
+	_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+	assert.Nil(t, err)
+	for _, query := range []string{
+		"DROP TABLE IF EXISTS `test`.`test_blogs`",
+		"CREATE TABLE `test_blogs` (`id` int NOT NULL, PRIMARY KEY (`id`)) ENGINE=InnoDB",
+		"DROP TABLE IF EXISTS `test`.`test_posts`",
+		"CREATE TABLE `test_posts` (`id` int NOT NULL, `blog` int NOT NULL, PRIMARY KEY (`id`), CONSTRAINT `test_fk_blog` FOREIGN KEY (`blog`) REFERENCES `test_blogs` (`id`)) ENGINE=InnoDB",
+		"INSERT INTO `test_blogs` VALUES (1)",
+		"INSERT INTO `test_posts` VALUES (1,1)",
+	} {
+		assert.Contains(t, rec.queries, query)
+	}
+	for _, query := range rec.queries {
+		assert.NotContains(t, query, "`posts`")
+		assert.NotContains(t, query, "`blogs`")
+	}
+}
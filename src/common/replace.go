@@ -0,0 +1,113 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Replacement is a literal find/replace applied to the string values of the
+// data INSERT statements on restore, like a production domain to a staging one.
+type Replacement struct {
+	Find    string
+	Replace string
+}
+
+// ParseReplacement parses a 'FIND=REPLACE' pair, split at the first '='.
+func ParseReplacement(s string) (Replacement, error) {
+	idx := strings.Index(s, "=")
+	if idx <= 0 {
+		return Replacement{}, fmt.Errorf("replacement %q must be FIND=REPLACE with a non empty FIND", s)
+	}
+	return Replacement{Find: s[:idx], Replace: s[idx+1:]}, nil
+}
+
+// replaceLiterals applies the replacements inside the quoted string literals
+// of an INSERT statement only: identifiers, keywords and numbers are left as they are.
+// The literals are matched by their value, unescaped, so Find and Replace are
+// plain values, quotes or backslashes in them are handled and a Find never
+// matches the half of an escape.
+func replaceLiterals(query string, reps []Replacement) string {
+	if len(reps) == 0 || !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "INSERT") {
+		return query
+	}
+	return mapQuotedLiterals(query, func(literal string, quote byte) string {
+		return replaceLiteral(literal, quote, reps)
+	})
+}
+
+// mapLiterals replaces the content of every quoted string literal of query
+// with fn of it, in its escaped form. Identifiers and comments are copied as
+// they are, an unterminated literal is left untouched.
+func mapLiterals(query string, fn func(literal string) string) string {
+	return mapQuotedLiterals(query, func(literal string, _ byte) string {
+		return fn(literal)
+	})
+}
+
+// mapQuotedLiterals is mapLiterals with the quote of the literal given to fn.
+// It scans query the way splitStatements does: comments and identifiers are
+// copied as they are, so a quote in them doesn't open a literal.
+func mapQuotedLiterals(query string, fn func(literal string, quote byte) string) string {
+	out := bytes.NewBuffer(make([]byte, 0, len(query)))
+	for i := 0; i < len(query); {
+		c := query[i]
+		if end := skipComment(query, i); end > i {
+			out.WriteString(query[i:end])
+			i = end
+			continue
+		}
+		switch c {
+		case '`':
+			end := skipQuoted(query, i)
+			for end < len(query) && query[end] == c {
+				end = skipQuoted(query, end)
+			}
+			out.WriteString(query[i:end])
+			i = end
+		case '\'', '"':
+			// A doubled quote is an escaped one, the literal goes on.
+			end, ok := scanQuoted(query, i)
+			for ok && end < len(query) && query[end] == c {
+				end, ok = scanQuoted(query, end)
+			}
+			if !ok {
+				// Unterminated, leave the rest untouched.
+				out.WriteString(query[i:])
+				return out.String()
+			}
+			out.WriteByte(c)
+			out.WriteString(fn(query[i+1:end-1], c))
+			out.WriteByte(c)
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String()
+}
+
+// replaceLiteral applies the replacements to the value of the literal quoted
+// with quote and escapes it again, as EscapeBytes does. A literal without a
+// Find is left as it was written.
+func replaceLiteral(literal string, quote byte, reps []Replacement) string {
+	value := unescapeLiteral(literal, quote)
+	replaced := value
+	for _, r := range reps {
+		replaced = strings.Replace(replaced, r.Find, r.Replace, -1)
+	}
+	if replaced == value {
+		return literal
+	}
+	return string(EscapeBytes([]byte(replaced)))
+}
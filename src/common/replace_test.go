@@ -0,0 +1,138 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplaceLiterals(t *testing.T) {
+	tests := []struct {
+		name  string
+		reps  []Replacement
+		query string
+		want  string
+	}{
+		{
+			name:  "literals",
+			reps:  []Replacement{{Find: "prod.example.com", Replace: "staging.example.com"}},
+			query: "INSERT INTO `t1`(`a`,`b`) VALUES\n(1,\"www.prod.example.com\"),\n(2,'prod.example.com/x')",
+			want:  "INSERT INTO `t1`(`a`,`b`) VALUES\n(1,\"www.staging.example.com\"),\n(2,'staging.example.com/x')",
+		},
+		{
+			name:  "keywords and identifiers",
+			reps:  []Replacement{{Find: "INSERT", Replace: "X"}, {Find: "VALUES", Replace: "X"}, {Find: "t1", Replace: "X"}, {Find: "1", Replace: "9"}},
+			query: "INSERT INTO `t1`(`a`) VALUES\n(1,\"a\")",
+			want:  "INSERT INTO `t1`(`a`) VALUES\n(1,\"a\")",
+		},
+		{
+			name:  "escapes",
+			reps:  []Replacement{{Find: `say "hi"`, Replace: `it's`}},
+			query: "INSERT INTO `t1`(`a`) VALUES\n(\"\\\"x\\\" say \\\"hi\\\"\")",
+			want:  "INSERT INTO `t1`(`a`) VALUES\n(\"\\\"x\\\" it\\'s\")",
+		},
+		{
+			name:  "no half of an escape",
+			reps:  []Replacement{{Find: "n", Replace: "m"}, {Find: `\`, Replace: "/"}},
+			query: "INSERT INTO `t1`(`a`) VALUES\n('a\\nb'),('c:\\\\d'),('no')",
+			want:  "INSERT INTO `t1`(`a`) VALUES\n('a\\nb'),('c:/d'),('mo')",
+		},
+		{
+			name:  "doubled quotes",
+			reps:  []Replacement{{Find: "it's", Replace: "it is"}},
+			query: "INSERT INTO `t1`(`a`) VALUES\n('it''s'),('x''y')",
+			want:  "INSERT INTO `t1`(`a`) VALUES\n('it is'),('x''y')",
+		},
+		{
+			name:  "quote in identifier",
+			reps:  []Replacement{{Find: "a", Replace: "b"}},
+			query: "INSERT INTO `t\"1`(`a`) VALUES\n(\"a\")",
+			want:  "INSERT INTO `t\"1`(`a`) VALUES\n(\"b\")",
+		},
+		{
+			name:  "quotes in comments",
+			reps:  []Replacement{{Find: "a", Replace: "b"}},
+			query: "INSERT INTO `t1`(`a`) /* don't */ VALUES -- it's\n('a'), # a'\n('a')",
+			want:  "INSERT INTO `t1`(`a`) /* don't */ VALUES -- it's\n('b'), # a'\n('b')",
+		},
+		{
+			name:  "not an insert",
+			reps:  []Replacement{{Find: "a", Replace: "b"}},
+			query: "SET NAMES 'a'",
+			want:  "SET NAMES 'a'",
+		},
+		{
+			name:  "unterminated",
+			reps:  []Replacement{{Find: "a", Replace: "b"}},
+			query: "INSERT INTO `t1`(`a`) VALUES\n(\"a",
+			want:  "INSERT INTO `t1`(`a`) VALUES\n(\"a",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, replaceLiterals(test.query, test.reps), test.name)
+	}
+}
+
+func TestReplaceParse(t *testing.T) {
+	r, err := ParseReplacement("prod.example.com=staging.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, Replacement{Find: "prod.example.com", Replace: "staging.example.com"}, r)
+
+	r, err = ParseReplacement("a=b=c")
+	assert.Nil(t, err)
+	assert.Equal(t, Replacement{Find: "a", Replace: "b=c"}, r)
+
+	r, err = ParseReplacement("a=")
+	assert.Nil(t, err)
+	assert.Equal(t, Replacement{Find: "a"}, r)
+
+	_, err = ParseReplacement("=b")
+	assert.NotNil(t, err)
+	_, err = ParseReplacement("ab")
+	assert.NotNil(t, err)
+}
+
+func TestReplaceLoader(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+	}
+
+	pool, err := NewPool(log, 1, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	dir := "/tmp/replaceloadertest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`url`) VALUES\n(\"https://prod.example.com\");\n")
+	AssertNil(x)
+
+	args := &LoadArgs{Replacements: []Replacement{{Find: "prod.example.com", Replace: "staging.example.com"}}}
+	restoreTable(log, conn, args, dir+"/test.t1.00001.sql")
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("insert into `t1`(`url`) values\n(\"https://staging.example.com\")"))
+}
@@ -0,0 +1,119 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// resolveFiles returns the dump directory of LoadArgs.Files and their names
+// in it: a relative path is in outdir, an absolute one must be, and without
+// an outdir the files must all be in one directory, which is the dump.
+func resolveFiles(outdir string, paths []string) (string, []string, error) {
+	dir := outdir
+	names := make([]string, 0, len(paths))
+	for _, file := range paths {
+		if _, _, _, err := ParseTableFile(file); err != nil {
+			return "", nil, fmt.Errorf("file %q is not a data file named 'db.table[.part]%s'", file, tableSuffix)
+		}
+		if outdir == "" {
+			if dir != "" && filepath.Dir(file) != dir {
+				return "", nil, fmt.Errorf("files %q and %q must be in one directory without a dump dir", paths[0], file)
+			}
+			dir = filepath.Dir(file)
+			names = append(names, filepath.Base(file))
+			continue
+		}
+		name := filepath.Clean(file)
+		if filepath.IsAbs(file) && storageScheme(outdir) == "" {
+			abs, err := filepath.Abs(outdir)
+			if err != nil {
+				return "", nil, err
+			}
+			if name, err = filepath.Rel(abs, file); err != nil {
+				return "", nil, fmt.Errorf("file %q is not in the dump dir %q", file, outdir)
+			}
+		}
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return "", nil, fmt.Errorf("file %q is not in the dump dir %q", file, outdir)
+		}
+		names = append(names, filepath.ToSlash(name))
+	}
+	return dir, names, nil
+}
+
+// namedFiles returns the files of a restore of LoadArgs.Files instead of the
+// whole dump: the data files names, which must be in the dump, with the
+// schema files of their tables missing on the target and the schema-create
+// files of their databases missing too. A missing table without a schema
+// file in the dump fails.
+func namedFiles(log *xlog.Log, conn *Connection, s Storage, args *LoadArgs, names []string) (*Files, error) {
+	files := &Files{}
+	seen := make(map[string]bool)
+	// dirs are the directories of the tables in the dump, their schema
+	// files are next to their data files.
+	dirs := make(map[string]string)
+	for _, name := range names {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		if _, err := s.Stat(name); err != nil {
+			return nil, wrapf(err, "restoring.files.file[%s].not.in.the.dump:%v", name, err)
+		}
+		files.tables = append(files.tables, name)
+		db, tbl, _ := parseTableFile(name)
+		dirs[db+"."+tbl] = path.Dir(name)
+	}
+	sort.Strings(files.tables)
+
+	keys := make([]string, 0, len(dirs))
+	for key := range dirs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dbs := make(map[string]bool)
+	for _, key := range keys {
+		db, tbl := splitTableName(key)
+		exists, err := tableExists(conn, db, args.targetTable(tbl))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			log.Info("restoring.files.table[%s].exists.schema.skipped", key)
+			continue
+		}
+		schema := path.Join(dirs[key], key+schemaSuffix)
+		if _, err := s.Stat(schema); err != nil {
+			return nil, fmt.Errorf("restoring.files.table[%s].is.missing.on.the.target.and.has.no.schema.file[%s]", key, schema)
+		}
+		log.Warning("restoring.files.table[%s].is.missing.on.the.target.restoring.its.schema", key)
+		files.schemas = append(files.schemas, schema)
+		if dbs[db] {
+			continue
+		}
+		dbs[db] = true
+		if exists, err = databaseExists(conn, db); err != nil {
+			return nil, err
+		}
+		create := path.Join(dirs[key], db+dbSuffix)
+		if _, err := s.Stat(create); !exists && err == nil {
+			files.databases = append(files.databases, create)
+		}
+	}
+	log.Info("restoring.files[%d].schemas[%d].databases[%d]", len(files.tables), len(files.schemas), len(files.databases))
+	return files, nil
+}
@@ -0,0 +1,116 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveFiles(t *testing.T) {
+	tests := []struct {
+		outdir string
+		paths  []string
+		dir    string
+		names  []string
+		err    bool
+	}{
+		// Relative to the dump dir, or in it.
+		{"/backups/db1", []string{"test.t1.00001.sql", "sub/../test.t2.sql"}, "/backups/db1", []string{"test.t1.00001.sql", "test.t2.sql"}, false},
+		{"/backups/db1", []string{"/backups/db1/test.t1.00001.sql"}, "/backups/db1", []string{"test.t1.00001.sql"}, false},
+		{"/backups/db1", []string{"/backups/db2/test.t1.00001.sql"}, "", nil, true},
+		{"/backups/db1", []string{"../db2/test.t1.00001.sql"}, "", nil, true},
+		// Without a dump dir, the directory of the files.
+		{"", []string{"/backups/db1/test.t1.00001.sql", "/backups/db1/test.t1.00002.sql"}, "/backups/db1", []string{"test.t1.00001.sql", "test.t1.00002.sql"}, false},
+		{"", []string{"/backups/db1/test.t1.00001.sql", "/backups/db2/test.t1.00002.sql"}, "", nil, true},
+		// Not a data file.
+		{"/backups/db1", []string{"metadata"}, "", nil, true},
+	}
+	for _, test := range tests {
+		dir, names, err := resolveFiles(test.outdir, test.paths)
+		assert.Equal(t, test.err, err != nil, test.paths)
+		assert.Equal(t, test.dir, dir, test.paths)
+		assert.Equal(t, test.names, names, test.paths)
+	}
+}
+
+func TestLoaderFiles(t *testing.T) {
+	dir := "/tmp/loaderfiles"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	files := map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\n",
+		"test.t1.00002.sql":      "INSERT INTO `t1` VALUES (2);\n",
+		"test.t2.00001.sql":      "INSERT INTO `t2` VALUES (1);\n",
+	}
+	for name, sql := range files {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 1000}
+	exists := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "COUNT(*)", Type: querypb.Type_INT64}},
+		Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_INT64, []byte("1"))}},
+	}
+
+	// A table of the target: only its file, no schema.
+	{
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			"SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA='test' AND TABLE_NAME='t1'": exists,
+			"SHOW DATABASES": {
+				Fields: []*querypb.Field{{Name: "Database", Type: querypb.Type_VARCHAR}},
+				Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("test"))}},
+			},
+		}}
+		args := args
+		args.Files = []string{"test.t1.00002.sql", dir + "/test.t1.00002.sql"}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (2)"}, matchingQueries(rec.queries, "INSERT"))
+		assert.Nil(t, matchingQueries(rec.queries, "CREATE"))
+		assert.Equal(t, uint64(1), report.FilesTotal)
+		assert.Equal(t, []string{"test.t1.00002.sql", "test.t1.00002.sql"}, report.FilesOnly)
+	}
+
+	// A table missing on the target, without a dump dir: its schema and its
+	// database first.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.Outdir = ""
+		args.Files = []string{dir + "/test.t2.00001.sql"}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"CREATE DATABASE IF NOT EXISTS `test`;"}, matchingQueries(rec.queries, "CREATE DATABASE"))
+		assert.Equal(t, []string{"CREATE TABLE `t2` (`a` int) ENGINE=InnoDB"}, matchingQueries(rec.queries, "CREATE TABLE"))
+		assert.Equal(t, []string{"INSERT INTO `t2` VALUES (1)"}, matchingQueries(rec.queries, "INSERT"))
+	}
+
+	// A file not in the dump.
+	{
+		rec := &recordingExecutor{}
+		args := args
+		args.Files = []string{"test.t3.00001.sql"}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Nil(t, matchingQueries(rec.queries, "INSERT"))
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// StatementKind classifies the statements given to a Rewriter.
+type StatementKind string
+
+// The kinds of the statements of the dump files.
+const (
+	// StatementCreateTable is a CREATE TABLE of a schema file.
+	StatementCreateTable StatementKind = "create_table"
+	// StatementInsert is an INSERT or a REPLACE of a data file.
+	StatementInsert StatementKind = "insert"
+	// StatementOther is any other statement: CREATE DATABASE, views,
+	// triggers, routines, SET.
+	StatementOther StatementKind = "other"
+)
+
+// Statement is a statement of a dump file about to be executed, after the
+// rewrites of the loader itself (definers, replacements, upsert).
+type Statement struct {
+	Kind StatementKind
+	// File is the dump file of the statement.
+	File string
+	// Database and Table are the ones of the file, Table is empty for a
+	// database schema file.
+	Database string
+	Table    string
+	SQL      string
+}
+
+// Rewriter returns the SQL to execute instead of the one of stmt, it may
+// return it as it is. An error fails the file as a failed statement does.
+type Rewriter func(stmt Statement) (string, error)
+
+// insertRegexp matches the start of an INSERT or REPLACE statement.
+var insertRegexp = regexp.MustCompile(`(?i)^\s*(INSERT|REPLACE)\b`)
+
+// statementKind classifies the statement query.
+func statementKind(query string) StatementKind {
+	switch {
+	case createTableRegexp.MatchString(query):
+		return StatementCreateTable
+	case insertRegexp.MatchString(query):
+		return StatementInsert
+	}
+	return StatementOther
+}
+
+// builtinRewrite is a rewrite of LoadArgs.Rewrites, applied to the
+// statements of its kinds.
+type builtinRewrite struct {
+	kinds   []StatementKind
+	rewrite Rewriter
+}
+
+// builtinRewrites are the rewrites of LoadArgs.Rewrites by name.
+var builtinRewrites = map[string]builtinRewrite{
+	"utf8mb3-to-utf8mb4": {kinds: []StatementKind{StatementCreateTable, StatementOther}, rewrite: utf8mb3ToUtf8mb4},
+	qualifyTablesRewrite: {kinds: []StatementKind{StatementCreateTable, StatementInsert}, rewrite: qualifyTables},
+}
+
+// BuiltinRewrites returns the names of the builtin rewrites of
+// LoadArgs.Rewrites, sorted.
+func BuiltinRewrites() []string {
+	var names []string
+	for name := range builtinRewrites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// utf8mb3ToUtf8mb4 replaces the utf8 and utf8mb3 character sets and
+// collations of a statement with the utf8mb4 ones, utf8_general_ci becomes
+// utf8mb4_general_ci, see upgradeCharsetNames. LoadArgs.UpgradeCharset also
+// shortens the keys which get too long.
+func utf8mb3ToUtf8mb4(stmt Statement) (string, error) {
+	return upgradeCharsetNames(stmt.SQL, nil), nil
+}
+
+// mapCode replaces every part of query outside the quoted strings and
+// identifiers with fn of it, the quoted ones are copied as they are.
+func mapCode(query string, fn func(code string) string) string {
+	out := bytes.NewBuffer(make([]byte, 0, len(query)))
+	start := 0
+	for i := 0; i < len(query); {
+		switch query[i] {
+		case '\'', '"', '`':
+			out.WriteString(fn(query[start:i]))
+			j := skipQuoted(query, i)
+			out.WriteString(query[i:j])
+			i, start = j, j
+		default:
+			i++
+		}
+	}
+	out.WriteString(fn(query[start:]))
+	return out.String()
+}
+
+// rewriteStatement applies the builtin rewrites of args.Rewrites, then the
+// rewriters of the LoadConfig for the kind of the statement query of file,
+// all in their order. CompatProxy applies qualify-tables first.
+func rewriteStatement(args *LoadArgs, file string, db string, table string, query string) (string, error) {
+	rewrites := args.Rewrites
+	if args.Compat == CompatProxy {
+		rewrites = append([]string{qualifyTablesRewrite}, rewrites...)
+	}
+	if len(rewrites) == 0 && len(args.rewriters) == 0 {
+		return query, nil
+	}
+	stmt := Statement{Kind: statementKind(query), File: file, Database: db, Table: table, SQL: query}
+	for _, name := range rewrites {
+		builtin := builtinRewrites[name]
+		for _, kind := range builtin.kinds {
+			if kind != stmt.Kind {
+				continue
+			}
+			sql, err := builtin.rewrite(stmt)
+			if err != nil {
+				return "", fmt.Errorf("rewrite[%s]:%v", name, err)
+			}
+			stmt.SQL = sql
+		}
+	}
+	for i, rewriter := range args.rewriters[stmt.Kind] {
+		sql, err := rewriter(stmt)
+		if err != nil {
+			return "", fmt.Errorf("rewriter[%s.%d]:%v", stmt.Kind, i, err)
+		}
+		stmt.SQL = sql
+	}
+	return stmt.SQL, nil
+}
@@ -0,0 +1,126 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteStatementKind(t *testing.T) {
+	assert.Equal(t, StatementCreateTable, statementKind("CREATE TABLE `t1` (`a` int)"))
+	assert.Equal(t, StatementCreateTable, statementKind("\ncreate table if not exists `t1` (`a` int)"))
+	assert.Equal(t, StatementInsert, statementKind("INSERT INTO `t1` VALUES (1)"))
+	assert.Equal(t, StatementInsert, statementKind("REPLACE INTO `t1` VALUES (1)"))
+	assert.Equal(t, StatementOther, statementKind("CREATE DATABASE IF NOT EXISTS `test`"))
+	assert.Equal(t, StatementOther, statementKind("CREATE VIEW `v1` AS SELECT 1"))
+	assert.Equal(t, StatementOther, statementKind("SET NAMES utf8"))
+}
+
+func TestRewriteUtf8mb3(t *testing.T) {
+	rewrite := func(sql string) string {
+		out, err := utf8mb3ToUtf8mb4(Statement{Kind: StatementCreateTable, SQL: sql})
+		assert.Nil(t, err)
+		return out
+	}
+	assert.Equal(t,
+		"CREATE TABLE `t1` (`a` varchar(10) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci",
+		rewrite("CREATE TABLE `t1` (`a` varchar(10) CHARACTER SET utf8 COLLATE utf8_bin) ENGINE=InnoDB DEFAULT CHARSET=utf8 COLLATE=utf8_general_ci"))
+	assert.Equal(t,
+		"CREATE TABLE `t1` (`a` text) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci",
+		rewrite("CREATE TABLE `t1` (`a` text) DEFAULT CHARSET=utf8mb3 COLLATE=utf8mb3_unicode_520_ci"))
+	assert.Equal(t, "CREATE DATABASE `test` DEFAULT CHARACTER SET utf8mb4", rewrite("CREATE DATABASE `test` DEFAULT CHARACTER SET UTF8"))
+
+	// utf8mb4, the quoted identifiers and strings and the other words are left as they are.
+	for _, sql := range []string{
+		"CREATE TABLE `t1` (`a` text) DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin",
+		"CREATE TABLE `utf8` (`utf8_bin` text COMMENT 'utf8 text') DEFAULT CHARSET=latin1",
+		"CREATE TABLE `t1` (`a` text DEFAULT 'it''s utf8') DEFAULT CHARSET=latin1",
+		"CREATE TABLE `t1` (`utf8x` int, `a_utf8` int)",
+	} {
+		assert.Equal(t, sql, rewrite(sql))
+	}
+}
+
+func TestRewriteStatement(t *testing.T) {
+	args := &LoadArgs{}
+
+	// Nothing to apply.
+	{
+		out, err := rewriteStatement(args, "test.t1-schema.sql", "test", "t1", "CREATE TABLE `t1` (`a` text) CHARSET=utf8")
+		assert.Nil(t, err)
+		assert.Equal(t, "CREATE TABLE `t1` (`a` text) CHARSET=utf8", out)
+	}
+
+	// The builtins to their kinds only, then the rewriters of the kind in order.
+	{
+		var got []Statement
+		args.Rewrites = []string{"utf8mb3-to-utf8mb4"}
+		args.rewriters = map[StatementKind][]Rewriter{
+			StatementCreateTable: {
+				func(stmt Statement) (string, error) {
+					got = append(got, stmt)
+					return stmt.SQL + " ROW_FORMAT=DYNAMIC", nil
+				},
+				func(stmt Statement) (string, error) {
+					return strings.Replace(stmt.SQL, "MyISAM", "InnoDB", 1), nil
+				},
+			},
+		}
+		out, err := rewriteStatement(args, "test.t1-schema.sql", "test", "t1", "CREATE TABLE `t1` (`a` text) ENGINE=MyISAM CHARSET=utf8")
+		assert.Nil(t, err)
+		assert.Equal(t, "CREATE TABLE `t1` (`a` text) ENGINE=InnoDB CHARSET=utf8mb4 ROW_FORMAT=DYNAMIC", out)
+		want := Statement{
+			Kind:     StatementCreateTable,
+			File:     "test.t1-schema.sql",
+			Database: "test",
+			Table:    "t1",
+			SQL:      "CREATE TABLE `t1` (`a` text) ENGINE=MyISAM CHARSET=utf8mb4",
+		}
+		assert.Equal(t, []Statement{want}, got)
+
+		out, err = rewriteStatement(args, "test.t1.00001.sql", "test", "t1", "INSERT INTO `t1` VALUES ('utf8')")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT INTO `t1` VALUES ('utf8')", out)
+		assert.Equal(t, 1, len(got))
+	}
+
+	// An error names the rewriter.
+	{
+		args.rewriters = map[StatementKind][]Rewriter{
+			StatementInsert: {func(stmt Statement) (string, error) { return "", errors.New("no inserts") }},
+		}
+		_, err := rewriteStatement(args, "test.t1.00001.sql", "test", "t1", "INSERT INTO `t1` VALUES (1)")
+		assert.Equal(t, "rewriter[insert.0]:no inserts", err.Error())
+	}
+}
+
+func TestRewriteTableFile(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/rewritetest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\nINSERT INTO `t1` VALUES (2);\n")
+	AssertNil(x)
+
+	// A failed rewriter fails the file before the statement is executed.
+	args := &LoadArgs{rewriters: map[StatementKind][]Rewriter{
+		StatementInsert: {func(stmt Statement) (string, error) { return "", errors.New("refused") }},
+	}}
+	_, err := executeTableFile(log, nil, args, dir+"/test.t1.00001.sql", nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, "restoring.rewrite.file["+dir+"/test.t1.00001.sql].offset[0].error:rewriter[insert.0]:refused", err.Error())
+}
@@ -0,0 +1,151 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/common"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+var (
+	// rollbackDropRegexp matches a statement of a rollback file, after its
+	// comment lines.
+	rollbackDropRegexp = regexp.MustCompile(`(?is)^(?:\s*(?:--|#)[^\n]*\n)*\s*(DROP\s+(?:TABLE|VIEW|DATABASE)\s+IF\s+EXISTS\s+.+)$`)
+	// rollbackSetRegexp matches the SET FOREIGN_KEY_CHECKS=0 of the head of a
+	// rollback file, after its comment lines.
+	rollbackSetRegexp = regexp.MustCompile(`(?is)^(?:\s*(?:--|#)[^\n]*\n)*\s*SET\s+FOREIGN_KEY_CHECKS\s*=\s*0$`)
+)
+
+// rollbackLog writes the DROP statements of the objects a restore creates to
+// LoadArgs.RollbackFile, each one synced once its object is created, so the
+// file is complete up to a crash. A nil *rollbackLog writes nothing.
+type rollbackLog struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	objects int
+}
+
+// openRollbackLog creates the rollback file path of a restore of outdir, nil
+// if path is empty.
+func openRollbackLog(path string, outdir string) (*rollbackLog, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, wrapf(err, "restoring.rollback.file[%s].error:%v", path, err)
+	}
+	r := &rollbackLog{path: path, f: f}
+	head := fmt.Sprintf("-- Rollback of the restore of %s started at %s, the objects it created:\n"+
+		"-- run it with 'go-mydumper load -rollback %s'.\nSET FOREIGN_KEY_CHECKS=0;\n", outdir, time.Now().Format(time.RFC3339), path)
+	if err := r.write(head); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// write appends s to the file and syncs it.
+func (r *rollbackLog) write(s string) error {
+	if _, err := r.f.WriteString(s); err != nil {
+		return wrapf(err, "restoring.rollback.file[%s].error:%v", r.path, err)
+	}
+	if err := r.f.Sync(); err != nil {
+		return wrapf(err, "restoring.rollback.file[%s].error:%v", r.path, err)
+	}
+	return nil
+}
+
+// createdDatabase records the database db created by the restore.
+func (r *rollbackLog) createdDatabase(db string) error {
+	return r.created(fmt.Sprintf("DROP DATABASE IF EXISTS %s;\n", quoteIdentifier(db)))
+}
+
+// createdTable records the table db.table created by the restore.
+func (r *rollbackLog) createdTable(db string, table string) error {
+	return r.created(fmt.Sprintf("DROP TABLE IF EXISTS %s.%s;\n", quoteIdentifier(db), quoteIdentifier(table)))
+}
+
+func (r *rollbackLog) created(drop string) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.write(drop); err != nil {
+		return err
+	}
+	r.objects++
+	return nil
+}
+
+// close closes the file and logs the objects it has.
+func (r *rollbackLog) close(log *xlog.Log) {
+	if r == nil {
+		return
+	}
+	r.f.Close()
+	log.Info("restoring.rollback.file[%s].objects[%d]", r.path, r.objects)
+}
+
+// ReadRollbackFile reads the DROP statements of a rollback file, see
+// LoadArgs.RollbackFile, in the order they are run: the last created object
+// first. A file with another statement is refused as a whole.
+func ReadRollbackFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var drops []string
+	for _, stmt := range splitStatements(common.BytesToString(data)) {
+		if rollbackSetRegexp.MatchString(stmt.sql) {
+			continue
+		}
+		match := rollbackDropRegexp.FindStringSubmatch(stmt.sql)
+		if match == nil {
+			return nil, fmt.Errorf("rollback.file[%s].offset[%d].not.a.drop.if.exists:%s", path, stmt.offset, redactSQL(stmt.sql, defaultLogSQLMaxBytes))
+		}
+		drops = append([]string{match[1]}, drops...)
+	}
+	return drops, nil
+}
+
+// Rollback runs the drops of ReadRollbackFile on the target of args, with
+// the foreign key checks off. The first error stops it, the drops done are
+// not undone but running it again goes on: they all have IF EXISTS.
+func Rollback(log *xlog.Log, args *LoadArgs, drops []string) error {
+	pool, err := newLoadPool(log, args, 1)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	if err := conn.Execute("SET FOREIGN_KEY_CHECKS=0"); err != nil {
+		return err
+	}
+	for i, drop := range drops {
+		if err := conn.Execute(drop); err != nil {
+			return wrapf(err, "rollback.statement[%d/%d].error:%v", i+1, len(drops), err)
+		}
+		log.Info("rollback.statement[%d/%d]:%s", i+1, len(drops), drop)
+	}
+	log.Info("rollback.done.statements[%d]", len(drops))
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollbackFile(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/rollbackfile"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	path := dir + "/rollback.sql"
+
+	// The drops are in the file as soon as the objects are created.
+	{
+		r, err := openRollbackLog(path, "/data/dump")
+		assert.Nil(t, err)
+		assert.Nil(t, r.createdDatabase("test"))
+		assert.Nil(t, r.createdTable("test", "t1"))
+		assert.Nil(t, r.createdTable("other", "t`2"))
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(string(data), "-- Rollback of the restore of /data/dump started at "))
+		assert.True(t, strings.HasSuffix(string(data), "SET FOREIGN_KEY_CHECKS=0;\n"+
+			"DROP DATABASE IF EXISTS `test`;\nDROP TABLE IF EXISTS `test`.`t1`;\nDROP TABLE IF EXISTS `other`.`t``2`;\n"))
+		r.close(log)
+	}
+
+	// Read back, the last created first.
+	{
+		drops, err := ReadRollbackFile(path)
+		assert.Nil(t, err)
+		want := []string{"DROP TABLE IF EXISTS `other`.`t``2`", "DROP TABLE IF EXISTS `test`.`t1`", "DROP DATABASE IF EXISTS `test`"}
+		assert.Equal(t, want, drops)
+	}
+
+	// Only drops.
+	{
+		x := WriteFile(path, "SET FOREIGN_KEY_CHECKS=0;\nDROP TABLE IF EXISTS `test`.`t1`;\nDELETE FROM `test`.`t2`;\n")
+		AssertNil(x)
+		_, err := ReadRollbackFile(path)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "not.a.drop.if.exists"))
+	}
+
+	// Without a file nothing is written.
+	{
+		r, err := openRollbackLog("", "/data/dump")
+		assert.Nil(t, err)
+		assert.Nil(t, r)
+		assert.Nil(t, r.createdTable("test", "t1"))
+		r.close(log)
+	}
+}
+
+func TestLoaderRollbackFile(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs: the database and t1 exist, t2 doesn't.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("drop .*", &sqltypes.Result{})
+		fakedbs.AddQuery("set foreign_key_checks=0", &sqltypes.Result{})
+		fakedbs.AddQuery("select count(*) from information_schema.schemata where schema_name='test'", singleResult("COUNT(*)", "1"))
+		fakedbs.AddQuery("select count(*) from information_schema.schemata where schema_name='other'", singleResult("COUNT(*)", "0"))
+		fakedbs.AddQuery("select count(*) from information_schema.tables where table_schema='test' and table_name='t1'", singleResult("COUNT(*)", "1"))
+		fakedbs.AddQuery("select count(*) from information_schema.tables where table_schema='test' and table_name='t2'", singleResult("COUNT(*)", "0"))
+		fakedbs.AddQuery("select count(*) from information_schema.tables where table_schema='other' and table_name='t3'", singleResult("COUNT(*)", "0"))
+	}
+
+	dir := "/tmp/loaderrollback"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql":  "CREATE DATABASE IF NOT EXISTS `test`;",
+		"other-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `other`;",
+		"test.t1-schema.sql":      "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t2-schema.sql":      "CREATE TABLE `t2` (`a` int) ENGINE=InnoDB;\n",
+		"other.t3-schema.sql":     "CREATE TABLE `t3` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":       "INSERT INTO `t1` VALUES (1);\n",
+		"test.t2.00001.sql":       "INSERT INTO `t2` VALUES (1);\n",
+		"other.t3.00001.sql":      "INSERT INTO `t3` VALUES (1);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	path := "/tmp/loaderrollback.sql"
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: address, Threads: 2, IntervalMs: 500,
+		CreateIfNotExists: true, RollbackFile: path}
+
+	// The existing database and t1 are not in the rollback file.
+	{
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+		drops, err := ReadRollbackFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(drops))
+		assert.Equal(t, "DROP DATABASE IF EXISTS `other`", drops[2])
+		data, _ := ioutil.ReadFile(path)
+		assert.True(t, strings.Contains(string(data), "DROP TABLE IF EXISTS `test`.`t2`;"))
+		assert.True(t, strings.Contains(string(data), "DROP TABLE IF EXISTS `other`.`t3`;"))
+		assert.False(t, strings.Contains(string(data), "`t1`"))
+		assert.False(t, strings.Contains(string(data), "DROP DATABASE IF EXISTS `test`"))
+	}
+
+	// The rollback drops them.
+	{
+		drops, err := ReadRollbackFile(path)
+		assert.Nil(t, err)
+		err = Rollback(log, &args, drops)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("drop table if exists `test`.`t2`"))
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("drop database if exists `other`"))
+		assert.Equal(t, 0, fakedbs.GetQueryCalledNum("drop table if exists `test`.`t1`"))
+	}
+}
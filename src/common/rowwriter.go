@@ -0,0 +1,239 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+// The DumpArgs.Format of the data files.
+const (
+	// FormatSQL writes multi-row INSERT statements, the only format the loader restores.
+	FormatSQL = "sql"
+	// FormatCSV writes CSV files for LOAD DATA, see README.
+	FormatCSV = "csv"
+	// FormatJSONL writes a JSON object per row, with a sidecar file of the
+	// columns of every table, see jsonlRowWriter.
+	FormatJSONL = "jsonl"
+)
+
+// RowWriter encodes the rows of a table into the content of its data files.
+// The dumper cuts the files by size above it: BeginTable, then WriteRow for
+// every row with EndChunk whenever a file is full, and EndTable.
+type RowWriter interface {
+	// BeginTable starts the table with the names of the selected columns.
+	BeginTable(table string, columns []string)
+	// WriteRow encodes a row and returns its size, the dumper counts it
+	// towards the chunk size and the dumped bytes.
+	WriteRow(row []sqltypes.Value) int
+	// EndChunk returns the content of the data file of the rows written since
+	// the last one.
+	EndChunk() []byte
+	// EndTable ends the table, the writer may be used for another one.
+	EndTable()
+}
+
+// rowFormat is a format of the data files: their suffix and their RowWriter.
+type rowFormat struct {
+	suffix string
+	writer func(args *DumpArgs) RowWriter
+	// columns writes the sidecar file of the columns of a table with the
+	// fields of its rows and its schema, nil if the format has none.
+	columns func(args *DumpArgs, table string, fields []*querypb.Field, schema string) error
+}
+
+// rowFormats are the formats by DumpArgs.Format.
+var rowFormats = map[string]rowFormat{
+	FormatSQL: {
+		suffix: tableSuffix,
+		writer: func(args *DumpArgs) RowWriter {
+			return &sqlRowWriter{stmtSize: args.StmtSize, axisOrder: args.axisOrder()}
+		},
+	},
+	FormatCSV: {
+		suffix: ".csv",
+		writer: func(args *DumpArgs) RowWriter { return &csvRowWriter{} },
+	},
+	FormatJSONL: {
+		suffix:  ".jsonl",
+		writer:  func(args *DumpArgs) RowWriter { return &jsonlRowWriter{loc: args.timeZone()} },
+		columns: writeJSONLColumns,
+	},
+}
+
+// format returns the format of the data files, FormatSQL if unset.
+func (args *DumpArgs) format() rowFormat {
+	if args.Format == "" {
+		return rowFormats[FormatSQL]
+	}
+	return rowFormats[args.Format]
+}
+
+// axisOrder reports whether the source has the axis-order option of
+// ST_GeomFromWKB, MySQL 8.0 or later.
+func (args *DumpArgs) axisOrder() bool {
+	v, ok := parseServerVersion(args.serverVersion)
+	return ok && !v.mariadb && v.major >= 8
+}
+
+// isNumber reports whether v is written unquoted.
+func isNumber(v sqltypes.Value) bool {
+	return v.IsSigned() || v.IsUnsigned() || v.IsFloat() || v.IsIntegral() || v.Type() == querypb.Type_DECIMAL
+}
+
+// sqlValue encodes a value as a SQL literal.
+func sqlValue(v sqltypes.Value) string {
+	switch {
+	case v.Raw() == nil:
+		return "NULL"
+	case isNumber(v):
+		return v.String()
+	default:
+		return fmt.Sprintf("\"%s\"", EscapeBytes(v.Raw()))
+	}
+}
+
+// geometryValue encodes a GEOMETRY value, which MySQL stores as its SRID in 4
+// little endian bytes then its WKB, as ST_GeomFromWKB of the WKB in hex with
+// the SRID: a column of MySQL 8.0 restricted to the SRID rejects a value of
+// another one. MySQL 8.0 stores the coordinates of a geographic SRID, like
+// 4326, longitude first but reads a WKB in the order of the SRID, latitude
+// first, so with axisOrder the WKB of a SRID is read 'axis-order=long-lat' and
+// the value is restored byte for byte. A value too short for a SRID is written
+// as a string.
+func geometryValue(raw []byte, axisOrder bool) string {
+	if len(raw) < 4 {
+		return fmt.Sprintf("\"%s\"", EscapeBytes(raw))
+	}
+	srid := binary.LittleEndian.Uint32(raw[:4])
+	if axisOrder && srid != 0 {
+		return fmt.Sprintf("ST_GeomFromWKB(0x%s, %d, 'axis-order=long-lat')", hex.EncodeToString(raw[4:]), srid)
+	}
+	return fmt.Sprintf("ST_GeomFromWKB(0x%s, %d)", hex.EncodeToString(raw[4:]), srid)
+}
+
+// sqlRowWriter writes INSERT statements of about stmtSize bytes of rows.
+// axisOrder is set if the source has the axis-order option of
+// ST_GeomFromWKB, see geometryValue.
+type sqlRowWriter struct {
+	stmtSize  int
+	axisOrder bool
+	insert    string
+	rows      []string
+	size      int
+	inserts   []string
+}
+
+func (w *sqlRowWriter) BeginTable(table string, columns []string) {
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, fmt.Sprintf("`%s`", column))
+	}
+	w.insert = fmt.Sprintf("INSERT INTO `%s`(%s) VALUES\n", table, strings.Join(quoted, ","))
+}
+
+func (w *sqlRowWriter) WriteRow(row []sqltypes.Value) int {
+	values := make([]string, 0, len(row))
+	for _, v := range row {
+		if v.Type() == querypb.Type_GEOMETRY && v.Raw() != nil {
+			values = append(values, geometryValue(v.Raw(), w.axisOrder))
+			continue
+		}
+		values = append(values, sqlValue(v))
+	}
+	r := "(" + strings.Join(values, ",") + ")"
+	w.rows = append(w.rows, r)
+	w.size += len(r)
+	if w.size >= w.stmtSize {
+		w.flush()
+	}
+	return len(r)
+}
+
+// flush ends the INSERT of the pending rows.
+func (w *sqlRowWriter) flush() {
+	if len(w.rows) == 0 {
+		return
+	}
+	w.inserts = append(w.inserts, w.insert+strings.Join(w.rows, ",\n"))
+	w.rows = w.rows[:0]
+	w.size = 0
+}
+
+func (w *sqlRowWriter) EndChunk() []byte {
+	w.flush()
+	data := strings.Join(w.inserts, ";\n") + ";\n"
+	w.inserts = w.inserts[:0]
+	return []byte(data)
+}
+
+func (w *sqlRowWriter) EndTable() {
+	w.rows = w.rows[:0]
+	w.inserts = w.inserts[:0]
+	w.size = 0
+}
+
+// csvValue encodes a value as a field of LOAD DATA with its default escaping:
+// NULL is \N, the strings are enclosed by '"' and escaped as SQL literals.
+func csvValue(v sqltypes.Value) string {
+	switch {
+	case v.Raw() == nil:
+		return `\N`
+	case isNumber(v):
+		return v.String()
+	default:
+		return fmt.Sprintf("\"%s\"", EscapeBytes(v.Raw()))
+	}
+}
+
+// csvRowWriter writes a header line of the column names then a line per row.
+type csvRowWriter struct {
+	header string
+	buf    []byte
+}
+
+func (w *csvRowWriter) BeginTable(table string, columns []string) {
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, fmt.Sprintf("\"%s\"", EscapeBytes([]byte(column))))
+	}
+	w.header = strings.Join(quoted, ",") + "\n"
+}
+
+func (w *csvRowWriter) WriteRow(row []sqltypes.Value) int {
+	if len(w.buf) == 0 {
+		w.buf = append(w.buf, w.header...)
+	}
+	n := len(w.buf)
+	for i, v := range row {
+		if i > 0 {
+			w.buf = append(w.buf, ',')
+		}
+		w.buf = append(w.buf, csvValue(v)...)
+	}
+	w.buf = append(w.buf, '\n')
+	return len(w.buf) - n
+}
+
+func (w *csvRowWriter) EndChunk() []byte {
+	data := w.buf
+	w.buf = nil
+	return data
+}
+
+func (w *csvRowWriter) EndTable() {
+	w.buf = nil
+}
@@ -0,0 +1,250 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRowWriterEscape checks the encoding of the same values by every format.
+func TestRowWriterEscape(t *testing.T) {
+	tests := []struct {
+		value sqltypes.Value
+		sql   string
+		csv   string
+		jsonl string
+	}{
+		{
+			value: sqltypes.NULL,
+			sql:   `NULL`,
+			csv:   `\N`,
+			jsonl: `null`,
+		},
+		{
+			value: sqltypes.MakeTrusted(querypb.Type_INT32, []byte("-11")),
+			sql:   `-11`,
+			csv:   `-11`,
+			jsonl: `-11`,
+		},
+		{
+			value: sqltypes.MakeTrusted(querypb.Type_DECIMAL, []byte("210.01")),
+			sql:   `210.01`,
+			csv:   `210.01`,
+			jsonl: `210.01`,
+		},
+		{
+			value: sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("")),
+			sql:   `""`,
+			csv:   `""`,
+			jsonl: `""`,
+		},
+		{
+			value: sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("NULL")),
+			sql:   `"NULL"`,
+			csv:   `"NULL"`,
+			jsonl: `"NULL"`,
+		},
+		{
+			value: sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("a,b \"c\" 'd'")),
+			sql:   `"a,b \"c\" \'d\'"`,
+			csv:   `"a,b \"c\" \'d\'"`,
+			jsonl: `"a,b \"c\" 'd'"`,
+		},
+		{
+			value: sqltypes.MakeTrusted(querypb.Type_BLOB, []byte("\\\x00\n\r\t\x1a")),
+			sql:   `"\\\0\n\r\t\Z"`,
+			csv:   `"\\\0\n\r\t\Z"`,
+			jsonl: `"XAAKDQka"`,
+		},
+		{
+			value: sqltypes.MakeTrusted(querypb.Type_DATETIME, []byte("2017-09-07 11:44:21")),
+			sql:   `"2017-09-07 11:44:21"`,
+			csv:   `"2017-09-07 11:44:21"`,
+			jsonl: `"2017-09-07T11:44:21Z"`,
+		},
+	}
+	jsonl := &jsonlRowWriter{loc: time.UTC}
+	for _, test := range tests {
+		assert.Equal(t, test.sql, sqlValue(test.value))
+		assert.Equal(t, test.csv, csvValue(test.value))
+		assert.Equal(t, test.jsonl, jsonl.value(test.value))
+	}
+}
+
+func rowWriterRows() [][]sqltypes.Value {
+	return [][]sqltypes.Value{
+		{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")), sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("x"))},
+		{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("2")), sqltypes.NULL},
+		{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("3")), sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("z"))},
+	}
+}
+
+func TestRowWriterSQL(t *testing.T) {
+	w := rowFormats[FormatSQL].writer(&DumpArgs{StmtSize: 10})
+	w.BeginTable("t1", []string{"a", "b"})
+	rows := rowWriterRows()
+
+	// A new INSERT every 10 bytes of rows, the pending rows end the chunk.
+	assert.Equal(t, len(`(1,"x")`), w.WriteRow(rows[0]))
+	w.WriteRow(rows[1])
+	w.WriteRow(rows[2])
+	assert.Equal(t, "INSERT INTO `t1`(`a`,`b`) VALUES\n(1,\"x\"),\n(2,NULL);\nINSERT INTO `t1`(`a`,`b`) VALUES\n(3,\"z\");\n", string(w.EndChunk()))
+
+	w.WriteRow(rows[0])
+	assert.Equal(t, "INSERT INTO `t1`(`a`,`b`) VALUES\n(1,\"x\");\n", string(w.EndChunk()))
+	w.EndTable()
+
+	// Another table.
+	w.BeginTable("t2", []string{"c"})
+	w.WriteRow(rows[0][:1])
+	assert.Equal(t, "INSERT INTO `t2`(`c`) VALUES\n(1);\n", string(w.EndChunk()))
+	w.EndTable()
+}
+
+func TestRowWriterCSV(t *testing.T) {
+	w := rowFormats[FormatCSV].writer(&DumpArgs{StmtSize: 10})
+	w.BeginTable("t1", []string{"a", "b\"c"})
+	rows := rowWriterRows()
+
+	// Every chunk has the header.
+	assert.Equal(t, len("1,\"x\"\n"), w.WriteRow(rows[0]))
+	w.WriteRow(rows[1])
+	assert.Equal(t, "\"a\",\"b\\\"c\"\n1,\"x\"\n2,\\N\n", string(w.EndChunk()))
+	w.WriteRow(rows[2])
+	assert.Equal(t, "\"a\",\"b\\\"c\"\n3,\"z\"\n", string(w.EndChunk()))
+	w.EndTable()
+}
+
+// geometry returns a GEOMETRY value as MySQL stores it: the SRID then the
+// little endian WKB of a POINT with one point, or of a POLYGON with a ring.
+func geometry(srid uint32, points ...[2]float64) []byte {
+	b := make([]byte, 4, 64)
+	binary.LittleEndian.PutUint32(b, srid)
+	u32 := func(n uint32) { b = append(b, 0, 0, 0, 0); binary.LittleEndian.PutUint32(b[len(b)-4:], n) }
+	f64 := func(f float64) {
+		b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint64(b[len(b)-8:], math.Float64bits(f))
+	}
+	b = append(b, 1)
+	if len(points) == 1 {
+		u32(1)
+	} else {
+		u32(3)
+		u32(1)
+		u32(uint32(len(points)))
+	}
+	for _, p := range points {
+		f64(p[0])
+		f64(p[1])
+	}
+	return b
+}
+
+// geometryLiteralRegexp matches a value of geometryValue.
+var geometryLiteralRegexp = regexp.MustCompile(`ST_GeomFromWKB\(0x([0-9a-f]*), (\d+)(, 'axis-order=long-lat')?\)`)
+
+// restoredGeometries returns the GEOMETRY values the target stores for the
+// ST_GeomFromWKB of query, in their order.
+func restoredGeometries(t *testing.T, query string) [][]byte {
+	var values [][]byte
+	for _, match := range geometryLiteralRegexp.FindAllStringSubmatch(query, -1) {
+		srid, err := strconv.ParseUint(match[2], 10, 32)
+		assert.Nil(t, err)
+		wkb, err := hex.DecodeString(match[1])
+		assert.Nil(t, err)
+		// A SRID is read longitude first only with the axis order.
+		assert.Equal(t, srid != 0, match[3] != "", match[0][:32])
+		value := make([]byte, 4, 4+len(wkb))
+		binary.LittleEndian.PutUint32(value, uint32(srid))
+		values = append(values, append(value, wkb...))
+	}
+	return values
+}
+
+func TestRowWriterGeometry(t *testing.T) {
+	point := geometry(4326, [2]float64{2.3522, 48.8566})
+	polygon := geometry(4326, [2]float64{2.25, 48.81}, [2]float64{2.42, 48.81}, [2]float64{2.42, 48.9}, [2]float64{2.25, 48.9}, [2]float64{2.25, 48.81})
+	cartesian := geometry(0, [2]float64{1, 2})
+
+	assert.Equal(t, "ST_GeomFromWKB(0x0101000000000000000000f03f0000000000000040, 0)", geometryValue(cartesian, true))
+	assert.Equal(t, "ST_GeomFromWKB(0x0101000000a835cd3b4ed1024076e09c11a56d4840, 4326, 'axis-order=long-lat')", geometryValue(point, true))
+	// Without the axis-order option, MySQL 5.7 or MariaDB.
+	assert.Equal(t, "ST_GeomFromWKB(0x0101000000a835cd3b4ed1024076e09c11a56d4840, 4326)", geometryValue(point, false))
+	assert.Equal(t, `"\0"`, geometryValue([]byte{0}, true))
+
+	// A big polygon, its hex literal is longer than the statement size.
+	var ring [][2]float64
+	for i := 0; i < 50000; i++ {
+		a := 2 * math.Pi * float64(i) / 50000
+		ring = append(ring, [2]float64{2.35 + math.Cos(a), 48.85 + math.Sin(a)})
+	}
+	ring = append(ring, ring[0])
+	big := geometry(4326, ring...)
+
+	rows := [][]byte{point, polygon, big, cartesian}
+	w := rowFormats[FormatSQL].writer(&DumpArgs{StmtSize: 1 << 20, serverVersion: "8.0.32"})
+	w.BeginTable("places", []string{"id", "location", "area"})
+	for i := 0; i < len(rows); i += 2 {
+		w.WriteRow([]sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte(strconv.Itoa(i))),
+			sqltypes.MakeTrusted(querypb.Type_GEOMETRY, rows[i]),
+			sqltypes.MakeTrusted(querypb.Type_GEOMETRY, rows[i+1]),
+		})
+	}
+	w.WriteRow([]sqltypes.Value{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("4")), sqltypes.NULL, sqltypes.NULL})
+	chunk := string(w.EndChunk())
+
+	// The loader splits the statements and counts their rows around the long
+	// literals, and doesn't prepare them.
+	stmts := splitStatements(chunk)
+	assert.Equal(t, 2, len(stmts))
+	assert.Equal(t, 2, insertRows(stmts[0].sql))
+	assert.Equal(t, 1, insertRows(stmts[1].sql))
+	_, _, ok := insertShape(stmts[0].sql)
+	assert.False(t, ok)
+	assert.True(t, strings.HasSuffix(stmts[1].sql, "VALUES\n(4,NULL,NULL)"))
+
+	// The values round-trip byte for byte through a restore.
+	dir := "/tmp/rowwritergeometry"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/gis-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `gis`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/gis.places-schema.sql", "CREATE TABLE `places` (`id` int NOT NULL, `location` point /*!80003 SRID 4326 */, "+
+		"`area` geometry /*!80003 SRID 4326 */, PRIMARY KEY (`id`)) ENGINE=InnoDB;\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/gis.places.00001.sql", chunk)
+	AssertNil(x)
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	rec := &recordingExecutor{}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, UsePrepared: true, MaxRowsPerSec: 1 << 20}
+	_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+	assert.Nil(t, err)
+	var restored [][]byte
+	for _, query := range rec.queries {
+		restored = append(restored, restoredGeometries(t, query)...)
+	}
+	assert.Equal(t, rows, restored)
+}
@@ -0,0 +1,118 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// runConfigFile is the RunConfig of a dump, in its directory.
+const runConfigFile = "runconfig.json"
+
+// RunConfig is the runconfig.json of a dump: its DumpArgs as the flags, the
+// profile and the config file resolved them, with the password redacted, and
+// the plan of its tables. ReadRunConfig reads it back for the dump to be run
+// again the same, see ReplayArgs.
+type RunConfig struct {
+	// Version is the version of the tool which ran the dump.
+	Version string `json:"version"`
+	// Args are the arguments of the dump.
+	Args DumpArgs `json:"args"`
+	// Tables are the tables the dump selected, in the order it dumped them.
+	Tables []RunConfigTable `json:"tables"`
+}
+
+// RunConfigTable is the chunk plan of a table of a RunConfig.
+type RunConfigTable struct {
+	Name string `json:"name"`
+	// ChunkBy is the column chunking its data files, nil for files of
+	// ChunksizeInMB.
+	ChunkBy       *ChunkColumn `json:"chunk_by,omitempty"`
+	ChunksizeInMB int          `json:"chunksize_mb,omitempty"`
+	// Partitions are the partitions dumped, none for all of them.
+	Partitions []string `json:"partitions,omitempty"`
+}
+
+// newRunConfig returns the RunConfig of a dump of tables.
+func newRunConfig(args *DumpArgs, tables []string) *RunConfig {
+	rc := &RunConfig{Version: Version, Args: *args, Tables: []RunConfigTable{}}
+	rc.Args.Password = redacted
+	for _, table := range tables {
+		t := RunConfigTable{Name: table, Partitions: args.tablePartitions(table)}
+		if col := args.tableChunkBy(table); col.Column != "" {
+			t.ChunkBy = &col
+		} else {
+			t.ChunksizeInMB = args.ChunksizeInMB
+		}
+		rc.Tables = append(rc.Tables, t)
+	}
+	return rc
+}
+
+// writeRunConfig writes the runconfig.json of a dump of tables.
+func writeRunConfig(args *DumpArgs, tables []string) error {
+	data, err := json.MarshalIndent(newRunConfig(args, tables), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(args.storage, runConfigFile, string(data)+"\n")
+}
+
+// ReadRunConfig reads the runconfig.json of a dump at path.
+func ReadRunConfig(path string) (*RunConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, wrapf(err, "runconfig[%s].error:%v", path, err)
+	}
+	rc := &RunConfig{}
+	if err := json.Unmarshal(data, rc); err != nil {
+		return nil, fmt.Errorf("runconfig[%s].parse.error:%v", path, err)
+	}
+	return rc, nil
+}
+
+// ReplayArgs returns the DumpArgs of the dump rc is the configuration of, to
+// run it again from path: the tables are the ones it dumped, the password is
+// left empty to be given again.
+func (rc *RunConfig) ReplayArgs(path string) DumpArgs {
+	args := rc.Args
+	args.Password = ""
+	args.Replay = path
+	names := make([]string, 0, len(rc.Tables))
+	for _, t := range rc.Tables {
+		names = append(names, t.Name)
+	}
+	args.Table = strings.Join(names, ",")
+	return args
+}
+
+// checkReplayTables checks the tables of a dump replaying a RunConfig all
+// still exist, before any of them is dumped, all the missing ones are
+// reported.
+func checkReplayTables(conn *Connection, args *DumpArgs, tables []string) error {
+	all, err := allTables(conn, args)
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool)
+	for _, table := range all {
+		exists[table] = true
+	}
+	v := &validator{}
+	for _, table := range tables {
+		if !exists[table] {
+			v.addf("table %q of the replayed %s no longer exists in %s", table, args.Replay, args.Database)
+		}
+	}
+	return v.err()
+}
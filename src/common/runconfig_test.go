@@ -0,0 +1,100 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunConfig(t *testing.T) {
+	dir := "/tmp/runconfigtest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	args := &DumpArgs{
+		User:            "mock",
+		Password:        "secret",
+		Address:         "10.0.0.1:3306",
+		Database:        "shop",
+		Outdir:          dir,
+		Threads:         8,
+		ChunksizeInMB:   64,
+		StmtSize:        1000000,
+		MaxRuntimeGrace: 5 * time.Minute,
+		Partitions:      map[string][]string{"shop.orders": {"p2024"}},
+		ChunkBy:         map[string]ChunkColumn{"shop.events": {Column: "created_at", Interval: "day"}},
+		IntervalMs:      10000,
+	}
+	args.storage = NewDirStorage(dir)
+	x = writeRunConfig(args, []string{"users", "orders", "events"})
+	AssertNil(x)
+
+	rc, err := ReadRunConfig(dir + "/" + runConfigFile)
+	assert.Nil(t, err)
+	assert.Equal(t, Version, rc.Version)
+	assert.Equal(t, redacted, rc.Args.Password)
+	assert.Equal(t, []RunConfigTable{
+		{Name: "users", ChunksizeInMB: 64},
+		{Name: "orders", ChunksizeInMB: 64, Partitions: []string{"p2024"}},
+		{Name: "events", ChunkBy: &ChunkColumn{Column: "created_at", Interval: "day"}},
+	}, rc.Tables)
+
+	// The replay has the arguments of the run, with its tables and without
+	// the password.
+	replay := rc.ReplayArgs(dir + "/" + runConfigFile)
+	want := *args
+	want.storage = nil
+	want.Password = ""
+	want.Table = "users,orders,events"
+	want.Replay = dir + "/" + runConfigFile
+	assert.Equal(t, want, replay)
+
+	// Not a run config.
+	{
+		x := WriteFile(dir+"/bad.json", "{")
+		AssertNil(x)
+		_, err := ReadRunConfig(dir + "/bad.json")
+		assert.NotNil(t, err)
+		_, err = ReadRunConfig(dir + "/none.json")
+		assert.NotNil(t, err)
+	}
+}
+
+func TestCheckReplayTables(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	rec := &recordingExecutor{results: map[string]*sqltypes.Result{"show tables from `shop`": {
+		Fields: []*querypb.Field{{Name: "Tables_in_shop", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("users"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("events"))},
+		},
+	}}}
+	pool, err := NewExecutorPool(log, 1, rec.executor)
+	AssertNil(err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+	args := &DumpArgs{Database: "shop", Replay: "/tmp/runconfig.json"}
+
+	assert.Nil(t, checkReplayTables(conn, args, []string{"users", "events"}))
+	err = checkReplayTables(conn, args, []string{"users", "orders", "events", "refunds"})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{
+		`table "orders" of the replayed /tmp/runconfig.json no longer exists in shop`,
+		`table "refunds" of the replayed /tmp/runconfig.json no longer exists in shop`,
+	}, err.(*ValidationError).Problems)
+}
@@ -0,0 +1,132 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// defaultMaxRuntimeGrace is the grace period of a MaxRuntime whose
+// MaxRuntimeGrace is 0.
+const defaultMaxRuntimeGrace = 5 * time.Minute
+
+// PartialError is the error of a run stopped by its MaxRuntime, see
+// DumpArgs.MaxRuntime and LoadArgs.MaxRuntime: what it finished is kept and
+// a run with Resume goes on from there. The CLI exits with its own status.
+type PartialError struct {
+	// Mode is "dump" or "load".
+	Mode       string
+	MaxRuntime time.Duration
+	// NotAttempted are the tables, 'db.table', of a dump or the data files of
+	// a restore which were not started before the deadline.
+	NotAttempted []string
+	// Interrupted are the tables or the data files started before the
+	// deadline and stopped once the grace period was over: a table is dumped
+	// again, a data file is restored from its next statement.
+	Interrupted []string
+	// SkippedPhases are the phases of a restore run after the datas which
+	// were not, like "verify".
+	SkippedPhases []string
+}
+
+func (e *PartialError) Error() string {
+	action, resume := "dumping", "Resume (-resume)"
+	if e.Mode == "load" {
+		action, resume = "restoring", "Resume (-resume) and the same ResumeFile (-resume-file)"
+	}
+	msg := fmt.Sprintf("%s.max.runtime[%v].reached.not.attempted[%d].interrupted[%d]", action, e.MaxRuntime, len(e.NotAttempted), len(e.Interrupted))
+	if len(e.SkippedPhases) > 0 {
+		msg += fmt.Sprintf(".phases.skipped[%s]", strings.Join(e.SkippedPhases, ","))
+	}
+	return msg + ", the run is partial: run it again with " + resume + " to go on"
+}
+
+// runtimeLimit is the deadline of a run with a MaxRuntime: once it's reached
+// no table or data file is started, once the grace period after it is over
+// the ones being dumped or restored are stopped. A nil *runtimeLimit never
+// stops anything.
+type runtimeLimit struct {
+	deadline time.Time
+	// over is set once the grace period is over.
+	over       int32
+	timer      *time.Timer
+	graceTimer *time.Timer
+}
+
+// newRuntimeLimit starts the deadline max from now, nil if max is 0. stop is
+// called once the grace period is over, it may be nil.
+func newRuntimeLimit(log *xlog.Log, action string, max time.Duration, grace time.Duration, stop func()) *runtimeLimit {
+	if max <= 0 {
+		return nil
+	}
+	if grace <= 0 {
+		grace = defaultMaxRuntimeGrace
+	}
+	r := &runtimeLimit{deadline: time.Now().Add(max)}
+	r.timer = time.AfterFunc(max, func() {
+		log.Warning("%s.max.runtime[%v].reached.nothing.new.is.started.grace[%v]", action, max, grace)
+	})
+	r.graceTimer = time.AfterFunc(max+grace, func() {
+		atomic.StoreInt32(&r.over, 1)
+		log.Warning("%s.max.runtime[%v].grace[%v].over.stopping.the.work.in.flight", action, max, grace)
+		if stop != nil {
+			stop()
+		}
+	})
+	return r
+}
+
+// reached reports whether the deadline is reached.
+func (r *runtimeLimit) reached() bool {
+	return r != nil && !time.Now().Before(r.deadline)
+}
+
+// interrupted reports whether the grace period after the deadline is over.
+func (r *runtimeLimit) interrupted() bool {
+	return r != nil && atomic.LoadInt32(&r.over) == 1
+}
+
+// close stops the timers, once the run is done.
+func (r *runtimeLimit) close() {
+	if r == nil {
+		return
+	}
+	r.timer.Stop()
+	r.graceTimer.Stop()
+}
+
+// stoppedError is the error of a data file stopped by the grace period of
+// the MaxRuntime, offset is the one of its first statement not executed.
+type stoppedError struct {
+	file   string
+	offset int
+}
+
+func (e *stoppedError) Error() string {
+	return fmt.Sprintf("restoring.file[%s].stopped.by.max.runtime.at.offset[%d]", e.file, e.offset)
+}
+
+// logPartialSummary logs what a run stopped by its MaxRuntime did not do, in
+// full: it's what the run with Resume does.
+func logPartialSummary(log *xlog.Log, action string, r Report) {
+	if r.Status != RunPartial {
+		return
+	}
+	logSummary(log, "%s.partial.not.attempted[%d]:%s", action, len(r.NotAttempted), strings.Join(r.NotAttempted, ","))
+	logSummary(log, "%s.partial.interrupted[%d]:%s", action, len(r.Interrupted), strings.Join(r.Interrupted, ","))
+	if len(r.SkippedPhases) > 0 {
+		logSummary(log, "%s.partial.phases.skipped[%s]", action, strings.Join(r.SkippedPhases, ","))
+	}
+}
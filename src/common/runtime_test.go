@@ -0,0 +1,191 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// slowExecutor is a recordingExecutor whose INSERTs take delay each.
+type slowExecutor struct {
+	recordingExecutor
+	delay time.Duration
+}
+
+func (s *slowExecutor) executor(id int) (Executor, error) {
+	return &slowConn{recordingConn: recordingConn{r: &s.recordingExecutor}, delay: s.delay}, nil
+}
+
+type slowConn struct {
+	recordingConn
+	delay time.Duration
+}
+
+func (c *slowConn) Execute(query string) error {
+	if strings.HasPrefix(query, "INSERT") {
+		time.Sleep(c.delay)
+	}
+	return c.recordingConn.Execute(query)
+}
+
+func TestRuntimeLimit(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+
+	// Without a MaxRuntime nothing stops.
+	{
+		r := newRuntimeLimit(log, "dumping", 0, time.Minute, nil)
+		assert.Nil(t, r)
+		assert.False(t, r.reached())
+		assert.False(t, r.interrupted())
+		r.close()
+	}
+
+	// The deadline, then the end of the grace period which calls stop.
+	{
+		stopped := make(chan struct{})
+		r := newRuntimeLimit(log, "dumping", 50*time.Millisecond, 100*time.Millisecond, func() { close(stopped) })
+		defer r.close()
+		assert.False(t, r.reached())
+		time.Sleep(75 * time.Millisecond)
+		assert.True(t, r.reached())
+		assert.False(t, r.interrupted())
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("the grace period never ended")
+		}
+		assert.True(t, r.interrupted())
+	}
+
+	// A closed limit is never interrupted.
+	{
+		r := newRuntimeLimit(log, "dumping", time.Millisecond, time.Millisecond, func() { t.Error("stopped after close") })
+		r.close()
+		time.Sleep(20 * time.Millisecond)
+		assert.True(t, r.reached())
+		assert.False(t, r.interrupted())
+	}
+}
+
+func TestLoaderMaxRuntime(t *testing.T) {
+	dir := "/tmp/loadermaxruntime"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\nINSERT INTO `t1` VALUES (2);\nINSERT INTO `t1` VALUES (3);\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (`a` int) ENGINE=InnoDB;\n",
+		"test.t2.00001.sql":      "INSERT INTO `t2` VALUES (1);\n",
+		"test.t2.00002.sql":      "INSERT INTO `t2` VALUES (2);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	path := dir + ".jsonl"
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, ResumeFile: path}
+	// matching returns the queries with the prefix, sorted.
+	matching := func(queries []string, prefix string) []string {
+		var found []string
+		for _, query := range queries {
+			if strings.HasPrefix(query, prefix) {
+				found = append(found, query)
+			}
+		}
+		sort.Strings(found)
+		return found
+	}
+
+	// The deadline is reached before the datas: the schemas are restored, no
+	// data file is started, nor the validation pass.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{}
+		args := args
+		args.MaxRuntime = time.Nanosecond
+		args.DeferConstraints = true
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		partial, ok := err.(*PartialError)
+		assert.True(t, ok, "%v", err)
+		if ok {
+			assert.Equal(t, []string{"test.t1.00001.sql", "test.t2.00001.sql", "test.t2.00002.sql"}, partial.NotAttempted)
+			assert.Nil(t, partial.Interrupted)
+			assert.Equal(t, []string{validatePhase}, partial.SkippedPhases)
+		}
+		assert.Equal(t, RunPartial, report.Status)
+		assert.Equal(t, 3, len(matching(rec.queries, "CREATE")))
+		assert.Nil(t, matching(rec.queries, "INSERT"))
+		assert.NotContains(t, rec.queries, "SET foreign_key_checks=1")
+
+		LogReport(log, report)
+		assert.True(t, strings.Contains(buf.String(), "restoring.partial.not.attempted[3]:test.t1.00001.sql,test.t2.00001.sql,test.t2.00002.sql"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.partial.interrupted[0]:"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.partial.phases.skipped[validate]"), buf.String())
+	}
+
+	// The resume restores the datas only, then runs the validation pass.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{}
+		args := args
+		args.Resume = true
+		args.DeferConstraints = true
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		assert.Nil(t, matching(rec.queries, "CREATE"))
+		assert.Equal(t, 5, len(matching(rec.queries, "INSERT")))
+		assert.Contains(t, rec.queries, "SET foreign_key_checks=1")
+	}
+
+	// The file being restored at the deadline goes on for the grace period,
+	// then stops before its next statement, and the resume restores it from
+	// there.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		slow := &slowExecutor{delay: 200 * time.Millisecond}
+		args := args
+		args.Filter = "table = t1"
+		args.MaxRuntime = 100 * time.Millisecond
+		args.MaxRuntimeGrace = 200 * time.Millisecond
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: slow.executor}).Run(context.Background())
+		partial, ok := err.(*PartialError)
+		assert.True(t, ok, "%v", err)
+		if ok {
+			assert.Nil(t, partial.NotAttempted)
+			assert.Equal(t, []string{"test.t1.00001.sql"}, partial.Interrupted)
+		}
+		assert.Equal(t, uint64(0), report.FilesFailed)
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1)", "INSERT INTO `t1` VALUES (2)"}, matching(slow.queries, "INSERT"))
+		data, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasSuffix(string(data), `{"file":"test.t1.00001.sql","offset":58}`+"\n"), string(data))
+
+		rec := &recordingExecutor{}
+		args.Resume = true
+		args.MaxRuntime = 0
+		_, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Nil(t, matching(rec.queries, "CREATE"))
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (3)"}, matching(rec.queries, "INSERT"))
+	}
+}
@@ -0,0 +1,139 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// unitScheduler hands out the restore units in their order, skipping the units
+// of a database which already has maxPerDB units in flight, or of a table
+// which already has its maxPerTable: a free thread takes the first unit of
+// another database or table instead. When only capped units are left the
+// threads wait, the restore goes on with the threads the caps allow.
+// A thread gets the first unit of the database of its connection if there is
+// one, so the connections mostly stay on their database without a 'use'.
+type unitScheduler struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  [][]string
+	inflight map[string]int
+	maxPerDB int
+	// maxPerTable are the caps of LoadArgs.TableThreads by 'db.table', and
+	// tables the units in flight by 'db.table'.
+	maxPerTable map[string]int
+	tables      map[string]int
+	// throttled is the time next waited with units left, all capped.
+	throttled time.Duration
+}
+
+// newUnitScheduler schedules the units, maxPerDB less than 1 caps nothing,
+// maxPerTable caps the tables it has.
+func newUnitScheduler(units [][]string, maxPerDB int, maxPerTable map[string]int) *unitScheduler {
+	s := &unitScheduler{pending: units, inflight: make(map[string]int), maxPerDB: maxPerDB, maxPerTable: maxPerTable, tables: make(map[string]int)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// unitDatabase returns the database of a unit, a batch never crosses databases.
+func unitDatabase(unit []string) string {
+	db, _, _ := parseTableFile(unit[0])
+	return db
+}
+
+// unitTables returns the 'db.table' of the files of a unit, once each.
+func unitTables(unit []string) []string {
+	var tables []string
+	seen := make(map[string]bool)
+	for _, file := range unit {
+		db, tbl, _ := parseTableFile(file)
+		if table := db + "." + tbl; !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// capped reports whether a unit has a database or a table at its cap.
+func (s *unitScheduler) capped(unit []string, db string) bool {
+	if s.maxPerDB > 0 && s.inflight[db] >= s.maxPerDB {
+		return true
+	}
+	if len(s.maxPerTable) > 0 {
+		for _, table := range unitTables(unit) {
+			if max, ok := s.maxPerTable[table]; ok && s.tables[table] >= max {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// next returns the next unit to restore for a connection on the database
+// current, empty if none. It waits while the units left are all of capped
+// databases. ok is false once there are none left.
+func (s *unitScheduler) next(current string) (unit []string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var waited time.Time
+	for len(s.pending) > 0 {
+		pick := -1
+		for i, u := range s.pending {
+			db := unitDatabase(u)
+			if s.capped(u, db) {
+				continue
+			}
+			if pick < 0 {
+				pick = i
+			}
+			if current == "" || db == current {
+				pick = i
+				break
+			}
+		}
+		if pick >= 0 {
+			u := s.pending[pick]
+			s.pending = append(s.pending[:pick], s.pending[pick+1:]...)
+			s.inflight[unitDatabase(u)]++
+			for _, table := range unitTables(u) {
+				s.tables[table]++
+			}
+			if !waited.IsZero() {
+				s.throttled += time.Since(waited)
+			}
+			return u, true
+		}
+		if waited.IsZero() {
+			waited = time.Now()
+		}
+		s.cond.Wait()
+	}
+	return nil, false
+}
+
+// done releases the slot of a unit returned by next.
+func (s *unitScheduler) done(unit []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight[unitDatabase(unit)]--
+	for _, table := range unitTables(unit) {
+		s.tables[table]--
+	}
+	s.cond.Broadcast()
+}
+
+// throttledFor returns the time the threads waited on the caps.
+func (s *unitScheduler) throttledFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.throttled
+}
@@ -0,0 +1,163 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerOrder(t *testing.T) {
+	units := [][]string{
+		{"a.t1.00001.sql"}, {"a.t1.00002.sql"}, {"a.t2.00001.sql"}, {"b.t1.00001.sql"}, {"a.t3.00001.sql"}, {"c.t1.00001.sql"},
+	}
+
+	// No cap, in order.
+	{
+		s := newUnitScheduler(append([][]string(nil), units...), 0, nil)
+		for _, want := range units {
+			unit, ok := s.next("")
+			assert.True(t, ok)
+			assert.Equal(t, want, unit)
+		}
+		_, ok := s.next("")
+		assert.False(t, ok)
+	}
+
+	// A capped database is passed over until one of its units is done.
+	{
+		s := newUnitScheduler(append([][]string(nil), units...), 2, nil)
+		var got []string
+		for i := 0; i < 4; i++ {
+			unit, ok := s.next("")
+			assert.True(t, ok)
+			got = append(got, unit[0])
+		}
+		assert.Equal(t, []string{"a.t1.00001.sql", "a.t1.00002.sql", "b.t1.00001.sql", "c.t1.00001.sql"}, got)
+		s.done([]string{"a.t1.00001.sql"})
+		unit, ok := s.next("")
+		assert.True(t, ok)
+		assert.Equal(t, []string{"a.t2.00001.sql"}, unit)
+	}
+}
+
+func TestSchedulerAffinity(t *testing.T) {
+	units := [][]string{
+		{"a.t1.00001.sql"}, {"b.t1.00001.sql"}, {"a.t2.00001.sql"}, {"b.t2.00001.sql"}, {"c.t1.00001.sql"},
+	}
+	s := newUnitScheduler(units, 1, nil)
+
+	// The database of the connection first, if not capped.
+	next := func(current string) string {
+		unit, ok := s.next(current)
+		assert.True(t, ok)
+		return unit[0]
+	}
+	assert.Equal(t, "b.t1.00001.sql", next("b"))
+	assert.Equal(t, "a.t1.00001.sql", next("b"))
+	s.done([]string{"b.t1.00001.sql"})
+	assert.Equal(t, "b.t2.00001.sql", next("b"))
+	assert.Equal(t, "c.t1.00001.sql", next("x"))
+}
+
+func TestSchedulerTableCap(t *testing.T) {
+	var units [][]string
+	for i := 1; i <= 10; i++ {
+		units = append(units, []string{fmt.Sprintf("a.fk.%05d.sql", i)})
+		units = append(units, []string{fmt.Sprintf("a.big.%05d.sql", i)})
+		units = append(units, []string{fmt.Sprintf("a.t%d.00001.sql", i)})
+	}
+	caps := map[string]int{"a.fk": 1, "a.big": 3}
+	s := newUnitScheduler(units, 0, caps)
+
+	// 8 threads, the capped tables never have more files at once.
+	var mu sync.Mutex
+	inflight := make(map[string]int)
+	var wg sync.WaitGroup
+	threads := make(chan struct{}, 8)
+	n := 0
+	for {
+		threads <- struct{}{}
+		unit, ok := s.next("")
+		if !ok {
+			break
+		}
+		n++
+		table := unitTables(unit)[0]
+		mu.Lock()
+		inflight[table]++
+		if max, ok := caps[table]; ok {
+			assert.True(t, inflight[table] <= max)
+		}
+		mu.Unlock()
+		wg.Add(1)
+		go func(unit []string) {
+			defer func() {
+				<-threads
+				wg.Done()
+			}()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			inflight[table]--
+			mu.Unlock()
+			s.done(unit)
+		}(unit)
+	}
+	wg.Wait()
+	assert.Equal(t, 30, n)
+	assert.Equal(t, []string{"a.fk", "a.big"}, unitTables([]string{"a.fk.00001.sql", "a.big.00001.sql", "a.fk.00002.sql"}))
+}
+
+func TestSchedulerCap(t *testing.T) {
+	var units [][]string
+	for i := 1; i <= 20; i++ {
+		units = append(units, []string{fmt.Sprintf("a.t1.%05d.sql", i)})
+	}
+	for i := 1; i <= 4; i++ {
+		units = append(units, []string{fmt.Sprintf("b.t1.%05d.sql", i)})
+	}
+	s := newUnitScheduler(units, 2, nil)
+
+	// 8 threads, at most 2 files of a database at once.
+	var mu sync.Mutex
+	inflight := make(map[string]int)
+	var wg sync.WaitGroup
+	threads := make(chan struct{}, 8)
+	for {
+		threads <- struct{}{}
+		unit, ok := s.next("")
+		if !ok {
+			break
+		}
+		db := unitDatabase(unit)
+		mu.Lock()
+		inflight[db]++
+		assert.True(t, inflight[db] <= 2)
+		mu.Unlock()
+		wg.Add(1)
+		go func(unit []string) {
+			defer func() {
+				<-threads
+				wg.Done()
+			}()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			inflight[db]--
+			mu.Unlock()
+			s.done(unit)
+		}(unit)
+	}
+	wg.Wait()
+	assert.True(t, s.throttledFor() > 0)
+}
@@ -0,0 +1,392 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/common"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+const (
+	// ddlRetries is how many times a DDL failed by a deadlock or lock wait timeout is retried.
+	ddlRetries = 5
+)
+
+// ddlRetryBackoff is the wait before the first DDL retry, doubled at each retry.
+var ddlRetryBackoff = 100 * time.Millisecond
+
+// referencesRegexp matches the referenced table of a FOREIGN KEY: REFERENCES `t` or REFERENCES `db`.`t`.
+var referencesRegexp = regexp.MustCompile("(?i)REFERENCES\\s+`([^`]+)`(?:\\.`([^`]+)`)?")
+
+// createTableRegexp matches the head of a CREATE TABLE statement and its IF NOT EXISTS, if any.
+var createTableRegexp = regexp.MustCompile(`(?is)^(\s*CREATE\s+TABLE\s+)(IF\s+NOT\s+EXISTS\s+)?`)
+
+// dropTableRegexp matches a DROP TABLE statement, like the one of a schema
+// file dumped with DumpArgs.AddDropTable.
+var dropTableRegexp = regexp.MustCompile(`(?is)^\s*DROP\s+TABLE\b`)
+
+// schemaFile is a table schema file and the tables its foreign keys reference.
+type schemaFile struct {
+	path  string
+	db    string
+	table string
+	sql   string
+	refs  []string
+}
+
+func (s *schemaFile) key() string {
+	return s.db + "." + s.table
+}
+
+func readSchemaFile(storage Storage, path string) (*schemaFile, error) {
+	name := strings.TrimSuffix(filepath.Base(path), schemaSuffix)
+	splits := strings.SplitN(name, ".", 2)
+	if len(splits) != 2 {
+		return nil, fmt.Errorf("schema.file[%s].not.named.as[db.table%s]", path, schemaSuffix)
+	}
+	data, err := readFile(storage, path)
+	if err != nil {
+		return nil, err
+	}
+	s := &schemaFile{path: path, db: splits[0], table: splits[1], sql: common.BytesToString(data)}
+	for _, match := range referencesRegexp.FindAllStringSubmatch(s.sql, -1) {
+		if match[2] != "" {
+			s.refs = append(s.refs, match[1]+"."+match[2])
+		} else {
+			s.refs = append(s.refs, s.db+"."+match[1])
+		}
+	}
+	return s, nil
+}
+
+// schemaGroups partitions the schemas into groups which are safe to create in parallel.
+//
+// The heuristic: a CREATE TABLE with a FOREIGN KEY takes a metadata lock on the
+// referenced (parent) table, so two DDL touching the same table, either as the
+// table itself or as a referenced one, end up in the same group and are executed
+// one after the other on one connection. Unrelated tables land in different groups.
+// Inside a group the referenced tables are created first, in file order otherwise.
+func schemaGroups(schemas []*schemaFile) [][]*schemaFile {
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(k string) string {
+		if p, ok := parent[k]; ok && p != k {
+			root := find(p)
+			parent[k] = root
+			return root
+		}
+		parent[k] = k
+		return k
+	}
+	union := func(a, b string) {
+		parent[find(a)] = find(b)
+	}
+	for _, s := range schemas {
+		find(s.key())
+		for _, ref := range s.refs {
+			union(s.key(), ref)
+		}
+	}
+
+	byKey := make(map[string]*schemaFile)
+	for _, s := range schemas {
+		byKey[s.key()] = s
+	}
+
+	var roots []string
+	members := make(map[string][]*schemaFile)
+	for _, s := range schemas {
+		root := find(s.key())
+		if _, ok := members[root]; !ok {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], s)
+	}
+
+	var groups [][]*schemaFile
+	for _, root := range roots {
+		var group []*schemaFile
+		visited := make(map[string]bool)
+		var visit func(s *schemaFile)
+		visit = func(s *schemaFile) {
+			if visited[s.key()] {
+				return
+			}
+			visited[s.key()] = true
+			for _, ref := range s.refs {
+				if r, ok := byKey[ref]; ok {
+					visit(r)
+				}
+			}
+			group = append(group, s)
+		}
+		for _, s := range members[root] {
+			visit(s)
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// executeDDL executes a DDL of what, like 'schema[db.table]', and retries it
+// on deadlocks and lock wait timeouts, once a read-only target is writable
+// again, see waitWritable, and once conn is reconnected after its server went
+// away, see failover. A done ctx stops the wait for a writable target.
+func executeDDL(ctx context.Context, log *xlog.Log, conn *Connection, args *LoadArgs, what string, query string) error {
+	backoff := ddlRetryBackoff
+	for i := 0; ; {
+		err := conn.Execute(query)
+		switch {
+		case err == nil:
+			return nil
+		case isLockError(err) && i < ddlRetries:
+			i++
+			args.metrics.retry(err)
+			log.Warning("restoring.schema.ddl.lock.error.retry[%d/%d].after[%v].thread[%d]:%v", i, ddlRetries, backoff, conn.ID, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		case isReadOnlyError(err):
+			if err := waitWritable(ctx, log, conn, args, what, err); err != nil {
+				return err
+			}
+		case isGoneError(err):
+			if err := failover(log, conn, args, what, err); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+}
+
+// createIfNotExists rewrites a CREATE TABLE statement into a CREATE TABLE IF
+// NOT EXISTS, the other statements are left as they are.
+func createIfNotExists(query string) string {
+	match := createTableRegexp.FindStringSubmatchIndex(query)
+	if match == nil || match[4] >= 0 {
+		return query
+	}
+	return query[:match[3]] + "IF NOT EXISTS " + query[match[3]:]
+}
+
+// tableExists reports whether the table exists on the target.
+func tableExists(conn *Connection, db string, table string) (bool, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA='%s' AND TABLE_NAME='%s'", EscapeBytes([]byte(db)), EscapeBytes([]byte(table))))
+	if err != nil {
+		return false, err
+	}
+	return len(qr.Rows) > 0 && qr.Rows[0][0].String() != "0", nil
+}
+
+// databaseExists reports whether the database exists on the target.
+func databaseExists(conn *Connection, db string) (bool, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT COUNT(*) FROM information_schema.SCHEMATA WHERE SCHEMA_NAME='%s'", EscapeBytes([]byte(db))))
+	if err != nil {
+		return false, err
+	}
+	return len(qr.Rows) > 0 && qr.Rows[0][0].String() != "0", nil
+}
+
+// restoreSchemaFile restores a table schema file. The loader options win
+// over the statements dumped with DumpArgs.AddDropTable or IfNotExists:
+// CreateIfNotExists skips a DROP TABLE of the file, OverwriteTables drops the
+// table first unless the file does, even if it creates it IF NOT EXISTS.
+func restoreSchemaFile(ctx context.Context, log *xlog.Log, conn *Connection, args *LoadArgs, schema *schemaFile) error {
+	if err := useDatabase(conn, args, schema.db); err != nil {
+		return err
+	}
+	stmts, _, err := schemaStatements(args.store(), schema.path, schema.sql, args.ExpandSource)
+	if err != nil {
+		return err
+	}
+	var drops, ifNotExists bool
+	for _, stmt := range stmts {
+		if dropTableRegexp.MatchString(stmt.sql) {
+			drops = true
+		} else if match := createTableRegexp.FindStringSubmatchIndex(stmt.sql); match != nil && match[4] >= 0 {
+			ifNotExists = true
+		}
+	}
+	// dropped is whether the restore drops the table, keep whether it keeps
+	// an existing one.
+	overwrite := args.OverwriteTables || args.recreate[schema.key()]
+	dropped := (drops && !args.CreateIfNotExists) || overwrite
+	keep := !dropped && (args.CreateIfNotExists || ifNotExists)
+	table := args.targetTable(schema.table)
+	if overwrite && !drops {
+		// Qualified, a connection of CompatProxy has no current database.
+		drop := fmt.Sprintf("DROP TABLE IF EXISTS %s.%s", quoteIdentifier(schema.db), quoteIdentifier(table))
+		logDDL(log, args, schema.path, drop)
+		if err := executeDDL(ctx, log, conn, args, "schema["+schema.key()+"]", drop); err != nil {
+			return err
+		}
+		log.Info("restoring.schema[%s].overwrite.table.dropped.thread[%d]", schema.key(), conn.ID)
+	}
+	exists := false
+	if !dropped && (keep || args.rollback != nil) {
+		if exists, err = tableExists(conn, schema.db, table); err != nil {
+			return err
+		}
+		if exists && keep && args.incremental {
+			log.Info("restoring.schema[%s].incremental.table.exists.kept.thread[%d]", schema.key(), conn.ID)
+		} else if exists && keep {
+			log.Warning("restoring.schema[%s].table.exists.schema.not.updated,datas.restored.into.it.thread[%d]", schema.key(), conn.ID)
+		}
+	}
+	for _, stmt := range stmts {
+		if strings.HasPrefix(stmt.sql, "/*") {
+			continue
+		}
+		if dropTableRegexp.MatchString(stmt.sql) && args.CreateIfNotExists {
+			log.Warning("restoring.schema[%s].create.if.not.exists.skips.the.drop.table.of.file[%s]", schema.key(), stmt.file)
+			continue
+		}
+		query, ok := managedStatement(log, args, stmt.file, stmt.sql, true)
+		if !ok {
+			continue
+		}
+		query = schemaQuery(log, args, schema, query)
+		query, err := rewriteStatement(args, stmt.file, schema.db, schema.table, query)
+		if err != nil {
+			return wrapf(err, "restoring.rewrite.file[%s].offset[%d].error:%v", stmt.file, stmt.offset, err)
+		}
+		logDDL(log, args, stmt.file, query)
+		if err := executeDDL(ctx, log, conn, args, "schema["+schema.key()+"]", query); err != nil {
+			if proxySkipSet(log, args, stmt.file, query, err) {
+				continue
+			}
+			logFailedSQL(log, args, stmt.file, statement{sql: query, offset: stmt.offset}, err)
+			return err
+		}
+		if !exists && statementKind(query) == StatementCreateTable {
+			if err := args.rollback.createdTable(schema.db, table); err != nil {
+				return err
+			}
+			checkDroppedConstraints(log, conn, schema.db, table, query)
+		}
+	}
+	log.Info("restoring.schema[%s].thread[%d]", schema.key(), conn.ID)
+	return nil
+}
+
+// schemaQuery returns a statement of the schema file as the restore executes
+// it, with the changes LoadArgs asks for, which are logged.
+func schemaQuery(log *xlog.Log, args *LoadArgs, schema *schemaFile, query string) string {
+	if args.CreateIfNotExists {
+		query = createIfNotExists(query)
+	}
+	if args.UpgradeCharset && statementKind(query) == StatementCreateTable {
+		var warnings []string
+		query, warnings = upgradeCharset(query, args.UpgradeCollations, args.UpgradeKeyBytes)
+		for _, warning := range warnings {
+			log.Warning("restoring.upgrade.charset.table[%s]:%s", schema.key(), warning)
+		}
+	}
+	if args.ForceTableCollation && args.DefaultCollation != "" && statementKind(query) == StatementCreateTable {
+		var old string
+		if query, old = defaultTableCollation(query, args.DefaultCollation); !strings.EqualFold(old, args.DefaultCollation) {
+			log.Info("restoring.default.collation.table[%s].collation[%s].to[%s]", schema.key(), old, args.DefaultCollation)
+		}
+	}
+	if args.ForceEngine != "" && statementKind(query) == StatementCreateTable {
+		var old string
+		var warnings []string
+		query, old, warnings = forceEngine(query, args.ForceEngine)
+		if !strings.EqualFold(old, args.ForceEngine) {
+			log.Info("restoring.force.engine.table[%s].engine[%s].to[%s]", schema.key(), old, args.ForceEngine)
+		}
+		for _, warning := range warnings {
+			log.Warning("restoring.force.engine.table[%s]:%s", schema.key(), warning)
+		}
+	}
+	if args.SkipCheckConstraints && statementKind(query) == StatementCreateTable {
+		var checks []string
+		if query, checks = stripCheckConstraints(query); len(checks) > 0 {
+			log.Warning("restoring.schema[%s].check.constraints.skipped[%s]", schema.key(), strings.Join(checks, ","))
+		}
+	}
+	if !args.KeepTablespaceOptions && statementKind(query) == StatementCreateTable {
+		var options []string
+		query, options = stripTablespaceOptions(query)
+		for _, option := range options {
+			log.Warning("restoring.schema[%s].tablespace.option.stripped[%s]", schema.key(), option)
+		}
+	}
+	return renameTables(args, schema.db, query)
+}
+
+// restoreTableSchemas restores the table schemas with at most threads
+// connections of the pool, see schemaGroups for what runs in parallel.
+// The first error stops the groups not started yet.
+func restoreTableSchemas(ctx context.Context, log *xlog.Log, pool *Pool, args *LoadArgs, paths []string, threads int) error {
+	limit := newPhaseLimit(args.metrics, "schemas", threads)
+	defer limit.done()
+	var schemas []*schemaFile
+	for _, path := range paths {
+		schema, err := readSchemaFile(args.store(), path)
+		if err != nil {
+			return err
+		}
+		schemas = append(schemas, schema)
+	}
+	groups := schemaGroups(schemas)
+	if threads < 1 {
+		threads = 1
+	}
+	if threads > len(groups) {
+		threads = len(groups)
+	}
+	log.Info("restoring.schemas[%d].groups[%d].threads[%d]", len(schemas), len(groups), threads)
+
+	var wg sync.WaitGroup
+	var errs firstError
+	ch := make(chan []*schemaFile)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			conn := limit.get(pool)
+			defer func() {
+				limit.put(pool, conn)
+				wg.Done()
+			}()
+			for group := range ch {
+				working := limit.working()
+				for _, schema := range group {
+					if errs.get() != nil {
+						break
+					}
+					if err := restoreSchemaFile(ctx, log, conn, args, schema); err != nil {
+						errs.set(wrapf(err, "restoring.schema[%s].error:%v", schema.key(), err))
+					} else if err := args.journal.restored(schema.path); err != nil {
+						errs.set(err)
+					}
+				}
+				working()
+			}
+		}()
+	}
+	for _, group := range groups {
+		if errs.get() != nil {
+			break
+		}
+		ch <- group
+	}
+	close(ch)
+	wg.Wait()
+	return errs.get()
+}
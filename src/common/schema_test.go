@@ -0,0 +1,272 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSchemaFiles(dir string, schemas map[string]string) {
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range schemas {
+		x := WriteFile(dir+"/"+name+schemaSuffix, sql)
+		AssertNil(x)
+	}
+}
+
+func TestSchemaGroups(t *testing.T) {
+	dir := "/tmp/schemagroupstest"
+	writeSchemaFiles(dir, map[string]string{
+		"test.child1": "CREATE TABLE `child1` (`id` int, `pid` int, CONSTRAINT `fk1` FOREIGN KEY (`pid`) REFERENCES `parent` (`id`)) ENGINE=InnoDB;\n",
+		"test.child2": "CREATE TABLE `child2` (`id` int, `pid` int, CONSTRAINT `fk2` FOREIGN KEY (`pid`) REFERENCES `parent` (`id`)) ENGINE=InnoDB;\n",
+		"test.parent": "CREATE TABLE `parent` (`id` int, PRIMARY KEY (`id`)) ENGINE=InnoDB;\n",
+		"test.alone":  "CREATE TABLE `alone` (`id` int) ENGINE=InnoDB;\n",
+		"other.x":     "CREATE TABLE `x` (`id` int, `aid` int, FOREIGN KEY (`aid`) references `test`.`alone` (`id`)) ENGINE=InnoDB;\n",
+		"other.y":     "CREATE TABLE `y` (`id` int) ENGINE=InnoDB;\n",
+	})
+
+	var schemas []*schemaFile
+	for _, name := range []string{"other.x", "other.y", "test.alone", "test.child1", "test.child2", "test.parent"} {
+		s, err := readSchemaFile(NewDirStorage(dir), name+schemaSuffix)
+		assert.Nil(t, err)
+		schemas = append(schemas, s)
+	}
+	assert.Equal(t, []string{"test.parent"}, schemas[3].refs)
+	assert.Equal(t, []string{"test.alone"}, schemas[0].refs)
+
+	groups := schemaGroups(schemas)
+	var got [][]string
+	for _, group := range groups {
+		var keys []string
+		for _, s := range group {
+			keys = append(keys, s.key())
+		}
+		got = append(got, keys)
+	}
+	want := [][]string{
+		{"test.alone", "other.x"},
+		{"other.y"},
+		{"test.parent", "test.child1", "test.child2"},
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestSchemaRestoreParallel(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create table .*", &sqltypes.Result{})
+	}
+
+	dir := "/tmp/schemarestoretest"
+	writeSchemaFiles(dir, map[string]string{
+		"test.child":  "CREATE TABLE `child` (`id` int, `pid` int, FOREIGN KEY (`pid`) REFERENCES `parent` (`id`)) ENGINE=InnoDB;\n",
+		"test.parent": "CREATE TABLE `parent` (`id` int, PRIMARY KEY (`id`)) ENGINE=InnoDB;\n",
+		"test.t1":     "CREATE TABLE `t1` (`id` int) ENGINE=InnoDB;\n",
+		"test.t2":     "CREATE TABLE `t2` (`id` int) ENGINE=InnoDB;\n",
+	})
+
+	pool, err := NewPool(log, 4, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	storage := NewDirStorage(dir)
+	files, err := loadFiles(storage)
+	assert.Nil(t, err)
+	err = restoreTableSchemas(context.Background(), log, pool, &LoadArgs{storage: storage}, files.schemas, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("create table `parent` (`id` int, primary key (`id`)) engine=innodb"))
+}
+
+func TestSchemaDDLRetry(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	defer func(backoff time.Duration) { ddlRetryBackoff = backoff }(ddlRetryBackoff)
+	ddlRetryBackoff = time.Millisecond
+
+	deadlock := &sqldb.SQLError{Num: erLockDeadlock, State: "40001", Message: "Deadlock found when trying to get lock"}
+	// fakedbs.
+	{
+		fakedbs.AddQueryError("create table `t1` (`id` int)", deadlock)
+		fakedbs.AddQueryError("create table `t2` (`id` int)", &sqldb.SQLError{Num: 1050, State: "42S01", Message: "Table 't2' already exists"})
+	}
+
+	pool, err := NewPool(log, 1, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+
+	// Deadlocks are retried.
+	{
+		err := executeDDL(context.Background(), log, conn, &LoadArgs{}, "schema[test.t1]", "CREATE TABLE `t1` (`id` int)")
+		assert.NotNil(t, err)
+		assert.Equal(t, ddlRetries+1, fakedbs.GetQueryCalledNum("create table `t1` (`id` int)"))
+	}
+
+	// Others are not.
+	{
+		err := executeDDL(context.Background(), log, conn, &LoadArgs{}, "schema[test.t2]", "CREATE TABLE `t2` (`id` int)")
+		assert.NotNil(t, err)
+		assert.Equal(t, 1, fakedbs.GetQueryCalledNum("create table `t2` (`id` int)"))
+	}
+
+	assert.True(t, isLockError(deadlock))
+	assert.False(t, isLockError(os.ErrNotExist))
+}
+
+func TestSchemaCreateIfNotExists(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"CREATE TABLE `t1` (`id` int)", "CREATE TABLE IF NOT EXISTS `t1` (`id` int)"},
+		{"create  table\n`t1` (`id` int)", "create  table\nIF NOT EXISTS `t1` (`id` int)"},
+		{"CREATE TABLE IF NOT EXISTS `t1` (`id` int)", "CREATE TABLE IF NOT EXISTS `t1` (`id` int)"},
+		{"CREATE TABLE if not exists `t1` (`id` int)", "CREATE TABLE if not exists `t1` (`id` int)"},
+		{"CREATE ALGORITHM=UNDEFINED VIEW `v1` AS select 1", "CREATE ALGORITHM=UNDEFINED VIEW `v1` AS select 1"},
+		{"INSERT INTO `t1` VALUES (1)", "INSERT INTO `t1` VALUES (1)"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, createIfNotExists(test.query))
+	}
+}
+
+func TestSchemaRestoreIfNotExists(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQuery("select count(*) from information_schema.tables where table_schema='test' and table_name='t1'", singleResult("COUNT(*)", "1"))
+		fakedbs.AddQuery("select count(*) from information_schema.tables where table_schema='test' and table_name='t2'", singleResult("COUNT(*)", "0"))
+		fakedbs.AddQuery("create table if not exists `t1` (`id` int) engine=innodb", &sqltypes.Result{})
+		fakedbs.AddQuery("create table if not exists `t2` (`id` int) engine=innodb", &sqltypes.Result{})
+	}
+
+	dir := "/tmp/schemaifnotexiststest"
+	writeSchemaFiles(dir, map[string]string{
+		"test.t1": "CREATE TABLE `t1` (`id` int) ENGINE=InnoDB;\n",
+		"test.t2": "CREATE TABLE `t2` (`id` int) ENGINE=InnoDB;\n",
+	})
+
+	pool, err := NewPool(log, 2, address, "mock", "mock")
+	assert.Nil(t, err)
+	defer pool.Close()
+
+	storage := NewDirStorage(dir)
+	files, err := loadFiles(storage)
+	assert.Nil(t, err)
+	err = restoreTableSchemas(context.Background(), log, pool, &LoadArgs{storage: storage, CreateIfNotExists: true}, files.schemas, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("create table if not exists `t1` (`id` int) engine=innodb"))
+	assert.Equal(t, 1, fakedbs.GetQueryCalledNum("create table if not exists `t2` (`id` int) engine=innodb"))
+}
+
+func TestSchemaDumpedDropTable(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	const create = "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB"
+
+	// dump writes the schema file with the options of the dump, restore
+	// restores it with the ones of the load and returns the statements.
+	dump := func(args DumpArgs) Storage {
+		args.Database = "test"
+		args.storage = NewMemStorage()
+		pool, err := NewExecutorPool(log, 1, (&slowSchemaExecutor{}).executor)
+		AssertNil(err)
+		defer pool.Close()
+		conn := pool.Get()
+		defer pool.Put(conn)
+		schema, err := dumpTableSchema(log, conn, &args, "t1")
+		AssertNil(err)
+		assert.Equal(t, create+";\n", schema)
+		return args.storage
+	}
+	restore := func(s Storage, args LoadArgs) []string {
+		rec := &recordingExecutor{}
+		pool, err := NewExecutorPool(log, 1, rec.executor)
+		AssertNil(err)
+		defer pool.Close()
+		args.storage = s
+		err = restoreTableSchemas(context.Background(), log, pool, &args, []string{"test.t1-schema.sql"}, 1)
+		assert.Nil(t, err)
+		return rec.queries[1:]
+	}
+	read := func(s Storage) string {
+		data, err := readFile(s, "test.t1-schema.sql")
+		AssertNil(err)
+		return string(data)
+	}
+
+	drop := dump(DumpArgs{AddDropTable: true})
+	assert.Equal(t, "DROP TABLE IF EXISTS `t1`;\n"+create+";\n", read(drop))
+	ifNotExists := dump(DumpArgs{IfNotExists: true})
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS `t1` (`a` int) ENGINE=InnoDB;\n", read(ifNotExists))
+	plain := dump(DumpArgs{})
+	assert.Equal(t, create+";\n", read(plain))
+
+	tests := []struct {
+		name string
+		s    Storage
+		args LoadArgs
+		want []string
+	}{
+		{"drop", drop, LoadArgs{}, []string{"DROP TABLE IF EXISTS `t1`", create}},
+		// Not dropped twice.
+		{"drop overwrite", drop, LoadArgs{OverwriteTables: true}, []string{"DROP TABLE IF EXISTS `t1`", create}},
+		// The loader keeps the existing tables.
+		{"drop create if not exists", drop, LoadArgs{CreateIfNotExists: true}, []string{
+			"SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA='test' AND TABLE_NAME='t1'",
+			"CREATE TABLE IF NOT EXISTS `t1` (`a` int) ENGINE=InnoDB",
+		}},
+		{"if not exists", ifNotExists, LoadArgs{}, []string{
+			"SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA='test' AND TABLE_NAME='t1'",
+			"CREATE TABLE IF NOT EXISTS `t1` (`a` int) ENGINE=InnoDB",
+		}},
+		// The loader replaces the existing tables.
+		{"if not exists overwrite", ifNotExists, LoadArgs{OverwriteTables: true}, []string{
+			"DROP TABLE IF EXISTS `test`.`t1`",
+			"CREATE TABLE IF NOT EXISTS `t1` (`a` int) ENGINE=InnoDB",
+		}},
+		{"plain overwrite", plain, LoadArgs{OverwriteTables: true}, []string{"DROP TABLE IF EXISTS `test`.`t1`", create}},
+		{"plain", plain, LoadArgs{}, []string{create}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, restore(test.s, test.args), test.name)
+	}
+}
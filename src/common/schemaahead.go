@@ -0,0 +1,88 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// tableSchema is the create statement of a table dumped ahead, or the error
+// of its SHOW CREATE TABLE.
+type tableSchema struct {
+	schema string
+	err    error
+}
+
+// schemaAhead dumps the schemas of the tables on the connections of a pool
+// of its own, see DumpArgs.SchemaThreads, in the order of the tables and
+// concurrently with the data threads. get waits for the schema of a table,
+// its file is written and closed by then: the data files of a table are
+// always created after its schema file.
+type schemaAhead struct {
+	done    chan struct{}
+	schemas []chan tableSchema
+	wg      sync.WaitGroup
+}
+
+// dumpSchemasAhead starts the threads dumping the schemas of tables on the
+// connections of pool.
+func dumpSchemasAhead(log *xlog.Log, pool *Pool, args *DumpArgs, tables []string, threads int) *schemaAhead {
+	a := &schemaAhead{done: make(chan struct{}), schemas: make([]chan tableSchema, len(tables))}
+	for i := range tables {
+		a.schemas[i] = make(chan tableSchema, 1)
+	}
+	next := make(chan int)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(next)
+		for i := range tables {
+			select {
+			case next <- i:
+			case <-a.done:
+				return
+			}
+		}
+	}()
+	for t := 0; t < threads; t++ {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			for i := range next {
+				select {
+				case <-a.done:
+					return
+				default:
+				}
+				conn := pool.Get()
+				schema, err := dumpTableSchema(log, conn, args, tables[i])
+				pool.Put(conn)
+				a.schemas[i] <- tableSchema{schema: schema, err: err}
+			}
+		}()
+	}
+	log.Info("dumping.schema.threads[%d].ahead.of.tables[%d]", threads, len(tables))
+	return a
+}
+
+// get waits for the schema of the table i.
+func (a *schemaAhead) get(i int) (string, error) {
+	ts := <-a.schemas[i]
+	return ts.schema, ts.err
+}
+
+// stop stops the dispatch of the schemas not started yet and waits for the
+// ones being dumped.
+func (a *schemaAhead) stop() {
+	close(a.done)
+	a.wg.Wait()
+}
@@ -0,0 +1,223 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// orderStorage records when the files are created and closed, in order.
+type orderStorage struct {
+	Storage
+	mu     sync.Mutex
+	events []string
+}
+
+func (s *orderStorage) record(event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+func (s *orderStorage) Create(name string) (io.WriteCloser, error) {
+	w, err := s.Storage.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	s.record("created:" + name)
+	return &orderFile{WriteCloser: w, name: name, s: s}, nil
+}
+
+// index returns the position of event, -1 if it's not recorded.
+func (s *orderStorage) index(event string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.events {
+		if e == event {
+			return i
+		}
+	}
+	return -1
+}
+
+type orderFile struct {
+	io.WriteCloser
+	name string
+	s    *orderStorage
+}
+
+func (f *orderFile) Close() error {
+	err := f.WriteCloser.Close()
+	f.s.record("closed:" + f.name)
+	return err
+}
+
+func createTableResult(table string) *sqltypes.Result {
+	return &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Table", Type: querypb.Type_VARCHAR},
+			{Name: "Create Table", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(table)),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(fmt.Sprintf("CREATE TABLE `%s` (`a` int) ENGINE=InnoDB", table))),
+			},
+		}}
+}
+
+// slowSchemaExecutor answers the SHOW CREATE TABLEs, the ones of slow after
+// a delay, the ones of errs with an error.
+type slowSchemaExecutor struct {
+	slow map[string]time.Duration
+	errs map[string]error
+}
+
+func (e *slowSchemaExecutor) executor(id int) (Executor, error) {
+	return e, nil
+}
+
+func (e *slowSchemaExecutor) Execute(query string) error {
+	return nil
+}
+
+func (e *slowSchemaExecutor) Fetch(query string) (*sqltypes.Result, error) {
+	table := query[strings.LastIndex(query, ".`")+2 : len(query)-1]
+	time.Sleep(e.slow[table])
+	if err := e.errs[table]; err != nil {
+		return nil, err
+	}
+	return createTableResult(table), nil
+}
+
+func (e *slowSchemaExecutor) Ping() error {
+	return nil
+}
+
+func (e *slowSchemaExecutor) Close() error {
+	return nil
+}
+
+func TestSchemaAhead(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	tables := []string{"t1", "t2", "t3", "t4"}
+
+	// The schemas in the order of the tables, a slow one doesn't hold the others.
+	{
+		s := &orderStorage{Storage: NewMemStorage()}
+		args := &DumpArgs{Database: "test", storage: s}
+		exec := &slowSchemaExecutor{slow: map[string]time.Duration{"t1": 200 * time.Millisecond}}
+		pool, err := NewExecutorPool(log, 2, exec.executor)
+		assert.Nil(t, err)
+		a := dumpSchemasAhead(log, pool, args, tables, 2)
+		for i, table := range tables {
+			schema, err := a.get(i)
+			assert.Nil(t, err)
+			assert.Equal(t, fmt.Sprintf("CREATE TABLE `%s` (`a` int) ENGINE=InnoDB;\n", table), schema)
+			assert.True(t, s.index("closed:test."+table+"-schema.sql") >= 0)
+		}
+		a.stop()
+		pool.Close()
+		assert.True(t, s.index("closed:test.t2-schema.sql") < s.index("closed:test.t1-schema.sql"), "%v", s.events)
+	}
+
+	// An error is the one of its table, stop doesn't wait for the tables not started.
+	{
+		s := &orderStorage{Storage: NewMemStorage()}
+		args := &DumpArgs{Database: "test", storage: s}
+		exec := &slowSchemaExecutor{
+			slow: map[string]time.Duration{"t3": 100 * time.Millisecond},
+			errs: map[string]error{"t2": errors.New("mock.table.doesn't.exist")},
+		}
+		pool, err := NewExecutorPool(log, 1, exec.executor)
+		assert.Nil(t, err)
+		a := dumpSchemasAhead(log, pool, args, tables, 1)
+		_, err = a.get(0)
+		assert.Nil(t, err)
+		_, err = a.get(1)
+		assert.NotNil(t, err)
+		a.stop()
+		pool.Close()
+		assert.Equal(t, -1, s.index("closed:test.t4-schema.sql"))
+	}
+}
+
+func TestDumperSchemaThreads(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "a", Type: querypb.Type_INT32}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1"))},
+		}}
+	tablesResult := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Tables_in_test", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t2"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t3"))},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("show tables from .*", tablesResult)
+		fakedbs.AddQueryPattern("select .*", selectResult)
+		fakedbs.AddQuery("show create table `test`.`t1`", createTableResult("t1"))
+		fakedbs.AddQueryDelay("show create table `test`.`t2`", createTableResult("t2"), 1000)
+		fakedbs.AddQuery("show create table `test`.`t3`", createTableResult("t3"))
+	}
+
+	s := &orderStorage{Storage: NewMemStorage()}
+	RegisterStorage("schemaorder", func(location string) (Storage, error) {
+		return s, nil
+	})
+	args := DumpArgs{
+		Database:      "test",
+		Outdir:        "schemaorder://test",
+		User:          "mock",
+		Password:      "mock",
+		Address:       address,
+		ChunksizeInMB: 1,
+		Threads:       2,
+		SchemaThreads: 2,
+		StmtSize:      10000,
+		IntervalMs:    500,
+	}
+	_, err = NewDumper(DumpConfig{DumpArgs: args, Log: log}).Run(context.Background())
+	assert.Nil(t, err)
+
+	// Every schema file is closed before the first data file of its table.
+	for _, table := range []string{"t1", "t2", "t3"} {
+		schema := s.index("closed:test." + table + "-schema.sql")
+		data := s.index("created:test." + table + ".00001.sql")
+		assert.True(t, schema >= 0 && data > schema, "%s:%v", table, s.events)
+	}
+	// The datas of t1 are dumped while the schema of t2 is slow.
+	assert.True(t, s.index("created:test.t1.00001.sql") < s.index("closed:test.t2-schema.sql"), "%v", s.events)
+}
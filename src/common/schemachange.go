@@ -0,0 +1,129 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// autoIncrementOptionRegexp matches the AUTO_INCREMENT=N table option, the
+// inserts move it without changing the definition.
+var autoIncrementOptionRegexp = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// schemaChecksum returns the CRC32 of the create statement of a table, without
+// its AUTO_INCREMENT counter.
+func schemaChecksum(schema string) uint32 {
+	create := strings.TrimSuffix(strings.TrimSpace(schema), ";")
+	options := tableOptions(create)
+	create = create[:len(create)-len(options)] + autoIncrementOptionRegexp.ReplaceAllString(options, "")
+	return crc32.ChecksumIEEE([]byte(create))
+}
+
+// schemaChanged reads the create statement of the table again on conn and
+// returns it if it's not the one of schema, empty if it's the same.
+func schemaChanged(conn *Connection, args *DumpArgs, table string, schema string) (string, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("show create table `%s`.`%s`", args.Database, table))
+	if err != nil {
+		return "", wrapf(err, "dumping.table[%s.%s].schema.recheck.error:%v", args.Database, table, err)
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 {
+		return "", fmt.Errorf("dumping.table[%s.%s].schema.recheck.show.create.table.has.no.row", args.Database, table)
+	}
+	now := qr.Rows[0][1].String()
+	if schemaChecksum(now) == schemaChecksum(schema) {
+		return "", nil
+	}
+	return now, nil
+}
+
+// redumpChangedSchema checks the schema of a table whose datas were just
+// dumped with stats ts is still the one of its schema file, see
+// DumpArgs.CheckSchemaChanges, and dumps the schema and the datas again on
+// conn while it changed, up to DumpArgs.SchemaChangeRetries times. The data
+// files of a dump are removed before the next one, and its stats taken out
+// of the metrics. It returns the schema and the stats of the last dump, and
+// why the table failed if the schema still changed or the first dumps left
+// data files which couldn't be removed and the last one didn't write again:
+// their rows are of the old schema. A table of a Consistency snapshot is
+// never checked, a DDL after the snapshot fails the reads of its rows.
+func redumpChangedSchema(log *xlog.Log, conn *Connection, args *DumpArgs, table string, schema string, ts *TableStats) (string, *TableStats, string, error) {
+	if !args.CheckSchemaChanges || (args.Consistency != "" && args.Consistency != ConsistencyNone) {
+		return schema, ts, "", nil
+	}
+	written := make(map[string]bool)
+	for retry := 0; ; retry++ {
+		changed, err := schemaChanged(conn, args, table, schema)
+		if err != nil {
+			return "", nil, "", err
+		}
+		if changed == "" {
+			break
+		}
+		log.Warning("dumping.table[%s.%s].schema.changed.during.the.dump.crc32[%08x].now[%08x].retry[%d/%d]", args.Database, table, schemaChecksum(schema), schemaChecksum(changed), retry+1, args.SchemaChangeRetries)
+		if retry >= args.SchemaChangeRetries {
+			return schema, ts, fmt.Sprintf("the schema changed during every dump of its datas (%d): the schema file may not match the datas", retry+1), nil
+		}
+		for _, chunk := range ts.chunks {
+			if err := removeFile(args.storage, chunk.Name); err != nil && !os.IsNotExist(err) {
+				log.Warning("dumping.table[%s.%s].stale.file[%s].not.removed:%v", args.Database, table, chunk.Name, err)
+				written[chunk.Name] = true
+			}
+		}
+		args.metrics.redumped(conn.ID, ts)
+		if schema, err = dumpTableSchema(log, conn, args, table); err != nil {
+			return "", nil, "", err
+		}
+		if ts, err = dumpTable(log, conn, args, table, schema); err != nil {
+			return "", nil, "", err
+		}
+	}
+	for _, chunk := range ts.chunks {
+		delete(written, chunk.Name)
+	}
+	if len(written) > 0 {
+		stale := make([]string, 0, len(written))
+		for name := range written {
+			stale = append(stale, name)
+		}
+		sort.Strings(stale)
+		return schema, ts, fmt.Sprintf("dumped again after its schema changed, the data files %s of the first dump are stale: remove them", strings.Join(stale, ",")), nil
+	}
+	return schema, ts, "", nil
+}
+
+// removeFile removes the file name of s, an error if s can't remove files.
+func removeFile(s Storage, name string) error {
+	remover, ok := s.(Remover)
+	if !ok {
+		return fmt.Errorf("storage.can.not.remove.files")
+	}
+	return remover.Remove(name)
+}
+
+// checkDumpFailures warns about the tables manifest.json records as failed,
+// they are restored as they were dumped.
+func checkDumpFailures(log *xlog.Log, s Storage) {
+	m, err := readManifest(s)
+	if err != nil {
+		return
+	}
+	for _, t := range m.Tables {
+		if t.Failed != "" {
+			log.Warning("restoring.table[%s.%s].failed.in.the.dump:%s", t.Database, t.Table, t.Failed)
+		}
+	}
+}
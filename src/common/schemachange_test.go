@@ -0,0 +1,127 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaChecksum(t *testing.T) {
+	schema := "CREATE TABLE `t1` (\n  `id` int NOT NULL AUTO_INCREMENT,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB AUTO_INCREMENT=10 DEFAULT CHARSET=utf8"
+	// The counter moves with the inserts, the column does not.
+	assert.Equal(t, schemaChecksum(schema), schemaChecksum("CREATE TABLE `t1` (\n  `id` int NOT NULL AUTO_INCREMENT,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB AUTO_INCREMENT=2400 DEFAULT CHARSET=utf8;\n"))
+	assert.Equal(t, schemaChecksum(schema), schemaChecksum("CREATE TABLE `t1` (\n  `id` int NOT NULL AUTO_INCREMENT,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8"))
+	assert.NotEqual(t, schemaChecksum(schema), schemaChecksum("CREATE TABLE `t1` (\n  `id` bigint NOT NULL AUTO_INCREMENT,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB AUTO_INCREMENT=10 DEFAULT CHARSET=utf8"))
+}
+
+func TestShowCreateTableNoRow(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := &DumpArgs{Database: "test"}
+	// The table was dropped in the meantime, the SHOW CREATE TABLE has no row.
+	conn := &Connection{exec: &recordingConn{r: &recordingExecutor{}}}
+
+	_, err := dumpTableSchema(log, conn, args, "t1")
+	assert.Equal(t, "dumping.table[test.t1].show.create.table.has.no.row", err.Error())
+	_, err = dumpAutoIncrement(conn, args, "t1")
+	assert.Equal(t, "dumping.table[test.t1].auto.increment.show.create.table.has.no.row", err.Error())
+	_, err = schemaChanged(conn, args, "t1", "CREATE TABLE `t1` (`a` int)")
+	assert.Equal(t, "dumping.table[test.t1].schema.recheck.show.create.table.has.no.row", err.Error())
+	_, err = tableRows(conn, "test", "t1")
+	assert.Equal(t, "table[test.t1].count.has.no.row", err.Error())
+}
+
+func TestRedumpChangedSchema(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	schema := "CREATE TABLE `t1` (\n  `a` int\n) ENGINE=InnoDB;\n"
+	query := "show create table `test`.`t1`"
+	created := func(create string) map[string]*sqltypes.Result {
+		return map[string]*sqltypes.Result{query: stringsResult([]string{"Table", "Create Table"}, []string{"t1", create})}
+	}
+	ts := &TableStats{Rows: 1, Files: 1, chunks: []checkpointChunk{{Name: "test.t1.00001.sql"}}}
+
+	// The same schema.
+	{
+		rec := &recordingExecutor{results: created("CREATE TABLE `t1` (\n  `a` int\n) ENGINE=InnoDB")}
+		args := &DumpArgs{Database: "test", CheckSchemaChanges: true, SchemaChangeRetries: 2}
+		got, stats, failed, err := redumpChangedSchema(log, &Connection{exec: &recordingConn{r: rec}}, args, "t1", schema, ts)
+		assert.Nil(t, err)
+		assert.Equal(t, schema, got)
+		assert.Equal(t, ts, stats)
+		assert.Equal(t, "", failed)
+		assert.Equal(t, []string{query}, rec.queries)
+	}
+
+	// A schema changed without retries left fails the table.
+	{
+		rec := &recordingExecutor{results: created("CREATE TABLE `t1` (\n  `a` int,\n  `b` int\n) ENGINE=InnoDB")}
+		args := &DumpArgs{Database: "test", CheckSchemaChanges: true}
+		_, _, failed, err := redumpChangedSchema(log, &Connection{exec: &recordingConn{r: rec}}, args, "t1", schema, ts)
+		assert.Nil(t, err)
+		assert.Equal(t, "the schema changed during every dump of its datas (1): the schema file may not match the datas", failed)
+	}
+
+	// The data files of a dump are removed before the next one, its stats
+	// taken out of the metrics.
+	{
+		rec := &recordingExecutor{results: created("CREATE TABLE `t1` (\n  `a` int,\n  `b` int\n) ENGINE=InnoDB")}
+		storage := NewMemStorage()
+		x := writeFile(storage, "test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\n")
+		AssertNil(x)
+		var bytes, rows uint64
+		metrics := newMetrics(log, "dump", nil, &bytes, &rows)
+		metrics.addProgress(1, 30, 1)
+		metrics.addProgress(2, 50, 2)
+		metrics.addFiles(2)
+		metrics.recordFile(fileEvent{file: "test.t1.00001.sql"})
+		metrics.recordFile(fileEvent{file: "test.t2.00001.sql"})
+		args := &DumpArgs{Database: "test", CheckSchemaChanges: true, SchemaChangeRetries: 1, storage: storage, metrics: metrics}
+		ts := &TableStats{Rows: 1, Files: 1, rowBytes: 30, chunks: []checkpointChunk{{Name: "test.t1.00001.sql"}}}
+		_, _, _, err := redumpChangedSchema(log, &Connection{ID: 1, exec: &rereadConn{recordingConn: recordingConn{r: rec}}}, args, "t1", schema, ts)
+		assert.NotNil(t, err)
+		_, err = storage.Stat("test.t1.00001.sql")
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, uint64(50), metrics.bytesDone())
+		assert.Equal(t, uint64(2), metrics.rowsDone())
+		assert.Equal(t, uint64(1), atomic.LoadUint64(&metrics.files))
+		assert.Equal(t, uint64(1), atomic.LoadUint64(&metrics.filesDone))
+	}
+
+	// Not checked in a snapshot, or without CheckSchemaChanges.
+	for _, args := range []*DumpArgs{
+		{Database: "test", CheckSchemaChanges: true, Consistency: ConsistencyLock},
+		{Database: "test"},
+	} {
+		rec := &recordingExecutor{}
+		_, _, failed, err := redumpChangedSchema(log, &Connection{exec: &recordingConn{r: rec}}, args, "t1", schema, ts)
+		assert.Nil(t, err)
+		assert.Equal(t, "", failed)
+		assert.Nil(t, rec.queries)
+	}
+}
+
+// rereadConn is a recordingConn whose reads fail but the first one.
+type rereadConn struct {
+	recordingConn
+	reads int
+}
+
+func (c *rereadConn) Fetch(query string) (*sqltypes.Result, error) {
+	if c.reads++; c.reads > 1 {
+		return nil, errors.New("mock.reread.error")
+	}
+	return c.recordingConn.Fetch(query)
+}
@@ -0,0 +1,208 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// verifySchemaPhase is the phase of LoadArgs.VerifySchema in the metrics.
+const verifySchemaPhase = "verify_schema"
+
+// schemaRule is a difference between two create table statements of the same
+// table which doesn't make them different tables, see normalizeCreateTable.
+type schemaRule struct {
+	name string
+	re   *regexp.Regexp
+	repl string
+}
+
+// schemaRules are the rules of normalizeCreateTable, in order.
+var schemaRules = []schemaRule{
+	// The counter moves with the rows, the restore sets it once the datas are in.
+	{"auto_increment", regexp.MustCompile(`(?i)\s+AUTO_INCREMENT=\d+`), ""},
+	// The default of InnoDB since MySQL 5.7.9, shown or not.
+	{"row_format", regexp.MustCompile(`(?i)\s+ROW_FORMAT=DYNAMIC`), ""},
+	// MySQL 8.0.30 shows utf8 as utf8mb3, the collations too.
+	{"utf8mb3", regexp.MustCompile(`(?i)\butf8(_|\b)`), "utf8mb3$1"},
+	// MySQL 8.0.19 dropped the display widths of the integers.
+	{"int_display_width", regexp.MustCompile(`(?i)\b(tinyint|smallint|mediumint|int|bigint)\(\d+\)`), "$1"},
+	// A dump with -if-not-exists or a restore with -create-if-not-exists.
+	{"if_not_exists", regexp.MustCompile(`(?i)^(\s*CREATE\s+TABLE\s+)IF\s+NOT\s+EXISTS\s+`), "$1"},
+}
+
+// normalizeCreateTable returns the lines of a create table statement with the
+// differences of schemaRules removed, trimmed of their spaces and of their
+// trailing comma: the last definition has none.
+func normalizeCreateTable(create string) []string {
+	create = strings.TrimSuffix(strings.TrimSpace(create), ";")
+	for _, rule := range schemaRules {
+		create = rule.re.ReplaceAllString(create, rule.repl)
+	}
+	var lines []string
+	for _, line := range strings.Split(create, "\n") {
+		if line = strings.TrimSuffix(strings.TrimSpace(line), ","); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// schemaDiff returns the differences of the create table statement of the
+// target with the dumped one, none if they are the same table: the lines
+// only in the dump with a '-', the ones only in the target with a '+'.
+func schemaDiff(dumped string, target string) []string {
+	want, got := normalizeCreateTable(dumped), normalizeCreateTable(target)
+	counts := make(map[string]int)
+	for _, line := range got {
+		counts[line]++
+	}
+	var diff []string
+	for _, line := range want {
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		diff = append(diff, "- "+line)
+	}
+	for _, line := range got {
+		if counts[line] > 0 {
+			counts[line]--
+			diff = append(diff, "+ "+line)
+		}
+	}
+	if len(diff) == 0 && strings.Join(want, "\n") != strings.Join(got, "\n") {
+		diff = append(diff, "the columns or the indexes are in another order")
+	}
+	return diff
+}
+
+// verifySchema compares the restored table of the schema file with the
+// create table statement of the file as the restore executes it, it returns
+// the differences, none if there is no CREATE TABLE in the file.
+func verifySchema(conn *Connection, args *LoadArgs, schema *schemaFile) ([]string, error) {
+	stmts, _, err := schemaStatements(args.store(), schema.path, schema.sql, args.ExpandSource)
+	if err != nil {
+		return nil, err
+	}
+	// The logs of the changes were written by the restore.
+	quiet := xlog.NewXLog(ioutil.Discard, xlog.Level(xlog.PANIC))
+	var create string
+	for _, stmt := range stmts {
+		if statementKind(stmt.sql) == StatementCreateTable {
+			if create, err = rewriteStatement(args, stmt.file, schema.db, schema.table, schemaQuery(quiet, args, schema, stmt.sql)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if create == "" {
+		return nil, nil
+	}
+	table := args.targetTable(schema.table)
+	qr, err := conn.Fetch(fmt.Sprintf("SHOW CREATE TABLE `%s`.`%s`", schema.db, table))
+	if err != nil {
+		return nil, err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) < 2 {
+		return nil, fmt.Errorf("restoring.verify.schema[%s.%s].show.create.table.has.no.row", schema.db, table)
+	}
+	return schemaDiff(create, qr.Rows[0][1].String()), nil
+}
+
+// verifySchemas compares every restored table of the schema files with its
+// schema, on the connections of the pool at once, see LoadArgs.VerifySchema.
+// A table which differs fails it once they are all compared, with the
+// differences of each. A done ctx stops it, the tables being compared are
+// waited for.
+func verifySchemas(ctx context.Context, log *xlog.Log, pool *Pool, args *LoadArgs, paths []string) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs firstError
+	var problems []string
+	verified := 0
+	for _, path := range paths {
+		if errs.get() != nil || ctx.Err() != nil {
+			break
+		}
+		schema, err := readSchemaFile(args.store(), path)
+		if err != nil {
+			return err
+		}
+		conn := pool.Get()
+		wg.Add(1)
+		go func(conn *Connection, schema *schemaFile) {
+			defer func() {
+				wg.Done()
+				pool.Put(conn)
+			}()
+			diff, err := verifySchema(conn, args, schema)
+			if err != nil {
+				errs.set(wrapf(err, "restoring.verify.schema[%s].error:%v", schema.key(), err))
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			verified++
+			if len(diff) > 0 {
+				log.Error("restoring.verify.schema[%s].mismatch:%s", schema.key(), strings.Join(diff, " | "))
+				problems = append(problems, fmt.Sprintf("%s:\n    %s", schema.key(), strings.Join(diff, "\n    ")))
+			}
+		}(conn, schema)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := errs.get(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("restoring.verify.schema.tables[%d/%d].mismatch:\n  %s", len(problems), verified, strings.Join(problems, "\n  "))
+	}
+	log.Info("restoring.verify.schema.tables[%d].all.match", verified)
+	return nil
+}
+
+// VerifySchema compares the tables of the dump in args.Outdir restored on
+// the target of args with their schema files, without restoring anything,
+// see LoadArgs.VerifySchema. args.Threads tables are compared at once, the
+// tables are looked for under LoadArgs.TablePrefix and TableSuffix. A done
+// ctx closes the connections.
+func VerifySchema(ctx context.Context, log *xlog.Log, args LoadArgs) error {
+	storage, err := openDumpStorage(log, args.Outdir, args.Volumes)
+	if err != nil {
+		return err
+	}
+	args.storage = storage
+	files, err := loadFiles(storage)
+	if err != nil {
+		return err
+	}
+	threads := args.Threads
+	if threads < 1 {
+		threads = 1
+	}
+	pool, err := newLoadPool(log, &args, threads)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	defer pool.CloseOnDone(ctx)()
+	return verifySchemas(ctx, log, pool, &args, files.schemas)
+}
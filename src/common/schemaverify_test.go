@@ -0,0 +1,141 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaDiff(t *testing.T) {
+	// The SHOW CREATE TABLE of the source and of the target.
+	tests := []struct {
+		name   string
+		dumped string
+		target string
+		diff   []string
+	}{
+		{
+			name:   "auto_increment",
+			dumped: "CREATE TABLE `t1` (\n  `id` bigint NOT NULL AUTO_INCREMENT,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB AUTO_INCREMENT=1042 DEFAULT CHARSET=utf8mb4;\n",
+			target: "CREATE TABLE `t1` (\n  `id` bigint NOT NULL AUTO_INCREMENT,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB AUTO_INCREMENT=17 DEFAULT CHARSET=utf8mb4",
+		},
+		{
+			name:   "row_format",
+			dumped: "CREATE TABLE `t1` (\n  `id` bigint NOT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=latin1 ROW_FORMAT=DYNAMIC",
+			target: "CREATE TABLE `t1` (\n  `id` bigint NOT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=latin1",
+		},
+		{
+			name:   "utf8mb3",
+			dumped: "CREATE TABLE `t1` (\n  `name` varchar(64) CHARACTER SET utf8 COLLATE utf8_bin DEFAULT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			target: "CREATE TABLE `t1` (\n  `name` varchar(64) CHARACTER SET utf8mb3 COLLATE utf8mb3_bin DEFAULT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3",
+		},
+		{
+			name:   "int_display_width",
+			dumped: "CREATE TABLE `t1` (\n  `a` int(11) DEFAULT NULL,\n  `b` tinyint(4) unsigned NOT NULL,\n  `c` bigint(20) DEFAULT NULL\n) ENGINE=InnoDB",
+			target: "CREATE TABLE `t1` (\n  `a` int DEFAULT NULL,\n  `b` tinyint unsigned NOT NULL,\n  `c` bigint DEFAULT NULL\n) ENGINE=InnoDB",
+		},
+		{
+			name:   "if_not_exists",
+			dumped: "CREATE TABLE IF NOT EXISTS `t1` (\n  `id` int NOT NULL\n) ENGINE=InnoDB",
+			target: "CREATE TABLE `t1` (\n  `id` int NOT NULL\n) ENGINE=InnoDB",
+		},
+		{
+			name:   "utf8mb4 is not utf8",
+			dumped: "CREATE TABLE `t1` (\n  `name` varchar(64) DEFAULT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			target: "CREATE TABLE `t1` (\n  `name` varchar(64) DEFAULT NULL\n) ENGINE=InnoDB DEFAULT CHARSET=utf8",
+			diff:   []string{"- ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4", "+ ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb3"},
+		},
+		{
+			name:   "a missing index and another column type",
+			dumped: "CREATE TABLE `t1` (\n  `id` int NOT NULL,\n  `total` decimal(10,2) DEFAULT NULL,\n  PRIMARY KEY (`id`),\n  KEY `idx_total` (`total`)\n) ENGINE=InnoDB",
+			target: "CREATE TABLE `t1` (\n  `id` int NOT NULL,\n  `total` decimal(12,2) DEFAULT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB",
+			diff:   []string{"- `total` decimal(10,2) DEFAULT NULL", "- KEY `idx_total` (`total`)", "+ `total` decimal(12,2) DEFAULT NULL"},
+		},
+		{
+			name:   "another engine",
+			dumped: "CREATE TABLE `t1` (\n  `id` int NOT NULL\n) ENGINE=MyISAM",
+			target: "CREATE TABLE `t1` (\n  `id` int NOT NULL\n) ENGINE=InnoDB",
+			diff:   []string{"- ) ENGINE=MyISAM", "+ ) ENGINE=InnoDB"},
+		},
+		{
+			name:   "the columns in another order",
+			dumped: "CREATE TABLE `t1` (\n  `a` int,\n  `b` int\n) ENGINE=InnoDB",
+			target: "CREATE TABLE `t1` (\n  `b` int,\n  `a` int\n) ENGINE=InnoDB",
+			diff:   []string{"the columns or the indexes are in another order"},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.diff, schemaDiff(test.dumped, test.target), test.name)
+	}
+
+	// Every rule has its pair.
+	names := make(map[string]bool)
+	for _, test := range tests {
+		names[test.name] = true
+	}
+	for _, rule := range schemaRules {
+		assert.True(t, names[rule.name], rule.name)
+	}
+}
+
+func TestLoaderVerifySchema(t *testing.T) {
+	dir := "/tmp/loaderverifyschema"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (\n  `a` int(11) NOT NULL,\n  `b` varchar(10) CHARACTER SET utf8 DEFAULT NULL,\n  PRIMARY KEY (`a`)\n) ENGINE=InnoDB AUTO_INCREMENT=5 DEFAULT CHARSET=utf8mb4;\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (\n  `a` int NOT NULL,\n  KEY `idx_a` (`a`)\n) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1,'x');\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500, VerifySchema: true, TablePrefix: "new_"}
+	t1 := "CREATE TABLE `new_t1` (\n  `a` int NOT NULL,\n  `b` varchar(10) CHARACTER SET utf8mb3 DEFAULT NULL,\n  PRIMARY KEY (`a`)\n) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+	t2 := "CREATE TABLE `new_t2` (\n  `a` int NOT NULL,\n  KEY `idx_a` (`a`)\n) ENGINE=InnoDB"
+	show := func(table string, create string) *sqltypes.Result {
+		return stringsResult([]string{"Table", "Create Table"}, []string{table, create})
+	}
+
+	// The restored tables, of the prefix, are the dumped ones.
+	{
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			"SHOW CREATE TABLE `test`.`new_t1`": show("new_t1", t1),
+			"SHOW CREATE TABLE `test`.`new_t2`": show("new_t2", t2),
+		}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		assert.Equal(t, 2, len(matchingQueries(rec.queries, "SHOW CREATE TABLE")))
+		_, ok := report.PhaseSeconds[verifySchemaPhase]
+		assert.True(t, ok)
+	}
+
+	// A target which dropped an index fails the restore before the datas.
+	{
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{
+			"SHOW CREATE TABLE `test`.`new_t1`": show("new_t1", t1),
+			"SHOW CREATE TABLE `test`.`new_t2`": show("new_t2", "CREATE TABLE `new_t2` (\n  `a` int NOT NULL\n) ENGINE=InnoDB"),
+		}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "restoring.verify.schema.tables[1/2].mismatch:\n  test.t2:\n    - KEY `idx_a` (`a`)")
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "INSERT")))
+	}
+}
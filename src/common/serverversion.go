@@ -0,0 +1,124 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// serverVersionRegexp matches the major, minor and patch of a VERSION(), like
+// '8.0.32', '5.7.42-log' or '10.6.12-MariaDB-1:10.6.12+maria~ubu2004'.
+var serverVersionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)\.(\d+)`)
+
+// serverVersion is the parsed VERSION() of a server.
+type serverVersion struct {
+	major, minor, patch int
+	mariadb             bool
+}
+
+// parseServerVersion parses a VERSION(), ok is false if it's not one.
+func parseServerVersion(s string) (v serverVersion, ok bool) {
+	match := serverVersionRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return v, false
+	}
+	v.major, _ = strconv.Atoi(match[1])
+	v.minor, _ = strconv.Atoi(match[2])
+	v.patch, _ = strconv.Atoi(match[3])
+	v.mariadb = strings.Contains(strings.ToLower(s), "mariadb")
+	return v, true
+}
+
+// flavor returns MariaDB or MySQL.
+func (v serverVersion) flavor() string {
+	if v.mariadb {
+		return "MariaDB"
+	}
+	return "MySQL"
+}
+
+// compare returns -1, 0 or 1 if v is older than, the same as or newer than o,
+// up to the patch if patch is set, else the minor.
+func (v serverVersion) compare(o serverVersion, patch bool) int {
+	a := []int{v.major, v.minor, v.patch}
+	b := []int{o.major, o.minor, o.patch}
+	if !patch {
+		a, b = a[:2], b[:2]
+	}
+	for i := range a {
+		switch {
+		case a[i] < b[i]:
+			return -1
+		case a[i] > b[i]:
+			return 1
+		}
+	}
+	return 0
+}
+
+// fetchServerVersion returns the VERSION() of the server of conn.
+func fetchServerVersion(conn *Connection) (string, error) {
+	qr, err := conn.Fetch("SELECT VERSION()")
+	if err != nil {
+		return "", err
+	}
+	if len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+		return "", fmt.Errorf("server.version.has.no.row")
+	}
+	return qr.Rows[0][0].String(), nil
+}
+
+// checkServerVersion compares the version of the source server recorded in
+// the manifest.json of the dump with the one of the target of conn. A target
+// of an older major or minor version of the same flavor fails the restore
+// before any statement, unless AllowVersionDowngrade: the dump may have
+// syntax it doesn't know. An older patch, or a target of the other flavor, is
+// a warning. A dump without the version, or a version which doesn't parse,
+// is not checked.
+func checkServerVersion(log *xlog.Log, conn *Connection, args *LoadArgs) error {
+	m, err := readManifest(args.store())
+	if err != nil || m.ServerVersion == "" {
+		log.Info("restoring.source.version[unknown].not.checked")
+		return nil
+	}
+	target, err := fetchServerVersion(conn)
+	if err != nil {
+		log.Warning("restoring.target.version.error.not.checked:%v", err)
+		return nil
+	}
+	sv, ok1 := parseServerVersion(m.ServerVersion)
+	tv, ok2 := parseServerVersion(target)
+	if !ok1 || !ok2 {
+		log.Info("restoring.source.version[%s].target.version[%s].not.checked", m.ServerVersion, target)
+		return nil
+	}
+	log.Info("restoring.source.version[%s].target.version[%s]", m.ServerVersion, target)
+
+	switch {
+	case sv.mariadb != tv.mariadb:
+		log.Warning("restoring.source.version[%s].target.version[%s].flavors.differ:%s syntax of the dump may fail on %s, check the compatibility report",
+			m.ServerVersion, target, sv.flavor(), tv.flavor())
+	case tv.compare(sv, false) < 0:
+		msg := fmt.Sprintf("restoring.target.version[%s].older.than.source[%s]:the %d.%d syntax of the dump, like functional indexes or the utf8mb4_0900 collations, "+
+			"may fail on the target with a syntax error, restore into %s %d.%d or later", target, m.ServerVersion, sv.major, sv.minor, sv.flavor(), sv.major, sv.minor)
+		if !args.AllowVersionDowngrade {
+			return fmt.Errorf("%s, or set AllowVersionDowngrade (-allow-version-downgrade) to try anyway", msg)
+		}
+		log.Warning("%s, going on as AllowVersionDowngrade is set", msg)
+	case tv.compare(sv, true) < 0:
+		log.Warning("restoring.target.version[%s].older.than.source[%s]:a feature of a later patch release may fail on the target", target, m.ServerVersion)
+	}
+	return nil
+}
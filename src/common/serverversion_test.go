@@ -0,0 +1,108 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerVersionCompare(t *testing.T) {
+	tests := []struct {
+		source string
+		target string
+		minor  int
+		patch  int
+	}{
+		{"8.0.32", "5.7.42-log", -1, -1},
+		{"8.0.32", "8.0.28", 0, -1},
+		{"8.0.32", "8.0.32", 0, 0},
+		{"5.7.42", "8.0.32", 1, 1},
+		{"8.0.32", "8.4.0", 1, 1},
+		{"10.6.12-MariaDB-1:10.6.12+maria~ubu2004", "10.11.2-MariaDB", 1, 1},
+	}
+	for _, test := range tests {
+		sv, ok := parseServerVersion(test.source)
+		assert.True(t, ok)
+		tv, ok := parseServerVersion(test.target)
+		assert.True(t, ok)
+		assert.Equal(t, test.minor, tv.compare(sv, false), "%s vs %s", test.target, test.source)
+		assert.Equal(t, test.patch, tv.compare(sv, true), "%s vs %s", test.target, test.source)
+	}
+
+	v, ok := parseServerVersion("10.6.12-MariaDB")
+	assert.True(t, ok)
+	assert.Equal(t, serverVersion{major: 10, minor: 6, patch: 12, mariadb: true}, v)
+	assert.Equal(t, "MariaDB", v.flavor())
+	_, ok = parseServerVersion("unknown")
+	assert.False(t, ok)
+}
+
+func TestLoaderServerVersion(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert .*", &sqltypes.Result{})
+	}
+
+	dir := "/tmp/loaderserverversion"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int, KEY `k` ((`a` + 1))) ENGINE=InnoDB;\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/"+manifestFile, `{"version": "0.2.0", "server_version": "8.0.32", "tables": []}`)
+	AssertNil(x)
+
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: address, Threads: 1, IntervalMs: 500}
+
+	// A 5.7 target is refused before any statement.
+	{
+		fakedbs.AddQuery("select version()", singleResult("VERSION()", "5.7.42-log"))
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "restoring.target.version[5.7.42-log].older.than.source[8.0.32]"))
+		assert.Equal(t, 0, fakedbs.GetQueryCalledNum("create database if not exists `test`"))
+	}
+
+	// Unless asked to go on.
+	{
+		args.AllowVersionDowngrade = true
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+		args.AllowVersionDowngrade = false
+	}
+
+	// An older patch only warns.
+	{
+		fakedbs.AddQuery("select version()", singleResult("VERSION()", "8.0.28"))
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// defaultSmallFileMaxBytes is the largest data file of a SmallFileBatch
+// when LoadArgs.SmallFileMaxBytes is 0.
+const defaultSmallFileMaxBytes = 1 << 20
+
+// smallFileMaxBytes returns the largest data file of a SmallFileBatch.
+func (args *LoadArgs) smallFileMaxBytes() int64 {
+	if args.SmallFileMaxBytes > 0 {
+		return args.SmallFileMaxBytes
+	}
+	return defaultSmallFileMaxBytes
+}
+
+// restoreSmallFiles restores a batch of small data files of the same
+// database back to back on conn, each in autocommit as a file of its own, under
+// one 'use' and with one log line for the batch, see LoadArgs.SmallFileBatch.
+// It returns the bytes of the files and how many of them were restored before
+// the one which failed: unlike a transaction batch, those stay restored.
+// Once the MaxRuntime is reached the next file is not started, the run
+// returns a *stoppedError for it at offset 0.
+func restoreSmallFiles(log *xlog.Log, conn *Connection, args *LoadArgs, files []string) (int, int, error) {
+	db := unitDatabase(files)
+	defer args.metrics.endWork(conn.ID)
+
+	log.Debug("restoring.small.files.database[%s].files[%d].thread[%d]", db, len(files), conn.ID)
+	if err := useDatabase(conn, args, db); err != nil {
+		args.metrics.fileFailed(files[0], err)
+		return 0, 0, wrapf(err, "restoring.small.files.database[%s].error:%v", db, err)
+	}
+	bytes := 0
+	for i, file := range files {
+		if i > 0 && args.runtime.reached() {
+			return bytes, i, &stoppedError{file: file}
+		}
+		_, tbl, _ := parseTableFile(file)
+		args.metrics.startWork(conn.ID, db+"."+tbl, file)
+		n, err := executeTableFile(log, conn, args, file, nil)
+		if _, ok := err.(*stoppedError); ok {
+			return bytes, i, err
+		}
+		if err != nil {
+			args.metrics.fileFailed(file, err)
+			return bytes, i, wrapf(err, "restoring.file[%s].error:%v", file, err)
+		}
+		bytes += n
+		args.metrics.threadBytes(conn.ID, uint64(n))
+		args.metrics.fileDone(file)
+	}
+	args.metrics.smallFilesDone(len(files))
+	log.Debug("restoring.small.files.database[%s].files[%d].bytes[%d].thread[%d].done...", db, len(files), bytes, conn.ID)
+	return bytes, len(files), nil
+}
+
+// logSmallFilesSummary logs the summary line of the small file batches of a
+// load, none if it had none.
+func logSmallFilesSummary(log *xlog.Log, action string, r Report) {
+	if r.SmallFileBatches == 0 {
+		return
+	}
+	logSummary(log, "%s.small.files.batches[%d].files[%d].files.per.batch[%.1f]", action, r.SmallFileBatches, r.SmallFiles, float64(r.SmallFiles)/float64(r.SmallFileBatches))
+}
@@ -0,0 +1,103 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoaderSmallFileBatch(t *testing.T) {
+	dir := "/tmp/loadersmallfiles"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	files := map[string]string{
+		"a-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `a`;",
+		"b-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `b`;",
+		"a.big-schema.sql":    "CREATE TABLE `big` (`a` int) ENGINE=InnoDB;\n",
+		"a.big.00001.sql":     "INSERT INTO `big` VALUES (" + strings.Repeat("1", 100) + ");\n",
+	}
+	for _, db := range []string{"a", "b"} {
+		for i := 1; i <= 4; i++ {
+			files[fmt.Sprintf("%s.t%d-schema.sql", db, i)] = fmt.Sprintf("CREATE TABLE `t%d` (`a` int) ENGINE=InnoDB;\n", i)
+			files[fmt.Sprintf("%s.t%d.00001.sql", db, i)] = fmt.Sprintf("INSERT INTO `t%d` VALUES (%d);\n", i, i)
+		}
+	}
+	for name, sql := range files {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, SmallFileBatch: 2, SmallFileMaxBytes: 64}
+
+	// The small files are restored by batches of a database under one
+	// 'use', the large one on its own.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(9), report.FilesDone)
+		assert.Equal(t, uint64(4), report.SmallFileBatches)
+		assert.Equal(t, uint64(8), report.SmallFiles)
+		assert.Equal(t, 9, len(matchingQueries(rec.queries, "INSERT")))
+
+		LogReport(log, report)
+		assert.True(t, strings.Contains(buf.String(), "restoring.small.files.batches[4].files[8].files.per.batch[2.0]"), buf.String())
+	}
+
+	// A failure stops its batch, the files restored before it are recorded
+	// for a resume and not restored again.
+	{
+		path := dir + ".jsonl"
+		os.Remove(path)
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		dup := sqldb.NewSQLError(1062, "Duplicate entry '2' for key 'PRIMARY'")
+		rec := &recordingExecutor{errs: map[string]error{"INSERT INTO `t2` VALUES (2)": dup}}
+		args := args
+		args.SmallFileBatch = 4
+		args.ResumeFile = path
+		args.ShuffleSeed = 1
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		data, rerr := ReadFile(path)
+		assert.Nil(t, rerr)
+		journal := string(data)
+		assert.False(t, strings.Contains(journal, "t2.00001.sql"), journal)
+
+		// The batch is cut where it failed.
+		var restored []string
+		for _, query := range rec.queries {
+			if strings.HasPrefix(query, "INSERT INTO `t") && query != "INSERT INTO `t2` VALUES (2)" {
+				restored = append(restored, query)
+			}
+		}
+		assert.NotEmpty(t, restored)
+		for _, query := range restored {
+			n := strings.TrimPrefix(query, "INSERT INTO `t")[:1]
+			assert.True(t, strings.Contains(journal, ".t"+n+".00001.sql"), "%s not recorded:%s", query, journal)
+		}
+
+		rec = &recordingExecutor{}
+		args.Resume = true
+		_, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 9-len(restored), len(matchingQueries(rec.queries, "INSERT")))
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+const (
+	// smokeRows bounds the rows of a table dumped by DumpArgs.SmokeTest.
+	smokeRows = 1000
+	// smokeSuffix is before the suffix of the format in the data file of a
+	// table of DumpArgs.SmokeTest, like 'db.t1.smoke.sql'.
+	smokeSuffix = ".smoke"
+)
+
+// SmokeTable is the outcome of a table of DumpArgs.SmokeTest.
+type SmokeTable struct {
+	// Table is 'db.table'.
+	Table   string  `json:"table"`
+	Rows    uint64  `json:"rows"`
+	Bytes   uint64  `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	// Error is why the table failed, empty if it was dumped.
+	Error string `json:"error,omitempty"`
+}
+
+// smokeFile reports whether the data file name is one of DumpArgs.SmokeTest,
+// 'db.table.smoke.sql': the data file of a table named smoke is not.
+func smokeFile(name string) bool {
+	splits := strings.Split(filepath.Base(name), ".")
+	return len(splits) == 4 && "."+splits[2] == smokeSuffix
+}
+
+// smokeOrder returns the quoted columns of the primary key of the create
+// table statement schema, comma separated, the order of the rows of
+// DumpArgs.SmokeTest: empty if it has none.
+func smokeOrder(schema string) string {
+	var columns []string
+	for _, def := range tableDefinitions(schema) {
+		if name, attrs, ok := columnDefinition(def); ok {
+			if inlinePrimaryKeyRegexp.MatchString(attrs) {
+				return name
+			}
+			continue
+		}
+		if match := primaryKeyRegexp.FindStringSubmatch(def); match != nil {
+			// A prefix length like `b`(10) is not a column.
+			columns = quotedNameRegexp.FindAllString(match[1], -1)
+		}
+	}
+	return strings.Join(columns, ",")
+}
+
+// smokeTest runs the DumpArgs.SmokeTest of args instead of the dump: every
+// table gets its schema file and a data file of its first smokeRows rows, by
+// its primary key. A table which fails doesn't stop the others, the outcome
+// of each is in the metrics, the error lists the failed ones.
+func smokeTest(ctx context.Context, log *xlog.Log, args *DumpArgs) error {
+	if args.storage == nil {
+		storage, err := OpenStorage(args.Outdir)
+		if err != nil {
+			return err
+		}
+		args.storage = withPerm(storage, args.filePerm())
+	}
+	pool, err := NewPool(log, args.Threads, args.Address, args.User, args.Password)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+	defer pool.CloseOnDone(ctx)()
+	args.metrics.pool = pool
+
+	conn := pool.Get()
+	args.serverVersion, _ = fetchServerVersion(conn)
+	err = dumpDatabaseSchema(log, conn, args)
+	if err == nil && args.Format == FormatJSONL {
+		if args.sessionTimeZone, err = sessionTimeZone(conn); err != nil {
+			err = wrapf(err, "dumping.session.time.zone.error:%v", err)
+		}
+	}
+	tables := strings.Split(args.Table, ",")
+	if err == nil && args.Table == "" {
+		tables, err = allTables(conn, args)
+	}
+	pool.Put(conn)
+	if err != nil {
+		return err
+	}
+	args.metrics.setTables(len(tables))
+	args.metrics.addFiles(len(tables))
+	log.Info("dumping.smoke.test.tables[%d].rows[%d]...", len(tables), smokeRows)
+
+	t := args.metrics.phaseStarted("data")
+	args.metrics.threadsStarted(args.Threads)
+	var wg sync.WaitGroup
+	for _, table := range tables {
+		if err := ctx.Err(); err != nil {
+			break
+		}
+		conn := pool.Get()
+		wg.Add(1)
+		go func(conn *Connection, table string) {
+			args.metrics.workerStarted()
+			args.metrics.startWork(conn.ID, args.Database+"."+table, "")
+			defer func() {
+				args.metrics.endWork(conn.ID)
+				args.metrics.workerDone()
+				wg.Done()
+				pool.Put(conn)
+			}()
+			start := time.Now()
+			st := SmokeTable{Table: args.Database + "." + table}
+			schema, err := dumpTableSchema(log, conn, args, table)
+			if err == nil {
+				st.Rows, st.Bytes, err = dumpSmokeTable(conn, args, table, schema)
+			}
+			st.Seconds = time.Since(start).Seconds()
+			if err != nil {
+				st.Error = err.Error()
+				log.Error("dumping.smoke.table[%s].error:%v", st.Table, err)
+			} else {
+				log.Info("dumping.smoke.table[%s].rows[%d].bytes[%d].done", st.Table, st.Rows, st.Bytes)
+				args.metrics.tableDone()
+			}
+			args.metrics.smokeDone(st)
+		}(conn, table)
+	}
+	wg.Wait()
+	args.metrics.threadsDone()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	args.metrics.phaseDone("data", t)
+	var failed []string
+	for _, st := range args.metrics.smokeTables() {
+		if st.Error != "" {
+			failed = append(failed, st.Table)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("dumping.smoke.test.tables[%d/%d].failed:%s", len(failed), len(tables), strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// dumpSmokeTable writes the data file of the first smokeRows rows of a table
+// of DumpArgs.SmokeTest, in the format of args, and returns its rows and
+// bytes. The file is written without a row too.
+func dumpSmokeTable(conn *Connection, args *DumpArgs, table string, schema string) (uint64, uint64, error) {
+	query := fmt.Sprintf("select /*backup*/ %s from `%s`.`%s`", selectColumns(schema), args.Database, table)
+	if order := smokeOrder(schema); order != "" {
+		query += " order by " + order
+	}
+	query += fmt.Sprintf(" limit %d", smokeRows)
+	cursor, err := conn.StreamFetch(query)
+	if err != nil {
+		return 0, 0, err
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			cursor.Close()
+		}
+	}()
+
+	var names []string
+	for _, fld := range cursor.Fields() {
+		names = append(names, fld.Name)
+	}
+	format := args.format()
+	if format.columns != nil {
+		if err := format.columns(args, table, cursor.Fields(), schema); err != nil {
+			return 0, 0, err
+		}
+	}
+	w := format.writer(args)
+	w.BeginTable(table, names)
+	defer w.EndTable()
+	var rows uint64
+	started := time.Now()
+	for cursor.Next() {
+		row, err := cursor.RowValues()
+		if err != nil {
+			return 0, 0, err
+		}
+		n := w.WriteRow(row)
+		rows++
+		args.metrics.addProgress(conn.ID, uint64(n), 1)
+	}
+	closed = true
+	if err := cursor.Close(); err != nil {
+		return 0, 0, err
+	}
+
+	data := w.EndChunk()
+	if args.FileTrailers {
+		data = append([]byte(fileHeader(args, table, "smoke", started)), data...)
+		data = append(data, fileTrailer(data, rows)...)
+	}
+	file := fmt.Sprintf("%s.%s%s%s", args.Database, table, smokeSuffix, format.suffix)
+	if err := writeFile(args.storage, file, string(data)); err != nil {
+		args.metrics.fileFailed(file, err)
+		return 0, 0, err
+	}
+	args.metrics.fileDone(file)
+	return rows, uint64(len(data)), nil
+}
+
+// smokeDone records the outcome of a table of DumpArgs.SmokeTest.
+func (m *Metrics) smokeDone(st SmokeTable) {
+	if m != nil {
+		m.mu.Lock()
+		m.smoke = append(m.smoke, st)
+		m.mu.Unlock()
+	}
+}
+
+// smokeTables returns the outcomes of the tables of DumpArgs.SmokeTest,
+// sorted by table.
+func (m *Metrics) smokeTables() []SmokeTable {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tables := append([]SmokeTable(nil), m.smoke...)
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Table < tables[j].Table })
+	return tables
+}
+
+// logSmokeSummary logs the outcome of every table of a smoke test, then
+// their count.
+func logSmokeSummary(log *xlog.Log, action string, tables []SmokeTable) {
+	if len(tables) == 0 {
+		return
+	}
+	failed := 0
+	for _, st := range tables {
+		if st.Error != "" {
+			failed++
+			logSummary(log, "%s.smoke.table[%s].failed:%s", action, st.Table, st.Error)
+			continue
+		}
+		logSummary(log, "%s.smoke.table[%s].ok.rows[%d].bytes[%d].cost[%.2fsec]", action, st.Table, st.Rows, st.Bytes, st.Seconds)
+	}
+	logSummary(log, "%s.smoke.tables[%d].ok[%d].failed[%d]", action, len(tables), len(tables)-failed, failed)
+}
+
+// checkSmokeFiles refuses the data files of a DumpArgs.SmokeTest, unless
+// allow: they are the first rows of the tables, not a dump.
+func checkSmokeFiles(log *xlog.Log, files *Files, allow bool) error {
+	var smoke []string
+	for _, name := range files.tables {
+		if smokeFile(name) {
+			smoke = append(smoke, name)
+		}
+	}
+	if len(smoke) == 0 {
+		return nil
+	}
+	if !allow {
+		return fmt.Errorf("restoring.smoke.test.files[%d].refused, they are the first %d rows of the tables of a smoke test, not a dump (allow them with AllowSmoke):\n  %s", len(smoke), smokeRows, strings.Join(smoke, ", "))
+	}
+	for _, name := range smoke {
+		log.Warning("restoring.smoke.test.file[%s].restored.anyway", name)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSmokeFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"test.t1.smoke.sql":         true,
+		"/backup/test.t1.smoke.sql": true,
+		"test.t1.smoke.csv":         true,
+		"test.t1.00001.sql":         false,
+		"test.smoke.sql":            false,
+		"test.smoke.00001.sql":      false,
+	} {
+		assert.Equal(t, want, smokeFile(name), name)
+	}
+}
+
+func TestSmokeOrder(t *testing.T) {
+	for schema, want := range map[string]string{
+		"CREATE TABLE `t1` (\n  `id` bigint NOT NULL,\n  `b` varchar(10),\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB":             "`id`",
+		"CREATE TABLE `t1` (\n  `a` int NOT NULL,\n  `b` varchar(64) NOT NULL,\n  PRIMARY KEY (`a`,`b`(10))\n) ENGINE=InnoDB": "`a`,`b`",
+		"CREATE TABLE `t1` (`id` int NOT NULL PRIMARY KEY, `b` int) ENGINE=InnoDB":                                            "`id`",
+		"CREATE TABLE `t1` (\n  `a` int,\n  UNIQUE KEY `uk` (`a`)\n) ENGINE=MyISAM":                                           "",
+	} {
+		assert.Equal(t, want, smokeOrder(schema), schema)
+	}
+}
+
+func TestDumperSmokeTest(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	schema := func(table string) *sqltypes.Result {
+		return &sqltypes.Result{
+			Fields: []*querypb.Field{{Name: "Table", Type: querypb.Type_VARCHAR}, {Name: "Create Table", Type: querypb.Type_VARCHAR}},
+			Rows: [][]sqltypes.Value{{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(table)),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `"+table+"` (\n  `id` int NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB")),
+			}},
+		}
+	}
+	fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+	fakedbs.AddQueryPattern("show create table `test`.`t1`", schema("t1"))
+	fakedbs.AddQueryPattern("show create table `test`.`t2`", schema("t2"))
+	fakedbs.AddQueryPattern("show tables from .*", &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Tables_in_test", Type: querypb.Type_VARCHAR}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1"))},
+			{sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t2"))},
+		},
+	})
+	fakedbs.AddQueryPattern("select /\\*backup\\*/ \\* from `test`.`t1` order by `id` limit 1000", &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "id", Type: querypb.Type_INT32}},
+		Rows: [][]sqltypes.Value{
+			{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1"))},
+			{sqltypes.MakeTrusted(querypb.Type_INT32, []byte("2"))},
+		},
+	})
+	fakedbs.AddQueryErrorPattern("select /\\*backup\\*/ \\* from `test`.`t2` .*", errors.New("SELECT command denied to user 'backup'@'%' for table 't2'"))
+	fakedbs.AddQueryPattern("select .*", &sqltypes.Result{})
+
+	args := DumpArgs{Database: "test", Outdir: "/tmp/dumpersmoketest", User: "mock", Password: "mock", Address: server.Addr(),
+		ChunksizeInMB: 1, Threads: 2, StmtSize: 10000, IntervalMs: 500, SmokeTest: true}
+	os.RemoveAll(args.Outdir)
+	x := os.MkdirAll(args.Outdir, 0777)
+	AssertNil(x)
+
+	// t2 fails without stopping t1, the report has both.
+	report, err := NewDumper(DumpConfig{DumpArgs: args, Log: log}).Run(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, "dumping.smoke.test.tables[1/2].failed:test.t2", err.Error())
+	assert.Equal(t, 2, len(report.Smoke))
+	assert.Equal(t, "test.t1", report.Smoke[0].Table)
+	assert.Equal(t, uint64(2), report.Smoke[0].Rows)
+	assert.Equal(t, "", report.Smoke[0].Error)
+	assert.Equal(t, "test.t2", report.Smoke[1].Table)
+	assert.Contains(t, report.Smoke[1].Error, "SELECT command denied")
+	dat, err := ioutil.ReadFile(args.Outdir + "/test.t1.smoke.sql")
+	assert.Nil(t, err)
+	assert.Contains(t, string(dat), "(1)")
+	_, err = os.Stat(args.Outdir + "/test.t1.00001.sql")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(args.Outdir + "/test.t1-schema.sql")
+	assert.Nil(t, err)
+}
+
+func TestLoaderSmokeFiles(t *testing.T) {
+	dir := "/tmp/loadersmokefiles"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.smoke.sql":      "INSERT INTO `t1` VALUES (1);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+
+	// Refused before any statement.
+	{
+		rec := &recordingExecutor{}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "restoring.smoke.test.files[1].refused"), err.Error())
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "CREATE")))
+	}
+
+	// Restored with AllowSmoke.
+	{
+		args.AllowSmoke = true
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1)"}, matchingQueries(rec.queries, "INSERT"))
+	}
+}
+
+func TestReportSmoke(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "info", "")
+	assert.Nil(t, err)
+	LogReport(log, Report{Mode: "dump", Status: RunFailed, Smoke: []SmokeTable{
+		{Table: "test.t1", Rows: 1000, Bytes: 20480, Seconds: 0.25},
+		{Table: "test.t2", Error: "SELECT command denied"},
+	}})
+	assert.Contains(t, out.String(), "dumping.smoke.table[test.t1].ok.rows[1000].bytes[20480].cost[0.25sec]")
+	assert.Contains(t, out.String(), "dumping.smoke.table[test.t2].failed:SELECT command denied")
+	assert.Contains(t, out.String(), "dumping.smoke.tables[2].ok[1].failed[1]")
+}
@@ -0,0 +1,164 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/common"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// maxSourceDepth bounds the nesting of the SOURCE includes.
+const maxSourceDepth = 16
+
+// sourceRegexp matches a SOURCE directive of the mysql client on its own
+// line, 'SOURCE file' or '\. file', with an optional ';'.
+var sourceRegexp = regexp.MustCompile(`(?i)^(?:SOURCE|\\\.)\s+(.+?)\s*;?\s*$`)
+
+// sourcedStatement is a statement of a schema file, or of a file it
+// includes with a SOURCE directive.
+type sourcedStatement struct {
+	statement
+	// file is the file of the statement, its offset is in it.
+	file string
+}
+
+// sourceDirective returns the file a statement starting with a SOURCE
+// directive names, after its comment lines, and where the line of the
+// directive ends in the statement.
+func sourceDirective(sql string) (name string, end int, ok bool) {
+	for start := 0; start < len(sql); {
+		end = strings.IndexByte(sql[start:], '\n')
+		if end < 0 {
+			end = len(sql)
+		} else {
+			end += start
+		}
+		line := strings.TrimSpace(sql[start:end])
+		if line != "" && !strings.HasPrefix(line, "#") && !isDashComment(line) {
+			match := sourceRegexp.FindStringSubmatch(line)
+			if match == nil {
+				return "", 0, false
+			}
+			return match[1], end, true
+		}
+		start = end + 1
+	}
+	return "", 0, false
+}
+
+// sourcePath resolves the file name of a SOURCE directive of file, relative
+// to the directory of file. It must stay in the dump.
+func sourcePath(file string, name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", fmt.Errorf("the path must be relative to the including file")
+	}
+	include := path.Join(path.Dir(file), name)
+	if include == ".." || strings.HasPrefix(include, "../") {
+		return "", fmt.Errorf("the path is outside of the dump")
+	}
+	return include, nil
+}
+
+// schemaStatements splits the schema file file of the storage s, with the
+// content sql, into its statements. A SOURCE directive of the mysql client
+// is an error naming the file and its line, unless expand: the file it names
+// is then split in its place, and so on up to maxSourceDepth, a file which
+// includes itself is an error. includes are the files included.
+func schemaStatements(s Storage, file string, sql string, expand bool) (stmts []sourcedStatement, includes []string, err error) {
+	var walk func(file string, sql string, from int, to int, chain []string) error
+	walk = func(file string, sql string, from int, to int, chain []string) error {
+		for _, stmt := range splitStatements(sql[from:to]) {
+			stmt.offset += from
+			name, end, ok := sourceDirective(stmt.sql)
+			if !ok {
+				stmts = append(stmts, sourcedStatement{statement: stmt, file: file})
+				continue
+			}
+			line := strings.Count(sql[:stmt.offset+end], "\n") + 1
+			if !expand {
+				return fmt.Errorf("restoring.schema.file[%s].line[%d].source[%s]:SOURCE is a command of the mysql client the server doesn't know, "+
+					"set ExpandSource (-expand-source) to restore the file it includes", file, line, name)
+			}
+			include, err := sourcePath(file, name)
+			if err != nil {
+				return wrapf(err, "restoring.schema.file[%s].line[%d].source[%s]:%v", file, line, name, err)
+			}
+			for _, f := range chain {
+				if f == include {
+					return fmt.Errorf("restoring.schema.file[%s].line[%d].source[%s]:includes itself through %s", file, line, name, strings.Join(append(chain, include), " -> "))
+				}
+			}
+			if len(chain) > maxSourceDepth {
+				return fmt.Errorf("restoring.schema.file[%s].line[%d].source[%s]:more than %d nested includes", file, line, name, maxSourceDepth)
+			}
+			data, err := readFile(s, include)
+			if err != nil {
+				return wrapf(err, "restoring.schema.file[%s].line[%d].source[%s].error:%v", file, line, name, err)
+			}
+			includes = append(includes, include)
+			included := common.BytesToString(data)
+			if err := walk(include, included, 0, len(included), append(append([]string{}, chain...), include)); err != nil {
+				return err
+			}
+			// The statement goes on after the directive without a ';'.
+			if err := walk(file, sql, stmt.offset+end, stmt.offset+len(stmt.sql), chain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(file, sql, 0, len(sql), []string{file}); err != nil {
+		return nil, nil, err
+	}
+	return stmts, includes, nil
+}
+
+// checkSourceIncludes checks the SOURCE directives of the schema files
+// before any statement, see schemaStatements, and drops the files they
+// include from the files restored: they are restored with their schema file.
+func checkSourceIncludes(log *xlog.Log, s Storage, files *Files, expand bool) error {
+	included := make(map[string]bool)
+	for _, file := range files.schemas {
+		data, err := readFile(s, file)
+		if err != nil {
+			return err
+		}
+		_, includes, err := schemaStatements(s, file, common.BytesToString(data), expand)
+		if err != nil {
+			return err
+		}
+		if len(includes) > 0 {
+			log.Info("restoring.schema.file[%s].sources[%s]", file, strings.Join(includes, ","))
+		}
+		for _, include := range includes {
+			included[include] = true
+		}
+	}
+	if len(included) == 0 {
+		return nil
+	}
+	drop := func(names []string) []string {
+		var kept []string
+		for _, name := range names {
+			if !included[name] {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	}
+	files.schemas = drop(files.schemas)
+	files.tables = drop(files.tables)
+	return nil
+}
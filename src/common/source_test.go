@@ -0,0 +1,103 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaStatementsSource(t *testing.T) {
+	s := NewMemStorage()
+	for name, sql := range map[string]string{
+		"test.t1-schema.sql":     "-- the shared columns\nSOURCE include/types.sql;\nCREATE TABLE `t1` (`a` int);\n\\. include/index.sql\nALTER TABLE `t1` ADD KEY (`a`);\n",
+		"include/types.sql":      "CREATE TABLE `types` (`id` int);\nsource ../test.t0.sql\n",
+		"include/index.sql":      "CREATE TABLE `idx` (`id` int);",
+		"test.t0.sql":            "CREATE TABLE `t0` (`id` int);",
+		"test.loop-schema.sql":   "SOURCE loop.sql;\n",
+		"loop.sql":               "SOURCE test.loop-schema.sql;\n",
+		"test.out-schema.sql":    "SOURCE ../etc/passwd;\n",
+		"test.abs-schema.sql":    "SOURCE /etc/passwd;\n",
+		"test.gone-schema.sql":   "CREATE TABLE `gone` (`id` int);\nSOURCE gone.sql;\n",
+		"test.quoted-schema.sql": "CREATE TABLE `q` (`a` varchar(32) DEFAULT 'SOURCE x.sql');\n",
+	} {
+		x := writeFile(s, name, sql)
+		AssertNil(x)
+	}
+	read := func(name string) string {
+		data, err := readFile(s, name)
+		AssertNil(err)
+		return string(data)
+	}
+
+	// Expanded in place, relative to the including file.
+	{
+		stmts, includes, err := schemaStatements(s, "test.t1-schema.sql", read("test.t1-schema.sql"), true)
+		assert.Nil(t, err)
+		var got []string
+		for _, stmt := range stmts {
+			got = append(got, stmt.file+":"+stmt.sql)
+		}
+		want := []string{
+			"include/types.sql:CREATE TABLE `types` (`id` int)",
+			"test.t0.sql:CREATE TABLE `t0` (`id` int)",
+			"test.t1-schema.sql:CREATE TABLE `t1` (`a` int)",
+			"include/index.sql:CREATE TABLE `idx` (`id` int)",
+			"test.t1-schema.sql:ALTER TABLE `t1` ADD KEY (`a`)",
+		}
+		assert.Equal(t, want, got)
+		assert.Equal(t, []string{"include/types.sql", "test.t0.sql", "include/index.sql"}, includes)
+		assert.Equal(t, strings.Index(read("test.t1-schema.sql"), "ALTER"), stmts[4].offset)
+	}
+
+	// Without ExpandSource, the file and the line of the directive.
+	{
+		_, _, err := schemaStatements(s, "test.t1-schema.sql", read("test.t1-schema.sql"), false)
+		assert.NotNil(t, err)
+		assert.True(t, strings.HasPrefix(err.Error(), "restoring.schema.file[test.t1-schema.sql].line[2].source[include/types.sql]:SOURCE is a command of the mysql client"))
+	}
+
+	// The errors.
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{"test.loop-schema.sql", "restoring.schema.file[loop.sql].line[1].source[test.loop-schema.sql]:includes itself through test.loop-schema.sql -> loop.sql -> test.loop-schema.sql"},
+		{"test.out-schema.sql", "restoring.schema.file[test.out-schema.sql].line[1].source[../etc/passwd]:the path is outside of the dump"},
+		{"test.abs-schema.sql", "restoring.schema.file[test.abs-schema.sql].line[1].source[/etc/passwd]:the path must be relative to the including file"},
+		{"test.gone-schema.sql", "restoring.schema.file[test.gone-schema.sql].line[2].source[gone.sql].error:"},
+	}
+	for _, test := range tests {
+		_, _, err := schemaStatements(s, test.file, read(test.file), true)
+		assert.NotNil(t, err, test.file)
+		assert.True(t, strings.HasPrefix(err.Error(), test.err), err.Error())
+	}
+
+	// A SOURCE in a string is not a directive.
+	{
+		stmts, includes, err := schemaStatements(s, "test.quoted-schema.sql", read("test.quoted-schema.sql"), false)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(stmts))
+		assert.Nil(t, includes)
+	}
+
+	// The included files are not restored as data files.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		files := &Files{schemas: []string{"test.t1-schema.sql"}, tables: []string{"include/index.sql", "include/types.sql", "test.t0.sql", "test.t1.00001.sql"}}
+		assert.Nil(t, checkSourceIncludes(log, s, files, true))
+		assert.Equal(t, []string{"test.t1-schema.sql"}, files.schemas)
+		assert.Equal(t, []string{"test.t1.00001.sql"}, files.tables)
+		assert.NotNil(t, checkSourceIncludes(log, s, files, false))
+	}
+}
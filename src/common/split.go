@@ -0,0 +1,148 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"strings"
+)
+
+// defaultDelimiter is the statement terminator until a DELIMITER statement changes it.
+const defaultDelimiter = ";"
+
+// statement is a statement of a SQL file and its byte offset in the file.
+type statement struct {
+	sql    string
+	offset int
+	// terminated is set if the statement ends with the delimiter, or is only
+	// comments, the last statement of a truncated file isn't.
+	terminated bool
+}
+
+// splitStatements splits a SQL file into its statements, the way the mysql
+// client does: a statement ends at the active delimiter outside of quotes and
+// comments, with or without a newline after it. 'DELIMITER $$' on its own line
+// switches the delimiter (for routine and trigger bodies) until the next
+// DELIMITER statement, the DELIMITER lines themselves are not returned.
+// The statements are trimmed and the empty ones dropped, the line comments
+// the sql starts with too, like the header of DumpArgs.FileTrailers.
+func splitStatements(sql string) []statement {
+	var stmts []statement
+	delimiter := defaultDelimiter
+	start := 0
+	// blank is set while only whitespace and line comments are seen since start.
+	blank := true
+	// leading is set until the first statement ends.
+	leading := true
+	emit := func(end int, terminated bool) {
+		leading = false
+		raw := sql[start:end]
+		if stmt := strings.TrimSpace(raw); stmt != "" {
+			offset := start + len(raw) - len(strings.TrimLeft(raw, " \t\n\r"))
+			stmts = append(stmts, statement{sql: stmt, offset: offset, terminated: terminated})
+		}
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case blank && (c == 'D' || c == 'd') && isDelimiterStatement(sql[i:]):
+			eol := strings.IndexByte(sql[i:], '\n')
+			if eol < 0 {
+				eol = len(sql) - i
+			}
+			if d := strings.TrimSpace(sql[i+len("DELIMITER") : i+eol]); d != "" {
+				delimiter = d
+			}
+			i += eol
+			start = i
+		case c == '#' || isDashComment(sql[i:]):
+			i = skipComment(sql, i)
+			if leading && blank {
+				start = i
+			}
+		case strings.HasPrefix(sql[i:], delimiter):
+			emit(i, true)
+			i += len(delimiter)
+			start = i
+			blank = true
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(sql, i)
+			blank = false
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			i = skipComment(sql, i)
+			blank = false
+		default:
+			if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				blank = false
+			}
+			i++
+		}
+	}
+	// Only comments after the last delimiter are no statement cut short.
+	emit(len(sql), blank)
+	return stmts
+}
+
+// isDelimiterStatement reports whether s starts with 'DELIMITER ', in any case.
+func isDelimiterStatement(s string) bool {
+	const keyword = "DELIMITER"
+	return len(s) > len(keyword) && strings.EqualFold(s[:len(keyword)], keyword) && (s[len(keyword)] == ' ' || s[len(keyword)] == '\t')
+}
+
+// isDashComment reports whether s starts with a '-- ' comment, the dashes
+// must be followed by a whitespace or the end.
+func isDashComment(s string) bool {
+	if !strings.HasPrefix(s, "--") {
+		return false
+	}
+	return len(s) == 2 || s[2] == ' ' || s[2] == '\t' || s[2] == '\n' || s[2] == '\r'
+}
+
+// skipComment returns the index after the '#', '-- ' or '/* */' comment
+// starting at i, or i if none starts there. A line comment ends after its
+// newline, an unterminated comment at the end of sql.
+func skipComment(sql string, i int) int {
+	switch {
+	case sql[i] == '#' || isDashComment(sql[i:]):
+		if eol := strings.IndexByte(sql[i:], '\n'); eol >= 0 {
+			return i + eol + 1
+		}
+		return len(sql)
+	case strings.HasPrefix(sql[i:], "/*"):
+		if end := strings.Index(sql[i+2:], "*/"); end >= 0 {
+			return i + 2 + end + 2
+		}
+		return len(sql)
+	}
+	return i
+}
+
+// skipQuoted returns the index after the quoted string or identifier starting at i,
+// backslash escapes apply to strings only.
+func skipQuoted(sql string, i int) int {
+	end, _ := scanQuoted(sql, i)
+	return end
+}
+
+// scanQuoted is skipQuoted also reporting whether the quote is closed.
+func scanQuoted(sql string, i int) (int, bool) {
+	quote := sql[i]
+	for j := i + 1; j < len(sql); j++ {
+		switch sql[j] {
+		case '\\':
+			if quote != '`' {
+				j++
+			}
+		case quote:
+			return j + 1, true
+		}
+	}
+	return len(sql), false
+}
@@ -0,0 +1,102 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{
+			name: "dumper chunk",
+			sql:  "/*!40101 SET NAMES binary*/;\nINSERT INTO `t1`(`a`) VALUES\n(1),\n(2);\nINSERT INTO `t1`(`a`) VALUES\n(3);\n",
+			want: []string{"/*!40101 SET NAMES binary*/", "INSERT INTO `t1`(`a`) VALUES\n(1),\n(2)", "INSERT INTO `t1`(`a`) VALUES\n(3)"},
+		},
+		{
+			name: "no newline after the terminator",
+			sql:  "SET a=1;SET b=2;  SET c=3",
+			want: []string{"SET a=1", "SET b=2", "SET c=3"},
+		},
+		{
+			name: "terminator in strings, identifiers and comments",
+			sql:  "INSERT INTO `t;1` VALUES ('a;b', \"c\\\";d\", 'it''s;');\n-- a; comment\nSELECT 1 /* x; y */;\n# other; comment\nSELECT 2;",
+			want: []string{"INSERT INTO `t;1` VALUES ('a;b', \"c\\\";d\", 'it''s;')", "-- a; comment\nSELECT 1 /* x; y */", "# other; comment\nSELECT 2"},
+		},
+		{
+			name: "routine",
+			sql: "DROP PROCEDURE IF EXISTS `p1`;\n" +
+				"DELIMITER $$\n" +
+				"CREATE PROCEDURE `p1`()\nBEGIN\n  SELECT 1;\n  SELECT ';$';\nEND$$\n" +
+				"CREATE TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW BEGIN SET NEW.a = 1; END $$\n" +
+				"DELIMITER ;\n" +
+				"SELECT 3;\n",
+			want: []string{
+				"DROP PROCEDURE IF EXISTS `p1`",
+				"CREATE PROCEDURE `p1`()\nBEGIN\n  SELECT 1;\n  SELECT ';$';\nEND",
+				"CREATE TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW BEGIN SET NEW.a = 1; END",
+				"SELECT 3",
+			},
+		},
+		{
+			name: "mysqldump style delimiter after comments",
+			sql:  "--\n-- Dumping routines\n--\ndelimiter ;;\nCREATE FUNCTION `f`() RETURNS int RETURN 1 ;;\nDELIMITER ;\n",
+			want: []string{"CREATE FUNCTION `f`() RETURNS int RETURN 1"},
+		},
+		{
+			name: "delimiter inside a statement is not a DELIMITER statement",
+			sql:  "INSERT INTO `t` VALUES ('x')\nDELIMITER $$;",
+			want: []string{"INSERT INTO `t` VALUES ('x')\nDELIMITER $$"},
+		},
+		{
+			name: "header comments",
+			sql:  "-- go-mydumper\n# chunk 00001\n\nINSERT INTO `t` VALUES (1);\n-- a comment\nINSERT INTO `t` VALUES (2);\n",
+			want: []string{"INSERT INTO `t` VALUES (1)", "-- a comment\nINSERT INTO `t` VALUES (2)"},
+		},
+		{
+			name: "empty",
+			sql:  " ;\n;\n",
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, stmt := range splitStatements(test.sql) {
+			got = append(got, stmt.sql)
+			assert.Equal(t, stmt.sql, test.sql[stmt.offset:stmt.offset+len(stmt.sql)], test.name)
+		}
+		assert.Equal(t, test.want, got, test.name)
+	}
+}
+
+func TestSplitStatementsTerminated(t *testing.T) {
+	// A truncated file: its last statement has no terminator, an unclosed
+	// string runs to the end of the file.
+	stmts := splitStatements("INSERT INTO `t` VALUES (1);\nINSERT INTO `t` VALUES (2),\n(3")
+	assert.Equal(t, 2, len(stmts))
+	assert.True(t, stmts[0].terminated)
+	assert.False(t, stmts[1].terminated)
+
+	stmts = splitStatements("INSERT INTO `t` VALUES ('a;b);\n")
+	assert.Equal(t, 1, len(stmts))
+	assert.False(t, stmts[0].terminated)
+
+	// A comment after the last statement.
+	stmts = splitStatements("DELIMITER $$\nCREATE TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW BEGIN SET NEW.a = 1; END $$\nDELIMITER ;\n-- done\n")
+	assert.Equal(t, 2, len(stmts))
+	assert.True(t, stmts[0].terminated)
+	assert.True(t, stmts[1].terminated)
+}
@@ -0,0 +1,75 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The LoadArgs.LogSQL levels.
+const (
+	// LogSQLNone logs no statement, only the failed ones.
+	LogSQLNone = "none"
+	// LogSQLDDL logs the database and table schema statements verbatim.
+	LogSQLDDL = "ddl"
+	// LogSQLAll logs the schema statements verbatim and the data statements redacted.
+	LogSQLAll = "all"
+)
+
+// defaultLogSQLMaxBytes is the prefix of a redacted statement kept in the log.
+const defaultLogSQLMaxBytes = 256
+
+// redactedLiteral replaces the content of the string literals of a redacted statement.
+const redactedLiteral = "…"
+
+// redactSQL returns query with the content of its string literals replaced
+// by '…', so no value of the datas ends in the log, truncated to max bytes.
+func redactSQL(query string, max int) string {
+	redacted := mapLiterals(query, func(string) string { return redactedLiteral })
+	if max <= 0 || len(redacted) <= max {
+		return redacted
+	}
+	// Don't cut a rune in two.
+	for max > 0 && !utf8.RuneStart(redacted[max]) {
+		max--
+	}
+	return fmt.Sprintf("%s...(%d bytes)", redacted[:max], len(query))
+}
+
+// logSQLMaxBytes returns the LogSQLMaxBytes of args, the default if unset.
+func (args *LoadArgs) logSQLMaxBytes() int {
+	if args.LogSQLMaxBytes > 0 {
+		return args.LogSQLMaxBytes
+	}
+	return defaultLogSQLMaxBytes
+}
+
+// logDDL logs a schema statement of file before it's executed, if LogSQL asks for it.
+func logDDL(log *xlog.Log, args *LoadArgs, file string, query string) {
+	if args.LogSQL == LogSQLDDL || args.LogSQL == LogSQLAll {
+		log.Info("restoring.sql.file[%s]:%s", file, query)
+	}
+}
+
+// logData logs a data statement of file before it's executed, redacted, if LogSQL asks for it.
+func logData(log *xlog.Log, args *LoadArgs, file string, query string) {
+	if args.LogSQL == LogSQLAll {
+		log.Info("restoring.sql.file[%s]:%s", file, redactSQL(query, args.logSQLMaxBytes()))
+	}
+}
+
+// logFailedSQL logs a failed statement of file, whatever LogSQL is: always
+// redacted, with its byte offset in the file and the MySQL error number.
+func logFailedSQL(log *xlog.Log, args *LoadArgs, file string, stmt statement, err error) {
+	log.Error("restoring.sql.file[%s].offset[%d].errno[%d].failed:%s, error:%v", file, stmt.offset, errorNumber(err), redactSQL(stmt.sql, args.logSQLMaxBytes()), err)
+}
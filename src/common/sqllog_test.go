@@ -0,0 +1,89 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSqlLogRedact(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		max   int
+		want  string
+	}{
+		{
+			name:  "literals",
+			query: "INSERT INTO `t'1`(`a`,`b`) VALUES\n(1,'secret'),\n(2,\"it\\\"s\")",
+			want:  "INSERT INTO `t'1`(`a`,`b`) VALUES\n(1,'…'),\n(2,\"…\")",
+		},
+		{
+			name:  "truncated",
+			query: "INSERT INTO `t1` VALUES (1),(2),(3)",
+			max:   16,
+			want:  "INSERT INTO `t1`...(35 bytes)",
+		},
+		{
+			name:  "not in a rune",
+			query: "INSERT INTO t VALUES ('x')",
+			max:   24,
+			want:  "INSERT INTO t VALUES ('...(26 bytes)",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, redactSQL(test.query, test.max), test.name)
+	}
+}
+
+func TestSqlLogLevels(t *testing.T) {
+	ddl := "CREATE TABLE `t1` (`a` varchar(8) DEFAULT 'x')"
+	data := "INSERT INTO `t1` VALUES ('secret')"
+	tests := []struct {
+		level string
+		want  []string
+		not   []string
+	}{
+		{level: "", not: []string{ddl, "INSERT"}},
+		{level: LogSQLNone, not: []string{ddl, "INSERT"}},
+		{level: LogSQLDDL, want: []string{ddl}, not: []string{"INSERT"}},
+		{level: LogSQLAll, want: []string{ddl, "INSERT INTO `t1` VALUES ('…')"}, not: []string{"secret"}},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		log, err := NewLog(out, "info", "text")
+		assert.Nil(t, err)
+		args := &LoadArgs{LogSQL: test.level}
+		logDDL(log, args, "/tmp/test.t1-schema.sql", ddl)
+		logData(log, args, "/tmp/test.t1.00001.sql", data)
+		for _, want := range test.want {
+			assert.True(t, strings.Contains(out.String(), want), test.level+":"+want)
+		}
+		for _, not := range test.not {
+			assert.False(t, strings.Contains(out.String(), not), test.level+":"+not)
+		}
+	}
+
+	// Failed statements are always logged, redacted.
+	{
+		out := &bytes.Buffer{}
+		log, err := NewLog(out, "info", "text")
+		assert.Nil(t, err)
+		logFailedSQL(log, &LoadArgs{LogSQL: LogSQLNone}, "/tmp/test.t1.00001.sql", statement{sql: data, offset: 42}, errors.New("mock.error"))
+		got := out.String()
+		assert.True(t, strings.Contains(got, "file[/tmp/test.t1.00001.sql].offset[42].errno[0].failed:INSERT INTO `t1` VALUES ('…')"), got)
+		assert.False(t, strings.Contains(got, "secret"), got)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+const statsFile = "stats.tsv"
+
+// statsHeader is the first line of stats.tsv, the columns never change order,
+// new ones are only appended.
+const statsHeader = "db\ttable\tengine\trows\tbytes\tfiles\tseconds\tmb_per_sec\n"
+
+// TableStats are the figures of one dumped table, a line of stats.tsv and the
+// stats of the table in manifest.json.
+type TableStats struct {
+	Engine string `json:"engine"`
+	Rows   uint64 `json:"rows"`
+	// Bytes are the bytes written to the data files of the table.
+	Bytes    uint64  `json:"bytes"`
+	Files    int     `json:"files"`
+	Seconds  float64 `json:"seconds"`
+	MBPerSec float64 `json:"mb_per_sec"`
+
+	// chunks are the data files written, for the checkpoint.
+	chunks []checkpointChunk
+	// paranoid are the sums of the chunks of DumpArgs.Paranoid, nil without it.
+	paranoid *paranoidSums
+	// chunkKey is the chunkKey of DumpArgs.ChunkRows the table was read by,
+	// empty if it was read at once.
+	chunkKey string
+	// rowBytes are the bytes of the rows added to the metrics.
+	rowBytes uint64
+	// next are the labels of the data files which would follow the ones
+	// written, one per key range, see checkStaleChunk.
+	next []string
+}
+
+// engineRegexp matches the table option ENGINE=xxx of a create table statement.
+var engineRegexp = regexp.MustCompile(`ENGINE=(\w+)`)
+
+// tableEngine returns the storage engine of a create table statement, empty for a view.
+func tableEngine(schema string) string {
+	if match := engineRegexp.FindStringSubmatch(tableOptions(schema)); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// autoIncrementRegexp matches the table option AUTO_INCREMENT=N of a create table statement.
+var autoIncrementRegexp = regexp.MustCompile(`AUTO_INCREMENT=(\d+)`)
+
+// tableAutoIncrement returns the AUTO_INCREMENT counter of a create table statement, 0 if it has none.
+func tableAutoIncrement(schema string) uint64 {
+	if match := autoIncrementRegexp.FindStringSubmatch(tableOptions(schema)); match != nil {
+		n, _ := strconv.ParseUint(match[1], 10, 64)
+		return n
+	}
+	return 0
+}
+
+// tableOptions returns the table options of a create table statement, what's after the columns.
+func tableOptions(schema string) string {
+	for i := len(schema) - 1; i >= 0; i-- {
+		if schema[i] == ')' {
+			return schema[i:]
+		}
+	}
+	return ""
+}
+
+// statsWriter appends the lines of stats.tsv as the tables finish, every line
+// is written straight to the file so a failed dump keeps the finished tables.
+type statsWriter struct {
+	mu   sync.Mutex
+	file io.WriteCloser
+}
+
+func newStatsWriter(s Storage) (*statsWriter, error) {
+	f, err := createLog(s, statsFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(f, statsHeader); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &statsWriter{file: f}, nil
+}
+
+func (w *statsWriter) write(db string, table string, s *TableStats) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := fmt.Fprintf(w.file, "%s\t%s\t%s\t%d\t%d\t%d\t%.3f\t%.2f\n", db, table, s.Engine, s.Rows, s.Bytes, s.Files, s.Seconds, s.MBPerSec)
+	return err
+}
+
+func (w *statsWriter) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
@@ -0,0 +1,65 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsTableEngine(t *testing.T) {
+	assert.Equal(t, "InnoDB", tableEngine("CREATE TABLE `t1` (`a` int(11) COMMENT 'ENGINE=x') ENGINE=InnoDB DEFAULT CHARSET=utf8"))
+	assert.Equal(t, "MyISAM", tableEngine("CREATE TABLE `t1` (`a` int(11)) ENGINE=MyISAM"))
+	assert.Equal(t, "", tableEngine("CREATE VIEW `v1` AS select 1 AS `1`"))
+}
+
+func TestStatsTableAutoIncrement(t *testing.T) {
+	assert.Equal(t, uint64(1001), tableAutoIncrement("CREATE TABLE `t1` (`id` int NOT NULL AUTO_INCREMENT, PRIMARY KEY (`id`)) ENGINE=InnoDB AUTO_INCREMENT=1001 DEFAULT CHARSET=utf8"))
+	assert.Equal(t, uint64(0), tableAutoIncrement("CREATE TABLE `t1` (`id` int NOT NULL AUTO_INCREMENT, PRIMARY KEY (`id`)) ENGINE=InnoDB"))
+}
+
+func TestStatsWriter(t *testing.T) {
+	dir := "/tmp/statswritertest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	w, err := newStatsWriter(NewDirStorage(dir))
+	assert.Nil(t, err)
+	x = w.write("test", "t1", &TableStats{Engine: "InnoDB", Rows: 10, Bytes: 2 * 1024 * 1024, Files: 2, Seconds: 0.5, MBPerSec: 4})
+	AssertNil(x)
+
+	// Each line is on disk as soon as it's written.
+	data, err := ReadFile(dir + "/" + statsFile)
+	assert.Nil(t, err)
+	assert.Equal(t, statsHeader+"test\tt1\tInnoDB\t10\t2097152\t2\t0.500\t4.00\n", string(data))
+	x = w.close()
+	AssertNil(x)
+
+	// Same records in the manifest.
+	m := newManifest()
+	m.addTable("test", "t1", "CREATE TABLE `t1` (`a` int(11)) ENGINE=InnoDB")
+	m.addTable("test", "t2", "CREATE TABLE `t2` (`a` int(11)) ENGINE=InnoDB")
+	m.setStats("test", "t1", &TableStats{Engine: "InnoDB", Rows: 10}, true)
+	x = m.write(NewDirStorage(dir))
+	AssertNil(x)
+	got, err := readManifest(NewDirStorage(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), got.Tables[0].Stats.Rows)
+	assert.Nil(t, got.Tables[1].Stats)
+
+	// No rows of a selection of a table are not an empty table.
+	m.setStats("test", "t2", &TableStats{Engine: "InnoDB"}, false)
+	assert.False(t, m.Tables[1].Empty)
+	m.setStats("test", "t2", &TableStats{Engine: "InnoDB"}, true)
+	assert.True(t, m.Tables[1].Empty)
+}
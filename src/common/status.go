@@ -0,0 +1,273 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// redacted replaces the passwords in the configuration the status shows.
+const redacted = "<redacted>"
+
+const (
+	// statusWaitingWritable is the Status.Waiting of a run waiting for a read-only target.
+	statusWaitingWritable = "waiting for target to become writable"
+	// statusWaitingCancel is the Status.Waiting of a run cancelled by a POST
+	// /cancel, until its workers return.
+	statusWaitingCancel = "cancelled, waiting for the workers to stop"
+	// statusWaitingReplicaLag is the Status.Waiting of a run paused while
+	// the replica it watches lags.
+	statusWaitingReplicaLag = "paused by the replica lag"
+)
+
+// statusInterval is how often the status snapshot is refreshed.
+var statusInterval = time.Second
+
+// Status is the JSON served at /status by -status-listen, it's built from the
+// same counters as the metrics and the summary line.
+// Rate is the average bytes a second since the start.
+// Percent and ETA are only known when the total is: a load knows its bytes
+// up front, a dump estimates them from information_schema, else counts
+// finished tables. Waiting says why a run which looks
+// stuck is, like a read-only target.
+type Status struct {
+	Mode        string              `json:"mode"`
+	RunID       string              `json:"run_id"`
+	Target      string              `json:"target,omitempty"`
+	Phase       string              `json:"phase"`
+	Waiting     string              `json:"waiting,omitempty"`
+	Percent     *float64            `json:"percent"`
+	ETASeconds  *float64            `json:"eta_seconds"`
+	Elapsed     float64             `json:"elapsed_seconds"`
+	BytesDone   uint64              `json:"bytes_done"`
+	BytesTotal  uint64              `json:"bytes_total,omitempty"`
+	Rate        float64             `json:"rate_bytes_per_second"`
+	RowsDone    *uint64             `json:"rows_done,omitempty"`
+	RowsTotal   uint64              `json:"rows_total,omitempty"`
+	TablesDone  uint64              `json:"tables_done,omitempty"`
+	TablesTotal uint64              `json:"tables_total,omitempty"`
+	FilesDone   uint64              `json:"files_done"`
+	FilesFailed uint64              `json:"files_failed"`
+	FilesTotal  uint64              `json:"files_total"`
+	InFlight    []*tableState       `json:"in_flight"`
+	Threads     []ThreadUtilization `json:"threads,omitempty"`
+	Errors      []string            `json:"recent_errors"`
+	Config      interface{}         `json:"config"`
+}
+
+// snapshot builds the current status.
+func (m *Metrics) snapshot() *Status {
+	st := &Status{
+		Mode:        m.mode,
+		RunID:       m.runID,
+		Target:      m.target,
+		Elapsed:     time.Since(m.start).Seconds(),
+		BytesDone:   m.bytesDone(),
+		BytesTotal:  atomic.LoadUint64(&m.totalBytes),
+		RowsTotal:   atomic.LoadUint64(&m.totalRows),
+		TablesDone:  atomic.LoadUint64(&m.tablesDone),
+		TablesTotal: atomic.LoadUint64(&m.tables),
+		FilesDone:   atomic.LoadUint64(&m.filesDone),
+		FilesFailed: atomic.LoadUint64(&m.filesFailed),
+		FilesTotal:  atomic.LoadUint64(&m.files),
+		InFlight:    []*tableState{},
+		Errors:      []string{},
+		Config:      m.config,
+	}
+	if m.rows != nil {
+		rows := m.rowsDone()
+		st.RowsDone = &rows
+	}
+
+	m.mu.Lock()
+	st.Phase = m.current
+	if _, paused := m.lag.pausedFor(); paused {
+		st.Waiting = statusWaitingReplicaLag
+	}
+	if atomic.LoadInt64(&m.readOnlyWaits) > 0 {
+		st.Waiting = statusWaitingWritable
+	}
+	if atomic.LoadInt32(&m.cancelled) == 1 && st.Phase != "done" {
+		st.Waiting = statusWaitingCancel
+	}
+	for _, ts := range m.inflight {
+		c := *ts
+		if c.FileBytes > 0 {
+			percent := float64(c.BytesDone) * 100 / float64(c.FileBytes)
+			c.Percent = &percent
+		}
+		st.InFlight = append(st.InFlight, &c)
+	}
+	st.Errors = append(st.Errors, m.errs...)
+	m.mu.Unlock()
+	sort.Slice(st.InFlight, func(i, j int) bool { return st.InFlight[i].Thread < st.InFlight[j].Thread })
+	st.Threads = m.threadUtilization()
+	if st.Elapsed > 0 {
+		st.Rate = float64(st.BytesDone) / st.Elapsed
+	}
+
+	percent, ok := progressPercent(st.BytesDone, st.BytesTotal, st.TablesDone, st.TablesTotal)
+	if st.Phase == "done" {
+		percent, ok = 100, true
+	}
+	if !ok {
+		return st
+	}
+	st.Percent = &percent
+	if percent > 0 {
+		eta := st.Elapsed * (100 - percent) / percent
+		st.ETASeconds = &eta
+	}
+	return st
+}
+
+// progressPercent returns the percent done of the bytes, else of the tables
+// without a total of bytes, false if neither total is known.
+func progressPercent(bytesDone uint64, bytesTotal uint64, tablesDone uint64, tablesTotal uint64) (float64, bool) {
+	var percent float64
+	switch {
+	case bytesTotal > 0:
+		percent = 100 * float64(bytesDone) / float64(bytesTotal)
+	case tablesTotal > 0:
+		percent = 100 * float64(tablesDone) / float64(tablesTotal)
+	default:
+		return 0, false
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	return percent, true
+}
+
+// serveStatus serves /status and /healthz on listen until the returned stop is called.
+// A POST to /skip?phase=warm or optimize skips the warm-up or the rebuilds of
+// a load, see warmTables and optimizeTables, a POST to /cancel cancels the run as a cancel of its context does.
+// With a token, the POSTs need it as their bearer token, without one /cancel
+// is refused.
+// The other handlers only read a snapshot refreshed every statusInterval and swapped
+// atomically, so polling never waits on the workers.
+func serveStatus(log *xlog.Log, listen string, token string, m *Metrics) (func(), error) {
+	var current atomic.Value
+	current.Store(m.snapshot())
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(statusInterval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				current.Store(m.snapshot())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(current.Load().(*Status))
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/skip", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if token != "" && !bearerToken(r, token) {
+			log.Warning("status.skip.refused.bad.token.from[%s]", r.RemoteAddr)
+			http.Error(w, "bad or missing token", http.StatusUnauthorized)
+			return
+		}
+		phase := r.URL.Query().Get("phase")
+		if !m.skipPhase(phase) {
+			http.Error(w, fmt.Sprintf("phase %q can not be skipped", phase), http.StatusBadRequest)
+			return
+		}
+		log.Warning("status.skip.phase[%s].requested", phase)
+		w.Write([]byte("skipping " + phase + "\n"))
+	})
+	mux.HandleFunc("/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		if token == "" {
+			http.Error(w, "cancel is disabled, it needs a status token", http.StatusForbidden)
+			return
+		}
+		if !bearerToken(r, token) {
+			log.Warning("status.cancel.refused.bad.token.from[%s]", r.RemoteAddr)
+			http.Error(w, "bad or missing token", http.StatusUnauthorized)
+			return
+		}
+		if !m.cancelRun() {
+			http.Error(w, "the run can not be cancelled", http.StatusConflict)
+			return
+		}
+		log.Warning("status.cancel.requested.by[%s]", r.RemoteAddr)
+		w.Write([]byte("cancelling\n"))
+	})
+	stop, err := serveHTTP(log, "status", listen, mux)
+	if err != nil {
+		close(done)
+		return nil, err
+	}
+	return func() {
+		stop()
+		close(done)
+	}, nil
+}
+
+// bearerToken reports whether r has the header 'Authorization: Bearer token',
+// compared in constant time.
+func bearerToken(r *http.Request, token string) bool {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// serveRun starts the metrics and status servers of a run for the listen
+// addresses which are set, the returned func shuts them down. The token is
+// the one of the POSTs of the status, see serveStatus.
+func serveRun(log *xlog.Log, m *Metrics, metricsListen string, statusListen string, statusToken string) (func(), error) {
+	var stops []func()
+	stopAll := func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+	if metricsListen != "" {
+		stop, err := serveMetrics(log, metricsListen, m)
+		if err != nil {
+			return nil, err
+		}
+		stops = append(stops, stop)
+	}
+	if statusListen != "" {
+		stop, err := serveStatus(log, statusListen, statusToken, m)
+		if err != nil {
+			stopAll()
+			return nil, err
+		}
+		stops = append(stops, stop)
+	}
+	return stopAll, nil
+}
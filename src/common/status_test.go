@@ -0,0 +1,253 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusSnapshot(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	pool := &Pool{conns: make(chan *Connection, 2)}
+	var allbytes uint64 = 250
+	m := newMetrics(log, "load", pool, &allbytes, nil)
+	m.config = &LoadArgs{User: "mock", Password: redacted, Threads: 2}
+
+	// Nothing known yet.
+	{
+		st := m.snapshot()
+		assert.Nil(t, st.Percent)
+		assert.Nil(t, st.ETASeconds)
+		assert.Equal(t, []*tableState{}, st.InFlight)
+		assert.Equal(t, []string{}, st.Errors)
+	}
+
+	m.setTotalBytes(1000)
+	m.setFiles(4)
+	m.phaseStarted("data")
+	m.startWork(2, "test.t2", "/tmp/test.t2.00001.sql")
+	m.startWork(1, "test.t1", "/tmp/test.t1.00001.sql")
+	m.fileDone("test.t1.00001.sql")
+	m.fileFailed("/tmp/test.t3.00001.sql", errors.New("mock.error"))
+	for i := 0; i < maxRecentErrors; i++ {
+		m.retry(errors.New("mock.deadlock"))
+	}
+	{
+		st := m.snapshot()
+		assert.Equal(t, "data", st.Phase)
+		assert.Equal(t, 25.0, *st.Percent)
+		assert.NotNil(t, st.ETASeconds)
+		assert.Equal(t, uint64(250), st.BytesDone)
+		assert.Equal(t, uint64(1000), st.BytesTotal)
+		assert.Equal(t, uint64(4), st.FilesTotal)
+		assert.Equal(t, uint64(1), st.FilesFailed)
+		assert.Equal(t, 2, len(st.InFlight))
+		assert.Equal(t, "test.t1", st.InFlight[0].Table)
+		assert.Equal(t, "/tmp/test.t2.00001.sql", st.InFlight[1].File)
+		assert.Equal(t, maxRecentErrors, len(st.Errors))
+		assert.Equal(t, "mock.deadlock", st.Errors[0])
+	}
+
+	m.endWork(1)
+	m.endWork(2)
+	m.phaseStarted("done")
+	{
+		st := m.snapshot()
+		assert.Equal(t, 100.0, *st.Percent)
+		assert.Equal(t, 0, len(st.InFlight))
+	}
+
+	// A dump counts tables.
+	{
+		var allrows uint64 = 7
+		m := newMetrics(log, "dump", pool, &allbytes, &allrows)
+		m.setTables(4)
+		m.tableDone()
+		st := m.snapshot()
+		assert.Equal(t, 25.0, *st.Percent)
+		assert.Equal(t, uint64(7), *st.RowsDone)
+	}
+}
+
+func TestStatusServe(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	defer func(interval time.Duration) { statusInterval = interval }(statusInterval)
+	statusInterval = 10 * time.Millisecond
+
+	pool := &Pool{conns: make(chan *Connection, 1)}
+	var allbytes uint64
+	m := newMetrics(log, "load", pool, &allbytes, nil)
+	config := LoadArgs{User: "mock", Password: "secret"}
+	config.Password = redacted
+	m.config = &config
+	m.setTotalBytes(100)
+
+	address := "127.0.0.1:18080"
+	token := "s3cret"
+	stop, err := serveRun(log, m, "", address, token)
+	assert.Nil(t, err)
+	defer stop()
+
+	get := func(path string) []byte {
+		resp, err := http.Get("http://" + address + path)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return body
+	}
+	assert.Equal(t, "ok\n", string(get("/healthz")))
+
+	atomic.StoreUint64(&allbytes, 50)
+	time.Sleep(50 * time.Millisecond)
+	st := make(map[string]interface{})
+	err = json.Unmarshal(get("/status"), &st)
+	assert.Nil(t, err)
+	assert.Equal(t, "load", st["mode"])
+	assert.Equal(t, 50.0, st["percent"])
+	assert.Equal(t, float64(50), st["bytes_done"])
+	cfg := st["config"].(map[string]interface{})
+	assert.Equal(t, "mock", cfg["User"])
+	assert.Equal(t, redacted, cfg["Password"])
+
+	// post posts to path of address with the bearer token.
+	post := func(path string, token string) int {
+		return postStatus(t, address, path, token)
+	}
+
+	// The warm-up is skipped by a POST with the token, the other phases
+	// can't be.
+	{
+		assert.Equal(t, http.StatusUnauthorized, post("/skip?phase=warm", ""))
+		assert.Equal(t, http.StatusUnauthorized, post("/skip?phase=warm", "wrong"))
+		assert.Equal(t, http.StatusBadRequest, post("/skip?phase=data", token))
+		resp, err := http.Get("http://" + address + "/skip?phase=warm")
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assert.Equal(t, http.StatusOK, post("/skip?phase=warm", token))
+		select {
+		case <-m.skipped(warmPhase):
+		default:
+			t.Fatal("warm.not.skipped")
+		}
+	}
+
+	// A run without a cancel can't be cancelled, one with is by a POST
+	// with the token.
+	{
+		assert.Equal(t, http.StatusConflict, post("/cancel", token))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		m.cancel = cancel
+		resp, err := http.Get("http://" + address + "/cancel")
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		assert.Equal(t, http.StatusUnauthorized, post("/cancel", ""))
+		assert.Equal(t, http.StatusUnauthorized, post("/cancel", "wrong"))
+		assert.Nil(t, ctx.Err())
+		assert.Equal(t, http.StatusOK, post("/cancel", token))
+		assert.Equal(t, context.Canceled, ctx.Err())
+		assert.Equal(t, statusWaitingCancel, m.snapshot().Waiting)
+	}
+
+	// Without a token /cancel is refused, /skip needs none.
+	{
+		address := "127.0.0.1:18081"
+		stop, err := serveRun(log, m, "", address, "")
+		assert.Nil(t, err)
+		defer stop()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		m.cancel = cancel
+		atomic.StoreInt32(&m.cancelled, 0)
+		assert.Equal(t, http.StatusForbidden, postStatus(t, address, "/cancel", ""))
+		assert.Equal(t, http.StatusForbidden, postStatus(t, address, "/cancel", token))
+		assert.Nil(t, ctx.Err())
+		assert.Equal(t, http.StatusOK, postStatus(t, address, "/skip?phase=optimize", ""))
+	}
+}
+
+// postStatus posts to path of the status on address with the bearer token,
+// none if it's empty, and returns the status code.
+func postStatus(t *testing.T, address string, path string, token string) int {
+	req, err := http.NewRequest(http.MethodPost, "http://"+address+path, nil)
+	assert.Nil(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestLoaderStatusCancel(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/loaderstatuscancel"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int);\n")
+	AssertNil(x)
+	for i := 1; i <= 8; i++ {
+		x = WriteFile(fmt.Sprintf("%s/test.t1.%05d.sql", dir, i), "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+		AssertNil(x)
+	}
+
+	// The first INSERT cancels the restore from /status, the files not
+	// started yet are left.
+	address := "127.0.0.1:18083"
+	rec := &recordingExecutor{}
+	var once sync.Once
+	executor := func(id int) (Executor, error) {
+		return &cancellingConn{Executor: &recordingConn{r: rec}, cancel: func() {
+			once.Do(func() {
+				assert.Equal(t, http.StatusOK, postStatus(t, address, "/cancel", "s3cret"))
+			})
+		}}, nil
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, StatusListen: address, StatusToken: "s3cret"}
+	report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: executor}).Run(context.Background())
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, RunCancelled, report.Status)
+	assert.True(t, report.FilesDone < 8, "files done %d", report.FilesDone)
+}
+
+// cancellingConn calls cancel before every INSERT it executes.
+type cancellingConn struct {
+	Executor
+	cancel func()
+}
+
+func (c *cancellingConn) Execute(query string) error {
+	if strings.HasPrefix(query, "INSERT") {
+		c.cancel()
+	}
+	return c.Executor.Execute(query)
+}
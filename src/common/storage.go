@@ -0,0 +1,343 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is where the files of a dump are written and read. The names are
+// '/' separated and relative to the storage, like 'db.t1.00001.sql'.
+type Storage interface {
+	// List returns the names of all the files, in the sub directories too, sorted.
+	List() ([]string, error)
+	// Open opens a file for reading, a missing file is an os.IsNotExist error.
+	Open(name string) (io.ReadCloser, error)
+	// Create creates or truncates a file for writing. It's published once
+	// closed, atomically: until then the name has the previous file or
+	// none, never a part of the new one, like the complete of a multipart
+	// upload.
+	Create(name string) (io.WriteCloser, error)
+	// Stat returns the size and the modification time of a file.
+	Stat(name string) (os.FileInfo, error)
+}
+
+// Remover is a Storage which can remove its files, Prune needs it: a storage
+// of RegisterStorage implements it to be pruned.
+type Remover interface {
+	// Remove removes a file, a missing file is an os.IsNotExist error.
+	Remove(name string) error
+}
+
+// StorageOpener opens the storage at a location of its scheme, like 'mem://name'.
+type StorageOpener func(location string) (Storage, error)
+
+var (
+	storagesMu sync.RWMutex
+	storages   = map[string]StorageOpener{
+		"file": func(location string) (Storage, error) {
+			return NewDirStorage(strings.TrimPrefix(location, "file://")), nil
+		},
+		"mem": openMemStorage,
+	}
+)
+
+// RegisterStorage registers the opener of the locations 'scheme://...', it
+// replaces any opener of the scheme. The locations without a scheme are
+// directories of the local filesystem.
+func RegisterStorage(scheme string, open StorageOpener) {
+	storagesMu.Lock()
+	defer storagesMu.Unlock()
+	storages[scheme] = open
+}
+
+// storageScheme returns the scheme of a location, "" for a directory.
+func storageScheme(location string) string {
+	if i := strings.Index(location, "://"); i > 0 {
+		return location[:i]
+	}
+	return ""
+}
+
+// OpenStorage opens the storage of a location, the -o/-d flags: a directory
+// or a 'scheme://...' URL of a registered scheme, see RegisterStorage.
+func OpenStorage(location string) (Storage, error) {
+	scheme := storageScheme(location)
+	if scheme == "" {
+		return NewDirStorage(location), nil
+	}
+	storagesMu.RLock()
+	open, ok := storages[scheme]
+	storagesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("storage.scheme[%s].of[%s].not.registered", scheme, location)
+	}
+	return open(location)
+}
+
+// readFile reads a whole file of the storage.
+func readFile(s Storage, name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// writeFile creates a file of the storage with data, like WriteFile.
+func writeFile(s Storage, name string, data string) error {
+	w, err := s.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, data); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// dirStorage is a directory of the local filesystem.
+type dirStorage struct {
+	dir string
+	// perm is the mode and the owner of the files created, nil leaves them
+	// as the umask makes them, see withPerm.
+	perm *filePerm
+}
+
+// NewDirStorage returns the storage of the directory dir. With an empty dir
+// the names are paths of the filesystem as they are.
+func NewDirStorage(dir string) Storage {
+	return &dirStorage{dir: dir}
+}
+
+func (s *dirStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
+
+func (s *dirStorage) List() ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			name, err := filepath.Rel(s.dir, path)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (s *dirStorage) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+// Create writes the file as name.tmp, synced and renamed into place once
+// closed: a file with the temp suffix is left by a crash.
+func (s *dirStorage) Create(name string) (io.WriteCloser, error) {
+	f, err := s.open(name + tempSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &dirWriter{f: f, path: s.path(name)}, nil
+}
+
+// open creates or truncates the file name with the perm of s.
+func (s *dirStorage) open(name string) (*os.File, error) {
+	f, err := os.OpenFile(s.path(name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil || s.perm == nil {
+		return f, err
+	}
+	if err := s.perm.apply(f.Name(), s.perm.fileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// dirWriter is a file of a dirStorage written under its temp name.
+type dirWriter struct {
+	f *os.File
+	// path is the one it's renamed to.
+	path string
+	// failed is set once a write failed, the file is then removed on Close.
+	failed bool
+}
+
+func (w *dirWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// Close syncs the file and renames it into place, a file whose writes
+// failed is removed instead.
+func (w *dirWriter) Close() error {
+	if w.failed {
+		w.f.Close()
+		return os.Remove(w.f.Name())
+	}
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.f.Name(), w.path)
+}
+
+func (s *dirStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+// Remove removes the file and the sub directories it leaves empty.
+func (s *dirStorage) Remove(name string) error {
+	if err := os.Remove(s.path(name)); err != nil {
+		return err
+	}
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if os.Remove(s.path(dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *dirStorage) String() string {
+	return s.dir
+}
+
+// MemStorage keeps the files in memory, for the tests. The 'mem://name'
+// locations all open the same MemStorage per name.
+type MemStorage struct {
+	mu    sync.RWMutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+var (
+	memStoragesMu sync.Mutex
+	memStorages   = make(map[string]*MemStorage)
+)
+
+// NewMemStorage returns an empty MemStorage.
+func NewMemStorage() *MemStorage {
+	return &MemStorage{files: make(map[string]*memFile)}
+}
+
+func openMemStorage(location string) (Storage, error) {
+	name := strings.TrimPrefix(location, "mem://")
+	memStoragesMu.Lock()
+	defer memStoragesMu.Unlock()
+	s, ok := memStorages[name]
+	if !ok {
+		s = NewMemStorage()
+		memStorages[name] = s
+	}
+	return s, nil
+}
+
+func (s *MemStorage) List() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *MemStorage) Open(name string) (io.ReadCloser, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+// Create truncates the file at once, the written data is stored on Close.
+func (s *MemStorage) Create(name string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = &memFile{modTime: time.Now()}
+	return &memWriter{storage: s, name: name}, nil
+}
+
+func (s *MemStorage) Stat(name string) (os.FileInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFileInfo{name: name, size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+func (s *MemStorage) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(s.files, name)
+	return nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	storage *MemStorage
+	name    string
+}
+
+func (w *memWriter) Close() error {
+	w.storage.mu.Lock()
+	defer w.storage.mu.Unlock()
+	w.storage.files[w.name] = &memFile{data: append([]byte(nil), w.Bytes()...), modTime: time.Now()}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (fi *memFileInfo) Name() string       { return filepath.Base(fi.name) }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return false }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
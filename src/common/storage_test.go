@@ -0,0 +1,184 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+// testStorage checks the Storage contract on an empty storage.
+func testStorage(t *testing.T, s Storage) {
+	names, err := s.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(names))
+
+	// Missing.
+	{
+		_, err := s.Open("test.t1.00001.sql")
+		assert.True(t, os.IsNotExist(err))
+		_, err = s.Stat("test.t1.00001.sql")
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// Create, truncate and read back.
+	{
+		x := writeFile(s, "test.t1.00001.sql", "INSERT INTO `t1` VALUES (1),(2);\n")
+		AssertNil(x)
+		x = writeFile(s, "test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);\n")
+		AssertNil(x)
+		x = writeFile(s, "metadata", "Version: v1\n")
+		AssertNil(x)
+
+		data, err := readFile(s, "test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT INTO `t1` VALUES (1);\n", string(data))
+		info, err := s.Stat("test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(data)), info.Size())
+		assert.Equal(t, "test.t1.00001.sql", info.Name())
+	}
+
+	names, err = s.List()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"metadata", "test.t1.00001.sql"}, names)
+}
+
+func TestStorageDir(t *testing.T) {
+	dir := "/tmp/storagedirtest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	testStorage(t, NewDirStorage(dir))
+
+	// The sub directories are listed, names are '/' separated.
+	{
+		x := os.MkdirAll(dir+"/sub", 0777)
+		AssertNil(x)
+		x = WriteFile(dir+"/sub/test.t2.00001.sql", "")
+		AssertNil(x)
+		names, err := NewDirStorage(dir).List()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"metadata", "sub/test.t2.00001.sql", "test.t1.00001.sql"}, names)
+	}
+
+	// Without a dir the names are paths.
+	{
+		data, err := readFile(NewDirStorage(""), dir+"/metadata")
+		assert.Nil(t, err)
+		assert.Equal(t, "Version: v1\n", string(data))
+	}
+
+	// A missing dir.
+	{
+		_, err := NewDirStorage("/tmp/storagedirtest/gone").List()
+		assert.NotNil(t, err)
+	}
+}
+
+func TestStorageMem(t *testing.T) {
+	testStorage(t, NewMemStorage())
+
+	// Nothing shows before Close.
+	{
+		s := NewMemStorage()
+		w, err := s.Create("stats.tsv")
+		assert.Nil(t, err)
+		w.Write([]byte("db\n"))
+		info, err := s.Stat("stats.tsv")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), info.Size())
+		w.Close()
+		info, err = s.Stat("stats.tsv")
+		assert.Nil(t, err)
+		assert.Equal(t, int64(3), info.Size())
+	}
+}
+
+func TestStorageOpen(t *testing.T) {
+	// Directories.
+	{
+		s, err := OpenStorage("/tmp/storageopentest")
+		assert.Nil(t, err)
+		assert.Equal(t, &dirStorage{dir: "/tmp/storageopentest"}, s)
+		s, err = OpenStorage("file:///tmp/storageopentest")
+		assert.Nil(t, err)
+		assert.Equal(t, &dirStorage{dir: "/tmp/storageopentest"}, s)
+	}
+
+	// One MemStorage per name.
+	{
+		a, err := OpenStorage("mem://storageopentest")
+		assert.Nil(t, err)
+		b, err := OpenStorage("mem://storageopentest")
+		assert.Nil(t, err)
+		c, err := OpenStorage("mem://other")
+		assert.Nil(t, err)
+		assert.True(t, a == b)
+		assert.True(t, a != c)
+	}
+
+	// Registered and unknown schemes.
+	{
+		_, err := OpenStorage("s3://bucket/dump")
+		assert.NotNil(t, err)
+		assert.NotNil(t, (&LoadArgs{User: "mock", Address: "127.0.0.1:3306", Outdir: "s3://bucket/dump", Threads: 1, IntervalMs: 1}).Validate())
+
+		RegisterStorage("s3", func(location string) (Storage, error) {
+			return nil, errors.New("mock.s3." + location)
+		})
+		defer func() {
+			storagesMu.Lock()
+			delete(storages, "s3")
+			storagesMu.Unlock()
+		}()
+		_, err = OpenStorage("s3://bucket/dump")
+		assert.Equal(t, "mock.s3.s3://bucket/dump", err.Error())
+		assert.Nil(t, (&LoadArgs{User: "mock", Address: "127.0.0.1:3306", Outdir: "s3://bucket/dump", Threads: 1, IntervalMs: 1}).Validate())
+	}
+}
+
+func TestStorageVerify(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	s, err := OpenStorage("mem://storageverifytest")
+	assert.Nil(t, err)
+	x := writeFile(s, "test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = writeFile(s, "test.t1-schema.sql", "CREATE TABLE `t1` (`a` int(11));\n")
+	AssertNil(x)
+	x = writeFile(s, "test.t1.00001.sql", "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+	AssertNil(x)
+
+	err = Verify(log, "mem://storageverifytest")
+	assert.Nil(t, err)
+	files, err := loadFiles(s)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test.t1.00001.sql"}, files.tables)
+	assert.Equal(t, uint64(len("INSERT INTO `t1`(`a`) VALUES\n(1);\n")), filesBytes(s, files.tables))
+
+	// The same files on disk.
+	dir := "/tmp/storageverifytest"
+	os.RemoveAll(dir)
+	x = os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for _, name := range []string{"test-schema-create.sql", "test.t1-schema.sql", "test.t1.00001.sql"} {
+		data, err := readFile(s, name)
+		assert.Nil(t, err)
+		x := ioutil.WriteFile(dir+"/"+name, data, 0644)
+		AssertNil(x)
+	}
+	err = Verify(log, dir)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,233 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// StreamConfig is the configuration of a Streamer.
+type StreamConfig struct {
+	User     string
+	Password string
+	Address  string
+	// Threads is the number of connections, the most tables streamed at once.
+	Threads int
+
+	// Log is the log of the streamer, nil logs to stderr at the info level.
+	Log *xlog.Log
+}
+
+// StreamOptions are the options of a StreamTable.
+type StreamOptions struct {
+	// Where is a condition on the rows, like 'id > 1000', empty streams them all.
+	Where string
+}
+
+// Streamer streams the rows of tables to the caller instead of data files,
+// with the SELECT of the dumper, see NewStreamer.
+type Streamer struct {
+	cfg  StreamConfig
+	log  *xlog.Log
+	pool *Pool
+}
+
+// NewStreamer validates the configuration and connects the pool of
+// cfg.Threads connections, Close releases it.
+func NewStreamer(cfg StreamConfig) (*Streamer, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	log := logOrDefault(cfg.Log)
+	pool, err := NewPool(log, cfg.Threads, cfg.Address, cfg.User, cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	return &Streamer{cfg: cfg, log: log, pool: pool}, nil
+}
+
+// Close closes the connections, the iterators must all be closed first.
+func (s *Streamer) Close() {
+	s.pool.Close()
+}
+
+// get takes a connection of the pool, waiting for a free one until ctx is
+// done. A connection closed by an iterator is connected again.
+func (s *Streamer) get(ctx context.Context) (*Connection, error) {
+	conns := s.pool.getConns()
+	if conns == nil {
+		return nil, errors.New("streamer.closed")
+	}
+	select {
+	case conn := <-conns:
+		if conn.client.Closed() {
+			client, err := driver.NewConn(s.cfg.User, s.cfg.Password, s.cfg.Address, "", "utf8")
+			if err != nil {
+				s.pool.Put(conn)
+				return nil, err
+			}
+			conn.client = client
+			conn.prepared = nil
+			conn.db = ""
+		}
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// StreamTable starts the SELECT of the rows of db.table on a connection of
+// the pool, the INVISIBLE columns are selected by name as the dumper does.
+// The rows are read off the connection as the caller asks for them, so a slow
+// caller slows the SELECT down. The connection is taken until the iterator is
+// closed, which must always be done. Once ctx is done the connection is
+// closed, which stops the SELECT, and Next returns false with Err ctx.Err().
+func (s *Streamer) StreamTable(ctx context.Context, db string, table string, opts StreamOptions) (*RowIterator, error) {
+	conn, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := closeConnOnDone(ctx, conn)
+	qr, err := conn.Fetch(fmt.Sprintf("show create table `%s`.`%s`", db, table))
+	if err == nil && (len(qr.Rows) == 0 || len(qr.Rows[0]) < 2) {
+		err = fmt.Errorf("streaming.table[%s.%s].not.found", db, table)
+	}
+	var rows driver.Rows
+	if err == nil {
+		rows, err = selectTable(s.log, conn, db, table, qr.Rows[0][1].String(), nil, opts.Where, "")
+	}
+	if err != nil {
+		stop()
+		s.pool.Put(conn)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &RowIterator{ctx: ctx, pool: s.pool, conn: conn, rows: rows, stop: stop}, nil
+}
+
+// closeConnOnDone closes the connection once ctx is done, like
+// Pool.CloseOnDone. The returned func stops the watch.
+func closeConnOnDone(ctx context.Context, conn *Connection) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// selectTable starts the SELECT of the rows of a table with the create
+// statement schema, the INVISIBLE columns are selected by name. The rows
+// are ordered by the column orderBy, if any.
+func selectTable(log *xlog.Log, conn *Connection, db string, table string, schema string, partitions []string, where string, orderBy string) (driver.Rows, error) {
+	columns := selectColumns(schema)
+	if columns != "*" {
+		log.Info("dumping.table[%s.%s].with.invisible.columns[%s]", db, table, columns)
+	}
+	query := fmt.Sprintf("select /*backup*/ %s from `%s`.`%s`", columns, db, table) + partitionClause(partitions)
+	if where != "" {
+		query += " where " + where
+	}
+	if orderBy != "" {
+		query += " order by " + quoteIdentifier(orderBy)
+	}
+	return conn.StreamFetch(query)
+}
+
+// RowIterator is the rows of a table, see Streamer.StreamTable:
+//
+//	for it.Next() {
+//		row := it.Row()
+//	}
+//	err := it.Err()
+//	it.Close()
+type RowIterator struct {
+	ctx  context.Context
+	pool *Pool
+	conn *Connection
+	rows driver.Rows
+	stop func()
+
+	row    []sqltypes.Value
+	err    error
+	done   bool
+	closed bool
+}
+
+// Columns returns the columns of the rows, with their names and types.
+func (it *RowIterator) Columns() []*querypb.Field {
+	return it.rows.Fields()
+}
+
+// Next reads the next row, false once there are no more rows or on an error.
+func (it *RowIterator) Next() bool {
+	if it.done || it.closed {
+		return false
+	}
+	if !it.rows.Next() {
+		it.done = true
+		it.err = it.rows.Close()
+		return false
+	}
+	row, err := it.rows.RowValues()
+	if err != nil {
+		it.done = true
+		it.err = err
+		return false
+	}
+	it.row = row
+	return true
+}
+
+// Row returns the row read by Next, it's only valid until the next call.
+func (it *RowIterator) Row() []sqltypes.Value {
+	return it.row
+}
+
+// Err returns the error which ended the rows, ctx.Err() if ctx is done.
+func (it *RowIterator) Err() error {
+	if it.err != nil && it.ctx.Err() != nil {
+		return it.ctx.Err()
+	}
+	return it.err
+}
+
+// Close releases the connection to the pool. If the rows were not all read
+// the connection is closed, which aborts the SELECT on the server instead of
+// reading the rest of the rows, the next StreamTable connects it again.
+func (it *RowIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	it.stop()
+	if !it.done || it.err != nil {
+		it.conn.client.Close()
+	}
+	it.pool.Put(it.conn)
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamerStreamTable(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	selectResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "a",
+				Type: querypb.Type_INT32,
+			},
+			{
+				Name: "b",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+	}
+	for i := 0; i < 1000; i++ {
+		selectResult.Rows = append(selectResult.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_INT32, []byte("1")),
+			sqltypes.NULL,
+		})
+	}
+
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "Table",
+				Type: querypb.Type_VARCHAR,
+			},
+			{
+				Name: "Create Table",
+				Type: querypb.Type_VARCHAR,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+				sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("CREATE TABLE `t1` (`a` int(11) DEFAULT NULL,`b` varchar(10) DEFAULT NULL) ENGINE=InnoDB")),
+			},
+		}}
+
+	// fakedbs.
+	{
+		fakedbs.AddQuery("show create table `test`.`t1`", schemaResult)
+		fakedbs.AddQuery("select /*backup*/ * from `test`.`t1`", selectResult)
+		fakedbs.AddQuery("select /*backup*/ * from `test`.`t1` where a > 0", selectResult)
+		fakedbs.AddQueryDelay("select /*backup*/ * from `test`.`t1` where a > 1", selectResult, 2000)
+	}
+
+	streamer, err := NewStreamer(StreamConfig{User: "mock", Password: "mock", Address: address, Threads: 1, Log: log})
+	assert.Nil(t, err)
+	defer streamer.Close()
+
+	// All the rows.
+	{
+		it, err := streamer.StreamTable(context.Background(), "test", "t1", StreamOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, "a", it.Columns()[0].Name)
+		assert.Equal(t, querypb.Type_VARCHAR, it.Columns()[1].Type)
+		rows := 0
+		for it.Next() {
+			assert.Equal(t, "1", it.Row()[0].String())
+			assert.Nil(t, it.Row()[1].Raw())
+			rows++
+		}
+		assert.Nil(t, it.Err())
+		assert.Nil(t, it.Close())
+		assert.Equal(t, 1000, rows)
+	}
+
+	// Closed early, the connection is connected again.
+	{
+		it, err := streamer.StreamTable(context.Background(), "test", "t1", StreamOptions{Where: "a > 0"})
+		assert.Nil(t, err)
+		assert.True(t, it.Next())
+		assert.Nil(t, it.Close())
+
+		it, err = streamer.StreamTable(context.Background(), "test", "t1", StreamOptions{})
+		assert.Nil(t, err)
+		assert.True(t, it.Next())
+		assert.Nil(t, it.Close())
+	}
+
+	// Cancelled.
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(200*time.Millisecond, cancel)
+		start := time.Now()
+		it, err := streamer.StreamTable(ctx, "test", "t1", StreamOptions{Where: "a > 1"})
+		if err == nil {
+			for it.Next() {
+			}
+			err = it.Err()
+			it.Close()
+		}
+		assert.Equal(t, context.Canceled, err)
+		assert.True(t, time.Since(start) < time.Second)
+	}
+
+	// No free connection.
+	{
+		it, err := streamer.StreamTable(context.Background(), "test", "t1", StreamOptions{})
+		assert.Nil(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err = streamer.StreamTable(ctx, "test", "t1", StreamOptions{})
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Nil(t, it.Close())
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// subsetBatch is how many rows of a table a query of the walk of a subset
+// takes at once.
+const subsetBatch = 500
+
+// The directions of a SubsetStep.
+const (
+	SubsetSeed   = "seed"
+	SubsetParent = "parent"
+	SubsetChild  = "child"
+)
+
+// SubsetStep is a step of the walk of a subset, in the manifest: the rows of
+// To reached from the rows of From through the foreign key Via, or the rows
+// of a seed.
+type SubsetStep struct {
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	// Via is the constraint name of the foreign key, the WHERE of a seed.
+	Via string `json:"via"`
+	// Direction is SubsetSeed, SubsetParent for the rows referenced by the
+	// rows of From, or SubsetChild for the rows referencing them.
+	Direction string `json:"direction"`
+	// Rows are the rows the step added to the subset.
+	Rows int `json:"rows"`
+}
+
+// ManifestSubset is the subset of a dump with DumpArgs.SubsetSeeds.
+type ManifestSubset struct {
+	Seeds map[string]string `json:"seeds"`
+	// Rows are the rows of the subset by table, the tables it didn't reach
+	// have none dumped.
+	Rows      map[string]int `json:"rows"`
+	Traversal []SubsetStep   `json:"traversal"`
+}
+
+// subsetEdge is a foreign key of a table of a subset, to walk from its rows
+// to the rows of other: the ones they reference if parent, else the ones
+// referencing them.
+type subsetEdge struct {
+	constraint string
+	other      string
+	parent     bool
+	// join matches the rows of the table, w, with the ones of other, o.
+	join string
+}
+
+// subsetTable is a table of the database of a subset dump.
+type subsetTable struct {
+	name string
+	// pk are the quoted columns of its primary key, none if it has none.
+	pk    []string
+	edges []subsetEdge
+	// rows are the primary keys of its rows in the subset, as the SQL tuple
+	// of their values, true for the rows whose children are walked, keys
+	// are the same in the order they were reached.
+	rows map[string]bool
+	keys []string
+	// down and up are the rows not walked yet, the ones of down with their
+	// children.
+	down []string
+	up   []string
+}
+
+// subset is the referentially complete subset of the tables of a dump with
+// DumpArgs.SubsetSeeds, see walkSubset.
+type subset struct {
+	db     string
+	tables map[string]*subsetTable
+	names  []string
+	total  int
+	steps  map[string]*SubsetStep
+	order  []string
+}
+
+// subsetTables returns the 'db.table' names of the DumpArgs.SubsetSeeds,
+// sorted.
+func (args *DumpArgs) subsetTables() []string {
+	names := make([]string, 0, len(args.SubsetSeeds))
+	for name := range args.SubsetSeeds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subsetWhere returns the WHERE selecting the rows of the subset of the
+// table, empty without DumpArgs.SubsetSeeds.
+func (args *DumpArgs) subsetWhere(table string) string {
+	if args.subset == nil {
+		return ""
+	}
+	return args.subset.where(table)
+}
+
+// readSubsetGraph reads the primary keys and the foreign keys of the tables
+// of the database db from information_schema.KEY_COLUMN_USAGE. A foreign key
+// to another database isn't walked, the subset can't follow it.
+func readSubsetGraph(log *xlog.Log, conn *Connection, db string) (*subset, error) {
+	qr, err := conn.Fetch(fmt.Sprintf("SELECT TABLE_NAME, CONSTRAINT_NAME, COLUMN_NAME, REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA='%s' AND (CONSTRAINT_NAME='PRIMARY' OR REFERENCED_TABLE_NAME IS NOT NULL) ORDER BY TABLE_NAME, CONSTRAINT_NAME, ORDINAL_POSITION",
+		EscapeBytes([]byte(db))))
+	if err != nil {
+		return nil, wrapf(err, "dumping.subset.foreign.keys.error:%v", err)
+	}
+	s := &subset{db: db, tables: make(map[string]*subsetTable), steps: make(map[string]*SubsetStep)}
+	type key struct {
+		table, constraint, ref string
+		columns, refs          []string
+	}
+	var keys []*key
+	var last *key
+	for _, row := range qr.Rows {
+		if len(row) < 6 {
+			continue
+		}
+		table, constraint, column := row[0].String(), row[1].String(), row[2].String()
+		t := s.table(table)
+		if constraint == "PRIMARY" {
+			t.pk = append(t.pk, quoteIdentifier(column))
+			continue
+		}
+		if refDB := row[3].String(); refDB != db {
+			log.Warning("dumping.subset.foreign.key[%s.%s.%s].references.database[%s].not.walked", db, table, constraint, refDB)
+			continue
+		}
+		if last == nil || last.table != table || last.constraint != constraint {
+			last = &key{table: table, constraint: constraint, ref: row[4].String()}
+			keys = append(keys, last)
+		}
+		last.columns = append(last.columns, quoteIdentifier(column))
+		last.refs = append(last.refs, quoteIdentifier(row[5].String()))
+	}
+	for _, k := range keys {
+		var toParent, toChild []string
+		for i := range k.columns {
+			toParent = append(toParent, fmt.Sprintf("o.%s = w.%s", k.refs[i], k.columns[i]))
+			toChild = append(toChild, fmt.Sprintf("w.%s = o.%s", k.refs[i], k.columns[i]))
+		}
+		child, parent := s.table(k.table), s.table(k.ref)
+		child.edges = append(child.edges, subsetEdge{constraint: k.constraint, other: k.ref, parent: true, join: strings.Join(toParent, " AND ")})
+		parent.edges = append(parent.edges, subsetEdge{constraint: k.constraint, other: k.table, join: strings.Join(toChild, " AND ")})
+	}
+	return s, nil
+}
+
+// table returns the subsetTable of the table, added if it's a new one.
+func (s *subset) table(name string) *subsetTable {
+	t, ok := s.tables[name]
+	if !ok {
+		t = &subsetTable{name: name, rows: make(map[string]bool)}
+		s.tables[name] = t
+		s.names = append(s.names, name)
+		sort.Strings(s.names)
+	}
+	return t
+}
+
+// check checks the tables the walk from the seeds can reach have a primary
+// key to tell their rows and are dumped, before any row is walked. The
+// tables reached by their parents only are walked to their parents only,
+// as the rows are.
+func (s *subset) check(args *DumpArgs, all []string, tables []string) error {
+	exists := make(map[string]bool)
+	for _, table := range all {
+		exists[table] = true
+	}
+	dumped := make(map[string]bool)
+	for _, table := range tables {
+		dumped[table] = true
+	}
+	var problems []string
+	down := make(map[string]bool)
+	var queue []string
+	reach := func(table string, withChildren bool) {
+		if d, ok := down[table]; ok && (d || !withChildren) {
+			return
+		}
+		down[table] = withChildren
+		queue = append(queue, table)
+	}
+	for _, name := range args.subsetTables() {
+		_, table := splitTableName(name)
+		if !exists[table] {
+			problems = append(problems, fmt.Sprintf("seed.table[%s].does.not.exist", name))
+			continue
+		}
+		reach(table, true)
+	}
+	for len(queue) > 0 {
+		table := queue[0]
+		queue = queue[1:]
+		for _, e := range s.table(table).edges {
+			if e.parent || down[table] {
+				reach(e.other, !e.parent)
+			}
+		}
+	}
+	for table := range down {
+		name := s.db + "." + table
+		if len(s.table(table).pk) == 0 {
+			problems = append(problems, fmt.Sprintf("table[%s].has.no.primary.key", name))
+		}
+		if !dumped[table] {
+			problems = append(problems, fmt.Sprintf("table[%s].is.reached.but.not.dumped", name))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("dumping.subset.preflight:%s", strings.Join(problems, ","))
+	}
+	return nil
+}
+
+// add adds the rows of the keys to the table, the ones already there are
+// walked again only to walk their children, and counts them in the step.
+func (s *subset) add(args *DumpArgs, t *subsetTable, keys []string, withChildren bool, step SubsetStep) error {
+	id := step.From + "|" + step.To + "|" + step.Via + "|" + step.Direction
+	st, ok := s.steps[id]
+	if !ok {
+		st = &step
+		s.steps[id] = st
+		s.order = append(s.order, id)
+	}
+	for _, k := range keys {
+		walked, ok := t.rows[k]
+		if ok && (walked || !withChildren) {
+			continue
+		}
+		if !ok {
+			t.keys = append(t.keys, k)
+			st.Rows++
+			s.total++
+		}
+		t.rows[k] = withChildren
+		if withChildren {
+			t.down = append(t.down, k)
+		} else {
+			t.up = append(t.up, k)
+		}
+	}
+	if args.SubsetMaxRows > 0 && s.total > args.SubsetMaxRows {
+		return fmt.Errorf("dumping.subset.rows.over.max[%d].at.table[%s.%s]:narrow the seeds or raise the subset max rows", args.SubsetMaxRows, s.db, t.name)
+	}
+	return nil
+}
+
+// fetchKeys returns the rows of the query as the SQL tuples of their values.
+func fetchKeys(conn *Connection, query string) ([]string, error) {
+	qr, err := conn.Fetch(query)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(qr.Rows))
+	for _, row := range qr.Rows {
+		keys = append(keys, keyTuple(row))
+	}
+	return keys, nil
+}
+
+// keyTuple returns the SQL tuple of the values, like (1,"a").
+func keyTuple(row []sqltypes.Value) string {
+	values := make([]string, len(row))
+	for i, v := range row {
+		values[i] = sqlValue(v)
+	}
+	return "(" + strings.Join(values, ",") + ")"
+}
+
+// columns returns the pk of the table with the alias, like w.`a`,w.`b`.
+func (t *subsetTable) columns(alias string) string {
+	columns := make([]string, len(t.pk))
+	for i, column := range t.pk {
+		columns[i] = alias + "." + column
+	}
+	return strings.Join(columns, ",")
+}
+
+// walk walks a batch of the rows not walked yet of the table, the rows with
+// their children first, to the rows of the other tables they reach.
+func (s *subset) walk(conn *Connection, args *DumpArgs, t *subsetTable) error {
+	pending, withChildren := &t.up, false
+	if len(t.down) > 0 {
+		pending, withChildren = &t.down, true
+	}
+	n := len(*pending)
+	if n > subsetBatch {
+		n = subsetBatch
+	}
+	batch := (*pending)[:n]
+	*pending = (*pending)[n:]
+	for _, e := range t.edges {
+		if !e.parent && !withChildren {
+			continue
+		}
+		other := s.table(e.other)
+		query := fmt.Sprintf("SELECT DISTINCT %s FROM `%s`.`%s` AS w JOIN `%s`.`%s` AS o ON %s WHERE (%s) IN (%s)",
+			other.columns("o"), s.db, t.name, s.db, other.name, e.join, t.columns("w"), strings.Join(batch, ","))
+		keys, err := fetchKeys(conn, query)
+		if err != nil {
+			return wrapf(err, "dumping.subset.table[%s.%s].foreign.key[%s].error:%v", s.db, t.name, e.constraint, err)
+		}
+		direction := SubsetChild
+		if e.parent {
+			direction = SubsetParent
+		}
+		if err := s.add(args, other, keys, !e.parent, SubsetStep{From: s.db + "." + t.name, To: s.db + "." + other.name, Via: e.constraint, Direction: direction}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkSubset walks the subset of the tables of the dump from the
+// DumpArgs.SubsetSeeds: the rows of the seeds, the rows referencing them
+// through a foreign key, recursively, and the rows all of these reference,
+// recursively, so every row dumped has the rows its foreign keys reference.
+// The rows reached as parents don't bring their children, else a product
+// would bring every order of it. The cycles end as a row is walked once, at
+// most twice when it's first reached as a parent, then as a child.
+func walkSubset(log *xlog.Log, conn *Connection, args *DumpArgs, tables []string) (*subset, error) {
+	s, err := readSubsetGraph(log, conn, args.Database)
+	if err != nil {
+		return nil, err
+	}
+	all, err := allTables(conn, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.check(args, all, tables); err != nil {
+		return nil, err
+	}
+	for _, name := range args.subsetTables() {
+		_, table := splitTableName(name)
+		t := s.table(table)
+		where := args.SubsetSeeds[name]
+		keys, err := fetchKeys(conn, fmt.Sprintf("SELECT %s FROM `%s`.`%s` WHERE %s", strings.Join(t.pk, ","), s.db, t.name, where))
+		if err != nil {
+			return nil, wrapf(err, "dumping.subset.seed[%s].error:%v", name, err)
+		}
+		if err := s.add(args, t, keys, true, SubsetStep{To: name, Via: where, Direction: SubsetSeed}); err != nil {
+			return nil, err
+		}
+	}
+	for walked := true; walked; {
+		walked = false
+		for _, name := range s.names {
+			t := s.tables[name]
+			for len(t.down) > 0 || len(t.up) > 0 {
+				if err := s.walk(conn, args, t); err != nil {
+					return nil, err
+				}
+				walked = true
+			}
+		}
+	}
+	for _, name := range s.names {
+		if t := s.tables[name]; len(t.keys) > 0 {
+			log.Info("dumping.subset.table[%s.%s].rows[%d]", s.db, name, len(t.keys))
+		}
+	}
+	log.Info("dumping.subset.seeds[%d].rows[%d]", len(args.SubsetSeeds), s.total)
+	return s, nil
+}
+
+// where returns the WHERE selecting the rows of the subset of the table, a
+// table the subset didn't reach has none.
+func (s *subset) where(table string) string {
+	t, ok := s.tables[table]
+	if !ok || len(t.keys) == 0 {
+		return "1=0"
+	}
+	return fmt.Sprintf("(%s) IN (%s)", strings.Join(t.pk, ","), strings.Join(t.keys, ","))
+}
+
+// manifest returns the ManifestSubset of the walk.
+func (s *subset) manifest(args *DumpArgs) *ManifestSubset {
+	m := &ManifestSubset{Seeds: args.SubsetSeeds, Rows: make(map[string]int), Traversal: []SubsetStep{}}
+	for _, name := range s.names {
+		if t := s.tables[name]; len(t.keys) > 0 {
+			m.Rows[s.db+"."+name] = len(t.keys)
+		}
+	}
+	for _, id := range s.order {
+		m.Traversal = append(m.Traversal, *s.steps[id])
+	}
+	return m
+}
@@ -0,0 +1,161 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+const subsetGraphQuery = "SELECT TABLE_NAME, CONSTRAINT_NAME, COLUMN_NAME, REFERENCED_TABLE_SCHEMA, REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA='shop' AND (CONSTRAINT_NAME='PRIMARY' OR REFERENCED_TABLE_NAME IS NOT NULL) ORDER BY TABLE_NAME, CONSTRAINT_NAME, ORDINAL_POSITION"
+
+// stringsResult returns a result of VARCHAR columns, an empty value is a NULL.
+func stringsResult(names []string, rows ...[]string) *sqltypes.Result {
+	r := &sqltypes.Result{}
+	for _, name := range names {
+		r.Fields = append(r.Fields, &querypb.Field{Name: name, Type: querypb.Type_VARCHAR})
+	}
+	for _, values := range rows {
+		var row []sqltypes.Value
+		for _, v := range values {
+			if v == "" {
+				row = append(row, sqltypes.NULL)
+				continue
+			}
+			row = append(row, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	return r
+}
+
+// intsResult returns the keys of INT columns.
+func intsResult(names []string, rows ...[]string) *sqltypes.Result {
+	r := stringsResult(names, rows...)
+	for _, f := range r.Fields {
+		f.Type = querypb.Type_INT64
+	}
+	for _, row := range r.Rows {
+		for i, v := range row {
+			row[i] = sqltypes.MakeTrusted(querypb.Type_INT64, v.Raw())
+		}
+	}
+	return r
+}
+
+func TestWalkSubset(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	// customers, with their account manager in employees whose managers
+	// reference each other, orders of the customers, items of the orders by
+	// (order_id, line) with their product, shipments of the items by the
+	// composite key.
+	graph := stringsResult([]string{"TABLE_NAME", "CONSTRAINT_NAME", "COLUMN_NAME", "REFERENCED_TABLE_SCHEMA", "REFERENCED_TABLE_NAME", "REFERENCED_COLUMN_NAME"},
+		[]string{"customers", "PRIMARY", "id", "", "", ""},
+		[]string{"customers", "fk_customers_manager", "manager_id", "shop", "employees", "id"},
+		[]string{"customers", "fk_customers_region", "region_id", "geo", "regions", "id"},
+		[]string{"employees", "PRIMARY", "id", "", "", ""},
+		[]string{"employees", "fk_manager", "manager_id", "shop", "employees", "id"},
+		[]string{"items", "PRIMARY", "order_id", "", "", ""},
+		[]string{"items", "PRIMARY", "line", "", "", ""},
+		[]string{"items", "fk_items_order", "order_id", "shop", "orders", "id"},
+		[]string{"items", "fk_items_product", "product_id", "shop", "products", "id"},
+		[]string{"orders", "PRIMARY", "id", "", "", ""},
+		[]string{"orders", "fk_orders_customer", "customer_id", "shop", "customers", "id"},
+		[]string{"products", "PRIMARY", "id", "", "", ""},
+		[]string{"shipments", "PRIMARY", "id", "", "", ""},
+		[]string{"shipments", "fk_shipments_item", "order_id", "shop", "items", "order_id"},
+		[]string{"shipments", "fk_shipments_item", "line", "shop", "items", "line"},
+	)
+	all := []string{"customers", "employees", "items", "orders", "products", "shipments"}
+	id := []string{"id"}
+	results := map[string]*sqltypes.Result{
+		subsetGraphQuery:                                   graph,
+		"show tables from `shop`":                          stringsResult([]string{"Tables_in_shop"}, []string{"customers"}, []string{"employees"}, []string{"items"}, []string{"orders"}, []string{"products"}, []string{"shipments"}),
+		"SELECT `id` FROM `shop`.`customers` WHERE id = 1": intsResult(id, []string{"1"}),
+		// The manager of the customer, the manager of the manager who is
+		// managed by the first one.
+		"SELECT DISTINCT o.`id` FROM `shop`.`customers` AS w JOIN `shop`.`employees` AS o ON o.`id` = w.`manager_id` WHERE (w.`id`) IN ((1))":     intsResult(id, []string{"7"}),
+		"SELECT DISTINCT o.`id` FROM `shop`.`employees` AS w JOIN `shop`.`employees` AS o ON o.`id` = w.`manager_id` WHERE (w.`id`) IN ((7))":     intsResult(id, []string{"8"}),
+		"SELECT DISTINCT o.`id` FROM `shop`.`employees` AS w JOIN `shop`.`employees` AS o ON o.`id` = w.`manager_id` WHERE (w.`id`) IN ((8))":     intsResult(id, []string{"7"}),
+		"SELECT DISTINCT o.`id` FROM `shop`.`customers` AS w JOIN `shop`.`orders` AS o ON w.`id` = o.`customer_id` WHERE (w.`id`) IN ((1))":       intsResult(id, []string{"10"}, []string{"11"}),
+		"SELECT DISTINCT o.`id` FROM `shop`.`orders` AS w JOIN `shop`.`customers` AS o ON o.`id` = w.`customer_id` WHERE (w.`id`) IN ((10),(11))": intsResult(id, []string{"1"}),
+		"SELECT DISTINCT o.`order_id`,o.`line` FROM `shop`.`orders` AS w JOIN `shop`.`items` AS o ON w.`id` = o.`order_id` WHERE (w.`id`) IN ((10),(11))": intsResult([]string{"order_id", "line"},
+			[]string{"10", "1"}, []string{"10", "2"}, []string{"11", "1"}),
+		"SELECT DISTINCT o.`id` FROM `shop`.`items` AS w JOIN `shop`.`orders` AS o ON o.`id` = w.`order_id` WHERE (w.`order_id`,w.`line`) IN ((10,1),(10,2),(11,1))":                                  intsResult(id, []string{"10"}, []string{"11"}),
+		"SELECT DISTINCT o.`id` FROM `shop`.`items` AS w JOIN `shop`.`products` AS o ON o.`id` = w.`product_id` WHERE (w.`order_id`,w.`line`) IN ((10,1),(10,2),(11,1))":                              intsResult(id, []string{"100"}, []string{"101"}),
+		"SELECT DISTINCT o.`id` FROM `shop`.`items` AS w JOIN `shop`.`shipments` AS o ON w.`order_id` = o.`order_id` AND w.`line` = o.`line` WHERE (w.`order_id`,w.`line`) IN ((10,1),(10,2),(11,1))": intsResult(id, []string{"500"}),
+		"SELECT DISTINCT o.`order_id`,o.`line` FROM `shop`.`shipments` AS w JOIN `shop`.`items` AS o ON o.`order_id` = w.`order_id` AND o.`line` = w.`line` WHERE (w.`id`) IN ((500))":                intsResult([]string{"order_id", "line"}, []string{"10", "1"}),
+		// Products of other orders are not walked from the products.
+		"SELECT DISTINCT o.`order_id`,o.`line` FROM `shop`.`products` AS w JOIN `shop`.`items` AS o ON w.`id` = o.`product_id` WHERE (w.`id`) IN ((100),(101))": intsResult([]string{"order_id", "line"}, []string{"99", "1"}),
+	}
+	rec := &recordingExecutor{results: results}
+	pool, err := NewExecutorPool(log, 1, rec.executor)
+	AssertNil(err)
+	defer pool.Close()
+	conn := pool.Get()
+	defer pool.Put(conn)
+	args := &DumpArgs{Database: "shop", SubsetSeeds: map[string]string{"shop.customers": "id = 1"}}
+
+	// The orders of the customer, their items and shipments, and all the rows
+	// these reference.
+	{
+		s, err := walkSubset(log, conn, args, all)
+		assert.Nil(t, err)
+		assert.Equal(t, "(`id`) IN ((1))", s.where("customers"))
+		assert.Equal(t, "(`id`) IN ((7),(8))", s.where("employees"))
+		assert.Equal(t, "(`order_id`,`line`) IN ((10,1),(10,2),(11,1))", s.where("items"))
+		assert.Equal(t, "(`id`) IN ((100),(101))", s.where("products"))
+		assert.Equal(t, "(`id`) IN ((500))", s.where("shipments"))
+		assert.Equal(t, "1=0", s.where("audit"))
+		assert.Nil(t, matchingQueries(rec.queries, "SELECT DISTINCT o.`order_id`,o.`line` FROM `shop`.`products`"))
+
+		m := s.manifest(args)
+		assert.Equal(t, map[string]int{"shop.customers": 1, "shop.employees": 2, "shop.items": 3, "shop.orders": 2, "shop.products": 2, "shop.shipments": 1}, m.Rows)
+		assert.Equal(t, []SubsetStep{
+			{To: "shop.customers", Via: "id = 1", Direction: SubsetSeed, Rows: 1},
+			{From: "shop.customers", To: "shop.employees", Via: "fk_customers_manager", Direction: SubsetParent, Rows: 1},
+			{From: "shop.customers", To: "shop.orders", Via: "fk_orders_customer", Direction: SubsetChild, Rows: 2},
+			{From: "shop.employees", To: "shop.employees", Via: "fk_manager", Direction: SubsetParent, Rows: 1},
+			{From: "shop.orders", To: "shop.items", Via: "fk_items_order", Direction: SubsetChild, Rows: 3},
+			{From: "shop.orders", To: "shop.customers", Via: "fk_orders_customer", Direction: SubsetParent, Rows: 0},
+			{From: "shop.items", To: "shop.orders", Via: "fk_items_order", Direction: SubsetParent, Rows: 0},
+			{From: "shop.items", To: "shop.products", Via: "fk_items_product", Direction: SubsetParent, Rows: 2},
+			{From: "shop.items", To: "shop.shipments", Via: "fk_shipments_item", Direction: SubsetChild, Rows: 1},
+			{From: "shop.shipments", To: "shop.items", Via: "fk_shipments_item", Direction: SubsetParent, Rows: 0},
+		}, m.Traversal)
+	}
+
+	// Over the max rows.
+	{
+		args := *args
+		args.SubsetMaxRows = 5
+		_, err := walkSubset(log, conn, &args, all)
+		assert.NotNil(t, err)
+		assert.Equal(t, "dumping.subset.rows.over.max[5].at.table[shop.items]:narrow the seeds or raise the subset max rows", err.Error())
+	}
+
+	// A table reached without a primary key, one reached but not dumped, a
+	// seed of no table: nothing is walked.
+	{
+		results[subsetGraphQuery].Rows = append(results[subsetGraphQuery].Rows,
+			stringsResult(nil, []string{"audit", "fk_audit_customer", "customer_id", "shop", "customers", "id"}).Rows...)
+		rec.queries = nil
+		args := *args
+		args.SubsetSeeds = map[string]string{"shop.customers": "id = 1", "shop.gone": "id = 1"}
+		_, err := walkSubset(log, conn, &args, []string{"customers", "employees", "items", "orders", "shipments"})
+		assert.NotNil(t, err)
+		assert.Equal(t, "dumping.subset.preflight:seed.table[shop.gone].does.not.exist,table[shop.audit].has.no.primary.key,table[shop.audit].is.reached.but.not.dumped,table[shop.products].is.reached.but.not.dumped", err.Error())
+		assert.Nil(t, matchingQueries(rec.queries, "SELECT DISTINCT"))
+	}
+}
@@ -0,0 +1,120 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The ways a table was read, ManifestTable.Consistency.
+const (
+	// TableSnapshot is a table of a transactional engine read in the snapshot
+	// of DumpArgs.Consistency: its rows are the ones at the point of the dump.
+	TableSnapshot = "snapshot"
+	// TableNoSnapshot is a table read as it was when it was dumped: without a
+	// Consistency snapshot, or of an engine like MyISAM the snapshot doesn't
+	// cover, the lock of ConsistencyLock is only held while the snapshots
+	// start. Without that lock, LockModeNone, the snapshots of the tables
+	// differ and none is at the point of the dump.
+	TableNoSnapshot = "none"
+	// TableReadLock is a table of an engine the snapshot doesn't cover read
+	// while the lock of ConsistencyLock was held, see heldLock: no write
+	// changed it, its rows are the ones at the point of the dump too.
+	TableReadLock = "lock"
+)
+
+// maxLoggedNoSnapshot bounds the tables named by checkDumpConsistency.
+const maxLoggedNoSnapshot = 10
+
+// tableConsistency returns how a table of engine is read by the dump, once
+// it's dumped.
+func tableConsistency(args *DumpArgs, engine string) string {
+	switch {
+	case args.Consistency == ConsistencyLock && args.LockMode == LockModeNone:
+		return TableNoSnapshot
+	case (args.Consistency == ConsistencyLock || args.Consistency == ConsistencyGTID) && snapshotEngine(engine):
+		return TableSnapshot
+	case args.heldLock.held():
+		return TableReadLock
+	}
+	return TableNoSnapshot
+}
+
+// snapshotEngine reports whether the snapshots cover the tables of engine,
+// InnoDB in any case.
+func snapshotEngine(engine string) bool {
+	return strings.EqualFold(engine, "InnoDB")
+}
+
+// lockedFirst orders the tables of an engine the snapshots don't cover
+// first, and returns how many: they are dumped while the lock is held.
+// A table of no engine, a view, isn't one.
+func lockedFirst(tables []string, engines map[string]string) ([]string, int) {
+	var locked, rest []string
+	for _, table := range tables {
+		if engine := engines[table]; engine != "" && !snapshotEngine(engine) {
+			locked = append(locked, table)
+		} else {
+			rest = append(rest, table)
+		}
+	}
+	return append(locked, rest...), len(locked)
+}
+
+// setConsistency records how a dumped table was read.
+func (m *Manifest) setConsistency(db string, table string, consistency string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.table(db, table).Consistency = consistency
+}
+
+// noSnapshotTables returns the tables, 'db.table', recorded as read
+// without a snapshot, and the tables with a record: a dump older than the
+// record has none.
+func (m *Manifest) noSnapshotTables() ([]string, int) {
+	var tables []string
+	recorded := 0
+	for _, t := range m.Tables {
+		if t.Consistency == "" {
+			continue
+		}
+		recorded++
+		if t.Consistency == TableNoSnapshot {
+			tables = append(tables, t.Database+"."+t.Table)
+		}
+	}
+	return tables, recorded
+}
+
+// checkDumpConsistency logs the tables manifest.json records as dumped
+// without a snapshot: they are not at the point of the dump, a restore may
+// have rows out of step with the other tables.
+func checkDumpConsistency(log *xlog.Log, s Storage) {
+	m, err := readManifest(s)
+	if err != nil {
+		return
+	}
+	tables, recorded := m.noSnapshotTables()
+	if recorded == 0 {
+		return
+	}
+	if len(tables) == 0 {
+		log.Info("restoring.dump.tables[%d].all.in.the.snapshot", recorded)
+		return
+	}
+	names := tables
+	if len(names) > maxLoggedNoSnapshot {
+		names = names[:maxLoggedNoSnapshot]
+	}
+	log.Warning("restoring.dump.tables.without.snapshot[%d/%d]:%s:their.rows.are.not.point.in.time.consistent.with.the.other.tables", len(tables), recorded, strings.Join(names, ","))
+}
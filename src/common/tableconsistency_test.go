@@ -0,0 +1,130 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableConsistency(t *testing.T) {
+	for _, tc := range []struct {
+		consistency string
+		lockMode    string
+		engine      string
+		want        string
+	}{
+		{ConsistencyLock, "", "InnoDB", TableSnapshot},
+		{ConsistencyLock, "", "innodb", TableSnapshot},
+		{ConsistencyLock, LockModeBackup, "InnoDB", TableSnapshot},
+		{ConsistencyLock, LockModeNone, "InnoDB", TableNoSnapshot},
+		{ConsistencyGTID, "", "InnoDB", TableSnapshot},
+		{ConsistencyLock, "", "MyISAM", TableNoSnapshot},
+		{ConsistencyGTID, "", "MEMORY", TableNoSnapshot},
+		{ConsistencyNone, "", "InnoDB", TableNoSnapshot},
+		{"", "", "InnoDB", TableNoSnapshot},
+	} {
+		args := &DumpArgs{Consistency: tc.consistency, LockMode: tc.lockMode}
+		assert.Equal(t, tc.want, tableConsistency(args, tc.engine), tc.consistency+"/"+tc.lockMode+"/"+tc.engine)
+	}
+
+	// The tables out of the snapshots are read under the lock while it's
+	// held.
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	rec := &recordingExecutor{}
+	args := &DumpArgs{Consistency: ConsistencyLock, heldLock: &heldLock{log: log, conn: &Connection{ID: 1, exec: &recordingConn{r: rec}}, lock: ftwrlLock}}
+	assert.Equal(t, TableSnapshot, tableConsistency(args, "InnoDB"))
+	assert.Equal(t, TableReadLock, tableConsistency(args, "MyISAM"))
+	assert.Nil(t, args.heldLock.release())
+	assert.Equal(t, []string{"UNLOCK TABLES"}, rec.queries)
+	assert.Equal(t, TableNoSnapshot, tableConsistency(args, "MyISAM"))
+}
+
+func TestLockedFirst(t *testing.T) {
+	engines := map[string]string{"orders": "InnoDB", "logs": "MyISAM", "hits": "MEMORY", "v": "", "items": "innodb"}
+	tables, locked := lockedFirst([]string{"orders", "logs", "v", "items", "hits"}, engines)
+	assert.Equal(t, []string{"logs", "hits", "orders", "v", "items"}, tables)
+	assert.Equal(t, 2, locked)
+	tables, locked = lockedFirst([]string{"orders", "items"}, engines)
+	assert.Equal(t, []string{"orders", "items"}, tables)
+	assert.Equal(t, 0, locked)
+}
+
+func TestCheckDumpConsistency(t *testing.T) {
+	dir := "/tmp/checkdumpconsistency"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	s := NewDirStorage(dir)
+
+	// A dump of InnoDB and MyISAM tables in a snapshot, one resumed from the
+	// checkpoint.
+	m := newManifest()
+	args := &DumpArgs{Consistency: ConsistencyGTID}
+	for table, engine := range map[string]string{"orders": "InnoDB", "customers": "InnoDB", "logs": "MyISAM"} {
+		m.addTable("shop", table, "")
+		m.setConsistency("shop", table, tableConsistency(args, engine))
+	}
+	m.addTable("shop", "archive", "")
+	quiet := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	var allbytes, allrows uint64
+	metrics := newMetrics(quiet, "dump", nil, &allbytes, &allrows)
+	stats, err := newStatsWriter(s)
+	assert.Nil(t, err)
+	defer stats.close()
+	x = resumeTable(quiet, &DumpArgs{metrics: metrics}, m, stats, &checkpointTable{Database: "shop", Table: "archive", Stats: &TableStats{Engine: "ARCHIVE"}, Consistency: TableNoSnapshot})
+	AssertNil(x)
+	assert.Equal(t, uint64(1), metrics.report(nil).TablesWithoutSnapshot)
+	tables, recorded := m.noSnapshotTables()
+	assert.Equal(t, 4, recorded)
+	assert.Equal(t, 2, len(tables))
+	assert.Contains(t, tables, "shop.logs")
+	assert.Contains(t, tables, "shop.archive")
+	x = m.write(s)
+	AssertNil(x)
+
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "info", "")
+	assert.Nil(t, err)
+	checkDumpConsistency(log, s)
+	assert.Contains(t, out.String(), "restoring.dump.tables.without.snapshot[2/4]:")
+	assert.Contains(t, out.String(), ":their.rows.are.not.point.in.time.consistent.with.the.other.tables")
+
+	// All in the snapshot.
+	m = newManifest()
+	m.addTable("shop", "orders", "")
+	m.setConsistency("shop", "orders", TableSnapshot)
+	x = m.write(s)
+	AssertNil(x)
+	out.Reset()
+	checkDumpConsistency(log, s)
+	assert.Contains(t, out.String(), "restoring.dump.tables[1].all.in.the.snapshot")
+
+	// A dump older than the record says nothing.
+	m = newManifest()
+	m.addTable("shop", "orders", "")
+	x = m.write(s)
+	AssertNil(x)
+	out.Reset()
+	checkDumpConsistency(log, s)
+	assert.Equal(t, "", out.String())
+}
+
+func TestReportTablesWithoutSnapshot(t *testing.T) {
+	out := &bytes.Buffer{}
+	log, err := NewLog(out, "info", "")
+	assert.Nil(t, err)
+	LogReport(log, Report{Mode: "dump", Status: RunOK, Rows: 10, Bytes: 100, TablesDone: 3, TablesWithoutSnapshot: 1})
+	assert.Contains(t, out.String(), "dumping.all.done.cost[0.00sec].allrows[10].allbytes[100].rate[0.00MB/s].tables.without.snapshot[1/3]")
+}
@@ -0,0 +1,55 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"regexp"
+	"strings"
+)
+
+// tablespaceClause matches a DATA DIRECTORY, INDEX DIRECTORY or TABLESPACE
+// option of a table or of a partition, in options masked by maskQuoted.
+const tablespaceClause = `(?:(?:DATA|INDEX)\s+DIRECTORY\s*=?\s*(?:'(?:[^']|'')*'|"(?:[^"]|"")*")|TABLESPACE\s*=?\s*(?:` + "`[^`]*`" + `|\w+)(?:\s+STORAGE\s+(?:DISK|MEMORY)\b)?)`
+
+// tablespaceOptionRegexp matches a tablespaceClause with the spaces before
+// it, alone in the /*!50100 TABLESPACE `ts` */ comment SHOW CREATE TABLE
+// wraps a tablespace in or not.
+var tablespaceOptionRegexp = regexp.MustCompile(`(?i)\s*(?:/\*!\d*\s*` + tablespaceClause + `\s*\*/|\b` + tablespaceClause + `)`)
+
+// stripTablespaceOptions returns the create table statement schema without
+// the DATA DIRECTORY, INDEX DIRECTORY and TABLESPACE options of the table
+// and of its partitions, and the options stripped: the directories and the
+// general tablespaces of the source are rarely on the target. The quoted
+// paths and names may have spaces or parentheses, the columns and their
+// comments are left as they are.
+func stripTablespaceOptions(schema string) (string, []string) {
+	end := definitionsEnd(schema)
+	if end < 0 {
+		return schema, nil
+	}
+	options := schema[end+1:]
+	matches := tablespaceOptionRegexp.FindAllStringIndex(maskQuoted(options), -1)
+	if matches == nil {
+		return schema, nil
+	}
+	var stripped []string
+	var out strings.Builder
+	out.WriteString(schema[:end+1])
+	last := 0
+	for _, match := range matches {
+		option := strings.TrimSpace(options[match[0]:match[1]])
+		option = strings.TrimSpace(strings.TrimSuffix(strings.TrimLeft(option, "/*!0123456789"), "*/"))
+		stripped = append(stripped, option)
+		out.WriteString(options[last:match[0]])
+		last = match[1]
+	}
+	out.WriteString(options[last:])
+	return out.String(), stripped
+}
@@ -0,0 +1,115 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripTablespaceOptions(t *testing.T) {
+	tests := []struct {
+		schema   string
+		want     string
+		stripped []string
+	}{
+		// None.
+		{"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB", "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB", nil},
+		// The directories, their paths with spaces and parentheses.
+		{"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 DATA DIRECTORY='/mnt/fast disk (2)/' INDEX DIRECTORY='/mnt/idx'",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+			[]string{"DATA DIRECTORY='/mnt/fast disk (2)/'", "INDEX DIRECTORY='/mnt/idx'"}},
+		// A quote in the path.
+		{`CREATE TABLE t1 (a int) DATA DIRECTORY = '/mnt/it''s' ENGINE=MyISAM`,
+			`CREATE TABLE t1 (a int) ENGINE=MyISAM`,
+			[]string{`DATA DIRECTORY = '/mnt/it''s'`}},
+		// A general tablespace in its comment, as SHOW CREATE TABLE has it.
+		{"CREATE TABLE `t1` (`a` int) /*!50100 TABLESPACE `ts 1` */ ENGINE=InnoDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB",
+			[]string{"TABLESPACE `ts 1`"}},
+		{"CREATE TABLE `t1` (`a` int) TABLESPACE=ts1 STORAGE DISK ENGINE=NDB",
+			"CREATE TABLE `t1` (`a` int) ENGINE=NDB",
+			[]string{"TABLESPACE=ts1 STORAGE DISK"}},
+		// The partitions.
+		{"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB\n/*!50100 PARTITION BY RANGE (`a`)\n(PARTITION p0 VALUES LESS THAN (10) DATA DIRECTORY = '/mnt/p0' ENGINE = InnoDB,\n PARTITION p1 VALUES LESS THAN MAXVALUE TABLESPACE = `innodb_file_per_table` ENGINE = InnoDB) */",
+			"CREATE TABLE `t1` (`a` int) ENGINE=InnoDB\n/*!50100 PARTITION BY RANGE (`a`)\n(PARTITION p0 VALUES LESS THAN (10) ENGINE = InnoDB,\n PARTITION p1 VALUES LESS THAN MAXVALUE ENGINE = InnoDB) */",
+			[]string{"DATA DIRECTORY = '/mnt/p0'", "TABLESPACE = `innodb_file_per_table`"}},
+		// The columns and the comments are not options.
+		{"CREATE TABLE `t1` (`tablespace` varchar(10) DEFAULT 'DATA DIRECTORY=''/x''') ENGINE=InnoDB COMMENT='TABLESPACE ts1'",
+			"CREATE TABLE `t1` (`tablespace` varchar(10) DEFAULT 'DATA DIRECTORY=''/x''') ENGINE=InnoDB COMMENT='TABLESPACE ts1'", nil},
+	}
+	for _, test := range tests {
+		got, stripped := stripTablespaceOptions(test.schema)
+		assert.Equal(t, test.want, got, test.schema)
+		assert.Equal(t, test.stripped, stripped, test.schema)
+	}
+}
+
+func TestTablespaceOptions(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	const create = "CREATE TABLE `t1` (`a` int) /*!50100 TABLESPACE `ts1` */ ENGINE=InnoDB DATA DIRECTORY='/mnt/data'"
+
+	schemaResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Table", Type: querypb.Type_VARCHAR},
+			{Name: "Create Table", Type: querypb.Type_VARCHAR},
+		},
+		Rows: [][]sqltypes.Value{{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte("t1")),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(create)),
+		}},
+	}
+
+	// dump writes the schema file with the options of the dump, restore
+	// restores it with the ones of the load and returns the CREATE TABLE.
+	dump := func(args DumpArgs) Storage {
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"show create table `test`.`t1`": schemaResult}}
+		pool, err := NewExecutorPool(log, 1, rec.executor)
+		AssertNil(err)
+		defer pool.Close()
+		conn := pool.Get()
+		defer pool.Put(conn)
+		args.Database = "test"
+		args.storage = NewMemStorage()
+		schema, err := dumpTableSchema(log, conn, &args, "t1")
+		AssertNil(err)
+		assert.Equal(t, create+";\n", schema)
+		return args.storage
+	}
+	restore := func(s Storage, args LoadArgs) string {
+		rec := &recordingExecutor{}
+		pool, err := NewExecutorPool(log, 1, rec.executor)
+		AssertNil(err)
+		defer pool.Close()
+		args.storage = s
+		err = restoreTableSchemas(context.Background(), log, pool, &args, []string{"test.t1-schema.sql"}, 1)
+		assert.Nil(t, err)
+		return rec.queries[len(rec.queries)-1]
+	}
+	read := func(s Storage) string {
+		data, err := readFile(s, "test.t1-schema.sql")
+		AssertNil(err)
+		return string(data)
+	}
+
+	stripped := dump(DumpArgs{})
+	assert.Equal(t, "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n", read(stripped))
+	kept := dump(DumpArgs{KeepTablespaceOptions: true})
+	assert.Equal(t, create+";\n", read(kept))
+
+	assert.Equal(t, "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB", restore(stripped, LoadArgs{}))
+	assert.Equal(t, "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB", restore(kept, LoadArgs{}))
+	assert.Equal(t, create, restore(kept, LoadArgs{KeepTablespaceOptions: true}))
+}
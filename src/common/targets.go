@@ -0,0 +1,178 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// DefaultTarget is the name of the LoadArgs.Address among the targets of a
+// load with LoadArgs.Targets, in the logs and the Report.Targets.
+const DefaultTarget = "default"
+
+// LoadTarget is a server a LoadConfig.Classifier routes tables to, see
+// LoadArgs.Targets.
+type LoadTarget struct {
+	Address  string
+	User     string
+	Password string
+	// Executor is the LoadConfig.Executor of the target, nil dials Address.
+	Executor ExecutorFunc `json:"-"`
+}
+
+// TableClassifier returns the name of the LoadArgs.Targets the table
+// db.table is restored into, empty or DefaultTarget for the LoadArgs.Address.
+// It's called for every table of the dump once per target and must always
+// return the same name for a table.
+type TableClassifier func(db string, table string) string
+
+// targetRoute is the target of one of the runs of a load with
+// LoadArgs.Targets and the classifier routing the tables to it.
+type targetRoute struct {
+	name     string
+	classify TableClassifier
+	// byDatabase is a classify of a LoadArgs.Placement, which routes the
+	// databases without any table too.
+	byDatabase bool
+}
+
+// targetOf returns the target the table db.table is routed to.
+func (r *targetRoute) targetOf(db string, table string) string {
+	target := r.classify(db, table)
+	if target == "" {
+		return DefaultTarget
+	}
+	return target
+}
+
+// emptyTarget returns the target of the database db without any table.
+func (r *targetRoute) emptyTarget(db string) string {
+	if r.byDatabase {
+		return r.targetOf(db, "")
+	}
+	return DefaultTarget
+}
+
+// loadTargets restores the dump into the LoadArgs.Address, then into every
+// target of args.Targets by name, one after the other: every run restores
+// the tables classify routes to its target, see filterTarget, with its own
+// pool, progress and report. The first failed run stops the ones not started.
+func loadTargets(ctx context.Context, log *xlog.Log, args *LoadArgs, classify TableClassifier) error {
+	for _, name := range targetNames(args.Targets) {
+		targs := *args
+		if target, ok := args.Targets[name]; ok {
+			targs.Address = target.Address
+			targs.User = target.User
+			targs.Password = target.Password
+			targs.executor = target.Executor
+		}
+		targs.route = &targetRoute{name: name, classify: classify, byDatabase: args.Placement != ""}
+		var bytes uint64
+		targs.metrics = newMetrics(log, "load", nil, &bytes, nil)
+		targs.metrics.target = name
+		targs.metrics.cancel = args.metrics.cancel
+		args.metrics.follow(targs.metrics)
+		log.Info("restoring.target[%s].address[%s]...", name, targs.Address)
+		err := load(ctx, log, &targs)
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		args.metrics.targetDone(name, targs.metrics.report(err))
+		if err != nil {
+			return wrapf(err, "restoring.target[%s].error:%v", name, err)
+		}
+	}
+	return nil
+}
+
+// filterTarget keeps only the schema and data files of the tables routed to
+// the target of args.route, and the databases of these tables: the
+// DefaultTarget also gets the databases without any table, unless they're
+// placed by a LoadArgs.Placement. The
+// LoadArgs.WarmTables and OptimizeTables are the ones routed to the target.
+func filterTarget(log *xlog.Log, args *LoadArgs, files *Files) error {
+	route := args.route
+	databases := make(map[string]bool)
+	routed := make(map[string]bool)
+	keep := func(db string, table string) (bool, error) {
+		target := route.targetOf(db, table)
+		if _, ok := args.Targets[target]; !ok && target != DefaultTarget {
+			return false, fmt.Errorf("restoring.table[%s.%s].target[%s].not.in.targets", db, table, target)
+		}
+		databases[db] = databases[db] || target == route.name
+		return target == route.name, nil
+	}
+
+	var schemas []string
+	for _, schema := range files.schemas {
+		splits := strings.SplitN(strings.TrimSuffix(filepath.Base(schema), schemaSuffix), ".", 2)
+		if len(splits) != 2 {
+			return fmt.Errorf("schema.file[%s].not.named.as[db.table%s]", schema, schemaSuffix)
+		}
+		ok, err := keep(splits[0], splits[1])
+		if err != nil {
+			return err
+		}
+		if ok {
+			schemas = append(schemas, schema)
+			routed[splits[0]+"."+splits[1]] = true
+		}
+	}
+	var datas []string
+	for _, table := range files.tables {
+		db, tbl, _ := parseTableFile(table)
+		ok, err := keep(db, tbl)
+		if err != nil {
+			return err
+		}
+		if ok {
+			datas = append(datas, table)
+			routed[db+"."+tbl] = true
+		}
+	}
+	var dbs []string
+	for _, file := range files.databases {
+		db := strings.TrimSuffix(filepath.Base(file), dbSuffix)
+		if has, ok := databases[db]; has || (!ok && route.name == route.emptyTarget(db)) {
+			dbs = append(dbs, file)
+		}
+	}
+	var warm []string
+	for _, name := range args.WarmTables {
+		if routed[name] {
+			warm = append(warm, name)
+		}
+	}
+	log.Info("restoring.target[%s].databases[%d/%d].tables[%d/%d].files[%d/%d]", route.name, len(dbs), len(files.databases),
+		len(schemas), len(files.schemas), len(datas), len(files.tables))
+	files.databases, files.schemas, files.tables = dbs, schemas, datas
+	args.WarmTables = warm
+	args.OptimizeTables = keptTables(args.OptimizeTables, routed)
+	return nil
+}
+
+// redactTargets returns the targets with their passwords redacted, for the
+// configuration of the status.
+func redactTargets(targets map[string]LoadTarget) map[string]LoadTarget {
+	if targets == nil {
+		return nil
+	}
+	redactedTargets := make(map[string]LoadTarget, len(targets))
+	for name, target := range targets {
+		target.Password = redacted
+		redactedTargets[name] = target
+	}
+	return redactedTargets
+}
@@ -0,0 +1,123 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoaderTargets(t *testing.T) {
+	dir := "/tmp/loadertargets"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql":      "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.users-schema.sql":       "CREATE TABLE `users` (`a` int) ENGINE=InnoDB;\n",
+		"test.users.00001.sql":        "INSERT INTO `users` VALUES (1);\n",
+		"test.logs_2019-schema.sql":   "CREATE TABLE `logs_2019` (`a` int) ENGINE=InnoDB;\n",
+		"test.logs_2019.00001.sql":    "INSERT INTO `logs_2019` VALUES (1);\n",
+		"test.logs_2019.00002.sql":    "INSERT INTO `logs_2019` VALUES (2);\n",
+		"empty-schema-create.sql":     "CREATE DATABASE IF NOT EXISTS `empty`;",
+		"audit-schema-create.sql":     "CREATE DATABASE IF NOT EXISTS `audit`;",
+		"audit.events-schema.sql":     "CREATE TABLE `events` (`a` int) ENGINE=InnoDB;\n",
+		"audit.events.00001.sql":      "INSERT INTO `events` VALUES (1);\n",
+		"audit.events_old-schema.sql": "CREATE TABLE `events_old` (`a` int) ENGINE=InnoDB;\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	classify := func(db string, table string) string {
+		if strings.HasPrefix(table, "logs_") || db == "audit" {
+			return "archive"
+		}
+		return ""
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 2, IntervalMs: 500}
+
+	// Every table on its target, with its database, the report per target.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		hot := &recordingExecutor{}
+		archive := &recordingExecutor{}
+		args := args
+		args.Targets = map[string]LoadTarget{"archive": {Address: "10.0.0.2:3306", User: "mock", Password: "secret", Executor: archive.executor}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: hot.executor, Classifier: classify}).Run(context.Background())
+		assert.Nil(t, err)
+
+		assert.Contains(t, hot.queries, "CREATE DATABASE IF NOT EXISTS `test`;")
+		assert.Contains(t, hot.queries, "CREATE DATABASE IF NOT EXISTS `empty`;")
+		assert.NotContains(t, hot.queries, "CREATE DATABASE IF NOT EXISTS `audit`;")
+		assert.Contains(t, hot.queries, "INSERT INTO `users` VALUES (1)")
+		assert.NotContains(t, hot.queries, "CREATE TABLE `logs_2019` (`a` int) ENGINE=InnoDB")
+
+		assert.Contains(t, archive.queries, "CREATE DATABASE IF NOT EXISTS `test`;")
+		assert.Contains(t, archive.queries, "CREATE DATABASE IF NOT EXISTS `audit`;")
+		assert.NotContains(t, archive.queries, "CREATE DATABASE IF NOT EXISTS `empty`;")
+		assert.Contains(t, archive.queries, "CREATE TABLE `logs_2019` (`a` int) ENGINE=InnoDB")
+		assert.Contains(t, archive.queries, "CREATE TABLE `events_old` (`a` int) ENGINE=InnoDB")
+		assert.Contains(t, archive.queries, "INSERT INTO `logs_2019` VALUES (2)")
+		assert.NotContains(t, archive.queries, "INSERT INTO `users` VALUES (1)")
+
+		assert.Equal(t, RunOK, report.Status)
+		assert.Equal(t, uint64(1), report.Targets[DefaultTarget].FilesDone)
+		assert.Equal(t, uint64(3), report.Targets["archive"].FilesDone)
+		assert.Equal(t, "archive", report.Targets["archive"].Target)
+		assert.Equal(t, uint64(4), report.FilesDone)
+		assert.Equal(t, uint64(4), report.FilesTotal)
+
+		LogReport(log, report)
+		for _, line := range []string{
+			"restoring.target[archive].databases[2/3].tables[3/4].files[3/4]",
+			"restoring.target[default].databases[2/3].tables[1/4].files[1/4]",
+			"restoring.target[archive].all.done.cost[",
+			"restoring.target[default].all.done.cost[",
+			"restoring.all.done.cost[",
+		} {
+			assert.True(t, strings.Contains(buf.String(), line), "%s:%s", line, buf.String())
+		}
+		assert.False(t, strings.Contains(buf.String(), "secret"), buf.String())
+	}
+
+	// A table routed to an unknown target fails the restore before any
+	// statement, a failed target stops the ones after it.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		hot := &recordingExecutor{}
+		archive := &recordingExecutor{}
+		args := args
+		args.Targets = map[string]LoadTarget{"archive": {Address: "10.0.0.2:3306", User: "mock", Executor: archive.executor}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: hot.executor, Classifier: func(db string, table string) string {
+			return "cold"
+		}}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.target[default].error:restoring.table[audit.events].target[cold].not.in.targets", err.Error())
+		assert.Equal(t, RunFailed, report.Targets[DefaultTarget].Status)
+		assert.Nil(t, archive.queries)
+	}
+
+	// Targets need a classifier.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		args := args
+		args.Targets = map[string]LoadTarget{"archive": {Address: "10.0.0.2:3306", User: "mock"}}
+		_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, "restoring.targets.require.a.classifier", err.Error())
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// tempSuffix ends the name a file of a directory is written under until it's
+// closed, see dirStorage.Create: a file with it was left by a crashed dump,
+// it's garbage.
+const tempSuffix = ".tmp"
+
+// tempFile reports whether the file name is a temp file of a crashed dump.
+func tempFile(name string) bool {
+	return strings.HasSuffix(name, tempSuffix)
+}
+
+// createLog creates a file written a line at a time as the dump goes, like
+// checkpoint.jsonl and stats.tsv: in a directory it's written under its name
+// at once, so a killed dump keeps its whole lines. The other storages
+// publish it once it's closed.
+func createLog(s Storage, name string) (io.WriteCloser, error) {
+	switch t := s.(type) {
+	case *dirStorage:
+		return t.open(name)
+	case *volumeStorage:
+		return createLog(t.main, name)
+	}
+	return s.Create(name)
+}
+
+// cleanTempFiles removes the temp files a crashed dump left in the
+// directories of s, the volumes too, see DumpArgs.Clean. The other storages
+// have none.
+func cleanTempFiles(log *xlog.Log, s Storage) error {
+	switch t := s.(type) {
+	case *dirStorage:
+		names, err := t.List()
+		if err != nil {
+			return wrapf(err, "dumping.clean.dir[%s].error:%v", t.dir, err)
+		}
+		for _, name := range names {
+			if !tempFile(name) {
+				continue
+			}
+			if err := os.Remove(t.path(name)); err != nil {
+				return wrapf(err, "dumping.clean.file[%s].error:%v", name, err)
+			}
+			log.Info("dumping.clean.removed[%s].left.by.a.crashed.dump", name)
+		}
+	case *volumeStorage:
+		if err := cleanTempFiles(log, t.main); err != nil {
+			return err
+		}
+		for _, v := range t.volumes {
+			if err := cleanTempFiles(log, v.storage); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warnTempFiles warns about the temp files of the dump, they are not restored.
+func warnTempFiles(log *xlog.Log, files *Files) {
+	for _, name := range files.temps {
+		log.Warning("restoring.temp.file[%s].ignored:left.by.a.crashed.dump", name)
+	}
+}
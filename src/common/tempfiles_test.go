@@ -0,0 +1,75 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirStorageTempFiles(t *testing.T) {
+	dir := "/tmp/tempfilestest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	s := NewDirStorage(dir)
+
+	// A file shows under its name once closed, never a part of it.
+	{
+		w, err := s.Create("test.t1.00001.sql")
+		assert.Nil(t, err)
+		_, err = io.WriteString(w, "INSERT INTO `t1` VALUES (1);\n")
+		assert.Nil(t, err)
+		_, err = s.Stat("test.t1.00001.sql")
+		assert.True(t, os.IsNotExist(err))
+		names, err := s.List()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"test.t1.00001.sql.tmp"}, names)
+		assert.Nil(t, w.Close())
+		data, err := readFile(s, "test.t1.00001.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, "INSERT INTO `t1` VALUES (1);\n", string(data))
+	}
+
+	// A log shows at once.
+	{
+		w, err := createLog(s, checkpointFile)
+		assert.Nil(t, err)
+		_, err = io.WriteString(w, "{}\n")
+		assert.Nil(t, err)
+		data, err := readFile(s, checkpointFile)
+		assert.Nil(t, err)
+		assert.Equal(t, "{}\n", string(data))
+		assert.Nil(t, w.Close())
+	}
+
+	// The temp files of a crash are listed apart by the loader, and removed
+	// by the clean of the next dump.
+	{
+		x := WriteFile(dir+"/test.t1.00002.sql.tmp", "INSERT INTO `t1` VALUES (2")
+		AssertNil(x)
+		x = WriteFile(dir+"/test.t2-schema.sql.tmp", "CREATE TABLE")
+		AssertNil(x)
+		files, err := loadFiles(s)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"test.t1.00001.sql"}, files.tables)
+		assert.Equal(t, []string{"test.t1.00002.sql.tmp", "test.t2-schema.sql.tmp"}, files.temps)
+
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		assert.Nil(t, cleanTempFiles(log, s))
+		names, err := s.List()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{checkpointFile, "test.t1.00001.sql"}, names)
+	}
+}
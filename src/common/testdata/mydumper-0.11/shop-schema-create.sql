@@ -0,0 +1 @@
+CREATE DATABASE `shop` /*!40100 DEFAULT CHARACTER SET utf8mb4 */;
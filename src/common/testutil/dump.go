@@ -0,0 +1,147 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package testutil
+
+import (
+	"common"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DumpShape is the shape of the dump of WriteDump, a field 0 is 1.
+type DumpShape struct {
+	// Databases are named db1, db2... and the Tables of each t1, t2...
+	Databases int
+	Tables    int
+	// Chunks are the data files of a table, 00001, 00002..., of Rows rows
+	// each, in INSERTs of RowsPerStatement rows, all of them if 0.
+	Chunks           int
+	Rows             int
+	RowsPerStatement int
+}
+
+// Dump is a dump written by WriteDump.
+type Dump struct {
+	Dir string
+	// Databases are the databases, the tables of each in Tables as
+	// 'db.table'.
+	Databases []string
+	Tables    map[string][]string
+	// Files are the names of the files, in the order they are written: the
+	// schema of a database, then of each of its tables, then their datas.
+	Files []string
+	// Inserts are the INSERTs of every data file by name, without their
+	// delimiter as the loader executes them.
+	Inserts map[string][]string
+	// Rows is the number of rows of all the tables.
+	Rows int
+}
+
+// FileOrder returns the data files in the order their INSERTs are in
+// statements, which must be the ones of the dump: the loader restores the
+// files in any order, the INSERTs of a file in order one after the other.
+func (d *Dump) FileOrder(statements []string) ([]string, error) {
+	var names []string
+	for name := range d.Inserts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var files []string
+	for len(statements) > 0 {
+		found := ""
+		for _, name := range names {
+			if inserts := d.Inserts[name]; len(inserts) <= len(statements) && inserts[0] == statements[0] {
+				found = name
+				break
+			}
+		}
+		if found == "" {
+			return files, fmt.Errorf("statement %q starts no data file", statements[0])
+		}
+		for i, insert := range d.Inserts[found] {
+			if statements[i] != insert {
+				return files, fmt.Errorf("statement %q of %s is %q", insert, found, statements[i])
+			}
+		}
+		files = append(files, found)
+		statements = statements[len(d.Inserts[found]):]
+	}
+	return files, nil
+}
+
+// nonZero returns n, 1 if it's 0.
+func nonZero(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+// WriteDump writes a dump of shape into dir, which is emptied first. The
+// tables have an id, the primary key counted from 1 in each table, and a
+// varchar.
+func WriteDump(dir string, shape DumpShape) (*Dump, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	rows, perStatement := nonZero(shape.Rows), shape.RowsPerStatement
+	if perStatement == 0 || perStatement > rows {
+		perStatement = rows
+	}
+	d := &Dump{Dir: dir, Tables: make(map[string][]string), Inserts: make(map[string][]string)}
+	write := func(name string, data string) error {
+		d.Files = append(d.Files, name)
+		return common.WriteFile(filepath.Join(dir, name), data)
+	}
+	for i := 1; i <= nonZero(shape.Databases); i++ {
+		db := fmt.Sprintf("db%d", i)
+		d.Databases = append(d.Databases, db)
+		if err := write(db+"-schema-create.sql", fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`;\n", db)); err != nil {
+			return nil, err
+		}
+		for j := 1; j <= nonZero(shape.Tables); j++ {
+			table := fmt.Sprintf("t%d", j)
+			d.Tables[db] = append(d.Tables[db], db+"."+table)
+			schema := fmt.Sprintf("CREATE TABLE `%s` (\n  `id` bigint NOT NULL,\n  `v` varchar(64) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB;\n", table)
+			if err := write(db+"."+table+"-schema.sql", schema); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range d.Tables[db] {
+			table := strings.TrimPrefix(name, db+".")
+			id := 0
+			for chunk := 1; chunk <= nonZero(shape.Chunks); chunk++ {
+				file := fmt.Sprintf("%s.%05d.sql", name, chunk)
+				var data strings.Builder
+				for done := 0; done < rows; done += perStatement {
+					var values []string
+					for k := done; k < done+perStatement && k < rows; k++ {
+						id++
+						values = append(values, fmt.Sprintf("(%d,'%s-%d')", id, name, id))
+					}
+					insert := fmt.Sprintf("INSERT INTO `%s` VALUES %s", table, strings.Join(values, ","))
+					d.Inserts[file] = append(d.Inserts[file], insert)
+					data.WriteString(insert + ";\n")
+				}
+				d.Rows += rows
+				if err := write(file, data.String()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return d, nil
+}
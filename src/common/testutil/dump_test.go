@@ -0,0 +1,63 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package testutil
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDump(t *testing.T) {
+	dir := "/tmp/testutildump"
+	dump, err := WriteDump(dir, DumpShape{Databases: 2, Chunks: 2, Rows: 5, RowsPerStatement: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db1", "db2"}, dump.Databases)
+	assert.Equal(t, []string{"db2.t1"}, dump.Tables["db2"])
+	assert.Equal(t, []string{
+		"db1-schema-create.sql", "db1.t1-schema.sql", "db1.t1.00001.sql", "db1.t1.00002.sql",
+		"db2-schema-create.sql", "db2.t1-schema.sql", "db2.t1.00001.sql", "db2.t1.00002.sql",
+	}, dump.Files)
+	assert.Equal(t, 20, dump.Rows)
+
+	// The ids go on from a chunk to the next.
+	want := []string{
+		"INSERT INTO `t1` VALUES (6,'db1.t1-6'),(7,'db1.t1-7')",
+		"INSERT INTO `t1` VALUES (8,'db1.t1-8'),(9,'db1.t1-9')",
+		"INSERT INTO `t1` VALUES (10,'db1.t1-10')",
+	}
+	assert.Equal(t, want, dump.Inserts["db1.t1.00002.sql"])
+	data, err := ioutil.ReadFile(dir + "/db1.t1.00002.sql")
+	assert.Nil(t, err)
+	assert.Equal(t, want[0]+";\n"+want[1]+";\n"+want[2]+";\n", string(data))
+
+	// A zero shape is a row.
+	dump, err = WriteDump(dir, DumpShape{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(dump.Files))
+	assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1,'db1.t1-1')"}, dump.Inserts["db1.t1.00001.sql"])
+}
+
+func TestDumpFileOrder(t *testing.T) {
+	dump, err := WriteDump("/tmp/testutilfileorder", DumpShape{Tables: 2, Rows: 2, RowsPerStatement: 1})
+	assert.Nil(t, err)
+	t1, t2 := dump.Inserts["db1.t1.00001.sql"], dump.Inserts["db1.t2.00001.sql"]
+
+	files, err := dump.FileOrder(append(append([]string(nil), t2...), t1...))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db1.t2.00001.sql", "db1.t1.00001.sql"}, files)
+
+	// The INSERTs of a file are one after the other.
+	_, err = dump.FileOrder([]string{t1[0], t2[0], t1[1], t2[1]})
+	assert.NotNil(t, err)
+	_, err = dump.FileOrder([]string{"use `db1`"})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,266 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package testutil
+
+import (
+	"common"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+)
+
+// The errors a Fault injects, as the server returns them.
+var (
+	// ErrDeadlock is a deadlock, the loader retries the statement.
+	ErrDeadlock = &sqldb.SQLError{Num: 1213, State: "40001", Message: "Deadlock found when trying to get lock; try restarting transaction"}
+	// ErrGoneAway is the server gone away under the connection, set
+	// Fault.Close with it: the loader reconnects, see LoadArgs.ReadOnlyMaxWait.
+	ErrGoneAway = &sqldb.SQLError{Num: 2006, State: "HY000", Message: "MySQL server has gone away"}
+	// ErrReadOnly is a write refused by a super_read_only server, the loader
+	// waits for it to be writable again.
+	ErrReadOnly = &sqldb.SQLError{Num: 1290, State: "HY000", Message: "The MySQL server is running with the --super-read-only option so it cannot execute this statement"}
+)
+
+// errClosed is the error of the statements of a connection closed by a
+// Fault without a server behind.
+var errClosed = errors.New("testutil.connection.closed")
+
+// Fault is an error or a delay a Recorder injects on the statements it
+// matches.
+type Fault struct {
+	// Conns are the ids in their pool of the connections the fault is on,
+	// every one if empty: the thread of a run restores on the connection of
+	// its id.
+	Conns []int
+	// Prefix is the start of the statements the fault is on, the case
+	// ignored, every one if empty.
+	Prefix string
+	// Nth is the statement the fault is on among the ones it matches,
+	// counted from 1 over all the connections, every one if 0.
+	Nth int
+	// Delay is waited before the statement is sent, a slow response.
+	Delay time.Duration
+	// Err is returned instead of the result, the statement is not sent.
+	Err error
+	// Result is the result of a fetch instead of the one of the server, like
+	// a read_only check which says the target is read-only once.
+	Result *sqltypes.Result
+	// Close closes the connection once Err is returned, like a server gone
+	// away: its next statements fail.
+	Close bool
+}
+
+// matches reports whether the fault is on the statement query of the
+// connection id, its Nth aside.
+func (f *Fault) matches(id int, query string) bool {
+	if len(f.Conns) > 0 {
+		found := false
+		for _, c := range f.Conns {
+			found = found || c == id
+		}
+		if !found {
+			return false
+		}
+	}
+	return strings.HasPrefix(strings.ToLower(query), strings.ToLower(f.Prefix))
+}
+
+// Conn is a connection of a Recorder, a reconnect of the pool is another one
+// with the same ID.
+type Conn struct {
+	// ID is the id of the connection in its pool, the pools of a run all
+	// start from 0.
+	ID int
+	// Statements are the statements executed or fetched on the connection in
+	// order, the ones a Fault failed included.
+	Statements []string
+	// Closed is set once the connection is closed.
+	Closed bool
+}
+
+// Recorder is the LoadConfig.Executor of a run which records the statements
+// of every connection, in the order they were dialed, and injects the Faults
+// on them. The statements are then sent to the executors of next, or
+// answered by the Results if next is nil.
+type Recorder struct {
+	next common.ExecutorFunc
+
+	mu      sync.Mutex
+	conns   []*Conn
+	faults  []*Fault
+	seen    map[*Fault]int
+	results map[string]*sqltypes.Result
+}
+
+// NewRecorder returns the Recorder of the executors of next. Without next,
+// every statement succeeds and a fetch returns the result set by Result, an
+// empty one if none.
+func NewRecorder(next common.ExecutorFunc) *Recorder {
+	return &Recorder{next: next, seen: make(map[*Fault]int), results: make(map[string]*sqltypes.Result)}
+}
+
+// Executor is the common.ExecutorFunc of the recorder, the LoadConfig.Executor
+// of a run.
+func (r *Recorder) Executor(id int) (common.Executor, error) {
+	var next common.Executor
+	if r.next != nil {
+		var err error
+		if next, err = r.next(id); err != nil {
+			return nil, err
+		}
+	}
+	c := &recordedConn{r: r, conn: &Conn{ID: id}, next: next}
+	r.mu.Lock()
+	r.conns = append(r.conns, c.conn)
+	r.mu.Unlock()
+	return c, nil
+}
+
+// Inject adds a fault, the first one added of the faults on a statement is
+// the one injected.
+func (r *Recorder) Inject(f Fault) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.faults = append(r.faults, &f)
+}
+
+// Result sets the result of the fetch of query without a server, see
+// NewRecorder.
+func (r *Recorder) Result(query string, qr *sqltypes.Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[query] = qr
+}
+
+// Conns returns a copy of the connections dialed so far, in order.
+func (r *Recorder) Conns() []Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	conns := make([]Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, Conn{ID: c.ID, Statements: append([]string(nil), c.Statements...), Closed: c.Closed})
+	}
+	return conns
+}
+
+// Statements returns the statements of the connections of id in order, the
+// ones of its reconnects after.
+func (r *Recorder) Statements(id int) []string {
+	var statements []string
+	for _, c := range r.Conns() {
+		if c.ID == id {
+			statements = append(statements, c.Statements...)
+		}
+	}
+	return statements
+}
+
+// before records query on c and returns the fault it's injected, nil if
+// none.
+func (r *Recorder) before(c *recordedConn, query string) *Fault {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c.conn.Statements = append(c.conn.Statements, query)
+	var fault *Fault
+	for _, f := range r.faults {
+		if !f.matches(c.conn.ID, query) {
+			continue
+		}
+		r.seen[f]++
+		if fault == nil && (f.Nth == 0 || r.seen[f] == f.Nth) {
+			fault = f
+		}
+	}
+	return fault
+}
+
+// recordedConn is the executor of a connection of a Recorder.
+type recordedConn struct {
+	r    *Recorder
+	conn *Conn
+	next common.Executor
+}
+
+// inject records query and injects its fault: the statement is not sent if
+// the error or the result returned is not nil.
+func (c *recordedConn) inject(query string) (*sqltypes.Result, error) {
+	f := c.r.before(c, query)
+	if f == nil {
+		return nil, c.closed()
+	}
+	time.Sleep(f.Delay)
+	if f.Close {
+		c.Close()
+	}
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if err := c.closed(); err != nil {
+		return nil, err
+	}
+	return f.Result, nil
+}
+
+// closed returns errClosed once a connection without a server is closed, a
+// server connection returns its own error.
+func (c *recordedConn) closed() error {
+	c.r.mu.Lock()
+	defer c.r.mu.Unlock()
+	if c.next == nil && c.conn.Closed {
+		return errClosed
+	}
+	return nil
+}
+
+func (c *recordedConn) Execute(query string) error {
+	if qr, err := c.inject(query); err != nil || qr != nil {
+		return err
+	}
+	if c.next == nil {
+		return nil
+	}
+	return c.next.Execute(query)
+}
+
+func (c *recordedConn) Fetch(query string) (*sqltypes.Result, error) {
+	if qr, err := c.inject(query); err != nil || qr != nil {
+		return qr, err
+	}
+	if c.next == nil {
+		c.r.mu.Lock()
+		defer c.r.mu.Unlock()
+		if qr, ok := c.r.results[query]; ok {
+			return qr, nil
+		}
+		return &sqltypes.Result{}, nil
+	}
+	return c.next.Fetch(query)
+}
+
+func (c *recordedConn) Ping() error {
+	if err := c.closed(); err != nil || c.next == nil {
+		return err
+	}
+	return c.next.Ping()
+}
+
+func (c *recordedConn) Close() error {
+	c.r.mu.Lock()
+	c.conn.Closed = true
+	c.r.mu.Unlock()
+	if c.next == nil {
+		return nil
+	}
+	return c.next.Close()
+}
@@ -0,0 +1,150 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package testutil
+
+import (
+	"common"
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecorderFaults(t *testing.T) {
+	r := NewRecorder(nil)
+	r.Inject(Fault{Prefix: "insert", Nth: 2, Err: ErrDeadlock})
+	r.Inject(Fault{Conns: []int{1}, Prefix: "commit", Err: ErrGoneAway, Close: true})
+	r.Inject(Fault{Conns: []int{0}, Prefix: "SELECT 1", Delay: 20 * time.Millisecond})
+	r.Inject(Fault{Prefix: "SELECT @@read_only", Nth: 1, Result: stringsResult("1")})
+	r.Result("SELECT 1", &sqltypes.Result{RowsAffected: 1})
+	c0, err := r.Executor(0)
+	assert.Nil(t, err)
+	c1, err := r.Executor(1)
+	assert.Nil(t, err)
+
+	// The second insert over the connections.
+	assert.Nil(t, c0.Execute("INSERT INTO `t1` VALUES (1)"))
+	assert.Equal(t, ErrDeadlock, c1.Execute("insert into `t1` values (2)"))
+	assert.Nil(t, c0.Execute("INSERT INTO `t1` VALUES (3)"))
+
+	// Only on its connection, which is closed.
+	assert.Nil(t, c0.Execute("COMMIT"))
+	assert.Equal(t, ErrGoneAway, c1.Execute("COMMIT"))
+	assert.Equal(t, errClosed, c1.Execute("INSERT INTO `t1` VALUES (4)"))
+	assert.Equal(t, errClosed, c1.Ping())
+
+	// A slow response, with the result set.
+	start := time.Now()
+	qr, err := c0.Fetch("SELECT 1")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), qr.RowsAffected)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	qr, err = c1.Fetch("SELECT 2")
+	assert.Equal(t, errClosed, err)
+
+	// A result once, then the one set or an empty one.
+	qr, err = c0.Fetch("SELECT @@read_only")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", qr.Rows[0][0].String())
+	qr, err = c0.Fetch("SELECT @@read_only")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(qr.Rows))
+
+	// A reconnect is another connection of the id.
+	c1, err = r.Executor(1)
+	assert.Nil(t, err)
+	assert.Nil(t, c1.Execute("INSERT INTO `t1` VALUES (4)"))
+	conns := r.Conns()
+	assert.Equal(t, 3, len(conns))
+	assert.True(t, conns[1].Closed)
+	assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1)", "INSERT INTO `t1` VALUES (3)", "COMMIT", "SELECT 1", "SELECT @@read_only", "SELECT @@read_only"}, r.Statements(0))
+	assert.Equal(t, []string{"insert into `t1` values (2)", "COMMIT", "INSERT INTO `t1` VALUES (4)", "SELECT 2", "INSERT INTO `t1` VALUES (4)"}, r.Statements(1))
+}
+
+// stringsResult returns a row of VARCHAR values.
+func stringsResult(values ...string) *sqltypes.Result {
+	r := &sqltypes.Result{}
+	var row []sqltypes.Value
+	for i, v := range values {
+		r.Fields = append(r.Fields, &querypb.Field{Name: fmt.Sprintf("c%d", i), Type: querypb.Type_VARCHAR})
+		row = append(row, sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(v)))
+	}
+	r.Rows = append(r.Rows, row)
+	return r
+}
+
+func TestRecorderLoader(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	dump, err := WriteDump("/tmp/testutilrecorder", DumpShape{Tables: 2, Chunks: 2, Rows: 3, RowsPerStatement: 2})
+	assert.Nil(t, err)
+	args := common.LoadArgs{Outdir: dump.Dir, User: User, Password: Password, Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+	want := []string{
+		"CREATE DATABASE IF NOT EXISTS `db1`;\n",
+		"use `db1`",
+		"CREATE TABLE `t1` (\n  `id` bigint NOT NULL,\n  `v` varchar(64) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB",
+		"CREATE TABLE `t2` (\n  `id` bigint NOT NULL,\n  `v` varchar(64) NOT NULL,\n  PRIMARY KEY (`id`)\n) ENGINE=InnoDB",
+	}
+	files := []string{"db1.t1.00001.sql", "db1.t1.00002.sql", "db1.t2.00001.sql", "db1.t2.00002.sql"}
+	// The schemas in order, then the files in any order.
+	restored := func(statements []string, schemas []string) {
+		assert.Equal(t, schemas, statements[:len(schemas)])
+		order, err := dump.FileOrder(statements[len(schemas):])
+		assert.Nil(t, err)
+		sort.Strings(order)
+		assert.Equal(t, files, order)
+	}
+
+	// The statements of the thread.
+	{
+		r := NewRecorder(nil)
+		report, err := common.NewLoader(common.LoadConfig{LoadArgs: args, Log: log, Executor: r.Executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, common.RunOK, report.Status)
+		assert.Equal(t, uint64(4), report.FilesDone)
+		restored(r.Statements(0), want)
+	}
+
+	// A deadlock of a CREATE TABLE is retried.
+	{
+		r := NewRecorder(nil)
+		r.Inject(Fault{Prefix: "CREATE TABLE `t2`", Nth: 1, Err: ErrDeadlock})
+		report, err := common.NewLoader(common.LoadConfig{LoadArgs: args, Log: log, Executor: r.Executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, common.RunOK, report.Status)
+		assert.Equal(t, []string{ErrDeadlock.Error()}, report.Errors)
+		restored(r.Statements(0), append(want, want[3]))
+	}
+
+	// A server gone away in the middle of a file: the thread reconnects once
+	// the server is writable, back in its database, and the statement is
+	// executed again.
+	{
+		r := NewRecorder(nil)
+		r.Inject(Fault{Prefix: "INSERT INTO `t2` VALUES (3,", Nth: 1, Err: ErrGoneAway, Close: true})
+		r.Result("SELECT @@global.super_read_only, @@global.read_only", stringsResult("0", "0"))
+		report, err := common.NewLoader(common.LoadConfig{LoadArgs: args, Log: log, Executor: r.Executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, common.RunOK, report.Status)
+		conns := r.Conns()
+		assert.Equal(t, 2, len(conns))
+		assert.True(t, conns[0].Closed)
+		gone := conns[0].Statements[len(conns[0].Statements)-1]
+		assert.Equal(t, "INSERT INTO `t2` VALUES (3,'db1.t2-3')", gone)
+		assert.Equal(t, []string{"SELECT @@global.super_read_only, @@global.read_only", "use `db1`", gone}, conns[1].Statements[:3])
+		// The restore without the statement which failed and the reconnect.
+		restored(append(conns[0].Statements[:len(conns[0].Statements)-1], conns[1].Statements[2:]...), want)
+	}
+}
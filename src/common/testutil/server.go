@@ -0,0 +1,112 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+// Package testutil is the harness of the tests of the runs without a MySQL:
+// a mock server, a Recorder of the statements of every connection which
+// injects errors and delays, and the dumps of WriteDump.
+package testutil
+
+import (
+	"common"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The user and the password of the mock server, it takes any.
+const (
+	User     = "mock"
+	Password = "mock"
+)
+
+// writePatterns are the statements AcceptWrites answers, lower case as the
+// mock server matches them.
+var writePatterns = []string{
+	"use .*", "set .*", "create .*", "drop .*", "alter .*", "truncate .*",
+	"insert .*", "replace .*", "update .*", "delete .*", "load data .*",
+	"begin", "start transaction.*", "commit", "rollback",
+	"lock tables .*", "unlock tables", "analyze table .*", "optimize table .*",
+}
+
+// Server is a mock MySQL server the connections of a run dial through the
+// protocol layer of go-mysqlstack, recorded and faulted by its Recorder: set
+// the Executor of the LoadConfig to server.Executor. Handler scripts the
+// results, the queries it doesn't know fail.
+type Server struct {
+	*Recorder
+	// Handler scripts the server, the queries are matched lower case, see
+	// driver.TestHandler.
+	Handler  *driver.TestHandler
+	listener *driver.Listener
+}
+
+// NewServer starts a mock server on a free port of localhost.
+func NewServer(log *xlog.Log) (*Server, error) {
+	handler := driver.NewTestHandler(log)
+	listener, err := driver.MockMysqlServer(log, handler)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Handler: handler, listener: listener}
+	s.Recorder = NewRecorder(s.dial)
+	return s, nil
+}
+
+// Addr returns the address of the server, for the LoadArgs.Address.
+func (s *Server) Addr() string {
+	return s.listener.Addr()
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.listener.Close()
+}
+
+// AcceptWrites answers the statements which return no rows with an empty
+// result: the schemas, the datas, the transactions and the session
+// variables of a restore. The patterns added before take precedence.
+func (s *Server) AcceptWrites() {
+	for _, p := range writePatterns {
+		s.Handler.AddQueryPattern(p, &sqltypes.Result{})
+	}
+}
+
+// dial connects to the server, the executor of the connection id.
+func (s *Server) dial(id int) (common.Executor, error) {
+	client, err := driver.NewConn(User, Password, s.Addr(), "", "utf8")
+	if err != nil {
+		return nil, err
+	}
+	return &clientExecutor{client: client}, nil
+}
+
+// clientExecutor runs the statements on a connection of the driver.
+type clientExecutor struct {
+	client driver.Conn
+}
+
+func (c *clientExecutor) Execute(query string) error {
+	return c.client.Exec(query)
+}
+
+func (c *clientExecutor) Fetch(query string) (*sqltypes.Result, error) {
+	return c.client.FetchAll(query, -1)
+}
+
+func (c *clientExecutor) Ping() error {
+	return c.client.Ping()
+}
+
+func (c *clientExecutor) Close() error {
+	if c.client.Closed() {
+		return nil
+	}
+	return c.client.Close()
+}
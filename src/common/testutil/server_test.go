@@ -0,0 +1,101 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package testutil
+
+import (
+	"common"
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerLoader(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	server, err := NewServer(log)
+	assert.Nil(t, err)
+	defer server.Close()
+	server.AcceptWrites()
+
+	dump, err := WriteDump("/tmp/testutilserver", DumpShape{Databases: 2, Tables: 3, Chunks: 2, Rows: 10, RowsPerStatement: 4})
+	assert.Nil(t, err)
+	args := common.LoadArgs{
+		Outdir:     dump.Dir,
+		User:       User,
+		Password:   Password,
+		Threads:    4,
+		Address:    server.Addr(),
+		IntervalMs: 500,
+	}
+
+	// Loader.
+	{
+		report, err := common.NewLoader(common.LoadConfig{LoadArgs: args, Log: log, Executor: server.Executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, common.RunOK, report.Status)
+		assert.Equal(t, uint64(12), report.FilesDone)
+	}
+
+	// Every data file restored once, its INSERTs in order on a thread.
+	{
+		var files []string
+		for _, c := range server.Conns() {
+			var inserts []string
+			for _, stmt := range c.Statements {
+				if strings.HasPrefix(stmt, "INSERT") {
+					inserts = append(inserts, stmt)
+				}
+			}
+			order, err := dump.FileOrder(inserts)
+			assert.Nil(t, err)
+			files = append(files, order...)
+		}
+		sort.Strings(files)
+		var want []string
+		for name := range dump.Inserts {
+			want = append(want, name)
+		}
+		sort.Strings(want)
+		assert.Equal(t, want, files)
+		assert.Equal(t, 1, server.Handler.GetQueryCalledNum("insert into `t1` values (1,'db1.t1-1'),(2,'db1.t1-2'),(3,'db1.t1-3'),(4,'db1.t1-4')"))
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	server, err := NewServer(log)
+	assert.Nil(t, err)
+	defer server.Close()
+	server.AcceptWrites()
+	server.Handler.AddQuery("select @@global.super_read_only, @@global.read_only", stringsResult("0", "0"))
+
+	dump, err := WriteDump("/tmp/testutilreadonly", DumpShape{Rows: 3, RowsPerStatement: 1})
+	assert.Nil(t, err)
+	args := common.LoadArgs{Outdir: dump.Dir, User: User, Password: Password, Threads: 1, Address: server.Addr(), IntervalMs: 500}
+
+	// The target flipped read-only under the CREATE TABLE, then writable at
+	// the next check.
+	server.Inject(Fault{Prefix: "CREATE TABLE", Nth: 1, Err: ErrReadOnly})
+	server.Inject(Fault{Prefix: "SELECT @@global.super_read_only", Nth: 1, Result: stringsResult("1", "1")})
+	report, err := common.NewLoader(common.LoadConfig{LoadArgs: args, Log: log, Executor: server.Executor}).Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, common.RunOK, report.Status)
+	var creates int
+	for _, stmt := range server.Statements(0) {
+		if strings.HasPrefix(stmt, "CREATE TABLE") {
+			creates++
+		}
+	}
+	assert.Equal(t, 2, creates)
+	assert.Equal(t, 1, server.Handler.GetQueryCalledNum("insert into `t1` values (3,'db1.t1-3')"))
+}
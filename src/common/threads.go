@@ -0,0 +1,170 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// threadUsage is where the time of one worker thread (a connection of the
+// pool) goes during the data phase: busy on a table or file, or idle waiting
+// for one. The idle time at the end is the straggler tail.
+type threadUsage struct {
+	busy        time.Duration
+	idle        time.Duration
+	longestIdle time.Duration
+	bytes       uint64
+	// busySince is zero while the thread is idle, idleSince while it's busy.
+	busySince time.Time
+	idleSince time.Time
+}
+
+// ThreadUtilization is the usage of one worker thread, in the summary and in /status.
+type ThreadUtilization struct {
+	Thread             int     `json:"thread"`
+	BusySeconds        float64 `json:"busy_seconds"`
+	IdleSeconds        float64 `json:"idle_seconds"`
+	LongestIdleSeconds float64 `json:"longest_idle_seconds"`
+	Bytes              uint64  `json:"bytes"`
+	Percent            float64 `json:"utilization_percent"`
+}
+
+// threadsStarted starts the accounting of the n threads of the pool, all idle,
+// at the start of the data phase.
+func (m *Metrics) threadsStarted(n int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	for i := 0; i < n; i++ {
+		m.threads[i] = &threadUsage{idleSince: now}
+	}
+}
+
+// threadsDone stops the accounting at the end of the data phase.
+func (m *Metrics) threadsDone() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.threadsEnd = m.now()
+}
+
+// threadBusy marks thread busy, called with m.mu held.
+func (m *Metrics) threadBusy(thread int, now time.Time) {
+	u, ok := m.threads[thread]
+	if !ok {
+		u = &threadUsage{idleSince: now}
+		m.threads[thread] = u
+	}
+	if !u.busySince.IsZero() {
+		// Already busy, like the next file of a batch.
+		return
+	}
+	gap := now.Sub(u.idleSince)
+	u.idle += gap
+	if gap > u.longestIdle {
+		u.longestIdle = gap
+	}
+	u.busySince = now
+	u.idleSince = time.Time{}
+}
+
+// threadIdle marks thread idle, called with m.mu held.
+func (m *Metrics) threadIdle(thread int, now time.Time) {
+	u, ok := m.threads[thread]
+	if !ok || u.busySince.IsZero() {
+		return
+	}
+	u.busy += now.Sub(u.busySince)
+	u.busySince = time.Time{}
+	u.idleSince = now
+}
+
+// threadBytes adds the bytes a thread executed or wrote.
+func (m *Metrics) threadBytes(thread int, n uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if u, ok := m.threads[thread]; ok {
+		u.bytes += n
+	}
+}
+
+// threadUtilization returns the usage of every thread so far, or up to
+// threadsDone, sorted by thread.
+func (m *Metrics) threadUtilization() []ThreadUtilization {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if !m.threadsEnd.IsZero() {
+		now = m.threadsEnd
+	}
+
+	var threads []ThreadUtilization
+	for thread, u := range m.threads {
+		busy, idle, longest := u.busy, u.idle, u.longestIdle
+		if !u.busySince.IsZero() {
+			busy += now.Sub(u.busySince)
+		} else {
+			gap := now.Sub(u.idleSince)
+			idle += gap
+			if gap > longest {
+				longest = gap
+			}
+		}
+		t := ThreadUtilization{
+			Thread:             thread,
+			BusySeconds:        busy.Seconds(),
+			IdleSeconds:        idle.Seconds(),
+			LongestIdleSeconds: longest.Seconds(),
+			Bytes:              u.bytes,
+		}
+		if busy+idle > 0 {
+			t.Percent = 100 * float64(busy) / float64(busy+idle)
+		}
+		threads = append(threads, t)
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i].Thread < threads[j].Thread })
+	return threads
+}
+
+// logThreadSummary logs the utilization of the threads after the summary line
+// of the run, like 'dumping.threads.utilization[0:97.1%/1200.50MB,1:54.0%/300.25MB].longest.idle[1:12.30sec]'.
+func logThreadSummary(log *xlog.Log, action string, threads []ThreadUtilization) {
+	if len(threads) == 0 {
+		return
+	}
+	buf := &bytes.Buffer{}
+	longest := threads[0]
+	for i, t := range threads {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%d:%.1f%%/%.2fMB", t.Thread, t.Percent, float64(t.Bytes)/1024/1024)
+		if t.LongestIdleSeconds > longest.LongestIdleSeconds {
+			longest = t
+		}
+	}
+	logSummary(log, "%s.threads.utilization[%s].longest.idle[%d:%.2fsec]", action, buf.String(), longest.Thread, longest.LongestIdleSeconds)
+}
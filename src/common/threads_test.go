@@ -0,0 +1,79 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreadsUtilization(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	var allbytes uint64
+	m := newMetrics(log, "load", &Pool{}, &allbytes, nil)
+	clock := time.Unix(1500000000, 0)
+	m.now = func() time.Time { return clock }
+	tick := func(sec int) { clock = clock.Add(time.Duration(sec) * time.Second) }
+
+	m.threadsStarted(3)
+	// Thread 0 works all along on 2 files, thread 1 waits 2s for its file and
+	// is done at 4s, thread 2 never gets one.
+	m.startWork(0, "test.t1", "/tmp/test.t1.00001.sql")
+	tick(2)
+	m.startWork(1, "test.t2", "/tmp/test.t2.00001.sql")
+	tick(2)
+	m.endWork(1)
+	m.threadBytes(1, 1024*1024)
+	m.endWork(0)
+	m.threadBytes(0, 2*1024*1024)
+	m.startWork(0, "test.t1", "/tmp/test.t1.00002.sql")
+	// Already busy, a batch.
+	m.startWork(0, "test.t1", "/tmp/test.t1.00003.sql")
+	tick(6)
+
+	// Thread 0 is still busy.
+	{
+		threads := m.threadUtilization()
+		assert.Equal(t, 3, len(threads))
+		assert.Equal(t, ThreadUtilization{Thread: 0, BusySeconds: 10, Bytes: 2 * 1024 * 1024, Percent: 100}, threads[0])
+		assert.Equal(t, ThreadUtilization{Thread: 1, BusySeconds: 2, IdleSeconds: 8, LongestIdleSeconds: 6, Bytes: 1024 * 1024, Percent: 20}, threads[1])
+		assert.Equal(t, ThreadUtilization{Thread: 2, IdleSeconds: 10, LongestIdleSeconds: 10, Percent: 0}, threads[2])
+	}
+
+	m.endWork(0)
+	m.threadsDone()
+	tick(100)
+	{
+		threads := m.threadUtilization()
+		assert.Equal(t, 10.0, threads[0].BusySeconds)
+		assert.Equal(t, 10.0, threads[2].IdleSeconds)
+		assert.Equal(t, threads, m.snapshot().Threads)
+
+		out := &bytes.Buffer{}
+		log, err := NewLog(out, "error", "text")
+		assert.Nil(t, err)
+		logThreadSummary(log, "restoring", threads)
+		want := "restoring.threads.utilization[0:100.0%/2.00MB,1:20.0%/1.00MB,2:0.0%/0.00MB].longest.idle[2:10.00sec]"
+		assert.True(t, strings.Contains(out.String(), want), out.String())
+	}
+
+	// A nil *Metrics is a no-op.
+	{
+		var m *Metrics
+		m.threadsStarted(1)
+		m.threadBytes(0, 1)
+		assert.Nil(t, m.threadUtilization())
+	}
+}
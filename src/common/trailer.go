@@ -0,0 +1,82 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// fileTrailerPrefix starts the last line of a data file of
+// DumpArgs.FileTrailers.
+const fileTrailerPrefix = "-- chunk completed: "
+
+// fileHeader returns the header comment of the data file chunk of table,
+// whose first row was read at started.
+func fileHeader(args *DumpArgs, table string, chunk string, started time.Time) string {
+	snapshot := "none"
+	if p := args.snapshot; p != nil {
+		snapshot = p.Mode
+		if p.GTIDSet != "" {
+			snapshot += ", gtid_set " + p.GTIDSet
+		}
+		if p.BinlogFile != "" {
+			snapshot += fmt.Sprintf(", binlog %s:%d", p.BinlogFile, p.BinlogPosition)
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- go-mydumper %s, table `%s`.`%s`, chunk %s\n", Version, args.Database, table, chunk)
+	fmt.Fprintf(&b, "-- snapshot: %s\n", snapshot)
+	fmt.Fprintf(&b, "-- started at: %s\n", started.UTC().Format(time.RFC3339))
+	return b.String()
+}
+
+// fileTrailer returns the trailer line of a data file of rows rows whose
+// bytes before it are body.
+func fileTrailer(body []byte, rows uint64) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf("%s%d rows, %d bytes, sha256=%s\n", fileTrailerPrefix, rows, len(body), hex.EncodeToString(sum[:]))
+}
+
+// splitFileTrailer splits a data file into its body and its trailer line,
+// without the newline. The trailer is empty if the last line isn't one.
+func splitFileTrailer(data string) (string, string) {
+	end := strings.TrimSuffix(data, "\n")
+	i := strings.LastIndexByte(end, '\n') + 1
+	if !strings.HasPrefix(end[i:], fileTrailerPrefix) {
+		return data, ""
+	}
+	return data[:i], end[i:]
+}
+
+// verifyFileTrailer checks the data file name against its trailer, see
+// LoadArgs.VerifyFileTrailers: a file without one, or whose body is not the
+// one the trailer was written for, is an error.
+func verifyFileTrailer(name string, data string) error {
+	body, trailer := splitFileTrailer(data)
+	if trailer == "" {
+		return fmt.Errorf("restoring.file[%s].has.no.trailer:the.file.is.truncated.or.was.dumped.without.-file-trailers", name)
+	}
+	var rows, size uint64
+	var sum string
+	if _, err := fmt.Sscanf(strings.TrimPrefix(trailer, fileTrailerPrefix), "%d rows, %d bytes, sha256=%s", &rows, &size, &sum); err != nil {
+		return fmt.Errorf("restoring.file[%s].trailer[%s].malformed:%v", name, trailer, err)
+	}
+	if uint64(len(body)) != size {
+		return fmt.Errorf("restoring.file[%s].has[%d].bytes.the.trailer.recorded[%d]", name, len(body), size)
+	}
+	if got := sha256.Sum256([]byte(body)); hex.EncodeToString(got[:]) != sum {
+		return fmt.Errorf("restoring.file[%s].sha256[%x].the.trailer.recorded[%s]", name, got, sum)
+	}
+	return nil
+}
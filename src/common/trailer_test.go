@@ -0,0 +1,118 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileTrailer(t *testing.T) {
+	args := &DumpArgs{Database: "test", snapshot: &ConsistentPoint{Mode: ConsistencyLock, BinlogFile: "bin.000003", BinlogPosition: 154, GTIDSet: "uuid:1-9"}}
+	started := time.Date(2026, 10, 15, 8, 30, 0, 0, time.UTC)
+	header := fileHeader(args, "t1", "00002", started)
+	assert.Equal(t, "-- go-mydumper "+Version+", table `test`.`t1`, chunk 00002\n"+
+		"-- snapshot: lock, gtid_set uuid:1-9, binlog bin.000003:154\n"+
+		"-- started at: 2026-10-15T08:30:00Z\n", header)
+	body := header + "INSERT INTO `t1`(`a`) VALUES\n(1),\n(2);\n"
+	data := body + fileTrailer([]byte(body), 2)
+	assert.Equal(t, fmt.Sprintf("%s-- chunk completed: 2 rows, %d bytes, sha256=%x\n", body, len(body), sha256.Sum256([]byte(body))), data)
+
+	// The splitter drops the header, the loader the trailer.
+	gotBody, trailer := splitFileTrailer(data)
+	assert.Equal(t, body, gotBody)
+	assert.True(t, strings.HasPrefix(trailer, fileTrailerPrefix))
+	stmts := splitStatements(gotBody)
+	assert.Equal(t, 1, len(stmts))
+	assert.Equal(t, "INSERT INTO `t1`(`a`) VALUES\n(1),\n(2)", stmts[0].sql)
+	assert.Nil(t, verifyFileTrailer("test.t1.00002.sql", data))
+
+	// Without a snapshot.
+	assert.Contains(t, fileHeader(&DumpArgs{Database: "test"}, "t1", "00001", started), "-- snapshot: none\n")
+
+	// A file cut short, without a trailer, or changed.
+	gotBody, trailer = splitFileTrailer(body)
+	assert.Equal(t, body, gotBody)
+	assert.Equal(t, "", trailer)
+	err := verifyFileTrailer("test.t1.00002.sql", body[:len(body)-10])
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "restoring.file[test.t1.00002.sql].has.no.trailer")
+	err = verifyFileTrailer("test.t1.00002.sql", strings.Replace(data, "(2)", "(3)", 1))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "restoring.file[test.t1.00002.sql].sha256[")
+	err = verifyFileTrailer("test.t1.00002.sql", strings.Replace(data, "(2)", "(22)", 1))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "bytes.the.trailer.recorded")
+}
+
+func TestLoaderVerifyFileTrailers(t *testing.T) {
+	dir := "/tmp/loaderfiletrailers"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	args := &DumpArgs{Database: "test"}
+	body := fileHeader(args, "t1", "00001", time.Now()) + "INSERT INTO `t1` VALUES (1);\n"
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      body + fileTrailer([]byte(body), 1),
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+	load := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, VerifyFileTrailers: true}
+
+	// The comments are not executed.
+	{
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: load, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		assert.Equal(t, []string{"INSERT INTO `t1` VALUES (1)"}, matchingQueries(rec.queries, "INSERT"))
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "--")))
+	}
+
+	// A file without its trailer fails before any statement.
+	{
+		x := WriteFile(dir+"/test.t1.00001.sql", body)
+		AssertNil(x)
+		rec := &recordingExecutor{}
+		_, err := NewLoader(LoadConfig{LoadArgs: load, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, 0, len(matchingQueries(rec.queries, "INSERT")))
+
+		// Restored as it is without the check.
+		load.VerifyFileTrailers = false
+		rec = &recordingExecutor{}
+		_, err = NewLoader(LoadConfig{LoadArgs: load, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(matchingQueries(rec.queries, "INSERT")))
+	}
+}
+
+// matchingQueries returns the queries with the prefix, in their order.
+func matchingQueries(queries []string, prefix string) []string {
+	var found []string
+	for _, query := range queries {
+		if strings.HasPrefix(query, prefix) {
+			found = append(found, query)
+		}
+	}
+	return found
+}
@@ -0,0 +1,181 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The values of LoadArgs.TuneTarget.
+const (
+	// TuneTargetOn sets the tunedVariables for the restore.
+	TuneTargetOn = "on"
+	// TuneTargetDryRun logs what TuneTargetOn would set, and sets nothing.
+	TuneTargetDryRun = "dry-run"
+)
+
+// erSpecificAccessDenied is the error of a SET GLOBAL without the
+// SYSTEM_VARIABLES_ADMIN or SUPER privilege.
+const erSpecificAccessDenied = 1227
+
+// tunedVariable is a global variable of the target TuneTarget sets for the
+// restore: value returns the faster value for the current one, or the
+// current one if it's fast already.
+type tunedVariable struct {
+	name  string
+	value func(current string) string
+}
+
+// tunedVariables are the variables TuneTarget sets, the ones whose faster
+// value only risks what a crash of the target loses, and the restore is run
+// again after a crash anyway.
+var tunedVariables = []tunedVariable{
+	// The redo log is flushed once a second instead of at every commit.
+	{"innodb_flush_log_at_trx_commit", func(v string) string {
+		if v == "1" {
+			return "2"
+		}
+		return v
+	}},
+	// The binary log is synced by the OS instead of at every commit.
+	{"sync_binlog", func(string) string { return "0" }},
+	// The buffer pool holds more dirty pages before it flushes them.
+	{"innodb_max_dirty_pages_pct", func(v string) string {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f < 90 {
+			return "90"
+		}
+		return v
+	}},
+}
+
+// tunedChange is a variable set by TuneTarget, from its original value.
+type tunedChange struct {
+	name string
+	from string
+	to   string
+}
+
+// globalVariables returns the values of the global variables names of the
+// server of conn by name, the unknown ones are left out.
+func globalVariables(conn *Connection, names []string) (map[string]string, error) {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, "'"+name+"'")
+	}
+	qr, err := conn.Fetch(fmt.Sprintf("SHOW GLOBAL VARIABLES WHERE Variable_name IN (%s)", strings.Join(quoted, ",")))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, row := range qr.Rows {
+		if len(row) >= 2 {
+			values[strings.ToLower(row[0].String())] = row[1].String()
+		}
+	}
+	return values, nil
+}
+
+// tuneChanges returns the tunedVariables whose value differs from the
+// current one in values.
+func tuneChanges(values map[string]string) []tunedChange {
+	var changes []tunedChange
+	for _, v := range tunedVariables {
+		current, ok := values[v.name]
+		if !ok {
+			continue
+		}
+		if to := v.value(current); to != current {
+			changes = append(changes, tunedChange{name: v.name, from: current, to: to})
+		}
+	}
+	return changes
+}
+
+// tuneTarget sets the tunedVariables on the target of args for the restore,
+// see LoadArgs.TuneTarget, and returns the func which sets them back: it must
+// be called once the restore is done, failed or cancelled. It runs on a
+// connection of its own, the pool of the restore is closed once its context
+// is done. A target it can't tune, like without the privilege, is restored
+// untuned with a warning.
+func tuneTarget(log *xlog.Log, args *LoadArgs) func() {
+	none := func() {}
+	if args.TuneTarget == "" {
+		return none
+	}
+	pool, err := newLoadPool(log, args, 1)
+	if err != nil {
+		log.Warning("restoring.tune.target.not.tuned:%v", err)
+		return none
+	}
+	conn := pool.Get()
+	closePool := func() {
+		pool.Put(conn)
+		pool.Close()
+	}
+	names := make([]string, 0, len(tunedVariables))
+	for _, v := range tunedVariables {
+		names = append(names, v.name)
+	}
+	values, err := globalVariables(conn, names)
+	if err != nil {
+		log.Warning("restoring.tune.target.variables.error.not.tuned:%v", err)
+		closePool()
+		return none
+	}
+	changes := tuneChanges(values)
+	if len(changes) == 0 {
+		log.Info("restoring.tune.target.nothing.to.change[%s]", strings.Join(names, ","))
+		closePool()
+		return none
+	}
+	if args.TuneTarget == TuneTargetDryRun {
+		for _, c := range changes {
+			log.Warning("restoring.tune.target.dry.run.would.set[%s].from[%s].to[%s]", c.name, c.from, c.to)
+		}
+		closePool()
+		return none
+	}
+
+	// The restore may be killed before it sets them back.
+	reverts := make([]string, 0, len(changes))
+	for _, c := range changes {
+		reverts = append(reverts, fmt.Sprintf("%s=%s", c.name, c.from))
+	}
+	log.Warning("restoring.tune.target.if.the.restore.is.killed.revert.by.hand:SET GLOBAL %s", strings.Join(reverts, ", "))
+	var set []tunedChange
+	for _, c := range changes {
+		err := conn.Execute(fmt.Sprintf("SET GLOBAL %s=%s", c.name, c.to))
+		if ErrorCategoryOf(err) == CategoryPrivilege {
+			log.Warning("restoring.tune.target.no.privilege.not.tuned, it needs SYSTEM_VARIABLES_ADMIN or SUPER:%v", err)
+			break
+		}
+		if err != nil {
+			log.Warning("restoring.tune.target.set[%s].to[%s].error:%v", c.name, c.to, err)
+			continue
+		}
+		log.Warning("restoring.tune.target.set[%s].from[%s].to[%s].for.the.restore", c.name, c.from, c.to)
+		set = append(set, c)
+	}
+	return func() {
+		defer closePool()
+		for i := len(set) - 1; i >= 0; i-- {
+			c := set[i]
+			if err := conn.Execute(fmt.Sprintf("SET GLOBAL %s=%s", c.name, c.from)); err != nil {
+				log.Error("restoring.tune.target.revert[%s].error, set it back by hand with 'SET GLOBAL %s=%s':%v", c.name, c.name, c.from, err)
+				continue
+			}
+			log.Warning("restoring.tune.target.reverted[%s].to[%s]", c.name, c.from)
+		}
+	}
+}
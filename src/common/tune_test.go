@@ -0,0 +1,138 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/sqldb"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+const tunedVariablesQuery = "SHOW GLOBAL VARIABLES WHERE Variable_name IN ('innodb_flush_log_at_trx_commit','sync_binlog','innodb_max_dirty_pages_pct')"
+
+// variablesResult is the result of SHOW GLOBAL VARIABLES with the values of
+// the name=value pairs.
+func variablesResult(pairs ...string) *sqltypes.Result {
+	r := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{Name: "Variable_name", Type: querypb.Type_VARCHAR},
+			{Name: "Value", Type: querypb.Type_VARCHAR},
+		},
+	}
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		r.Rows = append(r.Rows, []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(kv[0])),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(kv[1])),
+		})
+	}
+	return r
+}
+
+func TestTuneChanges(t *testing.T) {
+	changes := tuneChanges(map[string]string{"innodb_flush_log_at_trx_commit": "1", "sync_binlog": "1", "innodb_max_dirty_pages_pct": "75.000000"})
+	want := []tunedChange{
+		{"innodb_flush_log_at_trx_commit", "1", "2"},
+		{"sync_binlog", "1", "0"},
+		{"innodb_max_dirty_pages_pct", "75.000000", "90"},
+	}
+	assert.Equal(t, want, changes)
+
+	// The fast values and the unknown variables are left as they are.
+	assert.Nil(t, tuneChanges(map[string]string{"innodb_flush_log_at_trx_commit": "0", "sync_binlog": "0", "innodb_max_dirty_pages_pct": "90.000000"}))
+	assert.Nil(t, tuneChanges(nil))
+}
+
+func TestTuneTarget(t *testing.T) {
+	variables := variablesResult("innodb_flush_log_at_trx_commit=1", "innodb_max_dirty_pages_pct=90.000000", "sync_binlog=1")
+	args := &LoadArgs{User: "mock", Password: "mock", Address: "127.0.0.1:3306", TuneTarget: TuneTargetOn}
+
+	// The variables are set for the restore and set back in reverse.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{tunedVariablesQuery: variables}}
+		args := *args
+		args.executor = rec.executor
+		revert := tuneTarget(log, &args)
+		assert.Equal(t, []string{tunedVariablesQuery, "SET GLOBAL innodb_flush_log_at_trx_commit=2", "SET GLOBAL sync_binlog=0"}, rec.queries)
+		assert.True(t, strings.Contains(buf.String(), "restoring.tune.target.if.the.restore.is.killed.revert.by.hand:SET GLOBAL innodb_flush_log_at_trx_commit=1, sync_binlog=1"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.tune.target.set[sync_binlog].from[1].to[0].for.the.restore"), buf.String())
+		revert()
+		assert.Equal(t, []string{"SET GLOBAL sync_binlog=1", "SET GLOBAL innodb_flush_log_at_trx_commit=1"}, rec.queries[3:])
+		assert.True(t, strings.Contains(buf.String(), "restoring.tune.target.reverted[innodb_flush_log_at_trx_commit].to[1]"), buf.String())
+		assert.Equal(t, 1, rec.closed)
+	}
+
+	// The dry run changes nothing.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{tunedVariablesQuery: variables}}
+		args := *args
+		args.TuneTarget = TuneTargetDryRun
+		args.executor = rec.executor
+		tuneTarget(log, &args)()
+		assert.Equal(t, []string{tunedVariablesQuery}, rec.queries)
+		assert.True(t, strings.Contains(buf.String(), "restoring.tune.target.dry.run.would.set[innodb_flush_log_at_trx_commit].from[1].to[2]"), buf.String())
+	}
+
+	// Without the privilege the target is left untuned, with a warning.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		denied := sqldb.NewSQLError(erSpecificAccessDenied, "Access denied; you need (at least one of) the SUPER or SYSTEM_VARIABLES_ADMIN privilege(s) for this operation")
+		rec := &recordingExecutor{
+			results: map[string]*sqltypes.Result{tunedVariablesQuery: variables},
+			errs:    map[string]error{"SET GLOBAL innodb_flush_log_at_trx_commit=2": denied},
+		}
+		args := *args
+		args.executor = rec.executor
+		tuneTarget(log, &args)()
+		assert.Equal(t, []string{tunedVariablesQuery, "SET GLOBAL innodb_flush_log_at_trx_commit=2"}, rec.queries)
+		assert.True(t, strings.Contains(buf.String(), "restoring.tune.target.no.privilege.not.tuned"), buf.String())
+	}
+}
+
+func TestLoaderTuneTarget(t *testing.T) {
+	dir := "/tmp/loadertune"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1);\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+
+	// The restore runs tuned, the variables are set back once it failed.
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	rec := &recordingExecutor{
+		results: map[string]*sqltypes.Result{tunedVariablesQuery: variablesResult("sync_binlog=1")},
+		errs:    map[string]error{"INSERT INTO `t1` VALUES (1)": sqldb.NewSQLError(1062, "Duplicate entry '1' for key 'PRIMARY'")},
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500, TuneTarget: TuneTargetOn}
+	_, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+	assert.NotNil(t, err)
+	sets := matchingQueries(rec.queries, "SET GLOBAL")
+	assert.Equal(t, []string{"SET GLOBAL sync_binlog=0", "SET GLOBAL sync_binlog=1"}, sets)
+	assert.Equal(t, "SET GLOBAL sync_binlog=1", rec.queries[len(rec.queries)-1])
+}
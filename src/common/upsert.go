@@ -0,0 +1,174 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+var (
+	// primaryKeyRegexp matches a PRIMARY KEY index definition, with its columns.
+	primaryKeyRegexp = regexp.MustCompile("(?is)^(?:CONSTRAINT\\s+(?:`(?:[^`]|``)*`\\s+)?)?PRIMARY\\s+KEY\\b[^(]*\\((.*)\\)")
+	// inlinePrimaryKeyRegexp matches the PRIMARY KEY attribute of a column definition.
+	inlinePrimaryKeyRegexp = regexp.MustCompile(`(?i)\bPRIMARY\s+KEY\b`)
+	// generatedRegexp matches the attributes of a generated column, which can't be set.
+	generatedRegexp = regexp.MustCompile(`(?i)\bGENERATED\s+ALWAYS\b|\bAS\s*\(`)
+	// quotedNameRegexp matches a quoted identifier.
+	quotedNameRegexp = regexp.MustCompile("`(?:[^`]|``)*`")
+	// onDuplicateRegexp matches an ON DUPLICATE KEY UPDATE clause.
+	onDuplicateRegexp = regexp.MustCompile(`(?i)\bON\s+DUPLICATE\s+KEY\s+UPDATE\b`)
+)
+
+// upsertTable is a table restored with LoadArgs.Upsert, as read from the
+// create statement of its schema file.
+type upsertTable struct {
+	// columns are the quoted names of the columns, in their order, the columns
+	// of the INSERTs without a column list.
+	columns   []string
+	primary   map[string]bool
+	generated map[string]bool
+}
+
+// newUpsertTable reads the columns and the primary key of the create table
+// statement schema, ok is false if the table has no primary key.
+func newUpsertTable(schema string) (u *upsertTable, ok bool) {
+	u = &upsertTable{primary: make(map[string]bool), generated: make(map[string]bool)}
+	for _, def := range tableDefinitions(schema) {
+		if name, attrs, ok := columnDefinition(def); ok {
+			u.columns = append(u.columns, name)
+			if inlinePrimaryKeyRegexp.MatchString(attrs) {
+				u.primary[name] = true
+			}
+			if generatedRegexp.MatchString(attrs) {
+				u.generated[name] = true
+			}
+			continue
+		}
+		if match := primaryKeyRegexp.FindStringSubmatch(def); match != nil {
+			// A prefix length like `b`(10) is not a column.
+			for _, name := range quotedNameRegexp.FindAllString(match[1], -1) {
+				u.primary[name] = true
+			}
+		}
+	}
+	return u, len(u.primary) > 0
+}
+
+// rewrite turns the INSERT query into an upsert: its rows update the existing
+// rows with the same primary key, or unique key, instead of failing with a
+// duplicate key. The columns are the ones of its column list, else the ones of
+// the table. Any other statement, or an INSERT which already has an ON
+// DUPLICATE KEY UPDATE clause, is returned as it is.
+func (u *upsertTable) rewrite(query string) string {
+	if len(query) < 6 || !strings.EqualFold(query[:6], "INSERT") {
+		return query
+	}
+	i := valuesKeyword(query)
+	if i < 0 {
+		return query
+	}
+	if onDuplicateRegexp.MatchString(mapLiterals(query[i:], func(string) string { return "" })) {
+		return query
+	}
+	columns := insertColumns(query[:i])
+	if columns == nil {
+		columns = u.columns
+	}
+
+	var updates []string
+	for _, column := range columns {
+		if !u.primary[column] && !u.generated[column] {
+			updates = append(updates, column+"=VALUES("+column+")")
+		}
+	}
+	if len(updates) == 0 {
+		// Only key columns: the row is there, nothing to update.
+		for _, column := range columns {
+			if u.primary[column] {
+				updates = append(updates, column+"="+column)
+				break
+			}
+		}
+	}
+	if len(updates) == 0 {
+		return query
+	}
+	return strings.TrimRight(query, " \t\r\n") + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+}
+
+// insertColumns returns the quoted names of the column list of the head of an
+// INSERT, the part before VALUES, nil if it has none.
+func insertColumns(head string) []string {
+	open := -1
+	for i := 0; i < len(head) && open < 0; {
+		switch head[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(head, i)
+			continue
+		case '(':
+			open = i
+		}
+		i++
+	}
+	end := strings.LastIndexByte(head, ')')
+	if open < 0 || end < open {
+		return nil
+	}
+	list := head[open+1 : end]
+	if strings.Contains(list, "`") {
+		return quotedNameRegexp.FindAllString(list, -1)
+	}
+	var columns []string
+	for _, name := range strings.Split(list, ",") {
+		columns = append(columns, "`"+strings.TrimSpace(name)+"`")
+	}
+	return columns
+}
+
+// readUpsertTables reads the upsertTable of every table with data files from
+// its schema file, keyed by 'db.table'. A table without a primary key is left
+// out, its INSERTs stay plain ones, and a warning is logged; with keyless it's
+// kept, its rows update every column of the row of a unique key they match.
+func readUpsertTables(log *xlog.Log, storage Storage, schemas []string, tables []string, keyless bool) (map[string]*upsertTable, error) {
+	datas := make(map[string]bool)
+	for _, table := range tables {
+		db, tbl, _ := parseTableFile(table)
+		datas[db+"."+tbl] = true
+	}
+	upserts := make(map[string]*upsertTable)
+	for _, path := range schemas {
+		s, err := readSchemaFile(storage, path)
+		if err != nil {
+			return nil, err
+		}
+		name := s.db + "." + s.table
+		if !datas[name] {
+			continue
+		}
+		var create string
+		for _, stmt := range splitStatements(s.sql) {
+			if createTableRegexp.MatchString(stmt.sql) {
+				create = stmt.sql
+				break
+			}
+		}
+		u, ok := newUpsertTable(create)
+		if !ok && !keyless {
+			log.Warning("restoring.upsert.table[%s].has.no.primary.key,restored.with.plain.inserts", name)
+			continue
+		}
+		upserts[name] = u
+	}
+	log.Info("restoring.upsert.tables[%d/%d]", len(upserts), len(datas))
+	return upserts, nil
+}
@@ -0,0 +1,123 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpsertTable(t *testing.T) {
+	// Primary key index, with a prefix length.
+	{
+		u, ok := newUpsertTable("CREATE TABLE `t1` (\n" +
+			"  `id` int(11) NOT NULL,\n" +
+			"  `name` varchar(64) DEFAULT 'primary key',\n" +
+			"  `full` varchar(130) GENERATED ALWAYS AS (concat(`name`,'x')) VIRTUAL,\n" +
+			"  PRIMARY KEY (`id`,`name`(10)) USING BTREE,\n" +
+			"  KEY `idx` (`name`)\n" +
+			") ENGINE=InnoDB")
+		assert.True(t, ok)
+		assert.Equal(t, []string{"`id`", "`name`", "`full`"}, u.columns)
+		assert.Equal(t, map[string]bool{"`id`": true, "`name`": true}, u.primary)
+		assert.Equal(t, map[string]bool{"`full`": true}, u.generated)
+	}
+
+	// Inline primary key.
+	{
+		u, ok := newUpsertTable("CREATE TABLE `t1` (`id` int PRIMARY KEY, `a` int)")
+		assert.True(t, ok)
+		assert.Equal(t, map[string]bool{"`id`": true}, u.primary)
+	}
+
+	// No primary key, a COMMENT doesn't count.
+	{
+		_, ok := newUpsertTable("CREATE TABLE `t1` (`id` int COMMENT 'PRIMARY KEY', UNIQUE KEY `u` (`id`))")
+		assert.False(t, ok)
+	}
+}
+
+func TestUpsertRewrite(t *testing.T) {
+	u, ok := newUpsertTable("CREATE TABLE `t1` (`id` int, `a` int, `b` varchar(10), `c` int AS (`a`+1), PRIMARY KEY (`id`))")
+	assert.True(t, ok)
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		// Column list.
+		{
+			"INSERT INTO `t1`(`id`,`a`) VALUES\n(1,2),\n(2,3)\n",
+			"INSERT INTO `t1`(`id`,`a`) VALUES\n(1,2),\n(2,3) ON DUPLICATE KEY UPDATE `a`=VALUES(`a`)",
+		},
+		// Unquoted column list.
+		{
+			"insert into t1 (id, b) values (1,'x')",
+			"insert into t1 (id, b) values (1,'x') ON DUPLICATE KEY UPDATE `b`=VALUES(`b`)",
+		},
+		// Positional, the columns of the table but the generated one.
+		{
+			"INSERT INTO `t1` VALUES (1,2,'on duplicate key update',3)",
+			"INSERT INTO `t1` VALUES (1,2,'on duplicate key update',3) ON DUPLICATE KEY UPDATE `a`=VALUES(`a`),`b`=VALUES(`b`)",
+		},
+		// Only the key.
+		{
+			"INSERT INTO `t1`(`id`) VALUES (1)",
+			"INSERT INTO `t1`(`id`) VALUES (1) ON DUPLICATE KEY UPDATE `id`=`id`",
+		},
+		// Already an upsert.
+		{
+			"INSERT INTO `t1`(`id`,`a`) VALUES (1,2) ON DUPLICATE KEY UPDATE `a`=`a`+1",
+			"INSERT INTO `t1`(`id`,`a`) VALUES (1,2) ON DUPLICATE KEY UPDATE `a`=`a`+1",
+		},
+		// Not an INSERT.
+		{
+			"SET NAMES utf8",
+			"SET NAMES utf8",
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, u.rewrite(test.query))
+	}
+}
+
+func TestUpsertReadTables(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/upserttest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/db.t1-schema.sql", "/*!40101 SET NAMES binary*/;\nCREATE TABLE `t1` (`id` int, PRIMARY KEY (`id`));\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/db.t2-schema.sql", "CREATE TABLE `t2` (`id` int);\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/db.t3-schema.sql", "CREATE TABLE `t3` (`id` int, PRIMARY KEY (`id`));\n")
+	AssertNil(x)
+
+	// t2 has no primary key, t3 no data file.
+	upserts, err := readUpsertTables(log, NewDirStorage(dir),
+		[]string{"db.t1-schema.sql", "db.t2-schema.sql", "db.t3-schema.sql"},
+		[]string{"db.t1.00001.sql", "db.t2.00001.sql"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(upserts))
+	assert.Equal(t, []string{"`id`"}, upserts["db.t1"].columns)
+
+	// Keyless, as an incremental restores them, t2 updates the row of a
+	// unique key.
+	upserts, err = readUpsertTables(log, NewDirStorage(dir),
+		[]string{"db.t1-schema.sql", "db.t2-schema.sql", "db.t3-schema.sql"},
+		[]string{"db.t1.00001.sql", "db.t2.00001.sql"}, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(upserts))
+	assert.Equal(t, "INSERT INTO `t2` VALUES (1) ON DUPLICATE KEY UPDATE `id`=VALUES(`id`)", upserts["db.t2"].rewrite("INSERT INTO `t2` VALUES (1)"))
+}
@@ -0,0 +1,334 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// The LoadArgs.CheckUTF8 modes.
+const (
+	// CheckUTF8Warn logs the invalid values and restores them as they are.
+	CheckUTF8Warn = "warn"
+	// CheckUTF8Abort fails the file of the first invalid value.
+	CheckUTF8Abort = "abort"
+)
+
+// The kinds of the encoding problems, in the logs and Report.EncodingProblems.
+const (
+	invalidUTF8   = "invalid utf8"
+	doubleEncoded = "double encoded"
+)
+
+// cp1252Bytes are the characters cp1252, the latin1 of MySQL, has instead of
+// the C1 controls, by their byte.
+var cp1252Bytes = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// utf8Table is the schema of a table LoadArgs.CheckUTF8 checks the values of.
+type utf8Table struct {
+	// columns are the quoted names of the columns in the order of the table.
+	columns []string
+	// utf8 are the quoted names of the string columns in utf8, utf8mb3 or
+	// utf8mb4.
+	utf8 map[string]bool
+}
+
+// newUTF8Table returns the utf8Table of the create table statement schema,
+// false if the table has no utf8 string column. A column takes the character
+// set of the table options unless it has its own.
+func newUTF8Table(schema string) (*utf8Table, bool) {
+	tableUtf8 := false
+	if match := charsetRegexp.FindStringSubmatch(tableOptions(schema)); match != nil {
+		tableUtf8 = isUtf8(match[1])
+	}
+	t := &utf8Table{utf8: make(map[string]bool)}
+	for _, def := range tableDefinitions(schema) {
+		name, attrs, ok := columnDefinition(def)
+		if !ok {
+			continue
+		}
+		t.columns = append(t.columns, name)
+		if !stringTypeRegexp.MatchString(attrs) {
+			continue
+		}
+		utf8 := tableUtf8
+		if charset := charsetRegexp.FindStringSubmatch(attrs); charset != nil {
+			utf8 = isUtf8(charset[1])
+		}
+		if utf8 {
+			t.utf8[name] = true
+		}
+	}
+	return t, len(t.utf8) > 0
+}
+
+// isUtf8 reports whether charset is one of the UTF-8 character sets.
+func isUtf8(charset string) bool {
+	return isUtf8mb3(charset) || strings.EqualFold(charset, "utf8mb4")
+}
+
+// readUTF8Tables reads the utf8Table of every table with data files from its
+// schema file, keyed by 'db.table'. The tables without utf8 string columns
+// are left out, they have nothing to check.
+func readUTF8Tables(log *xlog.Log, storage Storage, schemas []string, tables []string) (map[string]*utf8Table, error) {
+	datas := make(map[string]bool)
+	for _, table := range tables {
+		db, tbl, _ := parseTableFile(table)
+		datas[db+"."+tbl] = true
+	}
+	checked := make(map[string]*utf8Table)
+	for _, path := range schemas {
+		s, err := readSchemaFile(storage, path)
+		if err != nil {
+			return nil, err
+		}
+		name := s.db + "." + s.table
+		if !datas[name] {
+			continue
+		}
+		for _, stmt := range splitStatements(s.sql) {
+			if createTableRegexp.MatchString(stmt.sql) {
+				if t, ok := newUTF8Table(stmt.sql); ok {
+					checked[name] = t
+				}
+				break
+			}
+		}
+	}
+	log.Info("restoring.check.utf8.tables[%d/%d]", len(checked), len(datas))
+	return checked, nil
+}
+
+// utf8Problem is a value of a utf8 column of a data statement which isn't
+// valid UTF-8, or looks double encoded.
+type utf8Problem struct {
+	kind string
+	// row is the row of the statement, from 1, and column the quoted name of
+	// the column.
+	row    int
+	column string
+	// detail tells where the value is wrong: the offset and the bytes of the
+	// first invalid sequence, or the first double encoded character.
+	detail string
+}
+
+func (p utf8Problem) String() string {
+	return fmt.Sprintf("row[%d].column[%s].%s[%s]", p.row, p.column, strings.Replace(p.kind, " ", ".", -1), p.detail)
+}
+
+// check returns the problems of the string literals the INSERT or REPLACE
+// query has for the utf8 columns of t, by the column list of the statement or
+// else the columns of the table. The values which aren't a plain literal,
+// like a _binary or a hex one, are not checked.
+func (t *utf8Table) check(query string) []utf8Problem {
+	if !insertRegexp.MatchString(query) {
+		return nil
+	}
+	i := valuesKeyword(query)
+	if i < 0 {
+		return nil
+	}
+	columns := insertColumns(query[:i])
+	if columns == nil {
+		columns = t.columns
+	}
+
+	var problems []utf8Problem
+	visit := func(row int, col int, value string) {
+		if col >= len(columns) || !t.utf8[columns[col]] {
+			return
+		}
+		raw, ok := stringLiteral(strings.TrimSpace(value))
+		if !ok {
+			return
+		}
+		if at := invalidUTF8At(raw); at >= 0 {
+			end := at + 4
+			if end > len(raw) {
+				end = len(raw)
+			}
+			problems = append(problems, utf8Problem{kind: invalidUTF8, row: row, column: columns[col],
+				detail: fmt.Sprintf("at.byte[%d].bytes[% x]", at, raw[at:end])})
+			return
+		}
+		if from, to, ok := doubleEncodedChar(raw); ok {
+			problems = append(problems, utf8Problem{kind: doubleEncoded, row: row, column: columns[col],
+				detail: fmt.Sprintf("%s->%s", from, to)})
+		}
+	}
+
+	row, col, depth, start := 0, 0, 0, 0
+	for i += len("VALUES"); i < len(query); {
+		switch c := query[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(query, i)
+			continue
+		case c == '(':
+			depth++
+			if depth == 1 {
+				row++
+				col, start = 0, i+1
+			}
+		case c == ')':
+			if depth == 1 {
+				visit(row, col, query[start:i])
+			}
+			depth--
+		case c == ',' && depth == 1:
+			visit(row, col, query[start:i])
+			col, start = col+1, i+1
+		case depth == 0 && c != ',' && !isSpace(c):
+			// The tuples end, like at an ON DUPLICATE KEY UPDATE.
+			return problems
+		}
+		i++
+	}
+	return problems
+}
+
+// stringLiteral returns the bytes of the quoted string literal value, false if
+// it's anything else, like a number, a NULL or a literal with an introducer.
+func stringLiteral(value string) (string, bool) {
+	if len(value) < 2 || (value[0] != '\'' && value[0] != '"') {
+		return "", false
+	}
+	quote := value[0]
+	// A doubled quote is an escaped one, the literal goes on.
+	end := skipQuoted(value, 0)
+	for end < len(value) && value[end] == quote {
+		end = skipQuoted(value, end)
+	}
+	if end != len(value) || value[end-1] != quote {
+		return "", false
+	}
+	return unescapeLiteral(value[1:end-1], quote), true
+}
+
+// unescapeLiteral returns the bytes of the body of a string literal quoted
+// with quote, see https://dev.mysql.com/doc/refman/5.7/en/string-literals.html.
+func unescapeLiteral(body string, quote byte) string {
+	if strings.IndexByte(body, '\\') < 0 && strings.IndexByte(body, quote) < 0 {
+		return body
+	}
+	b := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == quote && i+1 < len(body) && body[i+1] == quote:
+			i++
+		case c == '\\' && i+1 < len(body):
+			i++
+			switch c = body[i]; c {
+			case '0':
+				c = 0
+			case 'b':
+				c = '\b'
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'Z':
+				c = 0x1A
+			case '%', '_':
+				// They stay escaped, for LIKE.
+				b = append(b, '\\')
+			}
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// invalidUTF8At returns the offset of the first byte of s which isn't part of
+// a valid UTF-8 character, -1 if s is valid UTF-8.
+func invalidUTF8At(s string) int {
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
+
+// doubleEncodedChar reports whether s looks like UTF-8 read as latin1 and
+// encoded to UTF-8 again, the classic 'Ã©' for 'é': every character of s is
+// one of latin1, cp1252 the way MySQL has it, and their bytes are valid UTF-8
+// with characters of more than a byte. It returns the first of these
+// characters as it is in s and as it was.
+func doubleEncodedChar(s string) (from string, to string, ok bool) {
+	var b []byte
+	var runes []rune
+	first := -1
+	for _, r := range s {
+		c, ok := cp1252Bytes[r]
+		if !ok {
+			if r > 0xFF {
+				return "", "", false
+			}
+			c = byte(r)
+		}
+		if c >= 0x80 && first < 0 {
+			first = len(b)
+		}
+		b = append(b, c)
+		runes = append(runes, r)
+	}
+	if first < 0 || !utf8.Valid(b) {
+		return "", "", false
+	}
+	r, size := utf8.DecodeRune(b[first:])
+	return string(runes[first : first+size]), string(r), true
+}
+
+// checkUTF8 checks the values of the data statement query of table at offset
+// for LoadArgs.CheckUTF8, see utf8Table.check. The problems are counted by
+// kind, the first of a kind is logged for every table. It returns the error
+// of the first invalid value with CheckUTF8Abort: a double encoded value is
+// only a guess, it's never an error.
+func checkUTF8(log *xlog.Log, args *LoadArgs, table string, offset int, query string) error {
+	db, tbl, _ := parseTableFile(table)
+	t := args.utf8Tables[db+"."+tbl]
+	if t == nil {
+		return nil
+	}
+	for _, p := range t.check(query) {
+		if p.kind == invalidUTF8 && args.CheckUTF8 == CheckUTF8Abort {
+			args.metrics.encodingProblem(db+"."+tbl, p.kind)
+			return fmt.Errorf("restoring.file[%s].offset[%d].%s", table, offset, p)
+		}
+		if args.metrics.encodingProblem(db+"."+tbl, p.kind) {
+			log.Warning("restoring.file[%s].offset[%d].%s", table, offset, p)
+		}
+	}
+	return nil
+}
+
+// logEncodingSummary logs the summary line of the encoding problems of a load
+// by kind, none if it had none.
+func logEncodingSummary(log *xlog.Log, action string, problems map[string]uint64) {
+	if len(problems) == 0 {
+		return
+	}
+	total, kinds := countsByKind(problems)
+	logSummary(log, "%s.encoding.problems[%d].by.type[%s]", action, total, kinds)
+}
@@ -0,0 +1,160 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUTF8TableCheck(t *testing.T) {
+	schema := "CREATE TABLE `t1` (\n" +
+		"  `id` int NOT NULL,\n" +
+		"  `name` varchar(32) DEFAULT NULL,\n" +
+		"  `raw` varbinary(32) DEFAULT NULL,\n" +
+		"  `legacy` varchar(32) CHARACTER SET latin1 DEFAULT NULL,\n" +
+		"  `note` text,\n" +
+		"  PRIMARY KEY (`id`)\n" +
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+	table, ok := newUTF8Table(schema)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"`id`", "`name`", "`raw`", "`legacy`", "`note`"}, table.columns)
+	assert.Equal(t, map[string]bool{"`name`": true, "`note`": true}, table.utf8)
+
+	// A table of another character set has nothing to check.
+	{
+		_, ok := newUTF8Table("CREATE TABLE `t2` (`a` varchar(8), `b` text CHARACTER SET utf8) ENGINE=InnoDB DEFAULT CHARSET=latin1")
+		assert.True(t, ok)
+		_, ok = newUTF8Table("CREATE TABLE `t3` (`a` varchar(8), `b` blob) ENGINE=InnoDB DEFAULT CHARSET=latin1")
+		assert.False(t, ok)
+	}
+
+	// Valid values, the binary and latin1 columns are not checked.
+	{
+		query := "INSERT INTO `t1` VALUES (1,\"caf\xc3\xa9\",\"\xff\xfe\",\"\xe9t\xe9\",NULL),(2,'it''s \\\"ok\\\"','','',\"\")"
+		assert.Nil(t, table.check(query))
+	}
+
+	// An invalid byte, escaped or not, is found with its row and column.
+	{
+		query := "INSERT INTO `t1` VALUES (1,\"ok\",NULL,NULL,NULL),\n(2,\"caf\xe9 latte\",NULL,NULL,\"\\0\xc3\")"
+		want := []utf8Problem{
+			{kind: invalidUTF8, row: 2, column: "`name`", detail: "at.byte[3].bytes[e9 20 6c 61]"},
+			{kind: invalidUTF8, row: 2, column: "`note`", detail: "at.byte[1].bytes[c3]"},
+		}
+		assert.Equal(t, want, table.check(query))
+		assert.Equal(t, "row[2].column[`name`].invalid.utf8[at.byte[3].bytes[e9 20 6c 61]]", want[0].String())
+	}
+
+	// The column list of the statement wins over the table, an introducer, a
+	// hex literal and an expression are not checked.
+	{
+		query := "INSERT INTO `t1`(`note`,`id`,`legacy`) VALUES (\"\xe9\",1,\"\xe9\"),(_binary\"\xe9\",2,NULL),(0xE9,3,NULL),(CONCAT(\"\xe9\",'x'),4,NULL)"
+		assert.Equal(t, []utf8Problem{{kind: invalidUTF8, row: 1, column: "`note`", detail: "at.byte[0].bytes[e9]"}}, table.check(query))
+	}
+
+	// A double encoded value, latin1 and cp1252.
+	{
+		query := "REPLACE INTO `t1` VALUES (1,\"caf\xc3\x83\xc2\xa9\",NULL,NULL,\"it\xc3\xa2\xe2\x82\xac\xe2\x84\xa2s\"),(2,\"\xc3\xa9t\xc3\xa9\",NULL,NULL,NULL)"
+		want := []utf8Problem{
+			{kind: doubleEncoded, row: 1, column: "`name`", detail: "Ã©->é"},
+			{kind: doubleEncoded, row: 1, column: "`note`", detail: "â€™->’"},
+		}
+		assert.Equal(t, want, table.check(query))
+	}
+
+	// The tuples end at an ON DUPLICATE KEY UPDATE, the other statements have
+	// nothing to check.
+	{
+		query := "INSERT INTO `t1` VALUES (1,\"ok\",NULL,NULL,NULL) ON DUPLICATE KEY UPDATE `name`=\"\xe9\""
+		assert.Nil(t, table.check(query))
+		assert.Nil(t, table.check("UPDATE `t1` SET `name`=\"\xe9\""))
+	}
+}
+
+func TestUnescapeLiteral(t *testing.T) {
+	assert.Equal(t, "plain", unescapeLiteral("plain", '"'))
+	assert.Equal(t, "a\x00b\n\r\t\x1a\\c'\"d", unescapeLiteral(`a\0b\n\r\t\Z\\c\'\"d`, '"'))
+	assert.Equal(t, "it's", unescapeLiteral("it''s", '\''))
+	assert.Equal(t, `100\%\_x`, unescapeLiteral(`100\%\_\x`, '"'))
+}
+
+func TestLoaderCheckUTF8(t *testing.T) {
+	dir := "/tmp/loadercheckutf8"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int, `b` varchar(8)) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1,\"ok\"),(2,\"\xe9t\xe9\");\nINSERT INTO `t1` VALUES (3,\"\xe9\"),(4,\"caf\xc3\x83\xc2\xa9\");\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (`a` int, `b` varchar(8)) ENGINE=InnoDB DEFAULT CHARSET=latin1;\n",
+		"test.t2.00001.sql":      "INSERT INTO `t2` VALUES (1,\"\xe9t\xe9\");\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+
+	// Warn: the first invalid value of the table is logged, all are counted and
+	// restored.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{}
+		args := args
+		args.CheckUTF8 = CheckUTF8Warn
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]uint64{invalidUTF8: 2, doubleEncoded: 1}, report.EncodingProblems)
+		assert.True(t, strings.Contains(buf.String(), "restoring.check.utf8.tables[1/2]"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.file[test.t1.00001.sql].offset[0].row[2].column[`b`].invalid.utf8[at.byte[0].bytes[e9 74 e9]]"), buf.String())
+		assert.False(t, strings.Contains(buf.String(), "row[1].column[`b`].invalid.utf8"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "].row[2].column[`b`].double.encoded[Ã©->é]"), buf.String())
+		inserts := 0
+		for _, query := range rec.queries {
+			if strings.HasPrefix(query, "INSERT") {
+				inserts++
+			}
+		}
+		assert.Equal(t, 3, inserts)
+
+		LogReport(log, report)
+		assert.True(t, strings.Contains(buf.String(), "restoring.encoding.problems[3].by.type[invalid utf8:2,double encoded:1]"), buf.String())
+	}
+
+	// Abort: the file fails at its first invalid value.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{}
+		args := args
+		args.CheckUTF8 = CheckUTF8Abort
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "restoring.file[test.t1.00001.sql].offset[0].row[2].column[`b`].invalid.utf8"), err.Error())
+		assert.Equal(t, map[string]uint64{invalidUTF8: 1}, report.EncodingProblems)
+	}
+
+	// Off by default.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Nil(t, report.EncodingProblems)
+	}
+}
@@ -0,0 +1,867 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxThreads is the ceiling of the Threads arguments.
+	MaxThreads = 1024
+	// maxStmtSize is the max_allowed_packet ceiling of MySQL.
+	maxStmtSize = 1024 * 1024 * 1024
+	// maxChunksizeInMB is 1TB.
+	maxChunksizeInMB = 1024 * 1024
+)
+
+// ValidationError carries every problem found by Validate.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid arguments:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// validator collects the problems of the arguments.
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, a ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, a...))
+}
+
+func (v *validator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: v.problems}
+}
+
+func (v *validator) required(name string, value string) {
+	if value == "" {
+		v.addf("%s is required", name)
+	}
+}
+
+func (v *validator) between(name string, value int, min int, max int) {
+	if value < min || value > max {
+		v.addf("%s must be between %d and %d, got %d", name, min, max, value)
+	}
+}
+
+func (v *validator) address(address string) string {
+	parsed, err := ParseAddress(address, DefaultPort)
+	if err != nil {
+		v.addf("%v", err)
+	}
+	return parsed
+}
+
+// addresses checks a comma separated list of addresses, see SplitAddresses.
+func (v *validator) addresses(address string) {
+	addresses := SplitAddresses(address)
+	if len(addresses) == 0 {
+		v.address("")
+	}
+	seen := make(map[string]bool)
+	for _, a := range addresses {
+		parsed := v.address(a)
+		if parsed != "" && seen[parsed] {
+			v.addf("address %q is listed twice", a)
+		}
+		seen[parsed] = true
+	}
+}
+
+// listen checks an optional listen address, the host may be empty and the port 0.
+func (v *validator) listen(name string, address string) {
+	if address == "" {
+		return
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		v.addf("%s %q is not [host]:port: %v", name, address, err)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		v.addf("%s %q has an invalid port, it must be between 0 and 65535", name, address)
+	}
+}
+
+// location checks the scheme of a 'scheme://...' location is registered, see
+// OpenStorage. It returns false for a directory, which dir checks.
+func (v *validator) location(name string, location string) bool {
+	scheme := storageScheme(location)
+	if scheme == "" {
+		return false
+	}
+	storagesMu.RLock()
+	_, ok := storages[scheme]
+	storagesMu.RUnlock()
+	if !ok {
+		v.addf("%s %q has an unknown storage scheme %q", name, location, scheme)
+	}
+	return true
+}
+
+// dir checks dir is an existing directory, writable if write is set.
+func (v *validator) dir(name string, dir string, write bool) {
+	if dir == "" {
+		v.addf("%s is required", name)
+		return
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		v.addf("%s %q: %v", name, dir, err)
+		return
+	}
+	if !info.IsDir() {
+		v.addf("%s %q is not a directory", name, dir)
+		return
+	}
+	if write {
+		f, err := ioutil.TempFile(dir, ".go-mydumper-validate")
+		if err != nil {
+			v.addf("%s %q is not writable: %v", name, dir, err)
+			return
+		}
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// within reports whether the directory path is dir or inside it, compared as
+// cleaned absolute paths.
+func within(dir string, path string) bool {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Validate checks the arguments before any connection is made and returns a
+// *ValidationError with all the problems found. It changes nothing: with
+// ForceMkdir a missing Outdir is fine, the run creates it, see makeOutdir.
+func (args *DumpArgs) Validate() error {
+	v := &validator{}
+	v.required("user", args.User)
+	v.address(args.Address)
+	v.required("database", args.Database)
+	if !v.location("outdir", args.Outdir) {
+		if _, err := os.Stat(args.Outdir); args.Outdir != "" && os.IsNotExist(err) {
+			if !args.ForceMkdir {
+				v.addf("outdir %q does not exist, create it or use -force-mkdir", args.Outdir)
+			}
+		} else {
+			v.dir("outdir", args.Outdir, true)
+		}
+	}
+	if args.FileMode&^os.ModePerm != 0 {
+		v.addf("file mode must be permission bits like 0640, got %#o", uint32(args.FileMode))
+	}
+	if args.DirMode&^os.ModePerm != 0 {
+		v.addf("dir mode must be permission bits like 0750, got %#o", uint32(args.DirMode))
+	}
+	if args.Chown != "" {
+		if _, _, err := parseOwner(args.Chown); err != nil {
+			v.addf("chown %v", err)
+		} else if geteuid() != 0 {
+			v.addf("chown requires running as root, only root can give a file away")
+		}
+	}
+	v.between("threads", args.Threads, 1, MaxThreads)
+	v.between("chunksize(MB)", args.ChunksizeInMB, 1, maxChunksizeInMB)
+	v.between("statement size", args.StmtSize, 1, maxStmtSize)
+	v.between("schema threads", args.SchemaThreads, 0, MaxThreads)
+	if args.AddDropTable && args.IfNotExists {
+		v.addf("add drop table and if not exists can not be set together")
+	}
+	var listed map[string]bool
+	if args.Table != "" {
+		listed = make(map[string]bool)
+		for _, table := range strings.Split(args.Table, ",") {
+			listed[table] = true
+		}
+	}
+	for _, name := range args.partitionTables() {
+		db, table := splitTableName(name)
+		switch {
+		case db == "" || table == "" || strings.Contains(table, "."):
+			v.addf("partitions table %q must be 'db.table'", name)
+		case db != args.Database:
+			v.addf("partitions table %q must be a table of the database %q", name, args.Database)
+		case listed != nil && !listed[table]:
+			v.addf("partitions table %q is not a dumped table", name)
+		}
+		if len(args.Partitions[name]) == 0 {
+			v.addf("partitions of %q must not be empty", name)
+		}
+		for _, p := range args.Partitions[name] {
+			if p == "" || strings.Contains(p, "`") {
+				v.addf("partition %q of %q must be a partition name", p, name)
+			}
+		}
+	}
+	for _, name := range args.chunkByTables() {
+		db, table := splitTableName(name)
+		switch {
+		case db == "" || table == "" || strings.Contains(table, "."):
+			v.addf("chunk by table %q must be 'db.table'", name)
+		case db != args.Database:
+			v.addf("chunk by table %q must be a table of the database %q", name, args.Database)
+		case listed != nil && !listed[table]:
+			v.addf("chunk by table %q is not a dumped table", name)
+		}
+		col := args.ChunkBy[name]
+		if col.Column == "" {
+			v.addf("chunk by column of %q must not be empty", name)
+		}
+		if !col.validInterval() {
+			v.addf("chunk by interval of %q must be %s, %s, %s, %s or a positive number, got %q", name, ChunkHour, ChunkDay, ChunkMonth, ChunkYear, col.Interval)
+		}
+	}
+	if args.ChunkRows < 0 {
+		v.addf("chunk rows must not be negative, got %d", args.ChunkRows)
+	}
+	for _, name := range args.subsetTables() {
+		db, table := splitTableName(name)
+		switch {
+		case db == "" || table == "" || strings.Contains(table, "."):
+			v.addf("subset seed table %q must be 'db.table'", name)
+		case db != args.Database:
+			v.addf("subset seed table %q must be a table of the database %q", name, args.Database)
+		case listed != nil && !listed[table]:
+			v.addf("subset seed table %q is not a dumped table", name)
+		}
+		if strings.TrimSpace(args.SubsetSeeds[name]) == "" {
+			v.addf("subset seed of %q must have a WHERE clause", name)
+		}
+	}
+	if len(args.SubsetSeeds) > 0 {
+		if len(args.Partitions) > 0 {
+			v.addf("subset seeds can not be combined with partitions, the subset is walked on the whole tables")
+		}
+		if args.Checksum {
+			v.addf("checksum can not be recorded for a subset, the CHECKSUM TABLE is the one of all the rows")
+		}
+		if args.Resume {
+			v.addf("resume is not supported with subset seeds, the subset is walked again by every run")
+		}
+	}
+	if args.SubsetMaxRows < 0 {
+		v.addf("subset max rows must not be negative, got %d", args.SubsetMaxRows)
+	}
+	if args.IncrementalFrom != "" {
+		if args.Consistency != ConsistencyLock && args.Consistency != ConsistencyGTID {
+			v.addf("incremental from requires consistency %s or %s, the next incremental is from the gtid set of its snapshot", ConsistencyLock, ConsistencyGTID)
+		}
+		if args.Resume {
+			v.addf("resume is not supported with incremental from, the tables of the checkpoint are older than the snapshot")
+		}
+		if len(args.SubsetSeeds) > 0 || args.SmokeTest {
+			v.addf("incremental from can not be combined with subset seeds or smoke test")
+		}
+	}
+	columns := make([]string, 0, len(args.IncrementalColumns))
+	for name := range args.IncrementalColumns {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+	for _, name := range columns {
+		db, table := splitTableName(name)
+		switch {
+		case db == "" || table == "" || strings.Contains(table, "."):
+			v.addf("incremental column table %q must be 'db.table'", name)
+		case db != args.Database:
+			v.addf("incremental column table %q must be a table of the database %q", name, args.Database)
+		case listed != nil && !listed[table]:
+			v.addf("incremental column table %q is not a dumped table", name)
+		}
+		if strings.TrimSpace(args.IncrementalColumns[name]) == "" {
+			v.addf("incremental column of %q must not be empty", name)
+		}
+	}
+	if len(args.IncrementalColumns) > 0 {
+		if args.IncrementalFrom == "" {
+			v.addf("incremental columns require incremental from, they select the rows changed since it")
+		}
+		if args.Checksum {
+			v.addf("checksum can not be recorded with incremental columns, the CHECKSUM TABLE is the one of all the rows")
+		}
+	}
+	if args.SmokeTest && (args.Resume || len(args.Volumes) > 0 || len(args.SubsetSeeds) > 0) {
+		v.addf("smoke test can not be combined with resume, volumes or subset seeds, it writes a file of the first %d rows of every table", smokeRows)
+	}
+	seen := make(map[string]bool)
+	for _, vol := range args.Volumes {
+		if seen[vol.Path] {
+			v.addf("volume %q is given twice", vol.Path)
+		}
+		seen[vol.Path] = true
+		if !v.location("volume", vol.Path) {
+			if args.Outdir != "" && storageScheme(args.Outdir) == "" && within(args.Outdir, vol.Path) {
+				v.addf("volume %q must not be the outdir or inside it, its files would be listed as the ones of the outdir too", vol.Path)
+			}
+			v.dir("volume", vol.Path, true)
+		}
+		if vol.Budget <= 0 {
+			v.addf("volume %q budget must be positive, got %d", vol.Path, vol.Budget)
+		}
+	}
+	if _, ok := rowFormats[args.Format]; args.Format != "" && !ok {
+		v.addf("format must be %s, %s or %s, got %q", FormatSQL, FormatCSV, FormatJSONL, args.Format)
+	}
+	if args.FileTrailers && args.Format != "" && args.Format != FormatSQL {
+		v.addf("file trailers require format %s, the comments would be rows of %s", FormatSQL, args.Format)
+	}
+	if args.Format == FormatJSONL && args.Checksum {
+		v.addf("checksum can not be recorded with format %s, the CHECKSUM TABLE is verified by a load of its rows, which restores %s only", FormatJSONL, FormatSQL)
+	}
+	if args.MaxReplicaLag < 0 {
+		v.addf("max replica lag must not be negative, got %d", args.MaxReplicaLag)
+	}
+	if args.LagAction != "" && args.LagAction != LagActionPause && args.LagAction != LagActionAbort {
+		v.addf("lag action must be %s or %s, got %q", LagActionPause, LagActionAbort, args.LagAction)
+	}
+	switch args.Consistency {
+	case "", ConsistencyNone, ConsistencyLock, ConsistencyGTID:
+	default:
+		v.addf("consistency must be %s, %s or %s, got %q", ConsistencyNone, ConsistencyLock, ConsistencyGTID, args.Consistency)
+	}
+	switch args.LockMode {
+	case "", LockModeAuto:
+	case LockModeFTWRL, LockModeBackup, LockModeNone:
+		if args.Consistency != ConsistencyLock {
+			v.addf("lock mode %s requires consistency %s, got %q", args.LockMode, ConsistencyLock, args.Consistency)
+		}
+	default:
+		v.addf("lock mode must be %s, %s, %s or %s, got %q", LockModeAuto, LockModeFTWRL, LockModeBackup, LockModeNone, args.LockMode)
+	}
+	if args.Paranoid && args.Consistency != ConsistencyLock && args.Consistency != ConsistencyGTID {
+		v.addf("paranoid requires consistency %s or %s, the tables are read again in the snapshot of their rows", ConsistencyLock, ConsistencyGTID)
+	}
+	if args.SchemaChangeRetries < 0 {
+		v.addf("schema change retries must not be negative, got %d", args.SchemaChangeRetries)
+	}
+	if args.LockWaitTimeout < 0 {
+		v.addf("lock wait timeout must not be negative, got %d", args.LockWaitTimeout)
+	}
+	if args.MaxRuntime < 0 {
+		v.addf("max runtime must not be negative, got %v", args.MaxRuntime)
+	}
+	if args.MaxRuntimeGrace < 0 {
+		v.addf("max runtime grace must not be negative, got %v", args.MaxRuntimeGrace)
+	}
+	if args.Retention < 0 {
+		v.addf("retention must not be negative, got %v", args.Retention)
+	}
+	if args.IntervalMs <= 0 {
+		v.addf("interval(ms) must be positive, got %d", args.IntervalMs)
+	}
+	v.listen("metrics listen", args.MetricsListen)
+	v.listen("status listen", args.StatusListen)
+	if args.StatusToken != "" && args.StatusListen == "" {
+		v.addf("status token requires status listen, it's the token of its POSTs")
+	}
+	return v.err()
+}
+
+// Validate checks the configuration before any connection is made and returns a
+// *ValidationError with all the problems found.
+func (cfg *StreamConfig) Validate() error {
+	v := &validator{}
+	v.required("user", cfg.User)
+	v.address(cfg.Address)
+	v.between("threads", cfg.Threads, 1, MaxThreads)
+	return v.err()
+}
+
+// Validate checks the arguments before any connection is made and returns a
+// *ValidationError with all the problems found.
+func (args *LoadArgs) Validate() error {
+	v := &validator{}
+	v.required("user", args.User)
+	v.addresses(args.Address)
+	dir := args.Outdir
+	if len(args.Files) > 0 {
+		resolved, _, err := resolveFiles(args.Outdir, args.Files)
+		if err != nil {
+			v.addf("%v", err)
+		}
+		dir = resolved
+	}
+	if !v.location("dump dir", dir) && (dir != "" || len(args.Files) == 0) {
+		v.dir("dump dir", dir, false)
+	}
+	for _, path := range args.Volumes {
+		if !v.location("volume", path) {
+			v.dir("volume", path, false)
+		}
+	}
+	v.between("threads", args.Threads, 1, MaxThreads)
+	if args.SchemaThreads < 0 {
+		v.addf("schema threads must not be negative, got %d", args.SchemaThreads)
+	} else if args.SchemaThreads > MaxThreads {
+		v.addf("schema threads must be at most %d, got %d", MaxThreads, args.SchemaThreads)
+	}
+	v.between("data threads", args.DataThreads, 0, MaxThreads)
+	v.between("post threads", args.PostThreads, 0, MaxThreads)
+	if args.MaxThreadsPerDatabase < 0 {
+		v.addf("max threads per database must not be negative, got %d", args.MaxThreadsPerDatabase)
+	}
+	tables := make([]string, 0, len(args.TableThreads))
+	for table := range args.TableThreads {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if splits := strings.Split(table, "."); len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+			v.addf("table threads table %q must be 'db.table'", table)
+		}
+		if n := args.TableThreads[table]; n < 1 {
+			v.addf("table threads of %s must be at least 1, got %d", table, n)
+		}
+	}
+	if args.IntervalMs <= 0 {
+		v.addf("interval(ms) must be positive, got %d", args.IntervalMs)
+	}
+	if args.Filter != "" {
+		if _, err := parseFilter(args.Filter); err != nil {
+			v.addf("filter %q is invalid: %v", args.Filter, err)
+		}
+	}
+	if args.TxnBatchSize < 0 {
+		v.addf("txn batch size must not be negative, got %d", args.TxnBatchSize)
+	}
+	if args.MaxInFlightBytes < 0 {
+		v.addf("max in flight bytes must not be negative, got %d", args.MaxInFlightBytes)
+	}
+	if args.MaxMemory < 0 {
+		v.addf("max memory must not be negative, got %d", args.MaxMemory)
+	}
+	if args.MaxOpenFiles < 0 {
+		v.addf("max open files must not be negative, got %d", args.MaxOpenFiles)
+	}
+	if args.MaxBytesPerSec < 0 {
+		v.addf("max bytes per sec must not be negative, got %d", args.MaxBytesPerSec)
+	}
+	if args.MaxRowsPerSec < 0 {
+		v.addf("max rows per sec must not be negative, got %d", args.MaxRowsPerSec)
+	}
+	if args.MaxBytesPerSec > 0 && args.MaxRowsPerSec > 0 {
+		v.addf("max bytes per sec and max rows per sec can not be set together")
+	}
+	if args.TxnBatchFileMaxBytes < 0 {
+		v.addf("txn batch file max bytes must not be negative, got %d", args.TxnBatchFileMaxBytes)
+	}
+	if args.SmallFileBatch < 0 {
+		v.addf("small file batch must not be negative, got %d", args.SmallFileBatch)
+	}
+	if args.SmallFileMaxBytes < 0 {
+		v.addf("small file max bytes must not be negative, got %d", args.SmallFileMaxBytes)
+	}
+	if args.SmallFileBatch > 1 && args.TxnBatchSize > 1 {
+		v.addf("small file batch and txn batch size can not be set together")
+	}
+	if args.RecentChunks < 0 {
+		v.addf("recent chunks must not be negative, got %d", args.RecentChunks)
+	}
+	if args.VerifyChecksums && args.RecentChunks > 0 {
+		v.addf("verify checksums can not check a restore of the recent chunks only")
+	}
+	if args.VerifyChecksums && len(args.Replacements) > 0 {
+		v.addf("verify checksums can not check a restore with replacements, the datas differ")
+	}
+	if args.VerifyChecksums && args.Upsert {
+		v.addf("verify checksums can not check an upsert restore, the tables have rows of their own")
+	}
+	if args.VerifyChecksums && args.FillMissingColumns {
+		v.addf("verify checksums can not check a restore with filled columns, the tables have columns of their own")
+	}
+	if len(args.FillValues) > 0 && !args.FillMissingColumns {
+		v.addf("fill values require fill missing columns, they are its placeholders")
+	}
+	if args.VerifyChecksums && len(args.Files) > 0 {
+		v.addf("verify checksums can not check a restore of some files only")
+	}
+	if len(args.Files) > 0 {
+		// The files are named, not picked from the dump.
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"schema version", args.SchemaVersion != ""},
+			{"filter", args.Filter != ""},
+			{"recent chunks", args.RecentChunks > 0},
+			{"expect tables", len(args.ExpectTables) > 0},
+			{"overwrite tables", args.OverwriteTables},
+			{"targets", len(args.Targets) > 0},
+		} {
+			if option.set {
+				v.addf("files and %s can not be set together", option.name)
+			}
+		}
+	}
+	if args.PipeReopenCommand != "" && !args.AllowPipes {
+		v.addf("pipe reopen command requires allow pipes, only a pipe is read again")
+	}
+	if args.SkipBinlog && args.ManagedMode {
+		v.addf("skip binlog can not be set with managed mode, SET sql_log_bin needs SUPER")
+	}
+	if args.CheckTables && !args.DeferConstraints {
+		v.addf("check tables requires defer constraints, it runs in its validation pass")
+	}
+	if args.Compat != "" && args.Compat != CompatProxy {
+		v.addf("compat must be %s, got %q", CompatProxy, args.Compat)
+	}
+	if args.TxnMaxStatements < 0 {
+		v.addf("txn max statements must not be negative, got %d", args.TxnMaxStatements)
+	}
+	if args.TxnMaxTimeMs < 0 {
+		v.addf("txn max time(ms) must not be negative, got %d", args.TxnMaxTimeMs)
+	}
+	if args.ReplicaLagAddress != "" {
+		if _, err := ParseAddress(args.ReplicaLagAddress, DefaultPort); err != nil {
+			v.addf("replica lag %v", err)
+		}
+		if args.MaxReplicaLag < 1 {
+			v.addf("max replica lag must be positive with a replica lag address, got %d", args.MaxReplicaLag)
+		}
+		if len(args.Targets) > 0 {
+			v.addf("replica lag address is not supported with targets, the targets have replicas of their own")
+		}
+	} else if args.MaxReplicaLag != 0 {
+		v.addf("max replica lag needs a replica lag address")
+	}
+	if args.ReadOnlyMaxWait < 0 {
+		v.addf("read only max wait must not be negative, got %d", args.ReadOnlyMaxWait)
+	}
+	for _, name := range args.Rewrites {
+		if _, ok := builtinRewrites[name]; !ok {
+			v.addf("rewrite %q is unknown, the builtins are %s", name, strings.Join(BuiltinRewrites(), ", "))
+		}
+	}
+	collations := make([]string, 0, len(args.UpgradeCollations))
+	for from := range args.UpgradeCollations {
+		collations = append(collations, from)
+	}
+	sort.Strings(collations)
+	for _, from := range collations {
+		if match := utf8mb3Regexp.FindStringSubmatch(from); match == nil || match[0] != from || match[1] == "" {
+			v.addf("upgrade collation %q must be a utf8 or utf8mb3 collation", from)
+		}
+		if to := args.UpgradeCollations[from]; !strings.HasPrefix(strings.ToLower(to), "utf8mb4_") {
+			v.addf("upgrade collation of %s must be a utf8mb4 collation, got %q", from, to)
+		}
+	}
+	if args.UpgradeKeyBytes < 0 {
+		v.addf("upgrade key bytes must not be negative, got %d", args.UpgradeKeyBytes)
+	}
+	if args.DefaultCollation != "" && !collationNameRegexp.MatchString(args.DefaultCollation) {
+		v.addf("default collation must be a collation name like utf8mb4_0900_ai_ci, got %q", args.DefaultCollation)
+	}
+	if args.ForceTableCollation && args.DefaultCollation == "" {
+		v.addf("force table collation needs a default collation")
+	}
+	if args.ForceEngine != "" && !engineNameRegexp.MatchString(args.ForceEngine) {
+		v.addf("force engine must be an engine name, got %q", args.ForceEngine)
+	}
+	if args.OverwriteTables && args.CreateIfNotExists {
+		v.addf("overwrite tables and create if not exists can not be set together")
+	}
+	if n := len(args.TablePrefix) + len(args.TableSuffix); n >= maxIdentifierBytes {
+		v.addf("table prefix and suffix must be shorter than %d bytes together, got %d", maxIdentifierBytes, n)
+	}
+	targets := make([]string, 0, len(args.Targets))
+	for name := range args.Targets {
+		targets = append(targets, name)
+	}
+	sort.Strings(targets)
+	for _, name := range targets {
+		if name == "" || name == DefaultTarget {
+			v.addf("target name %q is reserved for the address", name)
+			continue
+		}
+		tv := &validator{}
+		tv.required("user", args.Targets[name].User)
+		tv.addresses(args.Targets[name].Address)
+		for _, problem := range tv.problems {
+			v.addf("target %s %s", name, problem)
+		}
+	}
+	switch args.Placement {
+	case "", PlacementRoundRobin:
+		if args.PlacementFile != "" {
+			v.addf("placement file is only read with placement %q", PlacementFile)
+		}
+	case PlacementFile:
+		if args.PlacementFile == "" {
+			v.addf("placement %q requires a placement file", PlacementFile)
+		}
+	default:
+		v.addf("placement must be %s or %s, got %q", PlacementRoundRobin, PlacementFile, args.Placement)
+	}
+	if args.Placement != "" && len(args.Targets) == 0 {
+		v.addf("placement requires targets, it places the databases on them")
+	}
+	if len(args.Targets) > 0 && args.RollbackFile != "" {
+		v.addf("rollback file is not supported with targets, it would mix the tables of the servers")
+	}
+	if len(args.Targets) > 0 && args.ResumeFile != "" {
+		v.addf("resume file is not supported with targets, it would mix the files of the servers")
+	}
+	if args.Resume && args.ResumeFile == "" {
+		v.addf("resume requires a resume file, it records what the previous restore did")
+	}
+	if args.MaxRuntime < 0 {
+		v.addf("max runtime must not be negative, got %v", args.MaxRuntime)
+	}
+	if args.MaxRuntimeGrace < 0 {
+		v.addf("max runtime grace must not be negative, got %v", args.MaxRuntimeGrace)
+	}
+	if args.MaxRuntime > 0 && args.ResumeFile == "" {
+		v.addf("max runtime requires a resume file, the restore it stops could not go on")
+	}
+	for _, dir := range args.Incrementals {
+		if !v.location("incremental", dir) {
+			v.dir("incremental", dir, false)
+		}
+	}
+	if len(args.Incrementals) > 0 {
+		for _, option := range []struct {
+			name string
+			set  bool
+		}{
+			{"files", len(args.Files) > 0},
+			{"targets", len(args.Targets) > 0},
+			{"recent chunks", args.RecentChunks > 0},
+			{"rollback file", args.RollbackFile != ""},
+			{"resume file", args.ResumeFile != ""},
+			{"verify checksums", args.VerifyChecksums},
+		} {
+			if option.set {
+				v.addf("incrementals and %s can not be set together", option.name)
+			}
+		}
+	}
+	for _, name := range args.ExpectTables {
+		if splits := strings.Split(name, "."); len(splits) > 2 || splits[0] == "" || splits[len(splits)-1] == "" {
+			v.addf("expected table %q must be 'db' or 'db.table'", name)
+		}
+	}
+	for _, name := range args.WarmTables {
+		if splits := strings.Split(name, "."); len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+			v.addf("warm table %q must be 'db.table'", name)
+		}
+	}
+	if args.WarmThreads < 0 {
+		v.addf("warm threads must not be negative, got %d", args.WarmThreads)
+	}
+	for _, name := range args.OptimizeTables {
+		if name == OptimizeAll {
+			if len(args.OptimizeTables) > 1 {
+				v.addf("optimize tables %q must be alone", OptimizeAll)
+			}
+			continue
+		}
+		if splits := strings.Split(name, "."); len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+			v.addf("optimize table %q must be 'db.table' or %q", name, OptimizeAll)
+		}
+	}
+	if args.OptimizeThreads < 0 {
+		v.addf("optimize threads must not be negative, got %d", args.OptimizeThreads)
+	}
+	if args.PostSQLDatabase != "" {
+		if strings.Contains(args.PostSQLDatabase, "`") {
+			v.addf("post sql database %q must be a database name", args.PostSQLDatabase)
+		}
+		if len(args.PostSQL)+len(args.PostSQLOnFailure) == 0 {
+			v.addf("post sql database requires post sql scripts")
+		}
+	}
+	switch args.GrantsExisting {
+	case "", GrantsSkipExisting, GrantsUpdateExisting:
+	default:
+		v.addf("grants existing must be %s or %s, got %q", GrantsSkipExisting, GrantsUpdateExisting, args.GrantsExisting)
+	}
+	if args.DefinerUser != "" {
+		if _, ok := definerAccount(args.DefinerUser); !ok {
+			v.addf("definer user %q must be 'user@host'", args.DefinerUser)
+		}
+	}
+	switch args.LogSQL {
+	case "", LogSQLNone, LogSQLDDL, LogSQLAll:
+	default:
+		v.addf("log sql must be %s, %s or %s, got %q", LogSQLNone, LogSQLDDL, LogSQLAll, args.LogSQL)
+	}
+	if args.LogSQLMaxBytes < 0 {
+		v.addf("log sql max bytes must not be negative, got %d", args.LogSQLMaxBytes)
+	}
+	if args.WarningMessages < 0 {
+		v.addf("warning messages must not be negative, got %d", args.WarningMessages)
+	}
+	if args.WarningsThreshold < 0 {
+		v.addf("warnings threshold must not be negative, got %d", args.WarningsThreshold)
+	}
+	if args.WarningsAsErrors && !args.CaptureWarnings {
+		v.addf("warnings as errors requires capture warnings, the warnings are only read with it")
+	}
+	if args.WarningsThreshold > 0 && !args.WarningsAsErrors {
+		v.addf("warnings threshold requires warnings as errors, it's the warnings of a table failing its file")
+	}
+	switch args.CheckUTF8 {
+	case "", CheckUTF8Warn, CheckUTF8Abort:
+	default:
+		v.addf("check utf8 must be %s or %s, got %q", CheckUTF8Warn, CheckUTF8Abort, args.CheckUTF8)
+	}
+	switch args.TuneTarget {
+	case "", TuneTargetOn, TuneTargetDryRun:
+	default:
+		v.addf("tune target must be %s or %s, got %q", TuneTargetOn, TuneTargetDryRun, args.TuneTarget)
+	}
+	if args.ForceLock && !args.Lock {
+		v.addf("force lock requires lock, it's the lock held by another restore it overrides")
+	}
+	v.listen("metrics listen", args.MetricsListen)
+	v.listen("status listen", args.StatusListen)
+	if args.StatusToken != "" && args.StatusListen == "" {
+		v.addf("status token requires status listen, it's the token of its POSTs")
+	}
+	return v.err()
+}
+
+// Validate checks the configuration before any connection is made and returns a
+// *ValidationError with all the problems found, the ones of the dump prefixed
+// with 'source' and the ones of the load with 'target'.
+func (cfg *CopyConfig) Validate() error {
+	v := &validator{}
+	// The files go through the pipe, any location passes the outdir checks.
+	dump := cfg.Dump
+	dump.Outdir = "mem://"
+	if err := dump.Validate(); err != nil {
+		for _, problem := range err.(*ValidationError).Problems {
+			v.addf("source %s", problem)
+		}
+	}
+	load := cfg.Load
+	load.Outdir = "mem://"
+	if err := load.Validate(); err != nil {
+		for _, problem := range err.(*ValidationError).Problems {
+			v.addf("target %s", problem)
+		}
+	}
+	if cfg.Dump.Format != "" && cfg.Dump.Format != FormatSQL {
+		v.addf("source format must be %s for a copy, got %q", FormatSQL, cfg.Dump.Format)
+	}
+	if cfg.Dump.Resume {
+		v.addf("source resume is not supported by a copy, it has no files to resume from")
+	}
+	if cfg.Dump.IncrementalFrom != "" {
+		v.addf("source incremental from is not supported by a copy, it writes no manifest to chain to")
+	}
+	if cfg.Dump.MaxRuntime > 0 {
+		v.addf("source max runtime is not supported by a copy, it has no files to resume from")
+	}
+	if len(cfg.Dump.Volumes) > 0 {
+		v.addf("source volumes are not supported by a copy, it has no files")
+	}
+	if cfg.Dump.Grants {
+		v.addf("source grants are not supported by a copy, it has no files")
+	}
+	if cfg.Dump.FileMode != 0 || cfg.Dump.DirMode != 0 || cfg.Dump.Chown != "" {
+		v.addf("source file modes and chown are not supported by a copy, it has no files")
+	}
+	// The restore options which need all the files of the dump at once, the
+	// memory is bounded by the pipe.
+	unsupported := []struct {
+		name string
+		set  bool
+	}{
+		{"schema version", cfg.Load.SchemaVersion != ""},
+		{"filter", cfg.Load.Filter != ""},
+		{"recent chunks", cfg.Load.RecentChunks > 0},
+		{"expect tables", len(cfg.Load.ExpectTables) > 0},
+		{"fail on incompat", cfg.Load.FailOnIncompat},
+		{"txn batch size", cfg.Load.TxnBatchSize > 1},
+		{"small file batch", cfg.Load.SmallFileBatch > 1},
+		{"max threads per database", cfg.Load.MaxThreadsPerDatabase > 0},
+		{"table threads", len(cfg.Load.TableThreads) > 0},
+		{"max in flight bytes", cfg.Load.MaxInFlightBytes > 0},
+		{"max open files", cfg.Load.MaxOpenFiles > 0},
+		{"rollback file", cfg.Load.RollbackFile != ""},
+		{"resume file", cfg.Load.ResumeFile != ""},
+		{"max runtime", cfg.Load.MaxRuntime > 0},
+		{"targets", len(cfg.Load.Targets) > 0},
+		{"expand source", cfg.Load.ExpandSource},
+		{"upsert", cfg.Load.Upsert},
+		{"fill missing columns", cfg.Load.FillMissingColumns},
+		{"check utf8", cfg.Load.CheckUTF8 != ""},
+		{"preserve auto increment", cfg.Load.PreserveAutoIncrement},
+		{"verify checksums", cfg.Load.VerifyChecksums},
+		{"defer constraints", cfg.Load.DeferConstraints},
+		{"warm tables", len(cfg.Load.WarmTables) > 0},
+		{"optimize tables", len(cfg.Load.OptimizeTables) > 0},
+		{"replica lag address", cfg.Load.ReplicaLagAddress != ""},
+		{"files", len(cfg.Load.Files) > 0},
+		{"incrementals", len(cfg.Load.Incrementals) > 0},
+		{"allow pipes", cfg.Load.AllowPipes},
+		{"grants", cfg.Load.Grants},
+		{"pre table hook", cfg.Load.PreTableHookCommand != ""},
+		{"post table hook", cfg.Load.PostTableHookCommand != ""},
+		{"post sql", len(cfg.Load.PostSQL)+len(cfg.Load.PostSQLOnFailure) > 0},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			v.addf("target %s is not supported by a copy, the files are restored as they are dumped", option.name)
+		}
+	}
+	return v.err()
+}
+
+// Validate checks the arguments before any connection is made and returns a
+// *ValidationError with all the problems found.
+func (args *BenchArgs) Validate() error {
+	v := &validator{}
+	v.required("user", args.User)
+	v.addresses(args.Address)
+	v.required("database", args.Database)
+	if args.Rows < 1 {
+		v.addf("rows must be positive, got %d", args.Rows)
+	}
+	v.between("row width", args.RowWidth, 1, maxBenchRowWidth)
+	v.between("chunksize(MB)", args.ChunksizeInMB, 1, maxChunksizeInMB)
+	v.between("statement size", args.StmtSize, 1, maxStmtSize)
+	if len(args.Threads) == 0 {
+		v.addf("threads must not be empty")
+	}
+	for _, threads := range args.Threads {
+		v.between("threads", threads, 1, MaxThreads)
+	}
+	if args.IntervalMs <= 0 {
+		v.addf("interval(ms) must be positive, got %d", args.IntervalMs)
+	}
+	return v.err()
+}
@@ -0,0 +1,668 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateDumpArgs(t *testing.T) {
+	dir := "/tmp/validatedumptest"
+	os.RemoveAll(dir)
+
+	args := &DumpArgs{
+		User:          "mock",
+		Address:       "127.0.0.1:3306",
+		Database:      "test",
+		Outdir:        dir,
+		Threads:       16,
+		ChunksizeInMB: 128,
+		StmtSize:      1000000,
+		IntervalMs:    1000,
+	}
+
+	// Outdir not exists.
+	{
+		err := args.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{`outdir "/tmp/validatedumptest" does not exist, create it or use -force-mkdir`}, err.(*ValidationError).Problems)
+	}
+
+	// Force mkdir, the run creates it.
+	{
+		args.ForceMkdir = true
+		err := args.Validate()
+		assert.Nil(t, err)
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err))
+		assert.Nil(t, args.makeOutdir())
+		_, err = os.Stat(dir)
+		assert.Nil(t, err)
+		assert.Nil(t, args.Validate())
+	}
+
+	// All problems together.
+	{
+		bad := *args
+		bad.User = ""
+		bad.Address = "127.0.0.1:mysql"
+		bad.Threads = 0
+		bad.ChunksizeInMB = -1
+		bad.StmtSize = 0
+		bad.SchemaThreads = -1
+		bad.AddDropTable = true
+		bad.IfNotExists = true
+		bad.Table = "t1,t2"
+		bad.Partitions = map[string][]string{"test.t1": {"p1", ""}, "test.t3": {"p1"}, "other.t1": {"p1"}, "t1": nil}
+		bad.ChunkBy = map[string]ChunkColumn{"test.t1": {Column: "created_date", Interval: "week"}, "test.t2": {Interval: "-5"}, "test.t3": {Column: "id", Interval: "1000"}}
+		bad.ChunkRows = -1
+		bad.SubsetSeeds = map[string]string{"test.t1": "id < 10", "test.t3": "id = 1", "other.t2": " "}
+		bad.SubsetMaxRows = -1
+		bad.SmokeTest = true
+		bad.Checksum = true
+		bad.Resume = true
+		bad.Format = "json"
+		bad.FileTrailers = true
+		bad.MaxReplicaLag = -1
+		bad.LagAction = "wait"
+		bad.Consistency = "snapshot"
+		bad.LockMode = "backup"
+		bad.Paranoid = true
+		bad.SchemaChangeRetries = -1
+		bad.LockWaitTimeout = -1
+		bad.MaxRuntime = -time.Second
+		bad.Retention = -time.Hour
+		bad.IntervalMs = 0
+		bad.StatusToken = "s3cret"
+		bad.FileMode = 04640
+		bad.DirMode = 01777
+		bad.Chown = "backup"
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"user is required",
+			`address "127.0.0.1:mysql" has an invalid port, it must be between 1 and 65535`,
+			"file mode must be permission bits like 0640, got 04640",
+			"dir mode must be permission bits like 0750, got 01777",
+			`chown owner "backup" is not uid:gid`,
+			"threads must be between 1 and 1024, got 0",
+			"chunksize(MB) must be between 1 and 1048576, got -1",
+			"statement size must be between 1 and 1073741824, got 0",
+			"schema threads must be between 0 and 1024, got -1",
+			"add drop table and if not exists can not be set together",
+			`partitions table "other.t1" must be a table of the database "test"`,
+			`partitions table "t1" must be 'db.table'`,
+			`partitions of "t1" must not be empty`,
+			`partition "" of "test.t1" must be a partition name`,
+			`partitions table "test.t3" is not a dumped table`,
+			`chunk by interval of "test.t1" must be hour, day, month, year or a positive number, got "week"`,
+			`chunk by column of "test.t2" must not be empty`,
+			`chunk by interval of "test.t2" must be hour, day, month, year or a positive number, got "-5"`,
+			`chunk by table "test.t3" is not a dumped table`,
+			"chunk rows must not be negative, got -1",
+			`subset seed table "other.t2" must be a table of the database "test"`,
+			`subset seed of "other.t2" must have a WHERE clause`,
+			`subset seed table "test.t3" is not a dumped table`,
+			"subset seeds can not be combined with partitions, the subset is walked on the whole tables",
+			"checksum can not be recorded for a subset, the CHECKSUM TABLE is the one of all the rows",
+			"resume is not supported with subset seeds, the subset is walked again by every run",
+			"subset max rows must not be negative, got -1",
+			"smoke test can not be combined with resume, volumes or subset seeds, it writes a file of the first 1000 rows of every table",
+			`format must be sql, csv or jsonl, got "json"`,
+			"file trailers require format sql, the comments would be rows of json",
+			"max replica lag must not be negative, got -1",
+			`lag action must be pause or abort, got "wait"`,
+			`consistency must be none, lock or gtid, got "snapshot"`,
+			`lock mode must be auto, ftwrl, backup-lock or none, got "backup"`,
+			"paranoid requires consistency lock or gtid, the tables are read again in the snapshot of their rows",
+			"schema change retries must not be negative, got -1",
+			"lock wait timeout must not be negative, got -1",
+			"max runtime must not be negative, got -1s",
+			"retention must not be negative, got -1h0m0s",
+			"interval(ms) must be positive, got 0",
+			"status token requires status listen, it's the token of its POSTs",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+
+	// Bad port, outdir is a file.
+	{
+		file := dir + "/file"
+		x := WriteFile(file, "")
+		AssertNil(x)
+		bad := *args
+		bad.Address = "127.0.0.1:99999"
+		bad.Outdir = file
+		bad.Threads = MaxThreads + 1
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			`address "127.0.0.1:99999" has an invalid port, it must be between 1 and 65535`,
+			`outdir "/tmp/validatedumptest/file" is not a directory`,
+			"threads must be between 1 and 1024, got 1025",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+
+	// Incremental dumps.
+	{
+		ok := *args
+		ok.Consistency = ConsistencyGTID
+		ok.IncrementalFrom = "/backups/full"
+		ok.IncrementalColumns = map[string]string{"test.t1": "updated_at"}
+		assert.Nil(t, ok.Validate())
+
+		bad := *args
+		bad.Table = "t1"
+		bad.IncrementalFrom = "/backups/full"
+		bad.IncrementalColumns = map[string]string{"test.t1": " ", "test.t2": "updated_at", "other.t1": "updated_at", "t1": "id"}
+		bad.Resume = true
+		bad.SmokeTest = true
+		bad.Checksum = true
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"incremental from requires consistency lock or gtid, the next incremental is from the gtid set of its snapshot",
+			"resume is not supported with incremental from, the tables of the checkpoint are older than the snapshot",
+			"incremental from can not be combined with subset seeds or smoke test",
+			`incremental column table "other.t1" must be a table of the database "test"`,
+			`incremental column table "t1" must be 'db.table'`,
+			`incremental column of "test.t1" must not be empty`,
+			`incremental column table "test.t2" is not a dumped table`,
+			"checksum can not be recorded with incremental columns, the CHECKSUM TABLE is the one of all the rows",
+			"smoke test can not be combined with resume, volumes or subset seeds, it writes a file of the first 1000 rows of every table",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+
+		bad = *args
+		bad.IncrementalColumns = map[string]string{"test.t1": "updated_at"}
+		err = bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"incremental columns require incremental from, they select the rows changed since it"}, err.(*ValidationError).Problems)
+	}
+
+	// Volumes in the outdir.
+	{
+		inside := dir + "/vol1"
+		x := os.MkdirAll(inside, 0755)
+		AssertNil(x)
+		outside := "/tmp/validatedumptest-vol2"
+		x = os.MkdirAll(outside, 0755)
+		AssertNil(x)
+		defer os.RemoveAll(outside)
+
+		ok := *args
+		ok.Volumes = []Volume{{Path: outside, Budget: 1}}
+		assert.Nil(t, ok.Validate())
+
+		bad := *args
+		bad.Volumes = []Volume{{Path: dir + "/", Budget: 1}, {Path: inside + "/../vol1", Budget: 1}, {Path: outside, Budget: 1}}
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			`volume "/tmp/validatedumptest/" must not be the outdir or inside it, its files would be listed as the ones of the outdir too`,
+			`volume "/tmp/validatedumptest/vol1/../vol1" must not be the outdir or inside it, its files would be listed as the ones of the outdir too`,
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+
+	// Format jsonl.
+	{
+		ok := *args
+		ok.Format = FormatJSONL
+		assert.Nil(t, ok.Validate())
+
+		bad := ok
+		bad.Checksum = true
+		bad.FileTrailers = true
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"file trailers require format sql, the comments would be rows of jsonl",
+			"checksum can not be recorded with format jsonl, the CHECKSUM TABLE is verified by a load of its rows, which restores sql only",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+}
+
+func TestValidateLoadArgs(t *testing.T) {
+	args := &LoadArgs{
+		User:       "mock",
+		Address:    "localhost:3306",
+		Outdir:     "/tmp",
+		Threads:    16,
+		IntervalMs: 1000,
+	}
+
+	{
+		err := args.Validate()
+		assert.Nil(t, err)
+	}
+
+	{
+		ok := *args
+		ok.MetricsListen = ":9104"
+		err := ok.Validate()
+		assert.Nil(t, err)
+	}
+
+	// The addresses of an HA pair.
+	{
+		ok := *args
+		ok.Address = "db1:3306, db2:3306"
+		err := ok.Validate()
+		assert.Nil(t, err)
+
+		bad := *args
+		bad.Address = "db1:3306,db1,db2:3306:1"
+		err = bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			`address "db1" is listed twice`,
+			`address "db2:3306:1" is not host:port nor an IPv6 address, an IPv6 address with a port must be '[v6::addr]:port'`,
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+
+		bad.Address = " , "
+		err = bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"address is required"}, err.(*ValidationError).Problems)
+	}
+
+	// The warnings are only read with CaptureWarnings.
+	{
+		bad := *args
+		bad.WarningsAsErrors = true
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"warnings as errors requires capture warnings, the warnings are only read with it"}, err.(*ValidationError).Problems)
+
+		bad = *args
+		bad.CaptureWarnings = true
+		bad.WarningsThreshold = 10
+		err = bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"warnings threshold requires warnings as errors, it's the warnings of a table failing its file"}, err.(*ValidationError).Problems)
+	}
+
+	// Only a lock can be forced.
+	{
+		bad := *args
+		bad.ForceLock = true
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"force lock requires lock, it's the lock held by another restore it overrides"}, err.(*ValidationError).Problems)
+	}
+
+	// The status token is the one of the status.
+	{
+		bad := *args
+		bad.StatusToken = "s3cret"
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"status token requires status listen, it's the token of its POSTs"}, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.SmallFileBatch = 64
+		bad.TxnBatchSize = 8
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"small file batch and txn batch size can not be set together"}, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.Address = ":3306"
+		bad.Outdir = "/xxu01/dump"
+		bad.TxnBatchSize = -1
+		bad.SmallFileMaxBytes = -1
+		bad.MetricsListen = ":99999"
+		bad.ExpectTables = []string{"test", "test.t1", "test.", "a.b.c"}
+		bad.RecentChunks = -1
+		bad.LogSQL = "verbose"
+		bad.LogSQLMaxBytes = -1
+		bad.WarningMessages = -1
+		bad.WarningsThreshold = -1
+		bad.CheckUTF8 = "strict"
+		bad.TuneTarget = "yes"
+		bad.Filter = "size matching 1G"
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			`address ":3306" has no host`,
+			`dump dir "/xxu01/dump": stat /xxu01/dump: no such file or directory`,
+			`filter "size matching 1G" is invalid: size is a number, it can not be MATCHING at 14`,
+			"txn batch size must not be negative, got -1",
+			"small file max bytes must not be negative, got -1",
+			"recent chunks must not be negative, got -1",
+			`expected table "test." must be 'db' or 'db.table'`,
+			`expected table "a.b.c" must be 'db' or 'db.table'`,
+			`log sql must be none, ddl or all, got "verbose"`,
+			"log sql max bytes must not be negative, got -1",
+			"warning messages must not be negative, got -1",
+			"warnings threshold must not be negative, got -1",
+			`check utf8 must be warn or abort, got "strict"`,
+			`tune target must be on or dry-run, got "yes"`,
+			`metrics listen ":99999" has an invalid port, it must be between 0 and 65535`,
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.SchemaThreads = 2000
+		bad.DataThreads = -1
+		bad.PostThreads = 2000
+		bad.MaxThreadsPerDatabase = -1
+		bad.MaxInFlightBytes = -1
+		bad.MaxMemory = -1
+		bad.MaxOpenFiles = -1
+		bad.MaxBytesPerSec = -1
+		bad.MaxRowsPerSec = -1
+		bad.WarmTables = []string{"test.t1", "test", "a.b.c"}
+		bad.WarmThreads = -1
+		bad.OptimizeTables = []string{"test.t1", "all", "test"}
+		bad.OptimizeThreads = -1
+		bad.PostSQLDatabase = "a`b"
+		bad.DefinerUser = "app"
+		bad.GrantsExisting = "drop"
+		bad.Compat = "vitess"
+		bad.TxnMaxStatements = -1
+		bad.TxnMaxTimeMs = -1
+		bad.ReplicaLagAddress = "[replica]:3306"
+		bad.ReadOnlyMaxWait = -1
+		bad.Rewrites = []string{"utf8mb3-to-utf8mb4", "latin1-to-utf8mb4"}
+		bad.UpgradeCollations = map[string]string{"utf8_general_ci": "utf8mb4_0900_ai_ci", "latin1_bin": "utf8mb4_bin", "utf8mb3_bin": "binary"}
+		bad.UpgradeKeyBytes = -1
+		bad.DefaultCollation = "utf8mb4"
+		bad.ForceEngine = "InnoDB;"
+		bad.OverwriteTables = true
+		bad.TablePrefix = strings.Repeat("p", 40)
+		bad.TableSuffix = strings.Repeat("s", 24)
+		bad.Targets = map[string]LoadTarget{
+			"default": {User: "mock", Address: "127.0.0.1:3306"},
+			"archive": {Address: "[archive]:3306"},
+		}
+		bad.RollbackFile = "rollback.sql"
+		bad.ResumeFile = "resume.jsonl"
+		bad.CreateIfNotExists = true
+		bad.TableThreads = map[string]int{"test.t1": 1, "test": 2, "test.t2": 0}
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"schema threads must be at most 1024, got 2000",
+			"data threads must be between 0 and 1024, got -1",
+			"post threads must be between 0 and 1024, got 2000",
+			"max threads per database must not be negative, got -1",
+			`table threads table "test" must be 'db.table'`,
+			"table threads of test.t2 must be at least 1, got 0",
+			"max in flight bytes must not be negative, got -1",
+			"max memory must not be negative, got -1",
+			"max open files must not be negative, got -1",
+			"max bytes per sec must not be negative, got -1",
+			"max rows per sec must not be negative, got -1",
+			`compat must be proxy, got "vitess"`,
+			"txn max statements must not be negative, got -1",
+			"txn max time(ms) must not be negative, got -1",
+			`replica lag address "[replica]:3306" has "replica" in brackets which is not an IPv6 address`,
+			"max replica lag must be positive with a replica lag address, got 0",
+			"replica lag address is not supported with targets, the targets have replicas of their own",
+			"read only max wait must not be negative, got -1",
+			`rewrite "latin1-to-utf8mb4" is unknown, the builtins are qualify-tables, utf8mb3-to-utf8mb4`,
+			`upgrade collation "latin1_bin" must be a utf8 or utf8mb3 collation`,
+			`upgrade collation of utf8mb3_bin must be a utf8mb4 collation, got "binary"`,
+			"upgrade key bytes must not be negative, got -1",
+			`default collation must be a collation name like utf8mb4_0900_ai_ci, got "utf8mb4"`,
+			`force engine must be an engine name, got "InnoDB;"`,
+			"overwrite tables and create if not exists can not be set together",
+			"table prefix and suffix must be shorter than 64 bytes together, got 64",
+			"target archive user is required",
+			`target archive address "[archive]:3306" has "archive" in brackets which is not an IPv6 address`,
+			`target name "default" is reserved for the address`,
+			"rollback file is not supported with targets, it would mix the tables of the servers",
+			"resume file is not supported with targets, it would mix the files of the servers",
+			`warm table "test" must be 'db.table'`,
+			`warm table "a.b.c" must be 'db.table'`,
+			"warm threads must not be negative, got -1",
+			`optimize tables "all" must be alone`,
+			`optimize table "test" must be 'db.table' or "all"`,
+			"optimize threads must not be negative, got -1",
+			"post sql database \"a`b\" must be a database name",
+			"post sql database requires post sql scripts",
+			`grants existing must be skip or update, got "drop"`,
+			`definer user "app" must be 'user@host'`,
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.VerifyChecksums = true
+		bad.RecentChunks = 2
+		bad.Replacements = []Replacement{{Find: "a", Replace: "b"}}
+		bad.Upsert = true
+		bad.FillMissingColumns = true
+		bad.CheckTables = true
+		bad.ForceTableCollation = true
+		bad.MaxReplicaLag = 30
+		bad.SkipBinlog = true
+		bad.ManagedMode = true
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"verify checksums can not check a restore of the recent chunks only",
+			"verify checksums can not check a restore with replacements, the datas differ",
+			"verify checksums can not check an upsert restore, the tables have rows of their own",
+			"verify checksums can not check a restore with filled columns, the tables have columns of their own",
+			"skip binlog can not be set with managed mode, SET sql_log_bin needs SUPER",
+			"check tables requires defer constraints, it runs in its validation pass",
+			"max replica lag needs a replica lag address",
+			"force table collation needs a default collation",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.FillValues = map[string]string{"datetime": "'2000-01-01 00:00:00'"}
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"fill values require fill missing columns, they are its placeholders"}, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.Resume = true
+		bad.MaxRuntime = 4 * time.Hour
+		bad.MaxRuntimeGrace = -time.Minute
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"resume requires a resume file, it records what the previous restore did",
+			"max runtime grace must not be negative, got -1m0s",
+			"max runtime requires a resume file, the restore it stops could not go on",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.Files = []string{"test.t1.00001.sql"}
+		bad.VerifyChecksums = true
+		bad.Filter = "table != t2"
+		bad.RecentChunks = 1
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"verify checksums can not check a restore of the recent chunks only",
+			"verify checksums can not check a restore of some files only",
+			"files and filter can not be set together",
+			"files and recent chunks can not be set together",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+
+		bad = *args
+		bad.Files = []string{"metadata"}
+		err = bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{`file "metadata" is not a data file named 'db.table[.part].sql'`}, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.PipeReopenCommand = "feed-pipe.sh"
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"pipe reopen command requires allow pipes, only a pipe is read again"}, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.Placement = "hash"
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			`placement must be round-robin or file, got "hash"`,
+			"placement requires targets, it places the databases on them",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+
+		bad = *args
+		bad.Placement = PlacementFile
+		bad.Targets = map[string]LoadTarget{"small2": {User: "mock", Address: "10.0.0.2:3306"}}
+		err = bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{`placement "file" requires a placement file`}, err.(*ValidationError).Problems)
+
+		bad = *args
+		bad.PlacementFile = "placement.txt"
+		bad.Targets = map[string]LoadTarget{"small2": {User: "mock", Address: "10.0.0.2:3306"}}
+		err = bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{`placement file is only read with placement "file"`}, err.(*ValidationError).Problems)
+	}
+
+	{
+		bad := *args
+		bad.MaxBytesPerSec = 1 << 20
+		bad.MaxRowsPerSec = 1000
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		assert.Equal(t, []string{"max bytes per sec and max rows per sec can not be set together"}, err.(*ValidationError).Problems)
+	}
+
+	// Incremental restores.
+	{
+		ok := *args
+		ok.Incrementals = []string{"/tmp", "/tmp"}
+		assert.Nil(t, ok.Validate())
+
+		bad := *args
+		bad.Incrementals = []string{"/tmp/validateloadtest-none", "ftp://backups/inc1"}
+		bad.Files = []string{"test.t1.00001.sql"}
+		bad.ResumeFile = "/tmp/resume.json"
+		bad.VerifyChecksums = true
+		err := bad.Validate()
+		assert.NotNil(t, err)
+		want := []string{
+			"verify checksums can not check a restore of some files only",
+			`incremental "/tmp/validateloadtest-none": stat /tmp/validateloadtest-none: no such file or directory`,
+			`incremental "ftp://backups/inc1" has an unknown storage scheme "ftp"`,
+			"incrementals and files can not be set together",
+			"incrementals and resume file can not be set together",
+			"incrementals and verify checksums can not be set together",
+		}
+		assert.Equal(t, want, err.(*ValidationError).Problems)
+	}
+}
+
+func TestValidateCopyConfig(t *testing.T) {
+	cfg := &CopyConfig{
+		Dump: DumpArgs{User: "mock", Address: "127.0.0.1:3306", Database: "test", Threads: 4, ChunksizeInMB: 128, StmtSize: 1000000, IntervalMs: 1000},
+		Load: LoadArgs{User: "mock", Address: "127.0.0.2:3306", Threads: 4, IntervalMs: 1000},
+	}
+	assert.Nil(t, cfg.Validate())
+
+	bad := *cfg
+	bad.Dump.Database = ""
+	bad.Dump.Format = FormatCSV
+	bad.Load.Threads = 0
+	bad.Load.Upsert = true
+	bad.Load.FillMissingColumns = true
+	bad.Load.TxnBatchSize = 8
+	bad.Load.MaxRuntime = time.Hour
+	bad.Load.ResumeFile = "resume.jsonl"
+	bad.Load.PostSQLOnFailure = []string{"alert.sql"}
+	bad.Dump.MaxRuntime = time.Hour
+	err := bad.Validate()
+	assert.NotNil(t, err)
+	want := []string{
+		"source database is required",
+		"target threads must be between 1 and 1024, got 0",
+		"source format must be sql for a copy, got \"csv\"",
+		"source max runtime is not supported by a copy, it has no files to resume from",
+		"target txn batch size is not supported by a copy, the files are restored as they are dumped",
+		"target resume file is not supported by a copy, the files are restored as they are dumped",
+		"target max runtime is not supported by a copy, the files are restored as they are dumped",
+		"target upsert is not supported by a copy, the files are restored as they are dumped",
+		"target fill missing columns is not supported by a copy, the files are restored as they are dumped",
+		"target post sql is not supported by a copy, the files are restored as they are dumped",
+	}
+	assert.Equal(t, want, err.(*ValidationError).Problems)
+}
+
+func TestValidateStreamConfig(t *testing.T) {
+	cfg := &StreamConfig{User: "mock", Address: "127.0.0.1:3306", Threads: 4}
+	assert.Nil(t, cfg.Validate())
+
+	bad := *cfg
+	bad.User = ""
+	bad.Threads = 0
+	err := bad.Validate()
+	assert.NotNil(t, err)
+	want := []string{
+		"user is required",
+		"threads must be between 1 and 1024, got 0",
+	}
+	assert.Equal(t, want, err.(*ValidationError).Problems)
+}
+
+func TestValidateBenchArgs(t *testing.T) {
+	args := &BenchArgs{User: "mock", Address: "127.0.0.1:3306", Database: "scratch", Rows: 1000, RowWidth: 200, ChunksizeInMB: 8, StmtSize: 1000000, Threads: []int{1, 4}, IntervalMs: 10000}
+	assert.Nil(t, args.Validate())
+
+	bad := *args
+	bad.Database = ""
+	bad.Rows = 0
+	bad.RowWidth = 65535
+	bad.Threads = []int{4, 0}
+	err := bad.Validate()
+	assert.NotNil(t, err)
+	want := []string{
+		"database is required",
+		"rows must be positive, got 0",
+		"row width must be between 1 and 60000, got 65535",
+		"threads must be between 1 and 1024, got 0",
+	}
+	assert.Equal(t, want, err.(*ValidationError).Problems)
+
+	bad = *args
+	bad.Threads = nil
+	err = bad.Validate()
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"threads must not be empty"}, err.(*ValidationError).Problems)
+}
@@ -0,0 +1,85 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// Verify checks the layout of a dump directory without any connection:
+// every data file must parse as 'db.table[.part].sql' and have a schema file,
+// and every schema file must have its database schema-create file.
+// The data files of a dump spread on volumes are searched on the volumes of
+// its manifest.json.
+func Verify(log *xlog.Log, dir string) error {
+	storage, err := openDumpStorage(log, dir, nil)
+	if err != nil {
+		return err
+	}
+	files, err := loadFiles(storage)
+	if err != nil {
+		return err
+	}
+	notDumpedMarker(storage, files)
+
+	problems := layoutProblems(files)
+	log.Info("verify.dir[%s].databases[%d].schemas[%d].tables[%d].problems[%d]", dir, len(files.databases), len(files.schemas), len(files.tables), len(problems))
+	if len(problems) > 0 {
+		return fmt.Errorf("verify.dir[%s].failed:\n  %s", dir, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// layoutProblems returns the problems of the layout of the files of a dump,
+// see Verify.
+func layoutProblems(files *Files) []string {
+	var problems []string
+	dbs := make(map[string]bool)
+	for _, db := range files.databases {
+		dbs[strings.TrimSuffix(filepath.Base(db), dbSuffix)] = true
+	}
+	if len(dbs) == 0 {
+		problems = append(problems, fmt.Sprintf("no '*%s' database files found", dbSuffix))
+	}
+
+	schemas := make(map[string]bool)
+	for _, schema := range files.schemas {
+		name := strings.TrimSuffix(filepath.Base(schema), schemaSuffix)
+		splits := strings.Split(name, ".")
+		if len(splits) != 2 {
+			problems = append(problems, fmt.Sprintf("schema file %s is not named 'db.table%s'", schema, schemaSuffix))
+			continue
+		}
+		if !dbs[splits[0]] {
+			problems = append(problems, fmt.Sprintf("schema file %s references database %s which has no schema-create file", schema, splits[0]))
+		}
+		schemas[name] = true
+	}
+
+	for _, name := range files.partials {
+		problems = append(problems, fmt.Sprintf("partial marker %s, the dump was still running or failed", name))
+	}
+
+	for _, table := range files.tables {
+		db, tbl, _, err := ParseTableFile(table)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("data file %s is not named 'db.table[.part]%s'", table, tableSuffix))
+			continue
+		}
+		if !schemas[db+"."+tbl] {
+			problems = append(problems, fmt.Sprintf("data file %s has no schema file %s.%s%s", table, db, tbl, schemaSuffix))
+		}
+	}
+	return problems
+}
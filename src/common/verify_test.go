@@ -0,0 +1,62 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.INFO))
+	dir := "/tmp/verifytest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+
+	x = WriteFile(dir+"/test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int(11));\n")
+	AssertNil(x)
+	x = WriteFile(dir+"/test.t1.00001.sql", "INSERT INTO `t1`(`a`) VALUES\n(1);\n")
+	AssertNil(x)
+
+	// Good.
+	{
+		err := Verify(log, dir)
+		assert.Nil(t, err)
+	}
+
+	// Missing schema and database.
+	{
+		x = WriteFile(dir+"/test.t2.00001.sql", "INSERT INTO `t2`(`a`) VALUES\n(1);\n")
+		AssertNil(x)
+		x = WriteFile(dir+"/other.t1-schema.sql", "CREATE TABLE `t1` (`a` int(11));\n")
+		AssertNil(x)
+
+		err := Verify(log, dir)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "test.t2.00001.sql has no schema file test.t2-schema.sql"))
+		assert.True(t, strings.Contains(err.Error(), "references database other which has no schema-create file"))
+	}
+
+	// A partial marker.
+	{
+		x = WriteFile(dir+"/metadata.partial", "Started dump at: 2017-10-13 10:11:12\n")
+		AssertNil(x)
+		err := Verify(log, dir)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "partial marker metadata.partial, the dump was still running or failed"))
+	}
+}
@@ -0,0 +1,43 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The build metadata, injected by the makefile:
+//
+//	go build -ldflags "-X common.GitCommit=... -X common.BuildDate=..."
+//
+// A plain 'go build' keeps the fallback values.
+var (
+	Version   = "0.2.0"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+// VersionString returns the one line version with the build metadata.
+func VersionString() string {
+	return fmt.Sprintf("go-mydumper %s (commit %s, built %s, %s)", Version, GitCommit, BuildDate, runtime.Version())
+}
+
+// majorVersion returns the major of a semantic version like 'v1.2.3', -1 if it can't be parsed.
+func majorVersion(version string) int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return -1
+	}
+	return major
+}
@@ -0,0 +1,361 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// Volume is a directory, or a 'scheme://...' location, a dump spreads its
+// data files on, see DumpArgs.Volumes.
+type Volume struct {
+	Path string
+	// Budget is the most bytes of data files kept on the volume.
+	Budget int64
+}
+
+// ParseVolume parses a volume as PATH=SIZE, the size in bytes or with a K,
+// M, G or T suffix (powers of 1024), like '/mnt/nfs1=2T'.
+func ParseVolume(s string) (Volume, error) {
+	i := strings.LastIndex(s, "=")
+	if i <= 0 {
+		return Volume{}, fmt.Errorf("volume %q must be PATH=SIZE", s)
+	}
+	budget, err := parseSize(s[i+1:])
+	if err != nil {
+		return Volume{}, fmt.Errorf("volume %q: %v", s, err)
+	}
+	return Volume{Path: s[:i], Budget: budget}, nil
+}
+
+// parseSize parses a size in bytes, with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	unit := int64(1)
+	if n := len(s); n > 0 {
+		if u, ok := units[s[n-1]&^0x20]; ok {
+			unit = u
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("size %q must be a positive number of bytes, K, M, G or T", s)
+	}
+	return n * unit, nil
+}
+
+// formatSize formats a number of bytes with the largest unit of parseSize.
+func formatSize(n int64) string {
+	for _, u := range []struct {
+		suffix string
+		size   int64
+	}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= u.size {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(u.size), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+// volumeFile reports whether a file of the dump goes on a volume: the data
+// files do, the database and table schemas and the files describing the
+// dump stay in the main storage.
+func volumeFile(name string) bool {
+	switch name {
+	case metaFile, manifestFile, statsFile, checkpointFile, compatibilityFile, grantsFile, runConfigFile:
+		return false
+	}
+	return !strings.HasSuffix(name, dbSuffix) && !strings.HasSuffix(name, schemaSuffix) && !strings.HasSuffix(name, jsonlColumnsSuffix)
+}
+
+// dataFileTable returns the database and the table of a data file named
+// 'db.table.00001.suffix', in any format.
+func dataFileTable(name string) (db string, table string) {
+	splits := strings.Split(filepath.Base(name), ".")
+	if len(splits) < 3 {
+		return "", ""
+	}
+	return splits[0], splits[1]
+}
+
+// volume is a Volume of a volumeStorage.
+type volume struct {
+	Volume
+	storage Storage
+	used    int64
+}
+
+// volumeStorage is the storage of a dump spread on volumes: the data files
+// are on the volumes, the other files in the main storage. A new data file
+// goes on the volume with the most budget left which has room for it, a data
+// file written again stays on its volume. The files found on the volumes when
+// it's opened count in their budgets.
+type volumeStorage struct {
+	main Storage
+
+	mu      sync.Mutex
+	volumes []*volume
+	files   map[string]*volume
+	sizes   map[string]int64
+	// full is the first data file which had room on no volume, and its size.
+	full     string
+	fullSize int64
+}
+
+// newVolumeStorage opens the volumes and lists their files.
+func newVolumeStorage(main Storage, volumes []Volume) (*volumeStorage, error) {
+	s := &volumeStorage{main: main, files: make(map[string]*volume), sizes: make(map[string]int64)}
+	for _, vol := range volumes {
+		storage, err := OpenStorage(vol.Path)
+		if err != nil {
+			return nil, err
+		}
+		v := &volume{Volume: vol, storage: storage}
+		names, err := storage.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !volumeFile(name) || tempFile(name) {
+				continue
+			}
+			if other, ok := s.files[name]; ok {
+				return nil, fmt.Errorf("volume.file[%s].on.volumes[%s,%s]", name, other.Path, vol.Path)
+			}
+			info, err := storage.Stat(name)
+			if err != nil {
+				return nil, err
+			}
+			s.files[name] = v
+			s.sizes[name] = info.Size()
+			v.used += info.Size()
+		}
+		s.volumes = append(s.volumes, v)
+	}
+	return s, nil
+}
+
+// List returns the files of the main storage and of the volumes, sorted.
+func (s *volumeStorage) List() ([]string, error) {
+	names, err := s.main.List()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	for name := range s.files {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *volumeStorage) Open(name string) (io.ReadCloser, error) {
+	return s.storage(name).Open(name)
+}
+
+// Create creates a file of the main storage, or buffers a data file which
+// is written on its volume once closed.
+func (s *volumeStorage) Create(name string) (io.WriteCloser, error) {
+	if !volumeFile(name) {
+		return s.main.Create(name)
+	}
+	return &volumeWriter{storage: s, name: name}, nil
+}
+
+func (s *volumeStorage) Stat(name string) (os.FileInfo, error) {
+	return s.storage(name).Stat(name)
+}
+
+// storage returns the storage a file is on, the main one if it's on no volume.
+func (s *volumeStorage) storage(name string) Storage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.files[name]; ok {
+		return v.storage
+	}
+	return s.main
+}
+
+// place picks the volume of a data file of size bytes and takes its room.
+func (s *volumeStorage) place(name string, size int64) (*volume, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.files[name]; ok {
+		v.used += size - s.sizes[name]
+		s.sizes[name] = size
+		return v, nil
+	}
+	var pick *volume
+	for _, v := range s.volumes {
+		if free := v.Budget - v.used; free >= size && (pick == nil || free > pick.Budget-pick.used) {
+			pick = v
+		}
+	}
+	if pick == nil {
+		if s.full == "" {
+			s.full, s.fullSize = name, size
+		}
+		return nil, fmt.Errorf("volumes.full.file[%s].size[%s]", name, formatSize(size))
+	}
+	pick.used += size
+	s.files[name] = pick
+	s.sizes[name] = size
+	return pick, nil
+}
+
+// unplace gives back the room of a data file which could not be written.
+func (s *volumeStorage) unplace(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.files[name]; ok {
+		v.used -= s.sizes[name]
+		delete(s.files, name)
+		delete(s.sizes, name)
+	}
+}
+
+// volumeFiles returns the volume path of every data file which keep says
+// belongs to the dump.
+func (s *volumeStorage) volumeFiles(keep func(name string) bool) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := make(map[string]string)
+	for name, v := range s.files {
+		if keep(name) {
+			files[name] = v.Path
+		}
+	}
+	return files
+}
+
+// fullError returns the error of a dump stopped by full volumes, with the
+// room still needed for the tables not dumped: their DATA_LENGTH estimate
+// less the room of their data files already written, which they get back
+// when they are dumped again, and the budget left. It's nil if the volumes
+// never were full.
+func (s *volumeStorage) fullError(log *xlog.Log, conn *Connection, db string, tables []string) error {
+	s.mu.Lock()
+	full, fullSize := s.full, s.fullSize
+	s.mu.Unlock()
+	if full == "" {
+		return nil
+	}
+
+	var estimate int64
+	if len(tables) > 0 {
+		var names []string
+		for _, table := range tables {
+			names = append(names, fmt.Sprintf("'%s'", EscapeBytes([]byte(table))))
+		}
+		qr, err := conn.Fetch(fmt.Sprintf("SELECT SUM(DATA_LENGTH) FROM information_schema.TABLES WHERE TABLE_SCHEMA='%s' AND TABLE_NAME IN (%s)", EscapeBytes([]byte(db)), strings.Join(names, ",")))
+		if err != nil {
+			log.Warning("dumping.volumes.full.estimate.error:%v", err)
+		} else if len(qr.Rows) > 0 && len(qr.Rows[0]) > 0 {
+			estimate, _ = strconv.ParseInt(qr.Rows[0][0].String(), 10, 64)
+		}
+	}
+	s.mu.Lock()
+	var written, free, budget int64
+	pending := make(map[string]bool)
+	for _, table := range tables {
+		pending[table] = true
+	}
+	for name, size := range s.sizes {
+		if d, tbl := dataFileTable(name); d == db && pending[tbl] {
+			written += size
+		}
+	}
+	for _, v := range s.volumes {
+		free += v.Budget - v.used
+		budget += v.Budget
+	}
+	s.mu.Unlock()
+	need := estimate - written - free
+	if need < fullSize {
+		need = fullSize
+	}
+	return fmt.Errorf("dumping.volumes.full: the data file %s (%s) has room on no volume, the %d volumes have %s left of %s, "+
+		"%d tables are not dumped, about %s more is needed (estimated from their DATA_LENGTH), add a volume or raise a budget and run again with -resume",
+		full, formatSize(fullSize), len(s.volumes), formatSize(free), formatSize(budget), len(tables), formatSize(need))
+}
+
+type volumeWriter struct {
+	bytes.Buffer
+	storage *volumeStorage
+	name    string
+}
+
+func (w *volumeWriter) Close() error {
+	data := w.String()
+	v, err := w.storage.place(w.name, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	if err := writeFile(v.storage, w.name, data); err != nil {
+		w.storage.unplace(w.name)
+		return err
+	}
+	return nil
+}
+
+// openDumpStorage opens the storage of a dump at location, spread on volumes
+// if its manifest.json records data files on volumes. The volumes are the
+// paths given, else the ones of the manifest. A data file the manifest
+// records which is on no volume fails.
+func openDumpStorage(log *xlog.Log, location string, paths []string) (Storage, error) {
+	main, err := OpenStorage(location)
+	if err != nil {
+		return nil, err
+	}
+	var files map[string]string
+	if m, err := readManifest(main); err == nil {
+		files = m.VolumeFiles
+	}
+	if len(files) == 0 && len(paths) == 0 {
+		return main, nil
+	}
+	if len(paths) == 0 {
+		seen := make(map[string]bool)
+		for _, path := range files {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+	}
+	var volumes []Volume
+	for _, path := range paths {
+		volumes = append(volumes, Volume{Path: path})
+	}
+	s, err := newVolumeStorage(main, volumes)
+	if err != nil {
+		return nil, err
+	}
+	for name, path := range files {
+		if _, ok := s.files[name]; !ok {
+			return nil, fmt.Errorf("volume.file[%s].of.volume[%s].not.found.on.volumes[%s]", name, path, strings.Join(paths, ","))
+		}
+	}
+	log.Info("dump[%s].volumes[%s].files[%d]", location, strings.Join(paths, ","), len(s.files))
+	return s, nil
+}
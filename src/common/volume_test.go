@@ -0,0 +1,156 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolumeParse(t *testing.T) {
+	v, err := ParseVolume("/mnt/nfs1=2T")
+	assert.Nil(t, err)
+	assert.Equal(t, Volume{Path: "/mnt/nfs1", Budget: 2 << 40}, v)
+
+	v, err = ParseVolume("/mnt/a=b=500m")
+	assert.Nil(t, err)
+	assert.Equal(t, Volume{Path: "/mnt/a=b", Budget: 500 << 20}, v)
+
+	v, err = ParseVolume("/mnt/nfs1=1024")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), v.Budget)
+
+	for _, bad := range []string{"/mnt/nfs1", "=2T", "/mnt/nfs1=", "/mnt/nfs1=0", "/mnt/nfs1=2X", "/mnt/nfs1=-1G"} {
+		_, err := ParseVolume(bad)
+		assert.NotNil(t, err)
+	}
+
+	assert.Equal(t, "1.5G", formatSize(3<<29))
+	assert.Equal(t, "100B", formatSize(100))
+}
+
+func TestVolumeStorage(t *testing.T) {
+	dir := "/tmp/volumetest"
+	os.RemoveAll(dir)
+	for _, sub := range []string{"main", "v1", "v2"} {
+		x := os.MkdirAll(dir+"/"+sub, 0777)
+		AssertNil(x)
+	}
+	volumes := []Volume{{Path: dir + "/v1", Budget: 100}, {Path: dir + "/v2", Budget: 60}}
+	s, err := newVolumeStorage(NewDirStorage(dir+"/main"), volumes)
+	assert.Nil(t, err)
+
+	// The schemas stay in the main storage, a data file goes on the volume with the most room left.
+	{
+		assert.Nil(t, writeFile(s, "test-schema-create.sql", "create database"))
+		assert.Nil(t, writeFile(s, "test.t1-schema.sql", "create table"))
+		assert.Nil(t, writeFile(s, "test.t1.00001.sql", strings.Repeat("a", 50)))
+		assert.Nil(t, writeFile(s, "test.t1.00002.sql", strings.Repeat("b", 40)))
+		assert.Nil(t, writeFile(s, "test.t1.00003.sql", strings.Repeat("c", 30)))
+		for _, file := range []string{
+			"main/test-schema-create.sql",
+			"main/test.t1-schema.sql",
+			"v1/test.t1.00001.sql",
+			"v2/test.t1.00002.sql",
+			"v1/test.t1.00003.sql",
+		} {
+			_, err := os.Stat(dir + "/" + file)
+			assert.Nil(t, err)
+		}
+		names, err := s.List()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"test-schema-create.sql", "test.t1-schema.sql", "test.t1.00001.sql", "test.t1.00002.sql", "test.t1.00003.sql"}, names)
+		data, err := readFile(s, "test.t1.00002.sql")
+		assert.Nil(t, err)
+		assert.Equal(t, strings.Repeat("b", 40), string(data))
+	}
+
+	// Written again on its volume, then full.
+	{
+		assert.Nil(t, writeFile(s, "test.t1.00001.sql", strings.Repeat("a", 60)))
+		_, err := os.Stat(dir + "/v2/test.t1.00001.sql")
+		assert.True(t, os.IsNotExist(err))
+		err = writeFile(s, "test.t2.00001.sql", strings.Repeat("d", 30))
+		assert.NotNil(t, err)
+		assert.Equal(t, "test.t2.00001.sql", s.full)
+		files := s.volumeFiles(func(name string) bool { return strings.HasPrefix(name, "test.t1.") })
+		assert.Equal(t, map[string]string{
+			"test.t1.00001.sql": dir + "/v1",
+			"test.t1.00002.sql": dir + "/v2",
+			"test.t1.00003.sql": dir + "/v1",
+		}, files)
+	}
+
+	// Opened again, the files count.
+	{
+		s, err := newVolumeStorage(NewDirStorage(dir+"/main"), volumes)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(90), s.volumes[0].used)
+		assert.Equal(t, int64(40), s.volumes[1].used)
+	}
+
+	// A file on two volumes.
+	{
+		x := WriteFile(dir+"/v2/test.t1.00003.sql", "c")
+		AssertNil(x)
+		_, err := newVolumeStorage(NewDirStorage(dir+"/main"), volumes)
+		assert.NotNil(t, err)
+		os.Remove(dir + "/v2/test.t1.00003.sql")
+	}
+}
+
+func TestVolumeOpenDumpStorage(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	dir := "/tmp/volumeopentest"
+	os.RemoveAll(dir)
+	for _, sub := range []string{"main", "v1", "v2", "moved"} {
+		x := os.MkdirAll(dir+"/"+sub, 0777)
+		AssertNil(x)
+	}
+	x := WriteFile(dir+"/main/test-schema-create.sql", "create database if not exists `test`;")
+	AssertNil(x)
+	x = WriteFile(dir+"/main/test.t1-schema.sql", "CREATE TABLE `t1` (`a` int);")
+	AssertNil(x)
+	x = WriteFile(dir+"/v1/test.t1.00001.sql", "INSERT INTO `t1` VALUES (1);")
+	AssertNil(x)
+	x = WriteFile(dir+"/moved/test.t1.00002.sql", "INSERT INTO `t1` VALUES (2);")
+	AssertNil(x)
+	m := newManifest()
+	m.VolumeFiles = map[string]string{"test.t1.00001.sql": dir + "/v1", "test.t1.00002.sql": dir + "/v2"}
+	assert.Nil(t, m.write(NewDirStorage(dir+"/main")))
+
+	// The volume of a file moved away.
+	{
+		_, err := openDumpStorage(log, dir+"/main", nil)
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), "volume.file[test.t1.00002.sql]"))
+		assert.NotNil(t, Verify(log, dir+"/main"))
+	}
+
+	// The volumes given.
+	{
+		s, err := openDumpStorage(log, dir+"/main", []string{dir + "/v1", dir + "/moved"})
+		assert.Nil(t, err)
+		files, err := loadFiles(s)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"test.t1.00001.sql", "test.t1.00002.sql"}, files.tables)
+	}
+
+	// From the manifest.
+	{
+		x := os.Rename(dir+"/moved/test.t1.00002.sql", dir+"/v2/test.t1.00002.sql")
+		AssertNil(x)
+		assert.Nil(t, Verify(log, dir+"/main"))
+	}
+}
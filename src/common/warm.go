@@ -0,0 +1,122 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// warmPhase is the phase of a load warming LoadArgs.WarmTables, it can be
+// skipped while it runs, see Metrics.skipPhase.
+const warmPhase = "warm"
+
+// warmIndexRegexp matches a secondary index definition, with its quoted name.
+// The FULLTEXT and SPATIAL ones don't match, a COUNT(*) can't scan them.
+var warmIndexRegexp = regexp.MustCompile("(?is)^(?:UNIQUE\\s+)?(?:KEY|INDEX)\\s+(`(?:[^`]|``)*`)")
+
+// warmQueries returns the SELECTs reading the indexes of the table db.table
+// of the create table statement schema: the primary key first, the rows, then
+// every secondary index. A table without primary key is scanned as the server
+// likes.
+func warmQueries(db string, table string, schema string) []string {
+	from := fmt.Sprintf("`%s`.`%s`", db, table)
+	primary := false
+	var indexes []string
+	for _, def := range tableDefinitions(schema) {
+		if _, attrs, ok := columnDefinition(def); ok {
+			if inlinePrimaryKeyRegexp.MatchString(attrs) {
+				primary = true
+			}
+			continue
+		}
+		if primaryKeyRegexp.MatchString(def) {
+			primary = true
+			continue
+		}
+		if match := warmIndexRegexp.FindStringSubmatch(def); match != nil {
+			indexes = append(indexes, fmt.Sprintf("SELECT COUNT(*) FROM %s FORCE INDEX(%s)", from, match[1]))
+		}
+	}
+	scan := "SELECT COUNT(*) FROM " + from
+	if primary {
+		scan += " FORCE INDEX(PRIMARY)"
+	}
+	return append([]string{scan}, indexes...)
+}
+
+// warmTables reads the tables of args.WarmTables into the buffer pool once
+// the restore is done, in their order, with args.WarmThreads connections of
+// the pool. A warm-up is best effort: a table not in the dump or a failed
+// query is a warning. Once the phase is skipped no table is started and the
+// connections are closed, which kills the queries running, the tables not
+// warmed are recorded as skipped and warmTables returns nil.
+func warmTables(ctx context.Context, log *xlog.Log, pool *Pool, args *LoadArgs, schemas []string) error {
+	tables, err := restoredSchemas(log, args, warmPhase, schemas, args.WarmTables)
+	if err != nil {
+		return err
+	}
+	warmCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-args.metrics.skipped(warmPhase):
+			log.Warning("restoring.warm.skipped")
+			cancel()
+		case <-warmCtx.Done():
+		}
+	}()
+
+	forEachTable(warmCtx, pool, args, warmPhase, args.WarmThreads, tables, func(conn *Connection, schema *schemaFile) {
+		if warmCtx.Err() != nil {
+			args.metrics.warmSkipped(schema.key())
+			return
+		}
+		start := time.Now()
+		err := warmTable(conn, args, schema)
+		switch {
+		case warmCtx.Err() != nil:
+			args.metrics.warmSkipped(schema.key())
+		case err != nil:
+			log.Warning("restoring.warm.table[%s].error:%v", schema.key(), err)
+		default:
+			args.metrics.warmDone(schema.key(), time.Since(start))
+			log.Info("restoring.warm.table[%s].done.cost[%.2fsec]", schema.key(), time.Since(start).Seconds())
+		}
+	})
+	return ctx.Err()
+}
+
+// logWarmSummary logs the summary line of the warm-up of a load, none if it
+// warmed nothing.
+func logWarmSummary(log *xlog.Log, action string, seconds map[string]float64, skipped []string) {
+	if len(seconds) == 0 && len(skipped) == 0 {
+		return
+	}
+	var cost float64
+	for _, s := range seconds {
+		cost += s
+	}
+	logSummary(log, "%s.warm.tables[%d].cost[%.2fsec].skipped[%d]", action, len(seconds), cost, len(skipped))
+}
+
+// warmTable runs the warmQueries of a restored table.
+func warmTable(conn *Connection, args *LoadArgs, schema *schemaFile) error {
+	for _, query := range warmQueries(schema.db, args.targetTable(schema.table), schema.sql) {
+		if _, err := conn.Fetch(query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
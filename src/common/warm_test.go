@@ -0,0 +1,155 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/XeLabs/go-mysqlstack/driver"
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmQueries(t *testing.T) {
+	// The primary key, then the secondary indexes but the FULLTEXT one.
+	{
+		schema := "CREATE TABLE `t1` (`a` int NOT NULL,`b` varchar(100) DEFAULT 'KEY `x`',`c` text," +
+			"PRIMARY KEY (`a`),UNIQUE KEY `ub` (`b`),KEY `ab` (`a`,`b`(10)),FULLTEXT KEY `fc` (`c`)) ENGINE=InnoDB"
+		assert.Equal(t, []string{
+			"SELECT COUNT(*) FROM `test`.`t1` FORCE INDEX(PRIMARY)",
+			"SELECT COUNT(*) FROM `test`.`t1` FORCE INDEX(`ub`)",
+			"SELECT COUNT(*) FROM `test`.`t1` FORCE INDEX(`ab`)",
+		}, warmQueries("test", "t1", schema))
+	}
+
+	// An inline primary key.
+	{
+		schema := "CREATE TABLE `t2` (`a` int NOT NULL PRIMARY KEY,`b` int)"
+		assert.Equal(t, []string{"SELECT COUNT(*) FROM `test`.`t2` FORCE INDEX(PRIMARY)"}, warmQueries("test", "t2", schema))
+	}
+
+	// No primary key.
+	{
+		schema := "CREATE TABLE `t3` (`a` int,`b` int,INDEX `b` (`b`))"
+		assert.Equal(t, []string{
+			"SELECT COUNT(*) FROM `test`.`t3`",
+			"SELECT COUNT(*) FROM `test`.`t3` FORCE INDEX(`b`)",
+		}, warmQueries("test", "t3", schema))
+	}
+}
+
+func TestWarmSkipPhase(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+	m := newMetrics(log, "load", nil, new(uint64), nil)
+	assert.False(t, m.skipPhase("data"))
+	assert.True(t, m.skipPhase(warmPhase))
+	assert.True(t, m.skipPhase(warmPhase))
+	select {
+	case <-m.skipped(warmPhase):
+	default:
+		t.Fatal("warm.not.skipped")
+	}
+
+	var nilMetrics *Metrics
+	assert.Nil(t, nilMetrics.skipped(warmPhase))
+}
+
+func TestLoaderWarmTables(t *testing.T) {
+	log := xlog.NewStdLog(xlog.Level(xlog.DEBUG))
+	fakedbs := driver.NewTestHandler(log)
+	server, err := driver.MockMysqlServer(log, fakedbs)
+	assert.Nil(t, err)
+	defer server.Close()
+	address := server.Addr()
+
+	dir := "/tmp/warmtest"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	x = WriteFile(dir+"/test-schema-create.sql", "CREATE DATABASE IF NOT EXISTS `test`")
+	AssertNil(x)
+	for _, table := range []string{"t1", "t2"} {
+		x = WriteFile(dir+"/test."+table+"-schema.sql", "CREATE TABLE `"+table+"` (`a` int NOT NULL,PRIMARY KEY (`a`)) ENGINE=InnoDB")
+		AssertNil(x)
+		x = WriteFile(dir+"/test."+table+".00001.sql", "INSERT INTO `"+table+"` VALUES (1);\n")
+		AssertNil(x)
+	}
+
+	countResult := &sqltypes.Result{
+		Fields: []*querypb.Field{
+			{
+				Name: "COUNT(*)",
+				Type: querypb.Type_INT64,
+			},
+		},
+		Rows: [][]sqltypes.Value{
+			{
+				sqltypes.MakeTrusted(querypb.Type_INT64, []byte("1")),
+			},
+		},
+	}
+
+	// fakedbs.
+	{
+		fakedbs.AddQueryPattern("use .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("create .*", &sqltypes.Result{})
+		fakedbs.AddQueryPattern("insert into .*", &sqltypes.Result{})
+		fakedbs.AddQuery("select count(*) from `test`.`t1` force index(primary)", countResult)
+		fakedbs.AddQueryDelay("select count(*) from `test`.`t2` force index(primary)", countResult, 2000)
+	}
+
+	args := LoadArgs{
+		Outdir:      dir,
+		User:        "mock",
+		Password:    "mock",
+		Threads:     4,
+		Address:     address,
+		IntervalMs:  500,
+		WarmTables:  []string{"test.t1", "test.t9"},
+		WarmThreads: 2,
+	}
+
+	// The tables of the dump are warmed, the others are a warning.
+	{
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, RunOK, report.Status)
+		_, ok := report.WarmSeconds["test.t1"]
+		assert.True(t, ok)
+		assert.Equal(t, 1, len(report.WarmSeconds))
+		assert.Nil(t, report.WarmSkipped)
+		_, ok = report.PhaseSeconds[warmPhase]
+		assert.True(t, ok)
+	}
+
+	// Skipped while it runs.
+	{
+		pool, err := NewPool(log, 2, address, "mock", "mock")
+		assert.Nil(t, err)
+		defer pool.Close()
+		args := args
+		args.WarmTables = []string{"test.t2", "test.t1"}
+		args.WarmThreads = 1
+		args.metrics = newMetrics(log, "load", pool, new(uint64), nil)
+		time.AfterFunc(100*time.Millisecond, func() { args.metrics.skipPhase(warmPhase) })
+		start := time.Now()
+		err = warmTables(context.Background(), log, pool, &args, []string{dir + "/test.t1-schema.sql", dir + "/test.t2-schema.sql"})
+		assert.Nil(t, err)
+		assert.True(t, time.Since(start) < time.Second)
+		report := args.metrics.report(nil)
+		assert.Nil(t, report.WarmSeconds)
+		assert.Equal(t, []string{"test.t2", "test.t1"}, report.WarmSkipped)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+// TableWarnings are the warnings of the data statements of a table of a
+// load with LoadArgs.CaptureWarnings.
+type TableWarnings struct {
+	Total uint64 `json:"total"`
+	// Counts count them by level and code, like 'Warning 1265'.
+	Counts map[string]uint64 `json:"counts"`
+	// Messages are the first LoadArgs.WarningMessages of them, with their
+	// file and offset.
+	Messages []string `json:"messages,omitempty"`
+}
+
+// warningUnlisted is the kind of the warnings SHOW WARNINGS doesn't list,
+// past the max_error_count of the session.
+const warningUnlisted = "Unlisted"
+
+// captureWarnings reads the warnings of the data statement of table at offset
+// just executed on conn and counts them by level and code, see
+// LoadArgs.CaptureWarnings. The first warning of a code is logged for every
+// table, the next ones are only counted. A failed SHOW WARNINGS is logged and
+// the restore goes on. With LoadArgs.WarningsAsErrors it fails the file once
+// the warnings of its table are over the LoadArgs.WarningsThreshold. The
+// warnings are counted with @@warning_count, the ones SHOW WARNINGS doesn't
+// list as warningUnlisted.
+func captureWarnings(log *xlog.Log, conn *Connection, args *LoadArgs, table string, offset int) error {
+	qr, err := conn.Fetch("SHOW WARNINGS")
+	if err != nil {
+		log.Warning("restoring.file[%s].offset[%d].show.warnings.error:%v", table, offset, err)
+		return nil
+	}
+	messages := args.WarningMessages
+	if messages == 0 {
+		messages = 5
+	}
+	db, tbl, _, _ := ParseTableFile(table)
+	var total, listed uint64
+	var last []string
+	for _, row := range qr.Rows {
+		if len(row) < 3 {
+			continue
+		}
+		listed++
+		kind := row[0].String() + " " + row[1].String()
+		message := fmt.Sprintf("file[%s].offset[%d].warning[%s]:%s", table, offset, kind, row[2].String())
+		var first bool
+		if first, total = args.metrics.statementWarning(db+"."+tbl, kind, message, messages); first {
+			log.Warning("restoring.%s", message)
+		}
+		last = []string{kind, row[2].String()}
+	}
+	if count := warningCount(conn); count > listed {
+		total = args.metrics.unlistedWarnings(db+"."+tbl, count-listed)
+		if last == nil {
+			last = []string{warningUnlisted, fmt.Sprintf("%d warnings over max_error_count", count-listed)}
+		}
+	}
+	if args.WarningsAsErrors && last != nil && total > uint64(args.WarningsThreshold) {
+		return &CategorizedError{Category: CategoryData, Err: fmt.Errorf("restoring.file[%s].offset[%d].warnings.of.table[%d].over.threshold[%d]:%s %s",
+			table, offset, total, args.WarningsThreshold, last[0], last[1])}
+	}
+	return nil
+}
+
+// warningCount returns the @@warning_count of the last statement of conn,
+// 0 if it can't be read.
+func warningCount(conn *Connection) uint64 {
+	qr, err := conn.Fetch("SELECT @@warning_count")
+	if err != nil || len(qr.Rows) == 0 || len(qr.Rows[0]) == 0 {
+		return 0
+	}
+	n, _ := strconv.ParseUint(qr.Rows[0][0].String(), 10, 64)
+	return n
+}
+
+// logWarningSummary logs the summary line of the warnings of a load by level
+// and code, the most frequent first, then the lines of every table with its
+// messages kept, none if it had none.
+func logWarningSummary(log *xlog.Log, action string, warnings map[string]uint64, tables map[string]TableWarnings) {
+	if len(warnings) == 0 {
+		return
+	}
+	total, kinds := countsByKind(warnings)
+	logSummary(log, "%s.warnings[%d].by.type[%s]", action, total, kinds)
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+	for _, table := range names {
+		total, kinds := countsByKind(tables[table].Counts)
+		logSummary(log, "%s.warnings.table[%s][%d].by.type[%s]", action, table, total, kinds)
+		for _, message := range tables[table].Messages {
+			logSummary(log, "%s.warnings.table[%s].%s", action, table, message)
+		}
+	}
+}
+
+// countsByKind returns the sum of counts and the counts as 'kind:n,...', the
+// most frequent first.
+func countsByKind(counts map[string]uint64) (uint64, string) {
+	kinds := make([]string, 0, len(counts))
+	var total uint64
+	for kind, n := range counts {
+		kinds = append(kinds, kind)
+		total += n
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if counts[kinds[i]] != counts[kinds[j]] {
+			return counts[kinds[i]] > counts[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%s:%d", kind, counts[kind])
+	}
+	return total, strings.Join(parts, ",")
+}
@@ -0,0 +1,171 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	querypb "github.com/XeLabs/go-mysqlstack/sqlparser/depends/query"
+	"github.com/XeLabs/go-mysqlstack/sqlparser/depends/sqltypes"
+	"github.com/XeLabs/go-mysqlstack/xlog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoaderCaptureWarnings(t *testing.T) {
+	dir := "/tmp/loadercapturewarnings"
+	os.RemoveAll(dir)
+	x := os.MkdirAll(dir, 0777)
+	AssertNil(x)
+	for name, sql := range map[string]string{
+		"test-schema-create.sql": "CREATE DATABASE IF NOT EXISTS `test`;",
+		"test.t1-schema.sql":     "CREATE TABLE `t1` (`a` int, `b` varchar(4)) ENGINE=InnoDB;\n",
+		"test.t1.00001.sql":      "INSERT INTO `t1` VALUES (1,'long'),(2,'longer');\nINSERT INTO `t1` VALUES (3,'longest'),(4,'x');\n",
+		"test.t2-schema.sql":     "CREATE TABLE `t2` (`a` int, `b` varchar(4)) ENGINE=InnoDB;\n",
+		"test.t2.00001.sql":      "INSERT INTO `t2` VALUES (1,'longer'),(2,'longest');\n",
+	} {
+		x := WriteFile(dir+"/"+name, sql)
+		AssertNil(x)
+	}
+	row := func(level, code, message string) []sqltypes.Value {
+		return []sqltypes.Value{
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(level)),
+			sqltypes.MakeTrusted(querypb.Type_UINT32, []byte(code)),
+			sqltypes.MakeTrusted(querypb.Type_VARCHAR, []byte(message)),
+		}
+	}
+	warnings := &sqltypes.Result{
+		Fields: []*querypb.Field{{Name: "Level"}, {Name: "Code"}, {Name: "Message"}},
+		Rows: [][]sqltypes.Value{
+			row("Warning", "1265", "Data truncated for column 'b' at row 1"),
+			row("Warning", "1265", "Data truncated for column 'b' at row 2"),
+			row("Note", "1592", "Unsafe statement written to the binary log"),
+		},
+	}
+	args := LoadArgs{Outdir: dir, User: "mock", Password: "mock", Address: "127.0.0.1:3306", Threads: 1, IntervalMs: 500}
+
+	// Every data statement is followed by a SHOW WARNINGS, the first warning
+	// of a code is logged per table, all are counted.
+	{
+		buf := &bytes.Buffer{}
+		log := xlog.NewXLog(buf, xlog.Level(xlog.INFO))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"SHOW WARNINGS": warnings}}
+		args := args
+		args.CaptureWarnings = true
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]uint64{"Warning 1265": 6, "Note 1592": 3}, report.Warnings)
+		for i, query := range rec.queries {
+			if strings.HasPrefix(query, "INSERT") {
+				assert.Equal(t, "SHOW WARNINGS", rec.queries[i+1])
+			}
+		}
+		assert.Equal(t, 2, strings.Count(buf.String(), "].warning[Warning 1265]:Data truncated for column 'b' at row 1"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.file[test.t2.00001.sql].offset[0].warning[Note 1592]:Unsafe statement"), buf.String())
+		assert.False(t, strings.Contains(buf.String(), "at row 2"), buf.String())
+
+		// By table, with their first messages.
+		assert.Equal(t, TableWarnings{
+			Total:  6,
+			Counts: map[string]uint64{"Warning 1265": 4, "Note 1592": 2},
+			Messages: []string{
+				"file[test.t1.00001.sql].offset[0].warning[Warning 1265]:Data truncated for column 'b' at row 1",
+				"file[test.t1.00001.sql].offset[0].warning[Warning 1265]:Data truncated for column 'b' at row 2",
+				"file[test.t1.00001.sql].offset[0].warning[Note 1592]:Unsafe statement written to the binary log",
+				"file[test.t1.00001.sql].offset[49].warning[Warning 1265]:Data truncated for column 'b' at row 1",
+				"file[test.t1.00001.sql].offset[49].warning[Warning 1265]:Data truncated for column 'b' at row 2",
+			},
+		}, report.TableWarnings["test.t1"])
+		assert.Equal(t, uint64(3), report.TableWarnings["test.t2"].Total)
+
+		LogReport(log, report)
+		assert.True(t, strings.Contains(buf.String(), "restoring.warnings[9].by.type[Warning 1265:6,Note 1592:3]"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.warnings.table[test.t1][6].by.type[Warning 1265:4,Note 1592:2]"), buf.String())
+		assert.True(t, strings.Contains(buf.String(), "restoring.warnings.table[test.t2].file[test.t2.00001.sql].offset[0].warning[Note 1592]:Unsafe"), buf.String())
+	}
+
+	// Fewer messages kept.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"SHOW WARNINGS": warnings}}
+		args := args
+		args.CaptureWarnings = true
+		args.WarningMessages = 1
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"file[test.t1.00001.sql].offset[0].warning[Warning 1265]:Data truncated for column 'b' at row 1"}, report.TableWarnings["test.t1"].Messages)
+	}
+
+	// Warnings as errors: the file bringing the warnings of its table over
+	// the threshold fails, at the statement which does.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"SHOW WARNINGS": warnings}}
+		args := args
+		args.CaptureWarnings = true
+		args.WarningsAsErrors = true
+		args.WarningsThreshold = 3
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, CategoryData, ErrorCategoryOf(err))
+		assert.True(t, strings.Contains(err.Error(), "restoring.file[test.t1.00001.sql].offset[49].warnings.of.table[6].over.threshold[3]:Note 1592 Unsafe statement"), err.Error())
+		assert.Equal(t, uint64(1), report.FilesFailed)
+
+		// The first warning with no threshold.
+		args.WarningsThreshold = 0
+		report, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), ".offset[0].warnings.of.table[3].over.threshold[0]:"), err.Error())
+		assert.Equal(t, uint64(1), report.FilesFailed)
+	}
+
+	// SHOW WARNINGS lists up to max_error_count of them, @@warning_count
+	// counts the others, the threshold too.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.PANIC))
+		count := &sqltypes.Result{
+			Fields: []*querypb.Field{{Name: "@@warning_count"}},
+			Rows:   [][]sqltypes.Value{{sqltypes.MakeTrusted(querypb.Type_UINT64, []byte("1003"))}},
+		}
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"SHOW WARNINGS": warnings, "SELECT @@warning_count": count}}
+		args := args
+		args.CaptureWarnings = true
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]uint64{"Warning 1265": 6, "Note 1592": 3, warningUnlisted: 3000}, report.Warnings)
+		assert.Equal(t, uint64(2006), report.TableWarnings["test.t1"].Total)
+		assert.Equal(t, uint64(2000), report.TableWarnings["test.t1"].Counts[warningUnlisted])
+
+		args.WarningsAsErrors = true
+		args.WarningsThreshold = 1000
+		_, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), ".offset[0].warnings.of.table[1003].over.threshold[1000]:"), err.Error())
+
+		// None listed.
+		rec = &recordingExecutor{results: map[string]*sqltypes.Result{"SELECT @@warning_count": count}}
+		_, err = NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), ".warnings.of.table[1003].over.threshold[1000]:Unlisted 1003 warnings over max_error_count"), err.Error())
+	}
+
+	// Off by default.
+	{
+		log := xlog.NewStdLog(xlog.Level(xlog.ERROR))
+		rec := &recordingExecutor{results: map[string]*sqltypes.Result{"SHOW WARNINGS": warnings}}
+		report, err := NewLoader(LoadConfig{LoadArgs: args, Log: log, Executor: rec.executor}).Run(context.Background())
+		assert.Nil(t, err)
+		assert.Nil(t, report.Warnings)
+		assert.NotContains(t, rec.queries, "SHOW WARNINGS")
+	}
+}
@@ -0,0 +1,25 @@
+/*
+ * go-mydumper
+ * xelabs.org
+ *
+ * Copyright (c) XeLabs
+ * GPL License
+ *
+ */
+
+package main
+
+import (
+	"cli"
+	"os"
+
+	"github.com/XeLabs/go-mysqlstack/xlog"
+)
+
+var (
+	log = xlog.NewStdLog(xlog.Level(xlog.INFO))
+)
+
+func main() {
+	os.Exit(cli.Main(log, "go-mydumper", os.Args[1:]))
+}
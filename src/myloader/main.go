@@ -10,51 +10,18 @@
 package main
 
 import (
-	"common"
-	"flag"
-	"fmt"
+	"cli"
 	"os"
 
 	"github.com/XeLabs/go-mysqlstack/xlog"
 )
 
 var (
-	flag_port, flag_threads                     int
-	flag_user, flag_passwd, flag_host, flag_dir string
-
 	log = xlog.NewStdLog(xlog.Level(xlog.INFO))
 )
 
-func init() {
-	flag.StringVar(&flag_user, "u", "", "Username with privileges to run the loader")
-	flag.StringVar(&flag_passwd, "p", "", "User password")
-	flag.StringVar(&flag_host, "h", "", "The host to connect to")
-	flag.IntVar(&flag_port, "P", 3306, "TCP/IP port to connect to")
-	flag.StringVar(&flag_dir, "d", "", "Directory of the dump to import")
-	flag.IntVar(&flag_threads, "t", 16, "Number of threads to use")
-}
-
-func usage() {
-	fmt.Println("Usage: " + os.Args[0] + " -h [HOST] -P [PORT] -u [USER] -p [PASSWORD] -d  [DIR]")
-	flag.PrintDefaults()
-}
-
+// Deprecated: myloader is a shim kept for one release, use 'go-mydumper load'.
 func main() {
-	flag.Usage = func() { usage() }
-	flag.Parse()
-
-	if flag_host == "" || flag_user == "" || flag_passwd == "" || flag_dir == "" {
-		usage()
-		os.Exit(0)
-	}
-
-	args := &common.Args{
-		User:       flag_user,
-		Password:   flag_passwd,
-		Address:    fmt.Sprintf("%s:%d", flag_host, flag_port),
-		Outdir:     flag_dir,
-		Threads:    flag_threads,
-		IntervalMs: 10 * 1000,
-	}
-	common.Loader(log, args)
+	log.Warning("myloader.is.deprecated.and.will.be.removed.in.the.next.release.use['go-mydumper load']")
+	os.Exit(cli.Main(log, "go-mydumper", append([]string{"load"}, os.Args[1:]...)))
 }